@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestServeMultiplexed_GRPCAndHTTPShareOnePort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	httpServer := &http.Server{Handler: mux}
+
+	go serveMultiplexed(listener, grpcServer, httpServer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// gRPC
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// HTTP/1.1
+	httpResp, err := http.Get("http://" + addr + "/health")
+	require.NoError(t, err)
+	body, err := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+
+	// Both drain and stop
+	grpcServer.GracefulStop()
+	require.NoError(t, httpServer.Shutdown(ctx))
+}
+
+func TestKeepaliveOptions_EnforcesMinPingInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		minTime    time.Duration
+		gap        time.Duration
+		wantGoAway bool
+	}{
+		// grpc's default MinTime (5m) would reject these pings too, so the
+		// lenient case is what shows cfg is applied.
+		{name: "pings within policy", minTime: time.Millisecond, gap: 20 * time.Millisecond, wantGoAway: false},
+		{name: "pings too often", minTime: time.Hour, gap: 0, wantGoAway: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				KeepaliveTime:                time.Hour,
+				KeepaliveTimeout:             time.Minute,
+				KeepaliveMinTime:             tt.minTime,
+				KeepalivePermitWithoutStream: true,
+			}
+			server := grpc.NewServer(keepaliveOptions(cfg)...)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			go server.Serve(listener)
+			defer server.Stop()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			_, err = io.WriteString(conn, http2.ClientPreface)
+			require.NoError(t, err)
+			framer := http2.NewFramer(conn, conn)
+			require.NoError(t, framer.WriteSettings())
+
+			// The server acks every ping, but sends GOAWAY after the third
+			// that breaks the policy.
+			const pings = 5
+			acks := 0
+			go func() {
+				for i := 0; i < pings; i++ {
+					time.Sleep(tt.gap)
+					framer.WritePing(false, [8]byte{byte(i)})
+				}
+			}()
+			for acks < pings {
+				frame, err := framer.ReadFrame()
+				require.NoError(t, err)
+				switch f := frame.(type) {
+				case *http2.GoAwayFrame:
+					require.True(t, tt.wantGoAway, "unexpected GOAWAY: %s", f.DebugData())
+					assert.Equal(t, http2.ErrCodeEnhanceYourCalm, f.ErrCode)
+					assert.Equal(t, "too_many_pings", string(f.DebugData()))
+					return
+				case *http2.PingFrame:
+					if f.IsAck() {
+						acks++
+					}
+				}
+			}
+			assert.False(t, tt.wantGoAway, "server acked every ping without GOAWAY")
+		})
+	}
+}
+
+// startShutdownTestServers serves an empty gRPC server and handler, counted
+// by inFlight, and returns the HTTP server's address.
+func startShutdownTestServers(t *testing.T, handler http.Handler, inFlight *inFlightRequests) (*grpc.Server, *http.Server, string) {
+	t.Helper()
+
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(inFlight.UnaryServerInterceptor()))
+	go grpcServer.Serve(grpcListener)
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: inFlight.Middleware(handler)}
+	go httpServer.Serve(httpListener)
+
+	return grpcServer, httpServer, httpListener.Addr().String()
+}
+
+func TestShutdownServers_WaitsForInFlightRequest(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finalized"))
+	})
+	inFlight := &inFlightRequests{}
+	grpcServer, httpServer, addr := startShutdownTestServers(t, handler, inFlight)
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/v1/requests/finalize", "application/json", nil)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	var logs bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownServers(ctx, grpcServer, httpServer, inFlight, zerolog.New(&logs))
+
+	// The slow request finished before shutdown returned
+	select {
+	case res := <-done:
+		require.NoError(t, res.err)
+		assert.Equal(t, "finalized", res.body)
+	default:
+		t.Fatal("shutdown returned before the in-flight request completed")
+	}
+	assert.NotContains(t, logs.String(), "deadline reached")
+
+	// And no new connections are accepted
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err)
+}
+
+func TestShutdownServers_LogsRequestsInFlightAtDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	inFlight := &inFlightRequests{}
+	grpcServer, httpServer, addr := startShutdownTestServers(t, handler, inFlight)
+
+	go http.Get("http://" + addr + "/")
+	<-started
+
+	var logs bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdownServers(ctx, grpcServer, httpServer, inFlight, zerolog.New(&logs))
+
+	assert.Contains(t, logs.String(), `"http_in_flight":1`)
+	assert.Contains(t, logs.String(), `"grpc_in_flight":0`)
+}
@@ -8,7 +8,7 @@ import (
 	"os"
 	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func main() {
@@ -42,6 +42,19 @@ func main() {
 
 	fmt.Println("Connected to DB")
 
+	// Migrate and seed into PG_SCHEMA if set. One connection, so the
+	// search_path set here applies to every statement below
+	if schema := os.Getenv("PG_SCHEMA"); schema != "" {
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema)); err != nil {
+			log.Fatal("Create schema failed:", err)
+		}
+		if _, err := db.Exec("SET search_path TO " + pq.QuoteIdentifier(schema) + ", public"); err != nil {
+			log.Fatal("Set search_path failed:", err)
+		}
+		fmt.Printf("Using schema %s\n", schema)
+	}
+
 	// 1. Run Migrations
 	fmt.Println("Running migrations...")
 	migrationFile, err := ioutil.ReadFile("../../migrations/001_initial_schema.up.sql")
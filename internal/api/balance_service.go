@@ -25,15 +25,44 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"strings"
 	"time"
 
+	"github.com/Beam/backend/internal/audit"
 	"github.com/Beam/backend/internal/auth"
 	"github.com/Beam/backend/internal/ledger"
+	"github.com/Beam/backend/internal/tokenizer"
 	pb "github.com/Beam/backend/pkg/proto/balance/v1"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxBatchFinalizeSize bounds a BatchFinalize call so one caller can't
+// monopolize Redis with a single giant pipeline.
+const maxBatchFinalizeSize = 1000
+
+// maxEndUserIDLength is the size of requests.end_user_id.
+const maxEndUserIDLength = 255
+
+// Buffer multipliers (CheckBalanceRequest.buffer_multiplier).
+const (
+	// DefaultBufferMultiplier applies when a request sends none.
+	DefaultBufferMultiplier = 1.2
+
+	// DefaultMaxBufferMultiplier is the largest multiplier accepted unless
+	// WithMaxBufferMultiplier says otherwise.
+	DefaultMaxBufferMultiplier = 10.0
+
+	// bufferMultiplierScale is the multiplier's precision: it is rounded to
+	// 6 decimal places and applied in integer arithmetic, so the same
+	// estimate and multiplier always reserve the same grains.
+	bufferMultiplierScale = 1_000_000
 )
 
 // BalanceService implements the gRPC BalanceService interface.
@@ -44,17 +73,149 @@ type BalanceService struct {
 	pb.UnimplementedBalanceServiceServer
 
 	ledger *ledger.Ledger
-	auth   *auth.Authenticator
+	auth   auth.Authenticator
 	log    zerolog.Logger
+
+	// hotLog is used for per-call debug logs in CheckBalance and DeductTokens.
+	// See WithLogSampleRate.
+	hotLog zerolog.Logger
+
+	// maxReservationGrains caps a single reservation (0 = uncapped).
+	// Customers may override it via ledger.CustomerConfig.
+	maxReservationGrains int64
+
+	// tokenizer counts prompt tokens server-side when a request includes
+	// the raw prompt. Nil means client counts are used as sent.
+	tokenizer tokenizer.Tokenizer
+
+	// maxBufferMultiplier is the largest buffer_multiplier accepted
+	// (0 = DefaultMaxBufferMultiplier).
+	maxBufferMultiplier float64
+
+	// bufferStrategy picks the multiplier of requests that send none.
+	bufferStrategy BufferStrategy
+
+	// maxCustomProperties and maxCustomPropertyBytes cap a reservation's
+	// custom_properties (0 = DefaultMaxCustomProperties and
+	// DefaultMaxCustomPropertyBytes). Over the cap, the request is rejected
+	// unless truncateCustomProperties is set.
+	maxCustomProperties      int
+	maxCustomPropertyBytes   int
+	truncateCustomProperties bool
+
+	// downgradeBelowGrains and killBelowGrains are the remaining balances
+	// under which DeductTokens suggests downgrading or killing the stream
+	// (0 = never, see WithSuggestedActionThresholds).
+	downgradeBelowGrains int64
+	killBelowGrains      int64
+
+	// recordAdminAction writes the audit row for an admin RPC. Defaults to
+	// the ledger's RecordAdminAction.
+	recordAdminAction func(ctx context.Context, a ledger.AdminAction) error
+
+	// auditLog, if set, also receives admin calls and refused admin calls
+	// (see WithAuditLogger)
+	auditLog *audit.Logger
+}
+
+// Option configures optional BalanceService behaviour.
+type Option func(*BalanceService)
+
+// WithLogSampleRate emits only 1 in every n hot-path debug log lines.
+// Warn and error logs are never sampled. Values of 0 or 1 disable sampling.
+func WithLogSampleRate(n uint32) Option {
+	return func(s *BalanceService) {
+		if n <= 1 {
+			return
+		}
+		s.hotLog = s.log.Sample(zerolog.LevelSampler{
+			DebugSampler: &zerolog.BasicSampler{N: n},
+		})
+	}
+}
+
+// WithMaxReservationGrains rejects any single reservation larger than n
+// grains, unless the customer has their own cap configured. This stops a
+// client bug sending an enormous estimate from locking a customer's whole
+// balance behind one request. Zero disables the server-wide cap.
+func WithMaxReservationGrains(n int64) Option {
+	return func(s *BalanceService) {
+		s.maxReservationGrains = n
+	}
+}
+
+// WithTokenizer verifies client-reported prompt token counts against t
+// whenever CheckBalance is sent the raw prompt.
+func WithTokenizer(t tokenizer.Tokenizer) Option {
+	return func(s *BalanceService) {
+		s.tokenizer = t
+	}
+}
+
+// WithMaxBufferMultiplier sets the largest buffer_multiplier CheckBalance
+// accepts. Values below 1 are ignored.
+func WithMaxBufferMultiplier(m float64) Option {
+	return func(s *BalanceService) {
+		if m >= 1 {
+			s.maxBufferMultiplier = m
+		}
+	}
+}
+
+// WithCustomPropertyLimits caps how many custom_properties a CheckBalance
+// may send and their total size in bytes (keys plus values). Zero keeps the
+// default for that limit.
+func WithCustomPropertyLimits(maxCount, maxBytes int) Option {
+	return func(s *BalanceService) {
+		s.maxCustomProperties = maxCount
+		s.maxCustomPropertyBytes = maxBytes
+	}
+}
+
+// WithTruncateCustomProperties drops the custom_properties over the limits
+// instead of rejecting the request with InvalidArgument.
+func WithTruncateCustomProperties(truncate bool) Option {
+	return func(s *BalanceService) {
+		s.truncateCustomProperties = truncate
+	}
+}
+
+// WithSuggestedActionThresholds makes DeductTokens suggest downgrading to a
+// cheaper model once the remaining balance drops below downgradeBelow
+// grains, and killing the stream below killBelow. Zero disables that
+// suggestion; a failed deduction always suggests a kill.
+func WithSuggestedActionThresholds(downgradeBelow, killBelow int64) Option {
+	return func(s *BalanceService) {
+		s.downgradeBelowGrains = downgradeBelow
+		s.killBelowGrains = killBelow
+	}
+}
+
+// WithAuditLogger records every admin RPC in the security audit trail as
+// well as admin_audit, and refuses the call if it can't be. Calls refused
+// for lack of the admin scope are recorded too, subject to its rate limit.
+func WithAuditLogger(l *audit.Logger) Option {
+	return func(s *BalanceService) {
+		s.auditLog = l
+	}
 }
 
 // NewBalanceService creates a new BalanceService instance.
-func NewBalanceService(l *ledger.Ledger, a *auth.Authenticator, logger zerolog.Logger) *BalanceService {
-	return &BalanceService{
+func NewBalanceService(l *ledger.Ledger, a auth.Authenticator, logger zerolog.Logger, opts ...Option) *BalanceService {
+	s := &BalanceService{
 		ledger: l,
 		auth:   a,
 		log:    logger.With().Str("component", "balance_service").Logger(),
 	}
+	s.hotLog = s.log
+	s.recordAdminAction = l.RecordAdminAction
+	s.bufferStrategy = FlatBufferStrategy(DefaultBufferMultiplier)
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 // CheckBalance implements the CheckBalance RPC method.
@@ -74,6 +235,7 @@ func NewBalanceService(l *ledger.Ledger, a *auth.Authenticator, logger zerolog.L
 // Performance: Target < 5ms, typically achieves 2-4ms
 func (s *BalanceService) CheckBalance(ctx context.Context, req *pb.CheckBalanceRequest) (*pb.CheckBalanceResponse, error) {
 	start := time.Now()
+	defer recordTotalTime(ctx, start)
 
 	// Extract API key from request metadata and validate
 	platformUserID, err := s.auth.ValidateAPIKey(ctx)
@@ -82,74 +244,194 @@ func (s *BalanceService) CheckBalance(ctx context.Context, req *pb.CheckBalanceR
 		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
 	}
 
+	reservation, err := s.prepareReservation(ctx, platformUserID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Call ledger to check and reserve balance
+	ledgerStart := time.Now()
+	result, err := s.ledger.CheckAndReserveBalance(ctx, reservation)
+	addRedisTime(ctx, ledgerStart)
+	if err != nil {
+		return nil, s.reserveError(req, err)
+	}
+
+	return s.checkBalanceResponse(req, reservation, result, start)
+}
+
+// prepareReservation validates a CheckBalance request and works out the
+// reservation to make for it.
+func (s *BalanceService) prepareReservation(ctx context.Context, platformUserID string, req *pb.CheckBalanceRequest) (ledger.ReservationRequest, error) {
 	// Log request for debugging (at debug level to avoid log spam)
-	s.log.Debug().
+	s.hotLog.Debug().
 		Str("platform_user_id", platformUserID).
 		Str("customer_id", req.CustomerId).
 		Str("request_id", req.RequestId).
 		Int64("estimated_grains", req.EstimatedGrains).
-		Float64("buffer_multiplier", req.BufferMultiplier).
+		Float64("buffer_multiplier", req.GetBufferMultiplier()).
 		Msg("check_balance request received")
 
 	// Validate request parameters
 	if req.CustomerId == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "customer_id is required")
 	}
 
 	if req.RequestId == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "request_id is required")
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "request_id is required")
 	}
 
 	if req.EstimatedGrains <= 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "estimated_grains must be positive")
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "estimated_grains must be positive")
+	}
+
+	priority, ok := requestPriorityString(req.Priority)
+	if !ok {
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "invalid priority")
+	}
+
+	endUserID := req.GetMetadata().GetEndUserId()
+	if len(endUserID) > maxEndUserIDLength {
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "end_user_id must be at most %d characters", maxEndUserIDLength)
 	}
 
 	// Apply buffer multiplier
-	// If not provided, we should fetch customer's configured default
-	// For now, default to conservative (1.2)
-	bufferMultiplier := req.BufferMultiplier
-	if bufferMultiplier == 0 {
-		bufferMultiplier = 1.2 // Conservative default
+	bufferMultiplier, err := s.bufferMultiplier(req)
+	if err != nil {
+		return ledger.ReservationRequest{}, err
+	}
+
+	customProperties, err := s.limitCustomProperties(req)
+	if err != nil {
+		return ledger.ReservationRequest{}, err
+	}
+
+	customerCfg, err := s.ledger.GetCustomerConfig(ctx, req.CustomerId)
+	if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to load customer config")
+		return ledger.ReservationRequest{}, ledgerError(err, "failed to check balance")
+	}
+
+	// Don't let an understated prompt token count shrink the reservation
+	estimatedGrains := req.EstimatedGrains
+	var promptTokens int32
+	var pricing *ledger.PricingInfo
+	if req.Metadata != nil {
+		promptTokens = s.verifyPromptTokens(req)
+		pricing = s.reservationPricing(platformUserID, req.Metadata.Model, customerCfg.Currency)
+		if floor := promptCostFloor(pricing, promptTokens); floor > estimatedGrains {
+			estimatedGrains = floor
+		}
 	}
 
 	// Calculate final reservation amount
-	reservedGrains := int64(float64(req.EstimatedGrains) * bufferMultiplier)
+	reservedGrains, err := bufferedReservation(estimatedGrains, bufferMultiplier)
+	if err != nil {
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// Enforce the per-reservation cap before touching the balance
+
+	if limit := customerCfg.ReservationCap(s.maxReservationGrains); limit > 0 && reservedGrains > limit {
+		s.log.Warn().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Int64("reserved_grains", reservedGrains).
+			Int64("max_reservation_grains", limit).
+			Msg("check_balance reservation exceeds cap")
+		return ledger.ReservationRequest{}, status.Errorf(codes.InvalidArgument,
+			"reservation of %d grains exceeds maximum of %d grains per request", reservedGrains, limit)
+	}
 
 	// Convert metadata to map for ledger
 	metadataMap := make(map[string]string)
 	if req.Metadata != nil {
 		metadataMap["model"] = req.Metadata.Model
 		metadataMap["max_tokens"] = fmt.Sprintf("%d", req.Metadata.MaxTokens)
-		metadataMap["prompt_tokens"] = fmt.Sprintf("%d", req.Metadata.PromptTokens)
+		metadataMap["prompt_tokens"] = fmt.Sprintf("%d", promptTokens)
 
 		// Include custom properties
-		for k, v := range req.Metadata.CustomProperties {
+		for k, v := range customProperties {
 			metadataMap[k] = v
 		}
 	}
 
-	// Call ledger to check and reserve balance
-	result, err := s.ledger.CheckAndReserveBalance(ctx, ledger.ReservationRequest{
+	var maxDeductions int64
+	if req.Metadata != nil {
+		maxDeductions = deductionCap(req.Metadata.MaxTokens)
+	}
+
+	return ledger.ReservationRequest{
 		CustomerID:      req.CustomerId,
 		RequestID:       req.RequestId,
 		ReservedGrains:  reservedGrains,
-		EstimatedGrains: req.EstimatedGrains,
+		EstimatedGrains: estimatedGrains,
 		Metadata:        metadataMap,
 		PlatformUserID:  platformUserID,
-	})
+		Currency:        customerCfg.Currency,
+		DryRun:          req.DryRun,
+		Pricing:         pricing,
+		Priority:        priority,
+		MaxDeductions:   maxDeductions,
+		EndUserID:       endUserID,
+		Tags:            customProperties,
+	}, nil
+}
 
-	if err != nil {
-		s.log.Error().Err(err).
+// reserveError translates a failed ledger reservation into a gRPC error.
+func (s *BalanceService) reserveError(req *pb.CheckBalanceRequest, err error) error {
+	s.log.Error().Err(err).
+		Str("customer_id", req.CustomerId).
+		Str("request_id", req.RequestId).
+		Msg("ledger check_and_reserve failed")
+	// With sync writes a failed write rolls the reservation back, so
+	// the client can safely retry once PostgreSQL recovers
+	if errors.Is(err, ledger.ErrWriteFailed) {
+		return retryableError(codes.Unavailable, s.ledger.WriteRetryDelay(), "failed to record reservation: %v", err)
+	}
+	return ledgerError(err, "failed to check balance")
+}
+
+// ledgerError translates a failed ledger call into a gRPC error by the kind
+// of failure, with msg saying what failed. Redis being unavailable is worth
+// retrying; a failed script, or anything unclassified, is Internal.
+func ledgerError(err error, msg string) error {
+	switch {
+	case errors.Is(err, ledger.ErrRedisUnavailable):
+		return retryableError(codes.Unavailable, redisRetryDelay, "%s: %v", msg, err)
+	case errors.Is(err, ledger.ErrCustomerNotFound):
+		return status.Errorf(codes.NotFound, "%s: %v", msg, err)
+	case errors.Is(err, ledger.ErrInsufficientBalance):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+// checkBalanceResponse builds the CheckBalance response for a reservation
+// the ledger made (or refused).
+func (s *BalanceService) checkBalanceResponse(req *pb.CheckBalanceRequest, reservation ledger.ReservationRequest, result *ledger.ReservationResult, start time.Time) (*pb.CheckBalanceResponse, error) {
+	// A duplicate request ID is not a balance problem, so don't report it as a
+	// plain rejection. If the caller owns this request (e.g. an SDK retry after
+	// a timeout), the original reservation is still held and they can treat
+	// this as idempotent success and continue with DeductTokens. The token is
+	// derived from the IDs alone, so the retry gets back the one the first
+	// call issued.
+	if result.RejectionReason == ledger.RejectionRequestExists {
+		s.log.Info().
 			Str("customer_id", req.CustomerId).
 			Str("request_id", req.RequestId).
-			Msg("ledger check_and_reserve failed")
-		return nil, status.Errorf(codes.Internal, "failed to check balance: %v", err)
+			Msg("check_balance duplicate request")
+		return nil, requestExistsError(req.RequestId, s.generateRequestToken(req.RequestId, req.CustomerId))
 	}
 
 	// Generate secure request token
 	// This token must be included in subsequent DeductTokens and FinalizeRequest calls
 	// It prevents replay attacks and ensures only approved requests can deduct grains
-	requestToken := s.generateRequestToken(req.RequestId, req.CustomerId)
+	// Dry runs hold nothing, so there is nothing for a token to authorize
+	var requestToken string
+	if !req.DryRun {
+		requestToken = s.generateRequestToken(req.RequestId, req.CustomerId)
+	}
 
 	// Build response
 	response := &pb.CheckBalanceResponse{
@@ -157,7 +439,15 @@ func (s *BalanceService) CheckBalance(ctx context.Context, req *pb.CheckBalanceR
 		RemainingBalance: result.RemainingBalance,
 		RequestToken:     requestToken,
 		RejectionReason:  result.RejectionReason,
-		ReservedGrains:   reservedGrains,
+		ReservedGrains:   reservation.ReservedGrains,
+		ShortfallGrains:  result.ShortfallGrains,
+		ReasonCode:       rejectionReasonCode(result),
+		Currency:         result.Currency,
+		PreemptedGrains:  result.PreemptedGrains,
+	}
+
+	if !result.Approved {
+		response.CurrentBalance = result.CurrentBalance
 	}
 
 	// Calculate and log duration
@@ -167,8 +457,10 @@ func (s *BalanceService) CheckBalance(ctx context.Context, req *pb.CheckBalanceR
 		s.log.Info().
 			Str("customer_id", req.CustomerId).
 			Str("request_id", req.RequestId).
-			Int64("reserved_grains", reservedGrains).
+			Int64("reserved_grains", reservation.ReservedGrains).
 			Int64("remaining_balance", result.RemainingBalance).
+			Str("priority", reservation.Priority).
+			Int64("preempted_grains", result.PreemptedGrains).
 			Dur("duration_ms", duration).
 			Msg("check_balance approved")
 	} else {
@@ -196,6 +488,16 @@ func (s *BalanceService) CheckBalance(ctx context.Context, req *pb.CheckBalanceR
 //
 // Performance: Target < 3ms, typically achieves 1-2ms
 func (s *BalanceService) DeductTokens(ctx context.Context, req *pb.DeductTokensRequest) (*pb.DeductTokensResponse, error) {
+	defer recordTotalTime(ctx, time.Now())
+
+	// Authenticate request
+	// Normally already done by the auth interceptor, in which case this
+	// costs nothing; it still guards callers that bypass gRPC (REST)
+	platformUserID, err := s.auth.ValidateAPIKey(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
 	// Validate request token
 	// This prevents unauthorized deductions from replayed or forged requests
 	if !s.validateRequestToken(req.RequestToken, req.RequestId, req.CustomerId) {
@@ -206,73 +508,145 @@ func (s *BalanceService) DeductTokens(ctx context.Context, req *pb.DeductTokensR
 		return nil, status.Errorf(codes.PermissionDenied, "invalid request token")
 	}
 
-	// Validate parameters
-	if req.TokensConsumed <= 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "tokens_consumed must be positive")
-	}
-
-	// Determine provider from model name
-	// Model names typically indicate the provider (e.g., "gpt-4" = openai, "claude-3" = anthropic)
-	provider := "openai" // Default
-	if len(req.Model) > 0 {
-		switch {
-		case req.Model[:3] == "gpt" || req.Model[:4] == "text" || req.Model[:3] == "ada":
-			provider = "openai"
-		case len(req.Model) >= 6 && req.Model[:6] == "claude":
-			provider = "anthropic"
-		case len(req.Model) >= 6 && req.Model[:6] == "gemini":
-			provider = "google"
-		}
+	if err := validateDeduction(req); err != nil {
+		return nil, err
 	}
 
-	// Calculate grain cost based on model pricing
-	pricing, err := s.ledger.GetModelPricing(req.Model, provider)
+	currency, err := s.ledger.CustomerCurrency(ctx, req.CustomerId)
 	if err != nil {
-		s.log.Error().Err(err).Str("model", req.Model).Msg("failed to get pricing")
-		return nil, status.Errorf(codes.Internal, "failed to get model pricing")
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to resolve customer currency")
+		return nil, ledgerError(err, "failed to deduct tokens")
 	}
 
-	// Calculate cost in grains
-	var costPerToken float64
-	if req.IsCompletion {
-		// Output tokens typically cost 2-3x more than input tokens
-		costPerToken = float64(pricing.OutputCostPerMillionTokens) / 1_000_000
-	} else {
-		costPerToken = float64(pricing.InputCostPerMillionTokens) / 1_000_000
+	deduction, err := s.prepareDeduction(ctx, platformUserID, req, currency)
+	if err != nil {
+		return nil, err
 	}
 
-	grainCost := int64(float64(req.TokensConsumed) * costPerToken)
-
 	// Call ledger to deduct grains
-	result, err := s.ledger.DeductGrains(ctx, ledger.DeductionRequest{
-		CustomerID:     req.CustomerId,
-		RequestID:      req.RequestId,
-		GrainAmount:    grainCost,
-		TokensConsumed: req.TokensConsumed,
-	})
+	ledgerStart := time.Now()
+	result, err := s.ledger.DeductGrains(ctx, deduction)
+	addRedisTime(ctx, ledgerStart)
 
 	if err != nil {
 		s.log.Error().Err(err).
 			Str("customer_id", req.CustomerId).
 			Str("request_id", req.RequestId).
 			Msg("ledger deduct_grains failed")
-		return nil, status.Errorf(codes.Internal, "failed to deduct tokens: %v", err)
+		return nil, ledgerError(err, "failed to deduct tokens")
+	}
+
+	// Not a kill: the SDK's price was off, so it should retry without
+	// grain_cost and let the server price the batch
+	if result.ErrorCode == ledger.DeductionCostExceedsReservation {
+		s.log.Warn().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Int64("grain_cost", deduction.GrainAmount).
+			Msg("provided grain_cost exceeds remaining reservation")
+		return nil, status.Errorf(codes.InvalidArgument, "grain_cost %d exceeds the request's remaining reservation", deduction.GrainAmount)
+	}
+
+	return s.deductTokensResponse(req, deduction, result), nil
+}
+
+// validateDeduction checks a DeductTokens request's parameters.
+func validateDeduction(req *pb.DeductTokensRequest) error {
+	if req.TokensConsumed == nil {
+		return status.Errorf(codes.InvalidArgument, "tokens_consumed is required")
+	}
+	if req.GetTokensConsumed() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "tokens_consumed must be positive")
 	}
+	if err := modalityTokens(req.ModalityTokens).Validate(int64(req.GetTokensConsumed())); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid modality_tokens: %v", err)
+	}
+	return validateGrainCost(req)
+}
+
+// prepareDeduction prices a validated DeductTokens request in currency and
+// returns the deduction to make for it. A deduction with a modality
+// breakdown is never repriced from pinned prices, which have no modality
+// rates.
+func (s *BalanceService) prepareDeduction(ctx context.Context, platformUserID string, req *pb.DeductTokensRequest, currency string) (ledger.DeductionRequest, error) {
+	var grainCost int64
+	var pricingPath string
+	switch {
+	case req.GrainCostOverride != nil:
+		// Negotiated pricing: skip the model pricing lookup entirely
+		if err := s.authorizeCostOverride(ctx, req.CustomerId, req.RequestId, req.GetGrainCostOverride()); err != nil {
+			return ledger.DeductionRequest{}, err
+		}
+		grainCost = req.GetGrainCostOverride()
+		pricingPath = pricingOverride
+
+	case req.GrainCost != nil:
+		// Fast path: the SDK already priced the batch. The ledger bounds
+		// it by the reservation, which was priced server-side
+		grainCost = req.GetGrainCost()
+		pricingPath = pricingProvided
+
+	default:
+		var err error
+		grainCost, err = s.priceTokens(platformUserID, req, currency)
+		if err != nil {
+			return ledger.DeductionRequest{}, err
+		}
+		pricingPath = pricingComputed
+	}
+	deductPricingTotal.WithLabelValues(pricingPath).Inc()
+
+	return ledger.DeductionRequest{
+		CustomerID:     req.CustomerId,
+		RequestID:      req.RequestId,
+		GrainAmount:    grainCost,
+		TokensConsumed: req.GetTokensConsumed(),
+		Currency:       currency,
+		ClientPriced:   pricingPath == pricingProvided,
+		PriceFromPins:  pricingPath == pricingComputed && req.ModalityTokens == nil,
+		IsCompletion:   req.IsCompletion,
+	}, nil
+}
 
+// deductTokensResponse builds the DeductTokens response for a deduction
+// the ledger made (or refused).
+func (s *BalanceService) deductTokensResponse(req *pb.DeductTokensRequest, deduction ledger.DeductionRequest, result *ledger.DeductionResult) *pb.DeductTokensResponse {
 	// Build response
 	response := &pb.DeductTokensResponse{
-		Success:          result.Success,
-		RemainingBalance: result.RemainingBalance,
-		ErrorCode:        result.ErrorCode,
+		Success:              result.Success,
+		RemainingBalance:     result.RemainingBalance,
+		ErrorCode:            result.ErrorCode,
+		RemainingGraceGrains: result.RemainingGraceGrains,
+		SuggestedAction:      s.suggestedAction(result),
 	}
 
 	// Log the deduction
-	if result.Success {
-		s.log.Debug().
+	if result.ErrorCode == ledger.DeductionRequestFinalized {
+		// A straggler after finalization, not a kill: the stream is over
+		s.log.Info().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Int64("grain_cost", deduction.GrainAmount).
+			Msg("deduct_tokens ignored, request already finalized")
+	} else if result.ErrorCode == ledger.DeductionTooManyDeductions {
+		// Not out of grains: the client is deducting far more often than
+		// the request's max_tokens could need
+		s.log.Warn().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Msg("deduct_tokens rejected, too many deductions for request")
+	} else if result.ErrorCode == ledger.DeductionRequestKilled {
+		// The kill was already logged when it happened
+		s.hotLog.Debug().
 			Str("customer_id", req.CustomerId).
 			Str("request_id", req.RequestId).
-			Int32("tokens", req.TokensConsumed).
-			Int64("grain_cost", grainCost).
+			Msg("deduct_tokens rejected, request already killed")
+	} else if result.Success {
+		s.hotLog.Debug().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Int32("tokens", req.GetTokensConsumed()).
+			Int64("grain_cost", result.GrainsDeducted).
 			Int64("remaining_balance", result.RemainingBalance).
 			Msg("deduct_tokens success")
 	} else {
@@ -285,119 +659,1074 @@ func (s *BalanceService) DeductTokens(ctx context.Context, req *pb.DeductTokensR
 			Msg("deduct_tokens failed - kill switch triggered")
 	}
 
-	return response, nil
+	return response
 }
 
-// FinalizeRequest implements the FinalizeRequest RPC method.
-//
-// This is called exactly once per request at stream-end with authoritative
-// token counts from the AI provider. It performs final reconciliation,
-// refunds any overcharges, releases the reservation, and marks the request
-// as complete.
-//
-// This method is more tolerant of higher latency than the others because
-// it's called after the user has already received their response. It's OK
-// if this takes 10-15ms.
+// CheckBalanceAndDeduct implements the CheckBalanceAndDeduct RPC method.
 //
-// Performance: Target < 10ms, typically achieves 3-8ms
-func (s *BalanceService) FinalizeRequest(ctx context.Context, req *pb.FinalizeRequestRequest) (*pb.FinalizeRequestResponse, error) {
+// The reservation is validated and priced exactly as by CheckBalance and the
+// first deduction exactly as by DeductTokens (minus the request token, which
+// doesn't exist yet); the ledger then makes both in one Redis script.
+func (s *BalanceService) CheckBalanceAndDeduct(ctx context.Context, req *pb.CheckBalanceAndDeductRequest) (*pb.CheckBalanceAndDeductResponse, error) {
 	start := time.Now()
+	defer recordTotalTime(ctx, start)
 
-	// Validate parameters
-	if req.CustomerId == "" || req.RequestId == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "customer_id and request_id are required")
+	platformUserID, err := s.auth.ValidateAPIKey(ctx)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("authentication failed")
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
 	}
 
-	if req.TotalActualCostGrains < 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "total_actual_cost_grains cannot be negative")
+	check := req.GetCheck()
+	if check == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "check is required")
+	}
+	if req.GetFirstDeduction() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "first_deduction is required")
+	}
+	if check.DryRun {
+		return nil, status.Errorf(codes.InvalidArgument, "dry_run can't be combined with a deduction")
 	}
 
-	// Translate status enum to string
-	var statusStr string
-	switch req.Status {
-	case pb.RequestStatus_COMPLETED_SUCCESS:
-		statusStr = "completed"
-	case pb.RequestStatus_KILLED_INSUFFICIENT_BALANCE:
-		statusStr = "killed"
-	case pb.RequestStatus_FAILED_ERROR:
-		statusStr = "failed"
-	case pb.RequestStatus_FAILED_TIMEOUT:
-		statusStr = "timeout"
-	default:
-		return nil, status.Errorf(codes.InvalidArgument, "invalid status")
+	// The deduction is for the request being reserved, whatever it says
+	first := proto.Clone(req.GetFirstDeduction()).(*pb.DeductTokensRequest)
+	first.CustomerId = check.CustomerId
+	first.RequestId = check.RequestId
+	first.RequestToken = ""
+
+	if err := validateDeduction(first); err != nil {
+		return nil, err
+	}
+	reservation, err := s.prepareReservation(ctx, platformUserID, check)
+	if err != nil {
+		return nil, err
+	}
+	deduction, err := s.prepareDeduction(ctx, platformUserID, first, reservation.Currency)
+	if err != nil {
+		return nil, err
 	}
 
-	// Call ledger to finalize
-	result, err := s.ledger.FinalizeRequest(ctx, ledger.FinalizationRequest{
-		CustomerID:        req.CustomerId,
-		RequestID:         req.RequestId,
-		Status:            statusStr,
-		ActualCostGrains:  req.TotalActualCostGrains,
-		PromptTokens:      req.ActualPromptTokens,
-		CompletionTokens:  req.ActualCompletionTokens,
-		Model:             req.Model,
-	})
+	ledgerStart := time.Now()
+	result, deducted, err := s.ledger.ReserveAndDeduct(ctx, reservation, deduction)
+	addRedisTime(ctx, ledgerStart)
+	if err != nil {
+		return nil, s.reserveError(check, err)
+	}
 
+	checkResp, err := s.checkBalanceResponse(check, reservation, result, start)
 	if err != nil {
-		s.log.Error().Err(err).
+		return nil, err
+	}
+
+	response := &pb.CheckBalanceAndDeductResponse{Check: checkResp}
+	if deducted != nil {
+		response.Deduction = s.deductTokensResponse(first, deduction, deducted)
+	}
+	return response, nil
+}
+
+// verifyPromptTokens returns the prompt token count to trust for a
+// CheckBalance: the server's own count if the raw prompt was sent and the
+// model has a tokenizer, otherwise the client's.
+func (s *BalanceService) verifyPromptTokens(req *pb.CheckBalanceRequest) int32 {
+	md := req.Metadata
+	counted := int32(tokenizer.PromptTokens(s.tokenizer, md.Model, md.Prompt, int(md.PromptTokens)))
+
+	if counted > md.PromptTokens {
+		s.log.Warn().
 			Str("customer_id", req.CustomerId).
 			Str("request_id", req.RequestId).
-			Msg("ledger finalize_request failed")
-		return nil, status.Errorf(codes.Internal, "failed to finalize request: %v", err)
+			Str("model", md.Model).
+			Int32("client_prompt_tokens", md.PromptTokens).
+			Int32("server_prompt_tokens", counted).
+			Msg("client understated prompt tokens")
 	}
 
-	// Build response
-	response := &pb.FinalizeRequestResponse{
-		Success:        result.Success,
-		RefundedGrains: result.RefundedGrains,
-		FinalBalance:   result.FinalBalance,
+	return counted
+}
+
+// reservationPricing returns model's pricing in currency, with the platform
+// user's cost multiplier applied, to be pinned on the reservation. Returns
+// nil if the model has no pricing.
+func (s *BalanceService) reservationPricing(platformUserID, model, currency string) *ledger.PricingInfo {
+	if model == "" {
+		return nil
 	}
 
-	duration := time.Since(start)
+	if currency == "" {
+		currency = ledger.DefaultCurrency
+	}
+	pricing, err := s.ledger.GetModelPricingFor(platformUserID, model, providerForModel(model), currency)
+	if err != nil {
+		s.hotLog.Debug().Err(err).Str("model", model).Msg("no pricing to pin on reservation")
+		return nil
+	}
 
-	// Log finalization
-	s.log.Info().
-		Str("customer_id", req.CustomerId).
-		Str("request_id", req.RequestId).
-		Str("status", statusStr).
-		Int64("actual_cost", req.TotalActualCostGrains).
-		Int64("refunded", result.RefundedGrains).
-		Int64("final_balance", result.FinalBalance).
-		Dur("duration_ms", duration).
-		Msg("finalize_request completed")
+	return pricing
+}
 
-	return response, nil
+// promptCostFloor returns what promptTokens cost at pricing, the least a
+// reservation may be. Returns 0 without pricing.
+func promptCostFloor(pricing *ledger.PricingInfo, promptTokens int32) int64 {
+	if pricing == nil || promptTokens <= 0 {
+		return 0
+	}
+
+	return int64(promptTokens) * pricing.InputCostPerMillionTokens / 1_000_000
 }
 
-// GetBalance implements the GetBalance RPC method.
-//
-// This is a simple read-only operation that returns the current balance
-// without any side effects. Used by dashboards and health checks.
-//
-// Performance: < 2ms typically
-func (s *BalanceService) GetBalance(ctx context.Context, req *pb.GetBalanceRequest) (*pb.GetBalanceResponse, error) {
-	// Authenticate request
-	_, err := s.auth.ValidateAPIKey(ctx)
-	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+// bufferMultiplier returns the multiplier a CheckBalance request asks for,
+// or the buffer strategy's if it leaves buffer_multiplier unset. One that is
+// set is validated, so an explicit 0 is rejected rather than defaulted.
+func (s *BalanceService) bufferMultiplier(req *pb.CheckBalanceRequest) (float64, error) {
+	if req.BufferMultiplier == nil {
+		md := req.GetMetadata()
+		m := s.bufferStrategy.Multiplier(md.GetModel(), md.GetMaxTokens())
+		if err := s.validateBufferMultiplier(m); err != nil {
+			s.log.Warn().
+				Float64("buffer_multiplier", m).
+				Str("model", md.GetModel()).
+				Msg("buffer strategy multiplier out of range, using the default")
+			return DefaultBufferMultiplier, nil
+		}
+		return m, nil
 	}
 
-	if req.CustomerId == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+	if err := s.validateBufferMultiplier(req.GetBufferMultiplier()); err != nil {
+		return 0, err
 	}
+	return req.GetBufferMultiplier(), nil
+}
 
-	// Get balance from ledger
-	balance, reserved, available, err := s.ledger.GetBalance(ctx, req.CustomerId)
-	if err != nil {
-		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to get balance")
-		return nil, status.Errorf(codes.Internal, "failed to get balance: %v", err)
+// validateBufferMultiplier checks m is within [1, maxBufferMultiplier]. A
+// multiplier below 1 would reserve less than the estimate.
+func (s *BalanceService) validateBufferMultiplier(m float64) error {
+	limit := s.maxBufferMultiplier
+	if limit == 0 {
+		limit = DefaultMaxBufferMultiplier
 	}
 
-	return &pb.GetBalanceResponse{
-		Balance:   balance,
-		Reserved:  reserved,
-		Available: available,
-	}, nil
+	// Written so NaN fails too
+	if !(m >= 1 && m <= limit) {
+		return status.Errorf(codes.InvalidArgument, "buffer_multiplier must be between 1.0 and %g", limit)
+	}
+	return nil
+}
+
+// deductionCap returns how many DeductTokens calls a request for up to
+// maxTokens completion tokens may make: four times one per 50 tokens, the
+// SDK's deduction interval, leaving room for smaller batches and prompt
+// deductions. 0 (unknown max_tokens) leaves the ledger's cap, which also
+// applies if it is larger.
+func deductionCap(maxTokens int32) int64 {
+	if maxTokens <= 0 {
+		return 0
+	}
+	return 4 * ((int64(maxTokens) + 49) / 50)
+}
+
+// bufferedReservation returns estimated * multiplier, rounded up.
+//
+// The multiplier is rounded to bufferMultiplierScale and the product taken in
+// 128-bit integer arithmetic, so large estimates neither lose precision to
+// float64 nor wrap around; a reservation that doesn't fit in an int64 is an
+// error.
+func bufferedReservation(estimated int64, multiplier float64) (int64, error) {
+	scaled := uint64(math.Round(multiplier * bufferMultiplierScale))
+
+	hi, lo := bits.Mul64(uint64(estimated), scaled)
+	if hi >= bufferMultiplierScale {
+		// The quotient wouldn't fit in 64 bits (and bits.Div64 would panic)
+		return 0, errReservationOverflow
+	}
+
+	reserved, rem := bits.Div64(hi, lo, bufferMultiplierScale)
+	if rem > 0 {
+		reserved++
+	}
+	if reserved > math.MaxInt64 {
+		return 0, errReservationOverflow
+	}
+	return int64(reserved), nil
+}
+
+var errReservationOverflow = errors.New("estimated_grains * buffer_multiplier is too large")
+
+// providerForModel guesses the provider from the model name.
+// Model names typically indicate the provider (e.g., "gpt-4" = openai, "claude-3" = anthropic)
+func providerForModel(model string) string {
+	switch {
+	case strings.HasPrefix(model, "claude"):
+		return "anthropic"
+	case strings.HasPrefix(model, "gemini"):
+		return "google"
+	}
+	return "openai" // Default, also covers gpt-*, text-*, ada-*
+}
+
+// validateGrainCost checks the SDK-provided grain_cost, if any, before
+// anything else is looked up.
+func validateGrainCost(req *pb.DeductTokensRequest) error {
+	if req.GrainCost == nil {
+		return nil
+	}
+	if req.GrainCostOverride != nil {
+		return status.Errorf(codes.InvalidArgument, "grain_cost and grain_cost_override are mutually exclusive")
+	}
+	if req.GetGrainCost() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "grain_cost must be positive")
+	}
+	return nil
+}
+
+// priceTokens computes the grain cost of a deduction from model pricing,
+// converted to the customer's currency, with the platform user's cost
+// multiplier applied.
+//
+// The ledger reprices the deduction from the prices pinned on the request
+// when it has them and there is no modality breakdown; this is the cost
+// for the rest. It rounds the same way the deduct script does.
+func (s *BalanceService) priceTokens(platformUserID string, req *pb.DeductTokensRequest, currency string) (int64, error) {
+	// Calculate grain cost based on model pricing
+	pricing, err := s.ledger.GetModelPricingFor(platformUserID, req.Model, providerForModel(req.Model), currency)
+	if err != nil {
+		s.log.Error().Err(err).Str("model", req.Model).Str("currency", currency).Msg("failed to get pricing")
+		return 0, status.Errorf(codes.Internal, "failed to get model pricing")
+	}
+
+	// Calculate cost in grains, each modality at its own rate
+	return pricing.Cost(int64(req.GetTokensConsumed()), modalityTokens(req.ModalityTokens), req.IsCompletion), nil
+}
+
+// modalityTokens converts a modality breakdown from the API. Unset is no
+// breakdown: all text.
+func modalityTokens(m *pb.ModalityTokens) ledger.ModalityTokens {
+	return ledger.ModalityTokens{ImageTokens: m.GetImageTokens(), AudioTokens: m.GetAudioTokens()}
+}
+
+// priceFinalization computes a finalized request's cost from its modality
+// breakdowns, at the model's current pricing in the customer's currency.
+func (s *BalanceService) priceFinalization(ctx context.Context, platformUserID string, req *pb.FinalizeRequestRequest) (int64, error) {
+	currency, err := s.ledger.CustomerCurrency(ctx, req.CustomerId)
+	if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to resolve customer currency")
+		return 0, ledgerError(err, "failed to resolve customer currency")
+	}
+
+	pricing, err := s.ledger.GetModelPricingFor(platformUserID, req.Model, providerForModel(req.Model), currency)
+	if err != nil {
+		s.log.Error().Err(err).Str("model", req.Model).Str("currency", currency).Msg("failed to get pricing")
+		return 0, status.Errorf(codes.Internal, "failed to get model pricing")
+	}
+
+	return pricing.Cost(int64(req.ActualPromptTokens), modalityTokens(req.PromptModalityTokens), false) +
+		pricing.Cost(int64(req.ActualCompletionTokens), modalityTokens(req.CompletionModalityTokens), true), nil
+}
+
+// authorizeCostOverride checks that the caller may set grain_cost_override.
+//
+// The override bypasses model pricing, so it requires the cost_override
+// scope on the caller's API key. Every use is logged for audit.
+func (s *BalanceService) authorizeCostOverride(ctx context.Context, customerID, requestID string, override int64) error {
+	if override < 0 {
+		return status.Errorf(codes.InvalidArgument, "grain_cost_override cannot be negative")
+	}
+
+	platformUserID, err := s.auth.RequireScope(ctx, auth.ScopeCostOverride)
+	if errors.Is(err, auth.ErrScopeDenied) {
+		s.log.Warn().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("unauthorized grain cost override rejected")
+		return status.Errorf(codes.PermissionDenied, "permission denied: grain_cost_override requires the %s scope", auth.ScopeCostOverride)
+	} else if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	s.log.Info().
+		Str("platform_user_id", platformUserID).
+		Str("customer_id", customerID).
+		Str("request_id", requestID).
+		Int64("grain_cost_override", override).
+		Msg("grain cost override used")
+
+	return nil
+}
+
+// finalizationCost validates a finalization's cost and returns what to
+// charge, and whether the ledger should reprice it from the prices pinned
+// on the request instead. FinalizeRequest and BatchFinalize share it so a
+// request is charged the same whichever way it is finalized.
+func (s *BalanceService) finalizationCost(ctx context.Context, platformUserID string, req *pb.FinalizeRequestRequest) (int64, bool, error) {
+	if req.TotalActualCostGrains < 0 {
+		return 0, false, status.Errorf(codes.InvalidArgument, "total_actual_cost_grains cannot be negative")
+	}
+
+	if err := modalityTokens(req.PromptModalityTokens).Validate(int64(req.ActualPromptTokens)); err != nil {
+		return 0, false, status.Errorf(codes.InvalidArgument, "invalid prompt_modality_tokens: %v", err)
+	}
+	if err := modalityTokens(req.CompletionModalityTokens).Validate(int64(req.ActualCompletionTokens)); err != nil {
+		return 0, false, status.Errorf(codes.InvalidArgument, "invalid completion_modality_tokens: %v", err)
+	}
+
+	if req.GrainCostOverride != nil {
+		if err := s.authorizeCostOverride(ctx, req.CustomerId, req.RequestId, req.GetGrainCostOverride()); err != nil {
+			return 0, false, err
+		}
+		return req.GetGrainCostOverride(), false, nil
+	}
+
+	// A modality breakdown is priced here: pinned prices have no modality
+	// rates
+	if req.PromptModalityTokens != nil || req.CompletionModalityTokens != nil {
+		cost, err := s.priceFinalization(ctx, platformUserID, req)
+		if err != nil {
+			return 0, false, err
+		}
+		return cost, false, nil
+	}
+
+	// Without token counts there is nothing to price at the pins: the
+	// caller only knows the cost
+	return req.TotalActualCostGrains, req.ActualPromptTokens > 0 || req.ActualCompletionTokens > 0, nil
+}
+
+// FinalizeRequest implements the FinalizeRequest RPC method.
+//
+// This is called exactly once per request at stream-end with authoritative
+// token counts from the AI provider. It performs final reconciliation,
+// refunds any overcharges, releases the reservation, and marks the request
+// as complete.
+//
+// This method is more tolerant of higher latency than the others because
+// it's called after the user has already received their response. It's OK
+// if this takes 10-15ms.
+//
+// Performance: Target < 10ms, typically achieves 3-8ms
+func (s *BalanceService) FinalizeRequest(ctx context.Context, req *pb.FinalizeRequestRequest) (*pb.FinalizeRequestResponse, error) {
+	start := time.Now()
+	defer recordTotalTime(ctx, start)
+
+	// Authenticate request
+	platformUserID, err := s.auth.ValidateAPIKey(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	// Validate parameters
+	if req.CustomerId == "" || req.RequestId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id and request_id are required")
+	}
+
+	// Translate status enum to string
+	statusStr, ok := requestStatusString(req.Status)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid status")
+	}
+
+	actualCost, priceFromPins, err := s.finalizationCost(ctx, platformUserID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Call ledger to finalize
+	ledgerStart := time.Now()
+	result, err := s.ledger.FinalizeRequest(ctx, ledger.FinalizationRequest{
+		CustomerID:        req.CustomerId,
+		RequestID:         req.RequestId,
+		Status:            statusStr,
+		ActualCostGrains:  actualCost,
+		PromptTokens:      req.ActualPromptTokens,
+		CompletionTokens:  req.ActualCompletionTokens,
+		Model:             req.Model,
+		Provider:          providerForModel(req.Model),
+		PriceFromPins:     priceFromPins,
+	})
+	addRedisTime(ctx, ledgerStart)
+
+	if err != nil {
+		s.log.Error().Err(err).
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Msg("ledger finalize_request failed")
+		return nil, ledgerError(err, "failed to finalize request")
+	}
+
+	// Build response
+	response := finalizeResponse(result)
+
+	duration := time.Since(start)
+
+	// Log finalization
+	s.log.Info().
+		Str("customer_id", req.CustomerId).
+		Str("request_id", req.RequestId).
+		Str("status", statusStr).
+		Int64("actual_cost", result.ActualCostGrains).
+		Int64("refunded", result.RefundedGrains).
+		Int64("final_balance", result.FinalBalance).
+		Dur("duration_ms", duration).
+		Msg("finalize_request completed")
+
+	return response, nil
+}
+
+// BatchFinalize implements the BatchFinalize RPC method.
+//
+// Every request is validated individually. Invalid entries get an
+// INVALID_ARGUMENT result and are not sent to the ledger; the rest are
+// priced as FinalizeRequest would price them and finalized together in one
+// Redis round trip. Only an empty or oversized batch, or a ledger outage,
+// fails the whole call.
+func (s *BalanceService) BatchFinalize(ctx context.Context, req *pb.BatchFinalizeRequest) (*pb.BatchFinalizeResponse, error) {
+	start := time.Now()
+	defer recordTotalTime(ctx, start)
+
+	// Authenticate request
+	platformUserID, err := s.auth.ValidateAPIKey(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	if len(req.Requests) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "requests must not be empty")
+	}
+	if len(req.Requests) > maxBatchFinalizeSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch exceeds %d requests", maxBatchFinalizeSize)
+	}
+
+	response := &pb.BatchFinalizeResponse{
+		Results: make(map[string]*pb.FinalizeRequestResponse, len(req.Requests)),
+	}
+
+	batch := make([]ledger.FinalizationRequest, 0, len(req.Requests))
+	for _, r := range req.Requests {
+		statusStr, ok := requestStatusString(r.Status)
+		if r.CustomerId == "" || r.RequestId == "" || !ok {
+			if r.RequestId != "" {
+				response.Results[r.RequestId] = &pb.FinalizeRequestResponse{ErrorCode: "INVALID_ARGUMENT"}
+			}
+			continue
+		}
+
+		actualCost, priceFromPins, err := s.finalizationCost(ctx, platformUserID, r)
+		switch status.Code(err) {
+		case codes.OK:
+		case codes.InvalidArgument:
+			response.Results[r.RequestId] = &pb.FinalizeRequestResponse{ErrorCode: "INVALID_ARGUMENT"}
+			continue
+		case codes.PermissionDenied, codes.Unauthenticated:
+			response.Results[r.RequestId] = &pb.FinalizeRequestResponse{ErrorCode: "PERMISSION_DENIED"}
+			continue
+		default:
+			// Pricing a modality breakdown failed, which the rest of
+			// the batch would run into too
+			return nil, err
+		}
+
+		batch = append(batch, ledger.FinalizationRequest{
+			CustomerID:       r.CustomerId,
+			RequestID:        r.RequestId,
+			Status:           statusStr,
+			ActualCostGrains: actualCost,
+			PromptTokens:     r.ActualPromptTokens,
+			CompletionTokens: r.ActualCompletionTokens,
+			Model:            r.Model,
+			Provider:         providerForModel(r.Model),
+			PriceFromPins:    priceFromPins,
+		})
+	}
+	if len(batch) == 0 {
+		return response, nil
+	}
+
+	ledgerStart := time.Now()
+	results, err := s.ledger.BatchFinalize(ctx, batch)
+	addRedisTime(ctx, ledgerStart)
+	if err != nil {
+		s.log.Error().Err(err).
+			Int("batch_size", len(batch)).
+			Msg("ledger batch_finalize failed")
+		return nil, ledgerError(err, "failed to finalize batch")
+	}
+
+	for requestID, result := range results {
+		response.Results[requestID] = finalizeResponse(result)
+	}
+
+	s.log.Info().
+		Int("batch_size", len(req.Requests)).
+		Dur("duration_ms", time.Since(start)).
+		Msg("batch_finalize completed")
+
+	return response, nil
+}
+
+// CancelRequest implements the CancelRequest RPC method.
+//
+// Releases a reservation the client won't use instead of leaving it locked
+// until the request hash expires.
+func (s *BalanceService) CancelRequest(ctx context.Context, req *pb.CancelRequestRequest) (*pb.CancelRequestResponse, error) {
+	// Authenticate request
+	if _, err := s.auth.ValidateAPIKey(ctx); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	if req.CustomerId == "" || req.RequestId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id and request_id are required")
+	}
+
+	// Only the client that was approved may give the reservation back
+	if !s.validateRequestToken(req.RequestToken, req.RequestId, req.CustomerId) {
+		s.log.Warn().
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Msg("invalid request token")
+		return nil, status.Errorf(codes.PermissionDenied, "invalid request token")
+	}
+
+	result, err := s.ledger.CancelRequest(ctx, req.CustomerId, req.RequestId)
+	if err != nil {
+		s.log.Error().Err(err).
+			Str("customer_id", req.CustomerId).
+			Str("request_id", req.RequestId).
+			Msg("ledger cancel_request failed")
+		return nil, ledgerError(err, "failed to cancel request")
+	}
+
+	return &pb.CancelRequestResponse{
+		Success:          result.Success,
+		AlreadyFinalized: result.AlreadyTerminal,
+		ReleasedGrains:   result.ReleasedGrains,
+		ErrorCode:        result.ErrorCode,
+	}, nil
+}
+
+// AdjustBalance implements the AdjustBalance RPC method.
+//
+// Support's audited way to correct a balance. Requires the admin scope.
+func (s *BalanceService) AdjustBalance(ctx context.Context, req *pb.AdjustBalanceRequest) (*pb.AdjustBalanceResponse, error) {
+	platformUserID, err := s.requireAdmin(ctx, "AdjustBalance", req.CustomerId, map[string]interface{}{
+		"delta_grains": req.DeltaGrains,
+		"reason":       req.Reason,
+		"operator":     req.Operator,
+		"bucket":       req.Bucket,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CustomerId == "" || req.DeltaGrains == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id and a non-zero delta_grains are required")
+	}
+	if req.Reason == "" || req.Operator == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "reason and operator are required")
+	}
+
+	result, err := s.ledger.AdjustBalance(ctx, ledger.AdjustmentRequest{
+		CustomerID:  req.CustomerId,
+		DeltaGrains: req.DeltaGrains,
+		Reason:      req.Reason,
+		Operator:    req.Operator,
+		Bucket:      req.Bucket,
+	})
+	if errors.Is(err, ledger.ErrCustomerNotFound) {
+		return nil, status.Errorf(codes.NotFound, "customer not found: %s", req.CustomerId)
+	} else if errors.Is(err, ledger.ErrUnknownBucket) {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	} else if err != nil {
+		s.log.Error().Err(err).
+			Str("customer_id", req.CustomerId).
+			Str("platform_user_id", platformUserID).
+			Msg("ledger adjust_balance failed")
+		return nil, ledgerError(err, "failed to adjust balance")
+	}
+
+	s.log.Info().
+		Str("platform_user_id", platformUserID).
+		Str("customer_id", req.CustomerId).
+		Str("operator", req.Operator).
+		Str("bucket", req.Bucket).
+		Str("transaction_id", result.TransactionID).
+		Int64("delta_grains", req.DeltaGrains).
+		Msg("balance adjustment applied")
+
+	return &pb.AdjustBalanceResponse{
+		TransactionId:  result.TransactionID,
+		NewBalance:     result.NewBalance,
+		Synced:         result.RedisApplied,
+		KillSignalSent: result.KillSignalSent,
+	}, nil
+}
+
+// GetBalance implements the GetBalance RPC method.
+//
+// This is a simple read-only operation that returns the current balance
+// without any side effects. Used by dashboards and health checks.
+//
+// Performance: < 2ms typically
+func (s *BalanceService) GetBalance(ctx context.Context, req *pb.GetBalanceRequest) (*pb.GetBalanceResponse, error) {
+	// Authenticate request
+	_, err := s.auth.ValidateAPIKey(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	if req.CustomerId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+	}
+
+	// Get balance from ledger, with the lifetime stats dashboards want
+	detailed, found, err := s.ledger.GetBalanceDetailed(ctx, req.CustomerId)
+	if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to get balance")
+		return nil, ledgerError(err, "failed to get balance")
+	}
+
+	// Not the same as a zero balance: reporting 0 for a customer who has
+	// funds but wasn't synced would be wrong
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "no balance found for customer: %s", req.CustomerId)
+	}
+
+	currency, err := s.ledger.CustomerCurrency(ctx, req.CustomerId)
+	if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to resolve customer currency")
+		return nil, ledgerError(err, "failed to get balance")
+	}
+
+	buckets, _, err := s.ledger.GetBalanceBuckets(ctx, req.CustomerId)
+	if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("failed to get balance buckets")
+		return nil, ledgerError(err, "failed to get balance")
+	}
+
+	pbBuckets := make([]*pb.BucketBalance, len(buckets))
+	for i, b := range buckets {
+		pbBuckets[i] = &pb.BucketBalance{Bucket: b.Bucket, Grains: b.Grains}
+	}
+
+	var lastActivity int64
+	if detailed.LastActivityAt != nil {
+		lastActivity = detailed.LastActivityAt.Unix()
+	}
+
+	return &pb.GetBalanceResponse{
+		Balance:             detailed.Balance,
+		Reserved:            detailed.Reserved,
+		Available:           detailed.Available,
+		Currency:            currency,
+		Buckets:             pbBuckets,
+		LifetimeSpentGrains: detailed.LifetimeSpentGrains,
+		LastActivityAt:      lastActivity,
+	}, nil
+}
+
+// WatchKillSignals implements the WatchKillSignals RPC method.
+//
+// Holds the stream open, relaying the customer's kill signals, until the
+// client disconnects; the Redis subscription is released with it.
+func (s *BalanceService) WatchKillSignals(req *pb.WatchKillSignalsRequest, stream pb.BalanceService_WatchKillSignalsServer) error {
+	ctx := stream.Context()
+
+	// Authenticate request
+	if _, err := s.auth.ValidateAPIKey(ctx); err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	if req.CustomerId == "" {
+		return status.Errorf(codes.InvalidArgument, "customer_id is required")
+	}
+
+	s.log.Debug().Str("customer_id", req.CustomerId).Msg("watch_kill_signals opened")
+	defer s.log.Debug().Str("customer_id", req.CustomerId).Msg("watch_kill_signals closed")
+
+	err := s.ledger.WatchKillSignals(ctx, req.CustomerId, func(sig ledger.KillSignal) error {
+		return stream.Send(&pb.KillSignal{
+			CustomerId: sig.CustomerID,
+			Reason:     sig.Reason,
+			Balance:    sig.Balance,
+			IssuedAt:   sig.IssuedAt.Unix(),
+		})
+	})
+	if err != nil {
+		// A failed Send means the client went away
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("watch_kill_signals failed")
+		return retryableError(codes.Unavailable, killStreamRetryDelay, "kill signal stream interrupted: %v", err)
+	}
+
+	return nil
+}
+
+// GetPricing implements the GetPricing RPC method.
+//
+// Served from the ledger's pricing cache, so it reflects the last reload
+// without touching PostgreSQL.
+func (s *BalanceService) GetPricing(ctx context.Context, req *pb.GetPricingRequest) (*pb.GetPricingResponse, error) {
+	// Authenticate request
+	if _, err := s.auth.ValidateAPIKey(ctx); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	prices, etag := s.ledger.PricingSnapshot()
+	if req.IfNoneMatch == etag {
+		return &pb.GetPricingResponse{Etag: etag, NotModified: true}, nil
+	}
+
+	pbPrices := make([]*pb.ModelPrice, len(prices))
+	for i, p := range prices {
+		pbPrices[i] = &pb.ModelPrice{
+			Model:                      p.Model,
+			Provider:                   p.Provider,
+			InputCostPerMillionTokens:  p.InputCostPerMillionTokens,
+			OutputCostPerMillionTokens: p.OutputCostPerMillionTokens,
+			ImageCostPerMillionTokens:  p.ImageCostPerMillionTokens,
+			AudioCostPerMillionTokens:  p.AudioCostPerMillionTokens,
+		}
+	}
+
+	return &pb.GetPricingResponse{Prices: pbPrices, Etag: etag}, nil
+}
+
+// ListCustomers implements the ListCustomers RPC method.
+//
+// Requires the admin scope.
+func (s *BalanceService) ListCustomers(ctx context.Context, req *pb.ListCustomersRequest) (*pb.ListCustomersResponse, error) {
+	if _, err := s.requireAdmin(ctx, "ListCustomers", "", map[string]interface{}{
+		"cursor":    req.Cursor,
+		"page_size": req.PageSize,
+	}); err != nil {
+		return nil, err
+	}
+
+	page, err := s.ledger.ListCustomers(ctx, req.Cursor, int(req.PageSize))
+	if errors.Is(err, ledger.ErrInvalidCursor) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid argument: %v", err)
+	} else if err != nil {
+		s.log.Error().Err(err).Msg("ledger list_customers failed")
+		return nil, status.Errorf(codes.Internal, "failed to list customers: %v", err)
+	}
+
+	customers := make([]*pb.Customer, len(page.Customers))
+	for i := range page.Customers {
+		customers[i] = customerToProto(&page.Customers[i])
+	}
+
+	return &pb.ListCustomersResponse{
+		Customers:  customers,
+		NextCursor: page.NextCursor,
+	}, nil
+}
+
+// GetCustomer implements the GetCustomer RPC method.
+//
+// Requires the admin scope.
+func (s *BalanceService) GetCustomer(ctx context.Context, req *pb.GetCustomerRequest) (*pb.Customer, error) {
+	if _, err := s.requireAdmin(ctx, "GetCustomer", req.CustomerId, nil); err != nil {
+		return nil, err
+	}
+
+	if req.CustomerId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+	}
+
+	customer, err := s.ledger.GetCustomer(ctx, req.CustomerId)
+	if errors.Is(err, ledger.ErrCustomerNotFound) {
+		return nil, status.Errorf(codes.NotFound, "customer not found: %s", req.CustomerId)
+	} else if err != nil {
+		s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("ledger get_customer failed")
+		return nil, status.Errorf(codes.Internal, "failed to get customer: %v", err)
+	}
+
+	return customerToProto(customer), nil
+}
+
+// GetUsage implements the GetUsage RPC method.
+//
+// Requires the admin scope.
+func (s *BalanceService) GetUsage(ctx context.Context, req *pb.GetUsageRequest) (*pb.GetUsageResponse, error) {
+	if _, err := s.requireAdmin(ctx, "GetUsage", req.CustomerId, map[string]interface{}{
+		"group_by": req.GroupBy,
+		"from":     req.From,
+		"to":       req.To,
+	}); err != nil {
+		return nil, err
+	}
+
+	if req.CustomerId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+	}
+
+	f := ledger.UsageFilter{
+		CustomerID: req.CustomerId,
+		EndUserID:  req.EndUserId,
+		Limit:      int(req.Limit),
+	}
+	if req.From > 0 {
+		f.From = time.Unix(req.From, 0)
+	}
+	if req.To > 0 {
+		f.To = time.Unix(req.To, 0)
+	}
+
+	var groups []*pb.UsageGroup
+	switch tag, isTag := strings.CutPrefix(req.GroupBy, "tag:"); {
+	case req.GroupBy == "end_user":
+		usage, err := s.ledger.UsageByEndUser(ctx, f)
+		if err != nil {
+			s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("ledger usage_by_end_user failed")
+			return nil, status.Errorf(codes.Internal, "failed to get usage: %v", err)
+		}
+		for _, u := range usage {
+			groups = append(groups, usageGroupToProto(u.EndUserID, u.UsageTotals))
+		}
+
+	case isTag:
+		usage, err := s.ledger.UsageByTag(ctx, f, tag)
+		if errors.Is(err, ledger.ErrUnknownTag) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid argument: %v", err)
+		} else if err != nil {
+			s.log.Error().Err(err).Str("customer_id", req.CustomerId).Msg("ledger usage_by_tag failed")
+			return nil, status.Errorf(codes.Internal, "failed to get usage: %v", err)
+		}
+		for _, u := range usage {
+			groups = append(groups, usageGroupToProto(u.Value, u.UsageTotals))
+		}
+
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "group_by must be end_user or tag:<key>")
+	}
+
+	return &pb.GetUsageResponse{Groups: groups}, nil
+}
+
+// AdminQuery implements the AdminQuery RPC method.
+//
+// Requires the admin scope. Only the ledger's predefined queries can run.
+func (s *BalanceService) AdminQuery(ctx context.Context, req *pb.AdminQueryRequest) (*pb.AdminQueryResponse, error) {
+	if _, err := s.requireAdmin(ctx, "AdminQuery", req.CustomerId, map[string]interface{}{
+		"query": req.Query.String(),
+		"from":  req.From,
+		"to":    req.To,
+		"limit": req.Limit,
+	}); err != nil {
+		return nil, err
+	}
+
+	kind, ok := adminQueryKind(req.Query)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid query")
+	}
+
+	p := ledger.AdminQueryParams{
+		CustomerID: req.CustomerId,
+		Limit:      int(req.Limit),
+	}
+	if req.From > 0 {
+		p.From = time.Unix(req.From, 0)
+	}
+	if req.To > 0 {
+		p.To = time.Unix(req.To, 0)
+	}
+	if kind != ledger.AdminQueryTopSpenders && p.CustomerID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "customer_id is required")
+	}
+
+	result, err := s.ledger.AdminQuery(ctx, kind, p)
+	if err != nil {
+		s.log.Error().Err(err).Str("query", string(kind)).Msg("ledger admin_query failed")
+		return nil, status.Errorf(codes.Internal, "failed to run query: %v", err)
+	}
+
+	rows := make([]*pb.AdminQueryRow, len(result.Rows))
+	for i, row := range result.Rows {
+		rows[i] = &pb.AdminQueryRow{Values: row}
+	}
+	return &pb.AdminQueryResponse{Columns: result.Columns, Rows: rows}, nil
+}
+
+// requireAdmin authenticates the caller, checks they hold the admin scope
+// for the RPC named method, and records the call in the admin audit log
+// (see ledger.RecordAdminAction) under their platform user ID, and in the
+// audit trail if there is one (see WithAuditLogger). customerID (if any)
+// and params describe the call. The call is refused if it can't be
+// audited. Returns the caller's platform user ID.
+func (s *BalanceService) requireAdmin(ctx context.Context, method, customerID string, params map[string]interface{}) (string, error) {
+	platformUserID, err := s.auth.RequireScope(ctx, auth.ScopeAdmin)
+	if errors.Is(err, auth.ErrScopeDenied) {
+		s.log.Warn().
+			Str("method", method).
+			Str("customer_id", customerID).
+			Msg("unauthorized admin call rejected")
+		if s.auditLog != nil {
+			s.auditLog.TryRecord(ctx, audit.Event{
+				Type:       audit.TypeAdminDenied,
+				CustomerID: customerID,
+				Detail:     map[string]string{"method": method},
+			})
+		}
+		return "", status.Errorf(codes.PermissionDenied, "permission denied: %s requires the %s scope", method, auth.ScopeAdmin)
+	} else if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	err = s.recordAdminAction(ctx, ledger.AdminAction{
+		Operator:   platformUserID,
+		Action:     method,
+		CustomerID: customerID,
+		Params:     params,
+	})
+	if err != nil {
+		s.log.Error().Err(err).
+			Str("method", method).
+			Str("platform_user_id", platformUserID).
+			Msg("admin audit write failed, call refused")
+		return "", status.Errorf(codes.Internal, "failed to record admin audit: %v", err)
+	}
+
+	if s.auditLog != nil {
+		err = s.auditLog.Record(ctx, audit.Event{
+			Type:       audit.TypeAdminAction,
+			Actor:      platformUserID,
+			CustomerID: customerID,
+			Detail:     adminAuditDetail(method, params),
+		})
+		if err != nil {
+			s.log.Error().Err(err).
+				Str("method", method).
+				Str("platform_user_id", platformUserID).
+				Msg("audit log write failed, call refused")
+			return "", status.Errorf(codes.Internal, "failed to record admin audit: %v", err)
+		}
+	}
+
+	return platformUserID, nil
+}
+
+// adminAuditDetail flattens an admin call's params into audit event detail.
+func adminAuditDetail(method string, params map[string]interface{}) map[string]string {
+	detail := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		detail[k] = fmt.Sprint(v)
+	}
+	detail["method"] = method
+	return detail
+}
+
+// customerToProto converts a ledger customer to its wire form.
+func customerToProto(c *ledger.Customer) *pb.Customer {
+	return &pb.Customer{
+		CustomerId:          c.CustomerID,
+		Name:                c.Name,
+		Currency:            c.Currency,
+		BalanceGrains:       c.BalanceGrains,
+		LifetimeSpentGrains: c.LifetimeSpentGrains,
+		CreatedAt:           c.CreatedAt.Unix(),
+	}
+}
+
+// usageGroupToProto converts one group of a usage summary to its wire form.
+func usageGroupToProto(key string, t ledger.UsageTotals) *pb.UsageGroup {
+	return &pb.UsageGroup{
+		Key:               key,
+		Requests:          t.Requests,
+		CompletedRequests: t.CompletedRequests,
+		KilledRequests:    t.KilledRequests,
+		SpentGrains:       t.SpentGrains,
+		TotalTokens:       t.TotalTokens,
+	}
+}
+
+// requestStatusString translates the wire status to the ledger's status string.
+func requestStatusString(st pb.RequestStatus) (string, bool) {
+	switch st {
+	case pb.RequestStatus_COMPLETED_SUCCESS:
+		return "completed", true
+	case pb.RequestStatus_KILLED_INSUFFICIENT_BALANCE:
+		return "killed", true
+	case pb.RequestStatus_FAILED_ERROR:
+		return "failed", true
+	case pb.RequestStatus_FAILED_TIMEOUT:
+		return "timeout", true
+	}
+	return "", false
+}
+
+// adminQueryKind maps an AdminQueryKind to the ledger's query.
+func adminQueryKind(k pb.AdminQueryKind) (ledger.AdminQueryKind, bool) {
+	switch k {
+	case pb.AdminQueryKind_ADMIN_QUERY_KIND_RECENT_REQUESTS:
+		return ledger.AdminQueryRecentRequests, true
+	case pb.AdminQueryKind_ADMIN_QUERY_KIND_TRANSACTIONS:
+		return ledger.AdminQueryTransactions, true
+	case pb.AdminQueryKind_ADMIN_QUERY_KIND_TOP_SPENDERS:
+		return ledger.AdminQueryTopSpenders, true
+	}
+	return "", false
+}
+
+// requestPriorityString maps a RequestPriority to the ledger's priority.
+// Unspecified is normal priority.
+func requestPriorityString(p pb.RequestPriority) (string, bool) {
+	switch p {
+	case pb.RequestPriority_REQUEST_PRIORITY_UNSPECIFIED, pb.RequestPriority_REQUEST_PRIORITY_NORMAL:
+		return ledger.PriorityNormal, true
+	case pb.RequestPriority_REQUEST_PRIORITY_LOW:
+		return ledger.PriorityLow, true
+	case pb.RequestPriority_REQUEST_PRIORITY_HIGH:
+		return ledger.PriorityHigh, true
+	}
+	return "", false
+}
+
+// finalizeResponse converts a ledger finalization result to its wire form.
+func finalizeResponse(result *ledger.FinalizationResult) *pb.FinalizeRequestResponse {
+	response := &pb.FinalizeRequestResponse{
+		Success:          result.Success,
+		RefundedGrains:   result.RefundedGrains,
+		FinalBalance:     result.FinalBalance,
+		ErrorCode:        result.ErrorCode,
+		ActualCostGrains: result.ActualCostGrains,
+		TotalCostGrains:  result.ActualCostGrains,
+	}
+	if p := result.PinnedPricing; p != nil {
+		response.PinnedPricing = &pb.PinnedPricing{
+			InputCostPerMillionTokens:  p.InputCostPerMillionTokens,
+			OutputCostPerMillionTokens: p.OutputCostPerMillionTokens,
+		}
+	}
+	if b := result.CostBreakdown; b != nil {
+		response.InputCostGrains = b.InputCostGrains
+		response.OutputCostGrains = b.OutputCostGrains
+	}
+	return response
+}
+
+// rejectionReasonCode maps a ledger rejection reason to its proto enum.
+func rejectionReasonCode(result *ledger.ReservationResult) pb.RejectionReasonCode {
+	if result.Approved {
+		return pb.RejectionReasonCode_REJECTION_REASON_UNSPECIFIED
+	}
+
+	switch result.RejectionReason {
+	case ledger.RejectionInsufficientBalance:
+		return pb.RejectionReasonCode_REJECTION_REASON_INSUFFICIENT_BALANCE
+	case ledger.RejectionIntegritySafeMode:
+		return pb.RejectionReasonCode_REJECTION_REASON_INTEGRITY_SAFE_MODE
+	case ledger.RejectionTooManyInflight:
+		return pb.RejectionReasonCode_REJECTION_REASON_TOO_MANY_INFLIGHT
+	case ledger.RejectionCustomerNotFound:
+		return pb.RejectionReasonCode_REJECTION_REASON_CUSTOMER_NOT_FOUND
+	case ledger.RejectionBalanceTooLow:
+		return pb.RejectionReasonCode_REJECTION_REASON_BALANCE_TOO_LOW
+	case ledger.RejectionRequestExists:
+		return pb.RejectionReasonCode_REJECTION_REASON_REQUEST_EXISTS
+	default:
+		return pb.RejectionReasonCode_REJECTION_REASON_OTHER
+	}
 }
 
 // generateRequestToken creates a secure token for a request.
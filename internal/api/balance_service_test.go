@@ -1,9 +1,31 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Beam/backend/internal/audit"
+	"github.com/Beam/backend/internal/auth"
+	"github.com/Beam/backend/internal/auth/authtest"
+	"github.com/Beam/backend/internal/ledger"
+	pb "github.com/Beam/backend/pkg/proto/balance/v1"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // MockLedger needs to be implemented or we use a real one. 
@@ -34,16 +56,876 @@ func TestCheckBalance_Validation(t *testing.T) {
 	assert.True(t, true, "Placeholder for integration test")
 }
 
-// Since I cannot rewrite the entire Ledger architecture in one step, 
-// I will create a simpler test that validates the Auth logic which IS mockable 
-// if I constructed it carefully, but Auth is also a struct.
-//
-// Instead, I'll write a test that checks the Request Validation logic 
-// by instantiating the service with nil dependencies (carefully) if possible, 
-// or I will mark this as "Integration Test" and skip if no env vars.
+func TestCheckBalance_Authentication(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	// Requests missing customer_id are rejected before the ledger is
+	// touched, so none is needed: the code shows whether auth let them through.
+	req := &pb.CheckBalanceRequest{RequestId: "req_1", EstimatedGrains: 100}
+
+	t.Run("valid key", func(t *testing.T) {
+		svc := NewBalanceService(nil, fake, zerolog.Nop())
+
+		_, err := svc.CheckBalance(withKey("sk_valid"), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		svc := NewBalanceService(nil, fake, zerolog.Nop())
+
+		_, err := svc.CheckBalance(withKey("sk_unknown"), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("authenticator unavailable", func(t *testing.T) {
+		failing := authtest.New()
+		failing.Err = errors.New("authentication service unavailable")
+		svc := NewBalanceService(nil, failing, zerolog.Nop())
+
+		_, err := svc.CheckBalance(withKey("sk_valid"), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
 
 func TestCheckBalance_Integration_SkipIfNoDB(t *testing.T) {
     // This is a stub for where the integration test goes.
     // In a real run, we would connect to the docker-compose Redis/PG.
     t.Skip("Skipping integration test in build environment without DB")
 }
+
+func TestRejectionReasonCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *ledger.ReservationResult
+		want   pb.RejectionReasonCode
+	}{
+		{
+			name:   "approved",
+			result: &ledger.ReservationResult{Approved: true},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_UNSPECIFIED,
+		},
+		{
+			name: "insufficient balance",
+			result: &ledger.ReservationResult{
+				RejectionReason: ledger.RejectionInsufficientBalance,
+				ShortfallGrains: 200,
+			},
+			want: pb.RejectionReasonCode_REJECTION_REASON_INSUFFICIENT_BALANCE,
+		},
+		{
+			name:   "integrity safe mode",
+			result: &ledger.ReservationResult{RejectionReason: ledger.RejectionIntegritySafeMode},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_INTEGRITY_SAFE_MODE,
+		},
+		{
+			name:   "too many in flight",
+			result: &ledger.ReservationResult{RejectionReason: ledger.RejectionTooManyInflight},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_TOO_MANY_INFLIGHT,
+		},
+		{
+			name:   "customer not found",
+			result: &ledger.ReservationResult{RejectionReason: ledger.RejectionCustomerNotFound},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_CUSTOMER_NOT_FOUND,
+		},
+		{
+			name: "balance too low",
+			result: &ledger.ReservationResult{
+				RejectionReason: ledger.RejectionBalanceTooLow,
+				ShortfallGrains: 1,
+			},
+			want: pb.RejectionReasonCode_REJECTION_REASON_BALANCE_TOO_LOW,
+		},
+		{
+			name:   "request exists",
+			result: &ledger.ReservationResult{RejectionReason: ledger.RejectionRequestExists},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_REQUEST_EXISTS,
+		},
+		{
+			name:   "unclassified",
+			result: &ledger.ReservationResult{RejectionReason: "SOMETHING_NEW"},
+			want:   pb.RejectionReasonCode_REJECTION_REASON_OTHER,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rejectionReasonCode(tt.result))
+		})
+	}
+}
+
+func TestCheckBalance_DuplicateReturnsRequestToken(t *testing.T) {
+	svc := &BalanceService{log: zerolog.Nop()}
+	req := &pb.CheckBalanceRequest{CustomerId: "cus_1", RequestId: "req_1"}
+	result := &ledger.ReservationResult{RejectionReason: ledger.RejectionRequestExists}
+
+	resp, err := svc.checkBalanceResponse(req, ledger.ReservationRequest{}, result, time.Now())
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// The retry gets the token the original reservation was issued, which
+	// is what DeductTokens and FinalizeRequest will accept
+	token, ok := ExistingRequestToken(err)
+	require.True(t, ok)
+	assert.Equal(t, svc.generateRequestToken("req_1", "cus_1"), token)
+	assert.True(t, svc.validateRequestToken(token, "req_1", "cus_1"))
+
+	_, ok = ExistingRequestToken(status.Error(codes.AlreadyExists, "no detail"))
+	assert.False(t, ok)
+}
+
+func TestAuthorizeCostOverride(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	authenticator := auth.NewAuthenticator(rdb, zerolog.Nop())
+	require.NoError(t, authenticator.StoreAPIKey(context.Background(), "sk_flat", "user_flat"))
+	require.NoError(t, authenticator.StoreAPIKey(context.Background(), "sk_plain", "user_plain"))
+	_, err := mr.SAdd("platform_user:scopes:user_flat", auth.ScopeCostOverride)
+	require.NoError(t, err)
+
+	// authorizeCostOverride only touches auth, so no ledger is needed.
+	svc := &BalanceService{auth: authenticator, log: zerolog.Nop()}
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	t.Run("override used with scope", func(t *testing.T) {
+		err := svc.authorizeCostOverride(withKey("sk_flat"), "cus_1", "req_1", 5000)
+		assert.NoError(t, err)
+	})
+
+	t.Run("override rejected without scope", func(t *testing.T) {
+		err := svc.authorizeCostOverride(withKey("sk_plain"), "cus_1", "req_1", 5000)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("negative override", func(t *testing.T) {
+		err := svc.authorizeCostOverride(withKey("sk_flat"), "cus_1", "req_1", -1)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestFinalizeRequest_RequiresAPIKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	// Authentication happens before the ledger is touched, so none is needed.
+	svc := &BalanceService{auth: auth.NewAuthenticator(rdb, zerolog.Nop()), log: zerolog.Nop()}
+
+	_, err := svc.FinalizeRequest(context.Background(), &pb.FinalizeRequestRequest{
+		CustomerId:            "cus_1",
+		RequestId:             "req_1",
+		Status:                pb.RequestStatus_COMPLETED_SUCCESS,
+		TotalActualCostGrains: 100,
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestValidateGrainCost(t *testing.T) {
+	cost := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name string
+		req  *pb.DeductTokensRequest
+		want codes.Code
+	}{
+		{"computed path", &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50)}, codes.OK},
+		{"provided cost", &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50), GrainCost: cost(1500)}, codes.OK},
+		{"zero cost", &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50), GrainCost: cost(0)}, codes.InvalidArgument},
+		{"negative cost", &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50), GrainCost: cost(-10)}, codes.InvalidArgument},
+		{"with override", &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50), GrainCost: cost(10), GrainCostOverride: cost(10)}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, status.Code(validateGrainCost(tt.req)))
+		})
+	}
+}
+
+func TestFinalizeResponse_CostBreakdown(t *testing.T) {
+	t.Run("itemized", func(t *testing.T) {
+		resp := finalizeResponse(&ledger.FinalizationResult{
+			Success:          true,
+			ActualCostGrains: 1016,
+			PinnedPricing:    &ledger.PricingInfo{InputCostPerMillionTokens: 250_000, OutputCostPerMillionTokens: 1_250_000},
+			CostBreakdown:    &ledger.CostBreakdown{InputCostGrains: 308, OutputCostGrains: 708},
+		})
+
+		assert.Equal(t, int64(308), resp.InputCostGrains)
+		assert.Equal(t, int64(708), resp.OutputCostGrains)
+		assert.Equal(t, int64(1016), resp.TotalCostGrains)
+		assert.Equal(t, resp.ActualCostGrains, resp.InputCostGrains+resp.OutputCostGrains)
+	})
+
+	t.Run("not itemized", func(t *testing.T) {
+		resp := finalizeResponse(&ledger.FinalizationResult{Success: true, ActualCostGrains: 5000})
+
+		assert.Zero(t, resp.InputCostGrains)
+		assert.Zero(t, resp.OutputCostGrains)
+		assert.Equal(t, int64(5000), resp.TotalCostGrains)
+	})
+}
+
+func TestCustomers_RequireAdmin(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_user", "user_1"))
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_admin", "admin_1"))
+	fake.Grant("admin_1", auth.ScopeAdmin)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	svc.recordAdminAction = func(context.Context, ledger.AdminAction) error { return nil }
+
+	_, err := svc.ListCustomers(withKey("sk_user"), &pb.ListCustomersRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = svc.GetCustomer(withKey("sk_user"), &pb.GetCustomerRequest{CustomerId: "cus_1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = svc.GetCustomer(withKey("sk_unknown"), &pb.GetCustomerRequest{CustomerId: "cus_1"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// An admin gets past auth to validation; the ledger is never reached.
+	_, err = svc.GetCustomer(withKey("sk_admin"), &pb.GetCustomerRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = svc.GetUsage(withKey("sk_user"), &pb.GetUsageRequest{CustomerId: "cus_1", GroupBy: "tag:team"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = svc.GetUsage(withKey("sk_admin"), &pb.GetUsageRequest{GroupBy: "tag:team"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = svc.GetUsage(withKey("sk_admin"), &pb.GetUsageRequest{CustomerId: "cus_1", GroupBy: "model"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBufferedReservation(t *testing.T) {
+	tests := []struct {
+		name       string
+		estimated  int64
+		multiplier float64
+		want       int64
+		overflow   bool
+	}{
+		{name: "default", estimated: 50000, multiplier: 1.2, want: 60000},
+		{name: "exact", estimated: 50000, multiplier: 1.0, want: 50000},
+		{name: "rounds up", estimated: 7, multiplier: 1.1, want: 8},
+		{name: "no float drift", estimated: 10, multiplier: 1.15, want: 12},
+		{name: "huge estimate exact", estimated: math.MaxInt64, multiplier: 1.0, want: math.MaxInt64},
+		{name: "huge estimate fits", estimated: math.MaxInt64 / 2, multiplier: 1.5, want: math.MaxInt64/2 + math.MaxInt64/4 + 1},
+		{name: "huge estimate overflows", estimated: math.MaxInt64 / 2, multiplier: 2.5, overflow: true},
+		{name: "near limit overflows", estimated: math.MaxInt64, multiplier: 1.000001, overflow: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bufferedReservation(tt.estimated, tt.multiplier)
+			if tt.overflow {
+				assert.ErrorIs(t, err, errReservationOverflow)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDeductionCap(t *testing.T) {
+	assert.Equal(t, int64(0), deductionCap(0), "unknown max_tokens leaves the ledger's cap")
+	assert.Equal(t, int64(4), deductionCap(1))
+	assert.Equal(t, int64(80), deductionCap(1000))
+	assert.Equal(t, int64(84), deductionCap(1001))
+}
+
+func TestCheckBalance_BufferMultiplierRange(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// Out-of-range multipliers are rejected before the ledger is touched.
+	svc := NewBalanceService(nil, fake, zerolog.Nop(), WithMaxBufferMultiplier(3))
+	for _, m := range []float64{0.5, -1.2, 3.01, 1e300, math.Inf(1), math.NaN()} {
+		_, err := svc.CheckBalance(ctx, &pb.CheckBalanceRequest{
+			CustomerId: "cus_1", RequestId: "req_1", EstimatedGrains: 100, BufferMultiplier: proto.Float64(m),
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "multiplier %v", m)
+	}
+
+	assert.NoError(t, svc.validateBufferMultiplier(3))
+	assert.NoError(t, svc.validateBufferMultiplier(DefaultBufferMultiplier))
+	assert.Error(t, NewBalanceService(nil, fake, zerolog.Nop()).validateBufferMultiplier(DefaultMaxBufferMultiplier+0.5))
+}
+
+func TestBufferMultiplier_UnsetVersusZero(t *testing.T) {
+	svc := NewBalanceService(nil, authtest.New(), zerolog.Nop())
+
+	// Unset: the default
+	m, err := svc.bufferMultiplier(&pb.CheckBalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBufferMultiplier, m)
+
+	// Explicitly 0: validated like any other value, not defaulted
+	_, err = svc.bufferMultiplier(&pb.CheckBalanceRequest{BufferMultiplier: proto.Float64(0)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	m, err = svc.bufferMultiplier(&pb.CheckBalanceRequest{BufferMultiplier: proto.Float64(1)})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, m)
+}
+
+func TestBufferMultiplier_Strategies(t *testing.T) {
+	req := &pb.CheckBalanceRequest{Metadata: &pb.RequestMetadata{Model: "gpt-4o", MaxTokens: 500}}
+
+	flat := NewBalanceService(nil, authtest.New(), zerolog.Nop())
+	m, err := flat.bufferMultiplier(req)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBufferMultiplier, m)
+
+	adaptive := NewBalanceService(nil, authtest.New(), zerolog.Nop(), WithBufferStrategy(ModelBufferStrategy{
+		Models:           map[string]float64{"gpt-4o": 1.5},
+		Default:          1.1,
+		UnknownMaxTokens: 3,
+	}))
+	m, err = adaptive.bufferMultiplier(req)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, m)
+
+	m, err = adaptive.bufferMultiplier(&pb.CheckBalanceRequest{Metadata: &pb.RequestMetadata{Model: "gpt-3.5-turbo", MaxTokens: 500}})
+	require.NoError(t, err)
+	assert.Equal(t, 1.1, m)
+
+	// No max_tokens: the completion could be any length
+	m, err = adaptive.bufferMultiplier(&pb.CheckBalanceRequest{Metadata: &pb.RequestMetadata{Model: "gpt-4o"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, m)
+
+	// A multiplier the request sends still wins
+	m, err = adaptive.bufferMultiplier(&pb.CheckBalanceRequest{BufferMultiplier: proto.Float64(1), Metadata: req.Metadata})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, m)
+}
+
+func TestBufferMultiplier_StrategyOutOfRange(t *testing.T) {
+	svc := NewBalanceService(nil, authtest.New(), zerolog.Nop(),
+		WithMaxBufferMultiplier(2), WithBufferStrategy(FlatBufferStrategy(5)))
+
+	m, err := svc.bufferMultiplier(&pb.CheckBalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBufferMultiplier, m)
+
+	svc = NewBalanceService(nil, authtest.New(), zerolog.Nop(), WithBufferStrategy(FlatBufferStrategy(0.5)))
+	m, err = svc.bufferMultiplier(&pb.CheckBalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBufferMultiplier, m, "a strategy can't under-reserve")
+}
+
+func TestDeductTokens_TokensConsumedPresence(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// Both are rejected before the ledger is touched, for different reasons.
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	req := &pb.DeductTokensRequest{
+		CustomerId: "cus_1", RequestId: "req_1", RequestToken: svc.generateRequestToken("req_1", "cus_1"),
+	}
+
+	_, err := svc.DeductTokens(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "tokens_consumed is required")
+
+	req.TokensConsumed = proto.Int32(0)
+	_, err = svc.DeductTokens(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "tokens_consumed must be positive")
+}
+
+func TestModalityTokens_Validation(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// Rejected before the ledger is touched
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	_, err := svc.DeductTokens(ctx, &pb.DeductTokensRequest{
+		CustomerId: "cus_1", RequestId: "req_1", RequestToken: svc.generateRequestToken("req_1", "cus_1"),
+		TokensConsumed: proto.Int32(50),
+		ModalityTokens: &pb.ModalityTokens{ImageTokens: 40, AudioTokens: 20},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "invalid modality_tokens")
+
+	_, err = svc.FinalizeRequest(ctx, &pb.FinalizeRequestRequest{
+		CustomerId: "cus_1", RequestId: "req_1", Status: pb.RequestStatus_COMPLETED_SUCCESS,
+		ActualPromptTokens: 100, ActualCompletionTokens: 10,
+		CompletionModalityTokens: &pb.ModalityTokens{AudioTokens: -1},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "invalid completion_modality_tokens")
+
+	// Unset is all text
+	assert.Equal(t, ledger.ModalityTokens{}, modalityTokens(nil))
+	assert.Equal(t, ledger.ModalityTokens{ImageTokens: 4000}, modalityTokens(&pb.ModalityTokens{ImageTokens: 4000}))
+}
+
+func TestBatchFinalize_ValidatesLikeFinalizeRequest(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// Every entry fails validation, so the ledger is never touched
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	resp, err := svc.BatchFinalize(ctx, &pb.BatchFinalizeRequest{Requests: []*pb.FinalizeRequestRequest{
+		{
+			CustomerId: "cus_1", RequestId: "req_modality", Status: pb.RequestStatus_COMPLETED_SUCCESS,
+			ActualPromptTokens:   100,
+			PromptModalityTokens: &pb.ModalityTokens{ImageTokens: 150},
+		},
+		{
+			CustomerId: "cus_1", RequestId: "req_negative", Status: pb.RequestStatus_COMPLETED_SUCCESS,
+			TotalActualCostGrains: -1,
+		},
+		{
+			CustomerId: "cus_1", RequestId: "req_override", Status: pb.RequestStatus_COMPLETED_SUCCESS,
+			GrainCostOverride: proto.Int64(10),
+		},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Results["req_modality"].ErrorCode)
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Results["req_negative"].ErrorCode)
+	assert.Equal(t, "PERMISSION_DENIED", resp.Results["req_override"].ErrorCode)
+}
+
+func TestCheckBalanceAndDeduct_Validation(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// All rejected before the ledger is touched
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	check := &pb.CheckBalanceRequest{CustomerId: "cus_1", RequestId: "req_1", EstimatedGrains: 100}
+	first := &pb.DeductTokensRequest{TokensConsumed: proto.Int32(50), Model: "gpt-4"}
+
+	tests := []struct {
+		name    string
+		req     *pb.CheckBalanceAndDeductRequest
+		message string
+	}{
+		{"no check", &pb.CheckBalanceAndDeductRequest{FirstDeduction: first}, "check is required"},
+		{"no deduction", &pb.CheckBalanceAndDeductRequest{Check: check}, "first_deduction is required"},
+		{
+			"dry run",
+			&pb.CheckBalanceAndDeductRequest{
+				Check:          &pb.CheckBalanceRequest{CustomerId: "cus_1", RequestId: "req_1", EstimatedGrains: 100, DryRun: true},
+				FirstDeduction: first,
+			},
+			"dry_run",
+		},
+		{
+			"no tokens",
+			&pb.CheckBalanceAndDeductRequest{Check: check, FirstDeduction: &pb.DeductTokensRequest{Model: "gpt-4"}},
+			"tokens_consumed is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.CheckBalanceAndDeduct(ctx, tt.req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.Contains(t, status.Convert(err).Message(), tt.message)
+		})
+	}
+}
+
+func TestCheckBalance_EndUserIDLength(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer sk_valid"))
+
+	// Rejected before the ledger is touched: it wouldn't fit requests.end_user_id.
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	_, err := svc.CheckBalance(ctx, &pb.CheckBalanceRequest{
+		CustomerId: "cus_1", RequestId: "req_1", EstimatedGrains: 100,
+		Metadata: &pb.RequestMetadata{Model: "gpt-4", EndUserId: strings.Repeat("u", maxEndUserIDLength+1)},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestAdjustBalance_RecordsAdminAudit(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_admin", "admin_1"))
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_user", "user_1"))
+	fake.Grant("admin_1", auth.ScopeAdmin)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	var recorded []ledger.AdminAction
+	auditErr := errors.New("connection refused")
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	svc.recordAdminAction = func(_ context.Context, a ledger.AdminAction) error {
+		recorded = append(recorded, a)
+		return auditErr
+	}
+
+	req := &pb.AdjustBalanceRequest{
+		CustomerId: "cus_1", DeltaGrains: -500, Reason: "duplicate charge", Operator: "support@example.com",
+	}
+
+	// Callers without the admin scope leave no row.
+	_, err := svc.AdjustBalance(withKey("sk_user"), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Empty(t, recorded)
+
+	// The row names the authenticated platform user; the operator the
+	// caller claims is kept with the params. No row, no adjustment: the
+	// ledger is never reached.
+	_, err = svc.AdjustBalance(withKey("sk_admin"), req)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	require.Len(t, recorded, 1)
+	assert.Equal(t, ledger.AdminAction{
+		Operator:   "admin_1",
+		Action:     "AdjustBalance",
+		CustomerID: "cus_1",
+		Params: map[string]interface{}{
+			"delta_grains": int64(-500),
+			"reason":       "duplicate charge",
+			"operator":     "support@example.com",
+			"bucket":       "",
+		},
+	}, recorded[0])
+}
+
+func TestRequireAdmin_WritesAuditLog(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_admin", "admin_1"))
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_user", "user_1"))
+	fake.Grant("admin_1", auth.ScopeAdmin)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	svc := NewBalanceService(nil, fake, zerolog.Nop(), WithAuditLogger(audit.NewLogger(sink, zerolog.Nop())))
+	svc.recordAdminAction = func(context.Context, ledger.AdminAction) error { return nil }
+
+	_, err = svc.requireAdmin(withKey("sk_user"), "AdjustBalance", "cus_1", nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	userID, err := svc.requireAdmin(withKey("sk_admin"), "AdjustBalance", "cus_1",
+		map[string]interface{}{"delta_grains": int64(-500), "reason": "duplicate charge"})
+	require.NoError(t, err)
+	assert.Equal(t, "admin_1", userID)
+
+	events, err := sink.Events(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, audit.TypeAdminDenied, events[0].Type)
+	assert.Equal(t, audit.TypeAdminAction, events[1].Type)
+	assert.Equal(t, "admin_1", events[1].Actor)
+	assert.Equal(t, map[string]string{"method": "AdjustBalance", "delta_grains": "-500", "reason": "duplicate charge"}, events[1].Detail)
+	assert.NoError(t, audit.Verify(events))
+}
+
+func TestRetryableError(t *testing.T) {
+	err := retryableError(codes.Unavailable, 4*time.Second, "failed to record reservation: %v", "db down")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "db down")
+	delay, ok := RetryDelay(err)
+	require.True(t, ok)
+	assert.Equal(t, 4*time.Second, delay)
+
+	// A healthy backoff state still asks for a sensible wait
+	delay, ok = RetryDelay(retryableError(codes.ResourceExhausted, 0, "slow down"))
+	require.True(t, ok)
+	assert.Equal(t, minRetryDelay, delay)
+
+	_, ok = RetryDelay(status.Error(codes.Unavailable, "no hint"))
+	assert.False(t, ok)
+	_, ok = RetryDelay(errors.New("not a status"))
+	assert.False(t, ok)
+}
+
+// trailerStream captures what a handler sets with grpc.SetTrailer.
+type trailerStream struct {
+	trailer metadata.MD
+}
+
+func (s *trailerStream) Method() string               { return "/balance.v1.BalanceService/DeductTokens" }
+func (s *trailerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *trailerStream) SendHeader(metadata.MD) error { return nil }
+
+func (s *trailerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+func TestTimingUnaryServerInterceptor(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	interceptor := TimingUnaryServerInterceptor()
+
+	call := func(handler grpc.UnaryHandler) metadata.MD {
+		stream := &trailerStream{}
+		ctx := grpc.NewContextWithServerTransportStream(
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer sk_valid")),
+			stream)
+		interceptor(ctx, &pb.DeductTokensRequest{}, &grpc.UnaryServerInfo{}, handler)
+		return stream.trailer
+	}
+	millis := func(md metadata.MD, key string) float64 {
+		t.Helper()
+		require.Len(t, md.Get(key), 1, key)
+		ms, err := strconv.ParseFloat(md.Get(key)[0], 64)
+		require.NoError(t, err)
+		return ms
+	}
+
+	t.Run("failed call is timed", func(t *testing.T) {
+		trailer := call(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return svc.DeductTokens(ctx, req.(*pb.DeductTokensRequest))
+		})
+		assert.Greater(t, millis(trailer, TimingTotalKey), 0.0)
+		assert.Zero(t, millis(trailer, TimingRedisKey), "the ledger was never reached")
+	})
+
+	t.Run("redis time is part of the total", func(t *testing.T) {
+		trailer := call(func(ctx context.Context, req interface{}) (interface{}, error) {
+			start := time.Now()
+			defer recordTotalTime(ctx, start)
+
+			ledgerStart := time.Now()
+			time.Sleep(5 * time.Millisecond)
+			addRedisTime(ctx, ledgerStart)
+			return nil, nil
+		})
+		redisMS, total := millis(trailer, TimingRedisKey), millis(trailer, TimingTotalKey)
+		assert.GreaterOrEqual(t, redisMS, 5.0)
+		assert.GreaterOrEqual(t, total, redisMS)
+		assert.Less(t, total, 1000.0)
+	})
+
+	t.Run("untimed call sends nothing", func(t *testing.T) {
+		trailer := call(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return svc.GetBalance(ctx, &pb.GetBalanceRequest{})
+		})
+		assert.Empty(t, trailer)
+	})
+}
+
+func TestLimitCustomProperties(t *testing.T) {
+	props := map[string]string{
+		"a_team":    "search",
+		"b_feature": "summarize",
+		"c_trace":   strings.Repeat("x", 40),
+	}
+	req := &pb.CheckBalanceRequest{
+		CustomerId: "cus_1", RequestId: "req_1", EstimatedGrains: 100,
+		Metadata: &pb.RequestMetadata{CustomProperties: props},
+	}
+
+	t.Run("within limits", func(t *testing.T) {
+		svc := NewBalanceService(nil, authtest.New(), zerolog.Nop())
+		got, err := svc.limitCustomProperties(req)
+		require.NoError(t, err)
+		assert.Equal(t, props, got)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		fake := authtest.New()
+		require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+		ctx := metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer sk_valid"))
+
+		// Rejected before the ledger is touched
+		for _, svc := range []*BalanceService{
+			NewBalanceService(nil, fake, zerolog.Nop(), WithCustomPropertyLimits(2, 0)),
+			NewBalanceService(nil, fake, zerolog.Nop(), WithCustomPropertyLimits(0, 64)),
+		} {
+			_, err := svc.CheckBalance(ctx, req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.Contains(t, err.Error(), "custom_properties exceed the limit")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		svc := NewBalanceService(nil, authtest.New(), zerolog.Nop(),
+			WithCustomPropertyLimits(2, 0), WithTruncateCustomProperties(true))
+		got, err := svc.limitCustomProperties(req)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"a_team": "search", "b_feature": "summarize"}, got)
+
+		// A property too big to fit is skipped, later ones still kept
+		svc = NewBalanceService(nil, authtest.New(), zerolog.Nop(),
+			WithCustomPropertyLimits(0, 30), WithTruncateCustomProperties(true))
+		got, err = svc.limitCustomProperties(&pb.CheckBalanceRequest{Metadata: &pb.RequestMetadata{
+			CustomProperties: map[string]string{"a_team": "search", "b_trace": strings.Repeat("x", 40), "c_env": "prod"},
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"a_team": "search", "c_env": "prod"}, got)
+	})
+}
+
+func TestAdminQuery_RequiresAdminAndAudits(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_user", "user_1"))
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_admin", "admin_1"))
+	fake.Grant("admin_1", auth.ScopeAdmin)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs("authorization", "Bearer "+key))
+	}
+
+	var recorded []ledger.AdminAction
+	svc := NewBalanceService(nil, fake, zerolog.Nop())
+	svc.recordAdminAction = func(_ context.Context, a ledger.AdminAction) error {
+		recorded = append(recorded, a)
+		return nil
+	}
+
+	_, err := svc.AdminQuery(withKey("sk_user"), &pb.AdminQueryRequest{
+		Query: pb.AdminQueryKind_ADMIN_QUERY_KIND_TOP_SPENDERS,
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Empty(t, recorded)
+
+	// Validation failures are still audited; the ledger is never reached
+	_, err = svc.AdminQuery(withKey("sk_admin"), &pb.AdminQueryRequest{
+		Query: pb.AdminQueryKind_ADMIN_QUERY_KIND_RECENT_REQUESTS, From: 1760000000, Limit: 20,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Len(t, recorded, 1)
+	assert.Equal(t, ledger.AdminAction{
+		Operator: "admin_1",
+		Action:   "AdminQuery",
+		Params: map[string]interface{}{
+			"query": "ADMIN_QUERY_KIND_RECENT_REQUESTS",
+			"from":  int64(1760000000),
+			"to":    int64(0),
+			"limit": int32(20),
+		},
+	}, recorded[0])
+
+	// Only the predefined queries exist
+	for _, kind := range []pb.AdminQueryKind{pb.AdminQueryKind_ADMIN_QUERY_KIND_UNSPECIFIED, pb.AdminQueryKind(99)} {
+		_, err = svc.AdminQuery(withKey("sk_admin"), &pb.AdminQueryRequest{Query: kind, CustomerId: "cus_1"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestSuggestedAction(t *testing.T) {
+	svc := NewBalanceService(nil, authtest.New(), zerolog.Nop(), WithSuggestedActionThresholds(10_000, 1_000))
+
+	tests := []struct {
+		name   string
+		result *ledger.DeductionResult
+		want   pb.SuggestedAction
+	}{
+		{
+			name:   "plenty left",
+			result: &ledger.DeductionResult{Success: true, RemainingBalance: 50_000},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE,
+		},
+		{
+			name:   "at the downgrade threshold",
+			result: &ledger.DeductionResult{Success: true, RemainingBalance: 10_000},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE,
+		},
+		{
+			name:   "below the downgrade threshold",
+			result: &ledger.DeductionResult{Success: true, RemainingBalance: 9_999},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_DOWNGRADE,
+		},
+		{
+			name:   "below the kill threshold",
+			result: &ledger.DeductionResult{Success: true, RemainingBalance: 999},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_KILL,
+		},
+		{
+			name:   "on kill grace",
+			result: &ledger.DeductionResult{Success: true, RemainingBalance: -200, RemainingGraceGrains: 300},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_KILL,
+		},
+		{
+			name:   "deduction failed",
+			result: &ledger.DeductionResult{ErrorCode: "INSUFFICIENT_BALANCE", RemainingBalance: 50_000},
+			want:   pb.SuggestedAction_SUGGESTED_ACTION_KILL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := svc.deductTokensResponse(&pb.DeductTokensRequest{CustomerId: "cus_1", RequestId: "req_1"},
+				ledger.DeductionRequest{}, tt.result)
+			assert.Equal(t, tt.want, resp.SuggestedAction)
+
+			// The hint never changes the outcome
+			assert.Equal(t, tt.result.Success, resp.Success)
+			assert.Equal(t, tt.result.RemainingBalance, resp.RemainingBalance)
+		})
+	}
+
+	t.Run("thresholds off", func(t *testing.T) {
+		svc := NewBalanceService(nil, authtest.New(), zerolog.Nop())
+		for balance, want := range map[int64]pb.SuggestedAction{
+			1:    pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE,
+			-200: pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE,
+		} {
+			assert.Equal(t, want, svc.suggestedAction(&ledger.DeductionResult{Success: true, RemainingBalance: balance}))
+		}
+		assert.Equal(t, pb.SuggestedAction_SUGGESTED_ACTION_KILL, svc.suggestedAction(&ledger.DeductionResult{}))
+	})
+}
+
+func TestLedgerError(t *testing.T) {
+	tests := []struct {
+		sentinel error
+		code     codes.Code
+	}{
+		{ledger.ErrRedisUnavailable, codes.Unavailable},
+		{ledger.ErrScriptFailed, codes.Internal},
+		{ledger.ErrCustomerNotFound, codes.NotFound},
+		{ledger.ErrInsufficientBalance, codes.FailedPrecondition},
+		{errors.New("something else"), codes.Internal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sentinel.Error(), func(t *testing.T) {
+			err := ledgerError(fmt.Errorf("wrapped: %w", tt.sentinel), "failed to deduct tokens")
+			assert.Equal(t, tt.code, status.Code(err))
+			assert.Contains(t, status.Convert(err).Message(), "failed to deduct tokens: wrapped: ")
+
+			_, retryable := RetryDelay(err)
+			assert.Equal(t, tt.code == codes.Unavailable, retryable)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+// BufferStrategy chooses the buffer multiplier for a CheckBalance that
+// leaves buffer_multiplier unset. model and maxTokens come from the
+// request's metadata, and are empty and 0 when it has none.
+//
+// A multiplier outside [1, max buffer multiplier] is ignored in favour of
+// DefaultBufferMultiplier, so a misconfigured strategy can't under-reserve.
+type BufferStrategy interface {
+	Multiplier(model string, maxTokens int32) float64
+}
+
+// FlatBufferStrategy applies the same multiplier to every request. The
+// default is FlatBufferStrategy(DefaultBufferMultiplier).
+type FlatBufferStrategy float64
+
+// Multiplier implements BufferStrategy.
+func (f FlatBufferStrategy) Multiplier(string, int32) float64 {
+	return float64(f)
+}
+
+// ModelBufferStrategy buffers each model by how far its estimates tend to
+// be off. A request that doesn't say how many tokens it may generate gets
+// UnknownMaxTokens instead, as its completion could be any length.
+type ModelBufferStrategy struct {
+	// Models maps a model name to its multiplier.
+	Models map[string]float64
+
+	// Default applies to models not in Models (0 = DefaultBufferMultiplier).
+	Default float64
+
+	// UnknownMaxTokens applies, whatever the model, when max_tokens is
+	// unset (0 = use the model's multiplier).
+	UnknownMaxTokens float64
+}
+
+// Multiplier implements BufferStrategy.
+func (s ModelBufferStrategy) Multiplier(model string, maxTokens int32) float64 {
+	if maxTokens <= 0 && s.UnknownMaxTokens > 0 {
+		return s.UnknownMaxTokens
+	}
+	if m, ok := s.Models[model]; ok {
+		return m
+	}
+	if s.Default > 0 {
+		return s.Default
+	}
+	return DefaultBufferMultiplier
+}
+
+// WithBufferStrategy picks the buffer multiplier of requests that don't
+// send one with bs instead of always using DefaultBufferMultiplier. A nil
+// bs is ignored.
+func WithBufferStrategy(bs BufferStrategy) Option {
+	return func(s *BalanceService) {
+		if bs != nil {
+			s.bufferStrategy = bs
+		}
+	}
+}
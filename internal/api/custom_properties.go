@@ -0,0 +1,75 @@
+package api
+
+import (
+	"sort"
+
+	pb "github.com/Beam/backend/pkg/proto/balance/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Custom property limits (CheckBalanceRequest.metadata.custom_properties).
+// The properties are stored on the request hash in Redis and on the
+// request's row, so an unbounded map from a client would bloat both.
+const (
+	DefaultMaxCustomProperties    = 50
+	DefaultMaxCustomPropertyBytes = 8 << 10
+)
+
+// limitCustomProperties returns req's custom_properties within the limits.
+// Over them, it rejects the request with InvalidArgument or, with
+// truncation on, keeps the properties that fit in key order and drops the
+// rest.
+func (s *BalanceService) limitCustomProperties(req *pb.CheckBalanceRequest) (map[string]string, error) {
+	props := req.GetMetadata().GetCustomProperties()
+
+	maxCount := s.maxCustomProperties
+	if maxCount == 0 {
+		maxCount = DefaultMaxCustomProperties
+	}
+	maxBytes := s.maxCustomPropertyBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxCustomPropertyBytes
+	}
+
+	size := 0
+	for k, v := range props {
+		size += len(k) + len(v)
+	}
+	if len(props) <= maxCount && size <= maxBytes {
+		return props, nil
+	}
+
+	if !s.truncateCustomProperties {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"custom_properties exceed the limit of %d properties and %d bytes", maxCount, maxBytes)
+	}
+
+	// Key order, so the same properties are always kept
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kept := make(map[string]string, maxCount)
+	size = 0
+	for _, k := range keys {
+		if len(kept) == maxCount {
+			break
+		}
+		if n := len(k) + len(props[k]); size+n <= maxBytes {
+			kept[k] = props[k]
+			size += n
+		}
+	}
+
+	s.log.Warn().
+		Str("customer_id", req.CustomerId).
+		Str("request_id", req.RequestId).
+		Int("custom_properties", len(props)).
+		Int("dropped", len(props)-len(kept)).
+		Msg("custom_properties truncated")
+
+	return kept, nil
+}
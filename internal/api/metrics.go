@@ -0,0 +1,26 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Deduction pricing paths, the values of the path label on
+// deductPricingTotal.
+const (
+	// pricingProvided: the SDK sent grain_cost, no pricing lookup.
+	pricingProvided = "provided"
+
+	// pricingComputed: priced server-side from model_pricing.
+	pricingComputed = "computed"
+
+	// pricingOverride: grain_cost_override from a cost_override key.
+	pricingOverride = "override"
+)
+
+// deductPricingTotal counts DeductTokens calls by how the grain cost was
+// arrived at, so operators can see how often the SDK fast path is taken.
+var deductPricingTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "consonant_deduct_pricing_total",
+	Help: "DeductTokens calls by pricing path (provided, computed, override).",
+}, []string{"path"})
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// minRetryDelay is the shortest retry hint sent. Retry-After has whole
+// second resolution, and clients retrying sooner than this would mostly
+// hit the same condition.
+const minRetryDelay = time.Second
+
+// killStreamRetryDelay is the hint for reconnecting an interrupted
+// WatchKillSignals stream. Nothing tracks why the subscription dropped, so
+// there is no state to derive it from.
+const killStreamRetryDelay = time.Second
+
+// redisRetryDelay is the hint for a call that failed because Redis was
+// unavailable (ledger.ErrRedisUnavailable). A dropped connection or a
+// failover usually clears within about this long.
+const redisRetryDelay = time.Second
+
+// retryableError returns a status error carrying a google.rpc.RetryInfo
+// detail that tells the client how long to wait before retrying. Delays
+// under minRetryDelay are raised to it.
+//
+// Use it for codes.Unavailable and codes.ResourceExhausted, the codes
+// SDKs retry on, with a delay taken from whatever state made the call
+// fail.
+func retryableError(code codes.Code, delay time.Duration, format string, args ...interface{}) error {
+	if delay < minRetryDelay {
+		delay = minRetryDelay
+	}
+
+	st := status.New(code, fmt.Sprintf(format, args...))
+	withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if err != nil {
+		// Only fails if the detail can't be marshaled
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// RetryDelay returns the retry hint carried by a status error (see
+// retryableError), if any.
+func RetryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// requestExistsReason is the google.rpc.ErrorInfo reason on the
+// ALREADY_EXISTS error for a duplicate request ID.
+const requestExistsReason = "REQUEST_EXISTS"
+
+// requestExistsError returns the ALREADY_EXISTS error for a request ID that
+// already has a reservation. It carries a google.rpc.ErrorInfo detail with
+// the request's token in its "request_token" metadata, so a client retrying
+// a CheckBalance whose response it lost can carry on with the original
+// reservation.
+func requestExistsError(requestID, requestToken string) error {
+	st := status.New(codes.AlreadyExists, fmt.Sprintf("request %s already has a reservation", requestID))
+	withInfo, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   requestExistsReason,
+		Metadata: map[string]string{"request_token": requestToken},
+	})
+	if err != nil {
+		// Only fails if the detail can't be marshaled
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// ExistingRequestToken returns the request token carried by an
+// ALREADY_EXISTS error (see requestExistsError), if any.
+func ExistingRequestToken(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return "", false
+	}
+
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.GetReason() == requestExistsReason {
+			token, ok := info.GetMetadata()["request_token"]
+			return token, ok
+		}
+	}
+	return "", false
+}
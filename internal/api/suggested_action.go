@@ -0,0 +1,20 @@
+package api
+
+import (
+	"github.com/Beam/backend/internal/ledger"
+	pb "github.com/Beam/backend/pkg/proto/balance/v1"
+)
+
+// suggestedAction returns the DeductTokens hint for result. It doesn't
+// affect the deduction, which the ledger has already made or refused.
+func (s *BalanceService) suggestedAction(result *ledger.DeductionResult) pb.SuggestedAction {
+	switch {
+	case !result.Success:
+		return pb.SuggestedAction_SUGGESTED_ACTION_KILL
+	case s.killBelowGrains > 0 && result.RemainingBalance < s.killBelowGrains:
+		return pb.SuggestedAction_SUGGESTED_ACTION_KILL
+	case s.downgradeBelowGrains > 0 && result.RemainingBalance < s.downgradeBelowGrains:
+		return pb.SuggestedAction_SUGGESTED_ACTION_DOWNGRADE
+	}
+	return pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Latency attribution keys, sent as gRPC trailers (REST response headers)
+// by CheckBalance, DeductTokens, CheckBalanceAndDeduct, FinalizeRequest and
+// BatchFinalize when timing is enabled. Values are milliseconds with three
+// decimals.
+const (
+	TimingRedisKey = "x-ledger-redis-ms"
+	TimingTotalKey = "x-ledger-total-ms"
+)
+
+// Timing is where one call's time went, for SDK developers chasing latency.
+// Total minus Redis is the server's own overhead: auth, validation and
+// pricing.
+type Timing struct {
+	// Redis is the time spent in the call's ledger operation: its Redis
+	// script plus queueing the PostgreSQL write, or making it with sync
+	// writes on.
+	Redis time.Duration
+
+	// Total is the handler's time, from its start until it returned.
+	Total time.Duration
+}
+
+type timingKey struct{}
+
+// ContextWithTiming returns a context that the BalanceService handlers
+// above record their Timing into. Without one they record nothing, so
+// timing costs nothing unless enabled.
+func ContextWithTiming(ctx context.Context) (context.Context, *Timing) {
+	t := &Timing{}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+// addRedisTime adds the time since start to ctx's Timing, if any.
+func addRedisTime(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(timingKey{}).(*Timing); ok {
+		t.Redis += time.Since(start)
+	}
+}
+
+// recordTotalTime sets ctx's Timing, if any, to the time since start. Call
+// it deferred, so error returns are timed too.
+func recordTotalTime(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(timingKey{}).(*Timing); ok {
+		t.Total = time.Since(start)
+	}
+}
+
+// Recorded reports whether a handler recorded t. Calls that aren't timed,
+// or were rejected before reaching a handler, have nothing to send.
+func (t *Timing) Recorded() bool {
+	return t.Total > 0
+}
+
+// Metadata returns t under TimingRedisKey and TimingTotalKey.
+func (t *Timing) Metadata() metadata.MD {
+	return metadata.Pairs(
+		TimingRedisKey, formatMillis(t.Redis),
+		TimingTotalKey, formatMillis(t.Total),
+	)
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// TimingUnaryServerInterceptor sends each timed call's Timing as trailing
+// metadata. Trailers go out with the status, so failed calls carry them too.
+func TimingUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, t := ContextWithTiming(ctx)
+		resp, err := handler(ctx, req)
+		if t.Recorded() {
+			grpc.SetTrailer(ctx, t.Metadata())
+		}
+		return resp, err
+	}
+}
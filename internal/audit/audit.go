@@ -0,0 +1,215 @@
+// Package audit writes the security audit trail: authentication failures
+// and admin operations, kept apart from the operational logs in a sink of
+// their own (a file or the audit_log table).
+//
+// Entries form a hash chain. Each entry's Hash is the SHA-256 of its
+// contents and the previous entry's hash, so altering, inserting or
+// removing an entry breaks the chain from that point on, and Verify says
+// where. The chain doesn't stop someone who can rewrite the whole sink from
+// recomputing every hash; ship the sink somewhere append-only (or record the
+// latest hash elsewhere) if that matters.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Event types written by the server.
+const (
+	// TypeAuthFailure is an API key that failed validation.
+	TypeAuthFailure = "auth_failure"
+
+	// TypeAdminAction is an admin operation about to run.
+	TypeAdminAction = "admin_action"
+
+	// TypeAdminDenied is an admin RPC refused for lack of the admin scope.
+	TypeAdminDenied = "admin_denied"
+)
+
+// GenesisHash is the PrevHash of the first entry in a chain.
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// DefaultRateLimit is how many rate-limited events (see Logger.TryRecord)
+// are written per second by default.
+const DefaultRateLimit = 100
+
+// Event is one audit entry.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// Actor is who acted: a platform user ID, a CLI operator, or for
+	// an auth failure the truncated hash of the key presented.
+	Actor string `json:"actor,omitempty"`
+
+	// CustomerID is the customer acted on, if any.
+	CustomerID string `json:"customer_id,omitempty"`
+
+	// Detail describes the event (method, reason, params, ...).
+	Detail map[string]string `json:"detail,omitempty"`
+
+	// PrevHash and Hash link the entry into the chain (see Seal).
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Seal links e to the entry before it, whose hash is prevHash, and sets its
+// Hash. Sinks call it under their own lock, so concurrent writers extend a
+// single chain.
+func (e *Event) Seal(prevHash string) {
+	e.PrevHash = prevHash
+	e.Hash = e.computeHash()
+}
+
+// computeHash hashes e's JSON encoding without its own Hash. Time is kept
+// in UTC to the microsecond (see Logger.record), so an entry read back from
+// a file or PostgreSQL encodes, and hashes, the same as when it was written.
+func (e Event) computeHash() string {
+	e.Hash = ""
+	e.Time = e.Time.UTC()
+	encoded, _ := json.Marshal(e) // only strings and a time; can't fail
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// ChainError reports the first entry at which a chain doesn't verify.
+type ChainError struct {
+	// Index is the entry's position in the slice given to Verify.
+	Index  int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at entry %d: %s", e.Index, e.Reason)
+}
+
+// Verify checks that events, oldest first, form an unbroken chain from
+// GenesisHash: every entry's Hash matches its contents and its PrevHash is
+// the Hash before it. It returns a *ChainError for the first entry that
+// doesn't.
+func Verify(events []Event) error {
+	prev := GenesisHash
+	for i, e := range events {
+		if e.PrevHash != prev {
+			return &ChainError{Index: i, Reason: "previous hash does not match"}
+		}
+		if e.computeHash() != e.Hash {
+			return &ChainError{Index: i, Reason: "hash does not match contents"}
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// Sink stores audit entries.
+type Sink interface {
+	// Append seals e (see Event.Seal) against the last entry stored and
+	// stores it, atomically with respect to every other writer.
+	Append(ctx context.Context, e *Event) error
+
+	// Events returns every entry stored, oldest first.
+	Events(ctx context.Context) ([]Event, error)
+}
+
+// Logger writes audit events to a Sink.
+type Logger struct {
+	sink Sink
+	log  zerolog.Logger
+
+	// rateLimit is how many TryRecord events are written per second.
+	rateLimit int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowCount int
+	suppressed  int
+
+	now func() time.Time
+}
+
+// Option configures optional Logger behaviour.
+type Option func(*Logger)
+
+// WithRateLimit writes at most perSecond TryRecord events a second, so a
+// credential-stuffing burst can't flood the sink. Values below 1 keep
+// DefaultRateLimit.
+func WithRateLimit(perSecond int) Option {
+	return func(l *Logger) {
+		if perSecond >= 1 {
+			l.rateLimit = perSecond
+		}
+	}
+}
+
+// NewLogger creates a Logger writing to sink.
+func NewLogger(sink Sink, logger zerolog.Logger, opts ...Option) *Logger {
+	l := &Logger{
+		sink:      sink,
+		log:       logger.With().Str("component", "audit").Logger(),
+		rateLimit: DefaultRateLimit,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Record writes e, timestamped now, and returns an error if it couldn't.
+// It is never rate limited: callers record an admin operation before
+// performing it and refuse to go ahead if this fails.
+func (l *Logger) Record(ctx context.Context, e Event) error {
+	return l.record(ctx, e)
+}
+
+// TryRecord writes e unless this second's rate limit is used up, and only
+// logs a failure. Events dropped by the limit are counted, and the next one
+// written carries the count in its "suppressed" detail, so the gap is
+// visible in the chain.
+func (l *Logger) TryRecord(ctx context.Context, e Event) {
+	l.mu.Lock()
+	now := l.now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.windowCount = 0
+	}
+	if l.windowCount >= l.rateLimit {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	l.windowCount++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		detail := make(map[string]string, len(e.Detail)+1)
+		for k, v := range e.Detail {
+			detail[k] = v
+		}
+		detail["suppressed"] = strconv.Itoa(suppressed)
+		e.Detail = detail
+	}
+
+	if err := l.record(ctx, e); err != nil {
+		l.log.Error().Err(err).Str("type", e.Type).Msg("audit write failed")
+	}
+}
+
+func (l *Logger) record(ctx context.Context, e Event) error {
+	e.Time = l.now().UTC().Truncate(time.Microsecond)
+	if err := l.sink.Append(ctx, &e); err != nil {
+		return fmt.Errorf("append audit event failed: %w", err)
+	}
+	return nil
+}
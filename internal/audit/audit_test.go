@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSink_ChainVerifiesAndBreaksWhenAltered(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+	l := NewLogger(sink, zerolog.Nop())
+
+	require.NoError(t, l.Record(ctx, Event{Type: TypeAdminAction, Actor: "user_1", CustomerID: "cus_a",
+		Detail: map[string]string{"method": "AdjustBalance", "amount_grains": "5000"}}))
+	l.TryRecord(ctx, Event{Type: TypeAuthFailure, Actor: "3f9a1c2b...", Detail: map[string]string{"reason": "invalid API key"}})
+	require.NoError(t, l.Record(ctx, Event{Type: TypeAdminAction, Actor: "user_1", Detail: map[string]string{"method": "ListCustomers"}}))
+
+	events, err := sink.Events(ctx)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, GenesisHash, events[0].PrevHash)
+	assert.Equal(t, events[0].Hash, events[1].PrevHash)
+	require.NoError(t, Verify(events))
+
+	// Someone edits the adjustment amount in the file.
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(raw), `"5000"`, `"50"`, 1)), 0o600))
+
+	events, err = sink.Events(ctx)
+	require.NoError(t, err)
+	var chainErr *ChainError
+	require.ErrorAs(t, Verify(events), &chainErr)
+	assert.Equal(t, 0, chainErr.Index)
+
+	// Dropping an entry breaks the link to the one after it.
+	truncated := append([]Event(nil), events[1:]...)
+	require.ErrorAs(t, Verify(truncated), &chainErr)
+	assert.Equal(t, 0, chainErr.Index)
+	assert.Contains(t, chainErr.Error(), "previous hash")
+}
+
+func TestFileSink_ContinuesChainAfterReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, NewLogger(sink, zerolog.Nop()).Record(ctx, Event{Type: TypeAdminAction, Actor: "user_1"}))
+
+	// A restart opens the same file.
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, NewLogger(sink, zerolog.Nop()).Record(ctx, Event{Type: TypeAdminAction, Actor: "user_2"}))
+
+	events, err := sink.Events(ctx)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.NoError(t, Verify(events))
+}
+
+func TestTryRecord_RateLimitsAndReportsSuppressed(t *testing.T) {
+	ctx := context.Background()
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	l := NewLogger(sink, zerolog.Nop(), WithRateLimit(2))
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		l.TryRecord(ctx, Event{Type: TypeAuthFailure})
+	}
+
+	// Admin actions are never dropped.
+	require.NoError(t, l.Record(ctx, Event{Type: TypeAdminAction}))
+
+	now = now.Add(time.Second)
+	l.TryRecord(ctx, Event{Type: TypeAuthFailure, Detail: map[string]string{"reason": "missing authorization header"}})
+
+	events, err := sink.Events(ctx)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, TypeAdminAction, events[2].Type)
+	assert.Equal(t, map[string]string{"reason": "missing authorization header", "suppressed": "3"}, events[3].Detail)
+	assert.NoError(t, Verify(events))
+}
@@ -8,6 +8,9 @@
 // is making the request. We never store the actual key in plaintext - only
 // a SHA-256 hash of the key is stored in the database.
 //
+// UnaryServerInterceptor runs this for every RPC, so handlers only need
+// PlatformUserID (or ValidateAPIKey, which reuses its result).
+//
 // The authentication flow:
 // 1. Extract "authorization" header from gRPC metadata
 // 2. Parse the "Bearer <key>" format
@@ -26,26 +29,80 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/kelpejol/beam/internal/audit"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc/metadata"
 )
 
+// Scopes grant privileged capabilities to individual platform users.
+// They are stored in platform_users.scopes and synced to Redis with the keys.
+const (
+	// ScopeCostOverride allows a caller to set an explicit grain cost
+	// instead of having it derived from model pricing.
+	ScopeCostOverride = "cost_override"
+
+	// ScopeAdmin allows administrative operations such as adjusting a
+	// customer's balance by hand.
+	ScopeAdmin = "admin"
+)
+
+// ErrScopeDenied is returned by RequireScope when the caller authenticated
+// but lacks the scope.
+var ErrScopeDenied = errors.New("scope not granted")
+
 // Authenticator validates API keys and returns platform user IDs.
-type Authenticator struct {
+//
+// RedisAuthenticator is the production implementation; services depend on
+// this interface so they can be tested against the fake in authtest.
+type Authenticator interface {
+	// ValidateAPIKey returns the platform_user_id owning the API key in ctx.
+	ValidateAPIKey(ctx context.Context) (string, error)
+
+	// RequireScope is ValidateAPIKey that also requires the owner to hold
+	// scope, failing with an error wrapping ErrScopeDenied if they don't.
+	RequireScope(ctx context.Context, scope string) (string, error)
+
+	// StoreAPIKey registers apiKey as belonging to platformUserID.
+	StoreAPIKey(ctx context.Context, apiKey, platformUserID string) error
+}
+
+// RedisAuthenticator validates API keys against the hashes synced to Redis.
+type RedisAuthenticator struct {
 	redis *redis.Client
 	log   zerolog.Logger
+
+	// auditLog receives authentication failures (see WithAuditLogger)
+	auditLog *audit.Logger
 }
 
-// NewAuthenticator creates a new Authenticator instance.
-func NewAuthenticator(rdb *redis.Client, logger zerolog.Logger) *Authenticator {
-	return &Authenticator{
+var _ Authenticator = (*RedisAuthenticator)(nil)
+
+// Option configures optional RedisAuthenticator behaviour.
+type Option func(*RedisAuthenticator)
+
+// WithAuditLogger records every failed ValidateAPIKey in the security audit
+// trail, subject to its rate limit (see audit.Logger.TryRecord).
+func WithAuditLogger(l *audit.Logger) Option {
+	return func(a *RedisAuthenticator) {
+		a.auditLog = l
+	}
+}
+
+// NewAuthenticator creates a new RedisAuthenticator instance.
+func NewAuthenticator(rdb *redis.Client, logger zerolog.Logger, opts ...Option) *RedisAuthenticator {
+	a := &RedisAuthenticator{
 		redis: rdb,
 		log:   logger.With().Str("component", "authenticator").Logger(),
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 // ValidateAPIKey extracts and validates the API key from gRPC metadata.
@@ -57,30 +114,59 @@ func NewAuthenticator(rdb *redis.Client, logger zerolog.Logger) *Authenticator {
 //
 // Returns the platform_user_id if authentication succeeds, error otherwise.
 //
+// If UnaryServerInterceptor already authenticated the request, the
+// platform_user_id it stored is returned without another lookup.
+//
+// Failures are recorded in the audit trail, if there is one (see
+// WithAuditLogger).
+//
 // Performance: < 1ms typical (Redis lookup)
-func (a *Authenticator) ValidateAPIKey(ctx context.Context) (string, error) {
+func (a *RedisAuthenticator) ValidateAPIKey(ctx context.Context) (string, error) {
+	if userID, ok := PlatformUserID(ctx); ok {
+		return userID, nil
+	}
+
+	userID, keyHash, err := a.lookupAPIKey(ctx)
+	if err != nil && a.auditLog != nil {
+		actor := ""
+		if keyHash != "" {
+			actor = keyHash[:8] + "..."
+		}
+		a.auditLog.TryRecord(ctx, audit.Event{
+			Type:   audit.TypeAuthFailure,
+			Actor:  actor,
+			Detail: map[string]string{"reason": err.Error()},
+		})
+	}
+	return userID, err
+}
+
+// lookupAPIKey resolves the API key in ctx's metadata to its platform user.
+// It also returns the key's hash, once the key has been parsed, so a
+// failure can be attributed without the key itself.
+func (a *RedisAuthenticator) lookupAPIKey(ctx context.Context) (string, string, error) {
 	// Extract metadata from context
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return "", fmt.Errorf("missing metadata")
+		return "", "", fmt.Errorf("missing metadata")
 	}
 
 	// Get authorization header
 	authHeaders := md.Get("authorization")
 	if len(authHeaders) == 0 {
-		return "", fmt.Errorf("missing authorization header")
+		return "", "", fmt.Errorf("missing authorization header")
 	}
 
 	authHeader := authHeaders[0]
 
 	// Parse "Bearer <key>" format
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("invalid authorization format, expected 'Bearer <key>'")
+		return "", "", fmt.Errorf("invalid authorization format, expected 'Bearer <key>'")
 	}
 
 	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
 	if apiKey == "" {
-		return "", fmt.Errorf("empty API key")
+		return "", "", fmt.Errorf("empty API key")
 	}
 
 	// Hash the API key
@@ -95,14 +181,53 @@ func (a *Authenticator) ValidateAPIKey(ctx context.Context) (string, error) {
 	if err == redis.Nil {
 		// Key not found in Redis - this is an invalid API key
 		a.log.Warn().Str("key_hash", keyHash[:8]+"...").Msg("invalid API key")
-		return "", fmt.Errorf("invalid API key")
+		return "", keyHash, fmt.Errorf("invalid API key")
 	} else if err != nil {
 		// Redis error - log but don't expose details to client
 		a.log.Error().Err(err).Msg("redis lookup failed during auth")
-		return "", fmt.Errorf("authentication service unavailable")
+		return "", keyHash, fmt.Errorf("authentication service unavailable")
 	}
 
 	// Successfully authenticated
+	return userID, keyHash, nil
+}
+
+// HasScope reports whether a platform user has been granted a scope.
+//
+// Redis key: "platform_user:scopes:<user_id>" -> set of scope names
+func (a *RedisAuthenticator) HasScope(ctx context.Context, platformUserID, scope string) (bool, error) {
+	scopesKey := fmt.Sprintf("platform_user:scopes:%s", platformUserID)
+
+	ok, err := a.redis.SIsMember(ctx, scopesKey, scope).Result()
+	if err != nil {
+		a.log.Error().Err(err).Msg("redis lookup failed during scope check")
+		return false, fmt.Errorf("authentication service unavailable")
+	}
+
+	return ok, nil
+}
+
+// RequireScope validates the API key in ctx and checks that its owner has
+// been granted scope. Returns the platform_user_id on success, or an error
+// wrapping ErrScopeDenied if the key is valid but the scope is missing.
+func (a *RedisAuthenticator) RequireScope(ctx context.Context, scope string) (string, error) {
+	userID, err := a.ValidateAPIKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := a.HasScope(ctx, userID, scope)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		a.log.Warn().
+			Str("platform_user_id", userID).
+			Str("scope", scope).
+			Msg("scope denied")
+		return "", fmt.Errorf("%w: %s", ErrScopeDenied, scope)
+	}
+
 	return userID, nil
 }
 
@@ -120,7 +245,7 @@ func hashAPIKey(key string) string {
 //
 // In production, API keys would be generated by the platform backend and
 // stored during user registration. This function is for development/testing.
-func (a *Authenticator) StoreAPIKey(ctx context.Context, apiKey, platformUserID string) error {
+func (a *RedisAuthenticator) StoreAPIKey(ctx context.Context, apiKey, platformUserID string) error {
 	keyHash := hashAPIKey(apiKey)
 	redisKey := fmt.Sprintf("apikey:%s", keyHash)
 
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/kelpejol/beam/internal/audit"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func newTestAuthenticator(t *testing.T) (*RedisAuthenticator, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return NewAuthenticator(rdb, zerolog.Nop()), mr
+}
+
+func withKey(key string) context.Context {
+	return metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer "+key))
+}
+
+func TestRequireScope(t *testing.T) {
+	a, mr := newTestAuthenticator(t)
+
+	require.NoError(t, a.StoreAPIKey(context.Background(), "sk_flat", "user_flat"))
+	require.NoError(t, a.StoreAPIKey(context.Background(), "sk_plain", "user_plain"))
+	_, err := mr.SAdd("platform_user:scopes:user_flat", ScopeCostOverride)
+	require.NoError(t, err)
+
+	t.Run("granted", func(t *testing.T) {
+		userID, err := a.RequireScope(withKey("sk_flat"), ScopeCostOverride)
+		require.NoError(t, err)
+		assert.Equal(t, "user_flat", userID)
+	})
+
+	t.Run("not granted", func(t *testing.T) {
+		_, err := a.RequireScope(withKey("sk_plain"), ScopeCostOverride)
+		assert.ErrorIs(t, err, ErrScopeDenied)
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := a.RequireScope(withKey("sk_unknown"), ScopeCostOverride)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrScopeDenied)
+	})
+}
+
+func TestValidateAPIKey_AuditsFailures(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	a := NewAuthenticator(rdb, zerolog.Nop(), WithAuditLogger(audit.NewLogger(sink, zerolog.Nop())))
+	require.NoError(t, a.StoreAPIKey(context.Background(), "sk_good", "user_1"))
+
+	_, err = a.ValidateAPIKey(withKey("sk_good"))
+	require.NoError(t, err)
+	_, err = a.ValidateAPIKey(withKey("sk_unknown"))
+	require.Error(t, err)
+	_, err = a.ValidateAPIKey(context.Background())
+	require.Error(t, err)
+
+	events, err := sink.Events(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 2, "only failures are audited")
+	assert.Equal(t, audit.TypeAuthFailure, events[0].Type)
+	assert.Equal(t, hashAPIKey("sk_unknown")[:8]+"...", events[0].Actor)
+	assert.Equal(t, "invalid API key", events[0].Detail["reason"])
+	assert.Equal(t, "missing metadata", events[1].Detail["reason"])
+	assert.NoError(t, audit.Verify(events))
+}
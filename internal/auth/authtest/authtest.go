@@ -0,0 +1,100 @@
+// Package authtest provides an in-memory auth.Authenticator for tests of
+// code that authenticates requests, so they don't need a running Redis.
+package authtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kelpejol/beam/internal/auth"
+	"google.golang.org/grpc/metadata"
+)
+
+// Authenticator is a fake auth.Authenticator backed by maps.
+//
+// Like auth.RedisAuthenticator it reads a "Bearer <key>" authorization header
+// from the incoming gRPC metadata (or the platform_user_id the interceptor
+// stored), so tests pass credentials the same way real callers do.
+//
+// Set Err to make every call fail, e.g. to simulate the auth store being
+// unavailable.
+type Authenticator struct {
+	// Err, if set, is returned by every method.
+	Err error
+
+	mu     sync.Mutex
+	keys   map[string]string   // API key -> platform_user_id
+	scopes map[string][]string // platform_user_id -> granted scopes
+}
+
+var _ auth.Authenticator = (*Authenticator)(nil)
+
+// New returns an Authenticator with no keys.
+func New() *Authenticator {
+	return &Authenticator{
+		keys:   make(map[string]string),
+		scopes: make(map[string][]string),
+	}
+}
+
+// Grant gives a platform user scopes.
+func (a *Authenticator) Grant(platformUserID string, scopes ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.scopes[platformUserID] = append(a.scopes[platformUserID], scopes...)
+}
+
+// ValidateAPIKey implements auth.Authenticator.
+func (a *Authenticator) ValidateAPIKey(ctx context.Context) (string, error) {
+	if a.Err != nil {
+		return "", a.Err
+	}
+	if userID, ok := auth.PlatformUserID(ctx); ok {
+		return userID, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := md.Get("authorization")
+	if len(header) == 0 || !strings.HasPrefix(header[0], "Bearer ") {
+		return "", fmt.Errorf("missing authorization header")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	userID, ok := a.keys[strings.TrimPrefix(header[0], "Bearer ")]
+	if !ok {
+		return "", fmt.Errorf("invalid API key")
+	}
+	return userID, nil
+}
+
+// RequireScope implements auth.Authenticator.
+func (a *Authenticator) RequireScope(ctx context.Context, scope string) (string, error) {
+	userID, err := a.ValidateAPIKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.scopes[userID] {
+		if s == scope {
+			return userID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", auth.ErrScopeDenied, scope)
+}
+
+// StoreAPIKey implements auth.Authenticator.
+func (a *Authenticator) StoreAPIKey(ctx context.Context, apiKey, platformUserID string) error {
+	if a.Err != nil {
+		return a.Err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[apiKey] = platformUserID
+	return nil
+}
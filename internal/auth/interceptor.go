@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// platformUserKey is the context key for the authenticated platform_user_id.
+type platformUserKey struct{}
+
+// WithPlatformUserID returns ctx carrying an authenticated platform_user_id.
+func WithPlatformUserID(ctx context.Context, platformUserID string) context.Context {
+	return context.WithValue(ctx, platformUserKey{}, platformUserID)
+}
+
+// PlatformUserID returns the platform_user_id that UnaryServerInterceptor
+// authenticated for this request, if any.
+func PlatformUserID(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(platformUserKey{}).(string)
+	return userID, ok && userID != ""
+}
+
+// UnaryServerInterceptor validates the API key of every unary RPC before its
+// handler runs and stores the platform_user_id in the context (see
+// PlatformUserID), so no handler can forget to authenticate.
+//
+// Methods listed in publicMethods (full method names, e.g.
+// "/grpc.health.v1.Health/Check") are let through unauthenticated.
+func (a *RedisAuthenticator) UnaryServerInterceptor(publicMethods ...string) grpc.UnaryServerInterceptor {
+	public := make(map[string]bool, len(publicMethods))
+	for _, m := range publicMethods {
+		public[m] = true
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if public[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		userID, err := a.ValidateAPIKey(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+		}
+
+		return handler(WithPlatformUserID(ctx, userID), req)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming RPCs: the
+// API key is checked once when the stream opens, and the handler's stream
+// context carries the platform_user_id.
+func (a *RedisAuthenticator) StreamServerInterceptor(publicMethods ...string) grpc.StreamServerInterceptor {
+	public := make(map[string]bool, len(publicMethods))
+	for _, m := range publicMethods {
+		public[m] = true
+	}
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if public[info.FullMethod] {
+			return handler(srv, ss)
+		}
+
+		userID, err := a.ValidateAPIKey(ss.Context())
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: WithPlatformUserID(ss.Context(), userID)})
+	}
+}
+
+// authenticatedStream overrides a ServerStream's context with one carrying
+// the platform_user_id.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
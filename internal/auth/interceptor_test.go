@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	a, _ := newTestAuthenticator(t)
+	require.NoError(t, a.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+
+	interceptor := a.UnaryServerInterceptor("/grpc.health.v1.Health/Check")
+	finalize := &grpc.UnaryServerInfo{FullMethod: "/balance.v1.BalanceService/FinalizeRequest"}
+
+	var handlerCtx context.Context
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerCtx = ctx
+		return "ok", nil
+	}
+
+	t.Run("unauthenticated FinalizeRequest is rejected", func(t *testing.T) {
+		handlerCtx = nil
+		_, err := interceptor(context.Background(), nil, finalize, handler)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Nil(t, handlerCtx, "handler must not run")
+
+		_, err = interceptor(withKey("sk_unknown"), nil, finalize, handler)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Nil(t, handlerCtx, "handler must not run")
+	})
+
+	t.Run("authenticated call carries the platform user", func(t *testing.T) {
+		resp, err := interceptor(withKey("sk_valid"), nil, finalize, handler)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", resp)
+
+		userID, ok := PlatformUserID(handlerCtx)
+		assert.True(t, ok)
+		assert.Equal(t, "user_1", userID)
+
+		// Handlers calling ValidateAPIKey reuse the interceptor's result.
+		userID, err = a.ValidateAPIKey(handlerCtx)
+		require.NoError(t, err)
+		assert.Equal(t, "user_1", userID)
+	})
+
+	t.Run("public methods skip authentication", func(t *testing.T) {
+		health := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+		_, err := interceptor(context.Background(), nil, health, handler)
+		require.NoError(t, err)
+
+		_, ok := PlatformUserID(handlerCtx)
+		assert.False(t, ok)
+	})
+}
+
+// fakeStream is a grpc.ServerStream with only a context.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeStream) Context() context.Context { return s.ctx }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	a, _ := newTestAuthenticator(t)
+	require.NoError(t, a.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+
+	interceptor := a.StreamServerInterceptor()
+	watch := &grpc.StreamServerInfo{FullMethod: "/balance.v1.BalanceService/WatchKillSignals", IsServerStream: true}
+
+	var handlerCtx context.Context
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		handlerCtx = ss.Context()
+		return nil
+	}
+
+	err := interceptor(nil, &fakeStream{ctx: withKey("sk_unknown")}, watch, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, handlerCtx, "handler must not run")
+
+	require.NoError(t, interceptor(nil, &fakeStream{ctx: withKey("sk_valid")}, watch, handler))
+	userID, ok := PlatformUserID(handlerCtx)
+	assert.True(t, ok)
+	assert.Equal(t, "user_1", userID)
+}
@@ -0,0 +1,243 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// AdjustmentRequest contains parameters for AdjustBalance.
+type AdjustmentRequest struct {
+	CustomerID string
+
+	// DeltaGrains is added to the balance: positive to credit, negative to
+	// debit. It is in the customer's currency.
+	DeltaGrains int64
+
+	// Reason is recorded as the transaction description. Required.
+	Reason string
+
+	// Operator identifies who made the adjustment (e.g. a support agent's
+	// email). Required; recorded in the transaction metadata.
+	Operator string
+
+	// Bucket is the funding bucket to adjust (see FundingBuckets). Empty
+	// means BucketPaid. Crediting any other bucket splits a single-bucket
+	// customer's balance, with everything they already had staying in
+	// BucketPaid.
+	Bucket string
+}
+
+// AdjustmentResult contains the outcome of AdjustBalance.
+type AdjustmentResult struct {
+	TransactionID string
+
+	// NewBalance is the balance in Redis after the adjustment. It is only
+	// set when RedisApplied is true.
+	NewBalance int64
+
+	// RedisApplied is false when the customer's balance wasn't in Redis;
+	// the next sync loads it from PostgreSQL, adjustment included.
+	RedisApplied bool
+
+	// KillSignalSent is true when the adjustment left the balance at or
+	// below zero and the customer's in-flight streams were told to stop
+	// (see WatchKillSignals).
+	KillSignalSent bool
+}
+
+// AdjustBalance credits or debits a customer's balance by hand, with an
+// audit trail.
+//
+// Unlike the hot-path operations, PostgreSQL is written first and
+// synchronously: the balance update and an 'adjustment' transaction carrying
+// the reason and operator commit together, and only then is the same delta
+// applied in Redis. A debit that would take the balance below zero (or below
+// the customer's kill grace) is rejected by the positive_balance constraint,
+// failing with ErrInsufficientBalance.
+//
+// If the Redis update fails after the commit, the error says so; the
+// adjustment must not be retried, since PostgreSQL already has it and the
+// periodic sync will carry it to Redis.
+//
+// A debit that leaves the balance at or below zero publishes a kill signal,
+// so in-flight streams stop immediately instead of at their next deduction.
+func (l *Ledger) AdjustBalance(ctx context.Context, req AdjustmentRequest) (*AdjustmentResult, error) {
+	if req.CustomerID == "" {
+		return nil, fmt.Errorf("customer_id is required")
+	}
+	if req.DeltaGrains == 0 {
+		return nil, fmt.Errorf("delta_grains must be non-zero")
+	}
+	if req.Reason == "" || req.Operator == "" {
+		return nil, fmt.Errorf("reason and operator are required")
+	}
+	if req.Bucket == "" {
+		req.Bucket = BucketPaid
+	}
+	if !validBucket(req.Bucket) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBucket, req.Bucket)
+	}
+
+	txID := uuid.New().String()
+	if err := l.writeAdjustmentToDB(ctx, txID, req); err != nil {
+		return nil, err
+	}
+
+	l.log.Info().
+		Str("customer_id", req.CustomerID).
+		Str("transaction_id", txID).
+		Str("operator", req.Operator).
+		Str("reason", req.Reason).
+		Str("bucket", req.Bucket).
+		Int64("delta_grains", req.DeltaGrains).
+		Msg("balance adjusted")
+
+	res := &AdjustmentResult{TransactionID: txID}
+
+	currency, err := l.customerCurrency(ctx, req.CustomerID, "")
+	if err != nil {
+		return res, fmt.Errorf("adjustment %s recorded in postgresql but not applied in redis: %w", txID, err)
+	}
+
+	keys := []string{
+		balanceKey(req.CustomerID, currency),
+		totalBalanceKey,
+		bucketsKey(req.CustomerID, currency),
+	}
+	result, err := l.adjustBalanceScript.Run(ctx, l.redis, keys, req.DeltaGrains, req.Bucket, BucketPaid).Result()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", req.CustomerID).
+			Str("transaction_id", txID).
+			Msg("adjust_balance lua script failed, redis will catch up on next sync")
+		return res, fmt.Errorf("adjustment %s recorded in postgresql but not applied in redis: %w", txID, scriptError(err))
+	}
+
+	// Parse result: {applied, new_balance}
+	resultArray := result.([]interface{})
+	res.RedisApplied = resultArray[0].(int64) == 1
+	res.NewBalance = resultArray[1].(int64)
+
+	if !res.RedisApplied {
+		l.log.Warn().
+			Str("customer_id", req.CustomerID).
+			Str("transaction_id", txID).
+			Msg("customer balance not in redis, adjustment will be picked up by sync")
+		return res, nil
+	}
+
+	// The adjustment already stands; a failed publish only means streams
+	// stop at their next deduction instead
+	if req.DeltaGrains < 0 && res.NewBalance <= 0 {
+		err := l.publishKillSignal(ctx, KillSignal{
+			CustomerID: req.CustomerID,
+			Reason:     KillReasonBalanceAdjusted,
+			Balance:    res.NewBalance,
+			IssuedAt:   time.Now().UTC(),
+		})
+		if err != nil {
+			l.log.Warn().Err(err).
+				Str("customer_id", req.CustomerID).
+				Str("transaction_id", txID).
+				Msg("failed to publish kill signal")
+		} else {
+			res.KillSignalSent = true
+		}
+	}
+
+	return res, nil
+}
+
+// writeAdjustmentToDB updates the customer's balance (and bucket, for a
+// customer with buckets) and records the adjustment transaction in one
+// PostgreSQL transaction.
+func (l *Ledger) writeAdjustmentToDB(ctx context.Context, txID string, req AdjustmentRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	metadata, err := json.Marshal(map[string]string{"operator": req.Operator})
+	if err != nil {
+		return fmt.Errorf("encode metadata failed: %w", err)
+	}
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var newBalance int64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE customers SET
+			current_balance_grains = current_balance_grains + $1,
+			updated_at = NOW()
+		WHERE customer_id = $2
+		RETURNING current_balance_grains
+	`, req.DeltaGrains, req.CustomerID).Scan(&newBalance)
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrCustomerNotFound, req.CustomerID)
+	} else if errors.As(err, &pqErr) && pqErr.Code == pqCheckViolation && pqErr.Constraint == "positive_balance" {
+		return fmt.Errorf("%w: debit of %d grains for %s", ErrInsufficientBalance, -req.DeltaGrains, req.CustomerID)
+	} else if err != nil {
+		return fmt.Errorf("update balance failed: %w", err)
+	}
+
+	if err := adjustBucketInDB(ctx, tx, req, newBalance-req.DeltaGrains); err != nil {
+		return fmt.Errorf("update bucket failed: %w", err)
+	}
+
+	err = insertTransaction(ctx, tx, Transaction{
+		TransactionID: txID,
+		CustomerID:    req.CustomerID,
+		AmountGrains:  req.DeltaGrains,
+		Type:          TransactionAdjustment,
+		Description:   req.Reason,
+		Metadata:      metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("insert transaction failed: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// adjustBucketInDB applies an adjustment to the customer's bucket row.
+//
+// A single-bucket customer has no rows, and a BucketPaid adjustment leaves
+// it that way. Any other bucket first seeds BucketPaid with the balance
+// they had before (oldBalance), so the rows keep summing to
+// current_balance_grains.
+func adjustBucketInDB(ctx context.Context, tx *sql.Tx, req AdjustmentRequest, oldBalance int64) error {
+	if req.Bucket == BucketPaid {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE customer_balance_buckets SET balance_grains = balance_grains + $1
+			WHERE customer_id = $2 AND bucket = $3
+		`, req.DeltaGrains, req.CustomerID, BucketPaid)
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO customer_balance_buckets (customer_id, bucket, balance_grains)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (customer_id, bucket) DO NOTHING
+	`, req.CustomerID, BucketPaid, oldBalance)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO customer_balance_buckets (customer_id, bucket, balance_grains)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (customer_id, bucket)
+		DO UPDATE SET balance_grains = customer_balance_buckets.balance_grains + EXCLUDED.balance_grains
+	`, req.CustomerID, req.Bucket, req.DeltaGrains)
+	return err
+}
@@ -0,0 +1,95 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdjustBalance_CreditAndDebit(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set(totalBalanceKey, "5000")
+
+	for _, step := range []struct{ delta, balance int64 }{{250, 1250}, {-400, 850}} {
+		delta := step.delta
+		mock.ExpectBegin()
+		mock.ExpectQuery("UPDATE customers SET").
+			WithArgs(delta, "cus_1").
+			WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}).AddRow(step.balance))
+		mock.ExpectExec("UPDATE customer_balance_buckets").
+			WithArgs(delta, "cus_1", "paid").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO transactions").
+			WithArgs(sqlmock.AnyArg(), "cus_1", delta, "adjustment", "", "goodwill credit",
+				`{"operator":"alice@example.com"}`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	res, err := l.AdjustBalance(ctx, AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: 250,
+		Reason:      "goodwill credit",
+		Operator:    "alice@example.com",
+	})
+	require.NoError(t, err)
+	assert.True(t, res.RedisApplied)
+	assert.Equal(t, int64(1250), res.NewBalance)
+	assert.NotEmpty(t, res.TransactionID)
+
+	res, err = l.AdjustBalance(ctx, AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: -400,
+		Reason:      "goodwill credit",
+		Operator:    "alice@example.com",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(850), res.NewBalance)
+
+	total, err := mr.Get(totalBalanceKey)
+	require.NoError(t, err)
+	assert.Equal(t, "4850", total)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdjustBalance_UnknownCustomerRollsBack(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE customers SET").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}))
+	mock.ExpectRollback()
+
+	_, err = l.AdjustBalance(ctx, AdjustmentRequest{
+		CustomerID:  "cus_missing",
+		DeltaGrains: 100,
+		Reason:      "test",
+		Operator:    "bob",
+	})
+	assert.ErrorIs(t, err, ErrCustomerNotFound)
+	assert.False(t, mr.Exists("customer:balance:cus_missing"))
+
+	// Reason and operator are required for the audit trail.
+	_, err = l.AdjustBalance(ctx, AdjustmentRequest{CustomerID: "cus_1", DeltaGrains: 100})
+	assert.Error(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AdminAction is one privileged operation, as recorded in admin_audit.
+type AdminAction struct {
+	// Operator is who performed the action: the platform user behind the
+	// API key for an RPC, the operator running beam-cli for a command.
+	Operator string
+
+	// Action names what was done, e.g. "AdjustBalance" or
+	// "cli: admin sync-all".
+	Action string
+
+	// CustomerID is the customer acted on, if any.
+	CustomerID string
+
+	// Params are the action's arguments, stored as JSON.
+	Params map[string]interface{}
+}
+
+// RecordAdminAction appends a to the admin_audit table.
+//
+// The write is synchronous: callers record the action before performing it
+// and refuse to go ahead if this fails, so nothing privileged happens
+// without a trail.
+func (l *Ledger) RecordAdminAction(ctx context.Context, a AdminAction) error {
+	if a.Operator == "" || a.Action == "" {
+		return fmt.Errorf("operator and action are required")
+	}
+
+	params := a.Params
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("encode audit params failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err = l.db.ExecContext(ctx, `
+		INSERT INTO admin_audit (operator, action, target_customer, params)
+		VALUES ($1, $2, $3, $4)
+	`, a.Operator, a.Action, sql.NullString{String: a.CustomerID, Valid: a.CustomerID != ""}, encoded)
+	if err != nil {
+		return fmt.Errorf("insert admin audit failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAdminAction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	ctx := context.Background()
+
+	mock.ExpectExec("INSERT INTO admin_audit").
+		WithArgs("user_admin", "AdjustBalance", sql.NullString{String: "cus_1", Valid: true},
+			[]byte(`{"delta_grains":-500,"reason":"refund"}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	require.NoError(t, l.RecordAdminAction(ctx, AdminAction{
+		Operator:   "user_admin",
+		Action:     "AdjustBalance",
+		CustomerID: "cus_1",
+		Params:     map[string]interface{}{"delta_grains": -500, "reason": "refund"},
+	}))
+
+	// Actions without a customer store NULL and an empty object.
+	mock.ExpectExec("INSERT INTO admin_audit").
+		WithArgs("alice", "cli: admin sync-all", sql.NullString{}, []byte(`{}`)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	require.NoError(t, l.RecordAdminAction(ctx, AdminAction{Operator: "alice", Action: "cli: admin sync-all"}))
+
+	assert.Error(t, l.RecordAdminAction(ctx, AdminAction{Action: "AdjustBalance"}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
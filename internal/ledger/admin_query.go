@@ -0,0 +1,172 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Admin query limits (AdminQueryParams.Limit).
+const (
+	DefaultAdminQueryLimit = 100
+	MaxAdminQueryLimit     = 1000
+)
+
+// ErrUnknownAdminQuery is returned by AdminQuery for a kind it doesn't
+// define.
+var ErrUnknownAdminQuery = errors.New("unknown admin query")
+
+// AdminQueryKind names one of the predefined queries AdminQuery runs.
+type AdminQueryKind string
+
+const (
+	// AdminQueryRecentRequests is a customer's requests, newest first.
+	AdminQueryRecentRequests AdminQueryKind = "recent_requests"
+
+	// AdminQueryTransactions is a customer's transactions, newest first.
+	AdminQueryTransactions AdminQueryKind = "transactions"
+
+	// AdminQueryTopSpenders sums spend per customer over the requests in
+	// the range, biggest first.
+	AdminQueryTopSpenders AdminQueryKind = "top_spenders"
+)
+
+// AdminQueryParams are the bound parameters of an admin query.
+type AdminQueryParams struct {
+	// CustomerID is required by the queries about one customer, and
+	// ignored by the others.
+	CustomerID string
+
+	// From and To bound created_at to [From, To). A zero time leaves that
+	// side open.
+	From time.Time
+	To   time.Time
+
+	// Limit is how many rows to return (DefaultAdminQueryLimit if <= 0, at
+	// most MaxAdminQueryLimit).
+	Limit int
+}
+
+// AdminQueryResult is a query's rows as text, for display.
+type AdminQueryResult struct {
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+// adminQuery is a predefined admin query. Its SQL is fixed: every value
+// comes in through a bound parameter. Customer-scoped queries take
+// ($1 customer_id, $2 from, $3 to, $4 limit), the others ($1 from, $2 to,
+// $3 limit).
+type adminQuery struct {
+	sql            string
+	columns        []string
+	customerScoped bool
+}
+
+var adminQueries = map[AdminQueryKind]adminQuery{
+	AdminQueryRecentRequests: {
+		sql: `
+			SELECT request_id, COALESCE(end_user_id, ''), model, status,
+			       estimated_cost_grains, actual_cost_grains, created_at, completed_at
+			FROM requests
+			WHERE customer_id = $1
+			  AND ($2::timestamp IS NULL OR created_at >= $2)
+			  AND ($3::timestamp IS NULL OR created_at < $3)
+			ORDER BY created_at DESC, request_id DESC
+			LIMIT $4`,
+		columns: []string{"request_id", "end_user_id", "model", "status",
+			"estimated_cost_grains", "actual_cost_grains", "created_at", "completed_at"},
+		customerScoped: true,
+	},
+	AdminQueryTransactions: {
+		sql: `
+			SELECT transaction_id, transaction_type, amount_grains,
+			       COALESCE(reference_id, ''), COALESCE(description, ''), created_at
+			FROM transactions
+			WHERE customer_id = $1
+			  AND ($2::timestamp IS NULL OR created_at >= $2)
+			  AND ($3::timestamp IS NULL OR created_at < $3)
+			ORDER BY created_at DESC, transaction_id DESC
+			LIMIT $4`,
+		columns:        []string{"transaction_id", "transaction_type", "amount_grains", "reference_id", "description", "created_at"},
+		customerScoped: true,
+	},
+	AdminQueryTopSpenders: {
+		sql: `
+			SELECT customer_id,
+			       COUNT(*),
+			       COALESCE(SUM(actual_cost_grains) FILTER (WHERE status IN ('completed', 'killed')), 0) AS spent
+			FROM requests
+			WHERE ($1::timestamp IS NULL OR created_at >= $1)
+			  AND ($2::timestamp IS NULL OR created_at < $2)
+			GROUP BY customer_id
+			ORDER BY spent DESC, customer_id
+			LIMIT $3`,
+		columns: []string{"customer_id", "requests", "spent_grains"},
+	},
+}
+
+// AdminQuery runs one of the predefined read-only queries for admin
+// dashboards, which get no PostgreSQL credentials of their own. Only the
+// queries defined here can run, and p only ever reaches them as bound
+// parameters; there is no way to pass SQL. Callers audit the query (see
+// RecordAdminAction).
+func (l *Ledger) AdminQuery(ctx context.Context, kind AdminQueryKind, p AdminQueryParams) (*AdminQueryResult, error) {
+	q, ok := adminQueries[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAdminQuery, kind)
+	}
+	if q.customerScoped && p.CustomerID == "" {
+		return nil, fmt.Errorf("customer_id is required")
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = DefaultAdminQueryLimit
+	} else if limit > MaxAdminQueryLimit {
+		limit = MaxAdminQueryLimit
+	}
+
+	args := []interface{}{nullTime(p.From), nullTime(p.To), limit}
+	if q.customerScoped {
+		args = append([]interface{}{p.CustomerID}, args...)
+	}
+
+	rows, err := l.db.QueryContext(ctx, q.sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("admin query %s failed: %w", kind, err)
+	}
+	defer rows.Close()
+
+	result := &AdminQueryResult{Columns: q.columns, Rows: [][]string{}}
+	values := make([]sql.NullString, len(q.columns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("admin query %s scan failed: %w", kind, err)
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("admin query %s failed: %w", kind, err)
+	}
+
+	return result, nil
+}
+
+// nullTime is t in UTC as a query argument, or NULL if t is zero.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
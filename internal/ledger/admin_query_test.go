@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminQuery_Shapes(t *testing.T) {
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		kind     AdminQueryKind
+		params   AdminQueryParams
+		args     []driver.Value
+		rows     *sqlmock.Rows
+		wantRows [][]string
+	}{
+		{
+			kind:   AdminQueryRecentRequests,
+			params: AdminQueryParams{CustomerID: "cus_1", Limit: 5},
+			args:   []driver.Value{"cus_1", nil, nil, 5},
+			rows: sqlmock.NewRows([]string{"request_id", "end_user_id", "model", "status",
+				"estimated_cost_grains", "actual_cost_grains", "created_at", "completed_at"}).
+				AddRow("req_1", "eu_42", "gpt-4", "completed", 1200, 900, "2026-10-14T09:30:00Z", nil),
+			wantRows: [][]string{{"req_1", "eu_42", "gpt-4", "completed", "1200", "900", "2026-10-14T09:30:00Z", ""}},
+		},
+		{
+			kind:   AdminQueryTransactions,
+			params: AdminQueryParams{CustomerID: "cus_1", From: from, To: to},
+			args:   []driver.Value{"cus_1", from, to, DefaultAdminQueryLimit},
+			rows: sqlmock.NewRows([]string{"transaction_id", "transaction_type", "amount_grains",
+				"reference_id", "description", "created_at"}).
+				AddRow("tx_1", "usage", -900, "req_1", "", "2026-10-14T09:30:00Z"),
+			wantRows: [][]string{{"tx_1", "usage", "-900", "req_1", "", "2026-10-14T09:30:00Z"}},
+		},
+		{
+			kind:   AdminQueryTopSpenders,
+			params: AdminQueryParams{CustomerID: "ignored", From: from, Limit: MaxAdminQueryLimit + 1},
+			args:   []driver.Value{from, nil, MaxAdminQueryLimit},
+			rows: sqlmock.NewRows([]string{"customer_id", "count", "spent"}).
+				AddRow("cus_2", 40, 88000).
+				AddRow("cus_1", 12, 9000),
+			wantRows: [][]string{{"cus_2", "40", "88000"}, {"cus_1", "12", "9000"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			require.NoError(t, err)
+			defer db.Close()
+			l := &Ledger{db: db, log: zerolog.Nop()}
+
+			// Exactly the predefined SQL, with the values bound
+			mock.ExpectQuery(adminQueries[tt.kind].sql).WithArgs(tt.args...).WillReturnRows(tt.rows)
+
+			res, err := l.AdminQuery(context.Background(), tt.kind, tt.params)
+			require.NoError(t, err)
+			assert.Equal(t, adminQueries[tt.kind].columns, res.Columns)
+			assert.Equal(t, tt.wantRows, res.Rows)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAdminQuery_NoArbitrarySQL(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer db.Close()
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	ctx := context.Background()
+
+	// Only predefined kinds run; anything else never reaches PostgreSQL
+	for _, kind := range []AdminQueryKind{"", "SELECT * FROM api_keys", "recent_requests; DROP TABLE requests"} {
+		_, err := l.AdminQuery(ctx, kind, AdminQueryParams{CustomerID: "cus_1"})
+		assert.ErrorIs(t, err, ErrUnknownAdminQuery, kind)
+	}
+
+	// Customer-scoped queries need a customer
+	_, err = l.AdminQuery(ctx, AdminQueryRecentRequests, AdminQueryParams{})
+	assert.ErrorContains(t, err, "customer_id is required")
+
+	// Parameters are bound, never spliced into the SQL
+	injection := "cus_1' OR '1'='1"
+	mock.ExpectQuery(adminQueries[AdminQueryRecentRequests].sql).
+		WithArgs(injection, nil, nil, DefaultAdminQueryLimit).
+		WillReturnRows(sqlmock.NewRows(adminQueries[AdminQueryRecentRequests].columns))
+	res, err := l.AdminQuery(ctx, AdminQueryRecentRequests, AdminQueryParams{CustomerID: injection})
+	require.NoError(t, err)
+	assert.Empty(t, res.Rows)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,155 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultArchiveBatchSize is how many requests ArchiveOldRequests moves per
+// transaction when not given a batch size.
+const DefaultArchiveBatchSize = 1000
+
+// archivableStatuses are the terminal request statuses. A request in any
+// other status may still be finalized, so it is never archived.
+var archivableStatuses = []string{"completed", "killed", "failed", "timeout", "cancelled", "abandoned", "released"}
+
+// ArchiveReport summarises an ArchiveOldRequests run.
+type ArchiveReport struct {
+	Archived int           `json:"archived"`
+	Batches  int           `json:"batches"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ArchiveOldRequests moves requests that reached a terminal status and were
+// created more than olderThan ago from requests into requests_archive (see
+// migrations/021_requests_archive.up.sql), batchSize at a time
+// (DefaultArchiveBatchSize if <= 0), oldest first.
+//
+// Each batch is moved in its own transaction, along with creating the month
+// partitions it needs, so an interrupted run leaves every request in exactly
+// one of the tables and can just be run again. Transactions are never
+// touched: the audit trail doesn't depend on requests rows.
+func (l *Ledger) ArchiveOldRequests(ctx context.Context, olderThan time.Duration, batchSize int) (*ArchiveReport, error) {
+	if olderThan <= 0 {
+		return nil, fmt.Errorf("retention must be positive, got %s", olderThan)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultArchiveBatchSize
+	}
+
+	start := time.Now()
+	report := &ArchiveReport{}
+
+	for {
+		n, err := l.archiveBatch(ctx, olderThan, batchSize)
+		if err != nil {
+			return report, err
+		}
+		if n > 0 {
+			report.Archived += n
+			report.Batches++
+		}
+		if n < batchSize {
+			break
+		}
+	}
+
+	report.Duration = time.Since(start)
+
+	l.log.Info().
+		Dur("older_than", olderThan).
+		Int("archived", report.Archived).
+		Int("batches", report.Batches).
+		Dur("duration", report.Duration).
+		Msg("request archive complete")
+
+	return report, nil
+}
+
+// archiveBatch moves up to limit archivable requests and returns how many it
+// moved. Rows another run has locked are skipped.
+func (l *Ledger) archiveBatch(ctx context.Context, olderThan time.Duration, limit int) (int, error) {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT request_id, date_trunc('month', created_at)
+		FROM requests
+		WHERE status = ANY($1) AND created_at < NOW() - $2 * INTERVAL '1 second'
+		ORDER BY created_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`, pq.Array(archivableStatuses), int64(olderThan.Seconds()), limit)
+	if err != nil {
+		return 0, fmt.Errorf("query archivable requests failed: %w", err)
+	}
+
+	var ids []string
+	months := make(map[time.Time]bool)
+	for rows.Next() {
+		var requestID string
+		var month time.Time
+		if err := rows.Scan(&requestID, &month); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan failed: %w", err)
+		}
+		ids = append(ids, requestID)
+		months[month] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	sorted := make([]time.Time, 0, len(months))
+	for month := range months {
+		sorted = append(sorted, month)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	for _, month := range sorted {
+		if _, err := tx.ExecContext(ctx, archivePartitionDDL(month)); err != nil {
+			return 0, fmt.Errorf("create archive partition for %s failed: %w", month.Format("2006-01"), err)
+		}
+	}
+
+	// requests_archive has requests' columns in the same order, then
+	// archived_at, which is left to its default
+	res, err := tx.ExecContext(ctx, `
+		WITH moved AS (
+			DELETE FROM requests WHERE request_id = ANY($1)
+			RETURNING *
+		)
+		INSERT INTO requests_archive SELECT * FROM moved
+	`, pq.Array(ids))
+	if err != nil {
+		return 0, fmt.Errorf("move requests failed: %w", err)
+	}
+	moved, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("move requests failed: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit failed: %w", err)
+	}
+	return int(moved), nil
+}
+
+// archivePartitionDDL returns the statement creating requests_archive's
+// partition for the month starting at month, if it doesn't exist yet.
+func archivePartitionDDL(month time.Time) string {
+	return fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS requests_archive_%s PARTITION OF requests_archive FOR VALUES FROM ('%s') TO ('%s')`,
+		month.Format("2006_01"), month.Format("2006-01-02"), month.AddDate(0, 1, 0).Format("2006-01-02"))
+}
@@ -0,0 +1,83 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveOldRequests(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	const retention = 90 * 24 * time.Hour
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// Only terminal requests past the retention are selected: recent and
+	// in-flight ones stay in requests
+	expectBatch := func() *sqlmock.ExpectedQuery {
+		mock.ExpectBegin()
+		return mock.ExpectQuery(`SELECT request_id, date_trunc\('month', created_at\)\s+FROM requests\s+WHERE status = ANY\(\$1\) AND created_at < NOW\(\) - \$2`).
+			WithArgs(pq.Array(archivableStatuses), int64(retention.Seconds()), 2)
+	}
+
+	// First batch is full and spans two months
+	expectBatch().WillReturnRows(sqlmock.NewRows([]string{"request_id", "month"}).
+		AddRow("req_old_1", feb).
+		AddRow("req_old_2", mar))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS requests_archive_2024_02 PARTITION OF requests_archive FOR VALUES FROM \('2024-02-01'\) TO \('2024-03-01'\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS requests_archive_2024_03 PARTITION OF requests_archive FOR VALUES FROM \('2024-03-01'\) TO \('2024-04-01'\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM requests WHERE request_id = ANY\(\$1\)\s+RETURNING \*\s+\)\s+INSERT INTO requests_archive SELECT \* FROM moved`).
+		WithArgs(pq.Array([]string{"req_old_1", "req_old_2"})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// Second batch finishes the backlog
+	expectBatch().WillReturnRows(sqlmock.NewRows([]string{"request_id", "month"}).
+		AddRow("req_old_3", mar))
+	mock.ExpectExec(`requests_archive_2024_03`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO requests_archive`).
+		WithArgs(pq.Array([]string{"req_old_3"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	report, err := l.ArchiveOldRequests(context.Background(), retention, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Archived)
+	assert.Equal(t, 2, report.Batches)
+
+	// Nothing touched transactions (sqlmock fails on unexpected statements)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestArchiveOldRequests_NothingToArchive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM requests`).WillReturnRows(sqlmock.NewRows([]string{"request_id", "month"}))
+	mock.ExpectRollback()
+
+	report, err := l.ArchiveOldRequests(context.Background(), time.Hour, 0)
+	require.NoError(t, err)
+	assert.Zero(t, report.Archived)
+	assert.Zero(t, report.Batches)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = l.ArchiveOldRequests(context.Background(), 0, 0)
+	assert.ErrorContains(t, err, "retention must be positive")
+}
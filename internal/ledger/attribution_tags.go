@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxAttributionTags caps how many tag keys WithAttributionTags may
+// allowlist, which bounds what usage can be grouped by.
+const MaxAttributionTags = 10
+
+// maxTagValueLength is the longest tag value stored; longer values are
+// dropped rather than truncated into a different value.
+const maxTagValueLength = 255
+
+// ErrUnknownTag is returned when grouping usage by a tag key that isn't
+// allowlisted.
+var ErrUnknownTag = errors.New("unknown attribution tag")
+
+// tagKeyPattern is what a tag key may look like.
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+// ParseAttributionTags parses a comma-separated list of tag keys for
+// WithAttributionTags, e.g. "team,project,feature". Keys are lowercase
+// letters, digits and underscores; at most MaxAttributionTags of them.
+func ParseAttributionTags(list string) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		if !tagKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid attribution tag %q: use lowercase letters, digits and underscores", key)
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if len(keys) > MaxAttributionTags {
+		return nil, fmt.Errorf("%d attribution tags configured, at most %d are allowed", len(keys), MaxAttributionTags)
+	}
+	return keys, nil
+}
+
+// WithAttributionTags allowlists the keys of ReservationRequest.Tags that
+// are recorded on requests in PostgreSQL and that usage can be grouped by
+// (see UsageByTag). Other tags are ignored. None by default.
+func WithAttributionTags(keys []string) Option {
+	return func(l *Ledger) {
+		l.attributionTags = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			l.attributionTags[key] = true
+		}
+	}
+}
+
+// requestTags encodes the allowlisted tags of a request as JSON for
+// requests.tags, or "" if it has none.
+func (l *Ledger) requestTags(tags map[string]string) (string, error) {
+	kept := make(map[string]string)
+	for key, value := range tags {
+		if l.attributionTags[key] && value != "" && len(value) <= maxTagValueLength {
+			kept[key] = value
+		}
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return "", fmt.Errorf("encode tags failed: %w", err)
+	}
+	return string(b), nil
+}
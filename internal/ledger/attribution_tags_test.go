@@ -0,0 +1,87 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAttributionTags(t *testing.T) {
+	keys, err := ParseAttributionTags(" team, project,,team,feature ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team", "project", "feature"}, keys)
+
+	keys, err = ParseAttributionTags("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseAttributionTags("team,Cost-Center")
+	assert.Error(t, err)
+
+	_, err = ParseAttributionTags("a,b,c,d,e,f,g,h,i,j,k")
+	assert.Error(t, err, "more than MaxAttributionTags")
+}
+
+func TestWritePreflightToDB_RecordsAllowlistedTags(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	WithAttributionTags([]string{"team", "project"})(l)
+
+	mock.ExpectExec("INSERT INTO requests").
+		WithArgs("req_1", "cus_1", "", "", int64(80), int64(100), "preflight_approved", PriorityNormal,
+			`{"team":"search"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = l.writePreflightToDB(context.Background(), ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100, EstimatedGrains: 80,
+		Priority: PriorityNormal,
+		Tags: map[string]string{
+			"team":       "search",
+			"project":    "", // empty values aren't tags
+			"session_id": "s_123",
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsageByTag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	WithAttributionTags([]string{"team"})(l)
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cols := []string{"value", "requests", "completed", "killed", "spent", "tokens"}
+
+	mock.ExpectQuery(`SELECT COALESCE\(tags->>\$2, ''\),.*WHERE customer_id = \$1 AND created_at >= \$3\s+GROUP BY 1\s+ORDER BY spent DESC, 1\s+LIMIT \$4`).
+		WithArgs("cus_1", "team", from, DefaultUsageLimit).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("search", 40, 38, 2, 700000, 21000).
+			AddRow("", 5, 5, 0, 9000, 300).
+			AddRow("billing", 2, 2, 0, 800, 50))
+
+	usage, err := l.UsageByTag(context.Background(), UsageFilter{CustomerID: "cus_1", From: from}, "team")
+	require.NoError(t, err)
+	assert.Equal(t, []TagUsage{
+		{Value: "search", UsageTotals: UsageTotals{Requests: 40, CompletedRequests: 38, KilledRequests: 2, SpentGrains: 700000, TotalTokens: 21000}},
+		{Value: "", UsageTotals: UsageTotals{Requests: 5, CompletedRequests: 5, SpentGrains: 9000, TotalTokens: 300}},
+		{Value: "billing", UsageTotals: UsageTotals{Requests: 2, CompletedRequests: 2, SpentGrains: 800, TotalTokens: 50}},
+	}, usage)
+
+	// Grouping by a tag that isn't recorded
+	_, err = l.UsageByTag(context.Background(), UsageFilter{CustomerID: "cus_1"}, "session_id")
+	assert.True(t, errors.Is(err, ErrUnknownTag))
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,119 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DefaultBalanceStatsTTL is how long GetBalanceDetailed reuses a customer's
+// lifetime stats before querying PostgreSQL again.
+const DefaultBalanceStatsTTL = 30 * time.Second
+
+// BalanceStats are a customer's lifetime figures from PostgreSQL.
+type BalanceStats struct {
+	LifetimeSpentGrains int64 `json:"lifetime_spent_grains"`
+
+	// LastActivityAt is when the customer's most recent request was made,
+	// or nil if they have made none. Archived requests (see
+	// ArchiveOldRequests) aren't considered.
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+}
+
+// DetailedBalance is GetBalance's result plus the customer's BalanceStats.
+type DetailedBalance struct {
+	Balance   int64 `json:"balance"`
+	Reserved  int64 `json:"reserved"`
+	Available int64 `json:"available"`
+
+	BalanceStats
+}
+
+// cachedBalanceStats is an entry of Ledger.balanceStats.
+type cachedBalanceStats struct {
+	stats    BalanceStats
+	loadedAt time.Time
+}
+
+// WithBalanceStatsTTL sets how long GetBalanceDetailed caches a customer's
+// lifetime stats. They trail PostgreSQL, which itself trails Redis by the
+// queued writes, by up to that long. Defaults to DefaultBalanceStatsTTL.
+func WithBalanceStatsTTL(d time.Duration) Option {
+	return func(l *Ledger) {
+		l.balanceStatsTTL = d
+	}
+}
+
+// GetBalanceDetailed is GetBalance for dashboards: along with the live
+// balance from Redis it returns the customer's lifetime spend and last
+// activity from PostgreSQL, cached per customer (see WithBalanceStatsTTL).
+//
+// The hot path keeps using GetBalance, which never touches PostgreSQL
+// unless the customer has to be synced. found is as for GetBalance; the
+// stats aren't looked up for a customer that isn't found.
+func (l *Ledger) GetBalanceDetailed(ctx context.Context, customerID string) (*DetailedBalance, bool, error) {
+	balance, reserved, available, found, err := l.GetBalance(ctx, customerID)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	stats, err := l.balanceStatsFor(ctx, customerID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &DetailedBalance{
+		Balance:      balance,
+		Reserved:     reserved,
+		Available:    available,
+		BalanceStats: stats,
+	}, true, nil
+}
+
+// balanceStatsFor returns customerID's stats from the cache, or loads them.
+func (l *Ledger) balanceStatsFor(ctx context.Context, customerID string) (BalanceStats, error) {
+	ttl := l.balanceStatsTTL
+	if ttl == 0 {
+		ttl = DefaultBalanceStatsTTL
+	}
+
+	if cached, ok := l.balanceStats.Load(customerID); ok {
+		entry := cached.(cachedBalanceStats)
+		if time.Since(entry.loadedAt) < ttl {
+			return entry.stats, nil
+		}
+	}
+
+	stats, err := l.loadBalanceStats(ctx, customerID)
+	if err != nil {
+		return BalanceStats{}, err
+	}
+
+	l.balanceStats.Store(customerID, cachedBalanceStats{stats: stats, loadedAt: time.Now()})
+	return stats, nil
+}
+
+// loadBalanceStats queries customerID's stats. A customer without a
+// customers row (not yet written) has zero stats.
+func (l *Ledger) loadBalanceStats(ctx context.Context, customerID string) (BalanceStats, error) {
+	var stats BalanceStats
+	var lastActivity sql.NullTime
+	err := l.db.QueryRowContext(ctx, `
+		SELECT c.lifetime_spent_grains,
+		       (SELECT MAX(r.created_at) FROM requests r WHERE r.customer_id = c.customer_id)
+		FROM customers c
+		WHERE c.customer_id = $1
+	`, customerID).Scan(&stats.LifetimeSpentGrains, &lastActivity)
+
+	if err == sql.ErrNoRows {
+		return BalanceStats{}, nil
+	} else if err != nil {
+		return BalanceStats{}, fmt.Errorf("balance stats query failed: %w", err)
+	}
+
+	if lastActivity.Valid {
+		stats.LastActivityAt = &lastActivity.Time
+	}
+	return stats, nil
+}
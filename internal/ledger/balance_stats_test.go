@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBalanceDetailed_LifetimeStats(t *testing.T) {
+	l, mr := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "10000")
+	mr.Set("customer:reserved:cus_1", "2500")
+	lastRequest := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+
+	// Loaded once, then served from the cache
+	mock.ExpectQuery(`SELECT c.lifetime_spent_grains`).
+		WithArgs("cus_1").
+		WillReturnRows(sqlmock.NewRows([]string{"lifetime_spent_grains", "max"}).AddRow(750000, lastRequest))
+
+	for i := 0; i < 2; i++ {
+		detailed, found, err := l.GetBalanceDetailed(ctx, "cus_1")
+		require.NoError(t, err)
+		require.True(t, found)
+
+		assert.Equal(t, int64(10000), detailed.Balance)
+		assert.Equal(t, int64(2500), detailed.Reserved)
+		assert.Equal(t, int64(7500), detailed.Available)
+		assert.Equal(t, int64(750000), detailed.LifetimeSpentGrains)
+		require.NotNil(t, detailed.LastActivityAt)
+		assert.True(t, lastRequest.Equal(*detailed.LastActivityAt))
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// Once the entry expires the stats are queried again
+	WithBalanceStatsTTL(time.Nanosecond)(l)
+	mock.ExpectQuery(`SELECT c.lifetime_spent_grains`).
+		WithArgs("cus_1").
+		WillReturnRows(sqlmock.NewRows([]string{"lifetime_spent_grains", "max"}).AddRow(760000, lastRequest))
+
+	detailed, _, err := l.GetBalanceDetailed(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(760000), detailed.LifetimeSpentGrains)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetBalanceDetailed_NoActivity(t *testing.T) {
+	l, mr := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_new", "500")
+	mock.ExpectQuery(`SELECT c.lifetime_spent_grains`).
+		WithArgs("cus_new").
+		WillReturnRows(sqlmock.NewRows([]string{"lifetime_spent_grains", "max"}).AddRow(0, nil))
+
+	detailed, found, err := l.GetBalanceDetailed(ctx, "cus_new")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Zero(t, detailed.LifetimeSpentGrains)
+	assert.Nil(t, detailed.LastActivityAt)
+
+	// A customer Redis doesn't have isn't looked up in PostgreSQL at all
+	_, found, err = l.GetBalanceDetailed(ctx, "cus_missing")
+	require.NoError(t, err)
+	assert.False(t, found)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
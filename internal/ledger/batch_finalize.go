@@ -0,0 +1,170 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// BatchFinalize finalizes many requests in a single Redis round trip.
+//
+// This is for callers that buffer completions and flush them together (e.g.
+// a queue consumer). Each request runs the same finalize script as
+// FinalizeRequest, pipelined, so every request is still reconciled
+// atomically on its own.
+//
+// Failures are per request, never per batch: a request that doesn't exist or
+// whose script errors gets a result with Success=false and an ErrorCode, and
+// the rest of the batch is unaffected. An error is returned only if Redis
+// couldn't be reached at all.
+//
+// Results are keyed by request_id. If a request_id appears more than once,
+// only its first occurrence is finalized.
+func (l *Ledger) BatchFinalize(ctx context.Context, reqs []FinalizationRequest) (map[string]*FinalizationResult, error) {
+	results := make(map[string]*FinalizationResult, len(reqs))
+	if len(reqs) == 0 {
+		return results, nil
+	}
+
+	batch := make([]FinalizationRequest, 0, len(reqs))
+	seen := make(map[string]bool, len(reqs))
+	for _, req := range reqs {
+		if seen[req.RequestID] {
+			continue
+		}
+		seen[req.RequestID] = true
+		batch = append(batch, req)
+	}
+
+	if err := l.resolveCurrencies(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	cmds, err := l.pipelineFinalize(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	// If Redis lost the script cache (restart, SCRIPT FLUSH), EVALSHA fails
+	// with NOSCRIPT before running anything, so those entries are safe to retry.
+	var retry []int
+	for i, cmd := range cmds {
+		if isNoScript(cmd.Err()) {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) > 0 {
+		if err := l.finalizeRequestScript.Load(ctx, l.redis).Err(); err != nil {
+			return nil, redisError("script load", err)
+		}
+
+		retryReqs := make([]FinalizationRequest, len(retry))
+		for j, i := range retry {
+			retryReqs[j] = batch[i]
+		}
+		retryCmds, err := l.pipelineFinalize(ctx, retryReqs)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range retry {
+			cmds[i] = retryCmds[j]
+		}
+	}
+
+	succeeded := 0
+	for i, req := range batch {
+		result, err := cmds[i].Result()
+		if err != nil {
+			l.log.Error().Err(err).
+				Str("customer_id", req.CustomerID).
+				Str("request_id", req.RequestID).
+				Msg("finalize_request lua script failed in batch")
+			results[req.RequestID] = &FinalizationResult{ErrorCode: "SCRIPT_ERROR"}
+			continue
+		}
+
+		res := parseFinalizeResult(result)
+		if err := l.finalizeCompleted(req, res); err != nil {
+			// Finalized in Redis, but the sync write was dead-lettered
+			res = &FinalizationResult{ErrorCode: "WRITE_FAILED"}
+		}
+		results[req.RequestID] = res
+		if res.Success {
+			succeeded++
+		}
+	}
+
+	l.log.Info().
+		Int("batch_size", len(batch)).
+		Int("succeeded", succeeded).
+		Msg("batch_finalize completed")
+
+	return results, nil
+}
+
+// pipelineFinalize runs the finalize script for each request in one pipeline.
+// The returned error is only set if the pipeline itself failed; per-command
+// errors are left on the commands.
+func (l *Ledger) pipelineFinalize(ctx context.Context, reqs []FinalizationRequest) ([]*redis.Cmd, error) {
+	pipe := l.redis.Pipeline()
+	cmds := make([]*redis.Cmd, len(reqs))
+	for i, req := range reqs {
+		keys, args := l.finalizeScriptParams(req)
+		cmds[i] = l.finalizeRequestScript.EvalSha(ctx, pipe, keys, args...)
+	}
+
+	// Exec returns the first command error, which we handle per command.
+	// Only a failure that left no command with a reply is fatal.
+	if _, err := pipe.Exec(ctx); err != nil {
+		if len(cmds) > 0 && isConnectionError(cmds[0].Err()) {
+			return nil, redisError("pipeline", err)
+		}
+	}
+
+	return cmds, nil
+}
+
+// resolveCurrencies fills in Currency for every request that doesn't carry
+// one, looking the customers up in a single pipeline.
+func (l *Ledger) resolveCurrencies(ctx context.Context, reqs []FinalizationRequest) error {
+	pipe := l.redis.Pipeline()
+	cmds := make(map[int]*redis.StringCmd)
+	for i, req := range reqs {
+		if req.Currency == "" {
+			cmds[i] = pipe.HGet(ctx, fmt.Sprintf("customer:config:%s", req.CustomerID), "currency")
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return redisError("pipeline", err)
+	}
+
+	for i, cmd := range cmds {
+		reqs[i].Currency = cmd.Val()
+		if reqs[i].Currency == "" {
+			reqs[i].Currency = l.currencyDefault()
+		}
+	}
+
+	return nil
+}
+
+// isNoScript reports whether err is Redis's "script not cached" error.
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// isConnectionError reports whether err came from the client or network
+// rather than from Redis executing the command.
+func isConnectionError(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	_, isRedisError := err.(redis.Error)
+	return !isRedisError
+}
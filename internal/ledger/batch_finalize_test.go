@@ -0,0 +1,83 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchFinalize_MixedBatchWithMissingRequest(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	for _, id := range []string{"req_a", "req_b"} {
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+			CustomerID:     "cus_1",
+			RequestID:      id,
+			ReservedGrains: 100,
+		})
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+	}
+	// Drain the preflight writes so only finalizations remain.
+	for len(l.writeQueues[0]) > 0 {
+		<-l.writeQueues[0]
+	}
+
+	// Simulate a cold script cache to exercise the NOSCRIPT retry.
+	require.NoError(t, l.redis.ScriptFlush(ctx).Err())
+
+	results, err := l.BatchFinalize(ctx, []FinalizationRequest{
+		{CustomerID: "cus_1", RequestID: "req_a", Status: "completed", ActualCostGrains: 40},
+		{CustomerID: "cus_1", RequestID: "req_missing", Status: "completed", ActualCostGrains: 10},
+		{CustomerID: "cus_1", RequestID: "req_b", Status: "completed", ActualCostGrains: 60},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	assert.True(t, results["req_a"].Success)
+	assert.Equal(t, int64(-40), results["req_a"].RefundedGrains)
+
+	assert.False(t, results["req_missing"].Success)
+	assert.Equal(t, "REQUEST_NOT_FOUND", results["req_missing"].ErrorCode)
+
+	assert.True(t, results["req_b"].Success)
+	assert.Equal(t, int64(900), results["req_b"].FinalBalance)
+
+	// Both reservations were released and charged; the missing one changed nothing.
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(900), balance)
+	assert.Equal(t, int64(0), reserved)
+
+	// Only successful finalizations are persisted.
+	assert.Len(t, l.writeQueues[0], 2)
+}
+
+func TestBatchFinalize_DuplicateRequestIDFinalizedOnce(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_a",
+		ReservedGrains: 100,
+	})
+	require.NoError(t, err)
+
+	results, err := l.BatchFinalize(ctx, []FinalizationRequest{
+		{CustomerID: "cus_1", RequestID: "req_a", Status: "completed", ActualCostGrains: 40},
+		{CustomerID: "cus_1", RequestID: "req_a", Status: "completed", ActualCostGrains: 999},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	balance, _, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(960), balance)
+}
@@ -0,0 +1,253 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxBatchReserveSize is the most sub-requests one BatchReserve call takes.
+// The whole batch runs as one Redis script, which blocks Redis meanwhile.
+const MaxBatchReserveSize = 100
+
+// ErrInvalidBatch is returned by BatchReserve for a batch it can't run.
+var ErrInvalidBatch = errors.New("invalid reservation batch")
+
+// BatchReservationResult is the outcome of BatchReserve.
+type BatchReservationResult struct {
+	// Approved is true if every sub-request was reserved, false if none was
+	Approved        bool   `json:"approved"`
+	RejectionReason string `json:"rejection_reason,omitempty"`
+
+	// RejectedRequestID is the sub-request that caused a REQUEST_EXISTS
+	// rejection
+	RejectedRequestID string `json:"rejected_request_id,omitempty"`
+
+	CurrentBalance   int64 `json:"current_balance"`
+	AvailableBalance int64 `json:"available_balance"`
+	RemainingBalance int64 `json:"remaining_balance"`
+
+	// ReservedGrains is the batch's total
+	ReservedGrains int64 `json:"reserved_grains"`
+
+	// ShortfallGrains is how much more the batch needed when rejected with
+	// INSUFFICIENT_BALANCE or BALANCE_TOO_LOW
+	ShortfallGrains int64 `json:"shortfall_grains,omitempty"`
+
+	// RequestIDs are the sub-requests' IDs, in order. Sub-requests given
+	// without one get a generated ID.
+	RequestIDs []string `json:"request_ids"`
+	Currency   string   `json:"currency"`
+}
+
+// BatchReserve reserves grains for several requests of one customer at
+// once, all or nothing: the batch's total is checked against the available
+// balance, and either every sub-request is reserved or none is. An agent
+// fanning out parallel calls gets all of its budget or can back off before
+// starting any of them.
+//
+// Each reserved sub-request is an ordinary request, finalized or cancelled
+// on its own. Preemption doesn't apply to a batch and dry runs aren't
+// supported. If persisting any sub-request fails with sync writes on, the
+// whole batch is released again and the error returned.
+func (l *Ledger) BatchReserve(ctx context.Context, reqs []ReservationRequest) (*BatchReservationResult, error) {
+	start := time.Now()
+
+	reqs, err := prepareBatch(reqs)
+	if err != nil {
+		return nil, err
+	}
+	customerID := reqs[0].CustomerID
+
+	resultArray, currency, err := l.runBatchReserve(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+
+	// A customer Redis has never heard of may just not be synced yet
+	if resultArray[2].(string) == RejectionCustomerNotFound && l.syncUnknownCustomers && l.loadBalance != nil {
+		if err := l.loadBalance(ctx, customerID); err != nil {
+			l.log.Warn().Err(err).
+				Str("customer_id", customerID).
+				Msg("on-demand sync of unknown customer failed")
+		} else {
+			resultArray, currency, err = l.runBatchReserve(ctx, reqs)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res := &BatchReservationResult{
+		Approved:        resultArray[0].(int64) == 1,
+		CurrentBalance:  resultArray[1].(int64),
+		RejectionReason: resultArray[2].(string),
+		Currency:        currency,
+	}
+	for _, req := range reqs {
+		res.ReservedGrains += req.ReservedGrains
+		res.RequestIDs = append(res.RequestIDs, req.RequestID)
+	}
+
+	if res.Approved {
+		res.RemainingBalance = resultArray[3].(int64)
+		res.AvailableBalance = res.RemainingBalance + res.ReservedGrains
+	} else {
+		res.AvailableBalance = resultArray[3].(int64)
+		res.RemainingBalance = res.CurrentBalance
+	}
+
+	switch res.RejectionReason {
+	case RejectionInsufficientBalance:
+		res.ShortfallGrains = res.ReservedGrains - res.AvailableBalance
+	case RejectionBalanceTooLow:
+		res.ShortfallGrains = balanceTooLowShortfall(res.ReservedGrains, res.AvailableBalance, resultArray[5].(int64))
+	case RejectionRequestExists:
+		res.RejectedRequestID = reqs[resultArray[4].(int64)-1].RequestID
+		duplicateRequestsTotal.Inc()
+	}
+
+	l.hotLog.Debug().
+		Str("customer_id", customerID).
+		Int("requests", len(reqs)).
+		Int64("reserved_grains", res.ReservedGrains).
+		Bool("approved", res.Approved).
+		Str("reason", res.RejectionReason).
+		Dur("duration_ms", time.Since(start)).
+		Msg("batch_reserve completed")
+
+	if !res.Approved {
+		return res, nil
+	}
+
+	for i, req := range reqs {
+		err := l.persist(writeOp{
+			opType:     "preflight",
+			customerID: customerID,
+			data:       req,
+			ctx:        context.Background(),
+		})
+		if err != nil {
+			l.rollbackBatch(ctx, reqs, i, currency)
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// prepareBatch validates reqs and fills in their defaults, returning a copy.
+func prepareBatch(reqs []ReservationRequest) ([]ReservationRequest, error) {
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("%w: no requests", ErrInvalidBatch)
+	}
+	if len(reqs) > MaxBatchReserveSize {
+		return nil, fmt.Errorf("%w: %d requests, at most %d", ErrInvalidBatch, len(reqs), MaxBatchReserveSize)
+	}
+
+	prepared := make([]ReservationRequest, len(reqs))
+	seen := make(map[string]bool, len(reqs))
+	for i, req := range reqs {
+		switch {
+		case req.CustomerID != reqs[0].CustomerID:
+			return nil, fmt.Errorf("%w: requests for more than one customer", ErrInvalidBatch)
+		case req.Currency != reqs[0].Currency:
+			return nil, fmt.Errorf("%w: requests in more than one currency", ErrInvalidBatch)
+		case req.DryRun:
+			return nil, fmt.Errorf("%w: dry runs aren't supported", ErrInvalidBatch)
+		case req.ReservedGrains < 0:
+			return nil, fmt.Errorf("%w: negative reservation", ErrInvalidBatch)
+		}
+
+		if req.Priority == "" {
+			req.Priority = PriorityNormal
+		} else if !validPriority(req.Priority) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownPriority, req.Priority)
+		}
+
+		if req.RequestID == "" {
+			req.RequestID = "req_" + uuid.New().String()
+		}
+		if seen[req.RequestID] {
+			return nil, fmt.Errorf("%w: duplicate request ID %q", ErrInvalidBatch, req.RequestID)
+		}
+		seen[req.RequestID] = true
+
+		prepared[i] = req
+	}
+	return prepared, nil
+}
+
+// runBatchReserve runs the batch_reserve script for reqs and returns its
+// result array along with the currency it reserved in.
+func (l *Ledger) runBatchReserve(ctx context.Context, reqs []ReservationRequest) ([]interface{}, string, error) {
+	customerID := reqs[0].CustomerID
+	currency, err := l.customerCurrency(ctx, customerID, reqs[0].Currency)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := []string{
+		balanceKey(customerID, currency),
+		reservedKey(customerID, currency),
+		totalReservedKey,
+		reservedLowKey(customerID, currency),
+		fmt.Sprintf("customer:config:%s", customerID),
+		debtKey(customerID, currency),
+		safeModeKey,
+		inflightKey(customerID),
+	}
+	var args []interface{}
+	for _, req := range reqs {
+		metadata, err := json.Marshal(req.Metadata)
+		if err != nil {
+			l.log.Warn().Err(err).Msg("failed to marshal metadata, using empty")
+			metadata = []byte("{}")
+		}
+
+		keys = append(keys, fmt.Sprintf("request:%s", req.RequestID))
+		reqArgs := l.reserveScriptArgs(req, metadata)
+		reqArgs[9] = boolArg(false) // the batch is checked without preemption
+		args = append(args, reqArgs...)
+	}
+
+	result, err := l.batchReserveScript.Run(ctx, l.redis, keys, args...).Result()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", customerID).
+			Int("requests", len(reqs)).
+			Msg("batch_reserve lua script failed")
+		return nil, "", scriptError(err)
+	}
+
+	return result.([]interface{}), currency, nil
+}
+
+// rollbackBatch releases a batch whose persisting failed at sub-request
+// failed. The sub-requests before it were already written, so their
+// cancellation is written too.
+func (l *Ledger) rollbackBatch(ctx context.Context, reqs []ReservationRequest, failed int, currency string) {
+	for i, req := range reqs {
+		l.rollbackReservation(ctx, req.CustomerID, req.RequestID, currency)
+		if i >= failed {
+			continue
+		}
+
+		err := l.persist(writeOp{
+			opType:     "cancellation",
+			customerID: req.CustomerID,
+			data:       cancellation{CustomerID: req.CustomerID, RequestID: req.RequestID},
+			ctx:        context.Background(),
+		})
+		if err != nil {
+			l.log.Error().Err(err).
+				Str("customer_id", req.CustomerID).
+				Str("request_id", req.RequestID).
+				Msg("failed to record cancellation of rolled back batch request")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchReserve_FullyFunded(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300},
+		{CustomerID: "cus_1", ReservedGrains: 200, Priority: PriorityLow},
+		{CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 100},
+	})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+	assert.Equal(t, int64(600), res.ReservedGrains)
+	assert.Equal(t, int64(1000), res.AvailableBalance)
+	assert.Equal(t, int64(400), res.RemainingBalance)
+
+	require.Len(t, res.RequestIDs, 3)
+	assert.Equal(t, "req_1", res.RequestIDs[0])
+	assert.Regexp(t, `^req_[0-9a-f-]{36}$`, res.RequestIDs[1], "generated")
+	assert.Equal(t, "req_3", res.RequestIDs[2])
+
+	// Each sub-request is an ordinary reserved request
+	for i, want := range []string{"300", "200", "100"} {
+		assert.Equal(t, want, mr.HGet("request:"+res.RequestIDs[i], "reserved_grains"))
+		assert.Equal(t, "preflight_approved", mr.HGet("request:"+res.RequestIDs[i], "status"))
+	}
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), reserved)
+	low, err := mr.Get("customer:reserved_low:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "200", low)
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Len(t, l.writeQueues[0], 3, "one preflight write each")
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_3", Status: "completed", ActualCostGrains: 50,
+	})
+	require.NoError(t, err)
+	assert.True(t, fin.Success)
+}
+
+func TestBatchReserve_ExceedsAvailable(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_0", ReservedGrains: 400})
+	require.NoError(t, err)
+	<-l.writeQueues[0] // preflight
+
+	// Each sub-request fits on its own, the batch doesn't
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300},
+		{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 300},
+		{CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 100},
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+	assert.Equal(t, int64(600), res.AvailableBalance)
+	assert.Equal(t, int64(100), res.ShortfallGrains)
+
+	// None reserved
+	for _, id := range []string{"req_1", "req_2", "req_3"} {
+		assert.False(t, mr.Exists("request:"+id), id)
+	}
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), reserved)
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Empty(t, l.writeQueues[0])
+}
+
+func TestBatchReserve_RejectsWholeBatch(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 100})
+	require.NoError(t, err)
+
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100},
+		{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 100},
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionRequestExists, res.RejectionReason)
+	assert.Equal(t, "req_2", res.RejectedRequestID)
+	assert.False(t, mr.Exists("request:req_1"))
+
+	// The concurrency limit counts the whole batch
+	mr.HSet("customer:config:cus_1", "max_concurrent_requests", "2")
+	res, err = l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 100},
+		{CustomerID: "cus_1", RequestID: "req_4", ReservedGrains: 100},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionTooManyInflight, res.RejectionReason)
+	assert.False(t, mr.Exists("request:req_3"))
+
+	res, err = l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_unknown", RequestID: "req_5", ReservedGrains: 100},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionCustomerNotFound, res.RejectionReason)
+}
+
+func TestBatchReserve_InvalidBatch(t *testing.T) {
+	l, _ := newTestLedger(t)
+	ctx := context.Background()
+
+	for name, reqs := range map[string][]ReservationRequest{
+		"empty":          nil,
+		"two customers":  {{CustomerID: "cus_1"}, {CustomerID: "cus_2"}},
+		"duplicate ids":  {{CustomerID: "cus_1", RequestID: "req_1"}, {CustomerID: "cus_1", RequestID: "req_1"}},
+		"dry run":        {{CustomerID: "cus_1", DryRun: true}},
+		"too many":       make([]ReservationRequest, MaxBatchReserveSize+1),
+		"two currencies": {{CustomerID: "cus_1", Currency: "usd"}, {CustomerID: "cus_1", Currency: "eur"}},
+	} {
+		_, err := l.BatchReserve(ctx, reqs)
+		assert.ErrorIs(t, err, ErrInvalidBatch, name)
+	}
+
+	_, err := l.BatchReserve(ctx, []ReservationRequest{{CustomerID: "cus_1", Priority: "urgent"}})
+	assert.ErrorIs(t, err, ErrUnknownPriority)
+}
+
+func TestBatchReserve_SyncWriteFailureReleasesAll(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithSyncWrites(true)(l)
+
+	mr.Set("customer:balance:cus_1", "1000")
+	var applied []writeOp
+	l.applyWrite = func(op writeOp) error {
+		if op.opType == "preflight" && op.data.(ReservationRequest).RequestID == "req_2" {
+			return errors.New("connection refused")
+		}
+		applied = append(applied, op)
+		return nil
+	}
+
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300},
+		{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 300},
+		{CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 300},
+	})
+	require.ErrorIs(t, err, ErrWriteFailed)
+	assert.Nil(t, res)
+
+	// Nothing is left held
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, reserved)
+	for _, id := range []string{"req_1", "req_2", "req_3"} {
+		assert.False(t, mr.Exists("request:"+id), id)
+	}
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// The sub-request already written is cancelled in PostgreSQL too
+	require.Len(t, applied, 2)
+	assert.Equal(t, "preflight", applied[0].opType)
+	assert.Equal(t, "cancellation", applied[1].opType)
+	assert.Equal(t, cancellation{CustomerID: "cus_1", RequestID: "req_1"}, applied[1].data)
+}
+
+func TestBatchReserve_MinimumCheckedOncePerBatch(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.minimumViableBalance = 300
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	// The last sub-request takes available below the minimum, but the
+	// minimum applies to the batch as a whole, as to a single reservation
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_a", ReservedGrains: 400},
+		{CustomerID: "cus_1", RequestID: "req_b", ReservedGrains: 400},
+		{CustomerID: "cus_1", RequestID: "req_c", ReservedGrains: 150},
+	})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+	assert.Equal(t, int64(950), res.ReservedGrains)
+
+	for _, id := range res.RequestIDs {
+		assert.True(t, mr.Exists("request:"+id), "%s was reserved", id)
+	}
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(950), reserved)
+}
@@ -0,0 +1,159 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Funding buckets a customer's balance can be split into.
+const (
+	// BucketPromo holds promotional grants.
+	BucketPromo = "promo"
+
+	// BucketPaid holds prepaid credit. A customer without buckets has their
+	// whole balance here.
+	BucketPaid = "paid"
+)
+
+// FundingBuckets lists the buckets in priority order: spending draws them
+// down first to last, refunds fill them back up last to first.
+var FundingBuckets = []string{BucketPromo, BucketPaid}
+
+// ErrUnknownBucket is returned for a bucket name not in FundingBuckets.
+var ErrUnknownBucket = errors.New("unknown funding bucket")
+
+// validBucket reports whether b is one of FundingBuckets.
+func validBucket(b string) bool {
+	for _, fb := range FundingBuckets {
+		if b == fb {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketBalance is one bucket's share of a customer's balance.
+type BucketBalance struct {
+	Bucket string
+	Grains int64
+}
+
+// bucketsKey returns the Redis hash of a customer's per-bucket balances;
+// see balanceKey.
+//
+// The hash only exists for customers with more than one funding source.
+// Its fields always sum to the balance key, which remains the combined
+// view that reservations are checked against. Customers without the hash
+// are single-bucket and every script leaves them exactly as before.
+func bucketsKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:buckets:%s", customerID)
+	}
+	return fmt.Sprintf("customer:buckets:%s:%s", customerID, currency)
+}
+
+// bucketFunctions returns the Lua helpers (see scripts/lua/buckets.lua)
+// that the deduct, finalize and cancel scripts are prepended with.
+//
+// draw_buckets spends amount from the buckets in priority order and records
+// how much came from each on the request hash as drawn:<bucket>. The last
+// bucket absorbs anything the others can't cover, so a balance inside its
+// kill grace goes negative there. return_buckets gives grains back to the
+// buckets the request drew them from, most recently drawn first.
+func bucketFunctions() string {
+	quoted := make([]string, len(FundingBuckets))
+	for i, b := range FundingBuckets {
+		quoted[i] = "'" + b + "'"
+	}
+
+	return `
+local bucket_order = {` + strings.Join(quoted, ", ") + `}
+local function draw_buckets(bkey, rkey, amount)
+    if amount <= 0 or redis.call('EXISTS', bkey) == 0 then
+        return
+    end
+    local remaining = amount
+    for i, b in ipairs(bucket_order) do
+        local take = remaining
+        if i < #bucket_order then
+            local have = tonumber(redis.call('HGET', bkey, b) or '0')
+            take = math.min(math.max(have, 0), remaining)
+        end
+        if take > 0 then
+            redis.call('HINCRBY', bkey, b, -take)
+            redis.call('HINCRBY', rkey, 'drawn:' .. b, take)
+            remaining = remaining - take
+        end
+    end
+end
+local function return_buckets(bkey, rkey, amount)
+    if amount <= 0 or redis.call('EXISTS', bkey) == 0 then
+        return
+    end
+    local remaining = amount
+    for i = #bucket_order, 1, -1 do
+        local b = bucket_order[i]
+        local drawn = tonumber(redis.call('HGET', rkey, 'drawn:' .. b) or '0')
+        local give = math.min(drawn, remaining)
+        if give > 0 then
+            redis.call('HINCRBY', bkey, b, give)
+            redis.call('HINCRBY', rkey, 'drawn:' .. b, -give)
+            remaining = remaining - give
+        end
+    end
+end
+`
+}
+
+// GetBalanceBuckets breaks a customer's balance down by funding bucket, in
+// priority order.
+//
+// A single-bucket customer gets one BucketPaid entry holding the whole
+// balance, so callers don't need to special-case them. found is false when
+// the customer has no balance in Redis; see GetBalance.
+func (l *Ledger) GetBalanceBuckets(ctx context.Context, customerID string) (buckets []BucketBalance, found bool, err error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	pipe := l.redis.Pipeline()
+	balanceCmd := pipe.Get(ctx, balanceKey(customerID, currency))
+	bucketsCmd := pipe.HGetAll(ctx, bucketsKey(customerID, currency))
+	_, err = pipe.Exec(ctx)
+
+	if err != nil && err != redis.Nil {
+		return nil, false, redisError("pipeline", err)
+	}
+
+	balance, err := balanceCmd.Int64()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("invalid balance: %w", err)
+	}
+
+	fields := bucketsCmd.Val()
+	if len(fields) == 0 {
+		return []BucketBalance{{Bucket: BucketPaid, Grains: balance}}, true, nil
+	}
+
+	buckets = make([]BucketBalance, 0, len(FundingBuckets))
+	for _, b := range FundingBuckets {
+		var grains int64
+		if v, ok := fields[b]; ok {
+			grains, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid %s bucket: %w", b, err)
+			}
+		}
+		buckets = append(buckets, BucketBalance{Bucket: b, Grains: grains})
+	}
+
+	return buckets, true, nil
+}
@@ -0,0 +1,210 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reserveAndDeduct reserves 300 grains for req_1 and streams deduct grains.
+func reserveAndDeduct(t *testing.T, l *Ledger, deduct int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: deduct})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+}
+
+func assertBuckets(t *testing.T, l *Ledger, promo, paid int64) {
+	t.Helper()
+
+	buckets, found, err := l.GetBalanceBuckets(context.Background(), "cus_1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, []BucketBalance{
+		{Bucket: BucketPromo, Grains: promo},
+		{Bucket: BucketPaid, Grains: paid},
+	}, buckets)
+
+	balance, _, _, _, err := l.GetBalance(context.Background(), "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, promo+paid, balance, "buckets must sum to the combined balance")
+}
+
+func TestBuckets_PromoConsumedBeforePaid(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "600")
+	mr.HSet("customer:buckets:cus_1", "promo", "100", "paid", "500")
+
+	reserveAndDeduct(t, l, 80)
+	assertBuckets(t, l, 20, 500)
+
+	_, err := l.DeductGrains(context.Background(), DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 70})
+	require.NoError(t, err)
+	assertBuckets(t, l, 0, 450)
+
+	assert.Equal(t, "100", mr.HGet("request:req_1", "drawn:promo"))
+	assert.Equal(t, "50", mr.HGet("request:req_1", "drawn:paid"))
+}
+
+func TestBuckets_RefundReturnsToBucketItCameFrom(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "600")
+	mr.HSet("customer:buckets:cus_1", "promo", "100", "paid", "500")
+
+	// 100 promo + 50 paid drawn; the 30 refunded were the paid grains.
+	reserveAndDeduct(t, l, 150)
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 120,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(30), fin.RefundedGrains)
+	assertBuckets(t, l, 0, 480)
+}
+
+func TestBuckets_LargeRefundSpillsBackIntoPromo(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "600")
+	mr.HSet("customer:buckets:cus_1", "promo", "100", "paid", "500")
+
+	reserveAndDeduct(t, l, 150)
+	_, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 20,
+	})
+	require.NoError(t, err)
+	assertBuckets(t, l, 80, 500)
+}
+
+func TestBuckets_UnderchargeDrawsInPriorityOrder(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "600")
+	mr.HSet("customer:buckets:cus_1", "promo", "100", "paid", "500")
+
+	reserveAndDeduct(t, l, 60)
+	_, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 160,
+	})
+	require.NoError(t, err)
+	assertBuckets(t, l, 0, 440)
+}
+
+func TestBuckets_RefusedCancelKeepsBucketsDrawn(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "600")
+	mr.HSet("customer:buckets:cus_1", "promo", "100", "paid", "500")
+
+	reserveAndDeduct(t, l, 150)
+	cancelled, err := l.CancelRequest(context.Background(), "cus_1", "req_1")
+	require.NoError(t, err)
+	require.Equal(t, CancellationRequestInProgress, cancelled.ErrorCode)
+	assertBuckets(t, l, 0, 450)
+}
+
+func TestBuckets_GraceOverdraftLandsInPaid(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "100")
+	mr.HSet("customer:buckets:cus_1", "promo", "40", "paid", "60")
+	mr.HSet("customer:config:cus_1", "kill_grace_grains", "50")
+	mr.HSet("request:req_1", "status", "reserved")
+
+	res, err := l.DeductGrains(context.Background(), DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 130})
+	require.NoError(t, err)
+	require.True(t, res.Success)
+	assertBuckets(t, l, 0, -30)
+}
+
+func TestBuckets_SingleBucketCustomerUnchanged(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "600")
+
+	reserveAndDeduct(t, l, 150)
+	assert.False(t, mr.Exists("customer:buckets:cus_1"))
+	assert.Empty(t, mr.HGet("request:req_1", "drawn:paid"))
+
+	buckets, found, err := l.GetBalanceBuckets(context.Background(), "cus_1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, []BucketBalance{{Bucket: BucketPaid, Grains: 450}}, buckets)
+
+	_, found, err = l.GetBalanceBuckets(context.Background(), "cus_missing")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestAdjustBalance_PromoGrantSplitsSingleBucketCustomer(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "500")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE customers SET").
+		WithArgs(int64(100), "cus_1").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}).AddRow(600))
+	mock.ExpectExec("INSERT INTO customer_balance_buckets").
+		WithArgs("cus_1", "paid", int64(500)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO customer_balance_buckets").
+		WithArgs("cus_1", "promo", int64(100)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, err := l.AdjustBalance(ctx, AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: 100,
+		Reason:      "launch promotion",
+		Operator:    "alice@example.com",
+		Bucket:      BucketPromo,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), res.NewBalance)
+	assertBuckets(t, l, 100, 500)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = l.AdjustBalance(ctx, AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: 100,
+		Reason:      "test",
+		Operator:    "bob",
+		Bucket:      "gift",
+	})
+	assert.ErrorIs(t, err, ErrUnknownBucket)
+}
@@ -0,0 +1,144 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CancellationResult contains the outcome of CancelRequest.
+type CancellationResult struct {
+	Success bool
+
+	// AlreadyTerminal is set when the request had already been finalized;
+	// nothing was changed.
+	AlreadyTerminal bool
+
+	// ReleasedGrains is the reservation returned to available balance.
+	ReleasedGrains int64
+
+	ErrorCode string
+}
+
+// CancellationRequestInProgress is the CancellationResult.ErrorCode for a
+// request that streaming has already deducted from. A cancelled request
+// costs nothing, so it isn't cancelled; finalize it instead.
+const CancellationRequestInProgress = "REQUEST_IN_PROGRESS"
+
+// cancellation is the queued PostgreSQL write for a cancelled request.
+type cancellation struct {
+	CustomerID string
+	RequestID  string
+}
+
+// CancelRequest releases a reservation the client decided not to use.
+//
+// Without this a reservation is held until the request hash expires, which
+// locks up the customer's available balance for up to an hour. The request
+// hash is deleted and the request is recorded as 'cancelled' with zero cost.
+//
+// Only a request with no usage can be cancelled: once DeductGrains has taken
+// anything, CancelRequest changes nothing and returns ErrorCode
+// CancellationRequestInProgress, so the usage is charged when the request is
+// finalized (or released, see ReleaseReservation).
+//
+// Cancelling a request that has already been finalized is a no-op and
+// reports success. A request that was never reserved, has expired, or was
+// already cancelled returns ErrorCode "REQUEST_NOT_FOUND".
+//
+// Performance: 1-3ms typical
+func (l *Ledger) CancelRequest(ctx context.Context, customerID, requestID string) (*CancellationResult, error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := l.cancelRequestScript.Run(ctx, l.redis, l.cancelScriptKeys(customerID, requestID, currency)).Result()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("cancel_request lua script failed")
+		return nil, scriptError(err)
+	}
+
+	// Parse result: {success, released, code}
+	resultArray := result.([]interface{})
+	code, _ := resultArray[2].(string)
+
+	if resultArray[0].(int64) != 1 {
+		l.log.Warn().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Str("error_code", code).
+			Msg("cancel_request failed")
+		return &CancellationResult{ErrorCode: code}, nil
+	}
+
+	if code == "ALREADY_TERMINAL" {
+		l.log.Info().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("cancel_request ignored, request already finalized")
+		return &CancellationResult{Success: true, AlreadyTerminal: true}, nil
+	}
+
+	res := &CancellationResult{
+		Success:        true,
+		ReleasedGrains: resultArray[1].(int64),
+	}
+
+	l.log.Info().
+		Str("customer_id", customerID).
+		Str("request_id", requestID).
+		Int64("released", res.ReleasedGrains).
+		Msg("cancel_request completed")
+
+	l.trace(requestID, traceStageCancel).
+		Str("customer_id", customerID).
+		Int64("released", res.ReleasedGrains).
+		Msg("request trace")
+
+	// Write to PostgreSQL (queued unless sync writes are on)
+	err = l.persist(writeOp{
+		opType:     "cancellation",
+		customerID: customerID,
+		data:       cancellation{CustomerID: customerID, RequestID: requestID},
+		ctx:        context.Background(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// cancelScriptKeys builds the KEYS for the cancel script.
+func (l *Ledger) cancelScriptKeys(customerID, requestID, currency string) []string {
+	return []string{
+		reservedKey(customerID, currency),
+		fmt.Sprintf("request:%s", requestID),
+		totalReservedKey,
+		reservedLowKey(customerID, currency),
+		inflightKey(customerID),
+	}
+}
+
+// writeCancellationToDB marks a request cancelled in PostgreSQL.
+//
+// A cancelled request never had a deduction, so there is no transaction to
+// record: the request simply ends with zero cost.
+func (l *Ledger) writeCancellationToDB(ctx context.Context, c cancellation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := l.db.ExecContext(ctx, `
+		UPDATE requests SET
+			actual_cost_grains = 0,
+			status = 'cancelled',
+			completed_at = NOW()
+		WHERE request_id = $1
+	`, c.RequestID)
+
+	return err
+}
@@ -0,0 +1,143 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelRequest_ReleasesFreshReservation(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set(totalBalanceKey, "1000")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	<-l.writeQueues[0] // preflight
+
+	cancelled, err := l.CancelRequest(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.True(t, cancelled.Success)
+	assert.False(t, cancelled.AlreadyTerminal)
+	assert.Equal(t, int64(300), cancelled.ReleasedGrains)
+
+	balance, reserved, available, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance)
+	assert.Equal(t, int64(0), reserved)
+	assert.Equal(t, int64(1000), available)
+
+	assert.False(t, mr.Exists("request:req_1"))
+
+	totalBalance, totalReserved, err := l.GetTotals(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), totalBalance)
+	assert.Equal(t, int64(0), totalReserved)
+
+	require.Len(t, l.writeQueues[0], 1)
+	op := <-l.writeQueues[0]
+	assert.Equal(t, "cancellation", op.opType)
+	assert.Equal(t, cancellation{CustomerID: "cus_1", RequestID: "req_1"}, op.data)
+
+	// The hash is gone, so cancelling again finds nothing to release.
+	again, err := l.CancelRequest(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.False(t, again.Success)
+	assert.Equal(t, "REQUEST_NOT_FOUND", again.ErrorCode)
+}
+
+func TestCancelRequest_RefusedAfterDeductions(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	_, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 50})
+	require.NoError(t, err)
+	queued := len(l.writeQueues[0])
+
+	// Streaming already used grains; cancelling would hand them back.
+	cancelled, err := l.CancelRequest(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.False(t, cancelled.Success)
+	assert.Equal(t, CancellationRequestInProgress, cancelled.ErrorCode)
+	assert.Len(t, l.writeQueues[0], queued)
+
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(950), balance)
+	assert.Equal(t, int64(300), reserved)
+	assert.Equal(t, "streaming", mr.HGet("request:req_1", "status"))
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n, "still in flight")
+
+	// The request still finalizes at what it used.
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 50,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+
+	balance, reserved, _, _, err = l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(950), balance)
+	assert.Equal(t, int64(0), reserved)
+}
+
+func TestCancelRequest_AlreadyFinalizedIsNoop(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 120,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	queued := len(l.writeQueues[0])
+
+	cancelled, err := l.CancelRequest(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.True(t, cancelled.Success)
+	assert.True(t, cancelled.AlreadyTerminal)
+	assert.Equal(t, int64(0), cancelled.ReleasedGrains)
+
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Equal(t, int64(0), reserved)
+
+	status, err := l.redis.HGet(ctx, "request:req_1", "status").Result()
+	require.NoError(t, err)
+	assert.Equal(t, "completed", status)
+	assert.Len(t, l.writeQueues[0], queued, "no cancellation write for a finalized request")
+}
@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+)
+
+// CostMultiplier returns the multiple of provider's list price that
+// platformUserID pays under their contract (the cost_multipliers table), or
+// 1 if they have none.
+//
+// Multipliers are only read from the cache, which is loaded with the
+// pricing cache (see ReloadPricing).
+func (l *Ledger) CostMultiplier(platformUserID, provider string) float64 {
+	if m, ok := l.costMultipliers.Load(platformUserID + ":" + provider); ok {
+		return m.(float64)
+	}
+	return 1
+}
+
+// GetModelPricingFor is GetModelPricingIn with platformUserID's cost
+// multiplier for the provider applied. Prices are rounded to the nearest
+// grain.
+func (l *Ledger) GetModelPricingFor(platformUserID, model, provider, currency string) (*PricingInfo, error) {
+	pricing, err := l.GetModelPricingIn(model, provider, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	m := l.CostMultiplier(platformUserID, provider)
+	if m == 1 {
+		return pricing, nil
+	}
+
+	scaled := pricing.scaled(m)
+	return &scaled, nil
+}
+
+// loadCostMultipliers replaces the cost multiplier cache with the contents
+// of cost_multipliers.
+func (l *Ledger) loadCostMultipliers(ctx context.Context) error {
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT platform_user_id, provider, multiplier
+		FROM cost_multipliers
+	`)
+	if err != nil {
+		return fmt.Errorf("cost multiplier query failed: %w", err)
+	}
+	defer rows.Close()
+
+	current := make(map[string]bool)
+	for rows.Next() {
+		var platformUserID, provider string
+		var m float64
+		if err := rows.Scan(&platformUserID, &provider, &m); err != nil {
+			return fmt.Errorf("cost multiplier scan failed: %w", err)
+		}
+
+		key := platformUserID + ":" + provider
+		l.costMultipliers.Store(key, m)
+		current[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cost multiplier query failed: %w", err)
+	}
+
+	// Drop multipliers that were deleted
+	l.costMultipliers.Range(func(k, _ interface{}) bool {
+		if !current[k.(string)] {
+			l.costMultipliers.Delete(k)
+		}
+		return true
+	})
+
+	return nil
+}
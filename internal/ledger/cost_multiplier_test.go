@@ -0,0 +1,111 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var multiplierCols = []string{"platform_user_id", "provider", "multiplier"}
+
+func TestCostMultiplier_LoadedWithPricing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	cols := []string{"model_name", "provider", "input_cost_per_million_tokens", "output_cost_per_million_tokens",
+		"image_cost_per_million_tokens", "audio_cost_per_million_tokens"}
+
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow("gpt-4", "openai", 30000000, 60000000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").
+		WillReturnRows(sqlmock.NewRows(multiplierCols).AddRow("user_a", "openai", 1.1))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(sqlmock.NewRows(aliasCols))
+
+	require.NoError(t, l.ReloadPricing(context.Background()))
+
+	assert.Equal(t, 1.1, l.CostMultiplier("user_a", "openai"))
+	assert.Equal(t, 1.0, l.CostMultiplier("user_a", "anthropic"), "other providers pay list price")
+	assert.Equal(t, 1.0, l.CostMultiplier("user_b", "openai"), "other users pay list price")
+
+	// user_a's contract ends.
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow("gpt-4", "openai", 30000000, 60000000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").
+		WillReturnRows(sqlmock.NewRows(multiplierCols))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(sqlmock.NewRows(aliasCols))
+
+	require.NoError(t, l.ReloadPricing(context.Background()))
+
+	assert.Equal(t, 1.0, l.CostMultiplier("user_a", "openai"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCostMultiplier_ChargesProportionallyMore(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	l.pricingCache.Store("gpt-4:openai", PricingInfo{
+		Model:                      "gpt-4",
+		Provider:                   "openai",
+		InputCostPerMillionTokens:  30_000_000,
+		OutputCostPerMillionTokens: 60_000_000,
+	})
+	l.costMultipliers.Store("user_a:openai", 1.1)
+
+	charge := func(platformUserID, customerID string) (deducted, finalized int64) {
+		t.Helper()
+
+		mr.Set("customer:balance:"+customerID, "1000000")
+
+		pricing, err := l.GetModelPricingFor(platformUserID, "gpt-4", "openai", "")
+		require.NoError(t, err)
+
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+			CustomerID:     customerID,
+			RequestID:      "req_" + customerID,
+			ReservedGrains: 200_000,
+			Pricing:        pricing,
+		})
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+
+		ded, err := l.DeductGrains(ctx, DeductionRequest{
+			CustomerID:     customerID,
+			RequestID:      "req_" + customerID,
+			TokensConsumed: 1000,
+			PriceFromPins:  true,
+			IsCompletion:   true,
+		})
+		require.NoError(t, err)
+		require.True(t, ded.Success)
+
+		fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+			CustomerID:       customerID,
+			RequestID:        "req_" + customerID,
+			Status:           "completed",
+			PromptTokens:     2000,
+			CompletionTokens: 1000,
+			PriceFromPins:    true,
+		})
+		require.NoError(t, err)
+		require.True(t, fin.Success)
+
+		return ded.GrainsDeducted, fin.ActualCostGrains
+	}
+
+	// 1000 completion tokens at 60M/1M, and 2000 prompt tokens at 30M/1M
+	// on top for the whole request.
+	deducted, finalized := charge("user_b", "cus_b")
+	assert.Equal(t, int64(60_000), deducted)
+	assert.Equal(t, int64(120_000), finalized)
+
+	deducted, finalized = charge("user_a", "cus_a")
+	assert.Equal(t, int64(66_000), deducted)
+	assert.Equal(t, int64(132_000), finalized)
+}
@@ -0,0 +1,146 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultCurrency is the currency of customers with none configured.
+// Balances predating multi-currency support are all USD.
+const DefaultCurrency = "USD"
+
+// GrainsPerUSD is how many grains make one US dollar.
+const GrainsPerUSD = 1_000_000
+
+// WithDefaultCurrency sets the currency assumed for customers whose config
+// hash has no currency (e.g. not yet synced since the currency column was
+// added). Defaults to DefaultCurrency.
+func WithDefaultCurrency(code string) Option {
+	return func(l *Ledger) {
+		l.defaultCurrency = code
+	}
+}
+
+// balanceKey returns the Redis balance key for a customer in a currency.
+//
+// USD keeps the original unsuffixed key so existing balances, scripts and
+// dashboards are unaffected; other currencies are suffixed with their code.
+func balanceKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:balance:%s", customerID)
+	}
+	return fmt.Sprintf("customer:balance:%s:%s", customerID, currency)
+}
+
+// reservedKey returns the Redis reserved-counter key; see balanceKey.
+func reservedKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:reserved:%s", customerID)
+	}
+	return fmt.Sprintf("customer:reserved:%s:%s", customerID, currency)
+}
+
+// customerCurrency returns the currency to use for a customer's keys.
+//
+// An explicit currency (e.g. from a CustomerConfig the caller already
+// loaded) is used as is, saving a round trip. Otherwise the customer's
+// config hash is consulted, falling back to the ledger default.
+func (l *Ledger) customerCurrency(ctx context.Context, customerID, explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+
+	currency, err := l.redis.HGet(ctx, fmt.Sprintf("customer:config:%s", customerID), "currency").Result()
+	if err != nil && err != redis.Nil {
+		return "", redisError("hget", err)
+	}
+
+	if currency == "" {
+		return l.currencyDefault(), nil
+	}
+	return currency, nil
+}
+
+// CustomerCurrency returns the currency a customer's balance is held in.
+func (l *Ledger) CustomerCurrency(ctx context.Context, customerID string) (string, error) {
+	return l.customerCurrency(ctx, customerID, "")
+}
+
+// currencyDefault returns the configured default currency.
+func (l *Ledger) currencyDefault() string {
+	if l.defaultCurrency == "" {
+		return DefaultCurrency
+	}
+	return l.defaultCurrency
+}
+
+// GetCurrencyRate returns how many grains of currency one USD grain is
+// worth (with caching). USD is always 1.
+func (l *Ledger) GetCurrencyRate(currency string) (float64, error) {
+	if currency == "" || currency == "USD" {
+		return 1, nil
+	}
+
+	// Try cache first
+	if cached, ok := l.currencyRates.Load(currency); ok {
+		return cached.(float64), nil
+	}
+
+	// Cache miss - load from database
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var rate float64
+	err := l.db.QueryRowContext(ctx, `
+		SELECT grains_per_usd_grain
+		FROM currency_rates
+		WHERE currency = $1
+	`, currency).Scan(&rate)
+
+	if err != nil {
+		return 0, fmt.Errorf("currency rate query failed for %s: %w", currency, err)
+	}
+
+	// Store in cache
+	l.currencyRates.Store(currency, rate)
+
+	return rate, nil
+}
+
+// USDToGrains converts an amount in dollars to grains of currency at the
+// stored currency_rates rate, rounded to the nearest grain. It fails for an
+// amount that isn't finite or doesn't fit in an int64.
+func (l *Ledger) USDToGrains(usd float64, currency string) (int64, error) {
+	rate, err := l.GetCurrencyRate(currency)
+	if err != nil {
+		return 0, err
+	}
+
+	grains := math.Round(usd * GrainsPerUSD * rate)
+	if math.IsNaN(grains) || grains >= math.MaxInt64 || grains <= math.MinInt64 {
+		return 0, fmt.Errorf("$%g is out of range", usd)
+	}
+
+	return int64(grains), nil
+}
+
+// GetModelPricingIn returns pricing for a model converted to currency at the
+// stored currency_rates rate. Prices are rounded to the nearest grain.
+func (l *Ledger) GetModelPricingIn(model, provider, currency string) (*PricingInfo, error) {
+	pricing, err := l.GetModelPricing(model, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	rate, err := l.GetCurrencyRate(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := pricing.scaled(rate)
+	return &converted, nil
+}
@@ -0,0 +1,107 @@
+package ledger
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetModelPricingIn_ConvertsAtStoredRate(t *testing.T) {
+	l, _ := newTestLedger(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	l.pricingCache.Store("gpt-4:openai", PricingInfo{
+		Model:                      "gpt-4",
+		Provider:                   "openai",
+		InputCostPerMillionTokens:  30_000_000,
+		OutputCostPerMillionTokens: 60_000_000,
+	})
+
+	mock.ExpectQuery("SELECT grains_per_usd_grain").
+		WithArgs("EUR").
+		WillReturnRows(sqlmock.NewRows([]string{"grains_per_usd_grain"}).AddRow("0.92"))
+
+	pricing, err := l.GetModelPricingIn("gpt-4", "openai", "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, int64(27_600_000), pricing.InputCostPerMillionTokens)
+	assert.Equal(t, int64(55_200_000), pricing.OutputCostPerMillionTokens)
+
+	// The rate is cached; a second lookup doesn't hit the database.
+	_, err = l.GetModelPricingIn("gpt-4", "openai", "EUR")
+	require.NoError(t, err)
+
+	// USD needs no rate at all.
+	usd, err := l.GetModelPricingIn("gpt-4", "openai", "USD")
+	require.NoError(t, err)
+	assert.Equal(t, int64(30_000_000), usd.InputCostPerMillionTokens)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckAndReserveBalance_UsesCustomerCurrency(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.HSet("customer:config:cus_eu", "currency", "EUR")
+	mr.Set("customer:balance:cus_eu:EUR", "1000")
+	// A stale USD balance must not be spent.
+	mr.Set("customer:balance:cus_eu", "50")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_eu",
+		RequestID:      "req_1",
+		ReservedGrains: 400,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	reserved, err := mr.Get("customer:reserved:cus_eu:EUR")
+	require.NoError(t, err)
+	assert.Equal(t, "400", reserved)
+
+	_, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_eu", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+
+	balance, reservedGrains, available, _, err := l.GetBalance(ctx, "cus_eu")
+	require.NoError(t, err)
+	assert.Equal(t, int64(900), balance)
+	assert.Equal(t, int64(400), reservedGrains)
+	assert.Equal(t, int64(500), available)
+
+	// Customers without a configured currency keep the legacy USD keys.
+	mr.Set("customer:balance:cus_us", "700")
+	balance, _, _, _, err = l.GetBalance(ctx, "cus_us")
+	require.NoError(t, err)
+	assert.Equal(t, int64(700), balance)
+}
+
+func TestUSDToGrains(t *testing.T) {
+	l, _ := newTestLedger(t)
+	l.currencyRates.Store("EUR", 0.92)
+
+	grains, err := l.USDToGrains(12.34, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12_340_000), grains)
+
+	grains, err = l.USDToGrains(0.0000004, "USD")
+	require.NoError(t, err)
+	assert.Zero(t, grains, "rounds to the nearest grain")
+
+	grains, err = l.USDToGrains(10, "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9_200_000), grains)
+
+	_, err = l.USDToGrains(1e13, "USD")
+	assert.Error(t, err, "doesn't fit in an int64")
+
+	_, err = l.USDToGrains(math.NaN(), "USD")
+	assert.Error(t, err)
+}
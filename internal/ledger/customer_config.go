@@ -0,0 +1,115 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// CustomerConfig holds per-customer settings that the hot path needs.
+//
+// These live in PostgreSQL on the customers row and are copied into the
+// Redis hash "customer:config:<customer_id>" by the syncer, so reading them
+// costs a single HGETALL. A zero value for any field means "no override,
+// use the server default".
+type CustomerConfig struct {
+	// MaxReservationGrains caps the size of a single reservation.
+	MaxReservationGrains int64
+
+	// Currency is the ISO 4217 code the customer's balance is held in.
+	Currency string
+
+	// KillGraceGrains is how far below zero streaming may take the balance
+	// before the kill switch fires. The deduct script reads it directly
+	// from the config hash.
+	KillGraceGrains int64
+
+	// BillingMode is BillingPrepaid or BillingPostpaid. Empty means
+	// prepaid.
+	BillingMode string
+
+	// CreditCeilingGrains caps a postpaid customer's debt plus
+	// reservations (see WithPostpaidCreditCeiling for the default).
+	CreditCeilingGrains int64
+
+	// RefundPolicy is one of the RefundPolicy constants. Empty means
+	// RefundPolicyFull. The finalize script reads it, and RefundPercent,
+	// directly from the config hash.
+	RefundPolicy string
+
+	// RefundPercent is the percentage refunded under
+	// RefundPolicyPartialPercent.
+	RefundPercent int64
+
+	// MaxConcurrentRequests caps how many requests the customer may have
+	// reserved and not yet finalized, cancelled, released or abandoned.
+	// Zero means no limit. The reserve script reads it directly from the
+	// config hash.
+	MaxConcurrentRequests int64
+
+	// MinimumViableBalanceGrains is the available balance below which a
+	// prepaid customer's reservations are refused with
+	// RejectionBalanceTooLow (see WithMinimumViableBalance for the
+	// default). The reserve script reads it directly from the config hash.
+	MinimumViableBalanceGrains int64
+}
+
+// Postpaid reports whether the customer is billed after the fact rather
+// than out of a prepaid balance.
+func (c *CustomerConfig) Postpaid() bool {
+	return c != nil && c.BillingMode == BillingPostpaid
+}
+
+// ReservationCap returns the effective cap on a single reservation for this
+// customer, given the server-wide default. Zero means uncapped.
+func (c *CustomerConfig) ReservationCap(defaultCap int64) int64 {
+	if c != nil && c.MaxReservationGrains > 0 {
+		return c.MaxReservationGrains
+	}
+	return defaultCap
+}
+
+// CurrencyOr returns the customer's currency, or defaultCurrency if none is
+// configured.
+func (c *CustomerConfig) CurrencyOr(defaultCurrency string) string {
+	if c != nil && c.Currency != "" {
+		return c.Currency
+	}
+	return defaultCurrency
+}
+
+// GetCustomerConfig reads a customer's config from Redis.
+//
+// A customer with no config hash gets an empty CustomerConfig (all
+// defaults), not an error.
+func (l *Ledger) GetCustomerConfig(ctx context.Context, customerID string) (*CustomerConfig, error) {
+	fields, err := l.redis.HGetAll(ctx, fmt.Sprintf("customer:config:%s", customerID)).Result()
+	if err != nil {
+		return nil, redisError("hgetall", err)
+	}
+
+	cfg := &CustomerConfig{}
+	if v, ok := fields["max_reservation_grains"]; ok {
+		cfg.MaxReservationGrains, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := fields["kill_grace_grains"]; ok {
+		cfg.KillGraceGrains, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := fields["credit_ceiling_grains"]; ok {
+		cfg.CreditCeilingGrains, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := fields["refund_percent"]; ok {
+		cfg.RefundPercent, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := fields["max_concurrent_requests"]; ok {
+		cfg.MaxConcurrentRequests, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := fields["minimum_viable_balance_grains"]; ok {
+		cfg.MinimumViableBalanceGrains, _ = strconv.ParseInt(v, 10, 64)
+	}
+	cfg.Currency = fields["currency"]
+	cfg.BillingMode = fields["billing_mode"]
+	cfg.RefundPolicy = fields["refund_policy"]
+
+	return cfg, nil
+}
@@ -0,0 +1,28 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomerConfig_ReservationCap(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.HSet("customer:config:cus_override", "max_reservation_grains", "5000")
+
+	// No config hash at all: server default applies.
+	cfg, err := l.GetCustomerConfig(ctx, "cus_default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), cfg.ReservationCap(1000))
+	assert.Equal(t, int64(0), cfg.ReservationCap(0))
+
+	// Per-customer override wins over the server default.
+	cfg, err = l.GetCustomerConfig(ctx, "cus_override")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5000), cfg.ReservationCap(1000))
+	assert.Equal(t, int64(5000), cfg.ReservationCap(0))
+}
@@ -0,0 +1,206 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrCustomerExists is returned by CreateCustomer for a customer ID that is
+// already taken.
+var ErrCustomerExists = errors.New("customer already exists")
+
+// pqUniqueViolation is the SQLSTATE of a duplicate key.
+const pqUniqueViolation = "23505"
+
+// CreateCustomerRequest contains parameters for CreateCustomer.
+type CreateCustomerRequest struct {
+	CustomerID     string
+	PlatformUserID string
+	Name           string
+
+	// Currency the balance is in. Empty means DefaultCurrency.
+	Currency string
+
+	// InitialBalanceGrains is the customer's opening balance, in Currency.
+	InitialBalanceGrains int64
+}
+
+// DefaultListCustomersLimit is the page size ListCustomers uses when none
+// is given.
+const DefaultListCustomersLimit = 50
+
+// Customer is a customer as recorded in PostgreSQL.
+//
+// BalanceGrains is the durable balance, which can trail Redis by the
+// finalizations still queued for PostgreSQL; GetBalance has the live one.
+type Customer struct {
+	CustomerID          string    `json:"customer_id"`
+	Name                string    `json:"name"`
+	Currency            string    `json:"currency"`
+	BalanceGrains       int64     `json:"balance_grains"`
+	LifetimeSpentGrains int64     `json:"lifetime_spent_grains"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// CustomerPage is one page of ListCustomers results.
+type CustomerPage struct {
+	Customers []Customer `json:"customers"`
+
+	// NextCursor fetches the next page, or is empty on the last one.
+	NextCursor string `json:"next_cursor"`
+}
+
+const customerColumns = `
+	customer_id, COALESCE(name, ''), currency, current_balance_grains,
+	lifetime_spent_grains, created_at`
+
+// GetCustomer returns one customer, or ErrCustomerNotFound.
+func (l *Ledger) GetCustomer(ctx context.Context, customerID string) (*Customer, error) {
+	var c Customer
+	err := l.db.QueryRowContext(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		WHERE customer_id = $1
+	`, customerID).Scan(&c.CustomerID, &c.Name, &c.Currency, &c.BalanceGrains,
+		&c.LifetimeSpentGrains, &c.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrCustomerNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("customer query failed: %w", err)
+	}
+
+	return &c, nil
+}
+
+// CreateCustomer creates a customer in PostgreSQL with their opening
+// balance, and returns it as recorded.
+//
+// A non-zero opening balance is recorded as an 'opening_balance'
+// transaction in the same PostgreSQL transaction, so the balance equals the
+// sum of the customer's transactions from the start and
+// verify_balance_integrity doesn't report them. The customer reaches Redis
+// with the next sync, or on first use (see WithBalanceLoader).
+func (l *Ledger) CreateCustomer(ctx context.Context, req CreateCustomerRequest) (*Customer, error) {
+	if req.CustomerID == "" || req.PlatformUserID == "" {
+		return nil, fmt.Errorf("customer_id and platform_user_id are required")
+	}
+	if req.InitialBalanceGrains < 0 {
+		return nil, fmt.Errorf("initial balance must not be negative")
+	}
+	if req.Currency == "" {
+		req.Currency = DefaultCurrency
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var c Customer
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO customers (customer_id, platform_user_id, name, currency, current_balance_grains)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		RETURNING `+customerColumns,
+		req.CustomerID, req.PlatformUserID, req.Name, req.Currency, req.InitialBalanceGrains,
+	).Scan(&c.CustomerID, &c.Name, &c.Currency, &c.BalanceGrains, &c.LifetimeSpentGrains, &c.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerExists, req.CustomerID)
+	} else if err != nil {
+		return nil, fmt.Errorf("insert customer failed: %w", err)
+	}
+
+	if req.InitialBalanceGrains != 0 {
+		err = insertTransaction(ctx, tx, Transaction{
+			TransactionID: uuid.New().String(),
+			CustomerID:    req.CustomerID,
+			AmountGrains:  req.InitialBalanceGrains,
+			Type:          TransactionOpeningBalance,
+			Description:   "Opening balance",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("insert opening balance failed: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit failed: %w", err)
+	}
+
+	l.log.Info().
+		Str("customer_id", c.CustomerID).
+		Str("currency", c.Currency).
+		Int64("balance_grains", c.BalanceGrains).
+		Msg("customer created")
+
+	return &c, nil
+}
+
+// ListCustomers returns a page of customers, newest first.
+//
+// Like ListRequests, pages use keyset pagination, here on
+// (created_at, customer_id). cursor is a previous page's NextCursor, or
+// empty for the first page; limit is the page size
+// (DefaultListCustomersLimit if <= 0).
+func (l *Ledger) ListCustomers(ctx context.Context, cursor string, limit int) (*CustomerPage, error) {
+	if limit <= 0 {
+		limit = DefaultListCustomersLimit
+	}
+
+	where := ""
+	args := []interface{}{limit + 1}
+	if cursor != "" {
+		createdAt, customerID, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		where = "WHERE (created_at, customer_id) < ($2, $3)"
+		args = append(args, createdAt, customerID)
+	}
+
+	// One extra row tells us whether there is a next page
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		`+where+`
+		ORDER BY created_at DESC, customer_id DESC
+		LIMIT $1
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list customers query failed: %w", err)
+	}
+	defer rows.Close()
+
+	page := &CustomerPage{Customers: []Customer{}}
+	for rows.Next() {
+		var c Customer
+		if err := rows.Scan(&c.CustomerID, &c.Name, &c.Currency, &c.BalanceGrains,
+			&c.LifetimeSpentGrains, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("list customers scan failed: %w", err)
+		}
+		page.Customers = append(page.Customers, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list customers query failed: %w", err)
+	}
+
+	if len(page.Customers) > limit {
+		page.Customers = page.Customers[:limit]
+		last := page.Customers[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.CustomerID)
+	}
+
+	return page, nil
+}
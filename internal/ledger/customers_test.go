@@ -0,0 +1,149 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var customerCols = []string{
+	"customer_id", "name", "currency", "current_balance_grains", "lifetime_spent_grains", "created_at",
+}
+
+func TestListCustomers_Pagination(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`FROM customers\s+ORDER BY created_at DESC, customer_id DESC\s+LIMIT \$1`).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(customerCols).
+			AddRow("cus_c", "Carol", "USD", 5000, 100, t0).
+			AddRow("cus_b", "", "EUR", 0, 0, t0.Add(-time.Hour)).
+			AddRow("cus_a", "Alice", "USD", 10, 9990, t0.Add(-2*time.Hour)))
+
+	page, err := l.ListCustomers(context.Background(), "", 2)
+	require.NoError(t, err)
+	require.Len(t, page.Customers, 2)
+	assert.Equal(t, Customer{
+		CustomerID: "cus_c", Name: "Carol", Currency: "USD",
+		BalanceGrains: 5000, LifetimeSpentGrains: 100, CreatedAt: t0,
+	}, page.Customers[0])
+	require.NotEmpty(t, page.NextCursor)
+
+	mock.ExpectQuery(`WHERE \(created_at, customer_id\) < \(\$2, \$3\)`).
+		WithArgs(3, t0.Add(-time.Hour), "cus_b").
+		WillReturnRows(sqlmock.NewRows(customerCols).
+			AddRow("cus_a", "Alice", "USD", 10, 9990, t0.Add(-2*time.Hour)))
+
+	page, err = l.ListCustomers(context.Background(), page.NextCursor, 2)
+	require.NoError(t, err)
+	require.Len(t, page.Customers, 1)
+	assert.Equal(t, "cus_a", page.Customers[0].CustomerID)
+	assert.Empty(t, page.NextCursor)
+
+	_, err = l.ListCustomers(context.Background(), "garbage!", 2)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetCustomer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_1").
+		WillReturnRows(sqlmock.NewRows(customerCols).
+			AddRow("cus_1", "Acme", "USD", 2500, 750, created))
+
+	c, err := l.GetCustomer(context.Background(), "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2500), c.BalanceGrains)
+	assert.Equal(t, int64(750), c.LifetimeSpentGrains)
+	assert.Equal(t, created, c.CreatedAt)
+
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_missing").
+		WillReturnRows(sqlmock.NewRows(customerCols))
+
+	_, err = l.GetCustomer(context.Background(), "cus_missing")
+	assert.ErrorIs(t, err, ErrCustomerNotFound)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateCustomer_OpeningBalancePassesIntegrityCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// verify_balance_integrity compares current_balance_grains with the sum
+	// of the customer's transactions: the opening balance is that sum.
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO customers").
+		WithArgs("cus_new", "user_1", "Dana", "USD", int64(5000)).
+		WillReturnRows(sqlmock.NewRows(customerCols).AddRow("cus_new", "Dana", "USD", 5000, 0, created))
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(sqlmock.AnyArg(), "cus_new", int64(5000), "opening_balance", "", "Opening balance", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	c, err := l.CreateCustomer(context.Background(), CreateCustomerRequest{
+		CustomerID:           "cus_new",
+		PlatformUserID:       "user_1",
+		Name:                 "Dana",
+		InitialBalanceGrains: 5000,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5000), c.BalanceGrains)
+
+	// A customer starting at zero has no transactions, which sum to zero.
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO customers").
+		WithArgs("cus_zero", "user_1", "", "EUR", int64(0)).
+		WillReturnRows(sqlmock.NewRows(customerCols).AddRow("cus_zero", "", "EUR", 0, 0, created))
+	mock.ExpectCommit()
+
+	_, err = l.CreateCustomer(context.Background(), CreateCustomerRequest{
+		CustomerID: "cus_zero", PlatformUserID: "user_1", Currency: "EUR",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateCustomer_Duplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO customers").
+		WillReturnError(&pq.Error{Code: pqUniqueViolation, Message: "duplicate key value violates unique constraint"})
+	mock.ExpectRollback()
+
+	_, err = l.CreateCustomer(context.Background(), CreateCustomerRequest{
+		CustomerID: "cus_1", PlatformUserID: "user_1", InitialBalanceGrains: 100,
+	})
+	assert.ErrorIs(t, err, ErrCustomerExists)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
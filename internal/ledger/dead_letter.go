@@ -0,0 +1,301 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	stdsync "sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// replayLease is how long a claimed failed write is hidden from other
+	// replayers. It must comfortably exceed one apply attempt.
+	replayLease = time.Minute
+
+	// maxReplayBackoff caps the delay between attempts for one failed write.
+	maxReplayBackoff = time.Hour
+)
+
+// storeFailedWrite saves a write that exhausted its retries to the
+// failed_writes table so the replay worker can apply it later.
+func (l *Ledger) storeFailedWrite(op writeOp, cause error) error {
+	payload, err := encodeWriteOp(op)
+	if err != nil {
+		return fmt.Errorf("encode payload failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = l.db.ExecContext(ctx, `
+		INSERT INTO failed_writes (op_type, customer_id, payload, last_error)
+		VALUES ($1, $2, $3, $4)
+	`, op.opType, op.customerID, payload, cause.Error())
+
+	return err
+}
+
+// finalizationPayload is how a finalization write is stored: the request,
+// plus the amounts finalizeCompleted set on it from the script's result,
+// which aren't exported.
+type finalizationPayload struct {
+	FinalizationRequest
+	WithheldGrains      int64 `json:",omitempty"`
+	ShortfallDebtGrains int64 `json:",omitempty"`
+}
+
+// encodeWriteOp encodes a queued write's data for storage (see
+// decodeWriteOp).
+func encodeWriteOp(op writeOp) ([]byte, error) {
+	if req, ok := op.data.(FinalizationRequest); ok {
+		return json.Marshal(finalizationPayload{
+			FinalizationRequest: req,
+			WithheldGrains:      req.withheldGrains,
+			ShortfallDebtGrains: req.shortfallDebtGrains,
+		})
+	}
+	return json.Marshal(op.data)
+}
+
+// decodeWriteOp rebuilds a queued write from its failed_writes row or
+// write-ahead log entry.
+func decodeWriteOp(opType, customerID string, payload []byte) (writeOp, error) {
+	op := writeOp{opType: opType, customerID: customerID, ctx: context.Background()}
+
+	var err error
+	switch opType {
+	case "preflight":
+		var req ReservationRequest
+		err = json.Unmarshal(payload, &req)
+		op.data = req
+	case "finalization":
+		var p finalizationPayload
+		err = json.Unmarshal(payload, &p)
+		p.withheldGrains = p.WithheldGrains
+		p.shortfallDebtGrains = p.ShortfallDebtGrains
+		op.data = p.FinalizationRequest
+	case "cancellation":
+		var c cancellation
+		err = json.Unmarshal(payload, &c)
+		op.data = c
+	default:
+		return op, fmt.Errorf("unknown write op type: %s", opType)
+	}
+
+	return op, err
+}
+
+// failedWrite is a claimed failed_writes row.
+type failedWrite struct {
+	id       int64
+	op       writeOp
+	attempts int
+}
+
+// deadLetterReplayer periodically replays failed writes until Close.
+//
+// It is deliberately low priority: at most batchSize rows per tick, with at
+// most concurrency applied at once, so a backlog built up during a
+// PostgreSQL incident doesn't hammer it the moment it recovers.
+func (l *Ledger) deadLetterReplayer(interval time.Duration, batchSize, concurrency int) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), replayLease)
+			replayed, err := l.replayFailedWrites(ctx, interval, batchSize, concurrency)
+			if err != nil {
+				l.log.Warn().Err(err).Msg("failed write replay failed")
+			} else if replayed > 0 {
+				l.log.Info().Int("replayed", replayed).Msg("failed writes replayed")
+			}
+			cancel()
+
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// replayFailedWrites claims up to batchSize due rows and re-applies them.
+// Returns how many were applied and deleted.
+//
+// A customer's writes are replayed in their original order, one at a time,
+// and stop at the first failure so a finalization is never applied ahead of
+// its preflight. Different customers are replayed in parallel, up to
+// concurrency at once. A failed row is rescheduled with exponential backoff
+// starting at baseBackoff.
+func (l *Ledger) replayFailedWrites(ctx context.Context, baseBackoff time.Duration, batchSize, concurrency int) (int, error) {
+	claimed, err := l.claimFailedWrites(ctx, `
+		UPDATE failed_writes SET next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM failed_writes
+			WHERE next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, op_type, customer_id, payload, attempts
+	`, int64(replayLease.Seconds()), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return l.replayClaimed(ctx, claimed, baseBackoff, concurrency), nil
+}
+
+// claimedWrites are failed writes claimed for replay, grouped by customer
+// in the order the customers were first seen.
+type claimedWrites struct {
+	customers  []string
+	byCustomer map[string][]failedWrite
+
+	// undecodable counts claimed rows that couldn't be decoded. They are
+	// left for a human; the lease keeps them from spinning.
+	undecodable int
+}
+
+// claimFailedWrites runs a query that leases failed_writes rows and returns
+// (id, op_type, customer_id, payload, attempts), decoding them for replay.
+func (l *Ledger) claimFailedWrites(ctx context.Context, query string, args ...interface{}) (*claimedWrites, error) {
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("claim failed writes failed: %w", err)
+	}
+	defer rows.Close()
+
+	// Group by customer, keeping each customer's rows in id order
+	claimed := &claimedWrites{byCustomer: make(map[string][]failedWrite)}
+	for rows.Next() {
+		var id int64
+		var opType, customerID string
+		var payload []byte
+		var attempts int
+		if err := rows.Scan(&id, &opType, &customerID, &payload, &attempts); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+
+		op, err := decodeWriteOp(opType, customerID, payload)
+		if err != nil {
+			// Leave it for a human; the lease keeps it from spinning
+			l.log.Error().Err(err).Int64("failed_write_id", id).Msg("undecodable failed write")
+			claimed.undecodable++
+			continue
+		}
+
+		if _, ok := claimed.byCustomer[customerID]; !ok {
+			claimed.customers = append(claimed.customers, customerID)
+		}
+		claimed.byCustomer[customerID] = append(claimed.byCustomer[customerID], failedWrite{id: id, op: op, attempts: attempts})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	// RETURNING doesn't promise the subquery's order
+	for _, writes := range claimed.byCustomer {
+		sort.Slice(writes, func(i, j int) bool { return writes[i].id < writes[j].id })
+	}
+
+	return claimed, nil
+}
+
+// replayClaimed re-applies claimed writes, one customer at a time in id
+// order and up to concurrency customers in parallel (see
+// replayFailedWrites). Returns how many were applied and deleted.
+func (l *Ledger) replayClaimed(ctx context.Context, claimed *claimedWrites, baseBackoff time.Duration, concurrency int) int {
+	var mu stdsync.Mutex
+	var wg stdsync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	replayed := 0
+
+	for _, customerID := range claimed.customers {
+		writes := claimed.byCustomer[customerID]
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			n := l.replayCustomer(ctx, writes, baseBackoff)
+
+			mu.Lock()
+			replayed += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return replayed
+}
+
+// replayCustomer applies one customer's claimed writes in order, stopping at
+// the first failure. Rows after a failure keep their lease and are retried
+// once it expires.
+//
+// A row may already have been applied: its first attempt committed but
+// reported an error (e.g. a client-side timeout), or it was replayed and
+// its DELETE failed. Writes are idempotent (see WithWriteAheadLog), and a
+// preflight refused as a duplicate key counts as applied, so such a row is
+// deleted rather than holding up the customer's later writes.
+func (l *Ledger) replayCustomer(ctx context.Context, writes []failedWrite, baseBackoff time.Duration) int {
+	for i, fw := range writes {
+		err := l.applyWrite(fw.op)
+		if alreadyApplied(fw.op, err) {
+			l.log.Info().
+				Int64("failed_write_id", fw.id).
+				Str("customer_id", fw.op.customerID).
+				Msg("failed write was already applied")
+			err = nil
+		}
+		if err != nil {
+			backoff := baseBackoff << min(fw.attempts, 16)
+			if backoff > maxReplayBackoff {
+				backoff = maxReplayBackoff
+			}
+
+			if _, uerr := l.db.ExecContext(ctx, `
+				UPDATE failed_writes SET
+					attempts = attempts + 1,
+					last_error = $1,
+					next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+				WHERE id = $3
+			`, err.Error(), int64(backoff.Seconds()), fw.id); uerr != nil {
+				l.log.Error().Err(uerr).Int64("failed_write_id", fw.id).Msg("failed to reschedule failed write")
+			}
+
+			l.log.Warn().Err(err).
+				Int64("failed_write_id", fw.id).
+				Str("op_type", fw.op.opType).
+				Str("customer_id", fw.op.customerID).
+				Int("attempts", fw.attempts+1).
+				Msg("failed write replay attempt failed")
+			return i
+		}
+
+		if _, err := l.db.ExecContext(ctx, `DELETE FROM failed_writes WHERE id = $1`, fw.id); err != nil {
+			// Applied but still stored, so it will be replayed again once
+			// the lease expires; logged so it can be removed by hand
+			l.log.Error().Err(err).Int64("failed_write_id", fw.id).Msg("failed to delete replayed write")
+		}
+	}
+
+	return len(writes)
+}
+
+// alreadyApplied reports whether err, from applying op, means an earlier
+// attempt already made the write: a preflight whose request row exists.
+func alreadyApplied(op writeOp, err error) bool {
+	var pqErr *pq.Error
+	return op.opType == "preflight" && errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
@@ -0,0 +1,132 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultFailedWritesLimit is how many failed writes ListFailedWrites
+// returns when not given a limit.
+const DefaultFailedWritesLimit = 100
+
+// FailedWrite is a write in the dead-letter store, as shown to operators.
+type FailedWrite struct {
+	ID         int64  `json:"id"`
+	OpType     string `json:"op_type"`
+	CustomerID string `json:"customer_id"`
+	RequestID  string `json:"request_id,omitempty"`
+	LastError  string `json:"last_error"`
+	Attempts   int    `json:"attempts"`
+
+	CreatedAt     time.Time `json:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// ListFailedWrites returns the oldest writes in the dead-letter store, up to
+// limit (DefaultFailedWritesLimit if <= 0).
+func (l *Ledger) ListFailedWrites(ctx context.Context, limit int) ([]FailedWrite, error) {
+	if limit <= 0 {
+		limit = DefaultFailedWritesLimit
+	}
+
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT id, op_type, customer_id, COALESCE(payload->>'RequestID', ''),
+		       COALESCE(last_error, ''), attempts, created_at, next_attempt_at
+		FROM failed_writes
+		ORDER BY id
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query failed writes failed: %w", err)
+	}
+	defer rows.Close()
+
+	var writes []FailedWrite
+	for rows.Next() {
+		var fw FailedWrite
+		if err := rows.Scan(&fw.ID, &fw.OpType, &fw.CustomerID, &fw.RequestID,
+			&fw.LastError, &fw.Attempts, &fw.CreatedAt, &fw.NextAttemptAt); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		writes = append(writes, fw)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	return writes, nil
+}
+
+// FailedWriteRetryReport summarizes a RetryFailedWrites run.
+type FailedWriteRetryReport struct {
+	// Claimed is how many of the requested writes were found and not
+	// being replayed by an API server at the time.
+	Claimed int `json:"claimed"`
+
+	// Replayed is how many were applied and removed from the store. The
+	// rest stay, rescheduled with their attempt counted.
+	Replayed int `json:"replayed"`
+}
+
+// RetryFailedWrites replays the given dead-lettered writes now, whatever
+// their next attempt time, or every one of them if ids is empty.
+//
+// This is the replay worker's logic (see replayFailedWrites): a customer's
+// writes are applied in id order and stop at that customer's first failure.
+// Rows an API server's replayer holds are skipped.
+func (l *Ledger) RetryFailedWrites(ctx context.Context, ids []int64) (*FailedWriteRetryReport, error) {
+	var claimed *claimedWrites
+	var err error
+	if len(ids) == 0 {
+		claimed, err = l.claimFailedWrites(ctx, `
+			UPDATE failed_writes SET next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT id FROM failed_writes
+				ORDER BY id
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, op_type, customer_id, payload, attempts
+		`, int64(replayLease.Seconds()))
+	} else {
+		claimed, err = l.claimFailedWrites(ctx, `
+			UPDATE failed_writes SET next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT id FROM failed_writes
+				WHERE id = ANY($2)
+				ORDER BY id
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, op_type, customer_id, payload, attempts
+		`, int64(replayLease.Seconds()), pq.Array(ids))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FailedWriteRetryReport{Claimed: claimed.undecodable}
+	for _, writes := range claimed.byCustomer {
+		report.Claimed += len(writes)
+	}
+	report.Replayed = l.replayClaimed(ctx, claimed, time.Second, 1)
+	return report, nil
+}
+
+// DiscardFailedWrites deletes the given writes from the dead-letter store,
+// or every one of them if ids is empty, and returns how many were deleted.
+// A discarded write is never applied: PostgreSQL won't have the reservation
+// or usage it recorded.
+func (l *Ledger) DiscardFailedWrites(ctx context.Context, ids []int64) (int64, error) {
+	query, args := `DELETE FROM failed_writes`, []interface{}{}
+	if len(ids) > 0 {
+		query, args = `DELETE FROM failed_writes WHERE id = ANY($1)`, []interface{}{pq.Array(ids)}
+	}
+
+	res, err := l.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("delete failed writes failed: %w", err)
+	}
+	return res.RowsAffected()
+}
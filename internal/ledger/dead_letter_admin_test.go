@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListFailedWrites(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT id, op_type, customer_id, COALESCE\(payload->>'RequestID', ''\)`).
+		WithArgs(DefaultFailedWritesLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "request_id", "last_error", "attempts", "created_at", "next_attempt_at"}).
+			AddRow(3, "preflight", "cus_1", "req_1", "connection refused", 2, created, created.Add(time.Minute)).
+			AddRow(4, "cancellation", "cus_2", "req_2", "", 0, created, created))
+
+	writes, err := l.ListFailedWrites(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, writes, 2)
+	assert.Equal(t, FailedWrite{
+		ID: 3, OpType: "preflight", CustomerID: "cus_1", RequestID: "req_1",
+		LastError: "connection refused", Attempts: 2,
+		CreatedAt: created, NextAttemptAt: created.Add(time.Minute),
+	}, writes[0])
+	assert.Equal(t, int64(4), writes[1].ID)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryFailedWrites(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	var applied []writeOp
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	l.applyWrite = func(op writeOp) error {
+		applied = append(applied, op)
+		return nil
+	}
+
+	// A finalization whose customer row has since been fixed
+	fin, _ := json.Marshal(FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 500})
+
+	mock.ExpectQuery(`UPDATE failed_writes SET next_attempt_at .* WHERE id = ANY\(\$2\)`).
+		WithArgs(int64(replayLease.Seconds()), pq.Array([]int64{7})).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(7, "finalization", "cus_1", fin, 5))
+	mock.ExpectExec("DELETE FROM failed_writes WHERE id = \\$1").
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	report, err := l.RetryFailedWrites(context.Background(), []int64{7})
+	require.NoError(t, err)
+	assert.Equal(t, &FailedWriteRetryReport{Claimed: 1, Replayed: 1}, report)
+	require.Len(t, applied, 1)
+	assert.Equal(t, int64(500), applied[0].data.(FinalizationRequest).ActualCostGrains)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryFailedWrites_AllKeepsCustomerOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	var applied []int64
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	l.applyWrite = func(op writeOp) error {
+		if op.opType == "finalization" {
+			applied = append(applied, 2)
+			return assert.AnError
+		}
+		applied = append(applied, 1)
+		return nil
+	}
+
+	pre, _ := json.Marshal(ReservationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+	fin, _ := json.Marshal(FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+
+	// Returned out of order: the preflight must still go first
+	mock.ExpectQuery(`UPDATE failed_writes SET next_attempt_at`).
+		WithArgs(int64(replayLease.Seconds())).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(2, "finalization", "cus_1", fin, 0).
+			AddRow(1, "preflight", "cus_1", pre, 0))
+	mock.ExpectExec("DELETE FROM failed_writes WHERE id = \\$1").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE failed_writes SET").
+		WithArgs(assert.AnError.Error(), int64(1), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	report, err := l.RetryFailedWrites(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, &FailedWriteRetryReport{Claimed: 2, Replayed: 1}, report)
+	assert.Equal(t, []int64{1, 2}, applied)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDiscardFailedWrites(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+
+	mock.ExpectExec(`DELETE FROM failed_writes WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.Array([]int64{9})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	n, err := l.DiscardFailedWrites(context.Background(), []int64{9})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	mock.ExpectExec(`DELETE FROM failed_writes$`).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	n, err = l.DiscardFailedWrites(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
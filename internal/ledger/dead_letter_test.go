@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterReplayer_ReplaysAndDeletesSeededWrite(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	var mu stdsync.Mutex
+	var applied []writeOp
+	l := &Ledger{db: db, log: zerolog.Nop(), done: make(chan struct{})}
+	l.applyWrite = func(op writeOp) error {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, op)
+		return nil
+	}
+
+	// A finalization dead-lettered while PostgreSQL was down.
+	seeded := FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 4200,
+		Currency:         "USD",
+	}
+	payload, err := json.Marshal(seeded)
+	require.NoError(t, err)
+
+	mock.ExpectQuery("UPDATE failed_writes SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(7, "finalization", "cus_1", payload, 2))
+	mock.ExpectExec("DELETE FROM failed_writes").
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	l.wg.Add(1)
+	go l.deadLetterReplayer(10*time.Millisecond, 100, 2)
+
+	assert.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	close(l.done)
+	l.wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, applied)
+	assert.Equal(t, "finalization", applied[0].opType)
+	assert.Equal(t, "cus_1", applied[0].customerID)
+	assert.Equal(t, seeded, applied[0].data)
+}
+
+func TestReplayFailedWrites_StopsCustomerAtFirstFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	l.applyWrite = func(op writeOp) error {
+		if op.opType == "preflight" {
+			return assert.AnError
+		}
+		return nil
+	}
+
+	pre, _ := json.Marshal(ReservationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+	fin, _ := json.Marshal(FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+
+	mock.ExpectQuery("UPDATE failed_writes SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(1, "preflight", "cus_1", pre, 0).
+			AddRow(2, "finalization", "cus_1", fin, 0))
+	// Only the preflight is rescheduled; the finalization is never attempted.
+	mock.ExpectExec("UPDATE failed_writes SET").
+		WithArgs(assert.AnError.Error(), int64(30), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	replayed, err := l.replayFailedWrites(context.Background(), 30*time.Second, 100, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayFailedWrites_AlreadyAppliedPreflightDoesNotBlockCustomer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	l.applyWrite = l.applyWriteToDB
+
+	// The preflight's first attempt committed, but its DELETE failed.
+	pre, _ := json.Marshal(ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", Priority: PriorityNormal})
+	cancelled, _ := json.Marshal(cancellation{CustomerID: "cus_1", RequestID: "req_1"})
+
+	mock.ExpectQuery("UPDATE failed_writes SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(1, "preflight", "cus_1", pre, 3).
+			AddRow(2, "cancellation", "cus_1", cancelled, 0))
+	mock.ExpectExec(`(?s)INSERT INTO requests.*ON CONFLICT \(request_id\) DO NOTHING`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM failed_writes").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE requests SET").
+		WithArgs("req_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM failed_writes").
+		WithArgs(int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	replayed, err := l.replayFailedWrites(context.Background(), 30*time.Second, 100, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayFailedWrites_DuplicatePreflightCountsAsApplied(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	var applied []string
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	l.applyWrite = func(op writeOp) error {
+		if op.opType == "preflight" {
+			return &pq.Error{Code: pqUniqueViolation, Message: "duplicate key value violates unique constraint \"requests_pkey\""}
+		}
+		applied = append(applied, op.opType)
+		return nil
+	}
+
+	pre, _ := json.Marshal(ReservationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+	fin, _ := json.Marshal(FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1"})
+
+	mock.ExpectQuery("UPDATE failed_writes SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op_type", "customer_id", "payload", "attempts"}).
+			AddRow(1, "preflight", "cus_1", pre, 0).
+			AddRow(2, "finalization", "cus_1", fin, 0))
+	mock.ExpectExec("DELETE FROM failed_writes").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM failed_writes").
+		WithArgs(int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	replayed, err := l.replayFailedWrites(context.Background(), 30*time.Second, 100, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, []string{"finalization"}, applied)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// Any other failure of a preflight still stops the customer
+	assert.False(t, alreadyApplied(writeOp{opType: "preflight"}, assert.AnError))
+	assert.False(t, alreadyApplied(writeOp{opType: "finalization"}, &pq.Error{Code: pqUniqueViolation}))
+}
@@ -0,0 +1,31 @@
+package ledger
+
+// DefaultMaxDeductions is how many DeductGrains calls a request may make
+// unless its reservation allows more (ReservationRequest.MaxDeductions).
+// Streaming deducts every 50 tokens or so, so this covers completions of
+// tens of thousands of tokens.
+const DefaultMaxDeductions = 1000
+
+// WithMaxDeductions sets how many DeductGrains calls a request may make
+// before further calls are refused with DeductionTooManyDeductions, unless
+// its reservation allows more. This keeps a client stuck in a loop from
+// hammering Redis for one request. Negative disables the cap. Defaults to
+// DefaultMaxDeductions.
+func WithMaxDeductions(n int64) Option {
+	return func(l *Ledger) {
+		l.maxDeductions = n
+	}
+}
+
+// maxDeductionsFor returns the deduction cap to record on a request whose
+// reservation asked for requested, or 0 for none.
+func (l *Ledger) maxDeductionsFor(requested int64) int64 {
+	limit := l.maxDeductions
+	if limit == 0 {
+		limit = DefaultMaxDeductions
+	}
+	if limit < 0 {
+		return 0
+	}
+	return max(limit, requested)
+}
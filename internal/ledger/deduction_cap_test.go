@@ -0,0 +1,88 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeductGrains_TooManyDeductions(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithMaxDeductions(5)(l)
+
+	mr.Set("customer:balance:cus_1", "10000")
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 1000, EstimatedGrains: 1000,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	for i := 0; i < 5; i++ {
+		ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 10})
+		require.NoError(t, err)
+		require.True(t, ded.Success, "deduction %d", i+1)
+	}
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 10})
+	require.NoError(t, err)
+	assert.False(t, ded.Success)
+	assert.Equal(t, DeductionTooManyDeductions, ded.ErrorCode)
+	assert.Equal(t, "50", mr.HGet("request:req_1", "consumed_grains"), "nothing deducted past the cap")
+
+	balance, err := mr.Get("customer:balance:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "9950", balance)
+
+	// The request can still be finalized
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 50,
+	})
+	require.NoError(t, err)
+	assert.True(t, fin.Success)
+}
+
+func TestDeductGrains_StreamingStaysUnderCap(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithMaxDeductions(5)(l)
+
+	mr.Set("customer:balance:cus_1", "100000")
+
+	// A 2000-token completion deducted every 50 tokens, with room to spare
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 50000, EstimatedGrains: 50000,
+		MaxDeductions: 160,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, "160", mr.HGet("request:req_1", "max_deductions"))
+
+	for i := 0; i < 40; i++ {
+		ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100, TokensConsumed: 50})
+		require.NoError(t, err)
+		require.True(t, ded.Success, "deduction %d: %s", i+1, ded.ErrorCode)
+	}
+	assert.Equal(t, "40", mr.HGet("request:req_1", "deductions"))
+}
+
+func TestDeductGrains_CapDisabled(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithMaxDeductions(-1)(l)
+
+	mr.Set("customer:balance:cus_1", "10000")
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 1000, EstimatedGrains: 1000, MaxDeductions: 3,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, mr.HGet("request:req_1", "max_deductions"))
+
+	for i := 0; i < 10; i++ {
+		ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 10})
+		require.NoError(t, err)
+		require.True(t, ded.Success)
+	}
+}
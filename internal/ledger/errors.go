@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Errors the ledger's failures wrap, so callers can tell them apart with
+// errors.Is rather than by message. Validation errors (ErrUnknownBucket,
+// ErrUnknownPriority, ...) live with the operations that return them.
+//
+// Rejections the hot path reports in its results (a reservation refused for
+// INSUFFICIENT_BALANCE, a deduction for REQUEST_NOT_FOUND) are not errors.
+var (
+	// ErrRedisUnavailable means Redis couldn't be reached or didn't answer
+	// in time: a refused or dropped connection, a timeout, an exhausted
+	// pool, or a server still loading or failing over. Worth retrying.
+	ErrRedisUnavailable = errors.New("redis unavailable")
+
+	// ErrScriptFailed means a Lua script ran but raised an error, e.g. on a
+	// key holding the wrong type. Retrying won't help.
+	ErrScriptFailed = errors.New("lua script failed")
+
+	// ErrCustomerNotFound is returned when an operation names a customer
+	// that doesn't exist in PostgreSQL.
+	ErrCustomerNotFound = errors.New("customer not found")
+
+	// ErrInsufficientBalance is returned when an operation that can't be
+	// partly applied, such as an AdjustBalance debit, would take a balance
+	// below zero (or below the customer's kill grace).
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
+
+// pqCheckViolation is the SQLSTATE of a failed CHECK constraint.
+const pqCheckViolation = "23514"
+
+// unavailableReplies are the error replies Redis sends while it can't serve
+// commands at all, as opposed to rejecting this one.
+var unavailableReplies = []string{"LOADING", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN", "READONLY"}
+
+// redisUnavailable reports whether err, from a Redis command, means Redis
+// couldn't serve it rather than that the command failed.
+func redisUnavailable(err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	if reply, ok := err.(redis.Error); ok {
+		for _, prefix := range unavailableReplies {
+			if strings.HasPrefix(reply.Error(), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redisError wraps the failure of a Redis command, wrapping
+// ErrRedisUnavailable too if Redis couldn't serve it.
+func redisError(command string, err error) error {
+	if redisUnavailable(err) {
+		return fmt.Errorf("redis %s failed: %w: %w", command, ErrRedisUnavailable, err)
+	}
+	return fmt.Errorf("redis %s failed: %w", command, err)
+}
+
+// scriptError wraps the failure of a Lua script as ErrRedisUnavailable if
+// Redis couldn't run it, or ErrScriptFailed if the script itself failed.
+func scriptError(err error) error {
+	if redisUnavailable(err) {
+		return fmt.Errorf("lua script execution failed: %w: %w", ErrRedisUnavailable, err)
+	}
+	return fmt.Errorf("lua script execution failed: %w: %w", ErrScriptFailed, err)
+}
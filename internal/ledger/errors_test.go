@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replyError is an error reply from Redis.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError()     {}
+
+func TestErrors_RedisUnavailable(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	mr.Close()
+
+	_, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 10, Currency: "USD"})
+	assert.ErrorIs(t, err, ErrRedisUnavailable, "script")
+	assert.NotErrorIs(t, err, ErrScriptFailed)
+
+	_, _, _, _, err = l.GetBalance(ctx, "cus_1")
+	assert.ErrorIs(t, err, ErrRedisUnavailable, "command")
+}
+
+func TestErrors_ScriptFailed(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	// The deduct script reads the request as a hash
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("request:req_1", "not a hash")
+
+	_, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 10})
+	assert.ErrorIs(t, err, ErrScriptFailed)
+	assert.NotErrorIs(t, err, ErrRedisUnavailable)
+}
+
+func TestErrors_InsufficientBalance(t *testing.T) {
+	l, mr := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "100")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE customers SET").
+		WithArgs(int64(-500), "cus_1").
+		WillReturnError(&pq.Error{Code: pqCheckViolation, Constraint: "positive_balance",
+			Message: `new row for relation "customers" violates check constraint "positive_balance"`})
+	mock.ExpectRollback()
+
+	_, err = l.AdjustBalance(context.Background(), AdjustmentRequest{
+		CustomerID: "cus_1", DeltaGrains: -500, Reason: "chargeback", Operator: "bob",
+	})
+	assert.ErrorIs(t, err, ErrInsufficientBalance)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	balance, err := mr.Get("customer:balance:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "100", balance, "nothing applied in redis")
+}
+
+func TestErrors_CustomerNotFound(t *testing.T) {
+	l, _ := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_missing").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id"}))
+
+	_, err = l.GetCustomer(context.Background(), "cus_missing")
+	assert.ErrorIs(t, err, ErrCustomerNotFound)
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("dial tcp 127.0.0.1:6379: connect: connection refused"), true},
+		{context.DeadlineExceeded, true},
+		{replyError("LOADING Redis is loading the dataset in memory"), true},
+		{replyError("READONLY You can't write against a read only replica."), true},
+		{replyError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{replyError("ERR Error running script"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			assert.Equal(t, tt.want, redisUnavailable(tt.err))
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+)
+
+// HealthCheck verifies that both Redis and PostgreSQL are reachable.
+//
+// It only pings; it doesn't read any customer data, so it works against an
+// empty database and is suitable for readiness probes.
+func (l *Ledger) HealthCheck(ctx context.Context) error {
+	if err := l.redis.Ping(ctx).Err(); err != nil {
+		return redisError("ping", err)
+	}
+
+	if err := l.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("postgres ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// Ready is HealthCheck for readiness probes, and additionally fails until
+// the pricing cache is loaded, so that no traffic is sent to an instance
+// that would query PostgreSQL for every price.
+func (l *Ledger) Ready(ctx context.Context) error {
+	if !l.PricingCacheLoaded() {
+		return fmt.Errorf("pricing cache not loaded")
+	}
+	return l.HealthCheck(ctx)
+}
@@ -0,0 +1,44 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck_PassesWithEmptyDatabase(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	// No customers anywhere: only the pings are expected.
+	mock.ExpectPing()
+	require.NoError(t, l.HealthCheck(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	mr.Close()
+	err = l.HealthCheck(context.Background())
+	assert.ErrorContains(t, err, "redis ping failed")
+}
+
+func TestReady_WaitsForPricingCache(t *testing.T) {
+	l, _ := newTestLedger(t)
+
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	assert.ErrorContains(t, l.Ready(context.Background()), "pricing cache not loaded")
+
+	l.pricingLoaded.Store(true)
+	mock.ExpectPing()
+	require.NoError(t, l.Ready(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
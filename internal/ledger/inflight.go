@@ -0,0 +1,35 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// inflightKey returns the Redis sorted set of a customer's in-flight
+// requests, across currencies.
+//
+// Members are request hash keys, scored with the Unix time their hash
+// expires. check_and_reserve adds a request, and every script that ends
+// one (finalize, cancel, abandon, release) removes it. A request that
+// never reaches any of them drops out once its score has passed, so the
+// count can't leak when the API server dies mid-stream.
+func inflightKey(customerID string) string {
+	return fmt.Sprintf("customer:inflight:%s", customerID)
+}
+
+// InflightRequests returns how many requests the customer has in flight:
+// reserved and not yet finalized, cancelled, released or abandoned. This
+// is what CustomerConfig.MaxConcurrentRequests is checked against.
+func (l *Ledger) InflightRequests(ctx context.Context, customerID string) (int64, error) {
+	now, err := l.redis.Time(ctx).Result()
+	if err != nil {
+		return 0, redisError("time", err)
+	}
+
+	n, err := l.redis.ZCount(ctx, inflightKey(customerID), "("+strconv.FormatInt(now.Unix(), 10), "+inf").Result()
+	if err != nil {
+		return 0, redisError("zcount", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,116 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "10000")
+	mr.HSet("customer:config:cus_1", "max_concurrent_requests", "2")
+
+	reserve := func(id string) *ReservationResult {
+		t.Helper()
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: id, ReservedGrains: 100})
+		require.NoError(t, err)
+		return res
+	}
+
+	assert.True(t, reserve("req_1").Approved)
+	assert.True(t, reserve("req_2").Approved)
+
+	res := reserve("req_3")
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionTooManyInflight, res.RejectionReason)
+	assert.False(t, mr.Exists("request:req_3"), "a rejected request reserves nothing")
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), reserved)
+
+	dry, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 100, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionTooManyInflight, dry.RejectionReason)
+
+	// Each way of ending a request frees its slot
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed"})
+	require.NoError(t, err)
+	assert.True(t, reserve("req_3").Approved)
+
+	_, err = l.CancelRequest(ctx, "cus_1", "req_2")
+	require.NoError(t, err)
+	assert.True(t, reserve("req_4").Approved)
+
+	_, err = l.ReleaseReservation(ctx, "cus_1", "req_3")
+	require.NoError(t, err)
+	assert.True(t, reserve("req_5").Approved)
+
+	abandoned, err := l.abandonRequest(ctx, "cus_1", "req_4", "")
+	require.NoError(t, err)
+	assert.True(t, abandoned)
+	assert.True(t, reserve("req_6").Approved)
+
+	assert.False(t, reserve("req_7").Approved)
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestMaxConcurrentRequests_Unlimited(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "10000")
+
+	for _, id := range []string{"req_1", "req_2", "req_3"} {
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: id, ReservedGrains: 100})
+		require.NoError(t, err)
+		assert.True(t, res.Approved)
+	}
+
+	// Requests are tracked even without a limit, so setting one later
+	// counts those already in flight
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	mr.HSet("customer:config:cus_1", "max_concurrent_requests", "3")
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_4", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionTooManyInflight, res.RejectionReason)
+}
+
+func TestMaxConcurrentRequests_ExpiredRequestsDontCount(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	redisNow := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mr.SetTime(redisNow)
+	mr.Set("customer:balance:cus_1", "10000")
+	mr.HSet("customer:config:cus_1", "max_concurrent_requests", "1")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	// req_1 is never finalized. Once its request hash would have expired
+	// it no longer holds the customer's only slot.
+	mr.SetTime(redisNow.Add(l.requestTTL() - time.Second))
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionTooManyInflight, res.RejectionReason)
+
+	mr.SetTime(redisNow.Add(l.requestTTL()))
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+}
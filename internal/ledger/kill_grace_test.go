@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeductGrains_WithoutGraceFailsAtZero(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "100")
+	mr.HSet("request:req_1", "status", "reserved")
+
+	res, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+	assert.True(t, res.Success)
+	assert.Equal(t, int64(0), res.RemainingBalance)
+	assert.Equal(t, int64(0), res.RemainingGraceGrains)
+
+	res, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 1})
+	require.NoError(t, err)
+	assert.False(t, res.Success)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", res.ErrorCode)
+	assert.Equal(t, int64(0), res.RemainingBalance)
+}
+
+func TestDeductGrains_DipsIntoGraceBeforeFailing(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "100")
+	mr.HSet("customer:config:cus_1", "kill_grace_grains", "50")
+	mr.HSet("request:req_1", "status", "reserved")
+
+	cfg, err := l.GetCustomerConfig(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), cfg.KillGraceGrains)
+
+	// Balance covers it; the grace is untouched.
+	res, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 80})
+	require.NoError(t, err)
+	require.True(t, res.Success)
+	assert.Equal(t, int64(20), res.RemainingBalance)
+	assert.Equal(t, int64(50), res.RemainingGraceGrains)
+
+	// Crosses zero: 30 of this comes out of the grace.
+	res, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 50})
+	require.NoError(t, err)
+	require.True(t, res.Success)
+	assert.Equal(t, int64(-30), res.RemainingBalance)
+	assert.Equal(t, int64(20), res.RemainingGraceGrains)
+	assert.Equal(t, "30", mr.HGet("request:req_1", "grace_used_grains"))
+
+	// More than the grace left: the kill switch fires and nothing is taken.
+	res, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 21})
+	require.NoError(t, err)
+	assert.False(t, res.Success)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", res.ErrorCode)
+	assert.Equal(t, int64(-30), res.RemainingBalance)
+	assert.Equal(t, int64(20), res.RemainingGraceGrains)
+
+	// An undercharge at finalize doesn't wipe out the grace that was used.
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 140,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+
+	balance, err := mr.Get("customer:balance:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "-30", balance)
+}
@@ -0,0 +1,15 @@
+package ledger
+
+// WithKillHysteresis makes the kill switch final for a request: once a
+// deduction fails for lack of balance, the kill is recorded on the request
+// hash (killed_at) and the request's later deductions fail with
+// DeductionRequestKilled, even if credits have brought the balance back up
+// since. Without it, a balance hovering around zero while credits trickle
+// in can let one stream flap between killed and running. Off by default.
+//
+// The request still has to be finalized as usual.
+func WithKillHysteresis(enabled bool) Option {
+	return func(l *Ledger) {
+		l.killHysteresis = enabled
+	}
+}
@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeductGrains_KillHysteresis(t *testing.T) {
+	tests := []struct {
+		name       string
+		hysteresis bool
+		wantResume bool
+	}{
+		{"killed request stays killed", true, false},
+		{"without hysteresis a credit resumes it", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, mr := newTestLedger(t)
+			ctx := context.Background()
+			WithKillHysteresis(tt.hysteresis)(l)
+
+			mr.Set("customer:balance:cus_1", "1000")
+			res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+				CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 500, EstimatedGrains: 500,
+			})
+			require.NoError(t, err)
+			require.True(t, res.Approved)
+
+			deduct := func() *DeductionResult {
+				t.Helper()
+				ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 200})
+				require.NoError(t, err)
+				return ded
+			}
+
+			require.True(t, deduct().Success)
+
+			// Another request drains the balance: this one is killed
+			mr.Set("customer:balance:cus_1", "100")
+			killed := deduct()
+			assert.False(t, killed.Success)
+			assert.Equal(t, "INSUFFICIENT_BALANCE", killed.ErrorCode)
+			assert.Equal(t, tt.hysteresis, mr.HGet("request:req_1", "killed_at") != "")
+
+			// An async credit lands before the SDK's next batch
+			mr.Set("customer:balance:cus_1", "5000")
+			next := deduct()
+			assert.Equal(t, tt.wantResume, next.Success)
+
+			balance, err := mr.Get("customer:balance:cus_1")
+			require.NoError(t, err)
+			if tt.wantResume {
+				assert.Equal(t, "4800", balance)
+			} else {
+				assert.Equal(t, DeductionRequestKilled, next.ErrorCode)
+				assert.Equal(t, "5000", balance, "nothing deducted after the kill")
+				assert.Equal(t, "200", mr.HGet("request:req_1", "consumed_grains"))
+			}
+
+			// Either way the request is finalized as usual
+			fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+				CustomerID: "cus_1", RequestID: "req_1", Status: "killed", ActualCostGrains: 200,
+			})
+			require.NoError(t, err)
+			assert.True(t, fin.Success)
+		})
+	}
+}
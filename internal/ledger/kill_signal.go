@@ -0,0 +1,99 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Kill signal reasons (see KillSignal.Reason).
+const (
+	// KillReasonBalanceAdjusted means an AdjustBalance debit left the
+	// balance at or below zero.
+	KillReasonBalanceAdjusted = "BALANCE_ADJUSTED"
+)
+
+// KillSignal tells a customer's in-flight streams to stop now rather than at
+// their next DeductTokens.
+type KillSignal struct {
+	CustomerID string    `json:"customer_id"`
+	Reason     string    `json:"reason"`
+	Balance    int64     `json:"balance"`
+	IssuedAt   time.Time `json:"issued_at"`
+}
+
+// killChannel returns the Redis pub/sub channel a customer's kill signals
+// are published on.
+func killChannel(customerID string) string {
+	return fmt.Sprintf("kill:%s", customerID)
+}
+
+// publishKillSignal broadcasts sig to every subscriber of the customer's
+// kill channel. Pub/sub is fire-and-forget: a stream that isn't watching
+// still stops at its next deduction.
+func (l *Ledger) publishKillSignal(ctx context.Context, sig KillSignal) error {
+	payload, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("encode kill signal failed: %w", err)
+	}
+
+	receivers, err := l.redis.Publish(ctx, killChannel(sig.CustomerID), payload).Result()
+	if err != nil {
+		return fmt.Errorf("publish kill signal failed: %w", err)
+	}
+
+	killSignalsPublishedTotal.WithLabelValues(sig.Reason).Inc()
+	l.log.Info().
+		Str("customer_id", sig.CustomerID).
+		Str("reason", sig.Reason).
+		Int64("receivers", receivers).
+		Msg("kill signal published")
+
+	return nil
+}
+
+// WatchKillSignals calls fn with every kill signal published for customerID
+// until ctx is done or fn returns an error, then unsubscribes. It returns
+// once the subscription is gone, so the caller's disconnect (ctx) is all it
+// takes to clean up.
+//
+// The subscription is confirmed before the first signal can arrive, so
+// nothing published after WatchKillSignals starts receiving is missed.
+func (l *Ledger) WatchKillSignals(ctx context.Context, customerID string, fn func(KillSignal) error) error {
+	pubsub := l.redis.Subscribe(ctx, killChannel(customerID))
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("subscribe to kill signals failed: %w", err)
+	}
+
+	killSignalWatchers.Inc()
+	defer killSignalWatchers.Dec()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("kill signal subscription closed")
+			}
+
+			var sig KillSignal
+			if err := json.Unmarshal([]byte(msg.Payload), &sig); err != nil {
+				l.log.Warn().Err(err).
+					Str("channel", msg.Channel).
+					Msg("ignoring malformed kill signal")
+				continue
+			}
+			if err := fn(sig); err != nil {
+				return err
+			}
+		}
+	}
+}
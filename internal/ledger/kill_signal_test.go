@@ -0,0 +1,107 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKillSignal_AdminZeroNotifiesWatchers(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "500")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan KillSignal, 1)
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- l.WatchKillSignals(ctx, "cus_1", func(sig KillSignal) error {
+			signals <- sig
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		return mr.PubSubNumSub("kill:cus_1")["kill:cus_1"] == 1
+	}, time.Second, 5*time.Millisecond)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE customers SET").
+		WithArgs(int64(-500), "cus_1").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}).AddRow(0))
+	mock.ExpectExec("UPDATE customer_balance_buckets").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO transactions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, err := l.AdjustBalance(context.Background(), AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: -500,
+		Reason:      "chargeback",
+		Operator:    "fraud@example.com",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), res.NewBalance)
+	assert.True(t, res.KillSignalSent)
+
+	select {
+	case sig := <-signals:
+		assert.Equal(t, "cus_1", sig.CustomerID)
+		assert.Equal(t, KillReasonBalanceAdjusted, sig.Reason)
+		assert.Equal(t, int64(0), sig.Balance)
+		assert.False(t, sig.IssuedAt.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("kill signal not received")
+	}
+
+	// Disconnecting unsubscribes.
+	cancel()
+	select {
+	case err := <-watchDone:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WatchKillSignals did not return after disconnect")
+	}
+	assert.Eventually(t, func() bool {
+		return mr.PubSubNumSub("kill:cus_1")["kill:cus_1"] == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestKillSignal_NotSentWhileBalanceStaysPositive(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "500")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE customers SET").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}).AddRow(400))
+	mock.ExpectExec("UPDATE customer_balance_buckets").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO transactions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, err := l.AdjustBalance(context.Background(), AdjustmentRequest{
+		CustomerID:  "cus_1",
+		DeltaGrains: -100,
+		Reason:      "correction",
+		Operator:    "alice@example.com",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), res.NewBalance)
+	assert.False(t, res.KillSignalSent)
+}
@@ -37,6 +37,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -57,28 +58,183 @@ type Ledger struct {
 	db    *sql.DB
 	log   zerolog.Logger
 
+	// hotLog is used for per-call debug logging on the hot path
+	// (CheckAndReserveBalance, DeductGrains). It may be sampled so that
+	// debug level at 10k RPS doesn't flood the logs. Warn and above are
+	// never sampled.
+	hotLog zerolog.Logger
+
 	// Lua scripts pre-loaded at initialization
 	// These are loaded once and reused for every operation
-	checkAndReserveScript *redis.Script
-	deductGrainsScript    *redis.Script
-	finalizeRequestScript *redis.Script
-
-	// Async write queue for PostgreSQL operations
-	// This prevents blocking the hot path on slow database writes
-	writeQueue chan writeOp
-	wg         sync.WaitGroup
+	checkAndReserveScript    *redis.Script
+	deductGrainsScript       *redis.Script
+	reserveAndDeductScript   *redis.Script
+	batchReserveScript       *redis.Script
+	finalizeRequestScript    *redis.Script
+	cancelRequestScript      *redis.Script
+	adjustBalanceScript      *redis.Script
+	abandonRequestScript     *redis.Script
+	releaseReservationScript *redis.Script
+	upgradeRequestScript     *redis.Script
+
+	// Async write queues for PostgreSQL operations, one per worker
+	// This prevents blocking the hot path on slow database writes.
+	// Ops are sharded by customer (see enqueueWrite) so one customer's
+	// writes are applied in order by a single worker.
+	writeQueues []chan writeOp
+	wg          sync.WaitGroup
+
+	// applyWrite performs a queued write. Defaults to applyWriteToDB.
+	applyWrite func(op writeOp) error
+
+	// deadLetter saves a write that exhausted its retries. Defaults to
+	// storeFailedWrite; nil drops such writes (tests).
+	deadLetter func(op writeOp, cause error) error
+
+	// applyBatch performs a batch of queued finalization writes in one
+	// transaction. Defaults to writeFinalizationBatchToDB.
+	applyBatch func(ops []writeOp) error
+
+	// writeBatchSize and writeBatchInterval bound a batch of finalization
+	// writes (see WithWriteBatching). A size of 0 or 1 disables batching.
+	writeBatchSize     int
+	writeBatchInterval time.Duration
+
+	// writeRetryBackoff is the delay before the first retry of a failed
+	// write; it doubles on each attempt. Zero means 100ms.
+	writeRetryBackoff time.Duration
+
+	// syncWrites makes writes go to PostgreSQL inline instead of through
+	// the write queues (see WithSyncWrites).
+	syncWrites bool
+
+	// walPath and walSync configure the write-ahead log of queued writes,
+	// wal (see WithWriteAheadLog)
+	walPath string
+	walSync string
+	wal     *writeAheadLog
+
+	// syncWriteFailures counts sync writes that failed in a row, reset by
+	// one that succeeds (see WriteRetryDelay).
+	syncWriteFailures atomic.Int64
+
+	// Outcome counters for queued writes, used for the shutdown report
+	writesSucceeded    atomic.Int64
+	writesDeadLettered atomic.Int64
+
+	// done is closed by Close to stop background loops (see totals.go)
+	done chan struct{}
 
 	// Pricing cache to avoid repeated database lookups
 	// Map of "model:provider" -> PricingInfo
 	pricingCache sync.Map
+
+	// Cost multiplier cache, map of "platform_user_id:provider" -> float64
+	// (see CostMultiplier). Loaded along with the pricing cache.
+	costMultipliers sync.Map
+
+	// Model alias cache, map of alias -> canonical model (see
+	// ResolveModelAlias). Loaded along with the pricing cache.
+	modelAliases sync.Map
+
+	// pricingLoaded is set once the pricing cache has been fully loaded
+	// (see Ready)
+	pricingLoaded atomic.Bool
+
+	// pricingRetryBackoff is the delay before the first retry of a failed
+	// pricing load; it doubles on each attempt. Zero means 1s.
+	pricingRetryBackoff time.Duration
+
+	// Currency rate cache, map of currency code -> grains per USD grain
+	currencyRates sync.Map
+
+	// defaultCurrency applies to customers with no currency configured.
+	// Empty means DefaultCurrency.
+	defaultCurrency string
+
+	// finalizeTimeout is how long a request may go unfinalized before the
+	// orphan sweeper abandons it. Zero means DefaultFinalizeTimeout.
+	finalizeTimeout time.Duration
+
+	// sweepCursor is where the next orphan sweep resumes, guarded by
+	// sweepMu (see SweepOrphanRequests).
+	sweepMu     sync.Mutex
+	sweepCursor sweepCursor
+
+	// terminalRequestTTLs is how long a request hash is kept once it
+	// reaches each terminal status (see WithTerminalRequestTTLs).
+	terminalRequestTTLs map[string]time.Duration
+
+	// attributionTags are the ReservationRequest.Tags keys recorded on
+	// requests (see WithAttributionTags).
+	attributionTags map[string]bool
+
+	// statementTimeout is PostgreSQL's statement_timeout for the ledger's
+	// sessions; nil means DefaultStatementTimeout (see WithStatementTimeout).
+	statementTimeout *time.Duration
+
+	// priorityPreemption lets high-priority reservations reserve against
+	// low-priority ones (see WithPriorityPreemption)
+	priorityPreemption bool
+
+	// postpaidCreditCeiling is the credit ceiling for postpaid customers
+	// without their own (see WithPostpaidCreditCeiling).
+	postpaidCreditCeiling int64
+
+	// minimumViableBalance is the available balance below which prepaid
+	// customers without their own are refused any reservation (see
+	// WithMinimumViableBalance).
+	minimumViableBalance int64
+
+	// maxDeductions caps DeductGrains calls per request. Zero means
+	// DefaultMaxDeductions, negative no cap (see WithMaxDeductions).
+	maxDeductions int64
+
+	// safeModeThreshold is how many mismatches ReconcileAll may find before
+	// it enters safe mode; zero never does (see WithSafeModeThreshold).
+	safeModeThreshold int
+
+	// traceSampleFraction is the fraction of requests whose whole
+	// lifecycle is logged (see WithTraceSampleFraction).
+	traceSampleFraction float64
+
+	// loadBalance loads a customer's balance into Redis when GetBalance
+	// finds it missing. Nil disables this (see WithBalanceLoader).
+	loadBalance func(ctx context.Context, customerID string) error
+
+	// syncUnknownCustomers makes CheckAndReserveBalance load a customer
+	// Redis has never heard of before rejecting them (see
+	// WithUnknownCustomerSync).
+	syncUnknownCustomers bool
+
+	// killHysteresis keeps a request killed once a deduction fails for
+	// lack of balance (see WithKillHysteresis).
+	killHysteresis bool
+
+	// shortfallPolicy is what finalization does with a cost the balance
+	// can't cover; empty means ShortfallPolicyAbsorb (see
+	// WithShortfallPolicy).
+	shortfallPolicy string
+
+	// schema is the PostgreSQL schema the ledger's tables are in; empty
+	// means the server's default search_path (see WithSchema).
+	schema string
+
+	// Balance stats cache, map of customer_id -> cachedBalanceStats (see
+	// GetBalanceDetailed). Entries older than balanceStatsTTL (zero means
+	// DefaultBalanceStatsTTL) are reloaded.
+	balanceStats    sync.Map
+	balanceStatsTTL time.Duration
 }
 
 // writeOp represents a queued PostgreSQL write operation.
 // These are processed by background workers to avoid blocking the hot path.
 type writeOp struct {
-	opType string      // "preflight", "finalization", "transaction"
-	data   interface{} // Operation-specific data
-	ctx    context.Context
+	opType     string      // "preflight", "finalization", "cancellation"
+	customerID string      // Shard key
+	data       interface{} // Operation-specific data
+	ctx        context.Context
+	walSeq     uint64 // Write-ahead log entry, 0 if not logged
 }
 
 // ReservationRequest contains all parameters for CheckAndReserveBalance.
@@ -89,8 +245,73 @@ type ReservationRequest struct {
 	EstimatedGrains int64
 	Metadata        map[string]string
 	PlatformUserID  string
+
+	// Currency the reservation is in. Empty means the customer's configured
+	// currency, looked up in Redis.
+	Currency string
+
+	// DryRun computes the approval decision without reserving anything:
+	// no reserved counter change, no request hash, no DB write.
+	DryRun bool
+
+	// Pricing, if set, is pinned on the request: deductions and the
+	// finalization that ask for it (PriceFromPins) price tokens at these
+	// rates, even if model_pricing changes while the request is running.
+	// Prices are per million tokens in the reservation's currency.
+	Pricing *PricingInfo
+
+	// Priority is one of PriorityLow, PriorityNormal or PriorityHigh, and
+	// is recorded on the request. Empty means PriorityNormal. See
+	// WithPriorityPreemption for how it affects approval.
+	Priority string
+
+	// MaxDeductions raises how many DeductGrains calls the request may make
+	// above the ledger's cap (see WithMaxDeductions), e.g. for a long
+	// completion. It can't lower it.
+	MaxDeductions int64
+
+	// EndUserID identifies the platform's end user the request is made for
+	// (the person behind CustomerID's request), for per-user analytics and
+	// abuse tracking. Optional; recorded on the request in Redis and
+	// PostgreSQL.
+	EndUserID string
+
+	// Tags are cost attribution tags (team, project, ...), typically the
+	// request's custom properties. Those allowlisted with
+	// WithAttributionTags are recorded on the request in PostgreSQL.
+	Tags map[string]string
 }
 
+// Rejection reasons returned by the check_and_reserve script.
+const (
+	// RejectionInsufficientBalance means available balance (balance - reserved)
+	// could not cover the requested reservation.
+	RejectionInsufficientBalance = "INSUFFICIENT_BALANCE"
+
+	// RejectionRequestExists means a reservation already exists for this
+	// request ID. This is either a client retry of a request that was already
+	// approved, or two different requests colliding on the same ID.
+	RejectionRequestExists = "REQUEST_EXISTS"
+
+	// RejectionIntegritySafeMode means the ledger is in integrity safe mode
+	// (see EnterSafeMode): Redis may not hold customers' true balances, so
+	// nothing is reserved until an operator clears it or a full resync.
+	RejectionIntegritySafeMode = "INTEGRITY_SAFE_MODE"
+
+	// RejectionTooManyInflight means the customer already has their
+	// max_concurrent_requests in flight (see CustomerConfig).
+	RejectionTooManyInflight = "TOO_MANY_INFLIGHT"
+
+	// RejectionCustomerNotFound means Redis has neither a balance nor a
+	// config for the customer: they were never synced, or don't exist.
+	RejectionCustomerNotFound = "CUSTOMER_NOT_FOUND"
+
+	// RejectionBalanceTooLow means the available balance is below the
+	// customer's minimum viable balance (see WithMinimumViableBalance),
+	// however small the reservation.
+	RejectionBalanceTooLow = "BALANCE_TOO_LOW"
+)
+
 // ReservationResult contains the outcome of a balance check and reservation.
 type ReservationResult struct {
 	Approved         bool
@@ -98,6 +319,22 @@ type ReservationResult struct {
 	RemainingBalance int64
 	RejectionReason  string
 	ReservedGrains   int64
+
+	// AvailableBalance is balance minus all reservations (including this
+	// one, if approved).
+	AvailableBalance int64
+
+	// ShortfallGrains is how many more grains would have been needed to
+	// approve the reservation. Only set for INSUFFICIENT_BALANCE and
+	// BALANCE_TOO_LOW.
+	ShortfallGrains int64
+	// Currency all grain amounts are denominated in.
+	Currency string
+
+	// PreemptedGrains is how much of an approved high-priority reservation
+	// was made against grains held by low-priority requests (see
+	// WithPriorityPreemption). AvailableBalance is negative by as much.
+	PreemptedGrains int64
 }
 
 // DeductionRequest contains parameters for DeductGrains.
@@ -106,13 +343,59 @@ type DeductionRequest struct {
 	RequestID      string
 	GrainAmount    int64
 	TokensConsumed int32
+
+	// Currency of GrainAmount. Empty means the customer's configured currency.
+	Currency string
+
+	// PriceFromPins prices TokensConsumed at the input or output price
+	// (per IsCompletion) pinned on the request at reservation, ignoring
+	// GrainAmount. Without pinned prices GrainAmount is used as is.
+	PriceFromPins bool
+	IsCompletion  bool
+
+	// ClientPriced marks GrainAmount as computed by the client rather than
+	// from server-side pricing. Such a deduction is refused with
+	// DeductionCostExceedsReservation, and nothing is deducted, if it would
+	// take the request's consumed grains past its reservation.
+	ClientPriced bool
 }
 
+// DeductionResult.ErrorCode values besides INSUFFICIENT_BALANCE and
+// REQUEST_NOT_FOUND.
+const (
+	// DeductionCostExceedsReservation is returned for a ClientPriced
+	// deduction larger than what is left of the reservation.
+	DeductionCostExceedsReservation = "COST_EXCEEDS_RESERVATION"
+
+	// DeductionRequestFinalized is returned for a deduction that arrives
+	// after the request was finalized, cancelled or abandoned (e.g. reordered
+	// on the network). Nothing is deducted: the final cost is already settled.
+	DeductionRequestFinalized = "REQUEST_FINALIZED"
+
+	// DeductionTooManyDeductions is returned once a request has made as
+	// many DeductGrains calls as its cap allows (see WithMaxDeductions).
+	// Nothing is deducted; the client should stop streaming and finalize.
+	DeductionTooManyDeductions = "TOO_MANY_DEDUCTIONS"
+
+	// DeductionRequestKilled is returned, with WithKillHysteresis, for a
+	// request that already failed a deduction for lack of balance, even if
+	// the balance has since recovered. Nothing is deducted.
+	DeductionRequestKilled = "REQUEST_KILLED"
+)
+
 // DeductionResult contains the outcome of a deduction operation.
 type DeductionResult struct {
 	Success          bool
 	RemainingBalance int64
 	ErrorCode        string
+
+	// RemainingGraceGrains is how much further the balance may go below
+	// zero before the kill switch fires (see CustomerConfig.KillGraceGrains).
+	RemainingGraceGrains int64
+
+	// GrainsDeducted is what was actually deducted on success: GrainAmount,
+	// or the pinned-price cost with PriceFromPins.
+	GrainsDeducted int64
 }
 
 // FinalizationRequest contains parameters for FinalizeRequest.
@@ -124,6 +407,25 @@ type FinalizationRequest struct {
 	PromptTokens      int32
 	CompletionTokens  int32
 	Model             string
+
+	// Provider serving Model (e.g. "openai"), used to break down spend
+	// by provider. Empty or unknown providers are counted as "other".
+	Provider string
+
+	// Currency of ActualCostGrains. Empty means the customer's configured
+	// currency.
+	Currency string
+
+	// PriceFromPins prices PromptTokens and CompletionTokens at the prices
+	// pinned on the request at reservation, ignoring ActualCostGrains.
+	// Without pinned prices, or with both token counts zero,
+	// ActualCostGrains is used as is.
+	PriceFromPins bool
+
+	// withheldGrains and shortfallDebtGrains are set from the
+	// FinalizationResult for the write to PostgreSQL.
+	withheldGrains      int64
+	shortfallDebtGrains int64
 }
 
 // FinalizationResult contains the outcome of request finalization.
@@ -132,14 +434,98 @@ type FinalizationResult struct {
 	RefundedGrains int64
 	FinalBalance   int64
 	ErrorCode      string
+
+	// AlreadyFinalized is set when the request had already reached a
+	// terminal status (finalized, or abandoned by the orphan sweeper);
+	// nothing was changed.
+	AlreadyFinalized bool
+
+	// ActualCostGrains is the cost the request was finalized at (see
+	// FinalizationRequest.PriceFromPins).
+	ActualCostGrains int64
+
+	// PinnedPricing holds the prices pinned at reservation, nil if none
+	// were. Only the cost fields are set.
+	PinnedPricing *PricingInfo
+
+	// CostBreakdown itemizes ActualCostGrains when the request was priced
+	// from its pinned pricing, nil otherwise.
+	CostBreakdown *CostBreakdown
+
+	// WithheldGrains is the part of the refund the customer's refund
+	// policy kept (see RefundPolicyNone); RefundedGrains is what was given
+	// back.
+	WithheldGrains int64
+
+	// ShortfallDebtGrains is the part of the actual cost the balance
+	// couldn't cover that was added to the customer's debt (see
+	// ShortfallPolicyDebt).
+	ShortfallDebtGrains int64
+}
+
+// CostBreakdown splits a request's cost into prompt and completion tokens.
+// InputCostGrains + OutputCostGrains is the request's actual cost.
+type CostBreakdown struct {
+	InputCostGrains  int64
+	OutputCostGrains int64
+}
+
+// Option configures optional Ledger behaviour at construction time.
+type Option func(*Ledger)
+
+// WithLogSampleRate emits only 1 in every n hot-path debug log lines.
+// Values of 0 or 1 disable sampling.
+func WithLogSampleRate(n uint32) Option {
+	return func(l *Ledger) {
+		l.hotLog = sampledLogger(l.log, n)
+	}
+}
+
+// WithBalanceLoader sets the function GetBalance calls when a customer's
+// balance is missing from Redis, typically sync.Syncer.SyncCustomer.
+func WithBalanceLoader(load func(ctx context.Context, customerID string) error) Option {
+	return func(l *Ledger) {
+		l.loadBalance = load
+	}
+}
+
+// WithUnknownCustomerSync makes CheckAndReserveBalance, on finding nothing
+// in Redis for a customer, load them with the balance loader (see
+// WithBalanceLoader) and try once more before rejecting with
+// RejectionCustomerNotFound. Each such request then costs a PostgreSQL
+// query, including ones for customers that really don't exist. Off by
+// default.
+func WithUnknownCustomerSync(enabled bool) Option {
+	return func(l *Ledger) {
+		l.syncUnknownCustomers = enabled
+	}
+}
+
+// sampledLogger wraps logger so that debug events are sampled 1-in-n while
+// info, warn, and error events always pass through.
+//
+// The sampler is shared by every event logged through the returned logger, so
+// this must be called once at construction, not per call.
+func sampledLogger(logger zerolog.Logger, n uint32) zerolog.Logger {
+	if n <= 1 {
+		return logger
+	}
+	return logger.Sample(zerolog.LevelSampler{
+		DebugSampler: &zerolog.BasicSampler{N: n},
+	})
 }
 
 // PricingInfo contains model pricing in grains per million tokens.
 type PricingInfo struct {
-	Model                      string
-	Provider                   string
-	InputCostPerMillionTokens  int64
-	OutputCostPerMillionTokens int64
+	Model                      string `json:"model"`
+	Provider                   string `json:"provider"`
+	InputCostPerMillionTokens  int64  `json:"input_cost_per_million_tokens"`
+	OutputCostPerMillionTokens int64  `json:"output_cost_per_million_tokens"`
+
+	// Rates for image and audio tokens of multimodal models (see Cost).
+	// Zero means the model has none, and they are priced as text.
+	ImageCostPerMillionTokens int64 `json:"image_cost_per_million_tokens,omitempty"`
+	AudioCostPerMillionTokens int64 `json:"audio_cost_per_million_tokens,omitempty"`
 }
 
 // NewLedger creates a new Ledger instance connected to Redis and PostgreSQL.
@@ -148,6 +534,7 @@ type PricingInfo struct {
 //   redisAddr: Redis connection string (e.g., "localhost:6379")
 //   postgresURL: PostgreSQL connection string
 //   logger: Structured logger for operational visibility
+//   opts: Optional behaviour (see Option)
 //
 // This function:
 // 1. Establishes connection pools to both databases
@@ -156,11 +543,26 @@ type PricingInfo struct {
 // 4. Loads model pricing into cache
 //
 // Returns an error if connections fail or Lua scripts are invalid.
-func NewLedger(redisAddr, postgresURL string, logger zerolog.Logger) (*Ledger, error) {
+func NewLedger(redisAddr, postgresURL string, logger zerolog.Logger, opts ...Option) (*Ledger, error) {
 	logger.Info().
 		Str("redis_addr", redisAddr).
 		Msg("initializing ledger")
 
+	// Create ledger instance. Options are applied first since some of them
+	// configure the connections.
+	l := &Ledger{
+		log:    logger,
+		hotLog: logger,
+		done:   make(chan struct{}),
+	}
+	l.applyWrite = l.applyWriteToDB
+	l.applyBatch = l.writeFinalizationBatchToDB
+	l.deadLetter = l.storeFailedWrite
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
 	// Connect to Redis with aggressive timeouts for sub-millisecond operations
 	rdb := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
@@ -188,13 +590,15 @@ func NewLedger(redisAddr, postgresURL string, logger zerolog.Logger) (*Ledger, e
 	defer cancel()
 
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("redis ping failed: %w", err)
+		return nil, redisError("ping", err)
 	}
 
 	logger.Info().Msg("redis connection established")
 
-	// Connect to PostgreSQL
-	db, err := sql.Open("postgres", postgresURL)
+	// Connect to PostgreSQL. statement_timeout makes the server cancel a
+	// query stuck on a lock instead of holding the connection until the
+	// caller's context expires.
+	db, err := openPostgres(postgresURL, l.statementTimeoutOrDefault(), l.schema)
 	if err != nil {
 		return nil, fmt.Errorf("postgres connection failed: %w", err)
 	}
@@ -210,157 +614,560 @@ func NewLedger(redisAddr, postgresURL string, logger zerolog.Logger) (*Ledger, e
 	if err := db.PingContext(ctx); err != nil {
 		return nil, fmt.Errorf("postgres ping failed: %w", err)
 	}
+	if err := checkSchema(ctx, db, l.schema); err != nil {
+		return nil, err
+	}
 
-	logger.Info().Msg("postgres connection established")
+	logger.Info().
+		Dur("statement_timeout", l.statementTimeoutOrDefault()).
+		Str("schema", l.schema).
+		Msg("postgres connection established")
 
-	// Create ledger instance
-	l := &Ledger{
-		redis:      rdb,
-		db:         db,
-		log:        logger,
-		writeQueue: make(chan writeOp, 10000), // Large buffer for burst traffic
-	}
+	l.redis = rdb
+	l.db = db
 
 	// Load Lua scripts
 	if err := l.loadLuaScripts(); err != nil {
 		return nil, fmt.Errorf("failed to load lua scripts: %w", err)
 	}
 
+	// Refuse to start with scripts that get the arithmetic wrong
+	if err := l.selfTest(ctx); err != nil {
+		return nil, fmt.Errorf("lua script self-test failed: %w", err)
+	}
+
 	logger.Info().Msg("lua scripts loaded successfully")
 
 	// Load pricing information into cache
 	if err := l.loadPricingCache(ctx); err != nil {
-		logger.Warn().Err(err).Msg("failed to load pricing cache, will load on demand")
-		// Non-fatal - we can load pricing on demand
+		logger.Warn().Err(err).Msg("failed to load pricing cache, retrying in the background")
+		// Non-fatal - pricing is loaded on demand meanwhile, and the server
+		// reports not ready until the cache is warm
+		l.wg.Add(1)
+		go l.pricingWarmer()
+	}
+
+	// Apply the writes a crashed process queued but never made, before
+	// anything new is queued
+	if l.walPath != "" {
+		if err := l.startWAL(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Start background workers for async PostgreSQL writes
-	// Multiple workers handle the queue concurrently for throughput
+	// Multiple workers handle the queues concurrently for throughput
 	numWorkers := 10
-	l.wg.Add(numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		go l.asyncWriteWorker(i)
-	}
+	l.startWriteWorkers(numWorkers, 10000) // Large buffer for burst traffic
 
 	logger.Info().
 		Int("num_workers", numWorkers).
 		Msg("async write workers started")
 
+	// Export system-wide reserved/balance totals to Prometheus
+	l.wg.Add(1)
+	go l.totalsCollector(15 * time.Second)
+
+	// Replay writes that were dead-lettered by this or an earlier process
+	l.wg.Add(1)
+	go l.deadLetterReplayer(30*time.Second, 100, 2)
+
+	// Release reservations of requests that were never finalized
+	l.wg.Add(1)
+	go l.orphanSweeper(time.Minute)
+
 	return l, nil
 }
 
 // loadLuaScripts loads and compiles all Lua scripts.
 // We load them once at startup rather than on every request for performance.
+//
+// The scripts take the timestamps they write from Redis's TIME rather than
+// from an argument, so API servers with skewed clocks agree on them (see
+// scripts/lua/check_and_reserve.lua).
 func (l *Ledger) loadLuaScripts() error {
 	// Load check_and_reserve.lua
 	checkAndReserveScript := `
 local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local postpaid = redis.call('HGET', KEYS[6], 'billing_mode') == 'postpaid'
+local ceiling = 0
+if postpaid then
+    ceiling = tonumber(redis.call('HGET', KEYS[6], 'credit_ceiling_grains') or '0')
+    if ceiling <= 0 then
+        ceiling = tonumber(ARGV[11])
+    end
+    balance = ceiling - tonumber(redis.call('GET', KEYS[7]) or '0')
+end
 local reserved = tonumber(redis.call('GET', KEYS[2]) or '0')
 local needed = tonumber(ARGV[1])
 local available = balance - reserved
+if redis.call('EXISTS', KEYS[8]) == 1 then
+    return {0, balance, 'INTEGRITY_SAFE_MODE', available}
+end
+if redis.call('EXISTS', KEYS[1], KEYS[6]) == 0 then
+    return {0, balance, 'CUSTOMER_NOT_FOUND', available}
+end
 local existing_request = redis.call('EXISTS', KEYS[3])
 if existing_request == 1 then
-    return {0, balance, 'REQUEST_EXISTS'}
+    return {0, balance, 'REQUEST_EXISTS', available}
+end
+local now = tonumber(redis.call('TIME')[1])
+local max_inflight = tonumber(redis.call('HGET', KEYS[6], 'max_concurrent_requests') or '0')
+if max_inflight > 0 then
+    redis.call('ZREMRANGEBYSCORE', KEYS[9], '-inf', now)
+    if redis.call('ZCARD', KEYS[9]) >= max_inflight then
+        return {0, balance, 'TOO_MANY_INFLIGHT', available}
+    end
+end
+if not postpaid and ARGV[16] ~= '1' then
+    local minimum = tonumber(redis.call('HGET', KEYS[6], 'minimum_viable_balance_grains') or '0')
+    if minimum <= 0 then
+        minimum = tonumber(ARGV[15])
+    end
+    if minimum > 0 and available < minimum then
+        return {0, balance, 'BALANCE_TOO_LOW', available, minimum}
+    end
 end
+local preempted = 0
 if available < needed then
-    return {0, balance, 'INSUFFICIENT_BALANCE'}
+    if ARGV[10] ~= '1' then
+        return {0, balance, 'INSUFFICIENT_BALANCE', available}
+    end
+    local low = math.max(tonumber(redis.call('GET', KEYS[5]) or '0'), 0)
+    if available + low < needed then
+        return {0, balance, 'INSUFFICIENT_BALANCE', available}
+    end
+    preempted = needed - math.max(available, 0)
+end
+if ARGV[5] == '1' then
+    return {1, available - needed, '', available - needed, preempted}
 end
 redis.call('INCRBY', KEYS[2], needed)
+redis.call('INCRBY', KEYS[4], needed)
+if ARGV[9] == 'low' then
+    redis.call('INCRBY', KEYS[5], needed)
+end
 redis.call('HSET', KEYS[3],
-    'customer_id', ARGV[5],
+    'customer_id', ARGV[4],
     'reserved_grains', ARGV[1],
     'estimated_grains', ARGV[2],
     'consumed_grains', '0',
     'status', 'preflight_approved',
-    'created_at', ARGV[3],
-    'metadata', ARGV[4]
+    'created_at', now,
+    'metadata', ARGV[3],
+    'priority', ARGV[9],
+    'billing', postpaid and 'postpaid' or 'prepaid',
+    'schema_version', ARGV[12]
 )
-redis.call('EXPIRE', KEYS[3], 3600)
+if ARGV[13] ~= '0' then
+    redis.call('HSET', KEYS[3], 'max_deductions', ARGV[13])
+end
+if ARGV[14] ~= '' then
+    redis.call('HSET', KEYS[3], 'end_user_id', ARGV[14])
+end
+if preempted > 0 then
+    redis.call('HSET', KEYS[3], 'preempted_grains', preempted)
+end
+if postpaid then
+    redis.call('HSET', KEYS[3], 'credit_ceiling', ceiling)
+end
+if ARGV[7] ~= '' then
+    redis.call('HSET', KEYS[3],
+        'input_cost_per_million', ARGV[7],
+        'output_cost_per_million', ARGV[8]
+    )
+end
+redis.call('EXPIRE', KEYS[3], ARGV[6])
+redis.call('ZADD', KEYS[9], now + tonumber(ARGV[6]), KEYS[3])
+redis.call('EXPIRE', KEYS[9], ARGV[6])
 local new_available = available - needed
-return {1, new_available, ''}
+return {1, new_available, '', new_available, preempted}
 `
 	l.checkAndReserveScript = redis.NewScript(checkAndReserveScript)
 
 	// Load deduct_grains.lua
-	deductGrainsScript := `
+	deductGrainsScript := bucketFunctions() + `
 local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local billing = redis.call('HMGET', KEYS[2], 'billing', 'credit_ceiling')
+local postpaid = billing[1] == 'postpaid'
+if postpaid then
+    balance = tonumber(billing[2]) - tonumber(redis.call('GET', KEYS[6]) or '0')
+end
 local amount = tonumber(ARGV[1])
-local request_exists = redis.call('EXISTS', KEYS[2])
-if request_exists == 0 then
-    return {0, balance, 'REQUEST_NOT_FOUND'}
+local grace = tonumber(redis.call('HGET', KEYS[4], 'kill_grace_grains') or '0')
+local function grace_left(b)
+    return math.max(0, grace + math.min(0, b))
+end
+local status = redis.call('HGET', KEYS[2], 'status')
+if not status then
+    return {0, balance, 'REQUEST_NOT_FOUND', grace_left(balance)}
+end
+if status == 'completed' or status == 'killed' or status == 'failed' or status == 'timeout' or status == 'abandoned' or status == 'released' then
+    return {0, balance, 'REQUEST_FINALIZED', grace_left(balance)}
 end
-if balance < amount then
-    return {0, balance, 'INSUFFICIENT_BALANCE'}
+if ARGV[5] == '1' and redis.call('HEXISTS', KEYS[2], 'killed_at') == 1 then
+    return {0, balance, 'REQUEST_KILLED', grace_left(balance)}
 end
-if balance - amount < 0 then
-    return {0, balance, 'BALANCE_NEGATIVE'}
+local deductions = redis.call('HMGET', KEYS[2], 'deductions', 'max_deductions')
+if deductions[2] and tonumber(deductions[1] or '0') >= tonumber(deductions[2]) then
+    return {0, balance, 'TOO_MANY_DEDUCTIONS', grace_left(balance)}
+end
+redis.call('HINCRBY', KEYS[2], 'deductions', 1)
+if ARGV[4] ~= '' then
+    local price = redis.call('HGET', KEYS[2], ARGV[4])
+    if price then
+        amount = math.floor(tonumber(ARGV[2]) * tonumber(price) / 1000000)
+    end
+end
+if ARGV[3] == '1' then
+    local request = redis.call('HMGET', KEYS[2], 'reserved_grains', 'consumed_grains')
+    if tonumber(request[2] or '0') + amount > tonumber(request[1] or '0') then
+        return {0, balance, 'COST_EXCEEDS_RESERVATION', grace_left(balance)}
+    end
+end
+if balance + grace < amount then
+    if ARGV[5] == '1' then
+        redis.call('HSET', KEYS[2], 'killed_at', redis.call('TIME')[1])
+    end
+    return {0, balance, 'INSUFFICIENT_BALANCE', grace_left(balance)}
+end
+local new_balance = balance - amount
+local grace_used = math.max(0, -new_balance) - math.max(0, -balance)
+if postpaid then
+    redis.call('INCRBY', KEYS[6], amount)
+else
+    redis.call('DECRBY', KEYS[1], amount)
+    redis.call('DECRBY', KEYS[3], amount)
+    draw_buckets(KEYS[5], KEYS[2], amount)
 end
-redis.call('DECRBY', KEYS[1], amount)
 redis.call('HINCRBY', KEYS[2], 'consumed_grains', amount)
+if grace_used > 0 then
+    redis.call('HINCRBY', KEYS[2], 'grace_used_grains', grace_used)
+end
 redis.call('HSET', KEYS[2], 
     'status', 'streaming',
-    'last_deduction_at', ARGV[3] or redis.call('TIME')[1]
+    'last_deduction_at', redis.call('TIME')[1]
 )
-local new_balance = balance - amount
-return {1, new_balance, ''}
+return {1, new_balance, '', grace_left(new_balance), amount}
 `
 	l.deductGrainsScript = redis.NewScript(deductGrainsScript)
 
+	// Load reserve_and_deduct.lua: the two scripts above wrapped as
+	// functions, so the first deduction happens in the same atomic step as
+	// the reservation
+	reserveAndDeductScript := `
+local function check_and_reserve(KEYS, ARGV)
+` + checkAndReserveScript + `
+end
+local function deduct_grains(KEYS, ARGV)
+` + deductGrainsScript + `
+end
+local reservation = check_and_reserve({unpack(KEYS, 1, 9)}, {unpack(ARGV, 1, 15)})
+if reservation[1] == 1 and ARGV[5] ~= '1' then
+    reservation[6] = deduct_grains({unpack(KEYS, 10, 15)}, {unpack(ARGV, 16, 20)})
+end
+return reservation
+`
+	l.reserveAndDeductScript = redis.NewScript(reserveAndDeductScript)
+
+	// Load batch_reserve.lua: checks a whole batch up front, then reserves
+	// each sub-request with check_and_reserve, wrapped as above
+	batchReserveScript := `
+local function check_and_reserve(KEYS, ARGV)
+` + checkAndReserveScript + `
+end
+local n = #KEYS - 8
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local postpaid = redis.call('HGET', KEYS[5], 'billing_mode') == 'postpaid'
+if postpaid then
+    local ceiling = tonumber(redis.call('HGET', KEYS[5], 'credit_ceiling_grains') or '0')
+    if ceiling <= 0 then
+        ceiling = tonumber(ARGV[11])
+    end
+    balance = ceiling - tonumber(redis.call('GET', KEYS[6]) or '0')
+end
+local available = balance - tonumber(redis.call('GET', KEYS[2]) or '0')
+if redis.call('EXISTS', KEYS[7]) == 1 then
+    return {0, balance, 'INTEGRITY_SAFE_MODE', available, 0}
+end
+if redis.call('EXISTS', KEYS[1], KEYS[5]) == 0 then
+    return {0, balance, 'CUSTOMER_NOT_FOUND', available, 0}
+end
+local needed = 0
+for i = 1, n do
+    if redis.call('EXISTS', KEYS[8 + i]) == 1 then
+        return {0, balance, 'REQUEST_EXISTS', available, i}
+    end
+    needed = needed + tonumber(ARGV[(i - 1) * 15 + 1])
+end
+local max_inflight = tonumber(redis.call('HGET', KEYS[5], 'max_concurrent_requests') or '0')
+if max_inflight > 0 then
+    redis.call('ZREMRANGEBYSCORE', KEYS[8], '-inf', tonumber(redis.call('TIME')[1]))
+    if redis.call('ZCARD', KEYS[8]) + n > max_inflight then
+        return {0, balance, 'TOO_MANY_INFLIGHT', available, 0}
+    end
+end
+if not postpaid then
+    local minimum = tonumber(redis.call('HGET', KEYS[5], 'minimum_viable_balance_grains') or '0')
+    if minimum <= 0 then
+        minimum = tonumber(ARGV[15])
+    end
+    if minimum > 0 and available < minimum then
+        return {0, balance, 'BALANCE_TOO_LOW', available, 0, minimum}
+    end
+end
+if available < needed then
+    return {0, balance, 'INSUFFICIENT_BALANCE', available, 0}
+end
+for i = 1, n do
+    local args = {unpack(ARGV, (i - 1) * 15 + 1, i * 15)}
+    args[16] = '1'
+    local reservation = check_and_reserve(
+        {KEYS[1], KEYS[2], KEYS[8 + i], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7], KEYS[8]},
+        args)
+    if reservation[1] ~= 1 then
+        return redis.error_reply('batch sub-request ' .. i .. ' rejected after precheck: ' .. reservation[3])
+    end
+end
+return {1, balance, '', available - needed, 0}
+`
+	l.batchReserveScript = redis.NewScript(batchReserveScript)
+
 	// Load finalize_request.lua
-	finalizeRequestScript := `
-local request_data = redis.call('HGETALL', KEYS[3])
-if #request_data == 0 then
+	finalizeRequestScript := bucketFunctions() + priorityFunctions() + requestFunctions() + `
+redis.call('ZREM', KEYS[10], KEYS[3])
+local request = load_request(KEYS[3])
+if not request then
     return {0, 0, 'REQUEST_NOT_FOUND'}
 end
-local request = {}
-for i = 1, #request_data, 2 do
-    request[request_data[i]] = request_data[i + 1]
+local postpaid = request['billing'] == 'postpaid'
+local function current_balance()
+    if postpaid then
+        return tonumber(request['credit_ceiling']) - tonumber(redis.call('GET', KEYS[8]) or '0')
+    end
+    return tonumber(redis.call('GET', KEYS[1]) or '0')
 end
 local current_status = request['status']
-if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' then
-    local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
-    return {1, 0, balance}
+if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' or current_status == 'timeout' or current_status == 'abandoned' or current_status == 'released' then
+    return {1, 0, current_balance(), 'ALREADY_FINALIZED'}
 end
 local reserved = tonumber(request['reserved_grains'] or '0')
 local consumed = tonumber(request['consumed_grains'] or '0')
 local actual_cost = tonumber(ARGV[1])
-local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local input_price = request['input_cost_per_million']
+local output_price = request['output_cost_per_million']
+local input_cost, output_cost = '', ''
+if ARGV[3] == '1' and input_price and output_price and (tonumber(ARGV[4]) > 0 or tonumber(ARGV[5]) > 0) then
+    input_cost = math.floor(tonumber(ARGV[4]) * tonumber(input_price) / 1000000)
+    output_cost = math.floor(tonumber(ARGV[5]) * tonumber(output_price) / 1000000)
+    actual_cost = input_cost + output_cost
+end
+local policy = redis.call('HMGET', KEYS[9], 'refund_policy', 'refund_percent')
+local function refundable(over)
+    if policy[1] == 'none' then
+        return 0
+    elseif policy[1] == 'partial_percent' then
+        return math.floor(over * tonumber(policy[2] or '100') / 100)
+    end
+    return over
+end
+local balance = current_balance()
 local refund = 0
-if consumed > actual_cost then
+local withheld = 0
+local shortfall_debt = 0
+if postpaid then
     refund = consumed - actual_cost
-    redis.call('INCRBY', KEYS[1], refund)
+    if refund > 0 then
+        local over = refund
+        refund = refundable(over)
+        withheld = over - refund
+    end
+    redis.call('DECRBY', KEYS[8], refund)
     balance = balance + refund
+elseif consumed > actual_cost then
+    local over = consumed - actual_cost
+    refund = refundable(over)
+    withheld = over - refund
+    if refund > 0 then
+        redis.call('INCRBY', KEYS[1], refund)
+        return_buckets(KEYS[6], KEYS[3], refund)
+        balance = balance + refund
+    end
 elseif actual_cost > consumed then
     local additional = actual_cost - consumed
-    if balance >= additional then
+    if balance >= additional or ARGV[7] == 'negative' then
         redis.call('DECRBY', KEYS[1], additional)
+        draw_buckets(KEYS[6], KEYS[3], additional)
         balance = balance - additional
         refund = -additional
     else
-        redis.call('SET', KEYS[1], '0')
-        refund = -balance
-        balance = 0
-        redis.call('HSET', KEYS[3], 'integrity_issue', 'undercharge_shortfall')
+        local taken = math.max(balance, 0)
+        redis.call('DECRBY', KEYS[1], taken)
+        draw_buckets(KEYS[6], KEYS[3], taken)
+        refund = -taken
+        balance = balance - taken
+        if ARGV[7] == 'debt' then
+            shortfall_debt = additional - taken
+            redis.call('INCRBY', KEYS[8], shortfall_debt)
+            redis.call('HSET', KEYS[3], 'shortfall_debt_grains', tostring(shortfall_debt))
+        else
+            redis.call('HSET', KEYS[3], 'integrity_issue', 'undercharge_shortfall')
+        end
     end
 end
+if refund ~= 0 and not postpaid then
+    redis.call('INCRBY', KEYS[4], refund)
+end
 local current_reserved = tonumber(redis.call('GET', KEYS[2]) or '0')
 if current_reserved >= reserved then
     redis.call('DECRBY', KEYS[2], reserved)
+    redis.call('DECRBY', KEYS[5], reserved)
+    release_low(KEYS[7], request['priority'], reserved)
 else
     redis.call('SET', KEYS[2], '0')
+    redis.call('DECRBY', KEYS[5], current_reserved)
+    release_low(KEYS[7], request['priority'], current_reserved)
     redis.call('HSET', KEYS[3], 'integrity_issue', 'reservation_underflow')
 end
 redis.call('HMSET', KEYS[3],
     'status', ARGV[2],
-    'actual_cost_grains', ARGV[1],
+    'actual_cost_grains', tostring(actual_cost),
     'refunded_grains', tostring(refund),
-    'finalized_at', ARGV[3]
+    'withheld_grains', tostring(withheld),
+    'finalized_at', redis.call('TIME')[1]
 )
-redis.call('EXPIRE', KEYS[3], 86400)
-return {1, refund, balance}
+redis.call('EXPIRE', KEYS[3], ARGV[6])
+return {1, refund, balance, '', actual_cost, input_price or '', output_price or '', input_cost, output_cost, withheld, shortfall_debt}
 `
 	l.finalizeRequestScript = redis.NewScript(finalizeRequestScript)
 
+	// Load cancel_request.lua
+	cancelRequestScript := priorityFunctions() + requestFunctions() + `
+local request = load_request(KEYS[2])
+if not request then
+    redis.call('ZREM', KEYS[5], KEYS[2])
+    return {0, 0, 'REQUEST_NOT_FOUND'}
+end
+local current_status = request['status']
+if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' or current_status == 'timeout' or current_status == 'abandoned' or current_status == 'released' then
+    redis.call('ZREM', KEYS[5], KEYS[2])
+    return {1, 0, 'ALREADY_TERMINAL'}
+end
+local consumed = tonumber(request['consumed_grains'] or '0')
+if consumed > 0 then
+    return {0, 0, 'REQUEST_IN_PROGRESS'}
+end
+redis.call('ZREM', KEYS[5], KEYS[2])
+local reserved = tonumber(request['reserved_grains'] or '0')
+local current_reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+local released = reserved
+if current_reserved < reserved then
+    released = current_reserved
+end
+redis.call('DECRBY', KEYS[1], released)
+redis.call('DECRBY', KEYS[3], released)
+release_low(KEYS[4], request['priority'], released)
+redis.call('DEL', KEYS[2])
+return {1, released, ''}
+`
+	l.cancelRequestScript = redis.NewScript(cancelRequestScript)
+
+	// Load adjust_balance.lua
+	adjustBalanceScript := `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+    return {0, 0}
+end
+if ARGV[2] ~= ARGV[3] or redis.call('EXISTS', KEYS[3]) == 1 then
+    if redis.call('EXISTS', KEYS[3]) == 0 then
+        redis.call('HSET', KEYS[3], ARGV[3], redis.call('GET', KEYS[1]))
+    end
+    redis.call('HINCRBY', KEYS[3], ARGV[2], ARGV[1])
+end
+local new_balance = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('INCRBY', KEYS[2], ARGV[1])
+return {1, new_balance}
+`
+	l.adjustBalanceScript = redis.NewScript(adjustBalanceScript)
+
+	// Load abandon_request.lua
+	abandonRequestScript := priorityFunctions() + requestFunctions() + `
+redis.call('ZREM', KEYS[5], KEYS[2])
+local request = load_request(KEYS[2])
+if not request then
+    return {0, 0, 0, 'REQUEST_NOT_FOUND'}
+end
+local current_status = request['status']
+if current_status ~= 'preflight_approved' and current_status ~= 'streaming' then
+    return {1, 0, 0, 'ALREADY_TERMINAL'}
+end
+local reserved = tonumber(request['reserved_grains'] or '0')
+local consumed = tonumber(request['consumed_grains'] or '0')
+local current_reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+local released = reserved
+if current_reserved < reserved then
+    released = current_reserved
+    redis.call('HSET', KEYS[2], 'integrity_issue', 'reservation_underflow')
+end
+redis.call('DECRBY', KEYS[1], released)
+redis.call('DECRBY', KEYS[3], released)
+release_low(KEYS[4], request['priority'], released)
+redis.call('HMSET', KEYS[2],
+    'status', 'abandoned',
+    'actual_cost_grains', tostring(consumed),
+    'finalized_at', redis.call('TIME')[1]
+)
+redis.call('EXPIRE', KEYS[2], ARGV[1])
+return {1, released, consumed, ''}
+`
+	l.abandonRequestScript = redis.NewScript(abandonRequestScript)
+
+	// Load release_reservation.lua
+	releaseReservationScript := priorityFunctions() + requestFunctions() + `
+redis.call('ZREM', KEYS[5], KEYS[2])
+local request = load_request(KEYS[2])
+if not request then
+    return {0, 0, 0, 'REQUEST_NOT_FOUND', ''}
+end
+local current_status = request['status']
+if current_status ~= 'preflight_approved' and current_status ~= 'streaming' then
+    return {1, 0, 0, 'ALREADY_TERMINAL', ''}
+end
+local reserved = tonumber(request['reserved_grains'] or '0')
+local consumed = tonumber(request['consumed_grains'] or '0')
+local current_reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+local released = reserved
+if current_reserved < reserved then
+    released = math.max(current_reserved, 0)
+    redis.call('HSET', KEYS[2], 'integrity_issue', 'reservation_underflow')
+end
+redis.call('DECRBY', KEYS[1], released)
+redis.call('DECRBY', KEYS[3], released)
+release_low(KEYS[4], request['priority'], released)
+redis.call('HMSET', KEYS[2],
+    'status', 'released',
+    'actual_cost_grains', tostring(consumed),
+    'finalized_at', redis.call('TIME')[1]
+)
+redis.call('EXPIRE', KEYS[2], ARGV[1])
+return {1, released, consumed, '', request['metadata'] or ''}
+`
+	l.releaseReservationScript = redis.NewScript(releaseReservationScript)
+
+	// Load upgrade_request.lua
+	upgradeRequestScript := requestFunctions() + `
+local request, version = load_request(KEYS[1])
+if not request or version >= tonumber(request['schema_version']) then
+    return 0
+end
+redis.call('HSET', KEYS[1],
+    'priority', request['priority'],
+    'billing', request['billing'],
+    'schema_version', request['schema_version']
+)
+return 1
+`
+	l.upgradeRequestScript = redis.NewScript(upgradeRequestScript)
+
 	return nil
 }
 
@@ -368,7 +1175,9 @@ return {1, refund, balance}
 func (l *Ledger) loadPricingCache(ctx context.Context) error {
 	rows, err := l.db.QueryContext(ctx, `
 		SELECT model_name, provider, 
-		       input_cost_per_million_tokens, output_cost_per_million_tokens
+		       input_cost_per_million_tokens, output_cost_per_million_tokens,
+		       COALESCE(image_cost_per_million_tokens, 0),
+		       COALESCE(audio_cost_per_million_tokens, 0)
 		FROM model_pricing
 		WHERE effective_until IS NULL
 	`)
@@ -377,20 +1186,43 @@ func (l *Ledger) loadPricingCache(ctx context.Context) error {
 	}
 	defer rows.Close()
 
-	count := 0
+	current := make(map[string]bool)
 	for rows.Next() {
 		var p PricingInfo
-		if err := rows.Scan(&p.Model, &p.Provider, &p.InputCostPerMillionTokens, &p.OutputCostPerMillionTokens); err != nil {
+		if err := rows.Scan(&p.Model, &p.Provider, &p.InputCostPerMillionTokens, &p.OutputCostPerMillionTokens,
+			&p.ImageCostPerMillionTokens, &p.AudioCostPerMillionTokens); err != nil {
 			return fmt.Errorf("pricing scan failed: %w", err)
 		}
 
 		key := fmt.Sprintf("%s:%s", p.Model, p.Provider)
 		l.pricingCache.Store(key, p)
-		count++
+		current[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("pricing query failed: %w", err)
 	}
 
-	l.log.Info().Int("count", count).Msg("pricing cache loaded")
-	return rows.Err()
+	// Drop prices that are no longer current (see ReloadPricing)
+	l.pricingCache.Range(func(k, _ interface{}) bool {
+		if !current[k.(string)] {
+			l.pricingCache.Delete(k)
+		}
+		return true
+	})
+
+	// Unlike prices, multipliers and aliases aren't looked up on a cache
+	// miss, so pricing isn't loaded until they are
+	if err := l.loadCostMultipliers(ctx); err != nil {
+		return err
+	}
+	if err := l.loadModelAliases(ctx); err != nil {
+		return err
+	}
+
+	l.pricingLoaded.Store(true)
+	pricingCacheLoaded.Set(1)
+	l.log.Info().Int("count", len(current)).Msg("pricing cache loaded")
+	return nil
 }
 
 // CheckAndReserveBalance performs atomic pre-flight validation and reservation.
@@ -410,12 +1242,24 @@ func (l *Ledger) loadPricingCache(ctx context.Context) error {
 //    - Check if available >= needed
 //    - If yes, increment reserved counter
 //    - Create request tracking hash
-// 2. Queue async write to PostgreSQL for durability
+//    - If the customer isn't in Redis at all, reject with
+//      RejectionCustomerNotFound (after one on-demand sync and retry with
+//      WithUnknownCustomerSync)
+// 2. Queue async write to PostgreSQL for durability (or, with
+//    WithSyncWrites, write it inline and roll the reservation back if that
+//    fails)
 // 3. Return result to caller
 //
 // Performance: 2-4ms typical, 10ms P99
 // Concurrency: Safe for unlimited concurrent calls
 func (l *Ledger) CheckAndReserveBalance(ctx context.Context, req ReservationRequest) (*ReservationResult, error) {
+	res, _, err := l.reserve(ctx, req, nil)
+	return res, err
+}
+
+// reserve implements CheckAndReserveBalance and, given a first deduction,
+// ReserveAndDeduct. The deduction result is nil unless ded ran.
+func (l *Ledger) reserve(ctx context.Context, req ReservationRequest, ded *DeductionRequest) (*ReservationResult, *DeductionResult, error) {
 	start := time.Now()
 
 	// Prepare metadata for storage
@@ -425,72 +1269,194 @@ func (l *Ledger) CheckAndReserveBalance(ctx context.Context, req ReservationRequ
 		metadata = []byte("{}")
 	}
 
-	// Execute Lua script
-	keys := []string{
-		fmt.Sprintf("customer:balance:%s", req.CustomerID),
-		fmt.Sprintf("customer:reserved:%s", req.CustomerID),
-		fmt.Sprintf("request:%s", req.RequestID),
+	if req.Priority == "" {
+		req.Priority = PriorityNormal
+	} else if !validPriority(req.Priority) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownPriority, req.Priority)
 	}
 
-	args := []interface{}{
-		req.ReservedGrains,
-		req.EstimatedGrains,
-		time.Now().Unix(),
-		string(metadata),
-		req.CustomerID,
+	resultArray, currency, err := l.runCheckAndReserve(ctx, req, metadata, ded)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	result, err := l.checkAndReserveScript.Run(ctx, l.redis, keys, args...).Result()
-	if err != nil {
-		l.log.Error().Err(err).
-			Str("customer_id", req.CustomerID).
-			Str("request_id", req.RequestID).
-			Msg("check_and_reserve lua script failed")
-		return nil, fmt.Errorf("lua script execution failed: %w", err)
+	// A customer Redis has never heard of may just not be synced yet
+	if resultArray[2].(string) == RejectionCustomerNotFound && l.syncUnknownCustomers && l.loadBalance != nil {
+		if err := l.loadBalance(ctx, req.CustomerID); err != nil {
+			l.log.Warn().Err(err).
+				Str("customer_id", req.CustomerID).
+				Str("request_id", req.RequestID).
+				Msg("on-demand sync of unknown customer failed")
+		} else {
+			resultArray, currency, err = l.runCheckAndReserve(ctx, req, metadata, ded)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
 	// Parse result from Lua
-	resultArray := result.([]interface{})
 	approved := resultArray[0].(int64) == 1
 	balance := resultArray[1].(int64)
 	reason := resultArray[2].(string)
+	available := resultArray[3].(int64)
 
 	duration := time.Since(start)
 
+	if reason == RejectionRequestExists {
+		duplicateRequestsTotal.Inc()
+	}
+
 	res := &ReservationResult{
 		Approved:         approved,
 		CurrentBalance:   balance,
 		RemainingBalance: balance,
 		RejectionReason:  reason,
 		ReservedGrains:   req.ReservedGrains,
+		AvailableBalance: available,
+		Currency:         currency,
+	}
+
+	if reason == RejectionInsufficientBalance {
+		res.ShortfallGrains = req.ReservedGrains - available
+	} else if reason == RejectionBalanceTooLow {
+		res.ShortfallGrains = balanceTooLowShortfall(req.ReservedGrains, available, resultArray[4].(int64))
+	}
+	if approved && len(resultArray) > 4 {
+		res.PreemptedGrains = resultArray[4].(int64)
+		if res.PreemptedGrains > 0 && !req.DryRun {
+			reservationPreemptionsTotal.Inc()
+		}
 	}
 
 	// Log the operation
-	l.log.Debug().
+	l.hotLog.Debug().
 		Str("customer_id", req.CustomerID).
 		Str("request_id", req.RequestID).
 		Int64("reserved_grains", req.ReservedGrains).
 		Bool("approved", approved).
+		Bool("dry_run", req.DryRun).
+		Str("priority", req.Priority).
+		Int64("preempted_grains", res.PreemptedGrains).
 		Str("reason", reason).
 		Dur("duration_ms", duration).
 		Msg("check_and_reserve completed")
 
-	// If approved, queue async write to PostgreSQL
-	if approved {
-		select {
-		case l.writeQueue <- writeOp{
-			opType: "preflight",
-			data:   req,
-			ctx:    context.Background(), // Use background context for async work
-		}:
-			// Queued successfully
-		default:
-			// Queue is full - log but don't block
-			l.log.Warn().Msg("write queue full, skipping async preflight write")
+	l.trace(req.RequestID, traceStageReserve).
+		Str("customer_id", req.CustomerID).
+		Int64("reserved_grains", req.ReservedGrains).
+		Int64("estimated_grains", req.EstimatedGrains).
+		Bool("approved", approved).
+		Bool("dry_run", req.DryRun).
+		Str("reason", reason).
+		Int64("available", available).
+		Msg("request trace")
+
+	var deduction *DeductionResult
+	if ded != nil && len(resultArray) > 5 {
+		deduction = parseDeductResult(resultArray[5].([]interface{}))
+		l.deductionCompleted(*ded, deduction)
+	}
+
+	// If approved, write to PostgreSQL (queued unless sync writes are on)
+	// Dry runs reserved nothing, so there is nothing to persist
+	if approved && !req.DryRun {
+		err := l.persist(writeOp{
+			opType:     "preflight",
+			customerID: req.CustomerID,
+			data:       req,
+			ctx:        context.Background(), // Use background context for async work
+		})
+		if err != nil {
+			// Cancelling also refunds a first deduction
+			l.rollbackReservation(ctx, req.CustomerID, req.RequestID, currency)
+			return nil, nil, err
 		}
 	}
 
-	return res, nil
+	return res, deduction, nil
+}
+
+// runCheckAndReserve runs the check_and_reserve script for req and returns
+// its result array along with the currency it reserved in. Given ded, it
+// runs reserve_and_deduct instead, whose array has the deduct script's
+// result appended if the reservation was approved.
+func (l *Ledger) runCheckAndReserve(ctx context.Context, req ReservationRequest, metadata []byte, ded *DeductionRequest) ([]interface{}, string, error) {
+	currency, err := l.customerCurrency(ctx, req.CustomerID, req.Currency)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Execute Lua script
+	keys := []string{
+		balanceKey(req.CustomerID, currency),
+		reservedKey(req.CustomerID, currency),
+		fmt.Sprintf("request:%s", req.RequestID),
+		totalReservedKey,
+		reservedLowKey(req.CustomerID, currency),
+		fmt.Sprintf("customer:config:%s", req.CustomerID),
+		debtKey(req.CustomerID, currency),
+		safeModeKey,
+		inflightKey(req.CustomerID),
+	}
+	args := l.reserveScriptArgs(req, metadata)
+
+	script := l.checkAndReserveScript
+	if ded != nil {
+		dedKeys, dedArgs := l.deductScriptParams(*ded, currency)
+		keys = append(keys, dedKeys...)
+		args = append(args, dedArgs...)
+		script = l.reserveAndDeductScript
+	}
+
+	result, err := script.Run(ctx, l.redis, keys, args...).Result()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", req.CustomerID).
+			Str("request_id", req.RequestID).
+			Msg("check_and_reserve lua script failed")
+		return nil, "", scriptError(err)
+	}
+
+	return result.([]interface{}), currency, nil
+}
+
+// reserveScriptArgs builds the check_and_reserve script's ARGV for req.
+func (l *Ledger) reserveScriptArgs(req ReservationRequest, metadata []byte) []interface{} {
+	args := []interface{}{
+		req.ReservedGrains,
+		req.EstimatedGrains,
+		string(metadata),
+		req.CustomerID,
+		boolArg(req.DryRun),
+		int64(l.requestTTL().Seconds()),
+	}
+	args = append(args, pinnedPricingArgs(req.Pricing)...)
+	args = append(args, req.Priority, boolArg(l.priorityPreemption && req.Priority == PriorityHigh))
+	args = append(args, l.postpaidCreditCeiling, RequestSchemaVersion, l.maxDeductionsFor(req.MaxDeductions), req.EndUserID)
+	args = append(args, l.minimumViableBalance)
+	return args
+}
+
+// rollbackReservation undoes a reservation whose preflight write failed,
+// so the request leaves no trace. Nothing can have streamed against it yet,
+// so cancelling it releases exactly what was reserved.
+func (l *Ledger) rollbackReservation(ctx context.Context, customerID, requestID, currency string) {
+	err := l.cancelRequestScript.Run(ctx, l.redis, l.cancelScriptKeys(customerID, requestID, currency)).Err()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("failed to roll back reservation, the orphan sweeper will release it")
+	}
+}
+
+// boolArg encodes a bool as a Lua script argument.
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
 }
 
 // DeductGrains atomically deducts grains during streaming.
@@ -499,19 +1465,19 @@ func (l *Ledger) CheckAndReserveBalance(ctx context.Context, req ReservationRequ
 // streams back to the user. Each call deducts grains and checks if the
 // balance has hit zero, which triggers the kill switch.
 //
+// A customer with a kill grace (CustomerConfig.KillGraceGrains) may go up
+// to that many grains below zero first, so a response that is nearly done
+// isn't cut off a few tokens short.
+//
 // Performance: 1-3ms typical
 // Call frequency: 10-30 times per streaming request
 func (l *Ledger) DeductGrains(ctx context.Context, req DeductionRequest) (*DeductionResult, error) {
-	keys := []string{
-		fmt.Sprintf("customer:balance:%s", req.CustomerID),
-		fmt.Sprintf("request:%s", req.RequestID),
+	currency, err := l.customerCurrency(ctx, req.CustomerID, req.Currency)
+	if err != nil {
+		return nil, err
 	}
 
-	args := []interface{}{
-		req.GrainAmount,
-		req.TokensConsumed,
-		time.Now().Unix(),
-	}
+	keys, args := l.deductScriptParams(req, currency)
 
 	result, err := l.deductGrainsScript.Run(ctx, l.redis, keys, args...).Result()
 	if err != nil {
@@ -519,29 +1485,71 @@ func (l *Ledger) DeductGrains(ctx context.Context, req DeductionRequest) (*Deduc
 			Str("customer_id", req.CustomerID).
 			Str("request_id", req.RequestID).
 			Msg("deduct_grains lua script failed")
-		return nil, fmt.Errorf("lua script execution failed: %w", err)
+		return nil, scriptError(err)
 	}
 
-	resultArray := result.([]interface{})
-	success := resultArray[0].(int64) == 1
-	balance := resultArray[1].(int64)
-	errorCode := resultArray[2].(string)
+	res := parseDeductResult(result.([]interface{}))
+	l.deductionCompleted(req, res)
+
+	return res, nil
+}
+
+// deductScriptParams builds the KEYS and ARGV for the deduct script.
+func (l *Ledger) deductScriptParams(req DeductionRequest, currency string) ([]string, []interface{}) {
+	keys := []string{
+		balanceKey(req.CustomerID, currency),
+		fmt.Sprintf("request:%s", req.RequestID),
+		totalBalanceKey,
+		fmt.Sprintf("customer:config:%s", req.CustomerID),
+		bucketsKey(req.CustomerID, currency),
+		debtKey(req.CustomerID, currency),
+	}
 
+	args := []interface{}{
+		req.GrainAmount,
+		req.TokensConsumed,
+		boolArg(req.ClientPriced),
+		pinnedPriceField(req.PriceFromPins, req.IsCompletion),
+		boolArg(l.killHysteresis),
+	}
+
+	return keys, args
+}
+
+// parseDeductResult decodes the deduct script's reply: {1, balance, "",
+// grace_left, deducted} on success, {0, balance, error_code, grace_left}
+// on failure.
+func parseDeductResult(resultArray []interface{}) *DeductionResult {
 	res := &DeductionResult{
-		Success:          success,
-		RemainingBalance: balance,
-		ErrorCode:        errorCode,
+		Success:              resultArray[0].(int64) == 1,
+		RemainingBalance:     resultArray[1].(int64),
+		RemainingGraceGrains: resultArray[3].(int64),
+		ErrorCode:            resultArray[2].(string),
+	}
+	if res.Success && len(resultArray) > 4 {
+		res.GrainsDeducted = resultArray[4].(int64)
 	}
+	return res
+}
 
-	l.log.Debug().
+// deductionCompleted logs a deduction.
+func (l *Ledger) deductionCompleted(req DeductionRequest, res *DeductionResult) {
+	l.hotLog.Debug().
 		Str("customer_id", req.CustomerID).
 		Str("request_id", req.RequestID).
-		Int64("grain_amount", req.GrainAmount).
-		Bool("success", success).
-		Str("error_code", errorCode).
+		Int64("grain_amount", res.GrainsDeducted).
+		Bool("success", res.Success).
+		Str("error_code", res.ErrorCode).
 		Msg("deduct_grains completed")
 
-	return res, nil
+	l.trace(req.RequestID, traceStageDeduct).
+		Str("customer_id", req.CustomerID).
+		Int64("grain_amount", res.GrainsDeducted).
+		Int32("tokens", req.TokensConsumed).
+		Bool("success", res.Success).
+		Str("error_code", res.ErrorCode).
+		Int64("remaining_balance", res.RemainingBalance).
+		Msg("request trace")
 }
 
 // FinalizeRequest performs final reconciliation at stream-end.
@@ -550,20 +1558,19 @@ func (l *Ledger) DeductGrains(ctx context.Context, req DeductionRequest) (*Deduc
 // from the AI provider. It reconciles estimated vs actual costs, refunds
 // any overcharges, releases the reservation, and marks the request complete.
 //
+// With WithSyncWrites, a failed PostgreSQL write returns ErrWriteFailed even
+// though the request is finalized in Redis; the write is dead-lettered.
+//
 // Performance: 3-8ms typical
 // Call frequency: Once per request
 func (l *Ledger) FinalizeRequest(ctx context.Context, req FinalizationRequest) (*FinalizationResult, error) {
-	keys := []string{
-		fmt.Sprintf("customer:balance:%s", req.CustomerID),
-		fmt.Sprintf("customer:reserved:%s", req.CustomerID),
-		fmt.Sprintf("request:%s", req.RequestID),
+	currency, err := l.customerCurrency(ctx, req.CustomerID, req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 
-	args := []interface{}{
-		req.ActualCostGrains,
-		req.Status,
-		time.Now().Unix(),
-	}
+	keys, args := l.finalizeScriptParams(req)
 
 	result, err := l.finalizeRequestScript.Run(ctx, l.redis, keys, args...).Result()
 	if err != nil {
@@ -571,122 +1578,339 @@ func (l *Ledger) FinalizeRequest(ctx context.Context, req FinalizationRequest) (
 			Str("customer_id", req.CustomerID).
 			Str("request_id", req.RequestID).
 			Msg("finalize_request lua script failed")
-		return nil, fmt.Errorf("lua script execution failed: %w", err)
+		return nil, scriptError(err)
+	}
+
+	res := parseFinalizeResult(result)
+	if err := l.finalizeCompleted(req, res); err != nil {
+		return nil, err
 	}
 
+	return res, nil
+}
+
+// finalizeScriptParams builds the KEYS and ARGV for the finalize script.
+// req.Currency must already be resolved.
+func (l *Ledger) finalizeScriptParams(req FinalizationRequest) ([]string, []interface{}) {
+	keys := []string{
+		balanceKey(req.CustomerID, req.Currency),
+		reservedKey(req.CustomerID, req.Currency),
+		fmt.Sprintf("request:%s", req.RequestID),
+		totalBalanceKey,
+		totalReservedKey,
+		bucketsKey(req.CustomerID, req.Currency),
+		reservedLowKey(req.CustomerID, req.Currency),
+		debtKey(req.CustomerID, req.Currency),
+		fmt.Sprintf("customer:config:%s", req.CustomerID),
+		inflightKey(req.CustomerID),
+	}
+
+	args := []interface{}{
+		req.ActualCostGrains,
+		req.Status,
+		boolArg(req.PriceFromPins),
+		req.PromptTokens,
+		req.CompletionTokens,
+		int64(l.terminalRequestTTL(req.Status).Seconds()),
+		l.shortfallPolicyArg(),
+	}
+
+	return keys, args
+}
+
+// parseFinalizeResult decodes the finalize script's reply.
+//
+// Success is {1, refund, balance, "", actual_cost, input_price,
+// output_price, input_cost, output_cost, withheld, shortfall_debt}, with
+// empty prices if none were pinned and empty costs unless actual_cost was
+// priced from them;
+// an already finalized request gives {1, 0, balance, "ALREADY_FINALIZED"};
+// failure is {0, 0, error_code}.
+func parseFinalizeResult(result interface{}) *FinalizationResult {
 	resultArray := result.([]interface{})
-	success := resultArray[0].(int64) == 1
-	refunded := resultArray[1].(int64)
-	finalBalance := resultArray[2].(int64)
+	if resultArray[0].(int64) != 1 {
+		errorCode, _ := resultArray[2].(string)
+		return &FinalizationResult{ErrorCode: errorCode}
+	}
 
 	res := &FinalizationResult{
-		Success:        success,
-		RefundedGrains: refunded,
-		FinalBalance:   finalBalance,
+		Success:        true,
+		RefundedGrains: resultArray[1].(int64),
+		FinalBalance:   resultArray[2].(int64),
+	}
+	if len(resultArray) > 3 {
+		code, _ := resultArray[3].(string)
+		res.AlreadyFinalized = code == "ALREADY_FINALIZED"
+	}
+	if len(resultArray) > 6 {
+		res.ActualCostGrains = resultArray[4].(int64)
+		input, _ := resultArray[5].(string)
+		output, _ := resultArray[6].(string)
+		res.PinnedPricing = parsePinnedPricing(input, output)
+	}
+	if len(resultArray) > 8 {
+		input, inOK := resultArray[7].(int64)
+		output, outOK := resultArray[8].(int64)
+		if inOK && outOK {
+			res.CostBreakdown = &CostBreakdown{InputCostGrains: input, OutputCostGrains: output}
+		}
+	}
+	if len(resultArray) > 9 {
+		res.WithheldGrains = resultArray[9].(int64)
+	}
+	if len(resultArray) > 10 {
+		res.ShortfallDebtGrains = resultArray[10].(int64)
+	}
+
+	return res
+}
+
+// finalizeCompleted logs a finalization and, if it succeeded, writes it to
+// PostgreSQL (see persist). The error is that of a failed sync write.
+func (l *Ledger) finalizeCompleted(req FinalizationRequest, res *FinalizationResult) error {
+	l.trace(req.RequestID, traceStageFinalize).
+		Str("customer_id", req.CustomerID).
+		Str("status", req.Status).
+		Int64("actual_cost", res.ActualCostGrains).
+		Bool("success", res.Success).
+		Bool("already_finalized", res.AlreadyFinalized).
+		Str("error_code", res.ErrorCode).
+		Int64("final_balance", res.FinalBalance).
+		Msg("request trace")
+
+	if !res.Success {
+		l.log.Warn().
+			Str("customer_id", req.CustomerID).
+			Str("request_id", req.RequestID).
+			Str("error_code", res.ErrorCode).
+			Msg("finalize_request failed")
+		return nil
+	}
+
+	// A retry (or a finalize after the request was abandoned) must not
+	// record the usage in PostgreSQL a second time
+	if res.AlreadyFinalized {
+		l.log.Info().
+			Str("customer_id", req.CustomerID).
+			Str("request_id", req.RequestID).
+			Msg("finalize_request ignored, request already finalized")
+		return nil
 	}
 
+	// The script may have priced the request from its pinned prices
+	req.ActualCostGrains = res.ActualCostGrains
+	req.withheldGrains = res.WithheldGrains
+	req.shortfallDebtGrains = res.ShortfallDebtGrains
+
 	l.log.Info().
 		Str("customer_id", req.CustomerID).
 		Str("request_id", req.RequestID).
 		Str("status", req.Status).
 		Int64("actual_cost", req.ActualCostGrains).
-		Int64("refunded", refunded).
+		Int64("refunded", res.RefundedGrains).
+		Int64("withheld", res.WithheldGrains).
+		Int64("shortfall_debt", res.ShortfallDebtGrains).
 		Msg("finalize_request completed")
 
-	// Queue async write to PostgreSQL
-	select {
-	case l.writeQueue <- writeOp{
-		opType: "finalization",
-		data:   req,
-		ctx:    context.Background(),
-	}:
-		// Queued successfully
-	default:
-		l.log.Warn().Msg("write queue full, skipping async finalization write")
+	if res.RefundedGrains != 0 {
+		l.trace(req.RequestID, traceStageRefund).
+			Str("customer_id", req.CustomerID).
+			Int64("refunded", res.RefundedGrains).
+			Msg("request trace")
 	}
 
-	return res, nil
+	l.recordProviderSpend(req)
+	l.recordCustomerSpend(req)
+
+	// Write to PostgreSQL (queued unless sync writes are on)
+	return l.persist(writeOp{
+		opType:     "finalization",
+		customerID: req.CustomerID,
+		data:       req,
+		ctx:        context.Background(),
+	})
 }
 
 // GetBalance returns current balance without side effects (read-only).
-func (l *Ledger) GetBalance(ctx context.Context, customerID string) (balance int64, reserved int64, available int64, err error) {
-	balanceKey := fmt.Sprintf("customer:balance:%s", customerID)
-	reservedKey := fmt.Sprintf("customer:reserved:%s", customerID)
+//
+// Amounts are in grains of the customer's configured currency. found is
+// false when the customer has no balance in Redis at all (never synced, or
+// evicted), which is not the same as a balance of zero. In that case the
+// balance loader (see WithBalanceLoader), if any, is asked to sync the
+// customer and the balance is read once more.
+func (l *Ledger) GetBalance(ctx context.Context, customerID string) (balance int64, reserved int64, available int64, found bool, err error) {
+	balance, reserved, found, err = l.readBalance(ctx, customerID)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+
+	if !found && l.loadBalance != nil {
+		l.log.Warn().
+			Str("customer_id", customerID).
+			Msg("customer balance missing in redis, syncing from postgresql")
+
+		if err := l.loadBalance(ctx, customerID); err != nil {
+			l.log.Error().Err(err).Str("customer_id", customerID).Msg("balance sync failed")
+		} else {
+			balance, reserved, found, err = l.readBalance(ctx, customerID)
+			if err != nil {
+				return 0, 0, 0, false, err
+			}
+		}
+	}
+
+	return balance, reserved, balance - reserved, found, nil
+}
+
+// readBalance reads a customer's balance and reserved counter from Redis.
+// found reports whether the balance key exists; a missing reserved counter
+// just means nothing is reserved.
+func (l *Ledger) readBalance(ctx context.Context, customerID string) (balance int64, reserved int64, found bool, err error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return 0, 0, false, err
+	}
 
 	// Use pipeline for efficiency (single round trip)
 	pipe := l.redis.Pipeline()
-	balanceCmd := pipe.Get(ctx, balanceKey)
-	reservedCmd := pipe.Get(ctx, reservedKey)
+	balanceCmd := pipe.Get(ctx, balanceKey(customerID, currency))
+	reservedCmd := pipe.Get(ctx, reservedKey(customerID, currency))
 	_, err = pipe.Exec(ctx)
 
 	if err != nil && err != redis.Nil {
-		return 0, 0, 0, fmt.Errorf("redis pipeline failed: %w", err)
+		return 0, 0, false, redisError("pipeline", err)
+	}
+
+	balance, err = balanceCmd.Int64()
+	if err == redis.Nil {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid balance: %w", err)
 	}
 
-	balance, _ = balanceCmd.Int64()
-	reserved, _ = reservedCmd.Int64()
-	available = balance - reserved
+	reserved, err = reservedCmd.Int64()
+	if err != nil && err != redis.Nil {
+		return 0, 0, false, fmt.Errorf("invalid reserved counter: %w", err)
+	}
 
-	return balance, reserved, available, nil
+	return balance, reserved, true, nil
 }
 
-// asyncWriteWorker processes queued PostgreSQL writes in background.
-func (l *Ledger) asyncWriteWorker(workerID int) {
+// asyncWriteWorker processes one shard's queued PostgreSQL writes in background.
+//
+// Ops are applied strictly in queue order. Retries block the shard, which is
+// what keeps a customer's finalization from overtaking its preflight. With
+// write batching enabled (see WithWriteBatching), consecutive finalizations
+// are applied together.
+func (l *Ledger) asyncWriteWorker(workerID int, queue <-chan writeOp) {
 	defer l.wg.Done()
 
 	logger := l.log.With().Int("worker_id", workerID).Logger()
 	logger.Info().Msg("async write worker started")
 
-	for op := range l.writeQueue {
-		// Process with retry logic
-		maxRetries := 5
-		backoff := 100 * time.Millisecond
+	for op := range queue {
+		if l.writeBatchSize <= 1 || op.opType != "finalization" {
+			l.applyWithRetry(logger, op)
+			continue
+		}
 
-		for attempt := 1; attempt <= maxRetries; attempt++ {
-			var err error
+		batch, next := l.collectFinalizations(op, queue)
+		l.applyFinalizationBatch(logger, batch)
+		if next != nil {
+			l.applyWithRetry(logger, *next)
+		}
+	}
 
-			switch op.opType {
-			case "preflight":
-				err = l.writePreflightToDB(op.ctx, op.data.(ReservationRequest))
-			case "finalization":
-				err = l.writeFinalizationToDB(op.ctx, op.data.(FinalizationRequest))
-			}
+	logger.Info().Msg("async write worker stopped")
+}
 
-			if err == nil {
-				break // Success
-			}
+// applyWithRetry applies one queued op, retrying with exponential backoff
+// and dead-lettering it once the retries are exhausted.
+func (l *Ledger) applyWithRetry(logger zerolog.Logger, op writeOp) {
+	maxRetries := 5
+	backoff := l.writeRetryBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		err := l.applyWrite(op)
+
+		if err == nil {
+			l.writesSucceeded.Add(1)
+			l.walDone(op)
+			return
+		}
+
+		// A statement timeout is usually a lock wait; retried like
+		// any failure, but counted so contention is visible
+		timedOut := isStatementTimeout(err)
+		if timedOut {
+			pgStatementTimeoutsTotal.WithLabelValues(op.opType).Inc()
+		}
 
-			if attempt < maxRetries {
-				logger.Warn().Err(err).
-					Int("attempt", attempt).
-					Str("op_type", op.opType).
-					Msg("async write failed, retrying")
-				time.Sleep(backoff)
-				backoff *= 2 // Exponential backoff
-			} else {
-				logger.Error().Err(err).
-					Str("op_type", op.opType).
-					Msg("async write failed after all retries")
+		if attempt < maxRetries {
+			logger.Warn().Err(err).
+				Int("attempt", attempt).
+				Str("op_type", op.opType).
+				Bool("statement_timeout", timedOut).
+				Msg("async write failed, retrying")
+			time.Sleep(backoff)
+			backoff *= 2 // Exponential backoff
+		} else {
+			l.writesDeadLettered.Add(1)
+			logger.Error().Err(err).
+				Str("op_type", op.opType).
+				Bool("statement_timeout", timedOut).
+				Msg("async write failed after all retries")
+
+			if l.deadLetter != nil {
+				if derr := l.deadLetter(op, err); derr != nil {
+					logger.Error().Err(derr).
+						Str("op_type", op.opType).
+						Str("customer_id", op.customerID).
+						Msg("failed to store dead-lettered write, write lost")
+				} else {
+					l.walDone(op)
+				}
 			}
 		}
 	}
+}
 
-	logger.Info().Msg("async write worker stopped")
+// applyWriteToDB dispatches a queued op to its PostgreSQL writer.
+func (l *Ledger) applyWriteToDB(op writeOp) error {
+	switch op.opType {
+	case "preflight":
+		return l.writePreflightToDB(op.ctx, op.data.(ReservationRequest))
+	case "finalization":
+		return l.writeFinalizationToDB(op.ctx, op.data.(FinalizationRequest))
+	case "cancellation":
+		return l.writeCancellationToDB(op.ctx, op.data.(cancellation))
+	}
+	return fmt.Errorf("unknown write op type: %s", op.opType)
 }
 
-// writePreflightToDB writes pre-flight data to PostgreSQL.
+// writePreflightToDB writes pre-flight data to PostgreSQL. A request that
+// is already recorded is left as it is, so a replayed preflight is a no-op.
 func (l *Ledger) writePreflightToDB(ctx context.Context, req ReservationRequest) error {
+	tags, err := l.requestTags(req.Tags)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := l.db.ExecContext(ctx, `
+	_, err = l.db.ExecContext(ctx, `
 		INSERT INTO requests (
-			request_id, customer_id, platform_user_id,
+			request_id, customer_id, platform_user_id, end_user_id,
 			estimated_cost_grains, reserved_grains,
-			status, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, NOW())
-	`, req.RequestID, req.CustomerID, req.PlatformUserID,
-		req.EstimatedGrains, req.ReservedGrains, "preflight_approved")
+			status, priority, tags, created_at
+		) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, NULLIF($9, '')::jsonb, NOW())
+		ON CONFLICT (request_id) DO NOTHING
+	`, req.RequestID, req.CustomerID, req.PlatformUserID, req.EndUserID,
+		req.EstimatedGrains, req.ReservedGrains, "preflight_approved", req.Priority, tags)
 
 	return err
 }
@@ -723,15 +1947,7 @@ func (l *Ledger) writeFinalizationToDB(ctx context.Context, req FinalizationRequ
 	}
 
 	// Record transaction for audit trail
-	txID := uuid.New().String()
-	_, err = tx.ExecContext(ctx, `
-		INSERT INTO transactions (
-			transaction_id, customer_id, amount_grains,
-			transaction_type, reference_id, description, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, NOW())
-	`, txID, req.CustomerID, -req.ActualCostGrains,
-		"ai_usage", req.RequestID,
-		fmt.Sprintf("AI usage: %s (%d tokens)", req.Model, req.PromptTokens+req.CompletionTokens))
+	err = insertTransactions(ctx, tx, finalizationTransactions(req))
 
 	if err != nil {
 		return fmt.Errorf("insert transaction failed: %w", err)
@@ -740,7 +1956,59 @@ func (l *Ledger) writeFinalizationToDB(ctx context.Context, req FinalizationRequ
 	return tx.Commit()
 }
 
+// finalizationTransactionNamespace namespaces the IDs made by
+// finalizationTransactionID (an arbitrary fixed UUID).
+var finalizationTransactionNamespace = uuid.MustParse("6a1f9c2e-3b7d-4e85-9f0a-2c4d8e6b1a57")
+
+// finalizationTransactionID returns the ID of the transaction of type t
+// recording requestID's finalization. It depends only on its arguments, so
+// a finalization written again (replayed from the write-ahead log or the
+// dead letter table) reuses its IDs and insertTransactions skips it.
+func finalizationTransactionID(customerID, requestID string, t TransactionType) string {
+	return uuid.NewSHA1(finalizationTransactionNamespace, []byte(customerID+"\x00"+requestID+"\x00"+string(t))).String()
+}
+
+// finalizationTransactions returns the transactions recording a
+// finalization: its AI usage and, if the refund policy kept part of the
+// refund, the withheld amount, or if part of the cost was added to the
+// customer's debt, that debt.
+func finalizationTransactions(req FinalizationRequest) []Transaction {
+	txns := []Transaction{{
+		TransactionID: finalizationTransactionID(req.CustomerID, req.RequestID, TransactionAIUsage),
+		CustomerID:    req.CustomerID,
+		AmountGrains:  -req.ActualCostGrains,
+		Type:          TransactionAIUsage,
+		ReferenceID:   req.RequestID,
+		Description:   fmt.Sprintf("AI usage: %s (%d tokens)", req.Model, req.PromptTokens+req.CompletionTokens),
+	}}
+	if req.withheldGrains > 0 {
+		txns = append(txns, Transaction{
+			TransactionID: finalizationTransactionID(req.CustomerID, req.RequestID, TransactionRefundWithheld),
+			CustomerID:    req.CustomerID,
+			AmountGrains:  -req.withheldGrains,
+			Type:          TransactionRefundWithheld,
+			ReferenceID:   req.RequestID,
+			Description:   fmt.Sprintf("Refund withheld by refund policy: %s", req.Model),
+		})
+	}
+	if req.shortfallDebtGrains > 0 {
+		txns = append(txns, Transaction{
+			TransactionID: finalizationTransactionID(req.CustomerID, req.RequestID, TransactionShortfallDebt),
+			CustomerID:    req.CustomerID,
+			AmountGrains:  req.shortfallDebtGrains,
+			Type:          TransactionShortfallDebt,
+			ReferenceID:   req.RequestID,
+			Description:   fmt.Sprintf("Shortfall recorded as debt: %s", req.Model),
+		})
+	}
+	return txns
+}
+
 // GetModelPricing returns pricing for a model (with caching).
+//
+// A model with no cached price of its own that is an alias (see
+// ResolveModelAlias) is priced as its canonical model, whose name is
+// returned in Model.
 func (l *Ledger) GetModelPricing(model string, provider string) (*PricingInfo, error) {
 	key := fmt.Sprintf("%s:%s", model, provider)
 
@@ -750,6 +2018,17 @@ func (l *Ledger) GetModelPricing(model string, provider string) (*PricingInfo, e
 		return &pricing, nil
 	}
 
+	// Then the canonical model of a variant like "gpt-4-0613"
+	if canonical, ok := l.ResolveModelAlias(model); ok {
+		model = canonical
+		key = fmt.Sprintf("%s:%s", model, provider)
+
+		if cached, ok := l.pricingCache.Load(key); ok {
+			pricing := cached.(PricingInfo)
+			return &pricing, nil
+		}
+	}
+
 	// Cache miss - load from database
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -757,10 +2036,13 @@ func (l *Ledger) GetModelPricing(model string, provider string) (*PricingInfo, e
 	var p PricingInfo
 	err := l.db.QueryRowContext(ctx, `
 		SELECT model_name, provider, 
-		       input_cost_per_million_tokens, output_cost_per_million_tokens
+		       input_cost_per_million_tokens, output_cost_per_million_tokens,
+		       COALESCE(image_cost_per_million_tokens, 0),
+		       COALESCE(audio_cost_per_million_tokens, 0)
 		FROM model_pricing
 		WHERE model_name = $1 AND provider = $2 AND effective_until IS NULL
-	`, model, provider).Scan(&p.Model, &p.Provider, &p.InputCostPerMillionTokens, &p.OutputCostPerMillionTokens)
+	`, model, provider).Scan(&p.Model, &p.Provider, &p.InputCostPerMillionTokens, &p.OutputCostPerMillionTokens,
+		&p.ImageCostPerMillionTokens, &p.AudioCostPerMillionTokens)
 
 	if err != nil {
 		return nil, fmt.Errorf("pricing query failed: %w", err)
@@ -783,11 +2065,19 @@ func (l *Ledger) GetDB() *sql.DB {
 func (l *Ledger) Close() error {
 	l.log.Info().Msg("shutting down ledger")
 
-	// Stop accepting new writes
-	close(l.writeQueue)
+	// Stop background loops
+	close(l.done)
+
+	// Stop accepting new writes and wait for pending ones to complete
+	report := l.drainWriteQueues()
+	report.log(l.log)
+	report.export()
 
-	// Wait for all pending writes to complete
-	l.wg.Wait()
+	if l.wal != nil {
+		if err := l.wal.close(); err != nil {
+			l.log.Error().Err(err).Msg("write-ahead log close failed")
+		}
+	}
 
 	// Close connections
 	if err := l.redis.Close(); err != nil {
@@ -0,0 +1,339 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLedger builds a Ledger backed by an in-memory Redis.
+//
+// There is no PostgreSQL connection, so anything that reaches the database
+// must be avoided. Queued async writes simply accumulate in a single
+// write queue; no workers are started.
+func newTestLedger(t *testing.T) (*Ledger, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	l := &Ledger{
+		redis:       rdb,
+		log:         zerolog.Nop(),
+		writeQueues: []chan writeOp{make(chan writeOp, 100)},
+	}
+	require.NoError(t, l.loadLuaScripts())
+
+	return l, mr
+}
+
+func TestCheckAndReserveBalance_DuplicateVersusInsufficient(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	req := ReservationRequest{
+		CustomerID:      "cus_1",
+		RequestID:       "req_1",
+		ReservedGrains:  600,
+		EstimatedGrains: 500,
+	}
+
+	first, err := l.CheckAndReserveBalance(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, first.Approved)
+
+	before := testutil.ToFloat64(duplicateRequestsTotal)
+
+	// Same request ID again: a duplicate, even though balance would allow it.
+	req.ReservedGrains = 100
+	dup, err := l.CheckAndReserveBalance(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, dup.Approved)
+	assert.Equal(t, RejectionRequestExists, dup.RejectionReason)
+	assert.Equal(t, before+1, testutil.ToFloat64(duplicateRequestsTotal))
+
+	// New request ID that can't be covered: a genuine balance rejection.
+	insufficient, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:      "cus_1",
+		RequestID:       "req_2",
+		ReservedGrains:  600,
+		EstimatedGrains: 500,
+	})
+	require.NoError(t, err)
+	assert.False(t, insufficient.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, insufficient.RejectionReason)
+	assert.Equal(t, int64(400), insufficient.AvailableBalance)
+	assert.Equal(t, int64(200), insufficient.ShortfallGrains)
+	assert.Equal(t, int64(0), dup.ShortfallGrains)
+	assert.Equal(t, before+1, testutil.ToFloat64(duplicateRequestsTotal))
+
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "600", reserved)
+}
+
+func TestDeductGrains_LogSampling(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	l.log = zerolog.New(&buf).Level(zerolog.DebugLevel)
+	WithLogSampleRate(10)(l)
+
+	mr.Set("customer:balance:cus_1", "1000000")
+	mr.HSet("request:req_1", "status", "preflight_approved")
+
+	for i := 0; i < 100; i++ {
+		_, err := l.DeductGrains(ctx, DeductionRequest{
+			CustomerID:  "cus_1",
+			RequestID:   "req_1",
+			GrainAmount: 1,
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 10, strings.Count(buf.String(), "deduct_grains completed"))
+
+	// Warnings are never sampled away.
+	buf.Reset()
+	for i := 0; i < 5; i++ {
+		l.hotLog.Warn().Msg("unsampled warning")
+	}
+	assert.Equal(t, 5, strings.Count(buf.String(), "unsampled warning"))
+}
+
+func TestCheckAndReserveBalance_DryRun(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("customer:reserved:cus_1", "200")
+
+	approved, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_dry",
+		ReservedGrains: 500,
+		DryRun:         true,
+	})
+	require.NoError(t, err)
+	assert.True(t, approved.Approved)
+	assert.Equal(t, int64(300), approved.RemainingBalance)
+
+	rejected, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_dry",
+		ReservedGrains: 900,
+		DryRun:         true,
+	})
+	require.NoError(t, err)
+	assert.False(t, rejected.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, rejected.RejectionReason)
+
+	// Nothing was held or recorded.
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "200", reserved)
+	assert.False(t, mr.Exists("request:req_dry"))
+	assert.Empty(t, l.writeQueues[0])
+}
+
+func TestGetBalance_SyncedZeroVersusUnsynced(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	// A synced customer who has genuinely spent everything.
+	mr.Set("customer:balance:cus_zero", "0")
+
+	balance, _, available, found, err := l.GetBalance(ctx, "cus_zero")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(0), balance)
+	assert.Equal(t, int64(0), available)
+
+	// Never synced and no loader: not found, rather than a zero balance.
+	_, _, _, found, err = l.GetBalance(ctx, "cus_unsynced")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// With a loader, the customer is synced and read again.
+	var loaded []string
+	l.loadBalance = func(ctx context.Context, customerID string) error {
+		loaded = append(loaded, customerID)
+		mr.Set("customer:balance:"+customerID, "5000")
+		return nil
+	}
+
+	balance, _, _, found, err = l.GetBalance(ctx, "cus_unsynced")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(5000), balance)
+	assert.Equal(t, []string{"cus_unsynced"}, loaded)
+
+	// A zero balance is found, so it never triggers a sync.
+	_, _, _, found, err = l.GetBalance(ctx, "cus_zero")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"cus_unsynced"}, loaded)
+}
+
+func TestDeductGrains_ClientPricedBoundedByReservation(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+
+	// Provided cost within the reservation is deducted as-is.
+	res, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 250, ClientPriced: true})
+	require.NoError(t, err)
+	assert.True(t, res.Success)
+	assert.Equal(t, int64(750), res.RemainingBalance)
+
+	// Past the reservation it is refused and nothing is deducted.
+	res, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100, ClientPriced: true})
+	require.NoError(t, err)
+	assert.False(t, res.Success)
+	assert.Equal(t, DeductionCostExceedsReservation, res.ErrorCode)
+	assert.Equal(t, int64(750), res.RemainingBalance)
+	assert.Equal(t, "250", mr.HGet("request:req_1", "consumed_grains"))
+
+	// A server-priced cost is trusted, reservation or not.
+	res, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+	assert.True(t, res.Success)
+	assert.Equal(t, int64(650), res.RemainingBalance)
+}
+
+func TestDeductGrains_RejectedAfterFinalize(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	_, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 120,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+
+	// A deduction reordered behind the finalize.
+	res, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 50})
+	require.NoError(t, err)
+	assert.False(t, res.Success)
+	assert.Equal(t, DeductionRequestFinalized, res.ErrorCode)
+	assert.Equal(t, int64(880), res.RemainingBalance)
+
+	balance, _, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Equal(t, "100", mr.HGet("request:req_1", "consumed_grains"))
+	assert.Equal(t, "completed", mr.HGet("request:req_1", "status"))
+}
+
+func TestScripts_TimestampsFromRedisTime(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	// Far from this machine's clock, so a timestamp taken from it would show
+	redisNow := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mr.SetTime(redisNow)
+	mr.Set("customer:balance:cus_1", "1000")
+
+	for _, id := range []string{"req_1", "req_2"} {
+		_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: id, ReservedGrains: 300})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "1577934245", mr.HGet("request:req_1", "created_at"))
+
+	mr.SetTime(redisNow.Add(time.Minute))
+	_, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+	assert.Equal(t, "1577934305", mr.HGet("request:req_1", "last_deduction_at"))
+
+	mr.SetTime(redisNow.Add(2 * time.Minute))
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 100,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1577934365", mr.HGet("request:req_1", "finalized_at"))
+
+	_, err = l.abandonRequestScript.Run(ctx, l.redis,
+		[]string{"customer:reserved:cus_1", "request:req_2", totalReservedKey, "customer:reserved_low:cus_1", "customer:inflight:cus_1"}, 60,
+	).Result()
+	require.NoError(t, err)
+	assert.Equal(t, "1577934365", mr.HGet("request:req_2", "finalized_at"))
+}
+
+func TestFinalizeRequest_RetryAfterTimeoutIsNoop(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "timeout",
+		ActualCostGrains: 120,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	require.False(t, fin.AlreadyFinalized)
+	assert.Equal(t, "timeout", mr.HGet("request:req_1", "status"))
+	queued := len(l.writeQueues[0])
+
+	// The SDK retries the finalize; it must not settle the request again.
+	retry, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "timeout",
+		ActualCostGrains: 120,
+	})
+	require.NoError(t, err)
+	assert.True(t, retry.Success)
+	assert.True(t, retry.AlreadyFinalized)
+	assert.Equal(t, int64(0), retry.RefundedGrains)
+	assert.Len(t, l.writeQueues[0], queued)
+
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Equal(t, int64(0), reserved)
+}
@@ -0,0 +1,174 @@
+package ledger
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultListRequestsLimit is the page size ListRequests uses when the
+// filter doesn't set one.
+const DefaultListRequestsLimit = 10
+
+// ErrInvalidCursor is returned by ListRequests and ListCustomers for a
+// cursor they didn't issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// RequestFilter selects the requests ListRequests returns.
+type RequestFilter struct {
+	// CustomerID is required.
+	CustomerID string
+
+	// Status, if set, only matches requests with that status (e.g.
+	// "completed" or "killed").
+	Status string
+
+	// EndUserID, if set, only matches requests made for that end user (see
+	// ReservationRequest.EndUserID).
+	EndUserID string
+
+	// From and To bound created_at to [From, To). A zero time leaves that
+	// side open.
+	From time.Time
+	To   time.Time
+
+	// Cursor continues from a previous page's NextCursor. The other fields
+	// must be the same as for that page.
+	Cursor string
+
+	// Limit is the page size (DefaultListRequestsLimit if <= 0).
+	Limit int
+}
+
+// RequestRecord is a request as recorded in PostgreSQL.
+type RequestRecord struct {
+	RequestID       string     `json:"request_id"`
+	EndUserID       string     `json:"end_user_id,omitempty"`
+	Model           string     `json:"model"`
+	Status          string     `json:"status"`
+	EstimatedGrains int64      `json:"estimated_grains"`
+	ActualGrains    int64      `json:"actual_grains"`
+	CreatedAt       time.Time  `json:"created_at"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+}
+
+// RequestPage is one page of ListRequests results.
+type RequestPage struct {
+	Requests []RequestRecord `json:"requests"`
+
+	// NextCursor fetches the next page, or is empty on the last one.
+	NextCursor string `json:"next_cursor"`
+}
+
+// ListRequests returns a customer's requests, newest first.
+//
+// Pages use keyset pagination on (created_at, request_id), so a page costs
+// the same however deep into the history it is, and requests recorded while
+// paging don't shift later pages.
+func (l *Ledger) ListRequests(ctx context.Context, f RequestFilter) (*RequestPage, error) {
+	if f.CustomerID == "" {
+		return nil, fmt.Errorf("customer_id is required")
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultListRequestsLimit
+	}
+
+	conds := []string{"customer_id = $1"}
+	args := []interface{}{f.CustomerID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Status != "" {
+		conds = append(conds, "status = "+arg(f.Status))
+	}
+	if f.EndUserID != "" {
+		conds = append(conds, "end_user_id = "+arg(f.EndUserID))
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "created_at >= "+arg(f.From.UTC()))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "created_at < "+arg(f.To.UTC()))
+	}
+	if f.Cursor != "" {
+		createdAt, requestID, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, fmt.Sprintf("(created_at, request_id) < (%s, %s)", arg(createdAt), arg(requestID)))
+	}
+
+	// One extra row tells us whether there is a next page
+	query := `
+		SELECT request_id, COALESCE(end_user_id, ''), model, status,
+		       estimated_cost_grains, actual_cost_grains, created_at, completed_at
+		FROM requests
+		WHERE ` + strings.Join(conds, " AND ") + `
+		ORDER BY created_at DESC, request_id DESC
+		LIMIT ` + arg(limit+1)
+
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list requests query failed: %w", err)
+	}
+	defer rows.Close()
+
+	page := &RequestPage{Requests: []RequestRecord{}}
+	for rows.Next() {
+		var r RequestRecord
+		var actual *int64
+		if err := rows.Scan(&r.RequestID, &r.EndUserID, &r.Model, &r.Status, &r.EstimatedGrains, &actual,
+			&r.CreatedAt, &r.CompletedAt); err != nil {
+			return nil, fmt.Errorf("list requests scan failed: %w", err)
+		}
+		if actual != nil {
+			r.ActualGrains = *actual
+		}
+		page.Requests = append(page.Requests, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list requests query failed: %w", err)
+	}
+
+	if len(page.Requests) > limit {
+		page.Requests = page.Requests[:limit]
+		last := page.Requests[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.RequestID)
+	}
+
+	return page, nil
+}
+
+// encodeCursor makes the opaque cursor for the page after the row created
+// at createdAt with the given id, for lists ordered by (created_at, id).
+func encodeCursor(createdAt time.Time, id string) string {
+	raw := createdAt.UTC().Format(time.RFC3339Nano) + "|" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor reverses encodeCursor.
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	return createdAt, id, nil
+}
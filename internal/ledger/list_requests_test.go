@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var listRequestsCols = []string{
+	"request_id", "end_user_id", "model", "status", "estimated_cost_grains", "actual_cost_grains",
+	"created_at", "completed_at",
+}
+
+func TestListRequests_StatusAndTimeFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	from := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	created := from.Add(10 * time.Minute)
+
+	mock.ExpectQuery(`WHERE customer_id = \$1 AND status = \$2 AND created_at >= \$3 AND created_at < \$4\s+ORDER BY created_at DESC, request_id DESC\s+LIMIT \$5`).
+		WithArgs("cus_1", "killed", from, to, 11).
+		WillReturnRows(sqlmock.NewRows(listRequestsCols).
+			AddRow("req_1", "", "gpt-4", "killed", 500, nil, created, created.Add(time.Second)))
+
+	page, err := l.ListRequests(context.Background(), RequestFilter{
+		CustomerID: "cus_1",
+		Status:     "killed",
+		From:       from,
+		To:         to,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, page.Requests, 1)
+	assert.Equal(t, "req_1", page.Requests[0].RequestID)
+	assert.Equal(t, int64(0), page.Requests[0].ActualGrains)
+	require.NotNil(t, page.Requests[0].CompletedAt)
+	assert.Empty(t, page.NextCursor)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListRequests_CursorRoundTrip(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 123456000, time.UTC)
+
+	// Page 1: three rows for a limit of two means there is a next page.
+	mock.ExpectQuery(`WHERE customer_id = \$1\s+ORDER BY`).
+		WithArgs("cus_1", 3).
+		WillReturnRows(sqlmock.NewRows(listRequestsCols).
+			AddRow("req_c", "", "gpt-4", "completed", 100, 90, t0, nil).
+			AddRow("req_b", "", "gpt-4", "completed", 100, 95, t0.Add(-time.Second), nil).
+			AddRow("req_a", "", "gpt-4", "completed", 100, 80, t0.Add(-2*time.Second), nil))
+
+	page, err := l.ListRequests(context.Background(), RequestFilter{CustomerID: "cus_1", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Requests, 2)
+	assert.Equal(t, "req_b", page.Requests[1].RequestID)
+	require.NotEmpty(t, page.NextCursor)
+
+	// Page 2 resumes strictly after the last request of page 1.
+	mock.ExpectQuery(`\(created_at, request_id\) < \(\$2, \$3\)`).
+		WithArgs("cus_1", t0.Add(-time.Second), "req_b", 3).
+		WillReturnRows(sqlmock.NewRows(listRequestsCols).
+			AddRow("req_a", "", "gpt-4", "completed", 100, 80, t0.Add(-2*time.Second), nil))
+
+	page, err = l.ListRequests(context.Background(), RequestFilter{
+		CustomerID: "cus_1",
+		Limit:      2,
+		Cursor:     page.NextCursor,
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Requests, 1)
+	assert.Equal(t, "req_a", page.Requests[0].RequestID)
+	assert.Empty(t, page.NextCursor)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListRequests_InvalidCursor(t *testing.T) {
+	l := &Ledger{log: zerolog.Nop()}
+
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	for _, cursor := range []string{"not base64!", raw("no-separator"), raw("yesterday|req_1")} {
+		_, err := l.ListRequests(context.Background(), RequestFilter{CustomerID: "cus_1", Cursor: cursor})
+		assert.ErrorIs(t, err, ErrInvalidCursor, cursor)
+	}
+}
@@ -0,0 +1,104 @@
+package ledger
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics for ledger operations.
+//
+// These are registered with the default registry so they are served by the
+// /metrics endpoint without any extra wiring.
+var (
+	// duplicateRequestsTotal counts reservations rejected with REQUEST_EXISTS.
+	// A steady trickle is normal (SDK retries); a spike usually means a client
+	// is generating colliding request IDs.
+	duplicateRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consonant_duplicate_requests_total",
+		Help: "Total number of reservations rejected because the request ID already exists.",
+	})
+
+	// reservationPreemptionsTotal counts high-priority reservations approved
+	// by reserving against low-priority ones (see WithPriorityPreemption).
+	reservationPreemptionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consonant_reservation_preemptions_total",
+		Help: "Total number of high-priority reservations that preempted low-priority ones.",
+	})
+
+	// killSignalsPublishedTotal counts kill signals published, by reason
+	// (see KillSignal).
+	killSignalsPublishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consonant_kill_signals_published_total",
+		Help: "Total number of out-of-band kill signals published.",
+	}, []string{"reason"})
+
+	// killSignalWatchers is the number of open WatchKillSignals
+	// subscriptions. It should return to its baseline as clients disconnect.
+	killSignalWatchers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_kill_signal_watchers",
+		Help: "Kill signal subscriptions currently open.",
+	})
+
+	// balanceMismatchesTotal counts customers found by ReconcileAll whose
+	// balance does not equal the sum of their transactions.
+	balanceMismatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consonant_balance_mismatches_total",
+		Help: "Total number of customer balances found not to match their transaction sum.",
+	})
+
+	// providerSpendGrainsTotal is finalized spend in USD grains, by provider
+	// and model (see recordProviderSpend for how labels are bounded).
+	providerSpendGrainsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consonant_provider_spend_grains_total",
+		Help: "Total finalized AI spend in USD grains, by provider and model.",
+	}, []string{"provider", "model"})
+
+	// pgStatementTimeoutsTotal counts async writes PostgreSQL cancelled for
+	// exceeding statement_timeout, by op type. These are usually lock waits;
+	// the write is retried like any other failure.
+	pgStatementTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consonant_pg_statement_timeouts_total",
+		Help: "Total number of async PostgreSQL writes cancelled by statement_timeout.",
+	}, []string{"op_type"})
+
+	// totalReservedGrains and totalBalanceGrains mirror the system-wide
+	// aggregates maintained by the Lua scripts (see totals.go).
+	totalReservedGrains = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_total_reserved_grains",
+		Help: "Grains currently reserved by in-flight requests across all customers.",
+	})
+
+	totalBalanceGrains = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_total_balance_grains",
+		Help: "Sum of all customer balances in grains.",
+	})
+
+	// pricingCacheLoaded is 1 once the pricing cache has been loaded (see
+	// Ledger.Ready); until then every price lookup queries PostgreSQL.
+	pricingCacheLoaded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_pricing_cache_loaded",
+		Help: "1 if the model pricing cache is loaded, 0 while prices are looked up in PostgreSQL.",
+	})
+
+	// Shutdown report (see ShutdownReport). Set once, as Close drains the
+	// async write queues.
+	shutdownQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_shutdown_queue_depth",
+		Help: "Async writes still queued when shutdown began.",
+	})
+
+	shutdownDrainedWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_shutdown_drained_writes",
+		Help: "Async writes completed while draining at shutdown.",
+	})
+
+	shutdownDeadLetteredWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_shutdown_dead_lettered_writes",
+		Help: "Async writes that exhausted their retries while draining at shutdown.",
+	})
+
+	shutdownDrainSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consonant_shutdown_drain_seconds",
+		Help: "Time spent draining the async write queues at shutdown.",
+	})
+)
@@ -0,0 +1,26 @@
+package ledger
+
+// WithMinimumViableBalance refuses every reservation of a prepaid customer
+// whose available balance is below grains, with RejectionBalanceTooLow,
+// however small the reservation. A balance that can't fund even a minimal
+// request would otherwise pass the check for a tiny estimate and hit the
+// kill switch as soon as the stream starts.
+//
+// This is the default for customers without their own
+// (CustomerConfig.MinimumViableBalanceGrains). Zero, the default, means no
+// minimum. Postpaid customers spend credit, not a balance, and are exempt.
+func WithMinimumViableBalance(grains int64) Option {
+	return func(l *Ledger) {
+		l.minimumViableBalance = grains
+	}
+}
+
+// balanceTooLowShortfall returns how many grains a customer refused with
+// RejectionBalanceTooLow must add for reserved to be approved: enough to
+// reach the minimum, or to cover the reservation if that is more.
+func balanceTooLowShortfall(reserved, available, minimum int64) int64 {
+	if reserved > minimum {
+		return reserved - available
+	}
+	return minimum - available
+}
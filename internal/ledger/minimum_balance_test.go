@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinimumViableBalance(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.minimumViableBalance = 500
+	ctx := context.Background()
+
+	reserve := func(customerID, requestID string) *ReservationResult {
+		t.Helper()
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: customerID, RequestID: requestID, ReservedGrains: 10})
+		require.NoError(t, err)
+		return res
+	}
+
+	// Just above the minimum: a tiny reservation goes through
+	mr.Set("customer:balance:cus_above", "501")
+	assert.True(t, reserve("cus_above", "req_1").Approved)
+
+	// Just below: refused, although 499 would cover it
+	mr.Set("customer:balance:cus_below", "499")
+	res := reserve("cus_below", "req_2")
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionBalanceTooLow, res.RejectionReason)
+	assert.Equal(t, int64(1), res.ShortfallGrains)
+	assert.False(t, mr.Exists("request:req_2"), "a rejected request reserves nothing")
+
+	// Reservations count against it: 501 - 10 reserved is below 500
+	assert.Equal(t, RejectionBalanceTooLow, reserve("cus_above", "req_3").RejectionReason)
+
+	// Exactly the minimum is enough
+	mr.Set("customer:balance:cus_exact", "500")
+	assert.True(t, reserve("cus_exact", "req_4").Approved)
+}
+
+func TestMinimumViableBalance_CustomerOverride(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.minimumViableBalance = 500
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "200")
+	mr.HSet("customer:config:cus_1", "minimum_viable_balance_grains", "100")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 10})
+	require.NoError(t, err)
+	assert.True(t, res.Approved, "the customer's own minimum replaces the default")
+
+	mr.HSet("customer:config:cus_1", "minimum_viable_balance_grains", "1000")
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 10})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionBalanceTooLow, res.RejectionReason)
+	assert.Equal(t, int64(1000-190), res.ShortfallGrains)
+
+	cfg, err := l.GetCustomerConfig(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), cfg.MinimumViableBalanceGrains)
+}
+
+func TestMinimumViableBalance_PostpaidExempt(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.minimumViableBalance = 500
+	ctx := context.Background()
+
+	mr.HSet("customer:config:cus_1", "billing_mode", BillingPostpaid, "credit_ceiling_grains", "100")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 10})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+}
+
+func TestMinimumViableBalance_Batch(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.minimumViableBalance = 500
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "499")
+
+	res, err := l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", ReservedGrains: 10},
+		{CustomerID: "cus_1", ReservedGrains: 10},
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionBalanceTooLow, res.RejectionReason)
+	assert.Equal(t, int64(1), res.ShortfallGrains)
+
+	mr.Set("customer:balance:cus_1", "520")
+	res, err = l.BatchReserve(ctx, []ReservationRequest{
+		{CustomerID: "cus_1", ReservedGrains: 10},
+		{CustomerID: "cus_1", ReservedGrains: 10},
+	})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+}
+
+func TestBalanceTooLowShortfall(t *testing.T) {
+	assert.Equal(t, int64(300), balanceTooLowShortfall(10, 200, 500))
+	assert.Equal(t, int64(800), balanceTooLowShortfall(1000, 200, 500), "the reservation needs more than the minimum")
+}
@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"fmt"
+	"math"
+)
+
+// ModalityTokens breaks a token count down by modality. Tokens counted as
+// neither image nor audio are text.
+type ModalityTokens struct {
+	ImageTokens int64
+	AudioTokens int64
+}
+
+// Validate checks that the breakdown fits in a count of tokens.
+func (m ModalityTokens) Validate(tokens int64) error {
+	if m.ImageTokens < 0 || m.AudioTokens < 0 {
+		return fmt.Errorf("modality token counts cannot be negative")
+	}
+	if m.ImageTokens+m.AudioTokens > tokens {
+		return fmt.Errorf("%d image and %d audio tokens are more than the %d tokens counted",
+			m.ImageTokens, m.AudioTokens, tokens)
+	}
+	return nil
+}
+
+// Cost returns the grain cost of tokens input tokens, or output tokens if
+// completion, of which m are image and audio tokens. Each modality is
+// priced at its own rate, falling back to the text rate for the direction
+// when the model has none; the total is rounded down once, so without a
+// breakdown it is what tokens cost at the text rate.
+func (p PricingInfo) Cost(tokens int64, m ModalityTokens, completion bool) int64 {
+	textRate := p.InputCostPerMillionTokens
+	if completion {
+		textRate = p.OutputCostPerMillionTokens
+	}
+	imageRate, audioRate := textRate, textRate
+	if p.ImageCostPerMillionTokens > 0 {
+		imageRate = p.ImageCostPerMillionTokens
+	}
+	if p.AudioCostPerMillionTokens > 0 {
+		audioRate = p.AudioCostPerMillionTokens
+	}
+
+	text := tokens - m.ImageTokens - m.AudioTokens
+	return (text*textRate + m.ImageTokens*imageRate + m.AudioTokens*audioRate) / 1_000_000
+}
+
+// scaled returns p with every rate multiplied by f (a currency rate or cost
+// multiplier), rounded to the nearest grain.
+func (p PricingInfo) scaled(f float64) PricingInfo {
+	scale := func(rate int64) int64 { return int64(math.Round(float64(rate) * f)) }
+
+	p.InputCostPerMillionTokens = scale(p.InputCostPerMillionTokens)
+	p.OutputCostPerMillionTokens = scale(p.OutputCostPerMillionTokens)
+	p.ImageCostPerMillionTokens = scale(p.ImageCostPerMillionTokens)
+	p.AudioCostPerMillionTokens = scale(p.AudioCostPerMillionTokens)
+	return p
+}
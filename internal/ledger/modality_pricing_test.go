@@ -0,0 +1,63 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPricingInfo_Cost_MixedTextAndImage(t *testing.T) {
+	// $10/$30 per million text tokens, $5 per million image tokens
+	p := PricingInfo{
+		InputCostPerMillionTokens:  10_000_000,
+		OutputCostPerMillionTokens: 30_000_000,
+		ImageCostPerMillionTokens:  5_000_000,
+	}
+
+	// 1,000 text and 4,000 image tokens in the prompt
+	cost := p.Cost(5000, ModalityTokens{ImageTokens: 4000}, false)
+	assert.Equal(t, int64(1000*10+4000*5), cost)
+
+	// No breakdown: all text
+	assert.Equal(t, int64(5000*10), p.Cost(5000, ModalityTokens{}, false))
+	assert.Equal(t, int64(5000*30), p.Cost(5000, ModalityTokens{}, true))
+}
+
+func TestPricingInfo_Cost_FallsBackToTextRates(t *testing.T) {
+	p := PricingInfo{InputCostPerMillionTokens: 10_000_000, OutputCostPerMillionTokens: 30_000_000}
+	m := ModalityTokens{ImageTokens: 2000, AudioTokens: 1000}
+
+	assert.Equal(t, p.Cost(5000, ModalityTokens{}, false), p.Cost(5000, m, false))
+	assert.Equal(t, p.Cost(5000, ModalityTokens{}, true), p.Cost(5000, m, true))
+}
+
+func TestPricingInfo_Cost_RoundsOnce(t *testing.T) {
+	p := PricingInfo{InputCostPerMillionTokens: 1_500_000, AudioCostPerMillionTokens: 2_500_000}
+
+	// 1 text token at 1.5 grains and 1 audio token at 2.5 grains is 4
+	// grains, not 1 + 2
+	assert.Equal(t, int64(4), p.Cost(2, ModalityTokens{AudioTokens: 1}, false))
+}
+
+func TestModalityTokens_Validate(t *testing.T) {
+	assert.NoError(t, ModalityTokens{}.Validate(0))
+	assert.NoError(t, ModalityTokens{ImageTokens: 600, AudioTokens: 400}.Validate(1000))
+	assert.Error(t, ModalityTokens{ImageTokens: 600, AudioTokens: 401}.Validate(1000))
+	assert.Error(t, ModalityTokens{ImageTokens: -1}.Validate(1000))
+}
+
+func TestPricingInfo_Scaled(t *testing.T) {
+	p := PricingInfo{
+		Model:                      "gpt-4o",
+		InputCostPerMillionTokens:  10_000_000,
+		OutputCostPerMillionTokens: 30_000_000,
+		ImageCostPerMillionTokens:  5_000_001,
+	}
+
+	scaled := p.scaled(1.5)
+	assert.Equal(t, "gpt-4o", scaled.Model)
+	assert.Equal(t, int64(15_000_000), scaled.InputCostPerMillionTokens)
+	assert.Equal(t, int64(45_000_000), scaled.OutputCostPerMillionTokens)
+	assert.Equal(t, int64(7_500_002), scaled.ImageCostPerMillionTokens)
+	assert.Zero(t, scaled.AudioCostPerMillionTokens, "absent rates stay absent")
+}
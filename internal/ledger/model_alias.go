@@ -0,0 +1,67 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ResolveModelAlias returns the canonical model_pricing model that model is
+// an alias of (the model_aliases table), or false if it isn't one.
+//
+// An exact alias wins over a prefix alias ("gpt-4-turbo-*"), and a longer
+// prefix over a shorter one. Aliases are only read from the cache, which is
+// loaded with the pricing cache (see ReloadPricing).
+func (l *Ledger) ResolveModelAlias(model string) (string, bool) {
+	if canonical, ok := l.modelAliases.Load(model); ok {
+		return canonical.(string), true
+	}
+
+	var canonical, longest string
+	l.modelAliases.Range(func(k, v interface{}) bool {
+		prefix, ok := strings.CutSuffix(k.(string), "*")
+		if ok && strings.HasPrefix(model, prefix) && len(prefix) >= len(longest) {
+			canonical, longest = v.(string), prefix
+		}
+		return true
+	})
+
+	return canonical, canonical != ""
+}
+
+// loadModelAliases replaces the model alias cache with the contents of
+// model_aliases.
+func (l *Ledger) loadModelAliases(ctx context.Context) error {
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT alias, canonical_model
+		FROM model_aliases
+	`)
+	if err != nil {
+		return fmt.Errorf("model alias query failed: %w", err)
+	}
+	defer rows.Close()
+
+	current := make(map[string]bool)
+	for rows.Next() {
+		var alias, canonical string
+		if err := rows.Scan(&alias, &canonical); err != nil {
+			return fmt.Errorf("model alias scan failed: %w", err)
+		}
+
+		l.modelAliases.Store(alias, canonical)
+		current[alias] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("model alias query failed: %w", err)
+	}
+
+	// Drop aliases that were deleted
+	l.modelAliases.Range(func(k, _ interface{}) bool {
+		if !current[k.(string)] {
+			l.modelAliases.Delete(k)
+		}
+		return true
+	})
+
+	return nil
+}
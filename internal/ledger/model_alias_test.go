@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var aliasCols = []string{"alias", "canonical_model"}
+
+// newAliasTestLedger loads gpt-4 and gpt-4-turbo pricing and the given
+// aliases, as a pricing reload would.
+func newAliasTestLedger(t *testing.T, aliases ...[2]string) (*Ledger, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	cols := []string{"model_name", "provider", "input_cost_per_million_tokens", "output_cost_per_million_tokens",
+		"image_cost_per_million_tokens", "audio_cost_per_million_tokens"}
+
+	rows := sqlmock.NewRows(aliasCols)
+	for _, a := range aliases {
+		rows.AddRow(a[0], a[1])
+	}
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("gpt-4", "openai", 30000000, 60000000, 0, 0).
+			AddRow("gpt-4-turbo", "openai", 10000000, 30000000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").WillReturnRows(sqlmock.NewRows(multiplierCols))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(rows)
+
+	require.NoError(t, l.ReloadPricing(context.Background()))
+
+	return l, mock
+}
+
+func TestGetModelPricing_ExactMatch(t *testing.T) {
+	l, mock := newAliasTestLedger(t, [2]string{"gpt-4-*", "gpt-4"})
+
+	// gpt-4-turbo has a price of its own, which wins over the prefix alias
+	pricing, err := l.GetModelPricing("gpt-4-turbo", "openai")
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4-turbo", pricing.Model)
+	assert.Equal(t, int64(10000000), pricing.InputCostPerMillionTokens)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetModelPricing_AliasMatch(t *testing.T) {
+	l, mock := newAliasTestLedger(t,
+		[2]string{"gpt-4-0613", "gpt-4"},
+		[2]string{"gpt-4-*", "gpt-4"},
+		[2]string{"gpt-4-turbo-*", "gpt-4-turbo"},
+	)
+
+	for _, tt := range []struct {
+		model     string
+		canonical string
+	}{
+		{model: "gpt-4-0613", canonical: "gpt-4"},
+		{model: "gpt-4-32k", canonical: "gpt-4"},
+		{model: "gpt-4-turbo-preview", canonical: "gpt-4-turbo"}, // longest prefix
+	} {
+		pricing, err := l.GetModelPricing(tt.model, "openai")
+		require.NoError(t, err, tt.model)
+		assert.Equal(t, tt.canonical, pricing.Model, tt.model)
+	}
+
+	pricing, err := l.GetModelPricing("gpt-4-0613", "openai")
+	require.NoError(t, err)
+	assert.Equal(t, int64(30000000), pricing.InputCostPerMillionTokens)
+	assert.Equal(t, int64(60000000), pricing.OutputCostPerMillionTokens)
+
+	// Resolved from the cache, without querying PostgreSQL
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetModelPricing_UnmatchedModel(t *testing.T) {
+	l, mock := newAliasTestLedger(t, [2]string{"gpt-4-*", "gpt-4"})
+
+	mock.ExpectQuery("FROM model_pricing").
+		WithArgs("llama-3-70b", "openai").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err := l.GetModelPricing("llama-3-70b", "openai")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	_, ok := l.ResolveModelAlias("gpt-3.5-turbo")
+	assert.False(t, ok)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
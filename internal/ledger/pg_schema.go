@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+// validSchema matches the schema names WithSchema accepts: unquoted
+// lowercase identifiers, so they never need quoting in search_path or DDL.
+var validSchema = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// WithSchema puts the ledger's tables in the PostgreSQL schema schema
+// rather than public, so several deployments can share one database. Every
+// session the ledger opens gets search_path "schema, public": queries stay
+// unqualified and resolve to schema's tables, while extensions installed
+// in public (uuid-ossp) still resolve.
+//
+// The schema must already exist and have been migrated (make db-migrate
+// PG_SCHEMA=...); NewLedger fails otherwise, rather than let PostgreSQL
+// skip the missing schema and fall through to public's tables.
+// Empty leaves the server's search_path alone.
+func WithSchema(schema string) Option {
+	return func(l *Ledger) {
+		l.schema = schema
+	}
+}
+
+// schemaDSN adds search_path for schema to a connection string, if schema
+// is set.
+func schemaDSN(dsn, schema string) (string, error) {
+	if schema == "" {
+		return dsn, nil
+	}
+	if !validSchema.MatchString(schema) {
+		return "", fmt.Errorf("invalid postgres schema %q: must be a lowercase identifier", schema)
+	}
+	return dsnWithSetting(dsn, "search_path", schema+",public")
+}
+
+// checkSchema returns an error if schema is set but doesn't exist.
+func checkSchema(ctx context.Context, db *sql.DB, schema string) error {
+	if schema == "" {
+		return nil
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = $1)
+	`, schema).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("postgres schema check failed: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("postgres schema %q does not exist, create and migrate it first", schema)
+	}
+	return nil
+}
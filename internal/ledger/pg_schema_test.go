@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaDSN(t *testing.T) {
+	tests := []struct {
+		name   string
+		dsn    string
+		schema string
+		want   string
+	}{
+		{
+			name:   "url",
+			dsn:    "postgres://u:p@localhost:5432/beam?sslmode=disable&statement_timeout=4000",
+			schema: "tenant_a",
+			want:   "postgres://u:p@localhost:5432/beam?search_path=tenant_a%2Cpublic&sslmode=disable&statement_timeout=4000",
+		},
+		{
+			name:   "key value",
+			dsn:    "host=localhost dbname=beam",
+			schema: "tenant_a",
+			want:   "host=localhost dbname=beam search_path=tenant_a,public",
+		},
+		{
+			name: "unset",
+			dsn:  "postgres://localhost/beam",
+			want: "postgres://localhost/beam",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := schemaDSN(tt.dsn, tt.schema)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// Anything that would need quoting, or could smuggle in more settings
+	for _, schema := range []string{"Tenant", "tenant a", "tenant;drop", "public,evil", "1tenant"} {
+		_, err := schemaDSN("postgres://localhost/beam", schema)
+		assert.ErrorContains(t, err, "invalid postgres schema", schema)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	// No schema configured: nothing to check
+	require.NoError(t, checkSchema(ctx, db, ""))
+
+	mock.ExpectQuery(`FROM pg_namespace WHERE nspname = \$1`).
+		WithArgs("tenant_a").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	require.NoError(t, checkSchema(ctx, db, "tenant_a"))
+
+	mock.ExpectQuery(`FROM pg_namespace`).
+		WithArgs("tenant_b").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	assert.ErrorContains(t, checkSchema(ctx, db, "tenant_b"), `schema "tenant_b" does not exist`)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestIntegration_SchemaIsolatesDeployments needs a real PostgreSQL server;
+// set TEST_POSTGRES_URL to run it.
+func TestIntegration_SchemaIsolatesDeployments(t *testing.T) {
+	postgresURL := os.Getenv("TEST_POSTGRES_URL")
+	if postgresURL == "" {
+		t.Skip("TEST_POSTGRES_URL not set")
+	}
+	ctx := context.Background()
+
+	admin, err := openPostgres(postgresURL, 0, "")
+	require.NoError(t, err)
+	defer admin.Close()
+	for _, schema := range []string{"beam_test_a", "beam_test_b"} {
+		_, err := admin.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema)
+		require.NoError(t, err)
+		_, err = admin.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+schema+`.customers (customer_id TEXT PRIMARY KEY)`)
+		require.NoError(t, err)
+		_, err = admin.ExecContext(ctx, `TRUNCATE `+schema+`.customers`)
+		require.NoError(t, err)
+	}
+	defer admin.ExecContext(ctx, `DROP SCHEMA beam_test_a, beam_test_b CASCADE`)
+
+	db, err := openPostgres(postgresURL, time.Second, "beam_test_a")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, checkSchema(ctx, db, "beam_test_a"))
+
+	// Unqualified statements land in the configured schema only
+	_, err = db.ExecContext(ctx, `INSERT INTO customers (customer_id) VALUES ('cus_1')`)
+	require.NoError(t, err)
+
+	var current string
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&current))
+	assert.Equal(t, "beam_test_a", current)
+
+	var inA, inB int
+	require.NoError(t, admin.QueryRowContext(ctx, `SELECT COUNT(*) FROM beam_test_a.customers`).Scan(&inA))
+	require.NoError(t, admin.QueryRowContext(ctx, `SELECT COUNT(*) FROM beam_test_b.customers`).Scan(&inB))
+	assert.Equal(t, 1, inA)
+	assert.Equal(t, 0, inB)
+}
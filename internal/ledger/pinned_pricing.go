@@ -0,0 +1,51 @@
+package ledger
+
+import "strconv"
+
+// Request hash fields holding the prices pinned at reservation (see
+// ReservationRequest.Pricing), per million tokens.
+const (
+	pinnedInputPriceField  = "input_cost_per_million"
+	pinnedOutputPriceField = "output_cost_per_million"
+)
+
+// pinnedPricingArgs returns the check_and_reserve ARGV entries that pin p
+// on the request, or empty ones to pin nothing.
+func pinnedPricingArgs(p *PricingInfo) []interface{} {
+	if p == nil {
+		return []interface{}{"", ""}
+	}
+	return []interface{}{p.InputCostPerMillionTokens, p.OutputCostPerMillionTokens}
+}
+
+// pinnedPriceField returns the request hash field the deduct script should
+// price tokens from, or "" to deduct the given amount as is.
+func pinnedPriceField(priceFromPins, isCompletion bool) string {
+	switch {
+	case !priceFromPins:
+		return ""
+	case isCompletion:
+		return pinnedOutputPriceField
+	default:
+		return pinnedInputPriceField
+	}
+}
+
+// parsePinnedPricing decodes the pinned prices returned by the finalize
+// script. Either being empty means nothing was pinned.
+func parsePinnedPricing(input, output string) *PricingInfo {
+	if input == "" || output == "" {
+		return nil
+	}
+
+	in, err := strconv.ParseInt(input, 10, 64)
+	if err != nil {
+		return nil
+	}
+	out, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &PricingInfo{InputCostPerMillionTokens: in, OutputCostPerMillionTokens: out}
+}
@@ -0,0 +1,217 @@
+package ledger
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinnedPricing_RepricingMidRequestDoesNotAffectRequest(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	l.pricingCache.Store("gpt-4:openai", PricingInfo{
+		Model:                      "gpt-4",
+		Provider:                   "openai",
+		InputCostPerMillionTokens:  30_000_000,
+		OutputCostPerMillionTokens: 60_000_000,
+	})
+	mr.Set("customer:balance:cus_1", "1000000")
+
+	pricing, err := l.GetModelPricing("gpt-4", "openai")
+	require.NoError(t, err)
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 200_000,
+		Pricing:        pricing,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, "30000000", mr.HGet("request:req_1", "input_cost_per_million"))
+	assert.Equal(t, "60000000", mr.HGet("request:req_1", "output_cost_per_million"))
+
+	// Pricing doubles while the request is streaming.
+	l.pricingCache.Store("gpt-4:openai", PricingInfo{
+		Model:                      "gpt-4",
+		Provider:                   "openai",
+		InputCostPerMillionTokens:  60_000_000,
+		OutputCostPerMillionTokens: 120_000_000,
+	})
+
+	// 1000 completion tokens at the pinned 60M/1M = 60000 grains, whatever
+	// the caller computed from the new pricing.
+	ded, err := l.DeductGrains(ctx, DeductionRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		GrainAmount:    120_000,
+		TokensConsumed: 1000,
+		PriceFromPins:  true,
+		IsCompletion:   true,
+	})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+	assert.Equal(t, int64(60_000), ded.GrainsDeducted)
+
+	// 2000 prompt tokens at 30M/1M + 1000 completion tokens at 60M/1M.
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 240_000,
+		PromptTokens:     2000,
+		CompletionTokens: 1000,
+		PriceFromPins:    true,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(120_000), fin.ActualCostGrains)
+	assert.Equal(t, &PricingInfo{
+		InputCostPerMillionTokens:  30_000_000,
+		OutputCostPerMillionTokens: 60_000_000,
+	}, fin.PinnedPricing)
+	assert.Equal(t, "120000", mr.HGet("request:req_1", "actual_cost_grains"))
+
+	balance, _, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880_000), balance)
+}
+
+func TestPinnedPricing_CostWithoutTokenCountsIsChargedAsReported(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000000")
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 200_000,
+		Pricing:        &PricingInfo{InputCostPerMillionTokens: 30_000_000, OutputCostPerMillionTokens: 60_000_000},
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	// The caller knows the cost but not the tokens; pricing zero tokens at
+	// the pins would make the request free
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 75_000,
+		PriceFromPins:    true,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(75_000), fin.ActualCostGrains)
+	assert.Nil(t, fin.CostBreakdown)
+
+	balance, _, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(925_000), balance)
+}
+
+func TestPinnedPricing_UnpinnedRequestUsesGivenAmounts(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Empty(t, mr.HGet("request:req_1", "input_cost_per_million"))
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		GrainAmount:    50,
+		TokensConsumed: 1000,
+		PriceFromPins:  true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), ded.GrainsDeducted)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_1",
+		Status:           "completed",
+		ActualCostGrains: 80,
+		PromptTokens:     1000,
+		PriceFromPins:    true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(80), fin.ActualCostGrains)
+	assert.Nil(t, fin.PinnedPricing)
+	assert.Nil(t, fin.CostBreakdown)
+}
+
+func TestPinnedPricing_CostBreakdownSumsToActualCost(t *testing.T) {
+	tests := []struct {
+		name             string
+		pricing          PricingInfo
+		promptTokens     int32
+		completionTokens int32
+		wantInput        int64
+		wantOutput       int64
+	}{
+		{
+			name:             "gpt-4",
+			pricing:          PricingInfo{Model: "gpt-4", Provider: "openai", InputCostPerMillionTokens: 30_000_000, OutputCostPerMillionTokens: 60_000_000},
+			promptTokens:     2000,
+			completionTokens: 1000,
+			wantInput:        60_000,
+			wantOutput:       60_000,
+		},
+		{
+			// Fractional grains are floored per side, as when charging.
+			name:             "claude-3-haiku",
+			pricing:          PricingInfo{Model: "claude-3-haiku", Provider: "anthropic", InputCostPerMillionTokens: 250_000, OutputCostPerMillionTokens: 1_250_000},
+			promptTokens:     1234,
+			completionTokens: 567,
+			wantInput:        308,
+			wantOutput:       708,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, mr := newTestLedger(t)
+			ctx := context.Background()
+			mr.Set("customer:balance:cus_1", "1000000")
+
+			res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+				CustomerID:     "cus_1",
+				RequestID:      "req_1",
+				ReservedGrains: 200_000,
+				Pricing:        &tt.pricing,
+			})
+			require.NoError(t, err)
+			require.True(t, res.Approved)
+
+			fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+				CustomerID:       "cus_1",
+				RequestID:        "req_1",
+				Status:           "completed",
+				ActualCostGrains: 1,
+				PromptTokens:     tt.promptTokens,
+				CompletionTokens: tt.completionTokens,
+				PriceFromPins:    true,
+			})
+			require.NoError(t, err)
+			require.True(t, fin.Success)
+
+			require.NotNil(t, fin.CostBreakdown)
+			assert.Equal(t, tt.wantInput, fin.CostBreakdown.InputCostGrains)
+			assert.Equal(t, tt.wantOutput, fin.CostBreakdown.OutputCostGrains)
+			assert.Equal(t, fin.ActualCostGrains, fin.CostBreakdown.InputCostGrains+fin.CostBreakdown.OutputCostGrains)
+			assert.Equal(t, strconv.FormatInt(fin.ActualCostGrains, 10), mr.HGet("request:req_1", "actual_cost_grains"))
+		})
+	}
+}
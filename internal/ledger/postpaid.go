@@ -0,0 +1,86 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Billing modes (customers.billing_mode).
+//
+// Prepaid customers spend a balance they topped up in advance, and nothing
+// is approved that the balance can't cover. Postpaid customers are billed
+// afterwards: their usage accrues to a debt counter instead of coming out of
+// the balance, and reservations are approved as long as debt plus
+// reservations stays under a credit ceiling.
+const (
+	BillingPrepaid  = "prepaid"
+	BillingPostpaid = "postpaid"
+)
+
+// WithPostpaidCreditCeiling sets the credit ceiling for postpaid customers
+// who have none of their own (CustomerConfig.CreditCeilingGrains). A
+// postpaid customer with no ceiling at all can't reserve anything.
+func WithPostpaidCreditCeiling(grains int64) Option {
+	return func(l *Ledger) {
+		l.postpaidCreditCeiling = grains
+	}
+}
+
+// debtKey returns the Redis key of a postpaid customer's accrued debt; see
+// balanceKey.
+//
+// The check_and_reserve script pins the ceiling and the billing mode on the
+// request hash, so deductions and the finalization charge the debt counter
+// for a request reserved as postpaid even if the customer's mode changes
+// while it runs. Within those scripts a postpaid request's balance is the
+// credit left: ceiling - debt.
+func debtKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:debt:%s", customerID)
+	}
+	return fmt.Sprintf("customer:debt:%s:%s", customerID, currency)
+}
+
+// PostpaidDebt returns the grains a postpaid customer has accrued since
+// their debt was last settled.
+func (l *Ledger) PostpaidDebt(ctx context.Context, customerID string) (int64, error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	debt, err := l.redis.Get(ctx, debtKey(customerID, currency)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, redisError("get", err)
+	}
+	return debt, nil
+}
+
+// SettlePostpaidDebt takes invoiced grains off a postpaid customer's debt
+// and returns what is left. Usage accrued since the invoice was drawn up
+// stays on the counter for the next one.
+func (l *Ledger) SettlePostpaidDebt(ctx context.Context, customerID string, grains int64) (int64, error) {
+	if grains <= 0 {
+		return 0, fmt.Errorf("settled grains must be positive")
+	}
+
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	remaining, err := l.redis.DecrBy(ctx, debtKey(customerID, currency), grains).Result()
+	if err != nil {
+		return 0, redisError("decrby", err)
+	}
+
+	l.log.Info().
+		Str("customer_id", customerID).
+		Int64("settled_grains", grains).
+		Int64("remaining_debt", remaining).
+		Msg("postpaid debt settled")
+
+	return remaining, nil
+}
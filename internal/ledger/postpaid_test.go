@@ -0,0 +1,158 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAndReserveBalance_PostpaidApprovedUpToCeiling(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	// No balance at all, but a 1000 grain credit ceiling.
+	mr.HSet("customer:config:cus_1", "billing_mode", "postpaid")
+	mr.HSet("customer:config:cus_1", "credit_ceiling_grains", "1000")
+
+	cfg, err := l.GetCustomerConfig(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.True(t, cfg.Postpaid())
+	assert.Equal(t, int64(1000), cfg.CreditCeilingGrains)
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 600, EstimatedGrains: 500,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, int64(400), res.RemainingBalance)
+
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 400, EstimatedGrains: 300,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, int64(0), res.RemainingBalance)
+
+	// Reservations are at the ceiling: one more grain is refused.
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_3", ReservedGrains: 1, EstimatedGrains: 1,
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", res.RejectionReason)
+
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", reserved)
+	assert.False(t, mr.Exists("customer:balance:cus_1"))
+}
+
+func TestCheckAndReserveBalance_PostpaidDefaultCeiling(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.HSet("customer:config:cus_1", "billing_mode", "postpaid")
+
+	// Without a ceiling of their own or a server default, nothing is approved.
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100, EstimatedGrains: 100,
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+
+	WithPostpaidCreditCeiling(500)(l)
+
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100, EstimatedGrains: 100,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, int64(400), res.RemainingBalance)
+	assert.Equal(t, "500", mr.HGet("request:req_1", "credit_ceiling"))
+}
+
+func TestPostpaid_UsageAccruesDebt(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "0")
+	mr.HSet("customer:config:cus_1", "billing_mode", "postpaid")
+	mr.HSet("customer:config:cus_1", "credit_ceiling_grains", "1000")
+	mr.Set("customer:debt:cus_1", "300")
+
+	// 300 already owed leaves 700 of credit.
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 800, EstimatedGrains: 700,
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 600, EstimatedGrains: 500,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 250})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+	assert.Equal(t, int64(450), ded.RemainingBalance)
+
+	debt, err := l.PostpaidDebt(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(550), debt)
+
+	// Finalization charges the actual cost to the debt, not the balance.
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 320,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(-70), fin.RefundedGrains)
+	assert.Equal(t, int64(380), fin.FinalBalance)
+
+	debt, err = l.PostpaidDebt(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(620), debt)
+
+	balance, err := mr.Get("customer:balance:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "0", balance)
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "0", reserved)
+
+	// Settling an invoice frees the credit up again.
+	remaining, err := l.SettlePostpaidDebt(ctx, "cus_1", 620)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), remaining)
+}
+
+func TestCancelRequest_PostpaidKeepsDebtForUsage(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.HSet("customer:config:cus_1", "billing_mode", "postpaid")
+	mr.HSet("customer:config:cus_1", "credit_ceiling_grains", "1000")
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 200, EstimatedGrains: 200,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 80})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+
+	cancelled, err := l.CancelRequest(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.Equal(t, CancellationRequestInProgress, cancelled.ErrorCode)
+
+	debt, err := l.PostpaidDebt(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(80), debt)
+	assert.False(t, mr.Exists("customer:balance:cus_1"))
+}
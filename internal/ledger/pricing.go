@@ -0,0 +1,92 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxPricingRetryBackoff caps the delay between pricing load retries.
+const maxPricingRetryBackoff = time.Minute
+
+// PricingCacheLoaded reports whether the pricing cache has been fully loaded
+// from model_pricing. Until it has, every price lookup is a PostgreSQL query.
+func (l *Ledger) PricingCacheLoaded() bool {
+	return l.pricingLoaded.Load()
+}
+
+// pricingWarmer retries the pricing load that failed at startup, with
+// exponential backoff, until it succeeds or the ledger is closed.
+func (l *Ledger) pricingWarmer() {
+	defer l.wg.Done()
+
+	backoff := l.pricingRetryBackoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-l.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := l.loadPricingCache(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		l.log.Warn().Err(err).
+			Int("attempt", attempt).
+			Dur("backoff", backoff).
+			Msg("pricing cache load failed, retrying")
+
+		if backoff *= 2; backoff > maxPricingRetryBackoff {
+			backoff = maxPricingRetryBackoff
+		}
+	}
+}
+
+// ReloadPricing reloads the pricing cache from model_pricing, the cost
+// multipliers from cost_multipliers and the model aliases from
+// model_aliases.
+//
+// Prices are replaced in place, so lookups during the reload see either the
+// old or the new price, never none. Models whose pricing was retired
+// (effective_until set) are dropped from the cache.
+func (l *Ledger) ReloadPricing(ctx context.Context) error {
+	return l.loadPricingCache(ctx)
+}
+
+// PricingSnapshot returns every cached model price in USD grains, sorted by
+// model and provider, with an ETag that changes whenever any price does.
+//
+// The ETag is a quoted strong HTTP entity tag, so it can be sent as is.
+func (l *Ledger) PricingSnapshot() ([]PricingInfo, string) {
+	prices := []PricingInfo{}
+	l.pricingCache.Range(func(_, v interface{}) bool {
+		prices = append(prices, v.(PricingInfo))
+		return true
+	})
+
+	sort.Slice(prices, func(i, j int) bool {
+		if prices[i].Model != prices[j].Model {
+			return prices[i].Model < prices[j].Model
+		}
+		return prices[i].Provider < prices[j].Provider
+	})
+
+	h := sha256.New()
+	for _, p := range prices {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\x00%d\n", p.Model, p.Provider, p.InputCostPerMillionTokens, p.OutputCostPerMillionTokens,
+			p.ImageCostPerMillionTokens, p.AudioCostPerMillionTokens)
+	}
+
+	return prices, `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
@@ -0,0 +1,109 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPricingSnapshot_ReflectsReload(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	cols := []string{"model_name", "provider", "input_cost_per_million_tokens", "output_cost_per_million_tokens",
+		"image_cost_per_million_tokens", "audio_cost_per_million_tokens"}
+
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("gpt-4", "openai", 30000000, 60000000, 0, 0).
+			AddRow("claude-3-haiku", "anthropic", 250000, 1250000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").WillReturnRows(sqlmock.NewRows(multiplierCols))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(sqlmock.NewRows(aliasCols))
+
+	require.NoError(t, l.ReloadPricing(context.Background()))
+
+	prices, etag := l.PricingSnapshot()
+	assert.Equal(t, []PricingInfo{
+		{Model: "claude-3-haiku", Provider: "anthropic", InputCostPerMillionTokens: 250000, OutputCostPerMillionTokens: 1250000},
+		{Model: "gpt-4", Provider: "openai", InputCostPerMillionTokens: 30000000, OutputCostPerMillionTokens: 60000000},
+	}, prices)
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+	_, again := l.PricingSnapshot()
+	assert.Equal(t, etag, again, "unchanged pricing keeps its ETag")
+
+	// gpt-4 gets cheaper and claude-3-haiku is retired.
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("gpt-4", "openai", 10000000, 30000000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").WillReturnRows(sqlmock.NewRows(multiplierCols))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(sqlmock.NewRows(aliasCols))
+
+	require.NoError(t, l.ReloadPricing(context.Background()))
+
+	prices, reloaded := l.PricingSnapshot()
+	assert.Equal(t, []PricingInfo{
+		{Model: "gpt-4", Provider: "openai", InputCostPerMillionTokens: 10000000, OutputCostPerMillionTokens: 30000000},
+	}, prices)
+	assert.NotEqual(t, etag, reloaded)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPricingSnapshot_Empty(t *testing.T) {
+	l := &Ledger{log: zerolog.Nop()}
+
+	prices, etag := l.PricingSnapshot()
+	assert.NotNil(t, prices)
+	assert.Empty(t, prices)
+	assert.NotEmpty(t, etag)
+}
+
+func TestPricingWarmer_RetriesUntilLoaded(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop(), done: make(chan struct{}), pricingRetryBackoff: time.Millisecond}
+	cols := []string{"model_name", "provider", "input_cost_per_million_tokens", "output_cost_per_million_tokens",
+		"image_cost_per_million_tokens", "audio_cost_per_million_tokens"}
+
+	mock.ExpectQuery("FROM model_pricing").WillReturnError(errors.New("connection refused"))
+	mock.ExpectQuery("FROM model_pricing").WillReturnError(errors.New("connection refused"))
+	mock.ExpectQuery("FROM model_pricing").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow("gpt-4", "openai", 30000000, 60000000, 0, 0))
+	mock.ExpectQuery("FROM cost_multipliers").WillReturnRows(sqlmock.NewRows(multiplierCols))
+	mock.ExpectQuery("FROM model_aliases").WillReturnRows(sqlmock.NewRows(aliasCols))
+
+	assert.False(t, l.PricingCacheLoaded())
+
+	l.wg.Add(1)
+	go l.pricingWarmer()
+	l.wg.Wait()
+
+	assert.True(t, l.PricingCacheLoaded())
+	prices, _ := l.PricingSnapshot()
+	assert.Equal(t, []PricingInfo{
+		{Model: "gpt-4", Provider: "openai", InputCostPerMillionTokens: 30000000, OutputCostPerMillionTokens: 60000000},
+	}, prices)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPricingWarmer_StopsOnClose(t *testing.T) {
+	l := &Ledger{log: zerolog.Nop(), done: make(chan struct{}), pricingRetryBackoff: time.Hour}
+
+	l.wg.Add(1)
+	go l.pricingWarmer()
+	close(l.done)
+	l.wg.Wait()
+
+	assert.False(t, l.PricingCacheLoaded())
+}
@@ -0,0 +1,67 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Request priorities (see ReservationRequest.Priority).
+const (
+	// PriorityLow is for work that can wait, such as background batches.
+	// With preemption enabled its reservations don't hold grains against
+	// high-priority requests.
+	PriorityLow = "low"
+
+	// PriorityNormal is the default.
+	PriorityNormal = "normal"
+
+	// PriorityHigh is for interactive requests. With preemption enabled it
+	// may reserve grains held by low-priority requests.
+	PriorityHigh = "high"
+)
+
+// ErrUnknownPriority is returned for a priority other than the Priority*
+// constants.
+var ErrUnknownPriority = errors.New("unknown request priority")
+
+// validPriority reports whether p is one of the Priority* constants.
+func validPriority(p string) bool {
+	return p == PriorityLow || p == PriorityNormal || p == PriorityHigh
+}
+
+// WithPriorityPreemption lets a high-priority reservation that the balance
+// can't otherwise cover proceed by reserving against grains held by
+// low-priority in-flight requests. Those requests keep running, but are
+// the ones that run out of balance first. Off by default.
+func WithPriorityPreemption(enabled bool) Option {
+	return func(l *Ledger) {
+		l.priorityPreemption = enabled
+	}
+}
+
+// reservedLowKey returns the Redis counter of grains reserved by a
+// customer's low-priority requests, a subset of reservedKey.
+func reservedLowKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:reserved_low:%s", customerID)
+	}
+	return fmt.Sprintf("customer:reserved_low:%s:%s", customerID, currency)
+}
+
+// priorityFunctions returns the Lua helper (see scripts/lua/priority.lua)
+// that the scripts releasing a reservation are prepended with.
+//
+// release_low takes a released reservation off the low-priority counter if
+// the request was low priority. The counter is clamped at zero, like the
+// reserved counter it shadows.
+func priorityFunctions() string {
+	return `
+local function release_low(lkey, priority, amount)
+    if priority ~= '` + PriorityLow + `' or amount <= 0 then
+        return
+    end
+    local held = tonumber(redis.call('GET', lkey) or '0')
+    redis.call('DECRBY', lkey, math.min(math.max(held, 0), amount))
+end
+`
+}
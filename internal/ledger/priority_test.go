@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reserve(t *testing.T, l *Ledger, requestID, priority string, grains int64) *ReservationResult {
+	t.Helper()
+
+	res, err := l.CheckAndReserveBalance(context.Background(), ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      requestID,
+		ReservedGrains: grains,
+		Priority:       priority,
+	})
+	require.NoError(t, err)
+	return res
+}
+
+func TestPriority_RecordedOnRequest(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	mr.Set("customer:balance:cus_1", "1000")
+
+	require.True(t, reserve(t, l, "req_default", "", 100).Approved)
+	require.True(t, reserve(t, l, "req_low", PriorityLow, 200).Approved)
+	require.True(t, reserve(t, l, "req_high", PriorityHigh, 300).Approved)
+
+	assert.Equal(t, PriorityNormal, mr.HGet("request:req_default", "priority"))
+	assert.Equal(t, PriorityLow, mr.HGet("request:req_low", "priority"))
+	assert.Equal(t, PriorityHigh, mr.HGet("request:req_high", "priority"))
+
+	// Only low-priority reservations are counted separately, and releasing
+	// them takes them off the counter again.
+	got, _ := mr.Get("customer:reserved_low:cus_1")
+	assert.Equal(t, "200", got)
+
+	_, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_high", Status: "completed", ActualCostGrains: 50,
+	})
+	require.NoError(t, err)
+	got, _ = mr.Get("customer:reserved_low:cus_1")
+	assert.Equal(t, "200", got)
+
+	_, err = l.CancelRequest(ctx, "cus_1", "req_low")
+	require.NoError(t, err)
+	got, _ = mr.Get("customer:reserved_low:cus_1")
+	assert.Equal(t, "0", got)
+
+	_, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_bad", ReservedGrains: 10, Priority: "urgent",
+	})
+	assert.ErrorIs(t, err, ErrUnknownPriority)
+}
+
+func TestPriority_PreflightWriteRecordsPriority(t *testing.T) {
+	l, _ := newTestLedger(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mock.ExpectExec("INSERT INTO requests").
+		WithArgs("req_1", "cus_1", "", "", int64(80), int64(100), "preflight_approved", PriorityLow, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = l.writePreflightToDB(context.Background(), ReservationRequest{
+		CustomerID:      "cus_1",
+		RequestID:       "req_1",
+		EstimatedGrains: 80,
+		ReservedGrains:  100,
+		Priority:        PriorityLow,
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPriority_NoPreemptionByDefault(t *testing.T) {
+	l, mr := newTestLedger(t)
+	mr.Set("customer:balance:cus_1", "1000")
+
+	require.True(t, reserve(t, l, "req_batch", PriorityLow, 800).Approved)
+
+	res := reserve(t, l, "req_chat", PriorityHigh, 500)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+	assert.Equal(t, int64(300), res.ShortfallGrains)
+}
+
+func TestPriority_HighPreemptsLowWhenEnabled(t *testing.T) {
+	l, mr := newTestLedger(t)
+	l.priorityPreemption = true
+	ctx := context.Background()
+	mr.Set("customer:balance:cus_1", "1000")
+
+	require.True(t, reserve(t, l, "req_batch", PriorityLow, 600).Approved)
+	require.True(t, reserve(t, l, "req_normal", PriorityNormal, 200).Approved)
+
+	// Normal priority requests can't preempt.
+	res := reserve(t, l, "req_other", PriorityNormal, 500)
+	assert.False(t, res.Approved)
+
+	// 200 available plus the 600 held by the low-priority request.
+	res = reserve(t, l, "req_chat", PriorityHigh, 500)
+	require.True(t, res.Approved)
+	assert.Equal(t, int64(300), res.PreemptedGrains)
+	assert.Equal(t, int64(-300), res.AvailableBalance)
+	assert.Equal(t, "300", mr.HGet("request:req_chat", "preempted_grains"))
+
+	// Grains held by normal and high priority requests are never preempted.
+	res = reserve(t, l, "req_chat_2", PriorityHigh, 400)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+
+	res = reserve(t, l, "req_chat_3", PriorityHigh, 300)
+	require.True(t, res.Approved)
+	assert.Equal(t, int64(300), res.PreemptedGrains)
+
+	// The low-priority request is now the one that runs out first.
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_chat", GrainAmount: 500})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+	ded, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_chat_3", GrainAmount: 300})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+	ded, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_batch", GrainAmount: 600})
+	require.NoError(t, err)
+	assert.False(t, ded.Success)
+	assert.Equal(t, "INSUFFICIENT_BALANCE", ded.ErrorCode)
+}
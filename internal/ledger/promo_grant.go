@@ -0,0 +1,301 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// DefaultPromoGrantBatchSize is how many customers GrantPromo credits per
+// PostgreSQL transaction when it isn't given a batch size.
+const DefaultPromoGrantBatchSize = 500
+
+// PromoGrant contains parameters for GrantPromo.
+type PromoGrant struct {
+	// CampaignID identifies the campaign. A customer is granted at most
+	// once per campaign, however often it is run. Required.
+	CampaignID string
+
+	CustomerIDs []string
+
+	// AmountGrains is credited to each customer's BucketPromo, in their
+	// currency. Must be positive.
+	AmountGrains int64
+
+	// ExpiresAt is the campaign's stated expiry, recorded with each grant
+	// and in its transaction metadata. It is metadata only: nothing takes
+	// unspent promo grains back once it passes. Zero records none.
+	ExpiresAt time.Time
+
+	// Reason is recorded as the transaction description. Required.
+	Reason string
+
+	// Operator identifies who ran the campaign. Required; recorded in the
+	// transaction metadata.
+	Operator string
+}
+
+// PromoGrantReport summarises a GrantPromo run.
+type PromoGrantReport struct {
+	// Granted customers were credited by this run.
+	Granted int `json:"granted"`
+
+	// AlreadyGranted customers had been credited by an earlier run of the
+	// campaign and were skipped.
+	AlreadyGranted int `json:"already_granted"`
+
+	// NotFound lists customer IDs that don't exist in PostgreSQL.
+	NotFound []string `json:"not_found"`
+
+	// Failed lists customers whose batch couldn't be written to
+	// PostgreSQL; nothing was granted to them and the campaign can be
+	// rerun.
+	Failed []string `json:"failed"`
+
+	// NotInRedis counts granted customers whose balance wasn't in Redis,
+	// or couldn't be updated there; the next sync loads it from
+	// PostgreSQL, grant included.
+	NotInRedis int `json:"not_in_redis"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// promoGrantee is a customer being granted promo credit within a batch.
+type promoGrantee struct {
+	customerID string
+	currency   string
+}
+
+// GrantPromo credits AmountGrains of promotional credit to each of
+// grant.CustomerIDs.
+//
+// Customers are granted batchSize at a time, each batch in one PostgreSQL
+// transaction that, per customer, records the grant in promo_grants, credits
+// the balance and BucketPromo as AdjustBalance would, and appends a 'credit'
+// transaction referencing the campaign. Redis is then brought in line with a
+// single pipeline of the adjust_balance script.
+//
+// A failed batch is reported in Failed and the run goes on with the next
+// one. Since promo_grants remembers who was granted, rerunning the campaign
+// credits only the customers it missed.
+func (l *Ledger) GrantPromo(ctx context.Context, grant PromoGrant, batchSize int) (*PromoGrantReport, error) {
+	if grant.CampaignID == "" {
+		return nil, fmt.Errorf("campaign_id is required")
+	}
+	if grant.AmountGrains <= 0 {
+		return nil, fmt.Errorf("amount_grains must be positive")
+	}
+	if grant.Reason == "" || grant.Operator == "" {
+		return nil, fmt.Errorf("reason and operator are required")
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultPromoGrantBatchSize
+	}
+
+	start := time.Now()
+	report := &PromoGrantReport{NotFound: []string{}, Failed: []string{}}
+
+	for i := 0; i < len(grant.CustomerIDs); i += batchSize {
+		batch := grant.CustomerIDs[i:min(i+batchSize, len(grant.CustomerIDs))]
+
+		granted, err := l.grantPromoBatch(ctx, grant, batch, report)
+		if err != nil {
+			l.log.Error().Err(err).
+				Str("campaign_id", grant.CampaignID).
+				Int("batch_size", len(batch)).
+				Msg("promo grant batch failed")
+			report.Failed = append(report.Failed, batch...)
+			continue
+		}
+
+		report.Granted += len(granted)
+		report.NotInRedis += l.applyPromoToRedis(ctx, grant, granted)
+	}
+
+	report.Duration = time.Since(start)
+
+	l.log.Info().
+		Str("campaign_id", grant.CampaignID).
+		Str("operator", grant.Operator).
+		Int64("amount_grains", grant.AmountGrains).
+		Int("granted", report.Granted).
+		Int("already_granted", report.AlreadyGranted).
+		Int("not_found", len(report.NotFound)).
+		Int("failed", len(report.Failed)).
+		Dur("duration", report.Duration).
+		Msg("promo grant complete")
+
+	return report, nil
+}
+
+// grantPromoBatch writes one batch of grants to PostgreSQL, returning the
+// customers it credited. Customers that don't exist or were already granted
+// are added to report.
+func (l *Ledger) grantPromoBatch(ctx context.Context, grant PromoGrant, customerIDs []string, report *PromoGrantReport) ([]promoGrantee, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var expiresAt interface{}
+	meta := map[string]string{"operator": grant.Operator, "campaign_id": grant.CampaignID}
+	if !grant.ExpiresAt.IsZero() {
+		expiresAt = grant.ExpiresAt.UTC()
+		meta["expires_at"] = grant.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("encode metadata failed: %w", err)
+	}
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the customers first, so a concurrent run of the same campaign
+	// waits for this one and then sees its grants
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.customer_id, c.currency, g.customer_id IS NOT NULL
+		FROM customers c
+		LEFT JOIN promo_grants g ON g.campaign_id = $1 AND g.customer_id = c.customer_id
+		WHERE c.customer_id = ANY($2)
+		ORDER BY c.customer_id
+		FOR UPDATE OF c
+	`, grant.CampaignID, pq.Array(customerIDs))
+	if err != nil {
+		return nil, fmt.Errorf("query customers failed: %w", err)
+	}
+
+	found := make(map[string]bool, len(customerIDs))
+	var grantees []promoGrantee
+	var alreadyGranted int
+	for rows.Next() {
+		var g promoGrantee
+		var granted bool
+		if err := rows.Scan(&g.customerID, &g.currency, &granted); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan customer failed: %w", err)
+		}
+		found[g.customerID] = true
+		if granted {
+			alreadyGranted++
+			continue
+		}
+		grantees = append(grantees, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query customers failed: %w", err)
+	}
+
+	txns := make([]Transaction, 0, len(grantees))
+	for _, g := range grantees {
+		txID := uuid.New().String()
+
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO promo_grants (campaign_id, customer_id, transaction_id, amount_grains, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, grant.CampaignID, g.customerID, txID, grant.AmountGrains, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("record grant for %s failed: %w", g.customerID, err)
+		}
+
+		var newBalance int64
+		err = tx.QueryRowContext(ctx, `
+			UPDATE customers SET
+				current_balance_grains = current_balance_grains + $1,
+				updated_at = NOW()
+			WHERE customer_id = $2
+			RETURNING current_balance_grains
+		`, grant.AmountGrains, g.customerID).Scan(&newBalance)
+		if err != nil {
+			return nil, fmt.Errorf("update balance for %s failed: %w", g.customerID, err)
+		}
+
+		adj := AdjustmentRequest{CustomerID: g.customerID, DeltaGrains: grant.AmountGrains, Bucket: BucketPromo}
+		if err := adjustBucketInDB(ctx, tx, adj, newBalance-grant.AmountGrains); err != nil {
+			return nil, fmt.Errorf("update bucket for %s failed: %w", g.customerID, err)
+		}
+
+		txns = append(txns, Transaction{
+			TransactionID: txID,
+			CustomerID:    g.customerID,
+			AmountGrains:  grant.AmountGrains,
+			Type:          TransactionCredit,
+			ReferenceID:   grant.CampaignID,
+			Description:   grant.Reason,
+			Metadata:      metadata,
+		})
+	}
+
+	if len(txns) > 0 {
+		if err := insertTransactions(ctx, tx, txns); err != nil {
+			return nil, fmt.Errorf("insert transactions failed: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit failed: %w", err)
+	}
+
+	report.AlreadyGranted += alreadyGranted
+	for _, id := range customerIDs {
+		if !found[id] {
+			report.NotFound = append(report.NotFound, id)
+		}
+	}
+
+	return grantees, nil
+}
+
+// applyPromoToRedis credits a committed batch of grants in Redis with one
+// pipeline of the adjust_balance script, returning how many customers it
+// couldn't apply to. Those are left for the sync, which loads their
+// balance from PostgreSQL.
+func (l *Ledger) applyPromoToRedis(ctx context.Context, grant PromoGrant, grantees []promoGrantee) int {
+	if len(grantees) == 0 {
+		return 0
+	}
+
+	if err := l.adjustBalanceScript.Load(ctx, l.redis).Err(); err != nil {
+		l.log.Error().Err(err).
+			Str("campaign_id", grant.CampaignID).
+			Msg("failed to load adjust_balance script, redis will catch up on next sync")
+		return len(grantees)
+	}
+
+	pipe := l.redis.Pipeline()
+	cmds := make([]*redis.Cmd, len(grantees))
+	for i, g := range grantees {
+		keys := []string{
+			balanceKey(g.customerID, g.currency),
+			totalBalanceKey,
+			bucketsKey(g.customerID, g.currency),
+		}
+		cmds[i] = l.adjustBalanceScript.EvalSha(ctx, pipe, keys, grant.AmountGrains, BucketPromo, BucketPaid)
+	}
+	// Errors are handled per command below
+	_, _ = pipe.Exec(ctx)
+
+	missed := 0
+	for i, cmd := range cmds {
+		applied, err := cmd.Slice()
+		if err == nil && applied[0].(int64) == 1 {
+			continue
+		}
+		if err != nil {
+			l.log.Error().Err(err).
+				Str("campaign_id", grant.CampaignID).
+				Str("customer_id", grantees[i].customerID).
+				Msg("adjust_balance lua script failed, redis will catch up on next sync")
+		}
+		missed++
+	}
+
+	return missed
+}
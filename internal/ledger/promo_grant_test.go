@@ -0,0 +1,153 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var promoGranteeCols = []string{"customer_id", "currency", "granted"}
+
+// expectPromoCredit expects the writes that grant amount to a customer whose
+// balance was oldBalance.
+func expectPromoCredit(mock sqlmock.Sqlmock, customerID string, amount, oldBalance int64) {
+	mock.ExpectExec("INSERT INTO promo_grants").
+		WithArgs("spring-promo", customerID, sqlmock.AnyArg(), amount, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE customers SET").
+		WithArgs(amount, customerID).
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains"}).AddRow(oldBalance + amount))
+	mock.ExpectExec("INSERT INTO customer_balance_buckets").
+		WithArgs(customerID, BucketPaid, oldBalance).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO customer_balance_buckets").
+		WithArgs(customerID, BucketPromo, amount).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestGrantPromo(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_a", "1000")
+	mr.Set("customer:balance:cus_b:EUR", "200")
+	mr.Set(totalBalanceKey, "1200")
+
+	grant := PromoGrant{
+		CampaignID:   "spring-promo",
+		CustomerIDs:  []string{"cus_a", "cus_b", "cus_missing"},
+		AmountGrains: 5_000_000,
+		ExpiresAt:    time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC),
+		Reason:       "Spring promotion",
+		Operator:     "alice@example.com",
+	}
+	metadata := `{"campaign_id":"spring-promo","expires_at":"2026-12-31T00:00:00Z","operator":"alice@example.com"}`
+
+	// Two batches: cus_a and cus_b, then cus_missing
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM customers c").
+		WithArgs("spring-promo", "{\"cus_a\",\"cus_b\"}").
+		WillReturnRows(sqlmock.NewRows(promoGranteeCols).
+			AddRow("cus_a", "USD", false).
+			AddRow("cus_b", "EUR", false))
+	expectPromoCredit(mock, "cus_a", 5_000_000, 1000)
+	expectPromoCredit(mock, "cus_b", 5_000_000, 200)
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(
+			sqlmock.AnyArg(), "cus_a", int64(5_000_000), "credit", "spring-promo", "Spring promotion", metadata,
+			sqlmock.AnyArg(), "cus_b", int64(5_000_000), "credit", "spring-promo", "Spring promotion", metadata,
+		).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM customers c").
+		WithArgs("spring-promo", "{\"cus_missing\"}").
+		WillReturnRows(sqlmock.NewRows(promoGranteeCols))
+	mock.ExpectCommit()
+
+	report, err := l.GrantPromo(ctx, grant, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Granted)
+	assert.Zero(t, report.AlreadyGranted)
+	assert.Equal(t, []string{"cus_missing"}, report.NotFound)
+	assert.Empty(t, report.Failed)
+	assert.Zero(t, report.NotInRedis)
+
+	balance, err := mr.Get("customer:balance:cus_a")
+	require.NoError(t, err)
+	assert.Equal(t, "5001000", balance)
+	assert.Equal(t, "5000000", mr.HGet("customer:buckets:cus_a", BucketPromo))
+	assert.Equal(t, "1000", mr.HGet("customer:buckets:cus_a", BucketPaid))
+	balance, err = mr.Get("customer:balance:cus_b:EUR")
+	require.NoError(t, err)
+	assert.Equal(t, "5000200", balance)
+	total, err := mr.Get(totalBalanceKey)
+	require.NoError(t, err)
+	assert.Equal(t, "10001200", total)
+
+	// Rerunning the campaign grants nothing twice
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM customers c").
+		WithArgs("spring-promo", "{\"cus_a\",\"cus_b\",\"cus_missing\"}").
+		WillReturnRows(sqlmock.NewRows(promoGranteeCols).
+			AddRow("cus_a", "USD", true).
+			AddRow("cus_b", "EUR", true))
+	mock.ExpectCommit()
+
+	report, err = l.GrantPromo(ctx, grant, 0)
+	require.NoError(t, err)
+	assert.Zero(t, report.Granted)
+	assert.Equal(t, 2, report.AlreadyGranted)
+	assert.Equal(t, []string{"cus_missing"}, report.NotFound)
+
+	balance, err = mr.Get("customer:balance:cus_a")
+	require.NoError(t, err)
+	assert.Equal(t, "5001000", balance)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGrantPromo_FailedBatchIsReported(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_a", "1000")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM customers c").
+		WillReturnRows(sqlmock.NewRows(promoGranteeCols).AddRow("cus_a", "USD", false))
+	mock.ExpectExec("INSERT INTO promo_grants").WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+
+	report, err := l.GrantPromo(ctx, PromoGrant{
+		CampaignID:   "spring-promo",
+		CustomerIDs:  []string{"cus_a"},
+		AmountGrains: 5_000_000,
+		Reason:       "Spring promotion",
+		Operator:     "alice@example.com",
+	}, 0)
+	require.NoError(t, err)
+	assert.Zero(t, report.Granted)
+	assert.Equal(t, []string{"cus_a"}, report.Failed)
+
+	balance, err := mr.Get("customer:balance:cus_a")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", balance, "nothing is credited in redis for a failed batch")
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
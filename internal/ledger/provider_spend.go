@@ -0,0 +1,54 @@
+package ledger
+
+import "fmt"
+
+// otherLabel is the provider_spend label value for anything outside the
+// known set.
+const otherLabel = "other"
+
+// knownProviders are the providers given their own provider_spend series.
+var knownProviders = map[string]bool{
+	"openai":    true,
+	"anthropic": true,
+	"google":    true,
+}
+
+// recordProviderSpend adds a finalized request's cost to
+// consonant_provider_spend_grains_total.
+//
+// Spend is converted to USD grains so customers in different currencies add
+// up. To keep cardinality bounded, unknown providers are counted as "other",
+// as are models with no current price for their provider: model names come
+// from clients and would otherwise be unbounded. Aliases of a priced model
+// are counted under it.
+func (l *Ledger) recordProviderSpend(req FinalizationRequest) {
+	if req.ActualCostGrains <= 0 {
+		return
+	}
+
+	rate, err := l.GetCurrencyRate(req.Currency)
+	if err != nil || rate <= 0 {
+		l.log.Warn().Err(err).
+			Str("currency", req.Currency).
+			Str("request_id", req.RequestID).
+			Msg("provider spend not recorded, no currency rate")
+		return
+	}
+
+	provider, model := otherLabel, otherLabel
+	if knownProviders[req.Provider] {
+		provider = req.Provider
+		name := req.Model
+		if _, ok := l.pricingCache.Load(fmt.Sprintf("%s:%s", name, req.Provider)); !ok {
+			// Variants are counted under their canonical model
+			if canonical, ok := l.ResolveModelAlias(name); ok {
+				name = canonical
+			}
+		}
+		if _, ok := l.pricingCache.Load(fmt.Sprintf("%s:%s", name, req.Provider)); ok {
+			model = name
+		}
+	}
+
+	providerSpendGrainsTotal.WithLabelValues(provider, model).Add(float64(req.ActualCostGrains) / rate)
+}
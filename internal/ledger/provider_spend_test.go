@@ -0,0 +1,60 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinalizeRequest_RecordsProviderSpend(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	l.pricingCache.Store("gpt-4:openai", PricingInfo{Model: "gpt-4", Provider: "openai"})
+	l.pricingCache.Store("claude-3-haiku:anthropic", PricingInfo{Model: "claude-3-haiku", Provider: "anthropic"})
+
+	spend := func(provider, model string) float64 {
+		return testutil.ToFloat64(providerSpendGrainsTotal.WithLabelValues(provider, model))
+	}
+	openai, anthropic := spend("openai", "gpt-4"), spend("anthropic", "claude-3-haiku")
+	unpriced, other := spend("openai", otherLabel), spend(otherLabel, otherLabel)
+
+	mr.Set("customer:balance:cus_1", "100000")
+	finalize := func(requestID, provider, model string, cost int64) {
+		t.Helper()
+		_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+			CustomerID: "cus_1", RequestID: requestID, ReservedGrains: 10000, EstimatedGrains: 10000,
+		})
+		require.NoError(t, err)
+
+		res, err := l.FinalizeRequest(ctx, FinalizationRequest{
+			CustomerID: "cus_1", RequestID: requestID, Status: "completed",
+			ActualCostGrains: cost, Model: model, Provider: provider,
+		})
+		require.NoError(t, err)
+		require.True(t, res.Success)
+	}
+
+	finalize("req_1", "openai", "gpt-4", 6000)
+	finalize("req_2", "anthropic", "claude-3-haiku", 30)
+	finalize("req_3", "openai", "gpt-4", 400)
+	finalize("req_4", "openai", "gpt-9-preview", 70)
+	finalize("req_5", "mistral", "mistral-large", 5)
+
+	assert.Equal(t, openai+6400, spend("openai", "gpt-4"))
+	assert.Equal(t, anthropic+30, spend("anthropic", "claude-3-haiku"))
+	assert.Equal(t, unpriced+70, spend("openai", otherLabel))
+	assert.Equal(t, other+5, spend(otherLabel, otherLabel))
+
+	// A repeated finalize is not counted again.
+	res, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed",
+		ActualCostGrains: 6000, Model: "gpt-4", Provider: "openai",
+	})
+	require.NoError(t, err)
+	assert.True(t, res.AlreadyFinalized)
+	assert.Equal(t, openai+6400, spend("openai", "gpt-4"))
+}
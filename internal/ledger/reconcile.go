@@ -0,0 +1,169 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BalanceMismatch describes a customer whose PostgreSQL balance does not
+// equal the sum of their transactions.
+type BalanceMismatch struct {
+	CustomerID      string `json:"customer_id"`
+	PostgresBalance int64  `json:"postgres_balance"`
+	TransactionsSum int64  `json:"transactions_sum"`
+	Difference      int64  `json:"difference"`
+	Fixed           bool   `json:"fixed"`
+}
+
+// ReconciliationReport summarises a ReconcileAll run.
+type ReconciliationReport struct {
+	CustomersChecked int               `json:"customers_checked"`
+	Mismatches       []BalanceMismatch `json:"mismatches"`
+	Fixed            int               `json:"fixed"`
+	Duration         time.Duration     `json:"duration"`
+}
+
+// ReconcileAll runs verify_balance_integrity across every customer.
+//
+// Customers are paged with keyset pagination on customer_id (batchSize per
+// page) so the whole table can be checked without a large sort or holding
+// everything in memory.
+//
+// The transactions table is the append-only audit trail, so when fix is true
+// a mismatched customers.current_balance_grains is corrected to the
+// transaction sum. The updated_at trigger then lets the periodic sync push
+// the corrected balance to Redis.
+//
+// Every mismatch found increments consonant_balance_mismatches_total,
+// whether or not it was fixed. More mismatches than the safe mode threshold
+// (see WithSafeModeThreshold) put the ledger in safe mode.
+func (l *Ledger) ReconcileAll(ctx context.Context, batchSize int, fix bool) (*ReconciliationReport, error) {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	start := time.Now()
+	report := &ReconciliationReport{Mismatches: []BalanceMismatch{}}
+	cursor := ""
+
+	for {
+		mismatches, last, n, err := l.reconcileBatch(ctx, cursor, batchSize)
+		if err != nil {
+			return report, err
+		}
+
+		report.CustomersChecked += n
+
+		for _, m := range mismatches {
+			balanceMismatchesTotal.Inc()
+
+			l.log.Warn().
+				Str("customer_id", m.CustomerID).
+				Int64("postgres_balance", m.PostgresBalance).
+				Int64("transactions_sum", m.TransactionsSum).
+				Int64("difference", m.Difference).
+				Msg("balance does not match transaction sum")
+
+			if fix {
+				if err := l.fixBalance(ctx, m); err != nil {
+					l.log.Error().Err(err).Str("customer_id", m.CustomerID).Msg("failed to correct balance")
+				} else {
+					m.Fixed = true
+					report.Fixed++
+				}
+			}
+
+			report.Mismatches = append(report.Mismatches, m)
+		}
+
+		if n < batchSize {
+			break
+		}
+		cursor = last
+	}
+
+	report.Duration = time.Since(start)
+
+	l.log.Info().
+		Int("customers_checked", report.CustomersChecked).
+		Int("mismatches", len(report.Mismatches)).
+		Int("fixed", report.Fixed).
+		Dur("duration", report.Duration).
+		Msg("reconciliation complete")
+
+	// Fixed balances reach Redis only with the next sync, so every
+	// mismatch counts towards the safe mode threshold
+	if err := l.checkSafeModeThreshold(ctx, "reconciliation", len(report.Mismatches)); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// reconcileBatch checks one page of customers after cursor.
+// Returns the mismatches, the last customer ID seen, and the page size.
+func (l *Ledger) reconcileBatch(ctx context.Context, cursor string, batchSize int) ([]BalanceMismatch, string, int, error) {
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT v.customer_id, v.postgres_balance, v.transactions_sum, v.difference, v.is_valid
+		FROM (
+			SELECT customer_id
+			FROM customers
+			WHERE customer_id > $1
+			ORDER BY customer_id
+			LIMIT $2
+		) c
+		CROSS JOIN LATERAL verify_balance_integrity(c.customer_id) v
+		ORDER BY v.customer_id
+	`, cursor, batchSize)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("integrity query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var mismatches []BalanceMismatch
+	last := cursor
+	n := 0
+
+	for rows.Next() {
+		var m BalanceMismatch
+		var valid bool
+		if err := rows.Scan(&m.CustomerID, &m.PostgresBalance, &m.TransactionsSum, &m.Difference, &valid); err != nil {
+			return nil, "", 0, fmt.Errorf("integrity scan failed: %w", err)
+		}
+
+		last = m.CustomerID
+		n++
+
+		if !valid {
+			mismatches = append(mismatches, m)
+		}
+	}
+
+	return mismatches, last, n, rows.Err()
+}
+
+// fixBalance sets a customer's balance to their transaction sum.
+func (l *Ledger) fixBalance(ctx context.Context, m BalanceMismatch) error {
+	// Only apply the fix if the balance hasn't moved since we read it,
+	// otherwise we'd overwrite a concurrent legitimate change.
+	res, err := l.db.ExecContext(ctx, `
+		UPDATE customers SET current_balance_grains = $1
+		WHERE customer_id = $2 AND current_balance_grains = $3
+	`, m.TransactionsSum, m.CustomerID, m.PostgresBalance)
+	if err != nil {
+		return fmt.Errorf("balance update failed: %w", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("balance changed concurrently, skipping")
+	}
+
+	l.log.Info().
+		Str("customer_id", m.CustomerID).
+		Int64("old_balance", m.PostgresBalance).
+		Int64("new_balance", m.TransactionsSum).
+		Msg("balance corrected to transaction sum")
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileAll_DetectsAndFixesCorruptedBalance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	cols := []string{"customer_id", "postgres_balance", "transactions_sum", "difference", "is_valid"}
+
+	// Page 1: cus_b has been corrupted (+500 grains with no transaction).
+	mock.ExpectQuery("verify_balance_integrity").
+		WithArgs("", 2).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("cus_a", 1000, 1000, 0, true).
+			AddRow("cus_b", 1500, 1000, 500, false))
+
+	mock.ExpectExec("UPDATE customers SET current_balance_grains").
+		WithArgs(int64(1000), "cus_b", int64(1500)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Page 2: short page ends the scan.
+	mock.ExpectQuery("verify_balance_integrity").
+		WithArgs("cus_b", 2).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("cus_c", 0, 0, 0, true))
+
+	before := testutil.ToFloat64(balanceMismatchesTotal)
+
+	report, err := l.ReconcileAll(context.Background(), 2, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.CustomersChecked)
+	require.Len(t, report.Mismatches, 1)
+	assert.Equal(t, "cus_b", report.Mismatches[0].CustomerID)
+	assert.Equal(t, int64(500), report.Mismatches[0].Difference)
+	assert.True(t, report.Mismatches[0].Fixed)
+	assert.Equal(t, 1, report.Fixed)
+	assert.Equal(t, before+1, testutil.ToFloat64(balanceMismatchesTotal))
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,16 @@
+package ledger
+
+// Refund policies (customers.refund_policy) decide how much of an
+// overestimated request is given back at finalization, that is, how much of
+// what streaming deducted beyond the request's actual cost. What isn't
+// refunded is recorded as a TransactionRefundWithheld.
+//
+// The finalize script reads the policy from the customer's config hash when
+// the request is finalized, so a plan change applies to requests already in
+// flight. Postpaid customers get the overestimate taken off their debt
+// under the same policy.
+const (
+	RefundPolicyFull           = "full"
+	RefundPolicyNone           = "none"
+	RefundPolicyPartialPercent = "partial_percent"
+)
@@ -0,0 +1,148 @@
+package ledger
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// finalizeOverestimated streams 600 grains of a request whose actual cost
+// turns out to be 200, leaving 400 to refund, and finalizes it.
+func finalizeOverestimated(t *testing.T, l *Ledger) *FinalizationResult {
+	t.Helper()
+	ctx := context.Background()
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 600, EstimatedGrains: 600,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 600})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 200,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+
+	return fin
+}
+
+func TestFinalizeRequest_RefundPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   []string
+		refunded int64
+		withheld int64
+	}{
+		{name: "unset", refunded: 400},
+		{name: "full", config: []string{"refund_policy", RefundPolicyFull}, refunded: 400},
+		{name: "none", config: []string{"refund_policy", RefundPolicyNone}, withheld: 400},
+		{
+			name:     "partial_percent",
+			config:   []string{"refund_policy", RefundPolicyPartialPercent, "refund_percent", "25"},
+			refunded: 100,
+			withheld: 300,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, mr := newTestLedger(t)
+
+			mr.Set("customer:balance:cus_1", "1000")
+			mr.Set("system:total_balance", "1000")
+			if len(tt.config) > 0 {
+				mr.HSet("customer:config:cus_1", tt.config...)
+			}
+
+			fin := finalizeOverestimated(t, l)
+			assert.Equal(t, tt.refunded, fin.RefundedGrains)
+			assert.Equal(t, tt.withheld, fin.WithheldGrains)
+			assert.Equal(t, int64(200), fin.ActualCostGrains)
+
+			// The customer pays the actual cost plus whatever was withheld
+			want := 1000 - 200 - tt.withheld
+			assert.Equal(t, want, fin.FinalBalance)
+			balance, err := mr.Get("customer:balance:cus_1")
+			require.NoError(t, err)
+			assert.Equal(t, strconv.FormatInt(want, 10), balance)
+			total, err := mr.Get("system:total_balance")
+			require.NoError(t, err)
+			assert.Equal(t, balance, total)
+			assert.Equal(t, strconv.FormatInt(tt.withheld, 10), mr.HGet("request:req_1", "withheld_grains"))
+		})
+	}
+}
+
+func TestFinalizeRequest_RefundPolicyPostpaid(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.HSet("customer:config:cus_1",
+		"billing_mode", BillingPostpaid,
+		"credit_ceiling_grains", "1000",
+		"refund_policy", RefundPolicyNone,
+	)
+
+	fin := finalizeOverestimated(t, l)
+	assert.Zero(t, fin.RefundedGrains)
+	assert.Equal(t, int64(400), fin.WithheldGrains)
+
+	debt, err := mr.Get("customer:debt:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "600", debt, "the customer owes what was streamed")
+}
+
+func TestFinalizeRequest_RefundPolicyIgnoresUndercharge(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.HSet("customer:config:cus_1", "refund_policy", RefundPolicyNone)
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 600, EstimatedGrains: 600,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 200,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(-200), fin.RefundedGrains)
+	assert.Zero(t, fin.WithheldGrains)
+	assert.Equal(t, int64(800), fin.FinalBalance)
+}
+
+func TestWriteFinalizationToDB_RecordsWithheldRefund(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	req := FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Model: "gpt-4", Status: "completed",
+		PromptTokens: 100, CompletionTokens: 50, ActualCostGrains: 200,
+		withheldGrains: 300,
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE requests SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(append(usageArgs(req),
+			sqlmock.AnyArg(), "cus_1", int64(-300), "refund_withheld", "req_1",
+			"Refund withheld by refund policy: gpt-4", nil)...).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	require.NoError(t, l.writeFinalizationToDB(context.Background(), req))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,129 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ReleaseResult contains the outcome of ReleaseReservation.
+type ReleaseResult struct {
+	Success bool
+
+	// AlreadyTerminal is set when the request had already been finalized,
+	// abandoned or released; nothing was changed.
+	AlreadyTerminal bool
+
+	// ReleasedGrains is the reservation returned to available balance.
+	ReleasedGrains int64
+
+	// ConsumedGrains is what streaming had already deducted. It stays spent
+	// and is what the request is charged.
+	ConsumedGrains int64
+
+	ErrorCode string
+}
+
+// ReleaseReservation gives back an in-flight request's reservation without
+// finalizing it, e.g. when the provider call failed before producing any
+// tokens. The reserved counter drops by the request's stored reservation
+// and the request is marked 'released'.
+//
+// Unlike FinalizeRequest nothing is refunded or charged: the balance isn't
+// touched, and the request is recorded in PostgreSQL at what it streamed.
+// Unlike CancelRequest, it also works once grains have been deducted.
+//
+// Releasing a request that is no longer in flight is a no-op reported as
+// AlreadyTerminal; one that was never reserved, has expired or was
+// cancelled returns ErrorCode "REQUEST_NOT_FOUND".
+//
+// Performance: 1-3ms typical
+func (l *Ledger) ReleaseReservation(ctx context.Context, customerID, requestID string) (*ReleaseResult, error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{
+		reservedKey(customerID, currency),
+		fmt.Sprintf("request:%s", requestID),
+		totalReservedKey,
+		reservedLowKey(customerID, currency),
+		inflightKey(customerID),
+	}
+
+	result, err := l.releaseReservationScript.Run(ctx, l.redis, keys, int64(l.terminalRequestTTL("released").Seconds())).Result()
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("release_reservation lua script failed")
+		return nil, scriptError(err)
+	}
+
+	// Parse result: {success, released, consumed, code, metadata}
+	resultArray := result.([]interface{})
+	code, _ := resultArray[3].(string)
+
+	if resultArray[0].(int64) != 1 {
+		l.log.Warn().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Str("error_code", code).
+			Msg("release_reservation failed")
+		return &ReleaseResult{ErrorCode: code}, nil
+	}
+
+	if code == "ALREADY_TERMINAL" {
+		l.log.Info().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Msg("release_reservation ignored, request no longer in flight")
+		return &ReleaseResult{Success: true, AlreadyTerminal: true}, nil
+	}
+
+	res := &ReleaseResult{
+		Success:        true,
+		ReleasedGrains: resultArray[1].(int64),
+		ConsumedGrains: resultArray[2].(int64),
+	}
+
+	l.log.Info().
+		Str("customer_id", customerID).
+		Str("request_id", requestID).
+		Int64("released", res.ReleasedGrains).
+		Int64("consumed", res.ConsumedGrains).
+		Msg("release_reservation completed")
+
+	l.trace(requestID, traceStageRelease).
+		Str("customer_id", customerID).
+		Int64("released", res.ReleasedGrains).
+		Int64("consumed", res.ConsumedGrains).
+		Msg("request trace")
+
+	// The model is only needed for the transaction description
+	var metadata map[string]string
+	if raw, _ := resultArray[4].(string); raw != "" {
+		_ = json.Unmarshal([]byte(raw), &metadata)
+	}
+
+	// Write to PostgreSQL (queued unless sync writes are on)
+	err = l.persist(writeOp{
+		opType:     "finalization",
+		customerID: customerID,
+		data: FinalizationRequest{
+			CustomerID:       customerID,
+			RequestID:        requestID,
+			Status:           "released",
+			ActualCostGrains: res.ConsumedGrains,
+			Model:            metadata["model"],
+			Currency:         currency,
+		},
+		ctx: context.Background(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
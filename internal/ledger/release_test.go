@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseReservation(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set(totalBalanceKey, "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_1",
+		ReservedGrains: 300,
+		Metadata:       map[string]string{"model": "gpt-4"},
+		Priority:       PriorityLow,
+	})
+	require.NoError(t, err)
+	<-l.writeQueues[0] // preflight
+
+	res, err := l.ReleaseReservation(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.True(t, res.Success)
+	assert.Equal(t, int64(300), res.ReleasedGrains)
+	assert.Zero(t, res.ConsumedGrains)
+
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance, "the balance isn't touched")
+	assert.Zero(t, reserved)
+	_, totalReserved, err := l.GetTotals(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, totalReserved)
+	low, err := mr.Get("customer:reserved_low:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "0", low)
+
+	assert.Equal(t, "released", mr.HGet("request:req_1", "status"))
+	assert.Equal(t, DefaultTerminalRequestTTL, mr.TTL("request:req_1"))
+
+	require.Len(t, l.writeQueues[0], 1)
+	op := <-l.writeQueues[0]
+	fin := op.data.(FinalizationRequest)
+	assert.Equal(t, "released", fin.Status)
+	assert.Zero(t, fin.ActualCostGrains)
+	assert.Equal(t, "gpt-4", fin.Model)
+
+	// Releasing again, or finalizing afterwards, changes nothing
+	res, err = l.ReleaseReservation(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.True(t, res.AlreadyTerminal)
+
+	fin2, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 100,
+	})
+	require.NoError(t, err)
+	assert.True(t, fin2.AlreadyFinalized)
+
+	balance, reserved, _, _, err = l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance)
+	assert.Zero(t, reserved)
+
+	res, err = l.ReleaseReservation(ctx, "cus_1", "req_missing")
+	require.NoError(t, err)
+	assert.False(t, res.Success)
+	assert.Equal(t, "REQUEST_NOT_FOUND", res.ErrorCode)
+}
+
+func TestReleaseReservation_KeepsStreamedGrainsSpent(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+	_, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 120})
+	require.NoError(t, err)
+
+	res, err := l.ReleaseReservation(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(300), res.ReleasedGrains)
+	assert.Equal(t, int64(120), res.ConsumedGrains)
+
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Zero(t, reserved)
+}
+
+func TestReleaseReservation_Underflow(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+
+	// The counter lost part of the reservation (e.g. reset by a resync)
+	mr.Set("customer:reserved:cus_1", "100")
+	mr.Set(totalReservedKey, "100")
+
+	res, err := l.ReleaseReservation(ctx, "cus_1", "req_1")
+	require.NoError(t, err)
+	assert.True(t, res.Success)
+	assert.Equal(t, int64(100), res.ReleasedGrains)
+
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "0", reserved, "never below zero")
+	assert.Equal(t, "reservation_underflow", mr.HGet("request:req_1", "integrity_issue"))
+
+	// Nothing left in the counter at all
+	_, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 200})
+	require.NoError(t, err)
+	mr.Set("customer:reserved:cus_1", "-50")
+
+	res, err = l.ReleaseReservation(ctx, "cus_1", "req_2")
+	require.NoError(t, err)
+	assert.Zero(t, res.ReleasedGrains)
+	reserved, err = mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "-50", reserved, "a negative counter isn't pushed further")
+}
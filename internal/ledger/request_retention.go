@@ -0,0 +1,31 @@
+package ledger
+
+import "time"
+
+// DefaultTerminalRequestTTL is how long a request hash is kept in Redis
+// after it reaches a terminal status, unless WithTerminalRequestTTLs sets
+// one for that status.
+const DefaultTerminalRequestTTL = 24 * time.Hour
+
+// WithTerminalRequestTTLs sets how long a request hash is kept in Redis once
+// it is finalized ("completed", "killed", "failed"), released ("released",
+// see ReleaseReservation) or abandoned by the orphan sweeper ("abandoned"),
+// keyed by that status. Completed requests are the bulk of the traffic and
+// are in PostgreSQL by then, so they can go sooner; killed ones may be worth
+// keeping longer for disputes. Statuses not in ttls, or with a TTL <= 0,
+// keep DefaultTerminalRequestTTL.
+func WithTerminalRequestTTLs(ttls map[string]time.Duration) Option {
+	return func(l *Ledger) {
+		l.terminalRequestTTLs = ttls
+	}
+}
+
+// terminalRequestTTL returns how long to keep a request hash that reached
+// status. It is never under a second, as EXPIRE 0 would delete it at once.
+func (l *Ledger) terminalRequestTTL(status string) time.Duration {
+	ttl := l.terminalRequestTTLs[status]
+	if ttl <= 0 {
+		return DefaultTerminalRequestTTL
+	}
+	return max(ttl, time.Second)
+}
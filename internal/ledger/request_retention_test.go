@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinalizeRequest_TTLByStatus(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	WithTerminalRequestTTLs(map[string]time.Duration{
+		"completed": time.Hour,
+		"killed":    7 * 24 * time.Hour,
+	})(l)
+
+	mr.Set("customer:balance:cus_1", "10000")
+
+	for _, id := range []string{"req_completed", "req_killed", "req_failed", "req_batch"} {
+		_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: id, ReservedGrains: 100})
+		require.NoError(t, err)
+	}
+
+	for id, status := range map[string]string{
+		"req_completed": "completed",
+		"req_killed":    "killed",
+		"req_failed":    "failed",
+	} {
+		res, err := l.FinalizeRequest(ctx, FinalizationRequest{
+			CustomerID: "cus_1", RequestID: id, Status: status, ActualCostGrains: 50,
+		})
+		require.NoError(t, err)
+		require.True(t, res.Success)
+	}
+
+	assert.Equal(t, time.Hour, mr.TTL("request:req_completed"))
+	assert.Equal(t, 7*24*time.Hour, mr.TTL("request:req_killed"))
+	assert.Equal(t, DefaultTerminalRequestTTL, mr.TTL("request:req_failed"), "unconfigured status")
+
+	// Batched finalizations get the same TTLs
+	results, err := l.BatchFinalize(ctx, []FinalizationRequest{
+		{CustomerID: "cus_1", RequestID: "req_batch", Status: "killed", ActualCostGrains: 50},
+	})
+	require.NoError(t, err)
+	require.True(t, results["req_batch"].Success)
+	assert.Equal(t, 7*24*time.Hour, mr.TTL("request:req_batch"))
+}
+
+func TestTerminalRequestTTL(t *testing.T) {
+	l := &Ledger{}
+	assert.Equal(t, DefaultTerminalRequestTTL, l.terminalRequestTTL("completed"))
+
+	WithTerminalRequestTTLs(map[string]time.Duration{
+		"abandoned": 48 * time.Hour,
+		"completed": -time.Hour,
+		"killed":    time.Millisecond,
+	})(l)
+	assert.Equal(t, 48*time.Hour, l.terminalRequestTTL("abandoned"))
+	assert.Equal(t, DefaultTerminalRequestTTL, l.terminalRequestTTL("completed"))
+	assert.Equal(t, time.Second, l.terminalRequestTTL("killed"))
+}
@@ -0,0 +1,84 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// RequestSchemaVersion is the layout of the request hashes
+// ("request:{request_id}") written by this version of check_and_reserve,
+// recorded in each hash's schema_version field.
+//
+// Hashes without the field are version 1. Version 2 always records the
+// request's priority and billing mode, which version 1 left out for normal
+// priority and prepaid requests.
+//
+// During a rolling deploy old and new scripts run against the same Redis,
+// so a new version may only add fields: old scripts ignore fields they
+// don't know, and new scripts fill in what an older hash lacks when they
+// load it (see requestFunctions). UpgradeRequestHashes then rewrites
+// in-flight hashes to the current version.
+const RequestSchemaVersion = 2
+
+// requestFunctions returns the Lua helper the scripts that read a whole
+// request hash share: finalize_request, cancel_request, abandon_request and
+// upgrade_request. It is prepended to their source, like bucketFunctions.
+//
+// load_request returns the hash as a table, upgraded in memory to
+// RequestSchemaVersion, and the version it was stored at; nil if the
+// request doesn't exist.
+func requestFunctions() string {
+	return `
+local function load_request(rkey)
+    local data = redis.call('HGETALL', rkey)
+    if #data == 0 then
+        return nil, 0
+    end
+    local request = {}
+    for i = 1, #data, 2 do
+        request[data[i]] = data[i + 1]
+    end
+    local version = tonumber(request['schema_version'] or '1')
+    if version < 2 then
+        request['priority'] = request['priority'] or '` + PriorityNormal + `'
+        request['billing'] = request['billing'] or 'prepaid'
+    end
+    request['schema_version'] = '` + strconv.Itoa(RequestSchemaVersion) + `'
+    return request, version
+end
+`
+}
+
+// UpgradeRequestHashes rewrites every request hash in Redis that was created
+// by an older version of the scripts to RequestSchemaVersion, returning how
+// many it upgraded.
+//
+// The scripts read older hashes anyway, so this isn't needed for
+// correctness; it is run once a deploy has finished so that no hash of the
+// previous layout is left behind when a later version stops reading it.
+// It is safe to run at any time, including while requests are in flight.
+func (l *Ledger) UpgradeRequestHashes(ctx context.Context) (int, error) {
+	upgraded := 0
+
+	iter := l.redis.Scan(ctx, 0, "request:*", 500).Iterator()
+	for iter.Next(ctx) {
+		n, err := l.upgradeRequestScript.Run(ctx, l.redis, []string{iter.Val()}).Int()
+		if err != nil {
+			return upgraded, fmt.Errorf("upgrade %s failed: %w", iter.Val(), err)
+		}
+		upgraded += n
+	}
+	if err := iter.Err(); err != nil {
+		return upgraded, fmt.Errorf("scan request hashes failed: %w", err)
+	}
+
+	if upgraded > 0 {
+		l.log.Info().
+			Int("upgraded", upgraded).
+			Int("schema_version", RequestSchemaVersion).
+			Msg("request hashes upgraded")
+	}
+
+	return upgraded, nil
+}
@@ -0,0 +1,103 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedV1Request writes a request hash as version 1 of check_and_reserve
+// did: no schema_version, and no priority or billing for a normal-priority
+// prepaid request.
+func seedV1Request(t *testing.T, mr *miniredis.Miniredis, requestID string, fields ...string) {
+	t.Helper()
+
+	key := "request:" + requestID
+	mr.HSet(key,
+		"customer_id", "cus_1",
+		"reserved_grains", "500",
+		"estimated_grains", "400",
+		"consumed_grains", "0",
+		"status", "preflight_approved",
+		"created_at", "1700000000",
+		"metadata", "{}",
+	)
+	if len(fields) > 0 {
+		mr.HSet(key, fields...)
+	}
+	mr.SetTTL(key, time.Hour)
+}
+
+func TestFinalizeRequest_V1RequestUnderV2(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("customer:reserved:cus_1", "500")
+	mr.Set("system:total_reserved", "500")
+	seedV1Request(t, mr, "req_v1")
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_v1", GrainAmount: 300})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_v1", Status: "completed", ActualCostGrains: 250,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(50), fin.RefundedGrains)
+	assert.Equal(t, int64(750), fin.FinalBalance)
+
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "0", reserved)
+	assert.Equal(t, "completed", mr.HGet("request:req_v1", "status"))
+}
+
+func TestCheckAndReserveBalance_WritesSchemaVersion(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	res, err := l.CheckAndReserveBalance(context.Background(), ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_v2", ReservedGrains: 100, EstimatedGrains: 100,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	assert.Equal(t, "2", mr.HGet("request:req_v2", "schema_version"))
+	assert.Equal(t, PriorityNormal, mr.HGet("request:req_v2", "priority"))
+	assert.Equal(t, "prepaid", mr.HGet("request:req_v2", "billing"))
+}
+
+func TestUpgradeRequestHashes(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	seedV1Request(t, mr, "req_v1")
+	seedV1Request(t, mr, "req_v1_low", "priority", PriorityLow)
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_v2", ReservedGrains: 100, EstimatedGrains: 100,
+	})
+	require.NoError(t, err)
+
+	upgraded, err := l.UpgradeRequestHashes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, upgraded)
+
+	assert.Equal(t, "2", mr.HGet("request:req_v1", "schema_version"))
+	assert.Equal(t, PriorityNormal, mr.HGet("request:req_v1", "priority"))
+	assert.Equal(t, "prepaid", mr.HGet("request:req_v1", "billing"))
+	assert.Equal(t, PriorityLow, mr.HGet("request:req_v1_low", "priority"), "fields already set are kept")
+	assert.Equal(t, time.Hour, mr.TTL("request:req_v1"), "the request still expires as before")
+
+	upgraded, err = l.UpgradeRequestHashes(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, upgraded)
+}
@@ -0,0 +1,371 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+)
+
+// snapshotWatchRetries is how many times SnapshotReservations re-reads a
+// customer whose reservations changed while it was reading them.
+const snapshotWatchRetries = 5
+
+// reservationSnapshot is the in-flight state SnapshotReservations copies to
+// PostgreSQL: what InitializeRedis can't rebuild from the customers table.
+type reservationSnapshot struct {
+	Counters []snapshotCounters `json:"counters"`
+	Requests []snapshotRequest  `json:"requests"`
+}
+
+// snapshotCounters are one customer's reserved counters.
+type snapshotCounters struct {
+	CustomerID  string `json:"customer_id"`
+	Currency    string `json:"currency"`
+	Reserved    int64  `json:"reserved"`
+	ReservedLow int64  `json:"reserved_low"`
+}
+
+// snapshotRequest is an in-flight request hash, with the Unix time it
+// expires (its score in the customer's in-flight set).
+type snapshotRequest struct {
+	CustomerID string            `json:"customer_id"`
+	RequestID  string            `json:"request_id"`
+	Fields     map[string]string `json:"fields"`
+	ExpiresAt  int64             `json:"expires_at"`
+}
+
+// ReservationRestore reports what RestoreReservations put back.
+type ReservationRestore struct {
+	// TakenAt is when the snapshot restored from was taken; zero if there
+	// was none.
+	TakenAt time.Time
+
+	// Restored is how many requests are in flight again, holding
+	// ReservedGrains between them.
+	Restored       int
+	ReservedGrains int64
+
+	// Skipped is how many snapshotted requests were left out because they
+	// ended since the snapshot, or their hash would have expired by now.
+	Skipped int
+}
+
+// StartReservationSnapshots runs SnapshotReservations every interval until
+// Close. Start it only once any RestoreReservations is done, or the first
+// snapshot replaces the one to restore from.
+func (l *Ledger) StartReservationSnapshots(interval time.Duration) {
+	l.wg.Add(1)
+	go l.reservationSnapshotter(interval)
+}
+
+func (l *Ledger) reservationSnapshotter(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if _, err := l.SnapshotReservations(ctx); err != nil {
+				l.log.Warn().Err(err).Msg("reservation snapshot failed")
+			}
+			cancel()
+
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// SnapshotReservations copies the reservations in flight in Redis to the
+// reservation_snapshots table, replacing the previous snapshot, and returns
+// how many requests it holds.
+//
+// The reserved counters and in-flight request hashes live only in Redis,
+// so if Redis is lost InitializeRedis rebuilds the balances but every
+// reservation is stranded. RestoreReservations puts them back from the
+// latest snapshot. Each customer's counters and requests are read
+// atomically, so they agree with each other; different customers may be
+// read a moment apart.
+func (l *Ledger) SnapshotReservations(ctx context.Context) (int, error) {
+	start := time.Now()
+	snapshot := reservationSnapshot{
+		Counters: []snapshotCounters{},
+		Requests: []snapshotRequest{},
+	}
+
+	iter := l.redis.Scan(ctx, 0, inflightKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		customerID := strings.TrimPrefix(iter.Val(), inflightKey(""))
+		if err := l.snapshotCustomer(ctx, customerID, &snapshot); err != nil {
+			return 0, fmt.Errorf("snapshot of %s failed: %w", customerID, err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("scan in-flight requests failed: %w", err)
+	}
+
+	counters, err := json.Marshal(snapshot.Counters)
+	if err != nil {
+		return 0, fmt.Errorf("marshal counters failed: %w", err)
+	}
+	requests, err := json.Marshal(snapshot.Requests)
+	if err != nil {
+		return 0, fmt.Errorf("marshal requests failed: %w", err)
+	}
+
+	_, err = l.db.ExecContext(ctx, `
+		INSERT INTO reservation_snapshots (id, counters, requests, taken_at)
+		VALUES (1, $1, $2, NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			counters = EXCLUDED.counters,
+			requests = EXCLUDED.requests,
+			taken_at = EXCLUDED.taken_at
+	`, string(counters), string(requests))
+	if err != nil {
+		return 0, fmt.Errorf("write snapshot failed: %w", err)
+	}
+
+	l.log.Debug().
+		Int("customers", len(snapshot.Counters)).
+		Int("requests", len(snapshot.Requests)).
+		Dur("duration", time.Since(start)).
+		Msg("reservations snapshotted")
+
+	return len(snapshot.Requests), nil
+}
+
+// snapshotCustomer adds a customer's counters and in-flight requests to
+// snapshot. The in-flight set is watched, so if a request starts or ends
+// between listing the requests and reading them, it starts over.
+func (l *Ledger) snapshotCustomer(ctx context.Context, customerID string, snapshot *reservationSnapshot) error {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return err
+	}
+	reserved := reservedKey(customerID, currency)
+	reservedLow := reservedLowKey(customerID, currency)
+	inflight := inflightKey(customerID)
+
+	for attempt := 0; attempt < snapshotWatchRetries; attempt++ {
+		var counters snapshotCounters
+		var requests []snapshotRequest
+
+		err := l.redis.Watch(ctx, func(tx *redis.Tx) error {
+			members, err := tx.ZRangeByScoreWithScores(ctx, inflight, &redis.ZRangeBy{
+				Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+				Max: "+inf",
+			}).Result()
+			if err != nil {
+				return err
+			}
+
+			var reservedCmd, reservedLowCmd *redis.StringCmd
+			hashes := make([]*redis.StringStringMapCmd, len(members))
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				reservedCmd = pipe.Get(ctx, reserved)
+				reservedLowCmd = pipe.Get(ctx, reservedLow)
+				for i, m := range members {
+					hashes[i] = pipe.HGetAll(ctx, m.Member.(string))
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			counters = snapshotCounters{CustomerID: customerID, Currency: currency}
+			if counters.Reserved, err = counterValue(reservedCmd); err != nil {
+				return err
+			}
+			if counters.ReservedLow, err = counterValue(reservedLowCmd); err != nil {
+				return err
+			}
+
+			requests = requests[:0]
+			for i, m := range members {
+				fields := hashes[i].Val()
+				if len(fields) == 0 {
+					continue // expired
+				}
+				requests = append(requests, snapshotRequest{
+					CustomerID: customerID,
+					RequestID:  strings.TrimPrefix(m.Member.(string), "request:"),
+					Fields:     fields,
+					ExpiresAt:  int64(m.Score),
+				})
+			}
+			return nil
+		}, reserved, reservedLow, inflight)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		snapshot.Counters = append(snapshot.Counters, counters)
+		snapshot.Requests = append(snapshot.Requests, requests...)
+		return nil
+	}
+
+	return fmt.Errorf("reservations kept changing, gave up after %d attempts", snapshotWatchRetries)
+}
+
+// counterValue returns a counter read in a pipeline, zero if it doesn't
+// exist.
+func counterValue(cmd *redis.StringCmd) (int64, error) {
+	n, err := cmd.Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// RestoreReservations puts the reservations of the latest snapshot (see
+// SnapshotReservations) back into Redis. It is meant for startup after
+// Redis was lost, once InitializeRedis has rebuilt the balances and before
+// traffic is served, so that in-flight requests can still be finalized and
+// their grains stay reserved meanwhile.
+//
+// Only requests PostgreSQL still has in flight are restored; those that
+// ended since the snapshot was taken, or whose hash would have expired by
+// now, are skipped and their grains taken off the snapshotted counters. A
+// request whose hash survived in Redis is left as it is, and counted only
+// if it is still in flight. Requests reserved after the snapshot are lost;
+// the orphan sweeper abandons them in PostgreSQL.
+func (l *Ledger) RestoreReservations(ctx context.Context) (*ReservationRestore, error) {
+	var counters, requests []byte
+	report := &ReservationRestore{}
+
+	err := l.db.QueryRowContext(ctx, `
+		SELECT counters, requests, taken_at FROM reservation_snapshots WHERE id = 1
+	`).Scan(&counters, &requests, &report.TakenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot failed: %w", err)
+	}
+
+	var snapshot reservationSnapshot
+	if err := json.Unmarshal(counters, &snapshot.Counters); err != nil {
+		return nil, fmt.Errorf("invalid snapshot counters: %w", err)
+	}
+	if err := json.Unmarshal(requests, &snapshot.Requests); err != nil {
+		return nil, fmt.Errorf("invalid snapshot requests: %w", err)
+	}
+
+	inFlight, err := l.requestsInFlight(ctx, snapshot.Requests)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grains of the snapshotted requests left out, per customer
+	skipped := make(map[string]int64)
+	skippedLow := make(map[string]int64)
+	inflightExpiry := make(map[string]int64)
+	now := time.Now().Unix()
+
+	pipe := l.redis.TxPipeline()
+	for _, req := range snapshot.Requests {
+		rkey := fmt.Sprintf("request:%s", req.RequestID)
+		grains, _ := strconv.ParseInt(req.Fields["reserved_grains"], 10, 64)
+
+		status, err := l.redis.HGet(ctx, rkey, "status").Result()
+		if err != nil && err != redis.Nil {
+			return nil, redisError("hget", err)
+		}
+
+		restore := inFlight[req.RequestID] && req.ExpiresAt > now
+		if status != "" {
+			// The hash survived; it is more current than the snapshot
+			restore = status == "preflight_approved" || status == "streaming"
+		}
+		if !restore {
+			report.Skipped++
+			skipped[req.CustomerID] += grains
+			if req.Fields["priority"] == PriorityLow {
+				skippedLow[req.CustomerID] += grains
+			}
+			continue
+		}
+
+		if status == "" {
+			pipe.HSet(ctx, rkey, req.Fields)
+			pipe.ExpireAt(ctx, rkey, time.Unix(req.ExpiresAt, 0))
+		}
+		pipe.ZAdd(ctx, inflightKey(req.CustomerID), &redis.Z{Score: float64(req.ExpiresAt), Member: rkey})
+		inflightExpiry[req.CustomerID] = max(inflightExpiry[req.CustomerID], req.ExpiresAt)
+		report.Restored++
+	}
+
+	// The in-flight set lives as long as its longest-lived request
+	for customerID, expiresAt := range inflightExpiry {
+		pipe.ExpireAt(ctx, inflightKey(customerID), time.Unix(expiresAt, 0))
+	}
+
+	for _, c := range snapshot.Counters {
+		reserved := max(c.Reserved-skipped[c.CustomerID], 0)
+		reservedLow := max(c.ReservedLow-skippedLow[c.CustomerID], 0)
+		pipe.IncrBy(ctx, reservedKey(c.CustomerID, c.Currency), reserved)
+		pipe.IncrBy(ctx, reservedLowKey(c.CustomerID, c.Currency), reservedLow)
+		pipe.IncrBy(ctx, totalReservedKey, reserved)
+		report.ReservedGrains += reserved
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("restore pipeline failed: %w", err)
+	}
+
+	l.log.Info().
+		Time("taken_at", report.TakenAt).
+		Int("restored", report.Restored).
+		Int("skipped", report.Skipped).
+		Int64("reserved_grains", report.ReservedGrains).
+		Msg("reservations restored from snapshot")
+
+	return report, nil
+}
+
+// requestsInFlight returns which of requests PostgreSQL has in flight.
+func (l *Ledger) requestsInFlight(ctx context.Context, requests []snapshotRequest) (map[string]bool, error) {
+	inFlight := make(map[string]bool, len(requests))
+	if len(requests) == 0 {
+		return inFlight, nil
+	}
+
+	ids := make([]string, len(requests))
+	for i, req := range requests {
+		ids[i] = req.RequestID
+	}
+
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT request_id FROM requests
+		WHERE request_id = ANY($1) AND status IN ('preflight_approved', 'streaming')
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("query in-flight requests failed: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		inFlight[id] = true
+	}
+	return inFlight, rows.Err()
+}
@@ -0,0 +1,172 @@
+package ledger
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturedArg matches any argument and keeps it.
+type capturedArg struct{ value driver.Value }
+
+func (c *capturedArg) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+func TestReservationSnapshot_RoundTrip(t *testing.T) {
+	l, mr := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("customer:balance:cus_2", "1000")
+	for _, req := range []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300},
+		{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 200, Priority: PriorityLow},
+		{CustomerID: "cus_2", RequestID: "req_3", ReservedGrains: 100, Priority: PriorityLow},
+	} {
+		res, err := l.CheckAndReserveBalance(ctx, req)
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+	}
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 50})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+	before := l.redis.HGetAll(ctx, "request:req_1").Val()
+
+	counters, requests := &capturedArg{}, &capturedArg{}
+	mock.ExpectExec("INSERT INTO reservation_snapshots").
+		WithArgs(counters, requests).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := l.SnapshotReservations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// Redis is lost; InitializeRedis brings back the balances only
+	mr.FlushAll()
+	mr.Set("customer:balance:cus_1", "950")
+	mr.Set("customer:balance:cus_2", "1000")
+
+	// req_2 was finalized in PostgreSQL after the snapshot
+	takenAt := time.Now().Add(-10 * time.Second).UTC().Truncate(time.Second)
+	mock.ExpectQuery("SELECT counters, requests, taken_at FROM reservation_snapshots").
+		WillReturnRows(sqlmock.NewRows([]string{"counters", "requests", "taken_at"}).
+			AddRow([]byte(counters.value.(string)), []byte(requests.value.(string)), takenAt))
+	mock.ExpectQuery("SELECT request_id FROM requests").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_id"}).AddRow("req_1").AddRow("req_3"))
+
+	report, err := l.RestoreReservations(ctx)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, takenAt, report.TakenAt)
+	assert.Equal(t, 2, report.Restored)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, int64(400), report.ReservedGrains)
+
+	// The in-flight requests are back as they were, holding their grains
+	assert.Equal(t, before, l.redis.HGetAll(ctx, "request:req_1").Val())
+	assert.True(t, mr.TTL("request:req_1") > 0)
+	assert.False(t, mr.Exists("request:req_2"))
+	for key, want := range map[string]string{
+		"customer:reserved:cus_1":     "300",
+		"customer:reserved_low:cus_1": "0",
+		"customer:reserved:cus_2":     "100",
+		"customer:reserved_low:cus_2": "100",
+		"system:total_reserved":       "400",
+	} {
+		got, err := mr.Get(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, got, key)
+	}
+	inflight, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), inflight)
+
+	// and finalize as usual
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 80,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+	assert.Equal(t, int64(920), fin.FinalBalance)
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, reserved)
+}
+
+func TestRestoreReservations_SurvivingHash(t *testing.T) {
+	l, mr := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	for _, id := range []string{"req_1", "req_2"} {
+		_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: id, ReservedGrains: 300})
+		require.NoError(t, err)
+	}
+
+	counters, requests := &capturedArg{}, &capturedArg{}
+	mock.ExpectExec("INSERT INTO reservation_snapshots").
+		WithArgs(counters, requests).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = l.SnapshotReservations(ctx)
+	require.NoError(t, err)
+
+	// A restart rather than a Redis loss: req_2 was finalized in Redis, with
+	// its PostgreSQL write still pending, and InitializeRedis reset the
+	// counters
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_2", Status: "completed", ActualCostGrains: 100,
+	})
+	require.NoError(t, err)
+	mr.Set("customer:reserved:cus_1", "0")
+	mr.Set("system:total_reserved", "0")
+	mr.Del("customer:inflight:cus_1")
+
+	mock.ExpectQuery("SELECT counters, requests, taken_at FROM reservation_snapshots").
+		WillReturnRows(sqlmock.NewRows([]string{"counters", "requests", "taken_at"}).
+			AddRow([]byte(counters.value.(string)), []byte(requests.value.(string)), time.Now()))
+	mock.ExpectQuery("SELECT request_id FROM requests").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_id"}).AddRow("req_1").AddRow("req_2"))
+
+	report, err := l.RestoreReservations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Restored)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, "completed", mr.HGet("request:req_2", "status"))
+
+	reserved, err := mr.Get("customer:reserved:cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, "300", reserved)
+}
+
+func TestRestoreReservations_NoSnapshot(t *testing.T) {
+	l, _ := newTestLedger(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mock.ExpectQuery("SELECT counters, requests, taken_at FROM reservation_snapshots").
+		WillReturnRows(sqlmock.NewRows([]string{"counters", "requests", "taken_at"}))
+
+	report, err := l.RestoreReservations(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, report.Restored)
+	assert.True(t, report.TakenAt.IsZero())
+}
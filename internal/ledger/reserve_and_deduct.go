@@ -0,0 +1,35 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDryRunDeduction is returned by ReserveAndDeduct for a dry run, which
+// holds nothing to deduct from.
+var ErrDryRunDeduction = errors.New("a dry run reservation can't make a deduction")
+
+// ReserveAndDeduct reserves grains for req and makes the request's first
+// deduction in the same Redis script, saving the client a round trip before
+// its stream starts.
+//
+// The reservation is exactly what CheckAndReserveBalance would make, and
+// ded is applied exactly as DeductGrains would apply it right afterwards:
+// the results are the same as making the two calls one after the other,
+// except that nothing can run between them. ded's CustomerID and RequestID
+// are taken from req, and it is deducted in the reservation's currency.
+//
+// The deduction result is nil if the reservation wasn't approved. A
+// deduction that fails (e.g. INSUFFICIENT_BALANCE) leaves the reservation
+// in place, as if DeductGrains had failed; the caller still finalizes or
+// cancels the request.
+func (l *Ledger) ReserveAndDeduct(ctx context.Context, req ReservationRequest, ded DeductionRequest) (*ReservationResult, *DeductionResult, error) {
+	if req.DryRun {
+		return nil, nil, ErrDryRunDeduction
+	}
+
+	ded.CustomerID = req.CustomerID
+	ded.RequestID = req.RequestID
+
+	return l.reserve(ctx, req, &ded)
+}
@@ -0,0 +1,125 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requestState is what a request left in Redis, minus the timestamps the
+// scripts take from the clock.
+func requestState(t *testing.T, mr *miniredis.Miniredis, customerID, requestID string) map[string]string {
+	t.Helper()
+
+	state := map[string]string{}
+	for _, key := range []string{
+		"customer:balance:" + customerID,
+		"customer:reserved:" + customerID,
+		totalBalanceKey,
+		totalReservedKey,
+	} {
+		v, _ := mr.Get(key)
+		state[key] = v
+	}
+	fields, err := mr.HKeys("request:" + requestID)
+	require.NoError(t, err)
+	for _, f := range fields {
+		if f == "created_at" || f == "last_deduction_at" {
+			continue
+		}
+		state["request."+f] = mr.HGet("request:"+requestID, f)
+	}
+	return state
+}
+
+func TestReserveAndDeduct_MatchesSeparateCalls(t *testing.T) {
+	pricing := &PricingInfo{InputCostPerMillionTokens: 2_000_000, OutputCostPerMillionTokens: 6_000_000}
+
+	tests := []struct {
+		name    string
+		balance string
+		ded     DeductionRequest
+	}{
+		{
+			name:    "flat amount",
+			balance: "10000",
+			ded:     DeductionRequest{GrainAmount: 300, TokensConsumed: 50},
+		},
+		{
+			name:    "priced from pins",
+			balance: "10000",
+			ded:     DeductionRequest{GrainAmount: 1, TokensConsumed: 50, PriceFromPins: true, IsCompletion: true},
+		},
+		{
+			name:    "deduction exceeds balance",
+			balance: "2000",
+			ded:     DeductionRequest{GrainAmount: 2500, TokensConsumed: 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			res := ReservationRequest{
+				CustomerID:      "cus_1",
+				RequestID:       "req_1",
+				ReservedGrains:  1500,
+				EstimatedGrains: 1200,
+				Pricing:         pricing,
+			}
+
+			separate, smr := newTestLedger(t)
+			smr.Set("customer:balance:cus_1", tt.balance)
+			smr.Set(totalBalanceKey, tt.balance)
+
+			wantRes, err := separate.CheckAndReserveBalance(ctx, res)
+			require.NoError(t, err)
+			require.True(t, wantRes.Approved)
+			ded := tt.ded
+			ded.CustomerID, ded.RequestID = res.CustomerID, res.RequestID
+			wantDed, err := separate.DeductGrains(ctx, ded)
+			require.NoError(t, err)
+
+			combined, cmr := newTestLedger(t)
+			cmr.Set("customer:balance:cus_1", tt.balance)
+			cmr.Set(totalBalanceKey, tt.balance)
+
+			gotRes, gotDed, err := combined.ReserveAndDeduct(ctx, res, tt.ded)
+			require.NoError(t, err)
+
+			assert.Equal(t, wantRes, gotRes)
+			assert.Equal(t, wantDed, gotDed)
+			assert.Equal(t, requestState(t, smr, "cus_1", "req_1"), requestState(t, cmr, "cus_1", "req_1"))
+		})
+	}
+}
+
+func TestReserveAndDeduct_Rejected(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	res, ded, err := l.ReserveAndDeduct(ctx, ReservationRequest{
+		CustomerID:      "cus_1",
+		RequestID:       "req_1",
+		ReservedGrains:  1500,
+		EstimatedGrains: 1200,
+	}, DeductionRequest{GrainAmount: 100, TokensConsumed: 50})
+	require.NoError(t, err)
+
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+	assert.Nil(t, ded)
+
+	// Nothing was reserved or deducted
+	balance, _ := mr.Get("customer:balance:cus_1")
+	assert.Equal(t, "1000", balance)
+	assert.False(t, mr.Exists("request:req_1"))
+
+	_, _, err = l.ReserveAndDeduct(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", DryRun: true}, DeductionRequest{})
+	assert.ErrorIs(t, err, ErrDryRunDeduction)
+}
@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// safeModeKey holds the reason and start time of integrity safe mode while
+// it is on. The check_and_reserve script refuses every reservation while
+// the key exists. sync.InitializeRedis deletes it after a full resync.
+const safeModeKey = "system:safe_mode"
+
+// SafeModeStatus describes integrity safe mode.
+type SafeModeStatus struct {
+	Active    bool      `json:"active"`
+	Reason    string    `json:"reason,omitempty"`
+	EnteredAt time.Time `json:"entered_at,omitempty"`
+}
+
+// WithSafeModeThreshold makes ReconcileAll put the ledger in safe mode
+// when it finds more than threshold mismatched balances. Zero (the default)
+// never enters safe mode automatically.
+func WithSafeModeThreshold(threshold int) Option {
+	return func(l *Ledger) {
+		l.safeModeThreshold = threshold
+	}
+}
+
+// EnterSafeMode makes CheckAndReserveBalance reject every reservation with
+// RejectionIntegritySafeMode, across all API instances, until ClearSafeMode
+// or a full resync. Balances stay readable and requests already in flight
+// can still be deducted and finalized. If safe mode is already on, its
+// original reason is kept.
+func (l *Ledger) EnterSafeMode(ctx context.Context, reason string) error {
+	pipe := l.redis.TxPipeline()
+	entered := pipe.HSetNX(ctx, safeModeKey, "reason", reason)
+	pipe.HSetNX(ctx, safeModeKey, "entered_at", time.Now().Unix())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return redisError("hsetnx", err)
+	}
+	if !entered.Val() {
+		return nil
+	}
+
+	l.log.Error().Str("reason", reason).Msg("integrity safe mode entered, rejecting all reservations")
+	return nil
+}
+
+// ClearSafeMode leaves integrity safe mode.
+func (l *Ledger) ClearSafeMode(ctx context.Context) error {
+	n, err := l.redis.Del(ctx, safeModeKey).Result()
+	if err != nil {
+		return redisError("del", err)
+	}
+
+	if n > 0 {
+		l.log.Warn().Msg("integrity safe mode cleared")
+	}
+	return nil
+}
+
+// SafeMode reports whether the ledger is in integrity safe mode.
+func (l *Ledger) SafeMode(ctx context.Context) (*SafeModeStatus, error) {
+	fields, err := l.redis.HGetAll(ctx, safeModeKey).Result()
+	if err != nil {
+		return nil, redisError("hgetall", err)
+	}
+	if len(fields) == 0 {
+		return &SafeModeStatus{}, nil
+	}
+
+	s := &SafeModeStatus{Active: true, Reason: fields["reason"]}
+	if ts, err := strconv.ParseInt(fields["entered_at"], 10, 64); err == nil {
+		s.EnteredAt = time.Unix(ts, 0).UTC()
+	}
+	return s, nil
+}
+
+// checkSafeModeThreshold enters safe mode if an integrity check found more
+// discrepancies than the configured threshold.
+func (l *Ledger) checkSafeModeThreshold(ctx context.Context, check string, discrepancies int) error {
+	if l.safeModeThreshold <= 0 || discrepancies <= l.safeModeThreshold {
+		return nil
+	}
+	return l.EnterSafeMode(ctx, fmt.Sprintf("%s found %d discrepancies (threshold %d)",
+		check, discrepancies, l.safeModeThreshold))
+}
@@ -0,0 +1,85 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeMode_RejectsReservationsUntilCleared(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	require.NoError(t, l.EnterSafeMode(ctx, "redis restored from snapshot"))
+	require.NoError(t, l.EnterSafeMode(ctx, "second reason"))
+
+	status, err := l.SafeMode(ctx)
+	require.NoError(t, err)
+	assert.True(t, status.Active)
+	assert.Equal(t, "redis restored from snapshot", status.Reason)
+	assert.False(t, status.EnteredAt.IsZero())
+
+	req := ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100, EstimatedGrains: 100}
+	res, err := l.CheckAndReserveBalance(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionIntegritySafeMode, res.RejectionReason)
+	assert.False(t, mr.Exists("request:req_1"))
+
+	// Reads are unaffected.
+	balance, _, available, found, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(1000), balance)
+	assert.Equal(t, int64(1000), available)
+
+	require.NoError(t, l.ClearSafeMode(ctx))
+	status, err = l.SafeMode(ctx)
+	require.NoError(t, err)
+	assert.False(t, status.Active)
+
+	res, err = l.CheckAndReserveBalance(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+}
+
+func TestReconcileAll_EntersSafeModeOverThreshold(t *testing.T) {
+	cols := []string{"customer_id", "postgres_balance", "transactions_sum", "difference", "is_valid"}
+
+	for _, tt := range []struct {
+		name      string
+		threshold int
+		want      bool
+	}{
+		{name: "at threshold", threshold: 2, want: false},
+		{name: "over threshold", threshold: 1, want: true},
+		{name: "disabled", threshold: 0, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, mr := newTestLedger(t)
+			WithSafeModeThreshold(tt.threshold)(l)
+
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			l.db = db
+
+			mock.ExpectQuery("verify_balance_integrity").
+				WithArgs("", 10).
+				WillReturnRows(sqlmock.NewRows(cols).
+					AddRow("cus_a", 1500, 1000, 500, false).
+					AddRow("cus_b", 0, 200, -200, false).
+					AddRow("cus_c", 700, 700, 0, true))
+
+			_, err = l.ReconcileAll(context.Background(), 10, false)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mr.Exists(safeModeKey))
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// selfTest runs the Lua scripts through a reserve → deduct → finalize cycle
+// on a throwaway customer and checks the arithmetic, so a script that was
+// edited into something valid but wrong fails startup instead of
+// misbilling production traffic.
+//
+// Every key lives under a fresh "selftest:<uuid>:" namespace, including the
+// system totals, so real customers and the exported totals are never
+// touched. The keys are deleted afterwards whether or not the test passed.
+func (l *Ledger) selfTest(ctx context.Context) error {
+	ns := fmt.Sprintf("selftest:%s:", uuid.New().String())
+	key := func(name string) string { return ns + name }
+
+	balance := key("balance")
+	reserved := key("reserved")
+	request := key("request")
+	totalBalance := key("total_balance")
+	totalReserved := key("total_reserved")
+	reservedLow := key("reserved_low")
+	config := key("config")
+	buckets := key("buckets")
+	debt := key("debt")
+	safeMode := key("safe_mode")
+	inflight := key("inflight")
+
+	defer func() {
+		// Cleanup must happen even if ctx is what made the test fail
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		l.redis.Del(cleanupCtx, balance, reserved, request, totalBalance, totalReserved,
+			reservedLow, config, buckets, debt, inflight)
+	}()
+
+	if err := l.redis.MSet(ctx, balance, 1000, totalBalance, 1000).Err(); err != nil {
+		return fmt.Errorf("seed failed: %w", err)
+	}
+
+	// Reserve 600 of 1000: 400 left available
+	res, err := l.checkAndReserveScript.Run(ctx, l.redis,
+		[]string{balance, reserved, request, totalReserved, reservedLow, config, debt, safeMode, inflight},
+		600, 500, "{}", "selftest", "0", 60, "", "", PriorityNormal, "0", 0, RequestSchemaVersion, 0, "", 0,
+	).Slice()
+	if err != nil {
+		return fmt.Errorf("check_and_reserve failed: %w", err)
+	}
+	if err := expectScriptResult("check_and_reserve", res, 1, 400); err != nil {
+		return err
+	}
+	if err := l.expectCounters(ctx, "check_and_reserve", map[string]int64{
+		balance: 1000, reserved: 600, totalReserved: 600,
+	}); err != nil {
+		return err
+	}
+
+	// Stream 250 of it
+	res, err = l.deductGrainsScript.Run(ctx, l.redis,
+		[]string{balance, request, totalBalance, config, buckets, debt},
+		250, 10, "0", "",
+	).Slice()
+	if err != nil {
+		return fmt.Errorf("deduct_grains failed: %w", err)
+	}
+	if err := expectScriptResult("deduct_grains", res, 1, 750); err != nil {
+		return err
+	}
+	if err := l.expectCounters(ctx, "deduct_grains", map[string]int64{
+		balance: 750, totalBalance: 750, reserved: 600,
+	}); err != nil {
+		return err
+	}
+
+	// The actual cost was 200: 50 refunded and the reservation released
+	res, err = l.finalizeRequestScript.Run(ctx, l.redis,
+		[]string{balance, reserved, request, totalBalance, totalReserved, buckets, reservedLow, debt, config, inflight},
+		200, "completed", "0", 0, 0, 60, ShortfallPolicyAbsorb,
+	).Slice()
+	if err != nil {
+		return fmt.Errorf("finalize_request failed: %w", err)
+	}
+	if err := expectScriptResult("finalize_request", res, 1, 50, 800); err != nil {
+		return err
+	}
+	return l.expectCounters(ctx, "finalize_request", map[string]int64{
+		balance: 800, totalBalance: 800, reserved: 0, totalReserved: 0,
+	})
+}
+
+// expectScriptResult checks the leading integers of a script's result.
+func expectScriptResult(script string, res []interface{}, want ...int64) error {
+	if len(res) < len(want) {
+		return fmt.Errorf("%s returned %v, want %v", script, res, want)
+	}
+	for i, w := range want {
+		if got, ok := res[i].(int64); !ok || got != w {
+			return fmt.Errorf("%s returned %v, want %v", script, res, want)
+		}
+	}
+	return nil
+}
+
+// expectCounters checks the values of integer keys after a script ran.
+func (l *Ledger) expectCounters(ctx context.Context, script string, want map[string]int64) error {
+	for k, w := range want {
+		got, err := l.redis.Get(ctx, k).Int64()
+		if err == redis.Nil {
+			got, err = 0, nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: reading %s failed: %w", script, k, err)
+		}
+		if got != w {
+			return fmt.Errorf("%s left %s at %d, want %d", script, k, got, w)
+		}
+	}
+	return nil
+}
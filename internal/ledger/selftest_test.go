@@ -0,0 +1,40 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest_PassesAndCleansUp(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("system:total_balance", "1000")
+
+	require.NoError(t, l.selfTest(context.Background()))
+
+	// Only the keys that were there before are left, untouched.
+	assert.ElementsMatch(t, []string{"customer:balance:cus_1", "system:total_balance"}, mr.Keys())
+	total, err := mr.Get("system:total_balance")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", total)
+}
+
+func TestSelfTest_FailsOnBrokenScript(t *testing.T) {
+	l, mr := newTestLedger(t)
+
+	// Valid Lua that reports success but never deducts anything.
+	l.deductGrainsScript = redis.NewScript(`
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+return {1, balance - tonumber(ARGV[1]), '', 0, tonumber(ARGV[1])}
+`)
+
+	err := l.selfTest(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "deduct_grains left")
+	assert.Empty(t, mr.Keys())
+}
@@ -0,0 +1,55 @@
+package ledger
+
+import "fmt"
+
+// Shortfall policies decide what finalization does when a prepaid request's
+// actual cost exceeds what streaming deducted by more than the customer's
+// balance can cover (an undercharge shortfall):
+//
+//   - ShortfallPolicyAbsorb takes what the balance has, leaving it at zero,
+//     and the platform eats the rest. The request is flagged
+//     undercharge_shortfall for manual review. This is the default.
+//   - ShortfallPolicyNegative takes the whole charge, leaving the balance
+//     below zero; the customer's next top-up pays it back first.
+//   - ShortfallPolicyDebt takes what the balance has and adds the rest to
+//     the customer's debt counter (see PostpaidDebt), to be invoiced and
+//     settled with SettlePostpaidDebt. It is recorded as a
+//     TransactionShortfallDebt.
+//
+// Postpaid requests are charged in full to the debt counter regardless.
+const (
+	ShortfallPolicyAbsorb   = "absorb"
+	ShortfallPolicyNegative = "negative"
+	ShortfallPolicyDebt     = "debt"
+)
+
+// WithShortfallPolicy sets the shortfall policy finalization applies.
+// Empty means ShortfallPolicyAbsorb; see ParseShortfallPolicy for checking a
+// configured value.
+func WithShortfallPolicy(policy string) Option {
+	return func(l *Ledger) {
+		l.shortfallPolicy = policy
+	}
+}
+
+// ParseShortfallPolicy checks a configured shortfall policy, treating empty
+// as ShortfallPolicyAbsorb.
+func ParseShortfallPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return ShortfallPolicyAbsorb, nil
+	case ShortfallPolicyAbsorb, ShortfallPolicyNegative, ShortfallPolicyDebt:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown shortfall policy %q: must be %s, %s or %s",
+		s, ShortfallPolicyAbsorb, ShortfallPolicyNegative, ShortfallPolicyDebt)
+}
+
+// shortfallPolicyArg returns the finalize script's shortfall policy
+// argument.
+func (l *Ledger) shortfallPolicyArg() string {
+	if l.shortfallPolicy == "" {
+		return ShortfallPolicyAbsorb
+	}
+	return l.shortfallPolicy
+}
@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// finalizeUnderestimated reserves and streams 300 grains of a request
+// against a balance of 500, then finalizes it at an actual cost of 1000:
+// 700 more than was deducted, of which the balance can only cover 200.
+func finalizeUnderestimated(t *testing.T, l *Ledger) *FinalizationResult {
+	t.Helper()
+	ctx := context.Background()
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300, EstimatedGrains: 300,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+
+	ded, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 300})
+	require.NoError(t, err)
+	require.True(t, ded.Success)
+
+	fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 1000,
+	})
+	require.NoError(t, err)
+	require.True(t, fin.Success)
+
+	return fin
+}
+
+func TestFinalizeRequest_ShortfallPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy    string
+		balance   string
+		refunded  int64
+		debt      int64
+		integrity string
+	}{
+		{policy: "", balance: "0", refunded: -200, integrity: "undercharge_shortfall"},
+		{policy: ShortfallPolicyAbsorb, balance: "0", refunded: -200, integrity: "undercharge_shortfall"},
+		{policy: ShortfallPolicyNegative, balance: "-500", refunded: -700},
+		{policy: ShortfallPolicyDebt, balance: "0", refunded: -200, debt: 500},
+	} {
+		t.Run("policy="+tt.policy, func(t *testing.T) {
+			l, mr := newTestLedger(t)
+			WithShortfallPolicy(tt.policy)(l)
+
+			mr.Set("customer:balance:cus_1", "500")
+			mr.Set("system:total_balance", "500")
+
+			fin := finalizeUnderestimated(t, l)
+			assert.Equal(t, tt.refunded, fin.RefundedGrains)
+			assert.Equal(t, tt.debt, fin.ShortfallDebtGrains)
+			assert.Equal(t, int64(1000), fin.ActualCostGrains)
+
+			balance, err := mr.Get("customer:balance:cus_1")
+			require.NoError(t, err)
+			assert.Equal(t, tt.balance, balance)
+			total, err := mr.Get("system:total_balance")
+			require.NoError(t, err)
+			assert.Equal(t, balance, total)
+			assert.Equal(t, tt.integrity, mr.HGet("request:req_1", "integrity_issue"))
+
+			debt, err := l.PostpaidDebt(context.Background(), "cus_1")
+			require.NoError(t, err)
+			assert.Equal(t, tt.debt, debt)
+
+			_, reserved, _, _, err := l.GetBalance(context.Background(), "cus_1")
+			require.NoError(t, err)
+			assert.Zero(t, reserved)
+		})
+	}
+}
+
+func TestFinalizeRequest_ShortfallPolicyCoveredCharge(t *testing.T) {
+	l, mr := newTestLedger(t)
+	WithShortfallPolicy(ShortfallPolicyDebt)(l)
+
+	// The balance covers the extra 700, so nothing is owed
+	mr.Set("customer:balance:cus_1", "2000")
+
+	fin := finalizeUnderestimated(t, l)
+	assert.Equal(t, int64(-700), fin.RefundedGrains)
+	assert.Zero(t, fin.ShortfallDebtGrains)
+	assert.Equal(t, int64(1000), fin.FinalBalance)
+	assert.False(t, mr.Exists("customer:debt:cus_1"))
+}
+
+func TestParseShortfallPolicy(t *testing.T) {
+	for in, want := range map[string]string{
+		"":         ShortfallPolicyAbsorb,
+		"absorb":   ShortfallPolicyAbsorb,
+		"negative": ShortfallPolicyNegative,
+		"debt":     ShortfallPolicyDebt,
+	} {
+		got, err := ParseShortfallPolicy(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := ParseShortfallPolicy("postpaid")
+	assert.Error(t, err)
+}
+
+func TestWriteFinalizationToDB_RecordsShortfallDebt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	req := FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Model: "gpt-4", Status: "completed",
+		PromptTokens: 100, CompletionTokens: 50, ActualCostGrains: 1000,
+		shortfallDebtGrains: 500,
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE requests SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(append(usageArgs(req),
+			sqlmock.AnyArg(), "cus_1", int64(500), "shortfall_debt", "req_1",
+			"Shortfall recorded as debt: gpt-4", nil)...).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	require.NoError(t, l.writeFinalizationToDB(context.Background(), req))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,91 @@
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultStatementTimeout is PostgreSQL's statement_timeout for the ledger's
+// connections. It is below the 5s context the async writers run under, so a
+// query stuck on a lock is cancelled by the server (freeing the backend and
+// its locks) before the client gives up on it.
+const DefaultStatementTimeout = 4 * time.Second
+
+// pqQueryCanceled is the SQLSTATE of a cancelled statement, whether by
+// statement_timeout or by the client.
+const pqQueryCanceled = "57014"
+
+// WithStatementTimeout sets the statement_timeout of every PostgreSQL
+// session the ledger opens. Zero or negative leaves the server's setting
+// alone. Defaults to DefaultStatementTimeout.
+func WithStatementTimeout(d time.Duration) Option {
+	return func(l *Ledger) {
+		l.statementTimeout = &d
+	}
+}
+
+// statementTimeoutOrDefault returns the configured statement timeout.
+func (l *Ledger) statementTimeoutOrDefault() time.Duration {
+	if l.statementTimeout == nil {
+		return DefaultStatementTimeout
+	}
+	return *l.statementTimeout
+}
+
+// openPostgres opens the ledger's connection pool with statement_timeout
+// and, given a schema, search_path set on every session (see WithSchema).
+func openPostgres(postgresURL string, statementTimeout time.Duration, schema string) (*sql.DB, error) {
+	dsn, err := statementTimeoutDSN(postgresURL, statementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err = schemaDSN(dsn, schema)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("postgres", dsn)
+}
+
+// statementTimeoutDSN adds statement_timeout to a connection string, in URL
+// or key=value form.
+func statementTimeoutDSN(dsn string, d time.Duration) (string, error) {
+	if d <= 0 {
+		return dsn, nil
+	}
+	return dsnWithSetting(dsn, "statement_timeout", fmt.Sprintf("%d", d.Milliseconds()))
+}
+
+// dsnWithSetting adds a session setting to a connection string, in URL or
+// key=value form. lib/pq sends parameters it doesn't know itself to the
+// server as session settings, so the pool's connections all get it. value
+// must not contain spaces.
+func dsnWithSetting(dsn, key, value string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid postgres url: %w", err)
+		}
+		q := u.Query()
+		q.Set(key, value)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	return strings.TrimSpace(dsn + " " + key + "=" + value), nil
+}
+
+// isStatementTimeout reports whether err is PostgreSQL cancelling a query
+// for running past statement_timeout, as opposed to a client cancellation.
+func isStatementTimeout(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == pqQueryCanceled && strings.Contains(pqErr.Message, "statement timeout")
+}
@@ -0,0 +1,110 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatementTimeoutDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		timeout time.Duration
+		want    string
+	}{
+		{
+			name:    "url",
+			dsn:     "postgres://u:p@localhost:5432/beam?sslmode=disable",
+			timeout: 4 * time.Second,
+			want:    "postgres://u:p@localhost:5432/beam?sslmode=disable&statement_timeout=4000",
+		},
+		{
+			name:    "url replaces existing setting",
+			dsn:     "postgresql://localhost/beam?statement_timeout=1",
+			timeout: 250 * time.Millisecond,
+			want:    "postgresql://localhost/beam?statement_timeout=250",
+		},
+		{
+			name:    "key value",
+			dsn:     "host=localhost dbname=beam",
+			timeout: time.Second,
+			want:    "host=localhost dbname=beam statement_timeout=1000",
+		},
+		{
+			name:    "disabled",
+			dsn:     "postgres://localhost/beam",
+			timeout: 0,
+			want:    "postgres://localhost/beam",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := statementTimeoutDSN(tt.dsn, tt.timeout)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestIsStatementTimeout(t *testing.T) {
+	timeout := &pq.Error{Code: pqQueryCanceled, Message: "canceling statement due to statement timeout"}
+	assert.True(t, isStatementTimeout(timeout))
+	assert.True(t, isStatementTimeout(fmt.Errorf("commit failed: %w", timeout)))
+
+	assert.False(t, isStatementTimeout(&pq.Error{Code: pqQueryCanceled, Message: "canceling statement due to user request"}))
+	assert.False(t, isStatementTimeout(&pq.Error{Code: "40P01", Message: "deadlock detected"}))
+	assert.False(t, isStatementTimeout(context.DeadlineExceeded))
+}
+
+func TestAsyncWrite_RetriesAndCountsStatementTimeouts(t *testing.T) {
+	before := testutil.ToFloat64(pgStatementTimeoutsTotal.WithLabelValues("preflight"))
+
+	attempts := 0
+	l := &Ledger{log: zerolog.Nop(), writeRetryBackoff: time.Millisecond}
+	l.applyWrite = func(op writeOp) error {
+		attempts++
+		if attempts == 1 {
+			return &pq.Error{Code: pqQueryCanceled, Message: "canceling statement due to statement timeout"}
+		}
+		return nil
+	}
+	l.startWriteWorkers(1, 10)
+
+	require.True(t, l.enqueueWrite(writeOp{opType: "preflight", customerID: "cus_1"}))
+	report := l.drainWriteQueues()
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int64(1), report.Drained)
+	assert.Equal(t, before+1, testutil.ToFloat64(pgStatementTimeoutsTotal.WithLabelValues("preflight")))
+}
+
+// TestIntegration_StatementTimeoutAbortsSlowQuery needs a real PostgreSQL server; set
+// TEST_POSTGRES_URL to run it.
+func TestIntegration_StatementTimeoutAbortsSlowQuery(t *testing.T) {
+	postgresURL := os.Getenv("TEST_POSTGRES_URL")
+	if postgresURL == "" {
+		t.Skip("TEST_POSTGRES_URL not set")
+	}
+
+	db, err := openPostgres(postgresURL, 200*time.Millisecond, "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Now()
+	_, err = db.ExecContext(context.Background(), "SELECT pg_sleep(5)")
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	assert.True(t, isStatementTimeout(err), "unexpected error: %v", err)
+	assert.Less(t, elapsed, 2*time.Second, "query should be cancelled at the statement timeout")
+}
@@ -0,0 +1,236 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultFinalizeTimeout is how long a request may stay unfinalized before
+// the orphan sweeper abandons it.
+const DefaultFinalizeTimeout = 30 * time.Minute
+
+// orphanSweepBatchSize caps how many requests one sweep looks at.
+const orphanSweepBatchSize = 500
+
+// sweepCursor is the last request an orphan sweep looked at, in the
+// sweep's (created_at, request_id) order. The zero value starts from the
+// oldest request.
+type sweepCursor struct {
+	createdAt time.Time
+	requestID string
+}
+
+// WithFinalizeTimeout sets how long a reserved request may go without
+// FinalizeRequest or CancelRequest before the orphan sweeper abandons it.
+// Request hashes in Redis are kept for twice this long, so the sweeper
+// always sees them. Defaults to DefaultFinalizeTimeout.
+func WithFinalizeTimeout(d time.Duration) Option {
+	return func(l *Ledger) {
+		l.finalizeTimeout = d
+	}
+}
+
+// finalizeTimeoutOrDefault returns the configured finalize timeout.
+func (l *Ledger) finalizeTimeoutOrDefault() time.Duration {
+	if l.finalizeTimeout <= 0 {
+		return DefaultFinalizeTimeout
+	}
+	return l.finalizeTimeout
+}
+
+// requestTTL is how long a request hash lives in Redis without finalization.
+func (l *Ledger) requestTTL() time.Duration {
+	return 2 * l.finalizeTimeoutOrDefault()
+}
+
+// orphanSweeper periodically abandons requests older than the finalize
+// timeout until Close.
+func (l *Ledger) orphanSweeper(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			swept, err := l.SweepOrphanRequests(ctx, l.finalizeTimeoutOrDefault())
+			if err != nil {
+				l.log.Warn().Err(err).Msg("orphan request sweep failed")
+			} else if swept > 0 {
+				l.log.Info().Int("swept", swept).Msg("orphan requests abandoned")
+			}
+			cancel()
+
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// SweepOrphanRequests abandons requests that have been in flight
+// ('preflight_approved' or 'streaming') in PostgreSQL for longer than
+// olderThan. Returns how many were abandoned.
+//
+// While the request hash still exists in Redis, its reservation is released
+// and the request is finalized with status 'abandoned' and a cost of what was
+// deducted while streaming, through the usual async finalization write. A
+// request whose hash is gone (expired, or cancelled with the PostgreSQL write
+// still pending) can't be reconciled, so its row is just marked 'abandoned'.
+//
+// A request already finalized in Redis keeps its in-flight row until its
+// PostgreSQL write lands, so each sweep resumes after the last request the
+// previous one looked at rather than starting over: a full batch of such
+// rows would otherwise hide every orphan behind them. Once a sweep reaches
+// the newest candidates, the next one starts again from the oldest.
+//
+// Safe to run from several instances at once: the Redis side is a single
+// script that only abandons in-flight requests.
+func (l *Ledger) SweepOrphanRequests(ctx context.Context, olderThan time.Duration) (int, error) {
+	l.sweepMu.Lock()
+	defer l.sweepMu.Unlock()
+
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT request_id, customer_id, COALESCE(model, ''), created_at
+		FROM requests
+		WHERE status IN ('preflight_approved', 'streaming')
+		  AND created_at < NOW() - $1 * INTERVAL '1 second'
+		  AND (created_at, request_id) > ($3, $4)
+		ORDER BY created_at, request_id
+		LIMIT $2
+	`, int64(olderThan.Seconds()), orphanSweepBatchSize, l.sweepCursor.createdAt, l.sweepCursor.requestID)
+	if err != nil {
+		return 0, fmt.Errorf("query orphan requests failed: %w", err)
+	}
+	defer rows.Close()
+
+	type orphan struct {
+		requestID, customerID, model string
+		createdAt                    time.Time
+	}
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.requestID, &o.customerID, &o.model, &o.createdAt); err != nil {
+			return 0, fmt.Errorf("scan failed: %w", err)
+		}
+		orphans = append(orphans, o)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("row iteration error: %w", err)
+	}
+	rows.Close()
+
+	if len(orphans) < orphanSweepBatchSize {
+		l.sweepCursor = sweepCursor{}
+	} else {
+		last := orphans[len(orphans)-1]
+		l.sweepCursor = sweepCursor{createdAt: last.createdAt, requestID: last.requestID}
+	}
+
+	swept := 0
+	for _, o := range orphans {
+		abandoned, err := l.abandonRequest(ctx, o.customerID, o.requestID, o.model)
+		if err != nil {
+			l.log.Error().Err(err).
+				Str("customer_id", o.customerID).
+				Str("request_id", o.requestID).
+				Msg("failed to abandon orphan request")
+			continue
+		}
+		if abandoned {
+			swept++
+		}
+	}
+
+	return swept, nil
+}
+
+// abandonRequest abandons one orphan request. Returns false if it turned out
+// to be finalized already.
+func (l *Ledger) abandonRequest(ctx context.Context, customerID, requestID, model string) (bool, error) {
+	currency, err := l.customerCurrency(ctx, customerID, "")
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{
+		reservedKey(customerID, currency),
+		fmt.Sprintf("request:%s", requestID),
+		totalReservedKey,
+		reservedLowKey(customerID, currency),
+		inflightKey(customerID),
+	}
+
+	result, err := l.abandonRequestScript.Run(ctx, l.redis, keys, int64(l.terminalRequestTTL("abandoned").Seconds())).Result()
+	if err != nil {
+		return false, scriptError(err)
+	}
+
+	// Parse result: {success, released, consumed, code}
+	resultArray := result.([]interface{})
+	code, _ := resultArray[3].(string)
+
+	switch {
+	case resultArray[0].(int64) != 1:
+		// Nothing left in Redis to release or reconcile against
+		_, err := l.db.ExecContext(ctx, `
+			UPDATE requests SET
+				status = 'abandoned',
+				kill_reason = 'not_finalized',
+				completed_at = NOW()
+			WHERE request_id = $1
+			  AND status IN ('preflight_approved', 'streaming')
+		`, requestID)
+		if err != nil {
+			return false, fmt.Errorf("mark abandoned failed: %w", err)
+		}
+
+		l.log.Warn().
+			Str("customer_id", customerID).
+			Str("request_id", requestID).
+			Str("error_code", code).
+			Msg("orphan request abandoned without redis state, its reservation may have leaked")
+		return true, nil
+
+	case code == "ALREADY_TERMINAL":
+		// Finalized in Redis; the PostgreSQL write is queued or dead-lettered
+		return false, nil
+	}
+
+	consumed := resultArray[2].(int64)
+
+	l.log.Warn().
+		Str("customer_id", customerID).
+		Str("request_id", requestID).
+		Int64("released", resultArray[1].(int64)).
+		Int64("consumed", consumed).
+		Msg("orphan request abandoned")
+
+	l.trace(requestID, traceStageAbandon).
+		Str("customer_id", customerID).
+		Int64("released", resultArray[1].(int64)).
+		Int64("consumed", consumed).
+		Msg("request trace")
+
+	err = l.persist(writeOp{
+		opType:     "finalization",
+		customerID: customerID,
+		data: FinalizationRequest{
+			CustomerID:       customerID,
+			RequestID:        requestID,
+			Status:           "abandoned",
+			ActualCostGrains: consumed,
+			Model:            model,
+			Currency:         currency,
+		},
+		ctx: context.Background(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
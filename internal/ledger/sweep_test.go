@@ -0,0 +1,146 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepOrphanRequests_AbandonsOldUnfinalizedRequest(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set(totalBalanceKey, "1000")
+
+	// Reserved, streamed a little, then the client went away.
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID:     "cus_1",
+		RequestID:      "req_old",
+		ReservedGrains: 500,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	<-l.writeQueues[0] // preflight
+
+	ttl := mr.TTL("request:req_old")
+	assert.Equal(t, 2*DefaultFinalizeTimeout, ttl)
+
+	_, err = l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_old", GrainAmount: 120})
+	require.NoError(t, err)
+
+	created := time.Now().Add(-time.Hour)
+	mock.ExpectQuery("FROM requests").
+		WithArgs(int64(1800), orphanSweepBatchSize, time.Time{}, "").
+		WillReturnRows(sqlmock.NewRows([]string{"request_id", "customer_id", "model", "created_at"}).
+			AddRow("req_old", "cus_1", "gpt-4", created).
+			AddRow("req_expired", "cus_1", "gpt-4", created))
+	// req_expired has no hash left; its row is just marked abandoned.
+	mock.ExpectExec("UPDATE requests SET").
+		WithArgs("req_expired").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	swept, err := l.SweepOrphanRequests(ctx, 30*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 2, swept)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// The reservation is released; the streamed grains stay spent.
+	balance, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Equal(t, int64(0), reserved)
+	assert.Equal(t, "abandoned", mr.HGet("request:req_old", "status"))
+	assert.Equal(t, DefaultTerminalRequestTTL, mr.TTL("request:req_old"))
+
+	_, totalReserved, err := l.GetTotals(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), totalReserved)
+
+	require.Len(t, l.writeQueues[0], 1)
+	op := <-l.writeQueues[0]
+	assert.Equal(t, "finalization", op.opType)
+	fin := op.data.(FinalizationRequest)
+	assert.Equal(t, "abandoned", fin.Status)
+	assert.Equal(t, int64(120), fin.ActualCostGrains)
+	assert.Equal(t, "gpt-4", fin.Model)
+
+	// A late finalize is a no-op rather than releasing the reservation twice.
+	late, err := l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID:       "cus_1",
+		RequestID:        "req_old",
+		Status:           "completed",
+		ActualCostGrains: 200,
+	})
+	require.NoError(t, err)
+	assert.True(t, late.Success)
+	assert.True(t, late.AlreadyFinalized)
+	assert.Equal(t, int64(0), late.RefundedGrains)
+	assert.Empty(t, l.writeQueues[0])
+
+	balance, reserved, _, _, err = l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(880), balance)
+	assert.Equal(t, int64(0), reserved)
+}
+
+func TestSweepOrphanRequests_PagesPastRequestsFinalizedInRedis(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	// A full batch of requests finalized in Redis whose PostgreSQL writes
+	// haven't landed, all older than the one real orphan
+	created := time.Now().Add(-2 * time.Hour)
+	first := sqlmock.NewRows([]string{"request_id", "customer_id", "model", "created_at"})
+	var lastID string
+	var lastCreated time.Time
+	for i := 0; i < orphanSweepBatchSize; i++ {
+		lastID = fmt.Sprintf("req_%03d", i)
+		lastCreated = created.Add(time.Duration(i) * time.Second)
+		mr.HSet("request:"+lastID, "customer_id", "cus_1", "status", "completed")
+		first.AddRow(lastID, "cus_1", "gpt-4", lastCreated)
+	}
+
+	mock.ExpectQuery("FROM requests").
+		WithArgs(int64(1800), orphanSweepBatchSize, time.Time{}, "").
+		WillReturnRows(first)
+	swept, err := l.SweepOrphanRequests(ctx, 30*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, swept)
+
+	// The next sweep resumes after them and reaches the orphan
+	mock.ExpectQuery("FROM requests").
+		WithArgs(int64(1800), orphanSweepBatchSize, lastCreated, lastID).
+		WillReturnRows(sqlmock.NewRows([]string{"request_id", "customer_id", "model", "created_at"}).
+			AddRow("req_orphan", "cus_1", "gpt-4", time.Now().Add(-time.Hour)))
+	mock.ExpectExec("UPDATE requests SET").
+		WithArgs("req_orphan").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	swept, err = l.SweepOrphanRequests(ctx, 30*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, swept)
+
+	// That was the end, so the one after starts from the oldest again
+	mock.ExpectQuery("FROM requests").
+		WithArgs(int64(1800), orphanSweepBatchSize, time.Time{}, "").
+		WillReturnRows(sqlmock.NewRows([]string{"request_id", "customer_id", "model", "created_at"}))
+	swept, err = l.SweepOrphanRequests(ctx, 30*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, swept)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,153 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrites_AsyncByDefault(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	l.applyWrite = func(op writeOp) error {
+		t.Fatalf("unexpected inline %s write", op.opType)
+		return nil
+	}
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 100})
+	require.NoError(t, err)
+
+	require.Len(t, l.writeQueues[0], 2)
+	assert.Equal(t, "preflight", (<-l.writeQueues[0]).opType)
+	assert.Equal(t, "finalization", (<-l.writeQueues[0]).opType)
+}
+
+func TestWrites_Sync(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithSyncWrites(true)(l)
+
+	mr.Set("customer:balance:cus_1", "1000")
+	var applied []string
+	l.applyWrite = func(op writeOp) error {
+		applied = append(applied, op.opType)
+		return nil
+	}
+
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"preflight"}, applied, "written before the call returns")
+
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 100})
+	require.NoError(t, err)
+	_, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 300})
+	require.NoError(t, err)
+	_, err = l.CancelRequest(ctx, "cus_1", "req_2")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"preflight", "finalization", "preflight", "cancellation"}, applied)
+	assert.Empty(t, l.writeQueues[0])
+}
+
+func TestWrites_SyncReservationFailureRollsBack(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithSyncWrites(true)(l)
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.HSet("customer:config:cus_1", "max_concurrent_requests", "1")
+	dbDown := errors.New("connection refused")
+	l.applyWrite = func(op writeOp) error { return dbDown }
+	l.deadLetter = func(op writeOp, cause error) error {
+		t.Fatalf("a rolled back reservation must not be dead-lettered")
+		return nil
+	}
+
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300, Priority: PriorityLow,
+	})
+	require.ErrorIs(t, err, ErrWriteFailed)
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Nil(t, res)
+
+	// Nothing is left held
+	_, reserved, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, reserved)
+	_, totalReserved, err := l.GetTotals(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, totalReserved)
+	assert.False(t, mr.Exists("request:req_1"))
+	n, err := l.InflightRequests(ctx, "cus_1")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// Once PostgreSQL is back the same request goes through
+	l.applyWrite = func(op writeOp) error { return nil }
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+}
+
+func TestWrites_SyncFinalizationFailureIsDeadLettered(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithSyncWrites(true)(l)
+
+	mr.Set("customer:balance:cus_1", "1000")
+	l.applyWrite = func(op writeOp) error { return nil }
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+
+	l.applyWrite = func(op writeOp) error { return errors.New("connection refused") }
+	var deadLettered []writeOp
+	l.deadLetter = func(op writeOp, cause error) error {
+		deadLettered = append(deadLettered, op)
+		return nil
+	}
+
+	res, err := l.FinalizeRequest(ctx, FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 100})
+	require.ErrorIs(t, err, ErrWriteFailed)
+	assert.Nil(t, res)
+
+	// Redis can't be rolled back, so the write is kept for replay
+	assert.Equal(t, "completed", mr.HGet("request:req_1", "status"))
+	require.Len(t, deadLettered, 1)
+	assert.Equal(t, "finalization", deadLettered[0].opType)
+	assert.Equal(t, int64(100), deadLettered[0].data.(FinalizationRequest).ActualCostGrains)
+}
+
+func TestWriteRetryDelay(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithSyncWrites(true)(l)
+	l.writeRetryBackoff = time.Second
+
+	mr.Set("customer:balance:cus_1", "1000")
+	assert.Zero(t, l.WriteRetryDelay())
+
+	l.applyWrite = func(op writeOp) error { return errors.New("connection refused") }
+	var delays []time.Duration
+	for i := 0; i < 7; i++ {
+		_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100})
+		require.ErrorIs(t, err, ErrWriteFailed)
+		delays = append(delays, l.WriteRetryDelay())
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		maxWriteRetryDelay, maxWriteRetryDelay,
+	}, delays)
+
+	l.applyWrite = func(op writeOp) error { return nil }
+	_, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.Zero(t, l.WriteRetryDelay(), "a successful write resets the backoff")
+}
@@ -0,0 +1,135 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultTopSpenders is how many customers TopSpenders returns when
+	// asked for none.
+	DefaultTopSpenders = 10
+
+	// DefaultTopSpendersWindow is the window TopSpenders ranks by when
+	// given none.
+	DefaultTopSpendersWindow = time.Hour
+
+	// MaxTopSpendersWindow is the longest window TopSpenders can rank by:
+	// older spend has expired.
+	MaxTopSpendersWindow = 24 * time.Hour
+
+	// spendBucket is the span of time each spend sorted set covers.
+	spendBucket = time.Minute
+)
+
+// ErrInvalidSpendWindow is returned by TopSpenders for a window longer than
+// MaxTopSpendersWindow.
+var ErrInvalidSpendWindow = errors.New("invalid spend window")
+
+// CustomerSpend is a customer's finalized spend over a window.
+type CustomerSpend struct {
+	CustomerID string `json:"customer_id"`
+
+	// SpentGrains is in USD grains, so customers in different currencies
+	// rank together
+	SpentGrains int64 `json:"spent_grains"`
+}
+
+// spendKey returns the Redis key of the sorted set of spend per customer
+// finalized in the spendBucket starting at bucket.
+func spendKey(bucket time.Time) string {
+	return fmt.Sprintf("system:spend:%d", bucket.Unix())
+}
+
+// recordCustomerSpend adds a finalized request's cost, in USD grains, to
+// its customer's score in the current spend bucket. It is best effort: a
+// failure is logged and the finalization stands.
+func (l *Ledger) recordCustomerSpend(req FinalizationRequest) {
+	if req.ActualCostGrains <= 0 {
+		return
+	}
+
+	rate, err := l.GetCurrencyRate(req.Currency)
+	if err != nil || rate <= 0 {
+		l.log.Warn().Err(err).
+			Str("currency", req.Currency).
+			Str("request_id", req.RequestID).
+			Msg("customer spend not recorded, no currency rate")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := spendKey(time.Now().Truncate(spendBucket))
+	pipe := l.redis.Pipeline()
+	pipe.ZIncrBy(ctx, key, float64(req.ActualCostGrains)/rate, req.CustomerID)
+	pipe.Expire(ctx, key, MaxTopSpendersWindow+spendBucket)
+	if _, err := pipe.Exec(ctx); err != nil {
+		l.log.Warn().Err(err).
+			Str("customer_id", req.CustomerID).
+			Str("request_id", req.RequestID).
+			Msg("failed to record customer spend")
+	}
+}
+
+// TopSpenders returns the n customers who spent the most over the last
+// window, highest first, as finalizations recorded it in Redis. n <= 0
+// means DefaultTopSpenders and window <= 0 DefaultTopSpendersWindow.
+//
+// Spend is kept in one sorted set per minute, so the window is rounded up
+// to whole minutes, the current one included. The minutes are merged with
+// ZUNIONSTORE into a temporary key and ranked with ZREVRANGE, which is cheap
+// enough to call while investigating a cost spike.
+func (l *Ledger) TopSpenders(ctx context.Context, n int, window time.Duration) ([]CustomerSpend, error) {
+	if n <= 0 {
+		n = DefaultTopSpenders
+	}
+	if window <= 0 {
+		window = DefaultTopSpendersWindow
+	}
+	if window > MaxTopSpendersWindow {
+		return nil, fmt.Errorf("%w: %s is longer than %s", ErrInvalidSpendWindow, window, MaxTopSpendersWindow)
+	}
+
+	current := time.Now().Truncate(spendBucket)
+	buckets := int((window + spendBucket - 1) / spendBucket)
+	keys := make([]string, buckets)
+	for i := range keys {
+		keys[i] = spendKey(current.Add(-time.Duration(i) * spendBucket))
+	}
+
+	var ranked []redis.Z
+	if len(keys) == 1 {
+		var err error
+		ranked, err = l.redis.ZRevRangeWithScores(ctx, keys[0], 0, int64(n-1)).Result()
+		if err != nil {
+			return nil, redisError("zrevrange", err)
+		}
+	} else {
+		dest := "system:spend:top:" + uuid.New().String()
+		pipe := l.redis.TxPipeline()
+		pipe.ZUnionStore(ctx, dest, &redis.ZStore{Keys: keys})
+		rangeCmd := pipe.ZRevRangeWithScores(ctx, dest, 0, int64(n-1))
+		pipe.Del(ctx, dest)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, redisError("zunionstore", err)
+		}
+		ranked = rangeCmd.Val()
+	}
+
+	spenders := make([]CustomerSpend, len(ranked))
+	for i, z := range ranked {
+		spenders[i] = CustomerSpend{
+			CustomerID:  fmt.Sprint(z.Member),
+			SpentGrains: int64(math.Round(z.Score)),
+		}
+	}
+	return spenders, nil
+}
@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopSpenders_UpdatedByFinalization(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	spend := func(customerID, requestID string, cost int64) {
+		t.Helper()
+		mr.Set("customer:balance:"+customerID, "100000")
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: customerID, RequestID: requestID, ReservedGrains: cost})
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+		fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+			CustomerID: customerID, RequestID: requestID, Status: "completed", ActualCostGrains: cost,
+		})
+		require.NoError(t, err)
+		require.True(t, fin.Success)
+	}
+
+	spend("cus_a", "req_1", 300)
+	spend("cus_b", "req_2", 500)
+	spend("cus_c", "req_3", 100)
+
+	top, err := l.TopSpenders(ctx, 2, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []CustomerSpend{
+		{CustomerID: "cus_b", SpentGrains: 500},
+		{CustomerID: "cus_a", SpentGrains: 300},
+	}, top)
+
+	// cus_a overtakes cus_b
+	spend("cus_a", "req_4", 400)
+	top, err = l.TopSpenders(ctx, 2, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []CustomerSpend{
+		{CustomerID: "cus_a", SpentGrains: 700},
+		{CustomerID: "cus_b", SpentGrains: 500},
+	}, top)
+
+	// A retried finalization isn't counted twice
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_c", RequestID: "req_3", Status: "completed", ActualCostGrains: 100,
+	})
+	require.NoError(t, err)
+	top, err = l.TopSpenders(ctx, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, top, 3)
+	assert.Equal(t, CustomerSpend{CustomerID: "cus_c", SpentGrains: 100}, top[2])
+}
+
+func TestTopSpenders_Window(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	now := time.Now().Truncate(spendBucket)
+	mr.ZAdd(spendKey(now), 100, "cus_a")
+	mr.ZAdd(spendKey(now.Add(-30*time.Minute)), 250, "cus_a")
+	mr.ZAdd(spendKey(now.Add(-30*time.Minute)), 300, "cus_b")
+	mr.ZAdd(spendKey(now.Add(-3*time.Hour)), 1000, "cus_c")
+
+	top, err := l.TopSpenders(ctx, 10, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []CustomerSpend{
+		{CustomerID: "cus_a", SpentGrains: 350},
+		{CustomerID: "cus_b", SpentGrains: 300},
+	}, top)
+
+	top, err = l.TopSpenders(ctx, 10, 6*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, top, 3)
+	assert.Equal(t, "cus_c", top[0].CustomerID)
+
+	// The temporary union is cleaned up
+	for _, key := range mr.Keys() {
+		assert.NotContains(t, key, "system:spend:top:")
+	}
+
+	_, err = l.TopSpenders(ctx, 10, 48*time.Hour)
+	assert.ErrorIs(t, err, ErrInvalidSpendWindow)
+}
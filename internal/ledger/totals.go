@@ -0,0 +1,71 @@
+package ledger
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// System-wide aggregates, maintained atomically by the Lua scripts alongside
+// every change to a customer's balance or reserved counter, and reset by a
+// full sync (sync.InitializeRedis). Reading two keys is far cheaper than
+// SCANning every customer:* key.
+//
+// The totals add grains across all currencies as-is; they measure load on
+// the ledger, not money.
+const (
+	totalBalanceKey  = "system:total_balance"
+	totalReservedKey = "system:total_reserved"
+)
+
+// GetTotals returns the sum of all customer balances and reserved counters.
+func (l *Ledger) GetTotals(ctx context.Context) (balance int64, reserved int64, err error) {
+	pipe := l.redis.Pipeline()
+	balanceCmd := pipe.Get(ctx, totalBalanceKey)
+	reservedCmd := pipe.Get(ctx, totalReservedKey)
+	_, err = pipe.Exec(ctx)
+
+	if err != nil && err != redis.Nil {
+		return 0, 0, redisError("pipeline", err)
+	}
+
+	balance, _ = balanceCmd.Int64()
+	reserved, _ = reservedCmd.Int64()
+
+	return balance, reserved, nil
+}
+
+// refreshTotals copies the current aggregates into the Prometheus gauges.
+func (l *Ledger) refreshTotals(ctx context.Context) error {
+	balance, reserved, err := l.GetTotals(ctx)
+	if err != nil {
+		return err
+	}
+
+	totalBalanceGrains.Set(float64(balance))
+	totalReservedGrains.Set(float64(reserved))
+	return nil
+}
+
+// totalsCollector refreshes the totals gauges every interval until Close.
+func (l *Ledger) totalsCollector(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := l.refreshTotals(ctx); err != nil {
+				l.log.Warn().Err(err).Msg("failed to refresh system totals")
+			}
+			cancel()
+
+		case <-l.done:
+			return
+		}
+	}
+}
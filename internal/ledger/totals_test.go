@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTotals_ReservationsMoveGauges(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_1", "1000")
+	mr.Set("customer:balance:cus_2", "500")
+	mr.Set(totalBalanceKey, "1500")
+
+	require.NoError(t, l.refreshTotals(ctx))
+	assert.Equal(t, float64(1500), testutil.ToFloat64(totalBalanceGrains))
+	assert.Equal(t, float64(0), testutil.ToFloat64(totalReservedGrains))
+
+	for _, r := range []ReservationRequest{
+		{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 300},
+		{CustomerID: "cus_2", RequestID: "req_2", ReservedGrains: 200},
+	} {
+		res, err := l.CheckAndReserveBalance(ctx, r)
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+	}
+
+	require.NoError(t, l.refreshTotals(ctx))
+	assert.Equal(t, float64(500), testutil.ToFloat64(totalReservedGrains))
+
+	// Streaming deducts from the balance total.
+	_, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: "req_1", GrainAmount: 100})
+	require.NoError(t, err)
+
+	// Finalizing at a higher actual cost charges the difference and releases
+	// the whole reservation.
+	_, err = l.FinalizeRequest(ctx, FinalizationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 250,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, l.refreshTotals(ctx))
+	assert.Equal(t, float64(200), testutil.ToFloat64(totalReservedGrains))
+	assert.Equal(t, float64(1250), testutil.ToFloat64(totalBalanceGrains))
+
+	// The aggregate agrees with the per-customer keys.
+	b1, r1, _, _, err := l.GetBalance(ctx, "cus_1")
+	require.NoError(t, err)
+	b2, r2, _, _, err := l.GetBalance(ctx, "cus_2")
+	require.NoError(t, err)
+	assert.Equal(t, float64(b1+b2), testutil.ToFloat64(totalBalanceGrains))
+	assert.Equal(t, float64(r1+r2), testutil.ToFloat64(totalReservedGrains))
+}
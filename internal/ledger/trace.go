@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+// Lifecycle stages logged for traced requests (see WithTraceSampleFraction).
+const (
+	traceStageReserve  = "reserve"
+	traceStageDeduct   = "deduct"
+	traceStageFinalize = "finalize"
+	traceStageRefund   = "refund"
+	traceStageCancel   = "cancel"
+	traceStageAbandon  = "abandon"
+	traceStageRelease  = "release"
+)
+
+// WithTraceSampleFraction logs the complete lifecycle of a fraction (0 to 1)
+// of requests at info level: the reservation, every deduction, the
+// finalization and any refund, each with the same trace_id. This keeps a
+// representative sample of whole request journeys in production logs
+// without debug logging every token.
+//
+// Whether a request is traced depends only on its request ID, so every call
+// for it, on any instance, makes the same decision. 0 disables tracing.
+func WithTraceSampleFraction(f float64) Option {
+	return func(l *Ledger) {
+		l.traceSampleFraction = f
+	}
+}
+
+// trace starts the trace log event for one stage of a request, or returns
+// nil if the request isn't sampled. zerolog treats a nil event as disabled,
+// so callers can chain fields and Msg unconditionally.
+func (l *Ledger) trace(requestID, stage string) *zerolog.Event {
+	if l.traceSampleFraction <= 0 {
+		return nil
+	}
+
+	// FNV and friends cluster similar IDs (req_1, req_2, ...), which would
+	// trace runs of sequential requests or none of them
+	digest := sha256.Sum256([]byte(requestID))
+	sum := binary.BigEndian.Uint64(digest[:8])
+
+	// The top 53 bits as a uniform float in [0, 1)
+	if float64(sum>>11)/(1<<53) >= l.traceSampleFraction {
+		return nil
+	}
+
+	return l.log.Info().
+		Str("trace_id", fmt.Sprintf("%016x", sum)).
+		Str("request_id", requestID).
+		Str("stage", stage)
+}
@@ -0,0 +1,69 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace_SampledRequestLogsWholeLifecycle(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	l.log = zerolog.New(&buf)
+	WithTraceSampleFraction(0.5)(l)
+
+	mr.Set("customer:balance:cus_1", "10000")
+
+	// At 0.5, req_2 hashes into the sample and req_1 doesn't.
+	for _, requestID := range []string{"req_1", "req_2"} {
+		res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{
+			CustomerID: "cus_1", RequestID: requestID, ReservedGrains: 500, EstimatedGrains: 400,
+		})
+		require.NoError(t, err)
+		require.True(t, res.Approved)
+
+		for i := 0; i < 3; i++ {
+			_, err := l.DeductGrains(ctx, DeductionRequest{CustomerID: "cus_1", RequestID: requestID, GrainAmount: 100})
+			require.NoError(t, err)
+		}
+
+		fin, err := l.FinalizeRequest(ctx, FinalizationRequest{
+			CustomerID: "cus_1", RequestID: requestID, Status: "completed", ActualCostGrains: 250,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(50), fin.RefundedGrains)
+	}
+
+	var stages []string
+	traceIDs := map[string]bool{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line struct {
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+			TraceID   string `json:"trace_id"`
+			Stage     string `json:"stage"`
+			Level     string `json:"level"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		if line.Message != "request trace" {
+			continue
+		}
+		assert.Equal(t, "req_2", line.RequestID, "req_1 is not sampled")
+		assert.Equal(t, "info", line.Level)
+		stages = append(stages, line.Stage)
+		traceIDs[line.TraceID] = true
+	}
+
+	assert.Equal(t, []string{"reserve", "deduct", "deduct", "deduct", "finalize", "refund"}, stages)
+	assert.Len(t, traceIDs, 1, "every stage shares one trace_id")
+	assert.NotContains(t, traceIDs, "")
+}
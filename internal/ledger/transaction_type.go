@@ -0,0 +1,177 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TransactionType categorizes a row in the transactions table.
+//
+// The set is closed: the database enforces it with a CHECK constraint
+// (migration 006) and TransactionType refuses to be written or read as
+// anything else, so a typo fails loudly instead of creating a type no
+// report knows about.
+type TransactionType string
+
+const (
+	// TransactionAIUsage is grains consumed by an AI request.
+	// reference_id is the request_id.
+	TransactionAIUsage TransactionType = "ai_usage"
+
+	// TransactionCredit is a top-up (e.g. a Stripe payment).
+	TransactionCredit TransactionType = "credit"
+
+	// TransactionRefund returns grains to a customer.
+	TransactionRefund TransactionType = "refund"
+
+	// TransactionTransferIn and TransactionTransferOut are the two sides of
+	// a move between customers or funding sources.
+	TransactionTransferIn  TransactionType = "transfer_in"
+	TransactionTransferOut TransactionType = "transfer_out"
+
+	// TransactionAdjustment is a manual correction by support or an admin.
+	TransactionAdjustment TransactionType = "adjustment"
+
+	// TransactionReservationLeaked records a reservation that was never
+	// finalized or cancelled and had to be written off.
+	TransactionReservationLeaked TransactionType = "reservation_leaked"
+
+	// TransactionOpeningBalance is the balance a customer was created with
+	// (see CreateCustomer).
+	TransactionOpeningBalance TransactionType = "opening_balance"
+
+	// TransactionRefundWithheld is the part of an overestimated request's
+	// refund that the customer's refund policy kept (see RefundPolicyNone).
+	// reference_id is the request_id.
+	TransactionRefundWithheld TransactionType = "refund_withheld"
+
+	// TransactionShortfallDebt is the part of an underestimated request's
+	// cost that its balance couldn't cover and was added to the customer's
+	// debt instead (see ShortfallPolicyDebt). It offsets that part of the
+	// request's ai_usage. reference_id is the request_id.
+	TransactionShortfallDebt TransactionType = "shortfall_debt"
+)
+
+// TransactionTypes lists every valid TransactionType.
+var TransactionTypes = []TransactionType{
+	TransactionAIUsage,
+	TransactionCredit,
+	TransactionRefund,
+	TransactionTransferIn,
+	TransactionTransferOut,
+	TransactionAdjustment,
+	TransactionReservationLeaked,
+	TransactionOpeningBalance,
+	TransactionRefundWithheld,
+	TransactionShortfallDebt,
+}
+
+// ErrUnknownTransactionType is returned for a type outside TransactionTypes.
+var ErrUnknownTransactionType = errors.New("unknown transaction type")
+
+// Valid reports whether t is one of TransactionTypes.
+func (t TransactionType) Valid() bool {
+	for _, known := range TransactionTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTransactionType converts s to a TransactionType, rejecting unknown
+// values.
+func ParseTransactionType(s string) (TransactionType, error) {
+	t := TransactionType(s)
+	if !t.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrUnknownTransactionType, s)
+	}
+	return t, nil
+}
+
+// Value implements driver.Valuer, so an invalid type can't be inserted.
+func (t TransactionType) Value() (driver.Value, error) {
+	if !t.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTransactionType, string(t))
+	}
+	return string(t), nil
+}
+
+// Scan implements sql.Scanner.
+func (t *TransactionType) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into TransactionType", src)
+	}
+
+	parsed, err := ParseTransactionType(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Transaction is one row of the append-only transactions table.
+type Transaction struct {
+	TransactionID string
+	CustomerID    string
+	AmountGrains  int64 // Positive = credit, negative = debit
+	Type          TransactionType
+	ReferenceID   string
+	Description   string
+
+	// Metadata is stored in the JSONB metadata column. Nil means NULL.
+	Metadata []byte
+}
+
+// insertTransaction validates t and appends it to the transactions table.
+// Every transaction write goes through here or insertTransactions.
+func insertTransaction(ctx context.Context, tx *sql.Tx, t Transaction) error {
+	return insertTransactions(ctx, tx, []Transaction{t})
+}
+
+// insertTransactions validates ts and appends them to the transactions table
+// with a single multi-row INSERT. Nothing is inserted if any is invalid.
+//
+// A transaction whose TransactionID is already recorded is skipped, so a
+// write with deterministic IDs (see finalizationTransactionID) can be
+// applied more than once without recording anything twice.
+func insertTransactions(ctx context.Context, tx *sql.Tx, ts []Transaction) error {
+	rows := make([]string, 0, len(ts))
+	args := make([]interface{}, 0, 7*len(ts))
+	for _, t := range ts {
+		if !t.Type.Valid() {
+			return fmt.Errorf("%w: %q", ErrUnknownTransactionType, string(t.Type))
+		}
+
+		var metadata interface{}
+		if len(t.Metadata) > 0 {
+			metadata = string(t.Metadata)
+		}
+
+		n := len(args)
+		rows = append(rows, fmt.Sprintf("($%d, $%d, $%d, $%d, NULLIF($%d, ''), $%d, $%d, NOW())",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+		args = append(args, t.TransactionID, t.CustomerID, t.AmountGrains,
+			t.Type, t.ReferenceID, t.Description, metadata)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO transactions (
+			transaction_id, customer_id, amount_grains,
+			transaction_type, reference_id, description, metadata, created_at
+		) VALUES `+strings.Join(rows, ", ")+`
+		ON CONFLICT (transaction_id) DO NOTHING`, args...)
+
+	return err
+}
@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionType_KnownTypesRoundTrip(t *testing.T) {
+	for _, typ := range TransactionTypes {
+		parsed, err := ParseTransactionType(string(typ))
+		require.NoError(t, err)
+		assert.Equal(t, typ, parsed)
+
+		v, err := typ.Value()
+		require.NoError(t, err)
+
+		var scanned TransactionType
+		require.NoError(t, scanned.Scan([]byte(v.(string))))
+		assert.Equal(t, typ, scanned)
+	}
+}
+
+func TestTransactionType_RejectsUnknown(t *testing.T) {
+	_, err := ParseTransactionType("admin_adjustment")
+	assert.ErrorIs(t, err, ErrUnknownTransactionType)
+
+	var scanned TransactionType
+	assert.ErrorIs(t, scanned.Scan("stripe_payment"), ErrUnknownTransactionType)
+
+	_, err = TransactionType("bogus").Value()
+	assert.ErrorIs(t, err, ErrUnknownTransactionType)
+}
+
+func TestInsertTransaction_ValidatesType(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs("tx_1", "cus_1", int64(-500), "ai_usage", "req_1", "usage", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	// An unknown type is rejected before reaching the database.
+	err = insertTransaction(ctx, tx, Transaction{
+		TransactionID: "tx_0",
+		CustomerID:    "cus_1",
+		AmountGrains:  -500,
+		Type:          "usage",
+	})
+	assert.ErrorIs(t, err, ErrUnknownTransactionType)
+
+	require.NoError(t, insertTransaction(ctx, tx, Transaction{
+		TransactionID: "tx_1",
+		CustomerID:    "cus_1",
+		AmountGrains:  -500,
+		Type:          TransactionAIUsage,
+		ReferenceID:   "req_1",
+		Description:   "usage",
+	}))
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
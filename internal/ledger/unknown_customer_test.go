@@ -0,0 +1,85 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAndReserve_UnknownVersusZeroBalance(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	mr.Set("customer:balance:cus_zero", "0")
+
+	// Synced with nothing left: a balance problem
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_zero", RequestID: "req_1", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+	assert.Equal(t, int64(100), res.ShortfallGrains)
+
+	// Never synced: not a balance problem at all
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_unsynced", RequestID: "req_2", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionCustomerNotFound, res.RejectionReason)
+	assert.Zero(t, res.ShortfallGrains)
+	assert.False(t, mr.Exists("request:req_2"))
+	assert.False(t, mr.Exists("customer:reserved:cus_unsynced"))
+
+	// Without WithUnknownCustomerSync the loader isn't used
+	l.loadBalance = func(ctx context.Context, customerID string) error {
+		t.Fatalf("unexpected sync of %s", customerID)
+		return nil
+	}
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_unsynced", RequestID: "req_3", ReservedGrains: 100})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionCustomerNotFound, res.RejectionReason)
+}
+
+func TestCheckAndReserve_UnknownCustomerSync(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+	WithUnknownCustomerSync(true)(l)
+
+	var loaded []string
+	l.loadBalance = func(ctx context.Context, customerID string) error {
+		loaded = append(loaded, customerID)
+		if customerID == "cus_missing" {
+			return errors.New("customer not found: cus_missing")
+		}
+		mr.Set("customer:balance:"+customerID, "1000")
+		mr.HSet("customer:config:"+customerID, "currency", "USD")
+		return nil
+	}
+
+	// Synced on demand, then reserved
+	res, err := l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_new", RequestID: "req_1", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.True(t, res.Approved)
+	assert.Equal(t, int64(700), res.RemainingBalance)
+	assert.Equal(t, []string{"cus_new"}, loaded)
+
+	// Known now, so no second sync
+	_, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_new", RequestID: "req_2", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cus_new"}, loaded)
+
+	// Not in PostgreSQL either: one attempt, then rejected
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_missing", RequestID: "req_3", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.False(t, res.Approved)
+	assert.Equal(t, RejectionCustomerNotFound, res.RejectionReason)
+	assert.Equal(t, []string{"cus_new", "cus_missing"}, loaded)
+
+	// A zero balance never triggers a sync
+	mr.Set("customer:balance:cus_zero", "0")
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{CustomerID: "cus_zero", RequestID: "req_4", ReservedGrains: 300})
+	require.NoError(t, err)
+	assert.Equal(t, RejectionInsufficientBalance, res.RejectionReason)
+	assert.Equal(t, []string{"cus_new", "cus_missing"}, loaded)
+}
@@ -0,0 +1,158 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultUsageLimit is how many groups UsageByEndUser and UsageByTag
+// return when the filter doesn't set a limit.
+const DefaultUsageLimit = 100
+
+// UsageFilter selects the requests UsageByEndUser and UsageByTag sum up.
+type UsageFilter struct {
+	// CustomerID is required.
+	CustomerID string
+
+	// EndUserID, if set, only sums that end user's requests.
+	EndUserID string
+
+	// From and To bound created_at to [From, To). A zero time leaves that
+	// side open.
+	From time.Time
+	To   time.Time
+
+	// Limit is how many groups to return (DefaultUsageLimit if <= 0).
+	Limit int
+}
+
+// UsageTotals sums a group of requests the way the customer_request_stats
+// view sums a customer's.
+type UsageTotals struct {
+	Requests          int64 `json:"requests"`
+	CompletedRequests int64 `json:"completed_requests"`
+	KilledRequests    int64 `json:"killed_requests"`
+
+	// SpentGrains is the actual cost of the completed and killed requests.
+	SpentGrains int64 `json:"spent_grains"`
+	TotalTokens int64 `json:"total_tokens"`
+}
+
+// EndUserUsage is one end user's requests for a customer, summed up.
+type EndUserUsage struct {
+	EndUserID string `json:"end_user_id"`
+	UsageTotals
+}
+
+// TagUsage is a customer's requests with one value of an attribution tag,
+// summed up. Value is empty for the requests without the tag.
+type TagUsage struct {
+	Value string `json:"value"`
+	UsageTotals
+}
+
+// UsageByEndUser sums a customer's requests per end user (see
+// ReservationRequest.EndUserID), biggest spenders first. Requests made
+// without an end user are left out.
+func (l *Ledger) UsageByEndUser(ctx context.Context, f UsageFilter) ([]EndUserUsage, error) {
+	var usage []EndUserUsage
+	err := l.sumUsage(ctx, f, "end_user_id", nil, []string{"end_user_id IS NOT NULL"},
+		func(key string, totals UsageTotals) {
+			usage = append(usage, EndUserUsage{EndUserID: key, UsageTotals: totals})
+		})
+	if err != nil {
+		return nil, fmt.Errorf("end user usage query failed: %w", err)
+	}
+	if usage == nil {
+		usage = []EndUserUsage{}
+	}
+	return usage, nil
+}
+
+// UsageByTag sums a customer's requests per value of the attribution tag
+// key (see WithAttributionTags), biggest spenders first. Requests without
+// the tag are summed under the empty value, so the spend that isn't
+// attributed shows too. key must be allowlisted, or ErrUnknownTag is
+// returned.
+func (l *Ledger) UsageByTag(ctx context.Context, f UsageFilter, key string) ([]TagUsage, error) {
+	if !l.attributionTags[key] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTag, key)
+	}
+
+	var usage []TagUsage
+	err := l.sumUsage(ctx, f, "COALESCE(tags->>$2, '')", []interface{}{key}, nil,
+		func(value string, totals UsageTotals) {
+			usage = append(usage, TagUsage{Value: value, UsageTotals: totals})
+		})
+	if err != nil {
+		return nil, fmt.Errorf("tag usage query failed: %w", err)
+	}
+	if usage == nil {
+		usage = []TagUsage{}
+	}
+	return usage, nil
+}
+
+// sumUsage sums the requests f selects grouped by the SQL expression group,
+// passing each group to add. group may refer to groupArgs as $2 onwards;
+// conds are extra WHERE conditions.
+func (l *Ledger) sumUsage(ctx context.Context, f UsageFilter, group string, groupArgs []interface{}, conds []string,
+	add func(key string, totals UsageTotals)) error {
+	if f.CustomerID == "" {
+		return fmt.Errorf("customer_id is required")
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultUsageLimit
+	}
+
+	conds = append([]string{"customer_id = $1"}, conds...)
+	args := append([]interface{}{f.CustomerID}, groupArgs...)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.EndUserID != "" {
+		conds = append(conds, "end_user_id = "+arg(f.EndUserID))
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "created_at >= "+arg(f.From.UTC()))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "created_at < "+arg(f.To.UTC()))
+	}
+
+	query := `
+		SELECT ` + group + `,
+		       COUNT(*),
+		       COUNT(*) FILTER (WHERE status = 'completed'),
+		       COUNT(*) FILTER (WHERE status = 'killed'),
+		       COALESCE(SUM(actual_cost_grains) FILTER (WHERE status IN ('completed', 'killed')), 0) AS spent,
+		       COALESCE(SUM(total_tokens), 0)
+		FROM requests
+		WHERE ` + strings.Join(conds, " AND ") + `
+		GROUP BY 1
+		ORDER BY spent DESC, 1
+		LIMIT ` + arg(limit)
+
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var t UsageTotals
+		if err := rows.Scan(&key, &t.Requests, &t.CompletedRequests, &t.KilledRequests,
+			&t.SpentGrains, &t.TotalTokens); err != nil {
+			return err
+		}
+		add(key, t)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,108 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAndReserveBalance_RecordsEndUser(t *testing.T) {
+	l, mr := newTestLedger(t)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	l.db = db
+
+	mr.Set("customer:balance:cus_1", "1000")
+
+	req := ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 100, EstimatedGrains: 80,
+		PlatformUserID: "user_1", EndUserID: "eu_42",
+	}
+	res, err := l.CheckAndReserveBalance(ctx, req)
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Equal(t, "eu_42", mr.HGet("request:req_1", "end_user_id"))
+
+	// Without one, the hash has no end_user_id at all
+	res, err = l.CheckAndReserveBalance(ctx, ReservationRequest{
+		CustomerID: "cus_1", RequestID: "req_2", ReservedGrains: 100, EstimatedGrains: 80,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Approved)
+	assert.Empty(t, mr.HGet("request:req_2", "end_user_id"))
+
+	mock.ExpectExec("INSERT INTO requests").
+		WithArgs("req_1", "cus_1", "user_1", "eu_42", int64(80), int64(100), "preflight_approved", PriorityNormal, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req.Priority = PriorityNormal
+	require.NoError(t, l.writePreflightToDB(ctx, req))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListRequests_EndUserFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`WHERE customer_id = \$1 AND end_user_id = \$2\s+ORDER BY`).
+		WithArgs("cus_1", "eu_42", 11).
+		WillReturnRows(sqlmock.NewRows(listRequestsCols).
+			AddRow("req_1", "eu_42", "gpt-4", "completed", 500, 450, created, nil))
+
+	page, err := l.ListRequests(context.Background(), RequestFilter{CustomerID: "cus_1", EndUserID: "eu_42"})
+	require.NoError(t, err)
+	require.Len(t, page.Requests, 1)
+	assert.Equal(t, "eu_42", page.Requests[0].EndUserID)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsageByEndUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cols := []string{"end_user_id", "requests", "completed", "killed", "spent", "tokens"}
+
+	mock.ExpectQuery(`WHERE customer_id = \$1 AND end_user_id IS NOT NULL AND created_at >= \$2\s+GROUP BY 1\s+ORDER BY spent DESC, 1\s+LIMIT \$3`).
+		WithArgs("cus_1", from, DefaultUsageLimit).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("eu_42", 12, 10, 2, 900000, 30000).
+			AddRow("eu_7", 3, 3, 0, 1200, 400))
+
+	usage, err := l.UsageByEndUser(context.Background(), UsageFilter{CustomerID: "cus_1", From: from})
+	require.NoError(t, err)
+	assert.Equal(t, []EndUserUsage{
+		{EndUserID: "eu_42", UsageTotals: UsageTotals{Requests: 12, CompletedRequests: 10, KilledRequests: 2, SpentGrains: 900000, TotalTokens: 30000}},
+		{EndUserID: "eu_7", UsageTotals: UsageTotals{Requests: 3, CompletedRequests: 3, SpentGrains: 1200, TotalTokens: 400}},
+	}, usage)
+
+	// One end user
+	mock.ExpectQuery(`WHERE customer_id = \$1 AND end_user_id IS NOT NULL AND end_user_id = \$2\s+GROUP BY`).
+		WithArgs("cus_1", "eu_7", 5).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow("eu_7", 3, 3, 0, 1200, 400))
+
+	usage, err = l.UsageByEndUser(context.Background(), UsageFilter{CustomerID: "cus_1", EndUserID: "eu_7", Limit: 5})
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	assert.Equal(t, int64(1200), usage[0].SpentGrains)
+
+	_, err = l.UsageByEndUser(context.Background(), UsageFilter{})
+	assert.Error(t, err)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
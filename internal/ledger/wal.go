@@ -0,0 +1,396 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Write-ahead log fsync policies (see WithWriteAheadLog).
+const (
+	// WALSyncAlways flushes every entry to disk before its write is queued,
+	// so not even a power failure loses one, at the cost of an fsync per
+	// write on the hot path.
+	WALSyncAlways = "always"
+
+	// WALSyncInterval flushes once a second. A process crash loses nothing,
+	// since the kernel already has the entries; a machine crash can lose
+	// the last second's.
+	WALSyncInterval = "interval"
+
+	// WALSyncNever leaves flushing to the OS.
+	WALSyncNever = "never"
+)
+
+const (
+	// walSyncInterval is how often WALSyncInterval flushes the log.
+	walSyncInterval = time.Second
+
+	// walCompactBytes is the size past which the log is rewritten with only
+	// its unfinished entries.
+	walCompactBytes = 64 << 20
+)
+
+// WithWriteAheadLog appends every queued PostgreSQL write to an append-only
+// log at path before queuing it, and marks it done once a worker has
+// written it (or dead-lettered it). At startup NewLedger applies the
+// entries a crashed process left unfinished before queuing anything new,
+// so queued writes survive a crash. syncPolicy is one of WALSyncAlways,
+// WALSyncInterval or WALSyncNever; empty means WALSyncInterval.
+//
+// Writes are replayed at least once: one written just before a crash but
+// not yet marked done is written again. That is safe because every queued
+// write is idempotent: a preflight already recorded is skipped, and a
+// finalization's transactions have deterministic IDs (see
+// finalizationTransactionID), so they are never recorded twice. Has no
+// effect with sync writes, which are never queued. An empty path disables
+// it (the default).
+func WithWriteAheadLog(path, syncPolicy string) Option {
+	return func(l *Ledger) {
+		l.walPath = path
+		l.walSync = syncPolicy
+	}
+}
+
+// ParseWALSync validates a write-ahead log fsync policy. Empty means
+// WALSyncInterval.
+func ParseWALSync(s string) (string, error) {
+	switch s {
+	case "":
+		return WALSyncInterval, nil
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown write-ahead log fsync policy %q (want %s, %s or %s)",
+		s, WALSyncAlways, WALSyncInterval, WALSyncNever)
+}
+
+// walEntry is one line of the write-ahead log: a queued write, or a mark
+// that the write with the same Seq is done.
+type walEntry struct {
+	Seq        uint64          `json:"seq"`
+	Done       bool            `json:"done,omitempty"`
+	OpType     string          `json:"op_type,omitempty"`
+	CustomerID string          `json:"customer_id,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+// writeAheadLog is an open write-ahead log file.
+type writeAheadLog struct {
+	path       string
+	syncPolicy string
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	nextSeq uint64
+
+	// pending holds the encoded lines of the entries not yet done, for
+	// compaction
+	pending map[uint64][]byte
+
+	// dirty is set by an append not yet flushed
+	dirty bool
+}
+
+// createWAL creates an empty write-ahead log at path, replacing any there.
+func createWAL(path, syncPolicy string) (*writeAheadLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{
+		path:       path,
+		syncPolicy: syncPolicy,
+		f:          f,
+		nextSeq:    1,
+		pending:    make(map[uint64][]byte),
+	}, nil
+}
+
+// append logs op and returns its sequence number.
+func (w *writeAheadLog) append(op writeOp) (uint64, error) {
+	payload, err := encodeWriteOp(op)
+	if err != nil {
+		return 0, fmt.Errorf("encode payload failed: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq := w.nextSeq
+	line, err := encodeWALEntry(walEntry{Seq: seq, OpType: op.opType, CustomerID: op.customerID, Payload: payload})
+	if err != nil {
+		return 0, err
+	}
+	if err := w.write(line); err != nil {
+		return 0, err
+	}
+	w.nextSeq++
+	w.pending[seq] = line
+
+	if w.syncPolicy == WALSyncAlways {
+		return seq, w.f.Sync()
+	}
+	w.dirty = true
+	return seq, nil
+}
+
+// done marks the write seq as done. The mark isn't flushed: losing it only
+// means the write is replayed.
+func (w *writeAheadLog) done(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line, err := encodeWALEntry(walEntry{Seq: seq, Done: true})
+	if err != nil {
+		return err
+	}
+	if err := w.write(line); err != nil {
+		return err
+	}
+	delete(w.pending, seq)
+
+	if w.size > walCompactBytes {
+		return w.compact()
+	}
+	return nil
+}
+
+// write appends line to the file. The caller holds mu.
+func (w *writeAheadLog) write(line []byte) error {
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// compact replaces the log with one holding only its pending entries. The
+// caller holds mu.
+func (w *writeAheadLog) compact() error {
+	seqs := make([]uint64, 0, len(w.pending))
+	for seq := range w.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var buf bytes.Buffer
+	for _, seq := range seqs {
+		buf.Write(w.pending[seq])
+	}
+
+	tmp := w.path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("compact failed: %w", err)
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return fmt.Errorf("compact failed: %w", err)
+	}
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen after compact failed: %w", err)
+	}
+	w.f.Close()
+	w.f = f
+	w.size = int64(buf.Len())
+	w.dirty = false
+	return nil
+}
+
+// flush syncs the log to disk if anything was appended since the last one.
+func (w *writeAheadLog) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// close flushes and closes the log.
+func (w *writeAheadLog) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// encodeWALEntry encodes e as a log line.
+func encodeWALEntry(e walEntry) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("encode entry failed: %w", err)
+	}
+	return append(line, '\n'), nil
+}
+
+// writeFileSync writes data to a new file at path and syncs it.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readWAL returns the unfinished entries of the log at path, in the order
+// they were appended. A missing log has none. A torn last line, from a
+// crash in the middle of an append, is ignored.
+func readWAL(path string) ([]walEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pending := make(map[uint64]walEntry)
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Whatever follows the last newline is a torn append
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if e.Done {
+			delete(pending, e.Seq)
+		} else {
+			pending[e.Seq] = e
+		}
+	}
+
+	entries := make([]walEntry, 0, len(pending))
+	for _, e := range pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+// startWAL applies the writes a previous process left unfinished in the
+// write-ahead log, then starts a new log. A write that fails is
+// dead-lettered; if that fails too, the old log is left as it is and an
+// error returned, so the writes are tried again on the next start.
+func (l *Ledger) startWAL() error {
+	entries, err := readWAL(l.walPath)
+	if err != nil {
+		return fmt.Errorf("read write-ahead log failed: %w", err)
+	}
+
+	replayed, deadLettered := 0, 0
+	for _, e := range entries {
+		op, err := decodeWriteOp(e.OpType, e.CustomerID, e.Payload)
+		if err != nil {
+			return fmt.Errorf("write-ahead log entry %d: %w", e.Seq, err)
+		}
+
+		if err := l.applyWrite(op); err == nil {
+			replayed++
+			continue
+		} else if l.deadLetter == nil {
+			return fmt.Errorf("replay write-ahead log entry %d failed: %w", e.Seq, err)
+		} else if derr := l.deadLetter(op, err); derr != nil {
+			return fmt.Errorf("replay write-ahead log entry %d failed: %w (dead-lettering failed: %v)", e.Seq, err, derr)
+		}
+		deadLettered++
+	}
+	if len(entries) > 0 {
+		l.log.Warn().
+			Str("path", l.walPath).
+			Int("replayed", replayed).
+			Int("dead_lettered", deadLettered).
+			Msg("replayed unfinished writes from the write-ahead log")
+	}
+
+	l.wal, err = createWAL(l.walPath, l.walSync)
+	if err != nil {
+		return fmt.Errorf("create write-ahead log failed: %w", err)
+	}
+
+	if l.walSync == WALSyncInterval || l.walSync == "" {
+		l.wg.Add(1)
+		go l.walSyncer()
+	}
+	return nil
+}
+
+// walSyncer flushes the write-ahead log every walSyncInterval until Close.
+func (l *Ledger) walSyncer() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.wal.flush(); err != nil {
+				l.log.Error().Err(err).Msg("write-ahead log fsync failed")
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// walAppend logs op in the write-ahead log, if there is one, before it is
+// queued. A write that can't be logged is still queued, just not durably.
+func (l *Ledger) walAppend(op *writeOp) {
+	if l.wal == nil {
+		return
+	}
+
+	seq, err := l.wal.append(*op)
+	if err != nil {
+		l.log.Error().Err(err).
+			Str("op_type", op.opType).
+			Str("customer_id", op.customerID).
+			Msg("failed to append write to the write-ahead log")
+		return
+	}
+	op.walSeq = seq
+}
+
+// walDone marks op done in the write-ahead log: it was written, or stored
+// for replay.
+func (l *Ledger) walDone(op writeOp) {
+	if l.wal == nil || op.walSeq == 0 {
+		return
+	}
+
+	if err := l.wal.done(op.walSeq); err != nil {
+		l.log.Error().Err(err).
+			Str("op_type", op.opType).
+			Str("customer_id", op.customerID).
+			Msg("failed to mark write done in the write-ahead log")
+	}
+}
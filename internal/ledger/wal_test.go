@@ -0,0 +1,228 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	stdsync "sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appliedWrites is an applyWrite stub that records the ops it is given.
+type appliedWrites struct {
+	mu  stdsync.Mutex
+	ops []writeOp
+	err error
+}
+
+func (a *appliedWrites) apply(op writeOp) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	a.ops = append(a.ops, op)
+	return nil
+}
+
+// newWALLedger returns a ledger with a write-ahead log at path and one
+// write queue with no worker, like a process that crashes before its
+// queued writes are made.
+func newWALLedger(t *testing.T, path string, applied *appliedWrites) *Ledger {
+	t.Helper()
+	l := &Ledger{
+		log:         zerolog.Nop(),
+		applyWrite:  applied.apply,
+		writeQueues: []chan writeOp{make(chan writeOp, 100)},
+		done:        make(chan struct{}),
+		walPath:     path,
+		walSync:     WALSyncAlways,
+	}
+	require.NoError(t, l.startWAL())
+	t.Cleanup(func() { l.wal.close() })
+	return l
+}
+
+func TestWAL_ReplaysUnfinishedWritesAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.wal")
+	crashed := newWALLedger(t, path, &appliedWrites{})
+
+	preflight := ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 500, Priority: PriorityNormal}
+	fin := FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 120, Model: "gpt-4"}
+	fin.withheldGrains = 30
+	fin.shortfallDebtGrains = 5
+	cancelled := cancellation{CustomerID: "cus_2", RequestID: "req_2"}
+
+	crashed.enqueueWrite(writeOp{opType: "preflight", customerID: "cus_1", data: preflight})
+	crashed.enqueueWrite(writeOp{opType: "cancellation", customerID: "cus_2", data: cancelled})
+	crashed.enqueueWrite(writeOp{opType: "finalization", customerID: "cus_1", data: fin})
+
+	// A worker made the cancellation before the crash
+	queue := crashed.writeQueues[0]
+	<-queue
+	crashed.walDone(<-queue)
+	require.Len(t, queue, 1)
+
+	// A torn append at the moment of the crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":4,"op_type":"prefl`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	applied := &appliedWrites{}
+	restarted := newWALLedger(t, path, applied)
+
+	require.Len(t, applied.ops, 2)
+	assert.Equal(t, "preflight", applied.ops[0].opType)
+	assert.Equal(t, preflight, applied.ops[0].data)
+	assert.Equal(t, "finalization", applied.ops[1].opType)
+	assert.Equal(t, fin, applied.ops[1].data, "including the amounts set from the script's result")
+	assert.Equal(t, "cus_1", applied.ops[1].customerID)
+
+	// The new log starts empty
+	entries, err := readWAL(path)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, uint64(1), restarted.wal.nextSeq)
+}
+
+func TestWAL_DoneWritesAreNotReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.wal")
+	l := newWALLedger(t, path, &appliedWrites{})
+	l.startWriteWorkers(2, 10)
+
+	for i := 0; i < 5; i++ {
+		l.enqueueWrite(writeOp{opType: "cancellation", customerID: "cus_1", data: cancellation{CustomerID: "cus_1"}})
+	}
+	l.drainWriteQueues()
+
+	entries, err := readWAL(path)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWAL_FailedReplayIsDeadLettered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.wal")
+	crashed := newWALLedger(t, path, &appliedWrites{})
+	crashed.enqueueWrite(writeOp{opType: "cancellation", customerID: "cus_1", data: cancellation{CustomerID: "cus_1", RequestID: "req_1"}})
+
+	var deadLettered []writeOp
+	l := &Ledger{
+		log:        zerolog.Nop(),
+		applyWrite: (&appliedWrites{err: errors.New("postgres down")}).apply,
+		deadLetter: func(op writeOp, cause error) error {
+			deadLettered = append(deadLettered, op)
+			return nil
+		},
+		done:    make(chan struct{}),
+		walPath: path,
+		walSync: WALSyncNever,
+	}
+	require.NoError(t, l.startWAL())
+	defer l.wal.close()
+	require.Len(t, deadLettered, 1)
+	assert.Equal(t, cancellation{CustomerID: "cus_1", RequestID: "req_1"}, deadLettered[0].data)
+
+	// With nowhere to put it, the log is kept for the next start
+	path2 := filepath.Join(t.TempDir(), "writes.wal")
+	crashed2 := newWALLedger(t, path2, &appliedWrites{})
+	crashed2.enqueueWrite(writeOp{opType: "cancellation", customerID: "cus_1", data: cancellation{CustomerID: "cus_1"}})
+
+	l2 := &Ledger{
+		log:        zerolog.Nop(),
+		applyWrite: (&appliedWrites{err: errors.New("postgres down")}).apply,
+		deadLetter: func(op writeOp, cause error) error { return errors.New("postgres down") },
+		done:       make(chan struct{}),
+		walPath:    path2,
+	}
+	assert.Error(t, l2.startWAL())
+	entries, err := readWAL(path2)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWAL_ReplayedWritesAreIdempotent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	ctx := context.Background()
+
+	// A preflight that was already recorded inserts nothing, without error
+	preflight := ReservationRequest{CustomerID: "cus_1", RequestID: "req_1", ReservedGrains: 500, Priority: PriorityNormal}
+	mock.ExpectExec(`(?s)INSERT INTO requests.*ON CONFLICT \(request_id\) DO NOTHING`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	require.NoError(t, l.writePreflightToDB(ctx, preflight))
+
+	// A finalization written twice reuses its transaction IDs, so the
+	// second write's transactions are skipped
+	fin := FinalizationRequest{CustomerID: "cus_1", RequestID: "req_1", Status: "completed", ActualCostGrains: 120, Model: "gpt-4"}
+	usageID := finalizationTransactionID("cus_1", "req_1", TransactionAIUsage)
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE requests SET").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`(?s)INSERT INTO transactions.*ON CONFLICT \(transaction_id\) DO NOTHING`).
+			WithArgs(usageID, "cus_1", int64(-120), "ai_usage", "req_1", "AI usage: gpt-4 (0 tokens)", nil).
+			WillReturnResult(sqlmock.NewResult(0, int64(1-i)))
+		mock.ExpectCommit()
+		require.NoError(t, l.writeFinalizationToDB(ctx, fin))
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NotEqual(t, usageID, finalizationTransactionID("cus_1", "req_2", TransactionAIUsage))
+	assert.NotEqual(t, usageID, finalizationTransactionID("cus_1", "req_1", TransactionRefundWithheld))
+}
+
+func TestWAL_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.wal")
+	w, err := createWAL(path, WALSyncNever)
+	require.NoError(t, err)
+	defer w.close()
+
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		seq, err := w.append(writeOp{opType: "cancellation", customerID: "cus_1", data: cancellation{CustomerID: "cus_1"}})
+		require.NoError(t, err)
+		seqs = append(seqs, seq)
+	}
+	require.NoError(t, w.done(seqs[0]))
+
+	w.mu.Lock()
+	require.NoError(t, w.compact())
+	w.mu.Unlock()
+
+	// Appends carry on in the compacted file
+	seq, err := w.append(writeOp{opType: "cancellation", customerID: "cus_2", data: cancellation{CustomerID: "cus_2"}})
+	require.NoError(t, err)
+	require.NoError(t, w.done(seqs[1]))
+
+	entries, err := readWAL(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, seqs[2], entries[0].Seq)
+	assert.Equal(t, seq, entries[1].Seq)
+}
+
+func TestParseWALSync(t *testing.T) {
+	for in, want := range map[string]string{
+		"":         WALSyncInterval,
+		"always":   WALSyncAlways,
+		"interval": WALSyncInterval,
+		"never":    WALSyncNever,
+	} {
+		got, err := ParseWALSync(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := ParseWALSync("sometimes")
+	assert.Error(t, err)
+}
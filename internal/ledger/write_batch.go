@@ -0,0 +1,164 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultWriteBatchInterval is how long a write worker waits for more
+// finalizations to fill a batch when WithWriteBatching isn't given one.
+const DefaultWriteBatchInterval = 20 * time.Millisecond
+
+// WithWriteBatching makes the async write workers apply finalization writes
+// in batches of up to maxBatch: the requests updates and ai_usage
+// transactions of a whole batch go to PostgreSQL in one transaction, instead
+// of one transaction per finalization. A worker holding a partial batch
+// flushes it after flushInterval (DefaultWriteBatchInterval if <= 0).
+//
+// Other writes are never batched and keep their place in the queue: a
+// preflight or cancellation queued behind some finalizations flushes them
+// first. A maxBatch of 0 or 1 disables batching.
+func WithWriteBatching(maxBatch int, flushInterval time.Duration) Option {
+	return func(l *Ledger) {
+		if flushInterval <= 0 {
+			flushInterval = DefaultWriteBatchInterval
+		}
+		l.writeBatchSize = maxBatch
+		l.writeBatchInterval = flushInterval
+	}
+}
+
+// collectFinalizations starts a batch with first and adds the finalizations
+// that follow it on queue, until the batch is full, the flush interval has
+// passed or the queue is closed.
+//
+// A write of another type ends the batch early and is returned as next, to
+// be applied right after the batch.
+func (l *Ledger) collectFinalizations(first writeOp, queue <-chan writeOp) (batch []writeOp, next *writeOp) {
+	batch = []writeOp{first}
+
+	timer := time.NewTimer(l.writeBatchInterval)
+	defer timer.Stop()
+
+	for len(batch) < l.writeBatchSize {
+		select {
+		case op, ok := <-queue:
+			if !ok {
+				return batch, nil
+			}
+			if op.opType != "finalization" {
+				return batch, &op
+			}
+			batch = append(batch, op)
+		case <-timer.C:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// applyFinalizationBatch writes a batch of finalizations in one transaction.
+//
+// If that fails, nothing of the batch was committed, and each write is
+// applied on its own with the usual retries. One bad finalization therefore
+// can't hold back the rest of its batch, and only the writes that really
+// fail are dead-lettered.
+func (l *Ledger) applyFinalizationBatch(logger zerolog.Logger, batch []writeOp) {
+	if len(batch) == 1 {
+		l.applyWithRetry(logger, batch[0])
+		return
+	}
+
+	err := l.applyBatch(batch)
+	if err == nil {
+		l.writesSucceeded.Add(int64(len(batch)))
+		for _, op := range batch {
+			l.walDone(op)
+		}
+		return
+	}
+
+	if isStatementTimeout(err) {
+		pgStatementTimeoutsTotal.WithLabelValues("finalization").Inc()
+	}
+	logger.Warn().Err(err).
+		Int("batch_size", len(batch)).
+		Msg("batched finalization write failed, writing individually")
+
+	for _, op := range batch {
+		l.applyWithRetry(logger, op)
+	}
+}
+
+// writeFinalizationBatchToDB writes a batch of finalizations to PostgreSQL:
+// what writeFinalizationToDB does for each of them, in one transaction.
+//
+// A request_id that appears more than once is written once, for its first
+// occurrence, so a batch never records the same usage twice.
+func (l *Ledger) writeFinalizationBatchToDB(ops []writeOp) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reqs := make([]FinalizationRequest, 0, len(ops))
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		req := op.data.(FinalizationRequest)
+		if seen[req.RequestID] {
+			continue
+		}
+		seen[req.RequestID] = true
+		reqs = append(reqs, req)
+	}
+
+	// Start transaction for atomic update
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Update every request record from one VALUES list
+	values := make([]string, 0, len(reqs))
+	args := make([]interface{}, 0, 5*len(reqs))
+	for _, req := range reqs {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d::varchar, $%d::bigint, $%d::int, $%d::int, $%d::varchar)",
+			n+1, n+2, n+3, n+4, n+5))
+		args = append(args, req.RequestID, req.ActualCostGrains, req.PromptTokens, req.CompletionTokens, req.Status)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE requests SET
+			provider_reported_cost_grains = v.actual_cost,
+			actual_cost_grains = v.actual_cost,
+			prompt_tokens = v.prompt_tokens,
+			completion_tokens = v.completion_tokens,
+			total_tokens = v.prompt_tokens + v.completion_tokens,
+			status = v.status,
+			completed_at = NOW(),
+			reconciled_at = NOW()
+		FROM (VALUES `+strings.Join(values, ", ")+`)
+			AS v(request_id, actual_cost, prompt_tokens, completion_tokens, status)
+		WHERE requests.request_id = v.request_id
+	`, args...)
+
+	if err != nil {
+		return fmt.Errorf("update requests failed: %w", err)
+	}
+
+	// Record transactions for audit trail
+	txns := make([]Transaction, 0, len(reqs))
+	for _, req := range reqs {
+		txns = append(txns, finalizationTransactions(req)...)
+	}
+
+	if err := insertTransactions(ctx, tx, txns); err != nil {
+		return fmt.Errorf("insert transactions failed: %w", err)
+	}
+
+	return tx.Commit()
+}
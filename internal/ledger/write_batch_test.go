@@ -0,0 +1,232 @@
+package ledger
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLog records the order writes are applied in, singly or as batches.
+type writeLog struct {
+	mu      stdsync.Mutex
+	applied []string
+}
+
+func (w *writeLog) apply(op writeOp) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.applied = append(w.applied, fmt.Sprintf("%s:%v", op.opType, op.data))
+	return nil
+}
+
+func (w *writeLog) applyBatch(ops []writeOp) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var data []interface{}
+	for _, op := range ops {
+		data = append(data, op.data)
+	}
+	w.applied = append(w.applied, fmt.Sprintf("batch:%v", data))
+	return nil
+}
+
+func (w *writeLog) snapshot() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.applied...)
+}
+
+// runWorker applies every op through a single write worker and waits for it.
+func runWorker(l *Ledger, ops ...writeOp) {
+	queue := make(chan writeOp, len(ops))
+	for _, op := range ops {
+		queue <- op
+	}
+	close(queue)
+
+	l.wg.Add(1)
+	l.asyncWriteWorker(0, queue)
+}
+
+func TestWriteBatching_BatchesConsecutiveFinalizations(t *testing.T) {
+	rec := &writeLog{}
+	l := &Ledger{log: zerolog.Nop(), applyWrite: rec.apply, applyBatch: rec.applyBatch}
+	WithWriteBatching(3, time.Hour)(l)
+
+	op := func(opType string, data interface{}) writeOp {
+		return writeOp{opType: opType, customerID: "cus_1", data: data, ctx: context.Background()}
+	}
+	runWorker(l,
+		op("preflight", "a"),
+		op("finalization", 1), op("finalization", 2), op("finalization", 3),
+		op("finalization", 4), op("finalization", 5),
+		op("cancellation", "b"),
+		op("finalization", 6),
+	)
+
+	// Batches never exceed the size, and a cancellation keeps its place.
+	assert.Equal(t, []string{
+		"preflight:a",
+		"batch:[1 2 3]",
+		"batch:[4 5]",
+		"cancellation:b",
+		"finalization:6",
+	}, rec.snapshot())
+	assert.Equal(t, int64(8), l.writesSucceeded.Load())
+}
+
+func TestWriteBatching_FlushesAfterInterval(t *testing.T) {
+	rec := &writeLog{}
+	l := &Ledger{log: zerolog.Nop(), applyWrite: rec.apply, applyBatch: rec.applyBatch}
+	WithWriteBatching(100, 10*time.Millisecond)(l)
+
+	queue := make(chan writeOp, 10)
+	l.wg.Add(1)
+	go l.asyncWriteWorker(0, queue)
+	defer func() {
+		close(queue)
+		l.wg.Wait()
+	}()
+
+	queue <- writeOp{opType: "finalization", customerID: "cus_1", data: 1}
+	queue <- writeOp{opType: "finalization", customerID: "cus_1", data: 2}
+
+	// Far from full, but written once the interval has passed.
+	assert.Eventually(t, func() bool {
+		return len(rec.snapshot()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"batch:[1 2]"}, rec.snapshot())
+}
+
+func TestWriteBatching_FallsBackToSingleWrites(t *testing.T) {
+	rec := &writeLog{}
+	l := &Ledger{
+		log:        zerolog.Nop(),
+		applyWrite: rec.apply,
+		applyBatch: func([]writeOp) error { return errors.New("deadlock detected") },
+	}
+	WithWriteBatching(10, time.Hour)(l)
+
+	runWorker(l,
+		writeOp{opType: "finalization", customerID: "cus_1", data: 1},
+		writeOp{opType: "finalization", customerID: "cus_1", data: 2},
+		writeOp{opType: "finalization", customerID: "cus_1", data: 3},
+	)
+
+	// Each write still gets its own result.
+	assert.Equal(t, []string{"finalization:1", "finalization:2", "finalization:3"}, rec.snapshot())
+	assert.Equal(t, int64(3), l.writesSucceeded.Load())
+	assert.Equal(t, int64(0), l.writesDeadLettered.Load())
+}
+
+var batchTestFinalizations = []FinalizationRequest{
+	{CustomerID: "cus_1", RequestID: "req_1", Model: "gpt-4", PromptTokens: 100, CompletionTokens: 50, ActualCostGrains: 6000, Status: "completed"},
+	{CustomerID: "cus_1", RequestID: "req_2", Model: "gpt-4", PromptTokens: 80, CompletionTokens: 0, ActualCostGrains: 2400, Status: "killed"},
+	{CustomerID: "cus_2", RequestID: "req_3", Model: "claude-3-haiku", PromptTokens: 10, CompletionTokens: 20, ActualCostGrains: 30, Status: "completed"},
+}
+
+// usageArgs are the transactions INSERT args expected for req, in either mode.
+func usageArgs(req FinalizationRequest) []driver.Value {
+	return []driver.Value{
+		sqlmock.AnyArg(), req.CustomerID, -req.ActualCostGrains, "ai_usage", req.RequestID,
+		fmt.Sprintf("AI usage: %s (%d tokens)", req.Model, req.PromptTokens+req.CompletionTokens), nil,
+	}
+}
+
+func finalizationOps(reqs []FinalizationRequest) []writeOp {
+	ops := make([]writeOp, len(reqs))
+	for i, req := range reqs {
+		ops[i] = writeOp{opType: "finalization", customerID: req.CustomerID, data: req, ctx: context.Background()}
+	}
+	return ops
+}
+
+func TestWriteFinalization_PerWriteAndBatchedRecordTheSame(t *testing.T) {
+	t.Run("per write", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		l := &Ledger{db: db, log: zerolog.Nop()}
+		l.applyWrite = l.applyWriteToDB
+
+		for _, req := range batchTestFinalizations {
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE requests SET").
+				WithArgs(req.ActualCostGrains, int64(req.PromptTokens), int64(req.CompletionTokens),
+					int64(req.PromptTokens+req.CompletionTokens), req.Status, req.RequestID).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("INSERT INTO transactions").
+				WithArgs(usageArgs(req)...).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+
+		runWorker(l, finalizationOps(batchTestFinalizations)...)
+
+		assert.Equal(t, int64(3), l.writesSucceeded.Load())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("batched", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		l := &Ledger{db: db, log: zerolog.Nop()}
+		l.applyWrite = l.applyWriteToDB
+		l.applyBatch = l.writeFinalizationBatchToDB
+		WithWriteBatching(10, time.Hour)(l)
+
+		var updateArgs, insertArgs []driver.Value
+		for _, req := range batchTestFinalizations {
+			updateArgs = append(updateArgs, req.RequestID, req.ActualCostGrains,
+				int64(req.PromptTokens), int64(req.CompletionTokens), req.Status)
+			insertArgs = append(insertArgs, usageArgs(req)...)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE requests SET[\s\S]+FROM \(VALUES \(\$1::varchar.*\), \(\$6::varchar.*\), \(\$11::varchar.*\)\)`).
+			WithArgs(updateArgs...).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(`INSERT INTO transactions[\s\S]+VALUES \(\$1, .*\), \(\$8, .*\), \(\$15, .*\)`).
+			WithArgs(insertArgs...).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectCommit()
+
+		runWorker(l, finalizationOps(batchTestFinalizations)...)
+
+		assert.Equal(t, int64(3), l.writesSucceeded.Load())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestWriteFinalizationBatchToDB_RecordsRepeatedRequestOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := &Ledger{db: db, log: zerolog.Nop()}
+	req := batchTestFinalizations[0]
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE requests SET").
+		WithArgs(req.RequestID, req.ActualCostGrains, int64(req.PromptTokens), int64(req.CompletionTokens), req.Status).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(usageArgs(req)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, l.writeFinalizationBatchToDB(finalizationOps([]FinalizationRequest{req, req})))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,215 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// startWriteWorkers creates one queue per worker and starts the workers.
+//
+// The total buffer is split evenly across shards, so overall burst capacity
+// matches a single queue of totalBuffer.
+func (l *Ledger) startWriteWorkers(numWorkers, totalBuffer int) {
+	perShard := totalBuffer / numWorkers
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	l.writeQueues = make([]chan writeOp, numWorkers)
+	l.wg.Add(numWorkers)
+	for i := range l.writeQueues {
+		l.writeQueues[i] = make(chan writeOp, perShard)
+		go l.asyncWriteWorker(i, l.writeQueues[i])
+	}
+}
+
+// shardFor returns the index of the write queue that owns a customer.
+//
+// Every write for a customer goes through the same queue and worker, so
+// finalizations for one customer never race each other on the customers row.
+// Different customers spread across workers for throughput.
+func (l *Ledger) shardFor(customerID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(customerID))
+	return int(h.Sum32() % uint32(len(l.writeQueues)))
+}
+
+// enqueueWrite queues an async PostgreSQL write on its customer's shard
+// without blocking. If that shard is full the write is dropped and logged;
+// Redis already holds the authoritative hot-path state. With a write-ahead
+// log, a dropped write stays unfinished in it and is made at the next start.
+func (l *Ledger) enqueueWrite(op writeOp) bool {
+	shard := l.shardFor(op.customerID)
+	l.walAppend(&op)
+
+	select {
+	case l.writeQueues[shard] <- op:
+		return true
+	default:
+		l.log.Warn().
+			Str("op_type", op.opType).
+			Str("customer_id", op.customerID).
+			Int("shard", shard).
+			Msg("write queue full, skipping async write")
+		return false
+	}
+}
+
+// ErrWriteFailed is returned, wrapped with the cause, when sync writes are
+// enabled and PostgreSQL didn't take a write (see WithSyncWrites).
+var ErrWriteFailed = errors.New("postgresql write failed")
+
+// WithSyncWrites makes every PostgreSQL write happen inline, in the call
+// that caused it, instead of being queued for the async workers. A crash
+// then never loses a write that Redis already applied, at the cost of a
+// database round trip on the hot path. Off by default.
+//
+// A sync write is attempted once. If it fails the call returns
+// ErrWriteFailed: a reservation is rolled back in Redis first, so the
+// caller can simply retry it; a finalization, cancellation, release or
+// abandonment has already been applied in Redis and can't be undone, so
+// its write is dead-lettered for replay like an async write that ran out
+// of retries.
+func WithSyncWrites(enabled bool) Option {
+	return func(l *Ledger) {
+		l.syncWrites = enabled
+	}
+}
+
+// persist records op in PostgreSQL: inline if sync writes are enabled,
+// otherwise by queuing it (see enqueueWrite), in which case it never fails.
+//
+// A failed preflight is left to the caller to roll back; any other op is
+// dead-lettered.
+func (l *Ledger) persist(op writeOp) error {
+	if !l.syncWrites {
+		l.enqueueWrite(op)
+		return nil
+	}
+
+	err := l.applyWrite(op)
+	if err == nil {
+		l.writesSucceeded.Add(1)
+		l.syncWriteFailures.Store(0)
+		return nil
+	}
+	l.syncWriteFailures.Add(1)
+
+	if isStatementTimeout(err) {
+		pgStatementTimeoutsTotal.WithLabelValues(op.opType).Inc()
+	}
+	l.log.Error().Err(err).
+		Str("op_type", op.opType).
+		Str("customer_id", op.customerID).
+		Msg("sync write failed")
+
+	if op.opType != "preflight" && l.deadLetter != nil {
+		l.writesDeadLettered.Add(1)
+		if derr := l.deadLetter(op, err); derr != nil {
+			l.log.Error().Err(derr).
+				Str("op_type", op.opType).
+				Str("customer_id", op.customerID).
+				Msg("failed to store dead-lettered write, write lost")
+		}
+	}
+
+	return fmt.Errorf("%w: %v", ErrWriteFailed, err)
+}
+
+// maxWriteRetryDelay caps WriteRetryDelay.
+const maxWriteRetryDelay = 30 * time.Second
+
+// WriteRetryDelay is how long a caller whose sync write failed should wait
+// before retrying. It follows the async workers' backoff schedule (see
+// applyWithRetry): the first retry delay, doubled for every further sync
+// write that has failed in a row, up to 30s. Zero while sync writes are
+// succeeding.
+func (l *Ledger) WriteRetryDelay() time.Duration {
+	failures := l.syncWriteFailures.Load()
+	if failures == 0 {
+		return 0
+	}
+
+	delay := l.writeRetryBackoff
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	for i := int64(1); i < failures && delay < maxWriteRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxWriteRetryDelay {
+		delay = maxWriteRetryDelay
+	}
+	return delay
+}
+
+// ShutdownReport summarizes the async write work handled during shutdown.
+type ShutdownReport struct {
+	// QueueDepth is the number of writes still queued when shutdown began
+	// (not counting writes a worker had already picked up).
+	QueueDepth int
+
+	// Drained is the number of writes that completed during shutdown.
+	Drained int64
+
+	// DeadLettered is the number of writes that exhausted their retries
+	// during shutdown and were saved to failed_writes for replay.
+	DeadLettered int64
+
+	// Duration is the time spent waiting for the queues to drain.
+	Duration time.Duration
+}
+
+// drainWriteQueues closes every write queue and waits for the workers to
+// finish what was queued. Nothing may be enqueued after this is called.
+func (l *Ledger) drainWriteQueues() ShutdownReport {
+	start := time.Now()
+
+	depth := 0
+	for _, queue := range l.writeQueues {
+		depth += len(queue)
+	}
+	succeededBefore := l.writesSucceeded.Load()
+	deadLetteredBefore := l.writesDeadLettered.Load()
+
+	for _, queue := range l.writeQueues {
+		close(queue)
+	}
+	l.wg.Wait()
+
+	return ShutdownReport{
+		QueueDepth:   depth,
+		Drained:      l.writesSucceeded.Load() - succeededBefore,
+		DeadLettered: l.writesDeadLettered.Load() - deadLetteredBefore,
+		Duration:     time.Since(start),
+	}
+}
+
+// log writes the report as one structured line. Dead-lettered writes are
+// data that reached Redis but never PostgreSQL, so they're logged at error.
+func (r ShutdownReport) log(logger zerolog.Logger) {
+	event := logger.Info()
+	if r.DeadLettered > 0 {
+		event = logger.Error()
+	}
+
+	event.
+		Int("queue_depth", r.QueueDepth).
+		Int64("drained", r.Drained).
+		Int64("dead_lettered", r.DeadLettered).
+		Dur("drain_duration", r.Duration).
+		Msg("async write queue shutdown report")
+}
+
+// export publishes the report as final metric values, for anything that
+// scrapes /metrics during shutdown or reads it from a push gateway.
+func (r ShutdownReport) export() {
+	shutdownQueueDepth.Set(float64(r.QueueDepth))
+	shutdownDrainedWrites.Set(float64(r.Drained))
+	shutdownDeadLetteredWrites.Set(float64(r.DeadLettered))
+	shutdownDrainSeconds.Set(r.Duration.Seconds())
+}
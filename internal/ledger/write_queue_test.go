@@ -0,0 +1,160 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inFlightRecorder is an applyWrite stub that tracks how many ops run at once,
+// overall and per customer, and the order each customer's ops were applied.
+type inFlightRecorder struct {
+	mu       stdsync.Mutex
+	inFlight map[string]int
+	maxPer   map[string]int
+	total    int
+	maxTotal int
+	applied  map[string][]int
+	holdFor  time.Duration
+}
+
+func newInFlightRecorder(hold time.Duration) *inFlightRecorder {
+	return &inFlightRecorder{
+		inFlight: make(map[string]int),
+		maxPer:   make(map[string]int),
+		applied:  make(map[string][]int),
+		holdFor:  hold,
+	}
+}
+
+func (r *inFlightRecorder) apply(op writeOp) error {
+	r.mu.Lock()
+	r.inFlight[op.customerID]++
+	r.total++
+	if r.inFlight[op.customerID] > r.maxPer[op.customerID] {
+		r.maxPer[op.customerID] = r.inFlight[op.customerID]
+	}
+	if r.total > r.maxTotal {
+		r.maxTotal = r.total
+	}
+	r.applied[op.customerID] = append(r.applied[op.customerID], op.data.(int))
+	r.mu.Unlock()
+
+	time.Sleep(r.holdFor)
+
+	r.mu.Lock()
+	r.inFlight[op.customerID]--
+	r.total--
+	r.mu.Unlock()
+	return nil
+}
+
+func TestWriteQueue_SerializesPerCustomerAndParallelizesAcross(t *testing.T) {
+	rec := newInFlightRecorder(2 * time.Millisecond)
+	l := &Ledger{log: zerolog.Nop(), applyWrite: rec.apply}
+	l.startWriteWorkers(4, 400)
+
+	// Pick customers that land on different shards.
+	var customers []string
+	seen := make(map[int]bool)
+	for i := 0; len(customers) < 4; i++ {
+		id := fmt.Sprintf("cus_%d", i)
+		if shard := l.shardFor(id); !seen[shard] {
+			seen[shard] = true
+			customers = append(customers, id)
+		}
+	}
+
+	const opsPerCustomer = 20
+	for seq := 0; seq < opsPerCustomer; seq++ {
+		for _, id := range customers {
+			require.True(t, l.enqueueWrite(writeOp{
+				opType:     "finalization",
+				customerID: id,
+				data:       seq,
+				ctx:        context.Background(),
+			}))
+		}
+	}
+
+	for _, queue := range l.writeQueues {
+		close(queue)
+	}
+	l.wg.Wait()
+
+	for _, id := range customers {
+		assert.Equal(t, 1, rec.maxPer[id], "ops for %s overlapped", id)
+
+		require.Len(t, rec.applied[id], opsPerCustomer)
+		for seq, got := range rec.applied[id] {
+			assert.Equal(t, seq, got, "ops for %s applied out of order", id)
+		}
+	}
+	assert.Greater(t, rec.maxTotal, 1, "different customers should be written in parallel")
+}
+
+func TestWriteQueue_DropsWhenShardFull(t *testing.T) {
+	l := &Ledger{log: zerolog.Nop()}
+	l.writeQueues = []chan writeOp{make(chan writeOp, 1), make(chan writeOp, 1)}
+
+	op := writeOp{opType: "preflight", customerID: "cus_full"}
+	assert.True(t, l.enqueueWrite(op))
+	assert.False(t, l.enqueueWrite(op), "second op should be dropped, shard is full")
+
+	// The other shard is unaffected.
+	var other string
+	for i := 0; ; i++ {
+		other = fmt.Sprintf("cus_%d", i)
+		if l.shardFor(other) != l.shardFor("cus_full") {
+			break
+		}
+	}
+	assert.True(t, l.enqueueWrite(writeOp{opType: "preflight", customerID: other}))
+}
+
+func TestDrainWriteQueues_ReportsCounts(t *testing.T) {
+	gate := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	l := &Ledger{log: zerolog.Nop(), writeRetryBackoff: time.Millisecond}
+	l.applyWrite = func(op writeOp) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-gate
+		if op.data == "fail" {
+			return fmt.Errorf("postgres unavailable")
+		}
+		return nil
+	}
+	l.startWriteWorkers(1, 10)
+
+	for _, data := range []string{"ok", "ok", "fail", "ok", "fail"} {
+		require.True(t, l.enqueueWrite(writeOp{opType: "finalization", customerID: "cus_1", data: data}))
+	}
+
+	// The worker holds the first op; the other four are still queued.
+	<-started
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(gate)
+	}()
+
+	report := l.drainWriteQueues()
+	assert.Equal(t, 4, report.QueueDepth)
+	assert.Equal(t, int64(3), report.Drained)
+	assert.Equal(t, int64(2), report.DeadLettered)
+	assert.Greater(t, report.Duration, time.Duration(0))
+
+	report.export()
+	assert.Equal(t, float64(4), testutil.ToFloat64(shutdownQueueDepth))
+	assert.Equal(t, float64(2), testutil.ToFloat64(shutdownDeadLetteredWrites))
+}
@@ -0,0 +1,1218 @@
+// Package rest provides HTTP/JSON REST API endpoints for Beam.
+//
+// This package wraps the gRPC service to provide a REST API for clients
+// that don't want to use gRPC. All gRPC methods are exposed as REST endpoints.
+//
+// Endpoints:
+//   GET  /v1/balance/:customer_id        - Get balance
+//   POST /v1/balance/check               - Check and reserve balance
+//   POST /v1/balance/deduct              - Deduct tokens
+//   POST /v1/balance/check-and-deduct    - Reserve and make the first deduction
+//   POST /v1/balance/finalize            - Finalize request
+//   POST /v1/balance/finalize/batch      - Finalize many requests
+//   GET  /v1/pricing                     - Current model pricing
+//   GET  /v1/customers                   - List customers (admin)
+//   GET  /v1/customers/:customer_id      - Get a customer (admin)
+//   GET  /v1/usage                       - Usage by end user or tag (admin)
+//   GET  /health                         - Health check
+//   GET  /ready                          - Readiness check
+//   GET  /metrics                        - Prometheus metrics
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourusername/beam/internal/api"
+	"github.com/yourusername/beam/internal/auth"
+	"github.com/yourusername/beam/internal/ledger"
+	pb "github.com/yourusername/beam/pkg/proto/balance/v1"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxBodyBytes is the largest request body the REST API reads,
+// matching the gRPC server's 4MB MaxRecvMsgSize.
+const DefaultMaxBodyBytes = 4 << 20
+
+// Handler provides REST API endpoints.
+type Handler struct {
+	balanceService *api.BalanceService
+	log            zerolog.Logger
+
+	// maxBodyBytes caps request bodies (see WithMaxBodyBytes)
+	maxBodyBytes int64
+
+	// timingHeaders adds latency attribution headers (see WithTimingHeaders)
+	timingHeaders bool
+
+	// timeouts bounds each class of route (see WithRouteTimeouts)
+	timeouts RouteTimeouts
+}
+
+// RouteTimeouts bounds how long the REST routes may take, by class. The
+// deadline is set on the request context, so it cancels the service call
+// and the ledger's Redis and PostgreSQL work under it; a request that runs
+// past it gets 504 Gateway Timeout. Zero leaves a class unbounded.
+type RouteTimeouts struct {
+	// Hot covers check, deduct and check-and-deduct, which normally answer
+	// in a few milliseconds
+	Hot time.Duration
+
+	// Standard covers balance lookups, finalize, cancel and pricing
+	Standard time.Duration
+
+	// Slow covers batch finalize and the admin customers and usage reports
+	Slow time.Duration
+}
+
+// DefaultRouteTimeouts are the route timeouts used unless
+// WithRouteTimeouts says otherwise.
+var DefaultRouteTimeouts = RouteTimeouts{
+	Hot:      250 * time.Millisecond,
+	Standard: 2 * time.Second,
+	Slow:     30 * time.Second,
+}
+
+// HandlerOption configures a Handler.
+type HandlerOption func(*Handler)
+
+// WithMaxBodyBytes sets the largest request body the handler reads; larger
+// ones get 413 Request Entity Too Large. Defaults to DefaultMaxBodyBytes.
+func WithMaxBodyBytes(n int64) HandlerOption {
+	return func(h *Handler) {
+		if n > 0 {
+			h.maxBodyBytes = n
+		}
+	}
+}
+
+// WithTimingHeaders adds the x-ledger-redis-ms and x-ledger-total-ms
+// headers (see api.Timing) to the balance endpoints' responses. Off by
+// default; it is meant for debugging latency, not for production.
+func WithTimingHeaders(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.timingHeaders = enabled
+	}
+}
+
+// WithRouteTimeouts sets the per-route timeouts. Defaults to
+// DefaultRouteTimeouts.
+func WithRouteTimeouts(t RouteTimeouts) HandlerOption {
+	return func(h *Handler) {
+		h.timeouts = t
+	}
+}
+
+// NewHandler creates a new REST API handler.
+func NewHandler(l *ledger.Ledger, a auth.Authenticator, logger zerolog.Logger, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		balanceService: api.NewBalanceService(l, a, logger),
+		log:            logger.With().Str("component", "rest_handler").Logger(),
+		maxBodyBytes:   DefaultMaxBodyBytes,
+		timeouts:       DefaultRouteTimeouts,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// RegisterRoutes registers all REST API routes on the provided mux.
+func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	// API v1 endpoints
+	hot, standard, slow := h.timeouts.Hot, h.timeouts.Standard, h.timeouts.Slow
+	mux.HandleFunc("/v1/balance/", h.deadline(standard, h.handleBalance))
+	mux.HandleFunc("/v1/balance/check", h.deadline(hot, h.timed(h.handleCheckBalance)))
+	mux.HandleFunc("/v1/balance/deduct", h.deadline(hot, h.timed(h.handleDeductTokens)))
+	mux.HandleFunc("/v1/balance/check-and-deduct", h.deadline(hot, h.timed(h.handleCheckBalanceAndDeduct)))
+	mux.HandleFunc("/v1/balance/finalize", h.deadline(standard, h.timed(h.handleFinalizeRequest)))
+	mux.HandleFunc("/v1/balance/finalize/batch", h.deadline(slow, h.timed(h.handleBatchFinalize)))
+	mux.HandleFunc("/v1/balance/cancel", h.deadline(standard, h.handleCancelRequest))
+	mux.HandleFunc("/v1/pricing", h.deadline(standard, h.handlePricing))
+	mux.HandleFunc("/v1/customers", h.deadline(slow, h.handleListCustomers))
+	mux.HandleFunc("/v1/customers/", h.deadline(slow, h.handleCustomer))
+	mux.HandleFunc("/v1/usage", h.deadline(slow, h.handleUsage))
+
+	// Health and monitoring endpoints
+	mux.HandleFunc("/health", h.handleHealth)
+	mux.HandleFunc("/ready", h.handleReady)
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
+// deadline runs next with a timeout on its request context. If next hasn't
+// finished by then, the client gets 504 with the usual error envelope and
+// whatever next goes on to write is discarded.
+func (h *Handler) deadline(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for key, values := range tw.header {
+				w.Header()[key] = values
+			}
+			if tw.code == 0 {
+				tw.code = http.StatusOK
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// The client went away; there is no one to answer
+				return
+			}
+			h.log.Warn().Str("path", r.URL.Path).Dur("timeout", timeout).Msg("REST request timed out")
+			h.writeError(w, http.StatusGatewayTimeout,
+				fmt.Sprintf("Request did not complete within %s", timeout))
+		}
+	}
+}
+
+// timeoutWriter buffers a deadline-bound handler's response, so it can be
+// dropped in favour of the 504 if the handler runs late.
+type timeoutWriter struct {
+	header http.Header
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.code == 0 {
+		tw.code = code
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// timed records the api.Timing of next's service call and sends it as
+// response headers, if timing headers are enabled.
+func (h *Handler) timed(next http.HandlerFunc) http.HandlerFunc {
+	if !h.timingHeaders {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, t := api.ContextWithTiming(r.Context())
+		next(&timingWriter{ResponseWriter: w, timing: t}, r.WithContext(ctx))
+	}
+}
+
+// timingWriter adds a recorded api.Timing to the response headers. The
+// service call has returned by the time the response is written.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *api.Timing
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(code int) {
+	if !tw.wroteHeader && tw.timing.Recorded() {
+		for key, values := range tw.timing.Metadata() {
+			tw.Header().Set(key, values[0])
+		}
+	}
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// handleBalance handles GET /v1/balance/:customer_id
+func (h *Handler) handleBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Extract customer_id from path
+	customerID := strings.TrimPrefix(r.URL.Path, "/v1/balance/")
+	if customerID == "" || strings.Contains(customerID, "/") {
+		h.writeError(w, http.StatusBadRequest, "Invalid customer_id")
+		return
+	}
+
+	// Create context with auth header
+	ctx := h.contextWithAuth(r)
+
+	// Call gRPC service
+	resp, err := h.balanceService.GetBalance(ctx, &pb.GetBalanceRequest{
+		CustomerId: customerID,
+	})
+
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCheckBalance handles POST /v1/balance/check
+func (h *Handler) handleCheckBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.CheckBalanceRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.CheckBalance(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDeductTokens handles POST /v1/balance/deduct
+func (h *Handler) handleDeductTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.DeductTokensRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.DeductTokens(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCheckBalanceAndDeduct handles POST /v1/balance/check-and-deduct
+func (h *Handler) handleCheckBalanceAndDeduct(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.CheckBalanceAndDeductRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.CheckBalanceAndDeduct(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleFinalizeRequest handles POST /v1/balance/finalize
+func (h *Handler) handleFinalizeRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.FinalizeRequestRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.FinalizeRequest(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleBatchFinalize handles POST /v1/balance/finalize/batch
+func (h *Handler) handleBatchFinalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.BatchFinalizeRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.BatchFinalize(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCancelRequest handles POST /v1/balance/cancel
+func (h *Handler) handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req pb.CancelRequestRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.CancelRequest(ctx, &req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePricing handles GET /v1/pricing
+//
+// The response carries an ETag; a request whose If-None-Match matches it
+// gets 304 Not Modified.
+func (h *Handler) handlePricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.GetPricing(ctx, &pb.GetPricingRequest{})
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writePricing(w, r, resp)
+}
+
+// writePricing writes a GetPricing response with HTTP cache validation.
+func (h *Handler) writePricing(w http.ResponseWriter, r *http.Request, resp *pb.GetPricingResponse) {
+	w.Header().Set("ETag", resp.Etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), resp.Etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleListCustomers handles GET /v1/customers?limit=&cursor=
+//
+// Pass the response's next_cursor back as cursor for the next page.
+func (h *Handler) handleListCustomers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req, err := listCustomersRequest(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.ListCustomers(ctx, req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// listCustomersRequest reads the ListCustomers paging from the query string.
+func listCustomersRequest(r *http.Request) (*pb.ListCustomersRequest, error) {
+	q := r.URL.Query()
+	req := &pb.ListCustomersRequest{Cursor: q.Get("cursor")}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxCustomersPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxCustomersPageSize)
+		}
+		req.PageSize = int32(limit)
+	}
+
+	return req, nil
+}
+
+// maxCustomersPageSize caps the limit of GET /v1/customers.
+const maxCustomersPageSize = 500
+
+// handleCustomer handles GET /v1/customers/:customer_id
+func (h *Handler) handleCustomer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	customerID := strings.TrimPrefix(r.URL.Path, "/v1/customers/")
+	if customerID == "" || strings.Contains(customerID, "/") {
+		h.writeError(w, http.StatusBadRequest, "Invalid customer_id")
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.GetCustomer(ctx, &pb.GetCustomerRequest{
+		CustomerId: customerID,
+	})
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleUsage handles
+// GET /v1/usage?customer_id=&group_by=&from=&to=&limit=&end_user_id=
+//
+// group_by is end_user or tag:<key>; from and to are RFC 3339.
+func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req, err := usageRequest(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := h.contextWithAuth(r)
+
+	resp, err := h.balanceService.GetUsage(ctx, req)
+	if err != nil {
+		h.handleGRPCError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// usageRequest reads a GetUsage request from the query string.
+func usageRequest(r *http.Request) (*pb.GetUsageRequest, error) {
+	q := r.URL.Query()
+	req := &pb.GetUsageRequest{
+		CustomerId: q.Get("customer_id"),
+		GroupBy:    q.Get("group_by"),
+		EndUserId:  q.Get("end_user_id"),
+	}
+
+	for name, dst := range map[string]*int64{"from": &req.From, "to": &req.To} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*dst = t.Unix()
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxUsageGroups {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxUsageGroups)
+		}
+		req.Limit = int32(limit)
+	}
+
+	return req, nil
+}
+
+// maxUsageGroups caps the limit of GET /v1/usage.
+const maxUsageGroups = 1000
+
+// handleHealth handles GET /health
+func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReady handles GET /ready
+func (h *Handler) handleReady(w http.ResponseWriter, r *http.Request) {
+	// TODO: Add actual readiness checks (database connectivity, etc.)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready"))
+}
+
+// decodeBody decodes a JSON request body into v, reading at most
+// maxBodyBytes of it. On failure it writes the error response (413 for an
+// oversized body, 400 for invalid JSON) and returns false.
+func (h *Handler) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+		return false
+	} else if err != nil {
+		h.writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// contextWithAuth creates a context with auth metadata from HTTP headers.
+func (h *Handler) contextWithAuth(r *http.Request) context.Context {
+	ctx := r.Context()
+
+	// Extract Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader != "" {
+		md := metadata.New(map[string]string{
+			"authorization": authHeader,
+		})
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+
+	return ctx
+}
+
+// handleGRPCError converts gRPC errors to HTTP errors.
+func (h *Handler) handleGRPCError(w http.ResponseWriter, err error) {
+	// Map gRPC errors to HTTP status codes
+	statusCode := http.StatusInternalServerError
+	message := err.Error()
+
+	if strings.Contains(message, "invalid API key") || strings.Contains(message, "unauthenticated") {
+		statusCode = http.StatusUnauthorized
+	} else if strings.Contains(message, "invalid argument") || strings.Contains(message, "required") {
+		statusCode = http.StatusBadRequest
+	} else if strings.Contains(message, "permission denied") {
+		statusCode = http.StatusForbidden
+	} else if strings.Contains(message, "not found") {
+		statusCode = http.StatusNotFound
+	} else if strings.Contains(message, "already has a reservation") {
+		statusCode = http.StatusConflict
+	}
+
+	// Retryable errors: pass the server's retry hint on as Retry-After
+	switch status.Code(err) {
+	case codes.Unavailable:
+		statusCode = http.StatusServiceUnavailable
+	case codes.ResourceExhausted:
+		statusCode = http.StatusTooManyRequests
+	case codes.DeadlineExceeded:
+		statusCode = http.StatusGatewayTimeout
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		statusCode = http.StatusGatewayTimeout
+	}
+	if delay, ok := api.RetryDelay(err); ok {
+		w.Header().Set("Retry-After", retryAfterSeconds(delay))
+	}
+
+	h.log.Error().Err(err).Int("status", statusCode).Msg("REST API error")
+
+	// A duplicate request ID comes with the original request's token, so the
+	// client can carry on with the reservation it already holds
+	if token, ok := api.ExistingRequestToken(err); ok {
+		h.writeJSON(w, statusCode, map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":          statusCode,
+				"message":       message,
+				"request_token": token,
+			},
+			"timestamp": time.Now().Unix(),
+		})
+		return
+	}
+
+	h.writeError(w, statusCode, message)
+}
+
+// retryAfterSeconds formats a retry delay as a Retry-After value: whole
+// seconds, rounded up so clients never retry early.
+func retryAfterSeconds(delay time.Duration) string {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// writeJSON writes a JSON response.
+func (h *Handler) writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.log.Error().Err(err).Msg("failed to encode JSON response")
+	}
+}
+
+// writeError writes a JSON error response.
+func (h *Handler) writeError(w http.ResponseWriter, statusCode int, message string) {
+	h.writeJSON(w, statusCode, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    statusCode,
+			"message": message,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// CORS middleware for development
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdempotencyKeyHeader is the request header carrying a client-chosen
+// idempotency key (see Idempotency).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyTTL is how long Idempotency remembers a response.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyPending marks a key whose first request is still being served.
+const idempotencyPending = "pending"
+
+// idempotencyLockMargin is how much longer than the slowest route timeout a
+// pending key is held (see idempotencyLockTTL).
+const idempotencyLockMargin = 15 * time.Second
+
+// idempotencyLockTTL bounds how long a pending key is held for routes
+// bounded by t: the longest timeout plus a margin, so the key outlives any
+// request it guards. A process that dies mid-request leaves the key to
+// expire after this, not after the full response TTL. If any class is
+// unbounded it returns 0, and the key is held for the response TTL.
+func idempotencyLockTTL(t RouteTimeouts) time.Duration {
+	longest := time.Duration(0)
+	for _, d := range []time.Duration{t.Hot, t.Standard, t.Slow} {
+		if d <= 0 {
+			return 0
+		}
+		longest = max(longest, d)
+	}
+	return longest + idempotencyLockMargin
+}
+
+// idempotencyStoreTimeout bounds storing or releasing a key once the
+// handler has run. The request's own context may already be cancelled by
+// then (a client that gave up is the one that will retry), so these writes
+// use a context detached from it.
+const idempotencyStoreTimeout = 2 * time.Second
+
+// idempotentResponse is a response stored for replay, with a fingerprint of
+// the request that produced it.
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// Idempotency makes POST requests that carry an Idempotency-Key header safe
+// to retry. The first request's response is stored in Redis for ttl and a
+// retry with the same key gets it back (marked Idempotent-Replayed: true)
+// without running the handler again, so a retried /v1/balance/check doesn't
+// reserve twice.
+//
+// Keys are scoped to the caller's Authorization header. A key reused for a
+// different request (method, path or body) is rejected with 409 Conflict, as
+// is a retry that arrives while the first request is still running.
+// Responses with a 5xx status are not stored, so those can be retried for
+// real, and so is a request whose handler panicked. A key is only held as
+// pending for a little longer than DefaultRouteTimeouts allow a request to
+// run, so a crashed server doesn't block retries for the whole ttl; wrap a
+// Handler built WithRouteTimeouts with its Idempotency method instead, which
+// holds keys for its own timeouts. If Redis is unavailable requests are
+// served without the guarantee. Keyed requests are buffered to be
+// fingerprinted, so a body over DefaultMaxBodyBytes is refused with 413
+// before it reaches the handler.
+func Idempotency(rdb *redis.Client, ttl time.Duration, logger zerolog.Logger) func(http.Handler) http.Handler {
+	return idempotency(rdb, ttl, idempotencyLockTTL(DefaultRouteTimeouts), logger)
+}
+
+// Idempotency is the package's Idempotency middleware with pending keys held
+// for h's route timeouts, so a slow route allowed to run longer than
+// DefaultRouteTimeouts can't outlive its key and run twice on a retry.
+func (h *Handler) Idempotency(rdb *redis.Client, ttl time.Duration) func(http.Handler) http.Handler {
+	return idempotency(rdb, ttl, idempotencyLockTTL(h.timeouts), h.log)
+}
+
+// idempotency implements Idempotency, holding pending keys for lockTTL (ttl
+// if lockTTL is 0).
+func idempotency(rdb *redis.Client, ttl, lockTTL time.Duration, logger zerolog.Logger) func(http.Handler) http.Handler {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if lockTTL <= 0 || lockTTL > ttl {
+		lockTTL = ttl
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Buffered whole to fingerprint it, so bounded before reading
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, DefaultMaxBodyBytes))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+				return
+			} else if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			bodyHash := sha256.Sum256(body)
+			fingerprint := r.Method + " " + r.URL.Path + " " + hex.EncodeToString(bodyHash[:])
+			redisKey := idempotencyRedisKey(r.Header.Get("Authorization"), key)
+			ctx := r.Context()
+
+			claimed, err := rdb.SetNX(ctx, redisKey, idempotencyPending, lockTTL).Result()
+			if err != nil {
+				logger.Error().Err(err).Msg("idempotency store unavailable, serving without it")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !claimed {
+				replayIdempotent(w, rdb, r, redisKey, fingerprint, logger)
+				return
+			}
+
+			release := func() {
+				storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyStoreTimeout)
+				defer cancel()
+				if err := rdb.Del(storeCtx, redisKey).Err(); err != nil {
+					logger.Error().Err(err).Msg("failed to release idempotency key")
+				}
+			}
+
+			rec := &recordingWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						release()
+						panic(p)
+					}
+				}()
+				next.ServeHTTP(rec, r)
+			}()
+
+			if rec.statusCode >= http.StatusInternalServerError {
+				release()
+				return
+			}
+
+			stored, _ := json.Marshal(idempotentResponse{
+				Fingerprint: fingerprint,
+				Status:      rec.statusCode,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+			storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyStoreTimeout)
+			defer cancel()
+			if err := rdb.Set(storeCtx, redisKey, stored, ttl).Err(); err != nil {
+				logger.Error().Err(err).Msg("failed to store idempotent response")
+			}
+		})
+	}
+}
+
+// replayIdempotent answers a request whose idempotency key is already taken.
+func replayIdempotent(w http.ResponseWriter, rdb *redis.Client, r *http.Request, redisKey, fingerprint string, logger zerolog.Logger) {
+	raw, err := rdb.Get(r.Context(), redisKey).Result()
+	if err == redis.Nil {
+		// Expired or released between SETNX and GET; let the client retry
+		writeJSONError(w, http.StatusConflict, "request with this Idempotency-Key is still in progress")
+		return
+	} else if err != nil {
+		logger.Error().Err(err).Msg("idempotency store unavailable")
+		writeJSONError(w, http.StatusServiceUnavailable, "idempotency store unavailable")
+		return
+	}
+
+	if raw == idempotencyPending {
+		writeJSONError(w, http.StatusConflict, "request with this Idempotency-Key is still in progress")
+		return
+	}
+
+	var stored idempotentResponse
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		logger.Error().Err(err).Msg("corrupt idempotent response")
+		writeJSONError(w, http.StatusInternalServerError, "corrupt idempotent response")
+		return
+	}
+
+	if stored.Fingerprint != fingerprint {
+		writeJSONError(w, http.StatusConflict, "Idempotency-Key was already used for a different request")
+		return
+	}
+
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// idempotencyRedisKey scopes an idempotency key to the caller, so one
+// caller can neither replay nor block another's requests.
+func idempotencyRedisKey(authorization, key string) string {
+	caller := sha256.Sum256([]byte(authorization))
+	return fmt.Sprintf("idempotency:%s:%s", hex.EncodeToString(caller[:8]), key)
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// writeJSONError writes an error in the same shape as Handler.writeError,
+// for middleware that has no Handler.
+func writeJSONError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    statusCode,
+			"message": message,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// EndpointAuth holds the credentials that guard privileged HTTP endpoints.
+//
+// /metrics and everything under /admin/ require credentials; /health and
+// /ready are always open so load balancers and Kubernetes probes keep
+// working. Leaving every field empty disables the gate.
+type EndpointAuth struct {
+	// AdminToken is a bearer token accepted on /admin/* and /metrics.
+	AdminToken string
+
+	// BasicUser and BasicPassword enable HTTP basic auth on the same paths,
+	// for tools that can't send a bearer token.
+	BasicUser     string
+	BasicPassword string
+
+	// MetricsToken is a bearer token accepted on /metrics only, so the
+	// Prometheus scraper doesn't need admin credentials.
+	MetricsToken string
+}
+
+// Enabled reports whether any credentials are configured.
+func (a EndpointAuth) Enabled() bool {
+	return a.AdminToken != "" || a.BasicUser != "" || a.MetricsToken != ""
+}
+
+// ProtectEndpoints requires credentials for /metrics and /admin/* requests.
+func ProtectEndpoints(auth EndpointAuth, logger zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			isMetrics := r.URL.Path == "/metrics"
+			isAdmin := strings.HasPrefix(r.URL.Path, "/admin/")
+
+			if !auth.Enabled() || (!isMetrics && !isAdmin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if auth.authorized(r, isMetrics) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			logger.Warn().
+				Str("path", r.URL.Path).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("unauthorized request to protected endpoint")
+
+			if auth.BasicUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="beam"`)
+			}
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		})
+	}
+}
+
+// authorized checks the request's credentials against the configured ones.
+// All comparisons are constant-time.
+func (a EndpointAuth) authorized(r *http.Request, isMetrics bool) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return a.BasicUser != "" &&
+			secureEqual(user, a.BasicUser) &&
+			secureEqual(pass, a.BasicPassword)
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	if a.AdminToken != "" && secureEqual(token, a.AdminToken) {
+		return true
+	}
+
+	return isMetrics && a.MetricsToken != "" && secureEqual(token, a.MetricsToken)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// TrustedProxies lists the networks of proxies (load balancers, ingress)
+// whose X-Forwarded-For and X-Real-IP headers are believed. Anyone else can
+// put whatever they like in those headers, so from other peers they are
+// ignored. A nil TrustedProxies trusts no one.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs (e.g.
+// "10.0.0.0/8,192.168.1.10"). A bare IP is treated as a single address.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) trusts(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client behind r.
+//
+// That is the immediate peer, unless the peer is a trusted proxy. Then
+// X-Forwarded-For is walked from the right (the entry the peer itself
+// added) past any further trusted proxies, and the first untrusted address
+// is the client. A trusted peer without X-Forwarded-For may send X-Real-IP
+// instead.
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !p.trusts(peerIP) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				// Garbage from a hop we can't vouch for; stop at what we know
+				break
+			}
+			client = ip.String()
+			if !p.trusts(ip) {
+				break
+			}
+		}
+		return client
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return peer
+}
+
+// LoggingMiddleware logs all HTTP requests, with the client IP resolved
+// through proxies (see TrustedProxies.ClientIP).
+func LoggingMiddleware(logger zerolog.Logger, proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			// Create a response writer wrapper to capture status code
+			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+			next.ServeHTTP(wrapped, r)
+
+			logger.Info().
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Int("status", wrapped.statusCode).
+				Dur("duration_ms", time.Since(start)).
+				Str("client_ip", proxies.ClientIP(r)).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("HTTP request")
+		})
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
\ No newline at end of file
@@ -0,0 +1,660 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yourusername/beam/internal/auth/authtest"
+	pb "github.com/yourusername/beam/pkg/proto/balance/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestProtectEndpoints(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := ProtectEndpoints(EndpointAuth{
+		AdminToken:    "admin-secret",
+		BasicUser:     "ops",
+		BasicPassword: "ops-secret",
+		MetricsToken:  "scrape-secret",
+	}, zerolog.Nop())(ok)
+
+	tests := []struct {
+		name   string
+		path   string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"health probe open", "/health", nil, http.StatusOK},
+		{"ready probe open", "/ready", nil, http.StatusOK},
+		{"metrics without credentials", "/metrics", nil, http.StatusUnauthorized},
+		{"admin without credentials", "/admin/apikeys/reload", nil, http.StatusUnauthorized},
+		{"metrics with metrics token", "/metrics", bearer("scrape-secret"), http.StatusOK},
+		{"admin with metrics token", "/admin/apikeys/reload", bearer("scrape-secret"), http.StatusUnauthorized},
+		{"admin with admin token", "/admin/apikeys/reload", bearer("admin-secret"), http.StatusOK},
+		{"metrics with admin token", "/metrics", bearer("admin-secret"), http.StatusOK},
+		{"admin with wrong token", "/admin/apikeys/reload", bearer("nope"), http.StatusUnauthorized},
+		{"admin with basic auth", "/admin/apikeys/reload", func(r *http.Request) { r.SetBasicAuth("ops", "ops-secret") }, http.StatusOK},
+		{"admin with bad basic auth", "/admin/apikeys/reload", func(r *http.Request) { r.SetBasicAuth("ops", "wrong") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestProtectEndpoints_DisabledWithoutCredentials(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := ProtectEndpoints(EndpointAuth{}, zerolog.Nop())(ok)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy forwards client",
+			remoteAddr: "10.1.2.3:443",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.1.2.3:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7, 192.168.1.10"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy with x-real-ip",
+			remoteAddr: "192.168.1.10:443",
+			headers:    map[string]string{"X-Real-IP": "203.0.113.7"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed headers from untrusted peer",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.1.2.3:443",
+			want:       "10.1.2.3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/health", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, proxies.ClientIP(r))
+		})
+	}
+
+	// Nobody is trusted by default.
+	r := httptest.NewRequest(http.MethodGet, "/health", nil)
+	r.RemoteAddr = "10.1.2.3:443"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "10.1.2.3", TrustedProxies(nil).ClientIP(r))
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies("not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestIdempotency(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	calls := 0
+	reserve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"approved":true,"reservation":%d}`, calls)
+	})
+	handler := Idempotency(rdb, time.Hour, zerolog.Nop())(reserve)
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sk_test")
+		r.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"customer_id":"cus_1","request_id":"req_1","estimated_grains":100}`
+
+	t.Run("first request", func(t *testing.T) {
+		w := post("key_1", body)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"approved":true,"reservation":1}`, w.Body.String())
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("identical retry is replayed", func(t *testing.T) {
+		w := post("key_1", body)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"approved":true,"reservation":1}`, w.Body.String())
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 1, calls, "handler must not run again")
+	})
+
+	t.Run("different body with same key conflicts", func(t *testing.T) {
+		w := post("key_1", `{"customer_id":"cus_1","request_id":"req_2","estimated_grains":100}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("same key from another caller is independent", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sk_other")
+		r.Header.Set(IdempotencyKeyHeader, "key_1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("retry while first is in flight conflicts", func(t *testing.T) {
+		require.NoError(t, rdb.Set(context.Background(),
+			idempotencyRedisKey("Bearer sk_test", "key_busy"), idempotencyPending, time.Hour).Err())
+
+		w := post("key_busy", body)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestIdempotency_ServerErrorsAreNotStored(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	calls := 0
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := Idempotency(rdb, time.Hour, zerolog.Nop())(flaky)
+
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader(`{}`))
+		r.Header.Set(IdempotencyKeyHeader, "key_1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, want, w.Code)
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotency_StoresAfterClientDisconnects(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	redisKey := idempotencyRedisKey("", "key_1")
+	calls := 0
+	var lockTTL time.Duration
+	reserve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		lockTTL = mr.TTL(redisKey)
+		// The reservation is made, then the client gives up
+		cancel()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"approved":true}`)
+	})
+	handler := Idempotency(rdb, time.Hour, zerolog.Nop())(reserve)
+
+	post := func(ctx context.Context) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader(`{}`)).WithContext(ctx)
+		r.Header.Set(IdempotencyKeyHeader, "key_1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	post(ctx)
+	assert.Equal(t, idempotencyLockTTL(DefaultRouteTimeouts), lockTTL, "pending is held for the lock TTL, not the response TTL")
+	stored, err := mr.Get(redisKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, idempotencyPending, stored, "the response is stored despite the cancelled context")
+	assert.Greater(t, mr.TTL(redisKey), idempotencyLockTTL(DefaultRouteTimeouts))
+
+	w := post(context.Background())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, calls)
+}
+
+func TestHandlerIdempotency_LockOutlivesConfiguredTimeouts(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	lockTTL := func(h *Handler) time.Duration {
+		var held time.Duration
+		handler := h.Idempotency(rdb, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			held = mr.TTL(idempotencyRedisKey("", "key_1"))
+			w.WriteHeader(http.StatusOK)
+		}))
+		mr.FlushAll()
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/finalize/batch", strings.NewReader(`{}`))
+		r.Header.Set(IdempotencyKeyHeader, "key_1")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return held
+	}
+
+	assert.Equal(t, DefaultRouteTimeouts.Slow+idempotencyLockMargin, lockTTL(&Handler{log: zerolog.Nop(), timeouts: DefaultRouteTimeouts}))
+
+	// A deployment that lets slow routes run longer holds keys longer
+	slow := &Handler{log: zerolog.Nop(), timeouts: RouteTimeouts{
+		Hot: time.Second, Standard: 5 * time.Second, Slow: 2 * time.Minute,
+	}}
+	assert.Equal(t, 2*time.Minute+idempotencyLockMargin, lockTTL(slow))
+
+	// An unbounded class may run for ever: hold the key for the response TTL
+	unbounded := &Handler{log: zerolog.Nop(), timeouts: RouteTimeouts{Hot: time.Second}}
+	assert.Equal(t, time.Hour, lockTTL(unbounded))
+}
+
+func TestIdempotency_PanicReleasesKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	handler := Idempotency(rdb, time.Hour, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler crashed")
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader(`{}`))
+	r.Header.Set(IdempotencyKeyHeader, "key_1")
+	assert.Panics(t, func() { handler.ServeHTTP(httptest.NewRecorder(), r) })
+	assert.False(t, mr.Exists(idempotencyRedisKey("", "key_1")), "a panicking handler releases its key")
+}
+
+func TestWritePricing(t *testing.T) {
+	h := &Handler{log: zerolog.Nop()}
+	resp := &pb.GetPricingResponse{
+		Prices: []*pb.ModelPrice{
+			{Model: "claude-3-haiku", Provider: "anthropic", InputCostPerMillionTokens: 250000, OutputCostPerMillionTokens: 1250000},
+			{Model: "gpt-4", Provider: "openai", InputCostPerMillionTokens: 30000000, OutputCostPerMillionTokens: 60000000},
+		},
+		Etag: `"3f2a9c"`,
+	}
+
+	t.Run("returns all prices with an etag", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.writePricing(w, httptest.NewRequest(http.MethodGet, "/v1/pricing", nil), resp)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"3f2a9c"`, w.Header().Get("ETag"))
+
+		var got pb.GetPricingResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		require.Len(t, got.Prices, 2)
+		assert.Equal(t, "claude-3-haiku", got.Prices[0].Model)
+		assert.Equal(t, int64(60000000), got.Prices[1].OutputCostPerMillionTokens)
+	})
+
+	for _, ifNoneMatch := range []string{`"3f2a9c"`, `W/"3f2a9c"`, `"old", "3f2a9c"`, `*`} {
+		t.Run("not modified for "+ifNoneMatch, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/pricing", nil)
+			r.Header.Set("If-None-Match", ifNoneMatch)
+			w := httptest.NewRecorder()
+			h.writePricing(w, r, resp)
+
+			assert.Equal(t, http.StatusNotModified, w.Code)
+			assert.Empty(t, w.Body.String())
+		})
+	}
+
+	t.Run("stale etag gets the prices", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/pricing", nil)
+		r.Header.Set("If-None-Match", `"old"`)
+		w := httptest.NewRecorder()
+		h.writePricing(w, r, resp)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestCustomersEndpoints(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_user", "user_1"))
+	h := NewHandler(nil, fake, zerolog.Nop())
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("requires the admin scope", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, get("/v1/customers", "sk_user").Code)
+		assert.Equal(t, http.StatusForbidden, get("/v1/customers/cus_1", "sk_user").Code)
+		assert.Equal(t, http.StatusUnauthorized, get("/v1/customers", "sk_unknown").Code)
+	})
+
+	t.Run("rejects a bad limit or path", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, get("/v1/customers?limit=0", "sk_user").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/v1/customers?limit=many", "sk_user").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/v1/customers/cus_1/extra", "sk_user").Code)
+	})
+
+	t.Run("unknown customer is 404", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.handleGRPCError(w, status.Errorf(codes.NotFound, "customer not found: cus_missing"))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestListCustomersRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/v1/customers?limit=25&cursor=abc", nil)
+	req, err := listCustomersRequest(r)
+	require.NoError(t, err)
+	assert.Equal(t, int32(25), req.PageSize)
+	assert.Equal(t, "abc", req.Cursor)
+
+	// No limit leaves the server default.
+	req, err = listCustomersRequest(httptest.NewRequest(http.MethodGet, "/v1/customers", nil))
+	require.NoError(t, err)
+	assert.Zero(t, req.PageSize)
+
+	_, err = listCustomersRequest(httptest.NewRequest(http.MethodGet, "/v1/customers?limit=501", nil))
+	assert.Error(t, err)
+}
+
+func TestUsageRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet,
+		"/v1/usage?customer_id=cus_1&group_by=tag:team&from=2026-03-01T00:00:00Z&limit=20", nil)
+	req, err := usageRequest(r)
+	require.NoError(t, err)
+	assert.Equal(t, "cus_1", req.CustomerId)
+	assert.Equal(t, "tag:team", req.GroupBy)
+	assert.Equal(t, int64(1772323200), req.From)
+	assert.Zero(t, req.To)
+	assert.Equal(t, int32(20), req.Limit)
+
+	_, err = usageRequest(httptest.NewRequest(http.MethodGet, "/v1/usage?from=yesterday", nil))
+	assert.Error(t, err)
+
+	_, err = usageRequest(httptest.NewRequest(http.MethodGet, "/v1/usage?limit=1001", nil))
+	assert.Error(t, err)
+}
+
+func TestHandleGRPCError_RetryAfter(t *testing.T) {
+	h := NewHandler(nil, authtest.New(), zerolog.Nop())
+
+	withRetryInfo := func(code codes.Code, delay time.Duration) error {
+		st, err := status.New(code, "try again later").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+		require.NoError(t, err)
+		return st.Err()
+	}
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantHeader string
+	}{
+		{"unavailable", withRetryInfo(codes.Unavailable, 4*time.Second), http.StatusServiceUnavailable, "4"},
+		{"resource exhausted", withRetryInfo(codes.ResourceExhausted, 2*time.Second), http.StatusTooManyRequests, "2"},
+		{"rounded up", withRetryInfo(codes.Unavailable, 1500*time.Millisecond), http.StatusServiceUnavailable, "2"},
+		{"no hint", status.Error(codes.Unavailable, "try again later"), http.StatusServiceUnavailable, ""},
+		{"not retryable", status.Error(codes.NotFound, "customer not found: cus_1"), http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.handleGRPCError(w, tt.err)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantHeader, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	h := NewHandler(nil, authtest.New(), zerolog.Nop(), WithMaxBodyBytes(64))
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	oversized := `{"customer_id": "` + strings.Repeat("x", 100) + `"}`
+
+	for _, path := range []string{"/v1/balance/check", "/v1/balance/deduct", "/v1/balance/check-and-deduct", "/v1/balance/finalize"} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(oversized)))
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+			assert.Contains(t, w.Body.String(), "exceeds 64 bytes")
+		})
+	}
+
+	t.Run("invalid JSON under the limit is still 400", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/balance/check", strings.NewReader("{")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("idempotency-keyed request", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		defer rdb.Close()
+
+		reached := false
+		handler := Idempotency(rdb, time.Minute, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check",
+			strings.NewReader(strings.Repeat("x", DefaultMaxBodyBytes+1)))
+		r.Header.Set(IdempotencyKeyHeader, "key-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.False(t, reached)
+		assert.Empty(t, mr.Keys(), "nothing claimed for a refused request")
+	})
+}
+
+func TestTimingHeaders(t *testing.T) {
+	fake := authtest.New()
+	require.NoError(t, fake.StoreAPIKey(context.Background(), "sk_valid", "user_1"))
+
+	// Missing customer_id: rejected by the service before the ledger, which
+	// is still timed
+	check := func(h *Handler) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		h.RegisterRoutes(mux)
+		r := httptest.NewRequest(http.MethodPost, "/v1/balance/check",
+			strings.NewReader(`{"request_id":"req_1","estimated_grains":100}`))
+		r.Header.Set("Authorization", "Bearer sk_valid")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		w := check(NewHandler(nil, fake, zerolog.Nop(), WithTimingHeaders(true)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		total, err := strconv.ParseFloat(w.Header().Get("X-Ledger-Total-Ms"), 64)
+		require.NoError(t, err)
+		redisMS, err := strconv.ParseFloat(w.Header().Get("X-Ledger-Redis-Ms"), 64)
+		require.NoError(t, err)
+		assert.Greater(t, total, 0.0)
+		assert.Less(t, total, 1000.0)
+		assert.Zero(t, redisMS, "the ledger was never reached")
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		w := check(NewHandler(nil, fake, zerolog.Nop()))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, w.Header().Get("X-Ledger-Total-Ms"))
+		assert.Empty(t, w.Header().Get("X-Ledger-Redis-Ms"))
+	})
+}
+
+// slowAuth holds API key validation until the caller's context is done,
+// standing in for a ledger call that hangs.
+type slowAuth struct {
+	*authtest.Authenticator
+	cancelled chan error
+}
+
+func (a *slowAuth) ValidateAPIKey(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	a.cancelled <- ctx.Err()
+	return "", ctx.Err()
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	a := &slowAuth{Authenticator: authtest.New(), cancelled: make(chan error, 1)}
+	h := NewHandler(nil, a, zerolog.Nop(), WithRouteTimeouts(RouteTimeouts{Hot: 20 * time.Millisecond}))
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/balance/check",
+		strings.NewReader(`{"customer_id":"cus_1","request_id":"req_1","estimated_grains":100}`)))
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Less(t, time.Since(start), time.Second)
+	var body struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Timestamp int64 `json:"timestamp"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, http.StatusGatewayTimeout, body.Error.Code)
+	assert.Contains(t, body.Error.Message, "20ms")
+	assert.NotZero(t, body.Timestamp)
+
+	select {
+	case err := <-a.cancelled:
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "the deadline reaches the service call")
+	case <-time.After(time.Second):
+		t.Fatal("service call was not cancelled")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	h := NewHandler(nil, authtest.New(), zerolog.Nop())
+
+	t.Run("slow handler gets 504", func(t *testing.T) {
+		late := make(chan struct{})
+		slow := h.deadline(10*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("too late"))
+			close(late)
+		})
+
+		w := httptest.NewRecorder()
+		slow(w, httptest.NewRequest(http.MethodGet, "/v1/usage", nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), `"code":504`)
+		<-late
+		assert.NotContains(t, w.Body.String(), "too late")
+	})
+
+	t.Run("fast handler passes through", func(t *testing.T) {
+		fast := h.deadline(time.Second, func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Deadline()
+			assert.True(t, ok)
+			w.Header().Set("X-Test", "1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("done"))
+		})
+
+		w := httptest.NewRecorder()
+		fast(w, httptest.NewRequest(http.MethodGet, "/v1/usage", nil))
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "1", w.Header().Get("X-Test"))
+		assert.Equal(t, "done", w.Body.String())
+	})
+
+	t.Run("zero timeout leaves the route unbounded", func(t *testing.T) {
+		h.deadline(0, func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Deadline()
+			assert.False(t, ok)
+		})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/usage", nil))
+	})
+}
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxDiffRows caps how many mismatches a BalanceDiff lists. Every mismatch
+// is still counted and, when fixing, resynced.
+const maxDiffRows = 1000
+
+// BalanceMismatch is a customer whose Redis balance differs from PostgreSQL.
+type BalanceMismatch struct {
+	CustomerID      string `json:"customer_id"`
+	Currency        string `json:"currency"`
+	RedisBalance    int64  `json:"redis_balance"`
+	PostgresBalance int64  `json:"postgres_balance"`
+
+	// MissingInRedis means Redis has no balance for the customer at all.
+	MissingInRedis bool `json:"missing_in_redis"`
+
+	// Fixed means the customer was resynced from PostgreSQL.
+	Fixed bool `json:"fixed"`
+}
+
+// Delta is how far the Redis balance is above PostgreSQL's.
+func (m BalanceMismatch) Delta() int64 {
+	return m.RedisBalance - m.PostgresBalance
+}
+
+// BalanceDiff is the result of DiffBalances.
+type BalanceDiff struct {
+	CustomersChecked int `json:"customers_checked"`
+
+	// Mismatched counts every customer found to differ, including those
+	// missing in Redis.
+	Mismatched int `json:"mismatched"`
+
+	// Fixed is how many of them were resynced.
+	Fixed int `json:"fixed"`
+
+	// Mismatches lists the first maxDiffRows of them.
+	Mismatches []BalanceMismatch `json:"mismatches"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// Remaining returns how many mismatches weren't fixed.
+func (d *BalanceDiff) Remaining() int {
+	return d.Mismatched - d.Fixed
+}
+
+// DiffBalances compares Redis balances against PostgreSQL for sampleSize
+// random customers, or for every customer if sampleSize <= 0 (paged by
+// batchSize, as in VerifyAll), and lists the ones that differ.
+//
+// With fix, each mismatched customer is resynced with SyncCustomer as it is
+// found; one that fails to sync stays unfixed. Unlike VerifyAll this doesn't
+// look for orphaned Redis balances or enter safe mode.
+func (s *Syncer) DiffBalances(ctx context.Context, sampleSize, batchSize int, fix bool) (*BalanceDiff, error) {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	start := time.Now()
+	diff := &BalanceDiff{Mismatches: []BalanceMismatch{}}
+
+	if sampleSize > 0 {
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT customer_id, current_balance_grains, currency
+			FROM customers
+			ORDER BY RANDOM()
+			LIMIT $1
+		`, sampleSize)
+		if err != nil {
+			return diff, fmt.Errorf("query failed: %w", err)
+		}
+		customers, err := scanCustomerBalances(rows)
+		if err != nil {
+			return diff, err
+		}
+		if err := s.diffCustomers(ctx, diff, customers, fix); err != nil {
+			return diff, err
+		}
+	} else {
+		cursor := ""
+		for {
+			customers, err := s.customerPage(ctx, cursor, batchSize)
+			if err != nil {
+				return diff, err
+			}
+			if err := s.diffCustomers(ctx, diff, customers, fix); err != nil {
+				return diff, err
+			}
+			if len(customers) < batchSize {
+				break
+			}
+			cursor = customers[len(customers)-1].customerID
+		}
+	}
+
+	diff.Duration = time.Since(start)
+
+	s.log.Info().
+		Int("customers_checked", diff.CustomersChecked).
+		Int("mismatched", diff.Mismatched).
+		Int("fixed", diff.Fixed).
+		Dur("duration", diff.Duration).
+		Msg("balance diff complete")
+
+	return diff, nil
+}
+
+// diffCustomers compares one batch of customers and adds them to diff.
+func (s *Syncer) diffCustomers(ctx context.Context, diff *BalanceDiff, customers []customerBalance, fix bool) error {
+	diff.CustomersChecked += len(customers)
+	if len(customers) == 0 {
+		return nil
+	}
+
+	mismatches, err := s.compareBalances(ctx, customers)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		if fix {
+			if err := s.SyncCustomer(ctx, m.CustomerID); err != nil {
+				s.log.Error().Err(err).Str("customer_id", m.CustomerID).Msg("failed to sync customer")
+			} else {
+				m.Fixed = true
+				diff.Fixed++
+			}
+		}
+
+		diff.Mismatched++
+		if len(diff.Mismatches) < maxDiffRows {
+			diff.Mismatches = append(diff.Mismatches, m)
+		}
+	}
+	return nil
+}
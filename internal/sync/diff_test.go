@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBalances_ListsInjectedMismatches(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	rdb.Set(ctx, "customer:balance:cus_a", 1000, 0)
+	rdb.Set(ctx, "customer:balance:cus_b", 1200, 0)    // drifted up
+	rdb.Set(ctx, "customer:balance:cus_d:EUR", 100, 0) // drifted down
+	// cus_c is missing in Redis
+
+	columns := []string{"customer_id", "current_balance_grains", "currency"}
+	mock.ExpectQuery("WHERE customer_id > \\$1").WithArgs("", 2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("cus_a", 1000, "USD").AddRow("cus_b", 1000, "USD"))
+	mock.ExpectQuery("WHERE customer_id > \\$1").WithArgs("cus_b", 2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("cus_c", 500, "USD").AddRow("cus_d", 250, "EUR"))
+	mock.ExpectQuery("WHERE customer_id > \\$1").WithArgs("cus_d", 2).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	diff, err := s.DiffBalances(ctx, 0, 2, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, diff.CustomersChecked)
+	assert.Equal(t, 3, diff.Mismatched)
+	assert.Equal(t, 3, diff.Remaining())
+	assert.Equal(t, []BalanceMismatch{
+		{CustomerID: "cus_b", Currency: "USD", RedisBalance: 1200, PostgresBalance: 1000},
+		{CustomerID: "cus_c", Currency: "USD", PostgresBalance: 500, MissingInRedis: true},
+		{CustomerID: "cus_d", Currency: "EUR", RedisBalance: 100, PostgresBalance: 250},
+	}, diff.Mismatches)
+	assert.Equal(t, int64(200), diff.Mismatches[0].Delta())
+	assert.Equal(t, int64(-150), diff.Mismatches[2].Delta())
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDiffBalances_SampleAndFix(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	rdb.Set(ctx, "customer:balance:cus_a", 900, 0)
+	rdb.Set(ctx, "customer:balance:cus_b", 50, 0)
+
+	mock.ExpectQuery("ORDER BY RANDOM").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "currency"}).
+			AddRow("cus_a", 1000, "USD").
+			AddRow("cus_b", 75, "USD"))
+
+	// cus_a resyncs; cus_b's sync fails and stays mismatched
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_a").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow(1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}"))
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_b").
+		WillReturnError(errors.New("connection reset"))
+
+	diff, err := s.DiffBalances(ctx, 2, 500, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, diff.CustomersChecked)
+	assert.Equal(t, 2, diff.Mismatched)
+	assert.Equal(t, 1, diff.Fixed)
+	assert.Equal(t, 1, diff.Remaining())
+	require.Len(t, diff.Mismatches, 2)
+	assert.True(t, diff.Mismatches[0].Fixed)
+	assert.False(t, diff.Mismatches[1].Fixed)
+
+	balance, err := rdb.Get(ctx, "customer:balance:cus_a").Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
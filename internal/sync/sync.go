@@ -23,29 +23,150 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	stdsync "sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
+// System-wide aggregates maintained by the ledger's Lua scripts (see
+// ledger/totals.go). Any balance the syncer overwrites must adjust them too.
+const (
+	totalBalanceKey  = "system:total_balance"
+	totalReservedKey = "system:total_reserved"
+)
+
+// safeModeKey mirrors the ledger's integrity safe mode flag (see
+// ledger.EnterSafeMode). While it exists no reservations are approved.
+const safeModeKey = "system:safe_mode"
+
+// balanceKey and reservedKey mirror the ledger's key scheme: USD keeps the
+// original unsuffixed keys, other currencies are suffixed with their code.
+func balanceKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:balance:%s", customerID)
+	}
+	return fmt.Sprintf("customer:balance:%s:%s", customerID, currency)
+}
+
+func reservedKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:reserved:%s", customerID)
+	}
+	return fmt.Sprintf("customer:reserved:%s:%s", customerID, currency)
+}
+
+// reservedLowKey is the share of reservedKey held by low-priority requests.
+func reservedLowKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:reserved_low:%s", customerID)
+	}
+	return fmt.Sprintf("customer:reserved_low:%s:%s", customerID, currency)
+}
+
+// inflightKey tracks the customer's in-flight requests, across currencies.
+func inflightKey(customerID string) string {
+	return fmt.Sprintf("customer:inflight:%s", customerID)
+}
+
+func bucketsKey(customerID, currency string) string {
+	if currency == "" || currency == "USD" {
+		return fmt.Sprintf("customer:buckets:%s", customerID)
+	}
+	return fmt.Sprintf("customer:buckets:%s:%s", customerID, currency)
+}
+
+// bucketsColumn selects a customer's funding buckets (see
+// ledger.FundingBuckets) as a JSON object of bucket -> grains, '{}' for a
+// single-bucket customer.
+const bucketsColumn = `COALESCE((
+			SELECT json_object_agg(b.bucket, b.balance_grains)
+			FROM customer_balance_buckets b
+			WHERE b.customer_id = customers.customer_id
+		), '{}')`
+
+// setBalanceScript overwrites a customer's balance and moves the system-wide
+// total by the same delta, atomically.
+//
+// KEYS[1] = customer:balance:{customer_id}, KEYS[2] = system:total_balance
+// ARGV[1] = new balance
+var setBalanceScript = redis.NewScript(`
+local old = tonumber(redis.call('GET', KEYS[1]) or '0')
+local new = tonumber(ARGV[1])
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('INCRBY', KEYS[2], new - old)
+return old
+`)
+
+// apiKeyIndexKey is a Redis set of every key hash written by SyncAPIKeys.
+// It lets a reload find and remove keys that are no longer active without
+// scanning the keyspace.
+const apiKeyIndexKey = "apikeys:synced"
+
 // Syncer handles PostgreSQL to Redis synchronization.
 type Syncer struct {
-	redis  *redis.Client
-	db     *sql.DB
-	log    zerolog.Logger
-	stopCh chan struct{}
+	redis *redis.Client
+	db    *sql.DB
+	log   zerolog.Logger
+
+	// ctx is cancelled by Stop. Every background goroutine started by the
+	// Syncer selects on it and is tracked by wg, so Stop can wait for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     stdsync.WaitGroup
+
+	// apiKeyMu serializes API key reloads within this process
+	apiKeyMu stdsync.Mutex
+
+	// safeModeThreshold is how many discrepancies an integrity check may
+	// find before it enters safe mode; zero never does.
+	safeModeThreshold int
+
+	// duplicateThreshold is how many duplicate customer IDs InitializeRedis
+	// tolerates before failing; zero never fails.
+	duplicateThreshold int
+}
+
+// Option configures optional Syncer behaviour.
+type Option func(*Syncer)
+
+// WithSafeModeThreshold makes VerifyIntegrity and VerifyAll put the ledger
+// in integrity safe mode when they find more than threshold discrepancies,
+// e.g. after Redis was flushed or restored from a stale snapshot. Zero (the
+// default) never enters safe mode automatically.
+func WithSafeModeThreshold(threshold int) Option {
+	return func(s *Syncer) {
+		s.safeModeThreshold = threshold
+	}
+}
+
+// WithDuplicateThreshold makes InitializeRedis fail when the customers table
+// holds more than threshold duplicate customer IDs, e.g. after a bad import.
+// Zero (the default) only logs them.
+func WithDuplicateThreshold(threshold int) Option {
+	return func(s *Syncer) {
+		s.duplicateThreshold = threshold
+	}
 }
 
 // NewSyncer creates a new Syncer instance.
-func NewSyncer(rdb *redis.Client, db *sql.DB, logger zerolog.Logger) *Syncer {
-	return &Syncer{
+func NewSyncer(rdb *redis.Client, db *sql.DB, logger zerolog.Logger, opts ...Option) *Syncer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Syncer{
 		redis:  rdb,
 		db:     db,
 		log:    logger.With().Str("component", "syncer").Logger(),
-		stopCh: make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // InitializeRedis performs a full sync of all customer balances from PostgreSQL to Redis.
@@ -59,6 +180,14 @@ func NewSyncer(rdb *redis.Client, db *sql.DB, logger zerolog.Logger) *Syncer {
 // 3. Initializes reserved counter to 0 for each customer
 // 4. Logs statistics about what was synced
 //
+// Redis then matches PostgreSQL again, so integrity safe mode, if on, is
+// cleared.
+//
+// A customer ID seen more than once keeps its first row; the rest are logged
+// and skipped. Past the duplicate threshold (see WithDuplicateThreshold) it
+// returns an error before the system-wide totals are reset or safe mode is
+// cleared, though earlier batches of customers have already been written.
+//
 // Performance: Can sync 10,000 customers in under 1 second using Redis pipeline.
 func (s *Syncer) InitializeRedis(ctx context.Context) error {
 	start := time.Now()
@@ -66,7 +195,8 @@ func (s *Syncer) InitializeRedis(ctx context.Context) error {
 
 	// Query all customers and their balances
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT customer_id, current_balance_grains
+		SELECT customer_id, current_balance_grains, max_reservation_grains, currency, kill_grace_grains,
+		billing_mode, credit_ceiling_grains, refund_policy, refund_percent, max_concurrent_requests, minimum_viable_balance_grains, `+bucketsColumn+`
 		FROM customers
 		ORDER BY customer_id
 	`)
@@ -78,24 +208,44 @@ func (s *Syncer) InitializeRedis(ctx context.Context) error {
 	// Use Redis pipeline for bulk operations (much faster than individual SETs)
 	pipe := s.redis.Pipeline()
 	count := 0
+	duplicates := 0
+	seen := make(map[string]struct{})
+	var totalBalance int64
 
 	for rows.Next() {
-		var customerID string
-		var balance int64
+		var customerID, currency, billingMode, refundPolicy string
+		var balance, killGrace, creditCeiling, refundPercent, maxConcurrent int64
+		var maxReservation, minimumBalance sql.NullInt64
+		var buckets []byte
 
-		if err := rows.Scan(&customerID, &balance); err != nil {
+		if err := rows.Scan(&customerID, &balance, &maxReservation, &currency, &killGrace, &billingMode, &creditCeiling, &refundPolicy, &refundPercent, &maxConcurrent, &minimumBalance, &buckets); err != nil {
 			s.log.Error().Err(err).Msg("failed to scan customer row")
 			continue
 		}
 
-		// Set balance in Rediscustomer
-		balanceKey := fmt.Sprintf(":balance:%s", customerID)
-		pipe.Set(ctx, balanceKey, balance, 0) // No expiration
+		// Customer IDs should be unique; a second row would silently
+		// overwrite the first and be counted twice in the total balance
+		if _, ok := seen[customerID]; ok {
+			duplicates++
+			s.log.Warn().Str("customer_id", customerID).Msg("duplicate customer id, skipping row")
+			continue
+		}
+		seen[customerID] = struct{}{}
+
+		// Set balance in Redis
+		pipe.Set(ctx, balanceKey(customerID, currency), balance, 0) // No expiration
+		totalBalance += balance
+		if err := setBuckets(ctx, pipe, customerID, currency, buckets); err != nil {
+			s.log.Error().Err(err).Str("customer_id", customerID).Msg("invalid funding buckets")
+		}
 
 		// Initialize reserved counter to 0
 		// This gets incremented when requests are approved
-		reservedKey := fmt.Sprintf("customer:reserved:%s", customerID)
-		pipe.Set(ctx, reservedKey, 0, 0)
+		pipe.Set(ctx, reservedKey(customerID, currency), 0, 0)
+		pipe.Set(ctx, reservedLowKey(customerID, currency), 0, 0)
+		pipe.Del(ctx, inflightKey(customerID))
+
+		setCustomerConfig(ctx, pipe, customerID, maxReservation, currency, killGrace, billingMode, creditCeiling, refundPolicy, refundPercent, maxConcurrent, minimumBalance)
 
 		count++
 
@@ -109,18 +259,36 @@ func (s *Syncer) InitializeRedis(ctx context.Context) error {
 		}
 	}
 
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("row iteration error: %w", err)
+	}
+
+	if duplicates > 0 {
+		s.log.Error().Int("duplicates", duplicates).Msg("customers table has duplicate customer ids")
+		if s.duplicateThreshold > 0 && duplicates > s.duplicateThreshold {
+			return fmt.Errorf("%d duplicate customer ids exceed threshold of %d", duplicates, s.duplicateThreshold)
+		}
+	}
+
+	// Every balance and reserved counter was just overwritten, so the
+	// system-wide aggregates are reset to match
+	pipe.Set(ctx, totalBalanceKey, totalBalance, 0)
+	pipe.Set(ctx, totalReservedKey, 0, 0)
+	clearedSafeMode := pipe.Del(ctx, safeModeKey)
+
 	// Execute remaining commands
 	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("final pipeline exec failed: %w", err)
 	}
 
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("row iteration error: %w", err)
+	if clearedSafeMode.Val() > 0 {
+		s.log.Warn().Msg("integrity safe mode cleared by full resync")
 	}
 
 	duration := time.Since(start)
 	s.log.Info().
 		Int("customer_count", count).
+		Int("duplicates", duplicates).
 		Dur("duration", duration).
 		Msg("redis initialization complete")
 
@@ -133,11 +301,23 @@ func (s *Syncer) InitializeRedis(ctx context.Context) error {
 // Redis for fast authentication during requests.
 //
 // Redis key format: "apikey:<sha256_hash>" -> platform_user_id
+//
+// Each user's scopes are written alongside their key, as the set
+// "platform_user:scopes:<user_id>" (see auth.RedisAuthenticator.HasScope).
+//
+// This is safe to call at any time, including while serving traffic. Keys
+// that are no longer active (revoked, user suspended) are removed, and the
+// whole key set is applied in one MULTI/EXEC, so requests never see a
+// half-reloaded set and concurrent reloads (periodic timer, admin endpoint,
+// CLI) can't interleave their writes.
 func (s *Syncer) SyncAPIKeys(ctx context.Context) error {
+	s.apiKeyMu.Lock()
+	defer s.apiKeyMu.Unlock()
+
 	s.log.Info().Msg("syncing API keys to redis")
 
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT user_id, api_key_hash
+		SELECT user_id, api_key_hash, scopes
 		FROM platform_users
 		WHERE subscription_status = 'active'
 	`)
@@ -146,29 +326,91 @@ func (s *Syncer) SyncAPIKeys(ctx context.Context) error {
 	}
 	defer rows.Close()
 
-	pipe := s.redis.Pipeline()
-	count := 0
-
+	keys := make(map[string]string)
+	scopes := make(map[string][]string)
 	for rows.Next() {
 		var userID, keyHash string
-		if err := rows.Scan(&userID, &keyHash); err != nil {
+		var userScopes pq.StringArray
+		if err := rows.Scan(&userID, &keyHash, &userScopes); err != nil {
 			s.log.Error().Err(err).Msg("failed to scan api key row")
 			continue
 		}
+		keys[keyHash] = userID
+		scopes[userID] = userScopes
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("row iteration error: %w", err)
+	}
+
+	// Keys we wrote last time; any not in the new set must be revoked
+	previous, err := s.redis.SMembers(ctx, apiKeyIndexKey).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read api key index: %w", err)
+	}
 
+	pipe := s.redis.TxPipeline()
+
+	hashes := make([]interface{}, 0, len(keys))
+	for keyHash, userID := range keys {
 		redisKey := fmt.Sprintf("apikey:%s", keyHash)
 		pipe.Set(ctx, redisKey, userID, 0) // No expiration
-		count++
+		hashes = append(hashes, keyHash)
+	}
+
+	for userID, userScopes := range scopes {
+		scopesKey := fmt.Sprintf("platform_user:scopes:%s", userID)
+		pipe.Del(ctx, scopesKey)
+		if len(userScopes) > 0 {
+			members := make([]interface{}, len(userScopes))
+			for i, scope := range userScopes {
+				members[i] = scope
+			}
+			pipe.SAdd(ctx, scopesKey, members...)
+		}
+	}
+
+	revoked := 0
+	for _, keyHash := range previous {
+		if _, ok := keys[keyHash]; !ok {
+			pipe.Del(ctx, fmt.Sprintf("apikey:%s", keyHash))
+			revoked++
+		}
+	}
+
+	pipe.Del(ctx, apiKeyIndexKey)
+	if len(hashes) > 0 {
+		pipe.SAdd(ctx, apiKeyIndexKey, hashes...)
 	}
 
 	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("pipeline exec failed: %w", err)
 	}
 
-	s.log.Info().Int("key_count", count).Msg("api keys synced to redis")
+	s.log.Info().
+		Int("key_count", len(keys)).
+		Int("revoked_count", revoked).
+		Msg("api keys synced to redis")
 	return nil
 }
 
+// StartPeriodicAPIKeySync starts a background goroutine that reloads API keys
+// from PostgreSQL periodically, so newly provisioned keys become usable
+// without a restart.
+//
+// Sync interval: Every minute by default
+func (s *Syncer) StartPeriodicAPIKeySync(interval time.Duration) {
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	s.log.Info().
+		Dur("interval", interval).
+		Msg("starting periodic api key sync")
+
+	s.runEvery("api key sync", interval, time.Minute, s.SyncAPIKeys)
+}
+
 // StartPeriodicSync starts a background goroutine that syncs Redis from PostgreSQL periodically.
 //
 // This corrects any drift that might occur due to:
@@ -186,24 +428,40 @@ func (s *Syncer) StartPeriodicSync(interval time.Duration) {
 		Dur("interval", interval).
 		Msg("starting periodic sync")
 
-	ticker := time.NewTicker(interval)
+	s.runEvery("sync", interval, 2*time.Minute, s.syncRecentlyUpdatedCustomers)
+}
+
+// runEvery runs fn every interval until the Syncer is stopped. Each run gets
+// its own timeout and is cancelled early if Stop is called mid-run.
+func (s *Syncer) runEvery(name string, interval, timeout time.Duration, fn func(ctx context.Context) error) {
+	s.spawn(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-				if err := s.syncRecentlyUpdatedCustomers(ctx); err != nil {
-					s.log.Error().Err(err).Msg("periodic sync failed")
+				runCtx, cancel := context.WithTimeout(ctx, timeout)
+				if err := fn(runCtx); err != nil && ctx.Err() == nil {
+					s.log.Error().Err(err).Msgf("periodic %s failed", name)
 				}
 				cancel()
 
-			case <-s.stopCh:
-				ticker.Stop()
-				s.log.Info().Msg("periodic sync stopped")
+			case <-ctx.Done():
+				s.log.Info().Msgf("periodic %s stopped", name)
 				return
 			}
 		}
+	})
+}
+
+// spawn starts a background goroutine owned by the Syncer. fn must return
+// once ctx is cancelled; Stop waits for it.
+func (s *Syncer) spawn(fn func(ctx context.Context)) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn(s.ctx)
 	}()
 }
 
@@ -221,7 +479,8 @@ func (s *Syncer) syncRecentlyUpdatedCustomers(ctx context.Context) error {
 
 	// Sync customers updated in the last hour
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT customer_id, current_balance_grains
+		SELECT customer_id, current_balance_grains, max_reservation_grains, currency, kill_grace_grains,
+		billing_mode, credit_ceiling_grains, refund_policy, refund_percent, max_concurrent_requests, minimum_viable_balance_grains, `+bucketsColumn+`
 		FROM customers
 		WHERE updated_at > NOW() - INTERVAL '1 hour'
 	`)
@@ -234,15 +493,20 @@ func (s *Syncer) syncRecentlyUpdatedCustomers(ctx context.Context) error {
 	count := 0
 
 	for rows.Next() {
-		var customerID string
-		var balance int64
+		var customerID, currency, billingMode, refundPolicy string
+		var balance, killGrace, creditCeiling, refundPercent, maxConcurrent int64
+		var maxReservation, minimumBalance sql.NullInt64
+		var buckets []byte
 
-		if err := rows.Scan(&customerID, &balance); err != nil {
+		if err := rows.Scan(&customerID, &balance, &maxReservation, &currency, &killGrace, &billingMode, &creditCeiling, &refundPolicy, &refundPercent, &maxConcurrent, &minimumBalance, &buckets); err != nil {
 			continue
 		}
 
-		balanceKey := fmt.Sprintf("customer:balance:%s", customerID)
-		pipe.Set(ctx, balanceKey, balance, 0)
+		setBalance(ctx, pipe, customerID, currency, balance)
+		if err := setBuckets(ctx, pipe, customerID, currency, buckets); err != nil {
+			s.log.Error().Err(err).Str("customer_id", customerID).Msg("invalid funding buckets")
+		}
+		setCustomerConfig(ctx, pipe, customerID, maxReservation, currency, killGrace, billingMode, creditCeiling, refundPolicy, refundPercent, maxConcurrent, minimumBalance)
 		count++
 	}
 
@@ -266,12 +530,16 @@ func (s *Syncer) syncRecentlyUpdatedCustomers(ctx context.Context) error {
 // This is called on-demand when we detect an integrity issue, like a negative
 // balance in Redis or a reconciliation discrepancy.
 func (s *Syncer) SyncCustomer(ctx context.Context, customerID string) error {
-	var balance int64
+	var balance, killGrace, creditCeiling, refundPercent, maxConcurrent int64
+	var maxReservation, minimumBalance sql.NullInt64
+	var currency, billingMode, refundPolicy string
+	var buckets []byte
 	err := s.db.QueryRowContext(ctx, `
-		SELECT current_balance_grains 
+		SELECT current_balance_grains, max_reservation_grains, currency, kill_grace_grains,
+		billing_mode, credit_ceiling_grains, refund_policy, refund_percent, max_concurrent_requests, minimum_viable_balance_grains, `+bucketsColumn+`
 		FROM customers 
 		WHERE customer_id = $1
-	`, customerID).Scan(&balance)
+	`, customerID).Scan(&balance, &maxReservation, &currency, &killGrace, &billingMode, &creditCeiling, &refundPolicy, &refundPercent, &maxConcurrent, &minimumBalance, &buckets)
 
 	if err == sql.ErrNoRows {
 		return fmt.Errorf("customer not found: %s", customerID)
@@ -279,8 +547,13 @@ func (s *Syncer) SyncCustomer(ctx context.Context, customerID string) error {
 		return fmt.Errorf("query failed: %w", err)
 	}
 
-	balanceKey := fmt.Sprintf("customer:balance:%s", customerID)
-	if err := s.redis.Set(ctx, balanceKey, balance, 0).Err(); err != nil {
+	pipe := s.redis.Pipeline()
+	setBalance(ctx, pipe, customerID, currency, balance)
+	if err := setBuckets(ctx, pipe, customerID, currency, buckets); err != nil {
+		return err
+	}
+	setCustomerConfig(ctx, pipe, customerID, maxReservation, currency, killGrace, billingMode, creditCeiling, refundPolicy, refundPercent, maxConcurrent, minimumBalance)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("redis set failed: %w", err)
 	}
 
@@ -297,10 +570,11 @@ func (s *Syncer) SyncCustomer(ctx context.Context, customerID string) error {
 // This is useful for health checks and debugging. It samples a subset of
 // customers and compares their balance in Redis vs PostgreSQL.
 //
-// Returns the number of discrepancies found.
+// Returns the number of discrepancies found. Finding more than the safe
+// mode threshold (see WithSafeModeThreshold) puts the ledger in safe mode.
 func (s *Syncer) VerifyIntegrity(ctx context.Context, sampleSize int) (int, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT customer_id, current_balance_grains
+		SELECT customer_id, current_balance_grains, currency
 		FROM customers
 		ORDER BY RANDOM()
 		LIMIT $1
@@ -313,16 +587,15 @@ func (s *Syncer) VerifyIntegrity(ctx context.Context, sampleSize int) (int, erro
 	discrepancies := 0
 
 	for rows.Next() {
-		var customerID string
+		var customerID, currency string
 		var pgBalance int64
 
-		if err := rows.Scan(&customerID, &pgBalance); err != nil {
+		if err := rows.Scan(&customerID, &pgBalance, &currency); err != nil {
 			continue
 		}
 
 		// Get balance from Redis
-		balanceKey := fmt.Sprintf("customer:balance:%s", customerID)
-		redisBalance, err := s.redis.Get(ctx, balanceKey).Int64()
+		redisBalance, err := s.redis.Get(ctx, balanceKey(customerID, currency)).Int64()
 		if err == redis.Nil {
 			// Missing in Redis - this is a discrepancy
 			s.log.Warn().
@@ -351,10 +624,87 @@ func (s *Syncer) VerifyIntegrity(ctx context.Context, sampleSize int) (int, erro
 		}
 	}
 
+	if err := s.checkSafeModeThreshold(ctx, "integrity check", discrepancies); err != nil {
+		return discrepancies, err
+	}
+
 	return discrepancies, nil
 }
 
-// Stop stops the periodic sync goroutine.
+// checkSafeModeThreshold enters integrity safe mode if a check found more
+// discrepancies than the configured threshold. An existing safe mode keeps
+// its original reason.
+func (s *Syncer) checkSafeModeThreshold(ctx context.Context, check string, discrepancies int) error {
+	if s.safeModeThreshold <= 0 || discrepancies <= s.safeModeThreshold {
+		return nil
+	}
+
+	reason := fmt.Sprintf("%s found %d discrepancies (threshold %d)", check, discrepancies, s.safeModeThreshold)
+
+	pipe := s.redis.TxPipeline()
+	entered := pipe.HSetNX(ctx, safeModeKey, "reason", reason)
+	pipe.HSetNX(ctx, safeModeKey, "entered_at", time.Now().Unix())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to enter safe mode: %w", err)
+	}
+
+	if entered.Val() {
+		s.log.Error().Str("reason", reason).Msg("integrity safe mode entered, rejecting all reservations")
+	}
+	return nil
+}
+
+// setBalance queues an overwrite of a customer's balance that keeps the
+// system-wide total consistent.
+func setBalance(ctx context.Context, pipe redis.Pipeliner, customerID, currency string, balance int64) {
+	keys := []string{balanceKey(customerID, currency), totalBalanceKey}
+	setBalanceScript.Eval(ctx, pipe, keys, balance)
+}
+
+// setBuckets queues an overwrite of a customer's funding bucket hash from
+// the JSON selected by bucketsColumn. A single-bucket customer ('{}') has
+// the hash removed, so the ledger treats their whole balance as paid.
+func setBuckets(ctx context.Context, pipe redis.Pipeliner, customerID, currency string, raw []byte) error {
+	var buckets map[string]int64
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &buckets); err != nil {
+			return fmt.Errorf("decode funding buckets: %w", err)
+		}
+	}
+
+	key := bucketsKey(customerID, currency)
+	pipe.Del(ctx, key)
+	if len(buckets) > 0 {
+		values := make(map[string]interface{}, len(buckets))
+		for bucket, grains := range buckets {
+			values[bucket] = grains
+		}
+		pipe.HSet(ctx, key, values)
+	}
+	return nil
+}
+
+// setCustomerConfig queues a write of the per-customer settings hash that the
+// ledger reads on the hot path (see ledger.CustomerConfig). NULL columns are
+// written as 0, meaning "use the server default".
+func setCustomerConfig(ctx context.Context, pipe redis.Pipeliner, customerID string, maxReservation sql.NullInt64, currency string, killGrace int64, billingMode string, creditCeiling int64, refundPolicy string, refundPercent int64, maxConcurrent int64, minimumBalance sql.NullInt64) {
+	configKey := fmt.Sprintf("customer:config:%s", customerID)
+	pipe.HSet(ctx, configKey,
+		"max_reservation_grains", maxReservation.Int64,
+		"currency", currency,
+		"kill_grace_grains", killGrace,
+		"billing_mode", billingMode,
+		"credit_ceiling_grains", creditCeiling,
+		"refund_policy", refundPolicy,
+		"refund_percent", refundPercent,
+		"max_concurrent_requests", maxConcurrent,
+		"minimum_viable_balance_grains", minimumBalance.Int64,
+	)
+}
+
+// Stop stops all background goroutines and waits for them to exit.
+// It is safe to call more than once.
 func (s *Syncer) Stop() {
-	close(s.stopCh)
-}
\ No newline at end of file
+	s.cancel()
+	s.wg.Wait()
+}
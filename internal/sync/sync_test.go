@@ -0,0 +1,301 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/kelpejol/beam/internal/auth"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func newTestSyncer(t *testing.T) (*Syncer, sqlmock.Sqlmock, *redis.Client) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return NewSyncer(rdb, db, zerolog.Nop()), mock, rdb
+}
+
+func keyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func bearer(key string) context.Context {
+	return metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer "+key))
+}
+
+func TestSyncAPIKeys_NewKeyUsableAfterReload(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	authenticator := auth.NewAuthenticator(rdb, zerolog.Nop())
+	cols := []string{"user_id", "api_key_hash", "scopes"}
+
+	// Startup sync: only the existing user.
+	mock.ExpectQuery("FROM platform_users").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("user_old", keyHash("sk_old"), "{}"))
+	require.NoError(t, s.SyncAPIKeys(context.Background()))
+
+	_, err := authenticator.ValidateAPIKey(bearer("sk_new"))
+	require.Error(t, err)
+
+	// A new user is provisioned and the old one is suspended.
+	mock.ExpectQuery("FROM platform_users").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("user_new", keyHash("sk_new"), "{}"))
+	require.NoError(t, s.SyncAPIKeys(context.Background()))
+
+	userID, err := authenticator.ValidateAPIKey(bearer("sk_new"))
+	require.NoError(t, err)
+	assert.Equal(t, "user_new", userID)
+
+	_, err = authenticator.ValidateAPIKey(bearer("sk_old"))
+	assert.Error(t, err, "keys no longer active should be revoked on reload")
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncAPIKeys_LeavesUnmanagedKeys(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	// Keys stored directly (e.g. the development test key) aren't owned by
+	// the sync and must survive a reload.
+	authenticator := auth.NewAuthenticator(rdb, zerolog.Nop())
+	require.NoError(t, authenticator.StoreAPIKey(ctx, "sk_dev", "test_user_1"))
+
+	mock.ExpectQuery("FROM platform_users").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "api_key_hash", "scopes"}))
+	require.NoError(t, s.SyncAPIKeys(ctx))
+
+	userID, err := authenticator.ValidateAPIKey(bearer("sk_dev"))
+	require.NoError(t, err)
+	assert.Equal(t, "test_user_1", userID)
+}
+
+func TestSyncAPIKeys_SyncsScopes(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+	cols := []string{"user_id", "api_key_hash", "scopes"}
+
+	mock.ExpectQuery("FROM platform_users").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("user_1", keyHash("sk_1"), "{cost_override}"))
+	require.NoError(t, s.SyncAPIKeys(ctx))
+
+	authenticator := auth.NewAuthenticator(rdb, zerolog.Nop())
+	ok, err := authenticator.HasScope(ctx, "user_1", auth.ScopeCostOverride)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Revoking the scope takes effect on the next reload.
+	mock.ExpectQuery("FROM platform_users").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("user_1", keyHash("sk_1"), "{}"))
+	require.NoError(t, s.SyncAPIKeys(ctx))
+
+	ok, err = authenticator.HasScope(ctx, "user_1", auth.ScopeCostOverride)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStop_IsIdempotentAndWaitsForGoroutines(t *testing.T) {
+	s, _, _ := newTestSyncer(t)
+
+	// Long intervals so no tick ever touches the database.
+	s.StartPeriodicSync(time.Hour)
+	s.StartPeriodicAPIKeySync(time.Hour)
+
+	exited := make(chan struct{})
+	s.spawn(func(ctx context.Context) {
+		<-ctx.Done()
+		close(exited)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return; a background goroutine is still running")
+	}
+
+	select {
+	case <-exited:
+	default:
+		t.Fatal("spawned goroutine did not exit before Stop returned")
+	}
+}
+
+func TestInitializeRedis_ResetsTotals(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	// Stale state from before a restart.
+	rdb.Set(ctx, "customer:reserved:cus_a", 400, 0)
+	rdb.Set(ctx, totalReservedKey, 400, 0)
+	rdb.Set(ctx, totalBalanceKey, 999999, 0)
+
+	mock.ExpectQuery("FROM customers").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow("cus_a", 1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_b", 250, nil, "EUR", 50, "postpaid", 5000, "partial_percent", 40, 25, 300, `{"promo": 50, "paid": 200}`))
+	require.NoError(t, s.InitializeRedis(ctx))
+
+	balance, err := rdb.Get(ctx, "customer:balance:cus_a").Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance)
+
+	// Non-USD customers get currency-suffixed keys and their currency in config.
+	balance, err = rdb.Get(ctx, "customer:balance:cus_b:EUR").Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(250), balance)
+	assert.Equal(t, "EUR", rdb.HGet(ctx, "customer:config:cus_b", "currency").Val())
+	assert.Equal(t, "50", rdb.HGet(ctx, "customer:config:cus_b", "kill_grace_grains").Val())
+	assert.Equal(t, "postpaid", rdb.HGet(ctx, "customer:config:cus_b", "billing_mode").Val())
+	assert.Equal(t, "5000", rdb.HGet(ctx, "customer:config:cus_b", "credit_ceiling_grains").Val())
+	assert.Equal(t, "partial_percent", rdb.HGet(ctx, "customer:config:cus_b", "refund_policy").Val())
+	assert.Equal(t, "40", rdb.HGet(ctx, "customer:config:cus_b", "refund_percent").Val())
+	assert.Equal(t, "25", rdb.HGet(ctx, "customer:config:cus_b", "max_concurrent_requests").Val())
+	assert.Equal(t, "300", rdb.HGet(ctx, "customer:config:cus_b", "minimum_viable_balance_grains").Val())
+	assert.Equal(t, "0", rdb.HGet(ctx, "customer:config:cus_a", "minimum_viable_balance_grains").Val(), "NULL is the server default")
+	assert.Equal(t, map[string]string{"promo": "50", "paid": "200"}, rdb.HGetAll(ctx, "customer:buckets:cus_b:EUR").Val())
+	assert.Zero(t, rdb.Exists(ctx, "customer:buckets:cus_a").Val())
+
+	total, err := rdb.Get(ctx, totalBalanceKey).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1250), total)
+
+	reserved, err := rdb.Get(ctx, totalReservedKey).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), reserved)
+}
+
+func TestInitializeRedis_SkipsDuplicateCustomers(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	// A bad import left cus_a in the table twice.
+	mock.ExpectQuery("FROM customers").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow("cus_a", 1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_a", 9000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_b", 250, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}"))
+	require.NoError(t, s.InitializeRedis(ctx))
+
+	balance, err := rdb.Get(ctx, "customer:balance:cus_a").Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), balance, "the first row wins")
+
+	total, err := rdb.Get(ctx, totalBalanceKey).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1250), total, "duplicates aren't counted twice")
+}
+
+func TestInitializeRedis_FailsPastDuplicateThreshold(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	s := NewSyncer(rdb, db, zerolog.Nop(), WithDuplicateThreshold(1))
+	ctx := context.Background()
+	mr.HSet(safeModeKey, "reason", "flushed")
+
+	mock.ExpectQuery("FROM customers").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow("cus_a", 1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_a", 1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_b", 250, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}").
+			AddRow("cus_b", 250, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}"))
+
+	err = s.InitializeRedis(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 duplicate customer ids")
+
+	// A failed sync doesn't vouch for Redis.
+	assert.True(t, mr.Exists(safeModeKey))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncCustomer_AdjustsTotalByDelta(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	rdb.Set(ctx, "customer:balance:cus_a", 1000, 0)
+	rdb.Set(ctx, totalBalanceKey, 1500, 0)
+	rdb.HSet(ctx, "customer:buckets:cus_a", "promo", 100, "paid", 900)
+
+	// Support credited 200 grains in PostgreSQL.
+	mock.ExpectQuery("FROM customers").
+		WithArgs("cus_a").
+		WillReturnRows(sqlmock.NewRows([]string{"current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow(1200, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}"))
+	require.NoError(t, s.SyncCustomer(ctx, "cus_a"))
+
+	total, err := rdb.Get(ctx, totalBalanceKey).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700), total)
+
+	// Buckets removed in PostgreSQL make the customer single-bucket again.
+	assert.Zero(t, rdb.Exists(ctx, "customer:buckets:cus_a").Val())
+}
+
+func TestVerifyIntegrity_SafeModeUntilResync(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	s := NewSyncer(rdb, db, zerolog.Nop(), WithSafeModeThreshold(2))
+	ctx := context.Background()
+
+	// Redis was flushed: every sampled customer is missing.
+	mock.ExpectQuery("ORDER BY RANDOM").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "currency"}).
+			AddRow("cus_a", 1000, "USD").
+			AddRow("cus_b", 250, "USD").
+			AddRow("cus_c", 80, "EUR"))
+
+	discrepancies, err := s.VerifyIntegrity(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, discrepancies)
+	assert.True(t, mr.Exists(safeModeKey))
+	assert.Contains(t, rdb.HGet(ctx, safeModeKey, "reason").Val(), "3 discrepancies")
+
+	mock.ExpectQuery("FROM customers").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "max_reservation_grains", "currency", "kill_grace_grains", "billing_mode", "credit_ceiling_grains", "refund_policy", "refund_percent", "max_concurrent_requests", "minimum_viable_balance_grains", "buckets"}).
+			AddRow("cus_a", 1000, nil, "USD", 0, "prepaid", 0, "full", 100, 0, nil, "{}"))
+	require.NoError(t, s.InitializeRedis(ctx))
+	assert.False(t, mr.Exists(safeModeKey))
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
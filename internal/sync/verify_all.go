@@ -0,0 +1,284 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+)
+
+// maxDiscrepancySamples caps how many offending customer IDs a VerifyReport
+// carries, so a badly drifted Redis doesn't produce a huge report.
+const maxDiscrepancySamples = 20
+
+// VerifyReport summarises a VerifyAll run.
+type VerifyReport struct {
+	CustomersChecked int `json:"customers_checked"`
+
+	// Mismatched customers exist in both stores with different balances.
+	Mismatched int `json:"mismatched"`
+
+	// MissingInRedis customers exist in PostgreSQL but have no Redis balance.
+	MissingInRedis int `json:"missing_in_redis"`
+
+	// OrphanedInRedis balance keys have no customer row in PostgreSQL.
+	OrphanedInRedis int `json:"orphaned_in_redis"`
+
+	// SampleCustomerIDs holds up to maxDiscrepancySamples offending IDs.
+	SampleCustomerIDs []string `json:"sample_customer_ids"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// Discrepancies returns the total number of problems found.
+func (r *VerifyReport) Discrepancies() int {
+	return r.Mismatched + r.MissingInRedis + r.OrphanedInRedis
+}
+
+func (r *VerifyReport) sample(customerID string) {
+	if len(r.SampleCustomerIDs) < maxDiscrepancySamples {
+		r.SampleCustomerIDs = append(r.SampleCustomerIDs, customerID)
+	}
+}
+
+// VerifyAll compares every customer's balance in Redis against PostgreSQL.
+//
+// Unlike VerifyIntegrity, which samples with ORDER BY RANDOM(), this covers
+// the whole dataset in two bounded passes:
+//  1. Page through customers with keyset pagination on customer_id and
+//     fetch each page's Redis balances in one pipeline
+//  2. SCAN customer:balance:* and look each batch up in PostgreSQL to find
+//     balances Redis holds for customers that no longer exist
+//
+// Memory use is one batch at a time. Nothing is corrected; use SyncCustomer
+// or InitializeRedis to act on the report. More discrepancies than the safe
+// mode threshold (see WithSafeModeThreshold) put the ledger in safe mode.
+func (s *Syncer) VerifyAll(ctx context.Context, batchSize int) (*VerifyReport, error) {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	start := time.Now()
+	report := &VerifyReport{SampleCustomerIDs: []string{}}
+
+	cursor := ""
+	for {
+		last, n, err := s.verifyBatch(ctx, report, cursor, batchSize)
+		if err != nil {
+			return report, err
+		}
+
+		report.CustomersChecked += n
+		if n < batchSize {
+			break
+		}
+		cursor = last
+	}
+
+	if err := s.findOrphanedBalances(ctx, report, batchSize); err != nil {
+		return report, err
+	}
+
+	report.Duration = time.Since(start)
+
+	s.log.Info().
+		Int("customers_checked", report.CustomersChecked).
+		Int("mismatched", report.Mismatched).
+		Int("missing_in_redis", report.MissingInRedis).
+		Int("orphaned_in_redis", report.OrphanedInRedis).
+		Dur("duration", report.Duration).
+		Msg("full integrity verification complete")
+
+	if err := s.checkSafeModeThreshold(ctx, "full integrity check", report.Discrepancies()); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// verifyBatch checks one page of customers after cursor. It returns the last
+// customer_id in the page and how many customers the page held.
+func (s *Syncer) verifyBatch(ctx context.Context, report *VerifyReport, cursor string, limit int) (string, int, error) {
+	customers, err := s.customerPage(ctx, cursor, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(customers) == 0 {
+		return cursor, 0, nil
+	}
+
+	mismatches, err := s.compareBalances(ctx, customers)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, m := range mismatches {
+		if m.MissingInRedis {
+			report.MissingInRedis++
+		} else {
+			report.Mismatched++
+		}
+		report.sample(m.CustomerID)
+	}
+
+	return customers[len(customers)-1].customerID, len(customers), nil
+}
+
+// customerBalance is a customer's balance as PostgreSQL has it.
+type customerBalance struct {
+	customerID string
+	currency   string
+	balance    int64
+}
+
+// customerPage returns up to limit customers after cursor, in customer_id
+// order.
+func (s *Syncer) customerPage(ctx context.Context, cursor string, limit int) ([]customerBalance, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT customer_id, current_balance_grains, currency
+		FROM customers
+		WHERE customer_id > $1
+		ORDER BY customer_id
+		LIMIT $2
+	`, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	return scanCustomerBalances(rows)
+}
+
+func scanCustomerBalances(rows *sql.Rows) ([]customerBalance, error) {
+	defer rows.Close()
+
+	var customers []customerBalance
+	for rows.Next() {
+		var c customerBalance
+		if err := rows.Scan(&c.customerID, &c.balance, &c.currency); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		customers = append(customers, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+	return customers, nil
+}
+
+// compareBalances fetches the customers' Redis balances in one pipeline and
+// returns those that differ from PostgreSQL's.
+func (s *Syncer) compareBalances(ctx context.Context, customers []customerBalance) ([]BalanceMismatch, error) {
+	pipe := s.redis.Pipeline()
+	cmds := make([]*redis.StringCmd, len(customers))
+	for i, c := range customers {
+		cmds[i] = pipe.Get(ctx, balanceKey(c.customerID, c.currency))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis pipeline failed: %w", err)
+	}
+
+	var mismatches []BalanceMismatch
+	for i, c := range customers {
+		m := BalanceMismatch{CustomerID: c.customerID, Currency: c.currency, PostgresBalance: c.balance}
+
+		redisBalance, err := cmds[i].Int64()
+		if err == redis.Nil {
+			m.MissingInRedis = true
+			mismatches = append(mismatches, m)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("redis get failed for %s: %w", c.customerID, err)
+		}
+
+		if redisBalance != c.balance {
+			s.log.Warn().
+				Str("customer_id", c.customerID).
+				Int64("redis_balance", redisBalance).
+				Int64("postgres_balance", c.balance).
+				Msg("balance mismatch detected")
+			m.RedisBalance = redisBalance
+			mismatches = append(mismatches, m)
+		}
+	}
+
+	return mismatches, nil
+}
+
+// findOrphanedBalances SCANs Redis balance keys and counts those whose
+// customer doesn't exist in PostgreSQL.
+func (s *Syncer) findOrphanedBalances(ctx context.Context, report *VerifyReport, batchSize int) error {
+	const prefix = "customer:balance:"
+
+	var scanCursor uint64
+	for {
+		keys, next, err := s.redis.Scan(ctx, scanCursor, prefix+"*", int64(batchSize)).Result()
+		if err != nil {
+			return fmt.Errorf("redis scan failed: %w", err)
+		}
+
+		if len(keys) > 0 {
+			ids := make([]string, len(keys))
+			for i, key := range keys {
+				ids[i] = customerIDFromBalanceKey(strings.TrimPrefix(key, prefix))
+			}
+
+			existing, err := s.existingCustomers(ctx, ids)
+			if err != nil {
+				return err
+			}
+
+			for _, customerID := range ids {
+				if !existing[customerID] {
+					report.OrphanedInRedis++
+					report.sample(customerID)
+				}
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		scanCursor = next
+	}
+}
+
+// customerIDFromBalanceKey strips the currency suffix, if any, from the part
+// of a balance key after "customer:balance:".
+func customerIDFromBalanceKey(suffix string) string {
+	i := strings.LastIndexByte(suffix, ':')
+	if i < 0 || len(suffix)-i-1 != 3 {
+		return suffix
+	}
+	for _, c := range suffix[i+1:] {
+		if c < 'A' || c > 'Z' {
+			return suffix
+		}
+	}
+	return suffix[:i]
+}
+
+// existingCustomers returns which of ids have a row in customers.
+func (s *Syncer) existingCustomers(ctx context.Context, ids []string) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT customer_id
+		FROM customers
+		WHERE customer_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var customerID string
+		if err := rows.Scan(&customerID); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		existing[customerID] = true
+	}
+
+	return existing, rows.Err()
+}
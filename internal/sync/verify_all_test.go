@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAll_FindsInjectedDiscrepancies(t *testing.T) {
+	s, mock, rdb := newTestSyncer(t)
+	ctx := context.Background()
+
+	const numCustomers = 250
+	const batchSize = 100
+
+	ids := make([]string, numCustomers)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("cus_%03d", i)
+		rdb.Set(ctx, "customer:balance:"+ids[i], 1000, 0)
+	}
+
+	// Injected problems.
+	rdb.Del(ctx, "customer:balance:cus_010")          // missing in Redis
+	rdb.Set(ctx, "customer:balance:cus_050", 1200, 0) // drifted up
+	rdb.Set(ctx, "customer:balance:cus_150", 0, 0)    // drifted down
+	rdb.Set(ctx, "customer:balance:cus_999", 500, 0)  // no PostgreSQL row
+
+	// Pass 1: keyset pages of customers.
+	cursor := ""
+	for start := 0; start < numCustomers; start += batchSize {
+		end := min(start+batchSize, numCustomers)
+		rows := sqlmock.NewRows([]string{"customer_id", "current_balance_grains", "currency"})
+		for _, id := range ids[start:end] {
+			rows.AddRow(id, 1000, "USD")
+		}
+		mock.ExpectQuery("WHERE customer_id > \\$1").WithArgs(cursor, batchSize).WillReturnRows(rows)
+		cursor = ids[end-1]
+	}
+
+	// Pass 2: SCAN batches (sorted in miniredis) looked up in PostgreSQL.
+	redisIDs := append(append(append([]string{}, ids[:10]...), ids[11:]...), "cus_999")
+	for start := 0; start < len(redisIDs); start += batchSize {
+		end := min(start+batchSize, len(redisIDs))
+		rows := sqlmock.NewRows([]string{"customer_id"})
+		for _, id := range redisIDs[start:end] {
+			if id != "cus_999" {
+				rows.AddRow(id)
+			}
+		}
+		mock.ExpectQuery("ANY\\(\\$1\\)").WillReturnRows(rows)
+	}
+
+	report, err := s.VerifyAll(ctx, batchSize)
+	require.NoError(t, err)
+
+	assert.Equal(t, numCustomers, report.CustomersChecked)
+	assert.Equal(t, 2, report.Mismatched)
+	assert.Equal(t, 1, report.MissingInRedis)
+	assert.Equal(t, 1, report.OrphanedInRedis)
+	assert.Equal(t, 4, report.Discrepancies())
+	assert.ElementsMatch(t, []string{"cus_010", "cus_050", "cus_150", "cus_999"}, report.SampleCustomerIDs)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCustomerIDFromBalanceKey(t *testing.T) {
+	assert.Equal(t, "cus_1", customerIDFromBalanceKey("cus_1"))
+	assert.Equal(t, "cus_1", customerIDFromBalanceKey("cus_1:EUR"))
+	assert.Equal(t, "org:cus_1", customerIDFromBalanceKey("org:cus_1"))
+}
@@ -0,0 +1,193 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var errRankFileMissing = errors.New("rank file missing")
+
+// pieceRE matches the leading alternatives of tiktoken's cl100k_base
+// pre-tokenizer. The remaining two, `\s+(?!\S)` and `\s+`, need a lookahead
+// RE2 doesn't support and are handled by hand in splitPieces. Go's \s is
+// ASCII-only, so Unicode separators are added explicitly.
+var pieceRE = regexp.MustCompile(`^(?:` +
+	`(?i:'s|'t|'re|'ve|'m|'ll|'d)` +
+	`|[^\r\n\p{L}\p{N}]?\p{L}+` +
+	`|\p{N}{1,3}` +
+	`| ?[^\s\p{Z}\x{85}\p{L}\p{N}]+[\r\n]*` +
+	`|[\s\p{Z}\x{85}]*[\r\n]+` +
+	`)`)
+
+// BPE is a byte-pair encoder compatible with OpenAI's tiktoken.
+type BPE struct {
+	ranks map[string]int
+}
+
+// LoadTiktokenFile reads a tiktoken rank file: one "<base64 token> <rank>"
+// pair per line, as published for cl100k_base.
+func LoadTiktokenFile(path string) (*BPE, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errRankFileMissing
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"<token> <rank>\"", line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranks[string(decoded)] = r
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &BPE{ranks: ranks}, nil
+}
+
+// Count returns the number of tokens text encodes to.
+func (b *BPE) Count(text string) int {
+	count := 0
+	for _, piece := range splitPieces(text) {
+		if _, ok := b.ranks[piece]; ok {
+			count++
+			continue
+		}
+		count += b.mergeCount([]byte(piece))
+	}
+	return count
+}
+
+// maxMergePiece caps how many bytes of a piece are merged together. The
+// merge is quadratic in the piece length, and a prompt can be one huge
+// piece (a megabyte of punctuation, say), so longer pieces are merged in
+// chunks of this size. No vocabulary token is this long, so a chunk boundary
+// only costs the merges that would have spanned it: the count comes out at
+// most one token per chunk high, never low.
+const maxMergePiece = 256
+
+// mergeCount runs tiktoken's byte-pair merge on one piece and returns how
+// many tokens remain: repeatedly merge the adjacent pair with the lowest
+// rank until no adjacent pair is in the vocabulary.
+func (b *BPE) mergeCount(piece []byte) int {
+	if len(piece) > maxMergePiece {
+		count := 0
+		for len(piece) > maxMergePiece {
+			count += b.mergeCount(piece[:maxMergePiece])
+			piece = piece[maxMergePiece:]
+		}
+		return count + b.mergeCount(piece)
+	}
+	if len(piece) < 2 {
+		return len(piece)
+	}
+
+	// parts[i] is the start offset of token i; the last entry is len(piece).
+	// ranks[i] is the rank of merging tokens i and i+1, kept up to date so a
+	// merge only looks up the two pairs it changed.
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	pairRank := func(i int) int {
+		if r, ok := b.ranks[string(piece[parts[i]:parts[i+2]])]; ok {
+			return r
+		}
+		return math.MaxInt
+	}
+	ranks := make([]int, len(piece)-1)
+	for i := range ranks {
+		ranks[i] = pairRank(i)
+	}
+
+	for len(ranks) > 0 {
+		best, bestRank := -1, math.MaxInt
+		for i, r := range ranks {
+			if r < bestRank {
+				best, bestRank = i, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+		ranks = append(ranks[:best], ranks[best+1:]...)
+		if best > 0 {
+			ranks[best-1] = pairRank(best - 1)
+		}
+		if best < len(ranks) {
+			ranks[best] = pairRank(best)
+		}
+	}
+
+	return len(parts) - 1
+}
+
+// splitPieces applies the cl100k_base pre-tokenizer.
+func splitPieces(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		n := len(pieceRE.FindString(text))
+		if n == 0 {
+			n = whitespaceRun(text)
+		}
+		if n == 0 {
+			// Unreachable with the full pattern, but never loop forever
+			_, n = utf8.DecodeRuneInString(text)
+		}
+		pieces = append(pieces, text[:n])
+		text = text[n:]
+	}
+	return pieces
+}
+
+// whitespaceRun implements `\s+(?!\S)|\s+` at the start of text: a run of
+// whitespace, minus its last character if a non-space follows it, so that
+// character can lead the next piece (e.g. the space in " world").
+func whitespaceRun(text string) int {
+	end := 0
+	last := 0
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		last = end
+		end += size
+	}
+
+	if end == 0 || end == len(text) || last == 0 {
+		return end
+	}
+	return last
+}
@@ -0,0 +1,112 @@
+// Package tokenizer counts prompt tokens server-side.
+//
+// CheckBalance reservations are sized from the client's own estimate, so a
+// client that understates its prompt tokens under-reserves. When a request
+// includes the raw prompt and a tokenizer for its model is configured, the
+// API counts the tokens itself and never reserves less than the prompt alone
+// costs. Models without a tokenizer fall back to the client's count.
+package tokenizer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Tokenizer counts tokens the way a model's provider does.
+type Tokenizer interface {
+	// CountTokens returns the number of tokens text encodes to for model.
+	// The result is only meaningful if Supports(model) is true.
+	CountTokens(model, text string) int
+
+	// Supports reports whether this tokenizer can count for model.
+	Supports(model string) bool
+}
+
+// openAIEncodings maps OpenAI model name prefixes to their tiktoken
+// encoding. Longest prefix wins. Only encodings that share the cl100k
+// pre-tokenizer are listed; other models fall back to the client count.
+var openAIEncodings = map[string]string{
+	"gpt-4":                  "cl100k_base",
+	"gpt-3.5-turbo":          "cl100k_base",
+	"text-embedding-ada-002": "cl100k_base",
+	"text-embedding-3":       "cl100k_base",
+}
+
+// o200kPrefixes are models that match an openAIEncodings prefix but use
+// o200k_base, whose vocabulary and pre-tokenizer differ from cl100k; they
+// fall back to the client count rather than being miscounted.
+var o200kPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5"}
+
+// OpenAI counts tokens for OpenAI models using tiktoken rank files.
+type OpenAI struct {
+	encodings map[string]*BPE // encoding name -> encoder
+}
+
+// NewOpenAI loads the tiktoken rank files (e.g. cl100k_base.tiktoken) found
+// in dir. Encodings whose file is missing are skipped, so their models fall
+// back to the client count; it is an error only if a file exists but can't
+// be parsed.
+func NewOpenAI(dir string) (*OpenAI, error) {
+	t := &OpenAI{encodings: make(map[string]*BPE)}
+
+	for _, name := range openAIEncodings {
+		if _, ok := t.encodings[name]; ok {
+			continue
+		}
+
+		bpe, err := LoadTiktokenFile(filepath.Join(dir, name+".tiktoken"))
+		if err == errRankFileMissing {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("load %s: %w", name, err)
+		}
+		t.encodings[name] = bpe
+	}
+
+	return t, nil
+}
+
+// encoderFor returns the loaded encoder for model, or nil.
+func (t *OpenAI) encoderFor(model string) *BPE {
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return nil
+		}
+	}
+
+	best := ""
+	for prefix := range openAIEncodings {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return t.encodings[openAIEncodings[best]]
+}
+
+// Supports implements Tokenizer.
+func (t *OpenAI) Supports(model string) bool {
+	return t.encoderFor(model) != nil
+}
+
+// CountTokens implements Tokenizer. Unsupported models count as 0.
+func (t *OpenAI) CountTokens(model, text string) int {
+	bpe := t.encoderFor(model)
+	if bpe == nil {
+		return 0
+	}
+	return bpe.Count(text)
+}
+
+// PromptTokens returns the server-side token count for a prompt, or
+// clientCount if tok is nil, the prompt is empty, or the model has no
+// tokenizer.
+func PromptTokens(tok Tokenizer, model, prompt string, clientCount int) int {
+	if tok == nil || prompt == "" || !tok.Supports(model) {
+		return clientCount
+	}
+	return tok.CountTokens(model, prompt)
+}
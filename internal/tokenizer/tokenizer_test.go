@@ -0,0 +1,97 @@
+package tokenizer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/cl100k_base.tiktoken is a tiny vocabulary in the real file
+// format: every single byte plus a handful of merges ("hello", " world",
+// "123", ...). The production file is dropped into TOKENIZER_DIR.
+func newTestOpenAI(t *testing.T) *OpenAI {
+	t.Helper()
+
+	tok, err := NewOpenAI("testdata")
+	require.NoError(t, err)
+	return tok
+}
+
+func TestOpenAI_CountsKnownModel(t *testing.T) {
+	tok := newTestOpenAI(t)
+
+	require.True(t, tok.Supports("gpt-4"))
+	require.True(t, tok.Supports("gpt-3.5-turbo-0125"))
+
+	assert.Equal(t, 2, tok.CountTokens("gpt-4", "hello world"))
+	// The extra space becomes its own piece; " world" keeps its leading space.
+	assert.Equal(t, 3, tok.CountTokens("gpt-4", "hello  world"))
+	// Digits split into groups of at most three.
+	assert.Equal(t, 3, tok.CountTokens("gpt-4", "hello1234"))
+	// Only "ll" merges in "yellow".
+	assert.Equal(t, 5, tok.CountTokens("gpt-4", "yellow"))
+	assert.Equal(t, 0, tok.CountTokens("gpt-4", ""))
+}
+
+func TestPromptTokens_FallsBackForUnknownModel(t *testing.T) {
+	tok := newTestOpenAI(t)
+
+	assert.False(t, tok.Supports("claude-3-opus"))
+	assert.Equal(t, 17, PromptTokens(tok, "claude-3-opus", "hello world", 17))
+
+	// No tokenizer configured, or no prompt sent.
+	assert.Equal(t, 17, PromptTokens(nil, "gpt-4", "hello world", 17))
+	assert.Equal(t, 17, PromptTokens(tok, "gpt-4", "", 17))
+
+	// Supported model with a prompt: the server count wins.
+	assert.Equal(t, 2, PromptTokens(tok, "gpt-4", "hello world", 1))
+}
+
+func TestOpenAI_O200kModelsFallBack(t *testing.T) {
+	tok := newTestOpenAI(t)
+
+	// gpt-4o and later share the "gpt-4" prefix but not its encoding.
+	assert.False(t, tok.Supports("gpt-4o"))
+	assert.False(t, tok.Supports("gpt-4o-mini"))
+	assert.False(t, tok.Supports("gpt-4.1"))
+	assert.Equal(t, 17, PromptTokens(tok, "gpt-4o", "hello world", 17))
+
+	assert.True(t, tok.Supports("gpt-4"))
+	assert.True(t, tok.Supports("gpt-4-turbo"))
+}
+
+func TestNewOpenAI_MissingRankFilesDisableModels(t *testing.T) {
+	tok, err := NewOpenAI(t.TempDir())
+	require.NoError(t, err)
+	assert.False(t, tok.Supports("gpt-4"))
+}
+
+func TestSplitPieces(t *testing.T) {
+	assert.Equal(t, []string{"it", "'s", " a", "  ", " test", "!\n"}, splitPieces("it's a   test!\n"))
+	assert.Equal(t, []string{"x", "   "}, splitPieces("x   "))
+}
+
+func TestBPE_LongPieceIsChunked(t *testing.T) {
+	// Every byte plus merges that keep applying across a run of "!", the
+	// worst case for a quadratic merge
+	ranks := make(map[string]int)
+	for i := 0; i < 256; i++ {
+		ranks[string([]byte{byte(i)})] = i
+	}
+	ranks["!!"] = 256
+	ranks["!!!!"] = 257
+	bpe := &BPE{ranks: ranks}
+
+	assert.Equal(t, 1, bpe.Count("!!!!"))
+	assert.Equal(t, maxMergePiece/4, bpe.Count(strings.Repeat("!", maxMergePiece)))
+
+	// A megabyte of punctuation is one piece; it must count in chunks, not
+	// hang the request
+	text := strings.Repeat("!", 1<<20)
+	start := time.Now()
+	assert.Equal(t, len(text)/4, bpe.Count(text))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
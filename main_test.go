@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yourusername/beam/internal/sync"
+	pb "github.com/yourusername/beam/pkg/proto/balance/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestValidateAdjustmentAmount(t *testing.T) {
+	const maxGrains = 1_000_000
+
+	assert.NoError(t, validateAdjustmentAmount(1, maxGrains))
+	assert.NoError(t, validateAdjustmentAmount(maxGrains, maxGrains))
+
+	err := validateAdjustmentAmount(maxGrains+1, maxGrains)
+	assert.ErrorContains(t, err, "over the maximum of 1000000")
+
+	err = validateAdjustmentAmount(0, maxGrains)
+	assert.ErrorContains(t, err, "must be positive")
+
+	err = validateAdjustmentAmount(-500, maxGrains)
+	assert.ErrorContains(t, err, "use --debit")
+}
+
+func TestReadCustomerIDs(t *testing.T) {
+	ids, err := readCustomerIDs(strings.NewReader("cus_a\n\n# spring list\n  cus_b  \ncus_a\ncus_c"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cus_a", "cus_b", "cus_c"}, ids)
+}
+
+func TestWatchBalance_SnapshotsUntilCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	readings := []struct {
+		snap balanceSnapshot
+		err  error
+	}{
+		{snap: balanceSnapshot{Found: true, Balance: 1000, Reserved: 200, Available: 800}},
+		{snap: balanceSnapshot{Found: true, Balance: 950, Reserved: 200, Available: 750}},
+		{err: errors.New("redis: connection refused")},
+		{snap: balanceSnapshot{Found: true, Balance: 900, Reserved: 0, Available: 900}},
+		{snap: balanceSnapshot{Found: false}},
+	}
+
+	polls := 0
+	poll := func(context.Context) (balanceSnapshot, error) {
+		r := readings[polls%len(readings)]
+		r.snap.At = at.Add(time.Duration(polls) * time.Second)
+		polls++
+		return r.snap, r.err
+	}
+
+	var out bytes.Buffer
+	printer := balanceWatchPrinter(&out)
+	shown := 0
+	show := func(snap balanceSnapshot, err error) {
+		printer(snap, err)
+		if shown++; shown == 5 {
+			cancel()
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- watchBalance(ctx, time.Millisecond, poll, show) }()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop after cancel")
+	}
+
+	assert.Equal(t, 5, shown)
+	assert.Equal(t, ""+
+		"12:00:00  balance 1000  reserved 200  available 800\n"+
+		"12:00:01  balance 950  reserved 200  available 750  (-50)\n"+
+		"12:00:02  error: redis: connection refused\n"+
+		"12:00:03  balance 900  reserved 0  available 900  (+150)\n"+
+		"12:00:04  no balance in redis (unknown customer, or run admin sync-all)\n",
+		out.String())
+}
+
+func TestWatchBalance_StopsWhenPollIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	poll := func(ctx context.Context) (balanceSnapshot, error) {
+		cancel()
+		return balanceSnapshot{}, ctx.Err()
+	}
+	show := func(balanceSnapshot, error) {
+		t.Fatal("a reading interrupted by Ctrl-C must not be shown")
+	}
+
+	assert.NoError(t, watchBalance(ctx, time.Hour, poll, show))
+}
+
+func TestDeadLetterIDs(t *testing.T) {
+	parse := func(args ...string) ([]int64, error) {
+		cmd := deadLetterCmd()
+		retry, _, err := cmd.Find([]string{"retry"})
+		require.NoError(t, err)
+		require.NoError(t, retry.ParseFlags(args))
+		return deadLetterIDs(retry)
+	}
+
+	ids, err := parse("--id", "3", "--id", "7")
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 7}, ids)
+
+	ids, err = parse("--all")
+	require.NoError(t, err)
+	assert.Nil(t, ids)
+
+	_, err = parse()
+	assert.ErrorContains(t, err, "--id or --all is required")
+	_, err = parse("--id", "3", "--all")
+	assert.ErrorContains(t, err, "can't be used together")
+}
+
+func TestPrintBalanceDiff(t *testing.T) {
+	diff := &sync.BalanceDiff{
+		CustomersChecked: 250,
+		Mismatched:       3,
+		Mismatches: []sync.BalanceMismatch{
+			{CustomerID: "cus_050", Currency: "USD", RedisBalance: 1200, PostgresBalance: 1000},
+			{CustomerID: "cus_010", Currency: "USD", PostgresBalance: 1000, MissingInRedis: true},
+			{CustomerID: "cus_150", Currency: "EUR", RedisBalance: 0, PostgresBalance: 1000},
+		},
+	}
+
+	var out bytes.Buffer
+	err := printBalanceDiff(&out, diff)
+	assert.EqualError(t, err, "3 balance mismatches remain")
+	assert.Equal(t, `CUSTOMER  CURRENCY  REDIS  POSTGRES  DELTA  STATUS
+cus_050   USD       1200   1000      +200   mismatch
+cus_010   USD       -      1000      -      missing
+cus_150   EUR       0      1000      -1000  mismatch
+250 customers checked, 3 mismatched, 0 fixed
+`, out.String())
+
+	// After --fix, only the customer that failed to resync keeps it failing
+	for i := range diff.Mismatches[:2] {
+		diff.Mismatches[i].Fixed = true
+	}
+	diff.Fixed = 2
+	out.Reset()
+	err = printBalanceDiff(&out, diff)
+	assert.EqualError(t, err, "1 balance mismatches remain")
+	assert.Contains(t, out.String(), "cus_010   USD       -      1000      -      missing, fixed\n")
+
+	diff.Mismatches[2].Fixed = true
+	diff.Fixed = 3
+	out.Reset()
+	assert.NoError(t, printBalanceDiff(&out, diff))
+	assert.Contains(t, out.String(), "3 mismatched, 3 fixed")
+
+	// Nothing wrong: just the summary
+	out.Reset()
+	assert.NoError(t, printBalanceDiff(&out, &sync.BalanceDiff{CustomersChecked: 10}))
+	assert.Equal(t, "10 customers checked, 0 mismatched, 0 fixed\n", out.String())
+}
+
+// lifecycleServer is a one-customer BalanceService that charges a grain per
+// token and suggests a kill once a request has spent its reservation.
+type lifecycleServer struct {
+	pb.UnimplementedBalanceServiceServer
+
+	balance   int64
+	reserved  int64
+	spent     int64
+	token     string
+	finalized bool
+
+	// refuse, if set, is the error code every deduction is refused with
+	refuse string
+}
+
+func (s *lifecycleServer) GetBalance(ctx context.Context, req *pb.GetBalanceRequest) (*pb.GetBalanceResponse, error) {
+	return &pb.GetBalanceResponse{Balance: s.balance, Available: s.balance - s.reserved, Currency: "USD"}, nil
+}
+
+func (s *lifecycleServer) CheckBalance(ctx context.Context, req *pb.CheckBalanceRequest) (*pb.CheckBalanceResponse, error) {
+	s.reserved = req.EstimatedGrains
+	s.token = "tok_" + req.RequestId
+	return &pb.CheckBalanceResponse{Approved: true, RequestToken: s.token, ReservedGrains: s.reserved, RemainingBalance: s.balance - s.reserved}, nil
+}
+
+func (s *lifecycleServer) DeductTokens(ctx context.Context, req *pb.DeductTokensRequest) (*pb.DeductTokensResponse, error) {
+	if req.RequestToken != s.token {
+		return &pb.DeductTokensResponse{ErrorCode: "INVALID_TOKEN"}, nil
+	}
+	if s.refuse != "" {
+		return &pb.DeductTokensResponse{ErrorCode: s.refuse, RemainingBalance: s.balance}, nil
+	}
+	if s.spent >= s.reserved {
+		return &pb.DeductTokensResponse{ErrorCode: "INSUFFICIENT_BALANCE", RemainingBalance: s.balance}, nil
+	}
+	s.spent += int64(req.GetTokensConsumed())
+	s.balance -= int64(req.GetTokensConsumed())
+	action := pb.SuggestedAction_SUGGESTED_ACTION_CONTINUE
+	if s.spent >= s.reserved {
+		action = pb.SuggestedAction_SUGGESTED_ACTION_KILL
+	}
+	return &pb.DeductTokensResponse{Success: true, RemainingBalance: s.balance, SuggestedAction: action}, nil
+}
+
+func (s *lifecycleServer) FinalizeRequest(ctx context.Context, req *pb.FinalizeRequestRequest) (*pb.FinalizeRequestResponse, error) {
+	refunded := s.reserved - s.spent
+	if refunded < 0 {
+		refunded = 0
+	}
+	s.reserved = 0
+	s.finalized = true
+	return &pb.FinalizeRequestResponse{Success: true, ActualCostGrains: s.spent, RefundedGrains: refunded, FinalBalance: s.balance}, nil
+}
+
+func dialLifecycleServer(t *testing.T, srv *lifecycleServer) pb.BalanceServiceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	pb.RegisterBalanceServiceServer(gs, srv)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewBalanceServiceClient(conn)
+}
+
+func TestRunRequestLifecycle_Completes(t *testing.T) {
+	client := dialLifecycleServer(t, &lifecycleServer{balance: 10000})
+
+	var out bytes.Buffer
+	result, err := runRequestLifecycle(context.Background(), client, lifecycleOptions{
+		CustomerID:      "cus_a",
+		Model:           "gpt-4",
+		Tokens:          125,
+		Deductions:      3,
+		EstimatedGrains: 1000,
+	}, &out)
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(125), result.TokensConsumed, "the last deduction takes the remainder")
+	assert.False(t, result.Killed)
+	assert.Equal(t, int64(10000), result.BalanceBefore)
+	assert.Equal(t, int64(9875), result.BalanceAfter)
+	assert.Equal(t, 3, strings.Count(out.String(), "deduct "))
+	assert.Contains(t, out.String(), "COMPLETED_SUCCESS")
+	assert.Contains(t, out.String(), "net -125")
+}
+
+func TestRunRequestLifecycle_KillOverDeducts(t *testing.T) {
+	client := dialLifecycleServer(t, &lifecycleServer{balance: 10000})
+
+	var out bytes.Buffer
+	result, err := runRequestLifecycle(context.Background(), client, lifecycleOptions{
+		CustomerID:      "cus_a",
+		Model:           "gpt-4",
+		Tokens:          100,
+		Deductions:      2,
+		EstimatedGrains: 300,
+		Kill:            true,
+	}, &out)
+	require.NoError(t, err)
+
+	assert.True(t, result.Killed)
+	assert.Equal(t, int32(300), result.TokensConsumed, "deducts past --tokens until the reservation is spent")
+	assert.Contains(t, out.String(), "SUGGESTED_ACTION_KILL")
+	assert.Contains(t, out.String(), "KILLED_INSUFFICIENT_BALANCE")
+}
+
+func TestRunRequestLifecycle_RefusalFails(t *testing.T) {
+	for _, kill := range []bool{false, true} {
+		srv := &lifecycleServer{balance: 10000, refuse: "INVALID_TOKEN"}
+		client := dialLifecycleServer(t, srv)
+
+		var out bytes.Buffer
+		result, err := runRequestLifecycle(context.Background(), client, lifecycleOptions{
+			CustomerID:      "cus_a",
+			Model:           "gpt-4",
+			Tokens:          100,
+			Deductions:      2,
+			EstimatedGrains: 300,
+			Kill:            kill,
+		}, &out)
+		require.Error(t, err, "kill=%v", kill)
+		assert.Contains(t, err.Error(), "INVALID_TOKEN")
+		assert.False(t, result.Killed, "kill=%v", kill)
+		assert.False(t, srv.finalized, "kill=%v", kill)
+	}
+}
+
+func TestRunRequestLifecycle_KillOnInsufficientBalance(t *testing.T) {
+	srv := &lifecycleServer{balance: 10000, refuse: "INSUFFICIENT_BALANCE"}
+	client := dialLifecycleServer(t, srv)
+
+	// Outside --kill running out of balance is a failure...
+	_, err := runRequestLifecycle(context.Background(), client, lifecycleOptions{
+		CustomerID:      "cus_a",
+		Model:           "gpt-4",
+		Tokens:          100,
+		Deductions:      2,
+		EstimatedGrains: 300,
+	}, io.Discard)
+	require.Error(t, err)
+
+	// ...and with it, the kill the run is looking for.
+	var out bytes.Buffer
+	result, err := runRequestLifecycle(context.Background(), client, lifecycleOptions{
+		CustomerID:      "cus_a",
+		Model:           "gpt-4",
+		Tokens:          100,
+		Deductions:      2,
+		EstimatedGrains: 300,
+		Kill:            true,
+	}, &out)
+	require.NoError(t, err)
+	assert.True(t, result.Killed)
+	assert.Equal(t, int32(0), result.TokensConsumed)
+	assert.True(t, srv.finalized)
+	assert.Contains(t, out.String(), "KILLED_INSUFFICIENT_BALANCE")
+}
@@ -0,0 +1,17 @@
+-- 002_customer_reservation_cap.up.sql
+--
+-- Purpose: Allow a per-customer cap on the size of a single reservation.
+--
+-- The server enforces a global MAX_RESERVATION_GRAINS cap in CheckBalance so a
+-- client bug sending an enormous estimate can't lock a customer's entire
+-- balance behind one request. This column overrides that cap for customers
+-- who legitimately need larger (or smaller) single reservations.
+--
+-- NULL means "use the server default". The value is synced to Redis in the
+-- customer:config:{customer_id} hash alongside the balance.
+
+ALTER TABLE customers
+    ADD COLUMN max_reservation_grains BIGINT
+        CHECK (max_reservation_grains IS NULL OR max_reservation_grains > 0);
+
+COMMENT ON COLUMN customers.max_reservation_grains IS 'Per-customer cap on a single reservation (NULL = server default)';
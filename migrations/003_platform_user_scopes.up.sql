@@ -0,0 +1,19 @@
+-- 003_platform_user_scopes.up.sql
+--
+-- Purpose: Grant optional, privileged capabilities to individual platform users.
+--
+-- Most API callers only need the standard balance operations. A few need
+-- more, e.g. customers with negotiated flat per-request pricing who send an
+-- explicit grain cost instead of having it derived from model_pricing.
+-- Those capabilities are granted as named scopes here.
+--
+-- Known scopes:
+--   cost_override - may set grain_cost_override on DeductTokens/FinalizeRequest
+--
+-- Scopes are synced to Redis with the API keys, in the
+-- platform_user:scopes:{user_id} set.
+
+ALTER TABLE platform_users
+    ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{}';
+
+COMMENT ON COLUMN platform_users.scopes IS 'Privileged capabilities granted to this user (e.g. cost_override)';
@@ -0,0 +1,29 @@
+-- 004_multi_currency.up.sql
+--
+-- Purpose: Let customers be billed in currencies other than USD.
+--
+-- A customer's grains are denominated in their currency: 1 grain is
+-- 1/1,000,000 of one unit of it. Existing customers are USD, which keeps
+-- their balances and Redis keys unchanged.
+--
+-- model_pricing stays in USD grains. Server-side pricing for a non-USD
+-- customer is converted at currency_rates.grains_per_usd_grain, i.e. how
+-- many of the customer's grains one USD grain is worth (EUR at 0.92 means
+-- 1,000,000 USD grains cost 920,000 EUR grains).
+--
+-- Redis keys for a non-USD customer carry the currency as a suffix:
+--   customer:balance:{customer_id}:{currency}
+--   customer:reserved:{customer_id}:{currency}
+
+ALTER TABLE customers
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+COMMENT ON COLUMN customers.currency IS 'ISO 4217 code the balance is denominated in';
+
+CREATE TABLE currency_rates (
+    currency CHAR(3) PRIMARY KEY,
+    grains_per_usd_grain NUMERIC(20, 10) NOT NULL CHECK (grains_per_usd_grain > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO currency_rates (currency, grains_per_usd_grain) VALUES ('USD', 1);
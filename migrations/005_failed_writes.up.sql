@@ -0,0 +1,30 @@
+-- 005_failed_writes.up.sql
+--
+-- Purpose: Dead-letter store for async PostgreSQL writes.
+--
+-- The ledger applies every balance change in Redis first and queues the
+-- PostgreSQL write. A queued write that still fails after its in-process
+-- retries (e.g. PostgreSQL was down for longer than the retry window) is
+-- saved here instead of being dropped, and a background worker in each API
+-- instance replays it with backoff until it succeeds.
+--
+-- payload holds the original operation, encoded as JSON. Rows are claimed by
+-- pushing next_attempt_at forward (a lease), so several instances can replay
+-- concurrently without applying the same write twice.
+
+CREATE TABLE failed_writes (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- "preflight", "finalization" or "cancellation"
+    op_type VARCHAR(50) NOT NULL,
+    customer_id VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+
+    last_error TEXT,
+    attempts INT NOT NULL DEFAULT 0,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_failed_writes_next_attempt ON failed_writes(next_attempt_at);
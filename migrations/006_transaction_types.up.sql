@@ -0,0 +1,31 @@
+-- 006_transaction_types.up.sql
+--
+-- Purpose: Restrict transactions.transaction_type to a fixed set.
+--
+-- transaction_type was free-form VARCHAR, so a typo in a writer silently
+-- created a type no report or reconciliation query knew about. The valid
+-- set now mirrors ledger.TransactionType:
+--
+--   'ai_usage'           - AI tokens consumed (reference_id = request_id)
+--   'credit'             - Customer top-up, e.g. a Stripe payment
+--   'refund'             - Grains returned to the customer
+--   'transfer_in'        - Grains moved into this customer
+--   'transfer_out'       - Grains moved out of this customer
+--   'adjustment'         - Manual correction by support or an admin
+--   'reservation_leaked' - Reservation that was never finalized, written off
+--
+-- Types written before this migration are mapped onto the new set first.
+
+UPDATE transactions SET transaction_type = 'credit'
+WHERE transaction_type = 'stripe_payment';
+
+UPDATE transactions SET transaction_type = 'adjustment'
+WHERE transaction_type IN ('admin_adjustment', 'reconciliation_adjustment');
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_transaction_type_check CHECK (
+        transaction_type IN (
+            'ai_usage', 'credit', 'refund', 'transfer_in',
+            'transfer_out', 'adjustment', 'reservation_leaked'
+        )
+    );
@@ -0,0 +1,26 @@
+-- 007_kill_grace.up.sql
+--
+-- Purpose: Per-customer grace before the streaming kill switch fires.
+--
+-- Killing a stream the instant the balance reaches zero can cut a response
+-- off one token short of completion. kill_grace_grains lets the balance go
+-- that far below zero during streaming before DeductTokens fails. It is a
+-- small buffer, not credit: CheckBalance still requires a positive available
+-- balance, so no new request starts while a customer is in their grace.
+--
+-- The value is synced to Redis in the customer:config:{customer_id} hash,
+-- where the deduct script reads it. 0 (the default) disables the grace.
+--
+-- positive_balance is relaxed to match, since a finalized request may leave
+-- the balance inside the grace.
+
+ALTER TABLE customers
+    ADD COLUMN kill_grace_grains BIGINT NOT NULL DEFAULT 0
+        CHECK (kill_grace_grains >= 0);
+
+ALTER TABLE customers DROP CONSTRAINT positive_balance;
+
+ALTER TABLE customers
+    ADD CONSTRAINT positive_balance CHECK (current_balance_grains + kill_grace_grains >= 0);
+
+COMMENT ON COLUMN customers.kill_grace_grains IS 'Grains the balance may go below zero mid-stream before the kill switch fires';
@@ -0,0 +1,16 @@
+-- 008_orphan_requests.up.sql
+--
+-- Purpose: Support sweeping requests that were never finalized.
+--
+-- A request is inserted as 'preflight_approved' and only leaves that status
+-- when FinalizeRequest or CancelRequest is called. If the client crashes in
+-- between, the row stays in flight forever and its reservation stays locked
+-- in Redis. Each API instance runs an orphan sweeper that marks such rows
+-- 'abandoned' once they are older than the finalize timeout, charging what
+-- was deducted while streaming and releasing the reservation.
+--
+-- This partial index keeps the sweep cheap: it only covers in-flight rows,
+-- which are a tiny fraction of the table.
+
+CREATE INDEX idx_requests_in_flight ON requests(created_at)
+    WHERE status IN ('preflight_approved', 'streaming');
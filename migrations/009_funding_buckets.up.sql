@@ -0,0 +1,29 @@
+-- 009_funding_buckets.up.sql
+--
+-- Purpose: Split a customer's balance into funding buckets.
+--
+-- Customers with both prepaid credit and promotional grants want the
+-- promotional grains spent first. Each row holds one bucket's share of
+-- customers.current_balance_grains, which stays the combined balance that
+-- reservations are checked against. When a customer has rows, they must sum
+-- to current_balance_grains; AdjustBalance maintains this.
+--
+-- A customer with no rows is single-bucket: their whole balance is 'paid',
+-- exactly as before this migration. Crediting the 'promo' bucket seeds a
+-- 'paid' row with the existing balance first.
+--
+-- The syncer copies the rows into the Redis hash
+-- customer:buckets:{customer_id}, where the deduct, finalize and cancel
+-- scripts draw buckets down in priority order (promo, then paid).
+--
+-- balance_grains has no lower bound: the paid bucket absorbs any overdraft
+-- into the customer's kill grace.
+
+CREATE TABLE customer_balance_buckets (
+    customer_id VARCHAR(255) NOT NULL REFERENCES customers(customer_id) ON DELETE CASCADE,
+    bucket VARCHAR(20) NOT NULL CHECK (bucket IN ('promo', 'paid')),
+    balance_grains BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (customer_id, bucket)
+);
+
+COMMENT ON TABLE customer_balance_buckets IS 'Per-bucket split of customers.current_balance_grains; no rows means single-bucket';
@@ -0,0 +1,20 @@
+-- 010_request_priority.up.sql
+--
+-- Purpose: Record each request's priority for reporting.
+--
+-- CheckBalance accepts a priority (low, normal or high). Under budget
+-- pressure, and with preemption enabled (PRIORITY_PREEMPTION), a
+-- high-priority request may be approved by reserving against grains held by
+-- low-priority requests still in flight; those low-priority requests are
+-- then the first to run out of balance. Requests from SDKs that don't send
+-- a priority are 'normal'.
+--
+-- In Redis the priority lives on the request:{request_id} hash, and grains
+-- reserved by low-priority requests are counted in
+-- customer:reserved_low:{customer_id}.
+
+ALTER TABLE requests
+    ADD COLUMN priority VARCHAR(10) NOT NULL DEFAULT 'normal'
+        CHECK (priority IN ('low', 'normal', 'high'));
+
+COMMENT ON COLUMN requests.priority IS 'Priority the request was reserved at: low, normal or high';
@@ -0,0 +1,25 @@
+-- 011_postpaid_billing.up.sql
+--
+-- Purpose: Let customers be billed after the fact instead of prepaying.
+--
+-- Prepaid customers (the default) can only reserve what their balance
+-- covers. Postpaid customers skip the balance check: their usage accrues to
+-- a running debt that is invoiced later, and a reservation is approved as
+-- long as debt plus reservations stays within credit_ceiling_grains. The
+-- balance of a postpaid customer is left untouched.
+--
+-- Both values are synced to Redis in the customer:config:{customer_id}
+-- hash. The debt lives in customer:debt:{customer_id} and is taken down as
+-- invoices are settled. A credit_ceiling_grains of 0 (the default) means the
+-- server-wide ceiling (POSTPAID_CREDIT_CEILING) applies.
+
+ALTER TABLE customers
+    ADD COLUMN billing_mode VARCHAR(20) NOT NULL DEFAULT 'prepaid'
+        CHECK (billing_mode IN ('prepaid', 'postpaid'));
+
+ALTER TABLE customers
+    ADD COLUMN credit_ceiling_grains BIGINT NOT NULL DEFAULT 0
+        CHECK (credit_ceiling_grains >= 0);
+
+COMMENT ON COLUMN customers.billing_mode IS 'prepaid (spend a topped-up balance) or postpaid (accrue debt, invoiced later)';
+COMMENT ON COLUMN customers.credit_ceiling_grains IS 'Most a postpaid customer may owe plus have reserved; 0 for the server default';
@@ -0,0 +1,40 @@
+-- 012_admin_audit.up.sql
+--
+-- Purpose: Immutable trail of privileged operations.
+--
+-- Every admin RPC (AdjustBalance, ListCustomers, GetCustomer, ...) and every
+-- beam-cli admin command appends a row here before it runs: who did it
+-- (operator: the platform user behind the API key, or the CLI operator),
+-- what they did (action), to whom (target_customer, if any) and with which
+-- arguments (params). If the row can't be written the operation is refused.
+--
+-- The table is append-only. UPDATE, DELETE and TRUNCATE are revoked from
+-- everyone, and since a table's owner is not bound by its own grants, a
+-- trigger rejects UPDATE and DELETE as well.
+
+CREATE TABLE admin_audit (
+    id BIGSERIAL PRIMARY KEY,
+    operator VARCHAR(255) NOT NULL,
+    action VARCHAR(100) NOT NULL,
+    target_customer VARCHAR(255),
+    params JSONB NOT NULL DEFAULT '{}',
+    at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_admin_audit_at ON admin_audit(at);
+CREATE INDEX idx_admin_audit_target_customer ON admin_audit(target_customer, at)
+    WHERE target_customer IS NOT NULL;
+
+REVOKE UPDATE, DELETE, TRUNCATE ON admin_audit FROM PUBLIC;
+
+CREATE OR REPLACE FUNCTION admin_audit_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'admin_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER admin_audit_append_only
+    BEFORE UPDATE OR DELETE ON admin_audit
+    FOR EACH ROW EXECUTE FUNCTION admin_audit_append_only();
+
+COMMENT ON TABLE admin_audit IS 'Append-only record of admin RPCs and CLI admin commands';
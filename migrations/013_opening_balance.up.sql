@@ -0,0 +1,43 @@
+-- 013_opening_balance.up.sql
+--
+-- Purpose: Record customers' opening balances as transactions.
+--
+-- verify_balance_integrity checks that current_balance_grains equals the sum
+-- of the customer's transactions, but customers created with a balance had
+-- no transaction for it, so they were reported as mismatched from the
+-- start. CreateCustomer now writes an 'opening_balance' transaction along
+-- with the customer.
+--
+-- Existing customers are backfilled with an opening_balance of whatever
+-- their transactions don't account for, dated when the customer was
+-- created. This can't tell a missing opening balance from drift that
+-- happened since; backfilled rows carry {"backfilled": true} in metadata so
+-- they can be reviewed.
+
+ALTER TABLE transactions DROP CONSTRAINT transactions_transaction_type_check;
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_transaction_type_check CHECK (
+        transaction_type IN (
+            'ai_usage', 'credit', 'refund', 'transfer_in',
+            'transfer_out', 'adjustment', 'reservation_leaked',
+            'opening_balance'
+        )
+    );
+
+INSERT INTO transactions (
+    transaction_id, customer_id, amount_grains, transaction_type,
+    description, created_at, metadata
+)
+SELECT
+    'tx_opening_' || c.customer_id,
+    c.customer_id,
+    c.current_balance_grains - COALESCE(SUM(t.amount_grains), 0),
+    'opening_balance',
+    'Opening balance (backfilled)',
+    c.created_at,
+    '{"backfilled": true}'::jsonb
+FROM customers c
+LEFT JOIN transactions t ON t.customer_id = c.customer_id
+GROUP BY c.customer_id, c.current_balance_grains, c.created_at
+HAVING c.current_balance_grains <> COALESCE(SUM(t.amount_grains), 0);
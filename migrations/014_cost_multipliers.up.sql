@@ -0,0 +1,20 @@
+-- 014_cost_multipliers.up.sql
+--
+-- Purpose: Let a platform user pay a contract multiple of a provider's list
+-- price, e.g. 1.1 for Azure-hosted OpenAI models.
+--
+-- The multiplier applies on top of model_pricing (after currency
+-- conversion) wherever the server prices tokens: the prices pinned on a
+-- reservation, and so the deductions and finalization priced from them.
+-- Users and providers without a row pay list price (1.0). Rows are cached
+-- with model pricing and picked up by a pricing reload.
+
+CREATE TABLE cost_multipliers (
+    platform_user_id VARCHAR(255) NOT NULL REFERENCES platform_users(user_id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    multiplier NUMERIC(8, 4) NOT NULL CHECK (multiplier > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (platform_user_id, provider)
+);
+
+COMMENT ON TABLE cost_multipliers IS 'Per platform user and provider multiple of list price (no row = 1.0)';
@@ -0,0 +1,28 @@
+-- 015_model_aliases.up.sql
+--
+-- Purpose: Price model name variants clients send (dated snapshots,
+-- "-preview" suffixes) at their canonical model_pricing entry.
+--
+-- An alias ending in '*' matches every model name starting with the rest of
+-- it; the longest matching prefix wins. Aliases are only consulted for a
+-- model with no price of its own, so a variant can still be priced
+-- separately by adding it to model_pricing. Rows are cached with model
+-- pricing and picked up by a pricing reload.
+
+CREATE TABLE model_aliases (
+    alias VARCHAR(100) PRIMARY KEY,
+    canonical_model VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE model_aliases IS 'Client model names priced as a canonical model_pricing model; a trailing * matches by prefix';
+
+INSERT INTO model_aliases (alias, canonical_model) VALUES
+('gpt-4-0613', 'gpt-4'),
+('gpt-4-0314', 'gpt-4'),
+('gpt-4-turbo-preview', 'gpt-4-turbo'),
+('gpt-4-turbo-*', 'gpt-4-turbo'),
+('gpt-3.5-turbo-*', 'gpt-3.5-turbo'),
+('claude-3-opus-*', 'claude-3-opus'),
+('claude-3-sonnet-*', 'claude-3-sonnet'),
+('claude-3-haiku-*', 'claude-3-haiku');
@@ -0,0 +1,40 @@
+-- 016_refund_policy.up.sql
+--
+-- Purpose: Let a customer's plan limit refunds of overestimated requests.
+--
+-- When a request was charged more while streaming than its actual cost,
+-- finalization gives the difference back. Some plans don't allow that, or
+-- only give part of it back:
+--
+--   'full'            - Refund the whole difference (the default, and the
+--                       behavior before this migration)
+--   'none'            - Refund nothing
+--   'partial_percent' - Refund refund_percent percent of the difference,
+--                       rounded down
+--
+-- Both values are synced to Redis in the customer:config:{customer_id}
+-- hash, which the finalize script reads. Whatever is not refunded is
+-- recorded as a 'refund_withheld' transaction next to the request's
+-- 'ai_usage', so the customer's transactions still add up to their balance.
+
+ALTER TABLE customers
+    ADD COLUMN refund_policy VARCHAR(20) NOT NULL DEFAULT 'full'
+        CHECK (refund_policy IN ('full', 'none', 'partial_percent'));
+
+ALTER TABLE customers
+    ADD COLUMN refund_percent SMALLINT NOT NULL DEFAULT 100
+        CHECK (refund_percent BETWEEN 0 AND 100);
+
+COMMENT ON COLUMN customers.refund_policy IS 'How much of an overestimated request is refunded at finalization: full, none or partial_percent';
+COMMENT ON COLUMN customers.refund_percent IS 'Percent of the overestimate refunded under the partial_percent policy';
+
+ALTER TABLE transactions DROP CONSTRAINT transactions_transaction_type_check;
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_transaction_type_check CHECK (
+        transaction_type IN (
+            'ai_usage', 'credit', 'refund', 'transfer_in',
+            'transfer_out', 'adjustment', 'reservation_leaked',
+            'opening_balance', 'refund_withheld'
+        )
+    );
@@ -0,0 +1,25 @@
+-- 017_promo_grants.up.sql
+--
+-- Purpose: Record promotional credit granted to customers by campaign.
+--
+-- Marketing campaigns credit the same amount of promo grains to many
+-- customers at once (beam-cli admin grant-promo). Each grant is recorded
+-- here, keyed by campaign and customer, so rerunning a campaign after a
+-- partial failure only credits the customers it missed.
+--
+-- The credit itself is a 'credit' transaction (reference_id = campaign_id)
+-- into the customer's 'promo' funding bucket. expires_at is when the
+-- campaign's credit is meant to lapse; it is recorded with the grant and in
+-- the transaction metadata, but nothing takes unspent promo grains back yet.
+
+CREATE TABLE promo_grants (
+    campaign_id VARCHAR(255) NOT NULL,
+    customer_id VARCHAR(255) NOT NULL REFERENCES customers(customer_id) ON DELETE CASCADE,
+    transaction_id VARCHAR(255) NOT NULL,
+    amount_grains BIGINT NOT NULL CHECK (amount_grains > 0),
+    expires_at TIMESTAMP,
+    granted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (campaign_id, customer_id)
+);
+
+COMMENT ON TABLE promo_grants IS 'Promotional credit granted per campaign; one row per customer makes reruns idempotent';
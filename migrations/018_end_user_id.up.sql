@@ -0,0 +1,20 @@
+-- 018_end_user_id.up.sql
+--
+-- Purpose: Record which of the platform's end users each request was for.
+--
+-- A request is made for a customer (customer_id) by a platform
+-- (platform_user_id), but platforms also need to know which of their own
+-- users was behind it, for per-user analytics and abuse tracking. SDKs may
+-- send it as RequestMetadata.end_user_id; it is stored here and on the
+-- request hash in Redis. Requests made without one have NULL.
+--
+-- The index serves ListRequests filtered by end user and the per-end-user
+-- usage summary (ledger.UsageByEndUser).
+
+ALTER TABLE requests ADD COLUMN end_user_id VARCHAR(255);
+
+CREATE INDEX idx_requests_customer_end_user
+    ON requests (customer_id, end_user_id, created_at DESC)
+    WHERE end_user_id IS NOT NULL;
+
+COMMENT ON COLUMN requests.end_user_id IS 'The platform''s end user the request was made for, if the SDK sent one';
@@ -0,0 +1,17 @@
+-- 019_request_tags.up.sql
+--
+-- Purpose: Record cost attribution tags on requests.
+--
+-- Platforms attribute spend to their own cost centers (team, project,
+-- feature, ...) by sending them as RequestMetadata.custom_properties. Only
+-- the keys allowlisted with ATTRIBUTION_TAGS are kept, so the set of keys
+-- stays small; the rest of custom_properties is not stored. Requests with no
+-- allowlisted tag have NULL.
+--
+-- Usage is summed per tag value from here (ledger.UsageByTag, GET
+-- /v1/usage?group_by=tag:<key>). Those queries are bounded by customer and
+-- time and use the existing customer indexes, so tags itself isn't indexed.
+
+ALTER TABLE requests ADD COLUMN tags JSONB;
+
+COMMENT ON COLUMN requests.tags IS 'Allowlisted cost attribution tags from the request''s custom_properties';
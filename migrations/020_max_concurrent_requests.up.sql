@@ -0,0 +1,19 @@
+-- 020_max_concurrent_requests.up.sql
+--
+-- Purpose: Cap how many requests a customer may have in flight at once.
+--
+-- A customer firing off thousands of concurrent requests holds a reservation
+-- for each, which can lock up their whole balance. With
+-- max_concurrent_requests set, a reservation is refused with
+-- TOO_MANY_INFLIGHT while the customer already has that many requests
+-- reserved and not yet finalized, cancelled, released or abandoned.
+--
+-- The value is synced to Redis in the customer:config:{customer_id} hash;
+-- the in-flight requests are tracked in customer:inflight:{customer_id}.
+-- 0 means no limit.
+
+ALTER TABLE customers
+    ADD COLUMN max_concurrent_requests INTEGER NOT NULL DEFAULT 0
+        CHECK (max_concurrent_requests >= 0);
+
+COMMENT ON COLUMN customers.max_concurrent_requests IS 'Most requests the customer may have in flight at once; 0 for no limit';
@@ -0,0 +1,37 @@
+-- 021_requests_archive.up.sql
+--
+-- Purpose: Keep the requests table small by archiving old finished requests.
+--
+-- Every AI request adds a row to requests, and ListRequests and the usage
+-- queries slow down as it grows. beam-cli admin archive-requests (run from
+-- cron) moves requests that reached a terminal status and are older than
+-- the retention into requests_archive, in batches (ledger.ArchiveOldRequests).
+-- Requests still in flight are never moved.
+--
+-- requests_archive has the same columns as requests plus archived_at, and is
+-- partitioned by month of created_at so a month can be detached or dropped
+-- once it is no longer needed. The archiver creates each month's partition
+-- (requests_archive_YYYY_MM) before moving rows into it. Rows are copied
+-- with SELECT *, so a column added to requests must be added to
+-- requests_archive too, in the same position (before archived_at).
+--
+-- Only requests rows move. Transactions reference requests by reference_id
+-- without a foreign key, so the transaction audit trail is unaffected, and
+-- balances never depend on requests.
+--
+-- Archived requests no longer show in ListRequests or usage summaries.
+
+CREATE TABLE requests_archive (
+    LIKE requests INCLUDING DEFAULTS,
+    archived_at TIMESTAMP NOT NULL DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE INDEX idx_requests_archive_request ON requests_archive(request_id);
+CREATE INDEX idx_requests_archive_customer_time ON requests_archive(customer_id, created_at DESC);
+
+-- Finds archivable rows without scanning the whole table; in-flight rows
+-- have idx_requests_in_flight
+CREATE INDEX idx_requests_created_at ON requests(created_at);
+
+COMMENT ON TABLE requests_archive IS 'Finished requests moved out of requests by ledger.ArchiveOldRequests, partitioned by month';
+COMMENT ON COLUMN requests_archive.archived_at IS 'When the request was moved out of requests';
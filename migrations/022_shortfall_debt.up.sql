@@ -0,0 +1,21 @@
+-- 022_shortfall_debt.up.sql
+--
+-- Purpose: Record undercharge shortfalls that are owed rather than absorbed.
+--
+-- When a request's actual cost exceeds what streaming deducted by more than
+-- the customer's balance, finalization used to zero the balance and let the
+-- platform eat the rest. SHORTFALL_POLICY=debt instead adds the rest to the
+-- customer's debt counter and records it as a 'shortfall_debt' transaction
+-- next to the request's 'ai_usage', offsetting the part of it the balance
+-- didn't pay, so the customer's transactions still add up to their balance.
+
+ALTER TABLE transactions DROP CONSTRAINT transactions_transaction_type_check;
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_transaction_type_check CHECK (
+        transaction_type IN (
+            'ai_usage', 'credit', 'refund', 'transfer_in',
+            'transfer_out', 'adjustment', 'reservation_leaked',
+            'opening_balance', 'refund_withheld', 'shortfall_debt'
+        )
+    );
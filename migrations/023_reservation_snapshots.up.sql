@@ -0,0 +1,28 @@
+-- 023_reservation_snapshots.up.sql
+--
+-- Purpose: Let in-flight reservations survive the loss of Redis.
+--
+-- Reserved counters and in-flight request hashes live only in Redis.
+-- InitializeRedis rebuilds balances from customers after Redis is lost, but
+-- every reservation in flight at the time was stranded: its grains were no
+-- longer held and its request could not be finalized.
+--
+-- With RESERVATION_SNAPSHOT_INTERVAL set, the API server periodically copies
+-- them here (ledger.SnapshotReservations), and at startup puts back those
+-- still in flight in requests (ledger.RestoreReservations). There is only
+-- ever one snapshot, the latest.
+
+CREATE TABLE reservation_snapshots (
+    id SMALLINT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+
+    -- [{customer_id, currency, reserved, reserved_low}]
+    counters JSONB NOT NULL,
+
+    -- [{customer_id, request_id, fields, expires_at}]: each request hash,
+    -- with the Unix time it expires
+    requests JSONB NOT NULL,
+
+    taken_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE reservation_snapshots IS 'Latest copy of the in-flight reservations in Redis, restored at startup after Redis is lost';
@@ -0,0 +1,16 @@
+-- 024_modality_pricing.up.sql
+--
+-- Purpose: Price image and audio tokens at their own rates.
+--
+-- Multimodal models charge differently for image and audio tokens than for
+-- text. When DeductTokens or FinalizeRequest is given a breakdown of its
+-- token counts by modality, each part is priced at the matching rate here.
+-- Both are optional: a model without one prices that modality at its text
+-- rate (input or output, as the tokens are).
+
+ALTER TABLE model_pricing
+    ADD COLUMN image_cost_per_million_tokens BIGINT CHECK (image_cost_per_million_tokens >= 0),
+    ADD COLUMN audio_cost_per_million_tokens BIGINT CHECK (audio_cost_per_million_tokens >= 0);
+
+COMMENT ON COLUMN model_pricing.image_cost_per_million_tokens IS 'Grains per million image tokens; NULL prices them at the text rate';
+COMMENT ON COLUMN model_pricing.audio_cost_per_million_tokens IS 'Grains per million audio tokens; NULL prices them at the text rate';
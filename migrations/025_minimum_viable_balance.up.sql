@@ -0,0 +1,19 @@
+-- 025_minimum_viable_balance.up.sql
+--
+-- Purpose: Allow a per-customer minimum viable balance.
+--
+-- A balance too small to fund even a minimal request still passes the
+-- reserve check if the estimate is tiny, and the request hits the kill
+-- switch as soon as it streams. With MINIMUM_VIABLE_BALANCE_GRAINS set,
+-- CheckBalance refuses every reservation of a prepaid customer whose
+-- available balance is below it with BALANCE_TOO_LOW, before anything is
+-- reserved. This column overrides that minimum for a customer.
+--
+-- NULL means "use the server default". The value is synced to Redis in the
+-- customer:config:{customer_id} hash alongside the balance.
+
+ALTER TABLE customers
+    ADD COLUMN minimum_viable_balance_grains BIGINT
+        CHECK (minimum_viable_balance_grains IS NULL OR minimum_viable_balance_grains > 0);
+
+COMMENT ON COLUMN customers.minimum_viable_balance_grains IS 'Available balance below which reservations are refused with BALANCE_TOO_LOW (NULL = server default)';
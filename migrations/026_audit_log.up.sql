@@ -0,0 +1,41 @@
+-- 026_audit_log.up.sql
+--
+-- Purpose: Tamper-evident security audit stream.
+--
+-- With AUDIT_LOG=postgres the server writes its security audit events here
+-- (see internal/audit): authentication failures, admin RPCs and refused
+-- admin calls, and admin HTTP operations such as clearing safe mode. Unlike
+-- admin_audit this is a hash chain: each row's hash covers its contents and
+-- the previous row's hash, so an edited, inserted or deleted row breaks
+-- every hash after it (beam-cli admin verify-audit-log).
+--
+-- Writers take a transaction-scoped advisory lock before reading the last
+-- hash, so replicas sharing the table extend one chain. Like admin_audit the
+-- table is append-only.
+
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    at TIMESTAMPTZ NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    actor VARCHAR(255),
+    target_customer VARCHAR(255),
+    detail JSONB NOT NULL DEFAULT '{}',
+    prev_hash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX idx_audit_log_at ON audit_log(at);
+
+REVOKE UPDATE, DELETE, TRUNCATE ON audit_log FROM PUBLIC;
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+COMMENT ON TABLE audit_log IS 'Hash-chained security audit events (auth failures, admin operations)';
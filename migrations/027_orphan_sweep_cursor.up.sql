@@ -0,0 +1,15 @@
+-- 027_orphan_sweep_cursor.up.sql
+--
+-- Purpose: Let the orphan sweeper page through in-flight requests.
+--
+-- A request finalized in Redis stays in flight in PostgreSQL until its
+-- write lands, and the sweeper can't abandon it. Rather than re-reading the
+-- same oldest rows every run, each sweep resumes after the last
+-- (created_at, request_id) the previous one saw. This replaces the index
+-- from 008_orphan_requests with one in that order, so resuming is an index
+-- range scan.
+
+DROP INDEX IF EXISTS idx_requests_in_flight;
+
+CREATE INDEX idx_requests_in_flight ON requests(created_at, request_id)
+    WHERE status IN ('preflight_approved', 'streaming');
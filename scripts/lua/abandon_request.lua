@@ -0,0 +1,74 @@
+-- abandon_request.lua
+--
+-- Purpose: Close out a request that was reserved (and maybe streamed) but
+-- never finalized, e.g. because the client crashed mid-stream. Called by the
+-- orphan sweeper once the request is older than the finalize timeout.
+--
+-- The reservation is released and the request is charged exactly what was
+-- deducted while streaming: those grains already left the balance, so there
+-- is nothing to refund or charge in Redis. The hash is kept (24h by default)
+-- with status 'abandoned' so a late FinalizeRequest or CancelRequest is a
+-- no-op.
+--
+-- A low-priority request's reservation is also taken off the low-priority
+-- counter (see priority.lua, which is prepended). The request hash is read
+-- with load_request (see request.lua, also prepended).
+--
+-- finalized_at is Redis server time (see check_and_reserve.lua).
+--
+-- Performance: Completes in 1-3ms
+--
+-- Arguments:
+--   KEYS[1] = "customer:reserved:{customer_id}"
+--   KEYS[2] = "request:{request_id}"
+--   KEYS[3] = "system:total_reserved" - Sum of all reserved counters (for metrics)
+--   KEYS[4] = "customer:reserved_low:{customer_id}" - Grains reserved by low-priority requests
+--   KEYS[5] = "customer:inflight:{customer_id}" - In-flight requests (see check_and_reserve.lua)
+--
+--   ARGV[1] = request_ttl - Seconds to keep the abandoned request hash
+--
+-- Returns:
+--   Abandoned: {1, released_grains, consumed_grains, ""}
+--   Already finalized: {1, 0, 0, "ALREADY_TERMINAL"}
+--   On failure: {0, 0, 0, error_code}
+--
+-- Error Codes:
+--   "REQUEST_NOT_FOUND" - Request tracking hash missing (expired or cancelled)
+
+-- The request is no longer in flight, whatever state it turns out to be in
+redis.call('ZREM', KEYS[5], KEYS[2])
+
+local request = load_request(KEYS[2])
+if not request then
+    return {0, 0, 0, 'REQUEST_NOT_FOUND'}
+end
+
+-- Only in-flight requests are abandoned. Anything else was finalized and
+-- its PostgreSQL write is on its way.
+local current_status = request['status']
+if current_status ~= 'preflight_approved' and current_status ~= 'streaming' then
+    return {1, 0, 0, 'ALREADY_TERMINAL'}
+end
+
+local reserved = tonumber(request['reserved_grains'] or '0')
+local consumed = tonumber(request['consumed_grains'] or '0')
+
+-- Release the reservation, clamped like finalize_request.lua
+local current_reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+local released = reserved
+if current_reserved < reserved then
+    released = current_reserved
+    redis.call('HSET', KEYS[2], 'integrity_issue', 'reservation_underflow')
+end
+redis.call('DECRBY', KEYS[1], released)
+redis.call('DECRBY', KEYS[3], released)
+release_low(KEYS[4], request['priority'], released)
+
+redis.call('HMSET', KEYS[2],
+    'status', 'abandoned',
+    'actual_cost_grains', tostring(consumed),
+    'finalized_at', redis.call('TIME')[1]
+)
+redis.call('EXPIRE', KEYS[2], ARGV[1])
+
+return {1, released, consumed, ''}
@@ -0,0 +1,45 @@
+-- adjust_balance.lua
+--
+-- Purpose: Apply a manual balance adjustment (credit or debit) made by
+-- support through AdjustBalance. PostgreSQL has already been updated and the
+-- audit transaction recorded; this brings Redis in line with the same delta.
+--
+-- A customer whose balance isn't in Redis yet is left alone rather than
+-- created at the delta: the next sync loads the full balance from PostgreSQL,
+-- which already includes the adjustment.
+--
+-- Funding buckets: the delta goes to the named bucket. An adjustment to the
+-- default bucket leaves a single-bucket customer single-bucket; any other
+-- bucket first creates the hash with their existing balance in the default
+-- bucket, so the hash keeps summing to the balance.
+--
+-- Performance: Completes in under 1ms
+--
+-- Arguments:
+--   KEYS[1] = "customer:balance:{customer_id}"
+--   KEYS[2] = "system:total_balance" - Sum of all balances (for metrics)
+--   KEYS[3] = "customer:buckets:{customer_id}" - Funding buckets (may not exist)
+--
+--   ARGV[1] = delta_grains - Positive to credit, negative to debit
+--   ARGV[2] = bucket - Funding bucket to adjust
+--   ARGV[3] = default_bucket - Bucket holding a single-bucket customer's balance
+--
+-- Returns:
+--   Applied: {1, new_balance}
+--   Not in Redis: {0, 0}
+
+if redis.call('EXISTS', KEYS[1]) == 0 then
+    return {0, 0}
+end
+
+if ARGV[2] ~= ARGV[3] or redis.call('EXISTS', KEYS[3]) == 1 then
+    if redis.call('EXISTS', KEYS[3]) == 0 then
+        redis.call('HSET', KEYS[3], ARGV[3], redis.call('GET', KEYS[1]))
+    end
+    redis.call('HINCRBY', KEYS[3], ARGV[2], ARGV[1])
+end
+
+local new_balance = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('INCRBY', KEYS[2], ARGV[1])
+
+return {1, new_balance}
@@ -0,0 +1,106 @@
+-- batch_reserve.lua
+--
+-- Purpose: Reserve grains for several requests of one customer all or
+-- nothing (ledger.BatchReserve). The batch's total is checked against the
+-- available balance first; only if the whole batch fits, and none of its
+-- request IDs is taken, is each sub-request reserved.
+--
+-- Each sub-request is reserved by check_and_reserve.lua, unchanged, wrapped
+-- in a function by the ledger, so it leaves exactly what a single
+-- reservation would. The checks below are that script's, for the whole
+-- batch, so none of the calls can be rejected. The minimum viable balance
+-- is checked once, before the batch, as for a single reservation; the
+-- calls skip it (ARGV[16] = "1"), or every sub-request after the first
+-- would be checked against a balance its siblings already reserved.
+-- Should a call be rejected anyway, the script fails rather than report
+-- the batch approved. Preemption doesn't apply: the ledger always passes
+-- preempt "0".
+--
+-- Arguments:
+--   KEYS[1] = "customer:balance:{customer_id}"
+--   KEYS[2] = "customer:reserved:{customer_id}"
+--   KEYS[3] = "system:total_reserved"
+--   KEYS[4] = "customer:reserved_low:{customer_id}"
+--   KEYS[5] = "customer:config:{customer_id}"
+--   KEYS[6] = "customer:debt:{customer_id}"
+--   KEYS[7] = "system:safe_mode"
+--   KEYS[8] = "customer:inflight:{customer_id}"
+--   KEYS[9..8+n] = "request:{request_id}" of each sub-request
+--
+--   ARGV[(i-1)*15+1 .. i*15] = check_and_reserve's ARGV for sub-request i
+--
+-- Returns:
+--   On success: {1, current_balance, "", remaining_available_balance, 0}
+--   On failure: {0, current_balance, rejection_reason, available_balance, index}
+--   For BALANCE_TOO_LOW: {0, current_balance, "BALANCE_TOO_LOW", available_balance, 0, minimum}
+--
+-- index is the 1-based sub-request whose ID exists for REQUEST_EXISTS, 0
+-- otherwise. Rejection reasons are check_and_reserve's.
+
+local function check_and_reserve(KEYS, ARGV)
+    -- check_and_reserve.lua
+end
+
+local n = #KEYS - 8
+
+-- The balance as check_and_reserve reads it, credit left for postpaid
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local postpaid = redis.call('HGET', KEYS[5], 'billing_mode') == 'postpaid'
+if postpaid then
+    local ceiling = tonumber(redis.call('HGET', KEYS[5], 'credit_ceiling_grains') or '0')
+    if ceiling <= 0 then
+        ceiling = tonumber(ARGV[11])
+    end
+    balance = ceiling - tonumber(redis.call('GET', KEYS[6]) or '0')
+end
+local available = balance - tonumber(redis.call('GET', KEYS[2]) or '0')
+
+if redis.call('EXISTS', KEYS[7]) == 1 then
+    return {0, balance, 'INTEGRITY_SAFE_MODE', available, 0}
+end
+if redis.call('EXISTS', KEYS[1], KEYS[5]) == 0 then
+    return {0, balance, 'CUSTOMER_NOT_FOUND', available, 0}
+end
+
+local needed = 0
+for i = 1, n do
+    if redis.call('EXISTS', KEYS[8 + i]) == 1 then
+        return {0, balance, 'REQUEST_EXISTS', available, i}
+    end
+    needed = needed + tonumber(ARGV[(i - 1) * 15 + 1])
+end
+
+-- The whole batch must fit under the concurrency limit
+local max_inflight = tonumber(redis.call('HGET', KEYS[5], 'max_concurrent_requests') or '0')
+if max_inflight > 0 then
+    redis.call('ZREMRANGEBYSCORE', KEYS[8], '-inf', tonumber(redis.call('TIME')[1]))
+    if redis.call('ZCARD', KEYS[8]) + n > max_inflight then
+        return {0, balance, 'TOO_MANY_INFLIGHT', available, 0}
+    end
+end
+
+if not postpaid then
+    local minimum = tonumber(redis.call('HGET', KEYS[5], 'minimum_viable_balance_grains') or '0')
+    if minimum <= 0 then
+        minimum = tonumber(ARGV[15])
+    end
+    if minimum > 0 and available < minimum then
+        return {0, balance, 'BALANCE_TOO_LOW', available, 0, minimum}
+    end
+end
+
+if available < needed then
+    return {0, balance, 'INSUFFICIENT_BALANCE', available, 0}
+end
+
+for i = 1, n do
+    local args = {unpack(ARGV, (i - 1) * 15 + 1, i * 15)}
+    args[16] = '1'
+    local reservation = check_and_reserve(
+        {KEYS[1], KEYS[2], KEYS[8 + i], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7], KEYS[8]},
+        args)
+    if reservation[1] ~= 1 then
+        return redis.error_reply('batch sub-request ' .. i .. ' rejected after precheck: ' .. reservation[3])
+    end
+end
+return {1, balance, '', available - needed, 0}
@@ -0,0 +1,60 @@
+-- buckets.lua
+--
+-- Purpose: Helpers shared by the scripts that move a customer's grains
+-- (deduct_grains, finalize_request, cancel_request). They are not a script
+-- of their own: the ledger prepends them to each of those scripts.
+--
+-- A customer with more than one funding source has a hash
+-- "customer:buckets:{customer_id}" of bucket -> grains alongside their
+-- balance key. The hash always sums to the balance key, which stays the
+-- combined view that check_and_reserve checks against. Customers without
+-- the hash are single-bucket, and both helpers do nothing for them.
+--
+-- bucket_order is generated from ledger.FundingBuckets: spending draws the
+-- buckets down first to last (promotional grants before prepaid credit).
+--
+-- Each request records how much it took from each bucket on its tracking
+-- hash as drawn:{bucket}, so refunds go back where the grains came from.
+
+local bucket_order = {'promo', 'paid'}
+
+-- draw_buckets spends amount from the buckets in priority order.
+-- The last bucket absorbs whatever the others can't cover, so a balance
+-- inside the customer's kill grace goes negative there.
+local function draw_buckets(bkey, rkey, amount)
+    if amount <= 0 or redis.call('EXISTS', bkey) == 0 then
+        return
+    end
+    local remaining = amount
+    for i, b in ipairs(bucket_order) do
+        local take = remaining
+        if i < #bucket_order then
+            local have = tonumber(redis.call('HGET', bkey, b) or '0')
+            take = math.min(math.max(have, 0), remaining)
+        end
+        if take > 0 then
+            redis.call('HINCRBY', bkey, b, -take)
+            redis.call('HINCRBY', rkey, 'drawn:' .. b, take)
+            remaining = remaining - take
+        end
+    end
+end
+
+-- return_buckets gives amount back to the buckets the request drew it
+-- from, most recently drawn (lowest priority) first.
+local function return_buckets(bkey, rkey, amount)
+    if amount <= 0 or redis.call('EXISTS', bkey) == 0 then
+        return
+    end
+    local remaining = amount
+    for i = #bucket_order, 1, -1 do
+        local b = bucket_order[i]
+        local drawn = tonumber(redis.call('HGET', rkey, 'drawn:' .. b) or '0')
+        local give = math.min(drawn, remaining)
+        if give > 0 then
+            redis.call('HINCRBY', bkey, b, give)
+            redis.call('HINCRBY', rkey, 'drawn:' .. b, -give)
+            remaining = remaining - give
+        end
+    end
+end
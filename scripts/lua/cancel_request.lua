@@ -0,0 +1,74 @@
+-- cancel_request.lua
+--
+-- Purpose: Release a reservation for a request the client decided not to run
+-- (e.g. the end user cancelled before the stream started). The request is
+-- recorded with zero cost, so only a request with no usage can be cancelled:
+-- once streaming has deducted anything the cancel is refused with
+-- REQUEST_IN_PROGRESS and the request must be finalized (or released, see
+-- release_reservation.lua) so that usage stays charged.
+--
+-- Already-terminal requests (completed, killed, failed, timeout, abandoned, released) are left
+-- untouched and reported as success, so cancelling after finalization is a
+-- safe no-op.
+--
+-- The request hash is read with load_request (see request.lua, which is
+-- prepended along with priority.lua).
+--
+-- Performance: Completes in 1-3ms
+--
+-- Arguments:
+--   KEYS[1] = "customer:reserved:{customer_id}"
+--   KEYS[2] = "request:{request_id}"
+--   KEYS[3] = "system:total_reserved" - Sum of all reserved counters (for metrics)
+--   KEYS[4] = "customer:reserved_low:{customer_id}" - Grains reserved by low-priority requests
+--   KEYS[5] = "customer:inflight:{customer_id}" - In-flight requests (see check_and_reserve.lua)
+--
+-- Returns:
+--   On cancellation: {1, released_grains, ""}
+--   Already terminal: {1, 0, "ALREADY_TERMINAL"}
+--   On failure: {0, 0, error_code}
+--
+-- Error Codes:
+--   "REQUEST_NOT_FOUND"   - Request tracking hash missing (never reserved,
+--                           expired, or already cancelled)
+--   "REQUEST_IN_PROGRESS" - Streaming has already deducted from the
+--                           request; nothing is changed
+
+local request = load_request(KEYS[2])
+if not request then
+    redis.call('ZREM', KEYS[5], KEYS[2])
+    return {0, 0, 'REQUEST_NOT_FOUND'}
+end
+
+-- Idempotency: finalized requests keep their hash (24h by default) with a
+-- terminal status. Their reservation is already released.
+local current_status = request['status']
+if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' or current_status == 'timeout' or current_status == 'abandoned' or current_status == 'released' then
+    redis.call('ZREM', KEYS[5], KEYS[2])
+    return {1, 0, 'ALREADY_TERMINAL'}
+end
+
+-- Cancelled requests cost nothing, so a request that has used anything
+-- can't be cancelled: it stays in flight until it is finalized
+local consumed = tonumber(request['consumed_grains'] or '0')
+if consumed > 0 then
+    return {0, 0, 'REQUEST_IN_PROGRESS'}
+end
+
+redis.call('ZREM', KEYS[5], KEYS[2])
+local reserved = tonumber(request['reserved_grains'] or '0')
+
+-- Release the full reservation, clamping at zero as finalize does
+local current_reserved = tonumber(redis.call('GET', KEYS[1]) or '0')
+local released = reserved
+if current_reserved < reserved then
+    released = current_reserved
+end
+redis.call('DECRBY', KEYS[1], released)
+redis.call('DECRBY', KEYS[3], released)
+-- Off the low-priority counter too, if it was counted there (see priority.lua)
+release_low(KEYS[4], request['priority'], released)
+
+redis.call('DEL', KEYS[2])
+
+return {1, released, ''}
@@ -7,6 +7,41 @@
 --
 -- This script is THE CORE of Beam's correctness guarantees. It must be perfect.
 --
+-- Funding buckets: the check is against the combined balance, which is the
+-- sum of a customer's buckets. A reservation doesn't yet say which bucket
+-- pays; buckets are drawn in priority order as the grains are actually spent
+-- (deduct_grains, finalize_request).
+--
+-- Postpaid billing: for a customer whose config hash has billing_mode
+-- "postpaid", the balance checked against is the credit left, i.e. their
+-- credit ceiling minus the debt they have accrued. Reservations are counted
+-- as for any customer. The billing mode and ceiling are pinned on the
+-- request hash so its deductions and finalization charge the debt counter
+-- (see deduct_grains.lua and finalize_request.lua).
+--
+-- Timestamps: created_at, like every timestamp the scripts write to a
+-- request hash (last_deduction_at, finalized_at), is taken from Redis's own
+-- clock with TIME rather than passed in by the API server. Servers' clocks
+-- drift apart, and a request reserved on one and finalized on another could
+-- otherwise be finalized "before" it was created. Redis time is one clock
+-- per node, so the timestamps on a hash only move forward. Calling TIME
+-- between writes needs Redis 5 or later, which replicates a script's
+-- effects rather than the script.
+--
+-- Concurrency limit: every reserved request is added to the customer's
+-- in-flight sorted set, scored with the time its request hash expires. If
+-- the config hash sets max_concurrent_requests, a reservation is refused
+-- with TOO_MANY_INFLIGHT while that many unexpired entries remain. The
+-- scripts ending a request (finalize, cancel, abandon, release) remove it,
+-- and an entry whose request was never ended stops counting when its score
+-- passes, so a crashed API server can't hold a customer's slots forever.
+--
+-- Minimum viable balance: a prepaid customer whose available balance is
+-- below their minimum_viable_balance_grains (or ARGV[15] if their config
+-- has none) is refused with BALANCE_TOO_LOW, however small the reservation.
+-- A balance that can't fund even a minimal request would otherwise pass for
+-- a tiny estimate and hit the kill switch as soon as the stream starts.
+--
 -- Performance: Executes in under 1 millisecond in Redis
 -- Atomicity: Guaranteed by Redis single-threaded execution model
 --
@@ -14,39 +49,150 @@
 --   KEYS[1] = "customer:balance:{customer_id}" - Current grain balance
 --   KEYS[2] = "customer:reserved:{customer_id}" - Currently reserved grains
 --   KEYS[3] = "request:{request_id}" - Request tracking hash
+--   KEYS[4] = "system:total_reserved" - Sum of all reserved counters (for metrics)
+--   KEYS[5] = "customer:reserved_low:{customer_id}" - Grains reserved by low-priority requests
+--   KEYS[6] = "customer:config:{customer_id}" - Per-customer settings (billing_mode, credit_ceiling_grains)
+--   KEYS[7] = "customer:debt:{customer_id}" - Postpaid debt accrued since the last settlement
+--   KEYS[8] = "system:safe_mode" - Present while the ledger is in integrity safe mode
+--   KEYS[9] = "customer:inflight:{customer_id}" - In-flight requests (sorted set)
 --
 --   ARGV[1] = reserved_grains - Amount to reserve for this request
 --   ARGV[2] = estimated_grains - Original estimate before buffer
---   ARGV[3] = current_timestamp - Unix timestamp (seconds)
---   ARGV[4] = request_metadata - JSON string with request details
---   ARGV[5] = customer_id - Extracted for hash storage
+--   ARGV[3] = request_metadata - JSON string with request details
+--   ARGV[4] = customer_id - Extracted for hash storage
+--   ARGV[5] = dry_run - "1" to decide approval without reserving anything
+--   ARGV[6] = request_ttl - Seconds to keep the request hash (see below)
+--   ARGV[7] = input_cost_per_million - Input price to pin on the request, "" for none
+--   ARGV[8] = output_cost_per_million - Output price to pin on the request
+--   ARGV[9] = priority - "low", "normal" or "high", recorded on the request
+--   ARGV[10] = preempt - "1" to let this request reserve against grains held
+--              by low-priority requests (high priority with preemption enabled)
+--   ARGV[11] = default_credit_ceiling - Ceiling for postpaid customers whose
+--              config has none
+--   ARGV[12] = schema_version - Request hash layout version, recorded on the
+--              request (see request.lua)
+--   ARGV[13] = max_deductions - How many deduct_grains calls the request may
+--              make, recorded on the request; "0" for no cap
+--   ARGV[14] = end_user_id - The platform's end user the request is made for,
+--              recorded on the request; "" if not given
+--   ARGV[15] = default_minimum_viable_balance - Minimum for prepaid customers
+--              whose config has none; "0" for no minimum
+--   ARGV[16] = skip_minimum - "1" when batch_reserve.lua already checked the
+--              minimum for the whole batch; absent otherwise
+--
+-- Pinned prices are stored on the request hash so its deductions and
+-- finalization are priced at the rates in effect when it was reserved
+-- (see deduct_grains.lua and finalize_request.lua).
+--
+-- Preemption: a request allowed to preempt that the available balance can't
+-- cover is still approved if available balance plus the grains reserved by
+-- low-priority requests covers it. preempted_grains is the part of the
+-- reservation the available balance didn't cover; it is recorded on the
+-- request hash, and the remaining available balance is negative by as much.
+-- The low-priority requests aren't touched, they just run out first.
 --
 -- Returns:
---   On success: {1, remaining_available_balance, ""}
---   On failure: {0, current_balance, rejection_reason}
+--   On success: {1, remaining_available_balance, "", remaining_available_balance, preempted_grains}
+--   On failure: {0, current_balance, rejection_reason, available_balance}
+--   For BALANCE_TOO_LOW: {0, current_balance, "BALANCE_TOO_LOW", available_balance, minimum}
+--
+-- available_balance on failure lets the caller compute the shortfall
+-- (reserved_grains - available_balance) without a second round trip.
 --
 -- Rejection Reasons:
 --   "INSUFFICIENT_BALANCE" - Not enough available grains
 --   "REQUEST_EXISTS" - Duplicate request_id (prevents double-reservation)
+--   "INTEGRITY_SAFE_MODE" - Balances in Redis are not trusted (see safe_mode.go);
+--                           nothing is reserved until safe mode is cleared
+--   "TOO_MANY_INFLIGHT" - The customer has max_concurrent_requests in flight
+--   "CUSTOMER_NOT_FOUND" - Neither a balance nor a config hash; the customer
+--                          was never synced into Redis (or doesn't exist)
+--   "BALANCE_TOO_LOW" - Available balance below the minimum viable balance
 
 -- Read current state atomically
 local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+-- Postpaid customers spend credit rather than a balance
+local postpaid = redis.call('HGET', KEYS[6], 'billing_mode') == 'postpaid'
+local ceiling = 0
+if postpaid then
+    ceiling = tonumber(redis.call('HGET', KEYS[6], 'credit_ceiling_grains') or '0')
+    if ceiling <= 0 then
+        ceiling = tonumber(ARGV[11])
+    end
+    balance = ceiling - tonumber(redis.call('GET', KEYS[7]) or '0')
+end
+
 local reserved = tonumber(redis.call('GET', KEYS[2]) or '0')
 local needed = tonumber(ARGV[1])
 
 -- Calculate truly available balance (what's not locked by other requests)
 local available = balance - reserved
 
+-- Integrity safe mode: the balance just read may be wrong, so don't let
+-- anyone spend against it
+if redis.call('EXISTS', KEYS[8]) == 1 then
+    return {0, balance, 'INTEGRITY_SAFE_MODE', available}
+end
+
+-- Every synced customer has a config hash, and prepaid ones a balance key.
+-- With neither there is nothing to check against, which would otherwise
+-- read as a zero balance and be reported as INSUFFICIENT_BALANCE
+if redis.call('EXISTS', KEYS[1], KEYS[6]) == 0 then
+    return {0, balance, 'CUSTOMER_NOT_FOUND', available}
+end
+
 -- Check if this request ID already exists (prevents replay attacks)
 local existing_request = redis.call('EXISTS', KEYS[3])
 if existing_request == 1 then
-    return {0, balance, 'REQUEST_EXISTS'}
+    return {0, balance, 'REQUEST_EXISTS', available}
+end
+
+-- Concurrency limit: drop entries whose request hash has expired, then
+-- count what's left
+local now = tonumber(redis.call('TIME')[1])
+local max_inflight = tonumber(redis.call('HGET', KEYS[6], 'max_concurrent_requests') or '0')
+if max_inflight > 0 then
+    redis.call('ZREMRANGEBYSCORE', KEYS[9], '-inf', now)
+    if redis.call('ZCARD', KEYS[9]) >= max_inflight then
+        return {0, balance, 'TOO_MANY_INFLIGHT', available}
+    end
+end
+
+-- Minimum viable balance: don't approve what a nearly empty balance would
+-- kill straight away. Postpaid customers spend credit and are exempt
+if not postpaid and ARGV[16] ~= '1' then
+    local minimum = tonumber(redis.call('HGET', KEYS[6], 'minimum_viable_balance_grains') or '0')
+    if minimum <= 0 then
+        minimum = tonumber(ARGV[15])
+    end
+    if minimum > 0 and available < minimum then
+        return {0, balance, 'BALANCE_TOO_LOW', available, minimum}
+    end
 end
 
 -- Critical check: Can we afford this request?
+local preempted = 0
 if available < needed then
     -- Not enough funds. Return failure with current state for debugging.
-    return {0, balance, 'INSUFFICIENT_BALANCE'}
+    if ARGV[10] ~= '1' then
+        return {0, balance, 'INSUFFICIENT_BALANCE', available}
+    end
+
+    -- A high-priority request may also reserve against grains held by
+    -- low-priority requests, never against normal or high priority ones
+    local low = math.max(tonumber(redis.call('GET', KEYS[5]) or '0'), 0)
+    if available + low < needed then
+        return {0, balance, 'INSUFFICIENT_BALANCE', available}
+    end
+    preempted = needed - math.max(available, 0)
+end
+
+-- Dry run: report what would happen, but leave no trace.
+-- No reserved counter change and no request hash, so a dry run can't block
+-- other requests or collide with the real request later.
+if ARGV[5] == '1' then
+    return {1, available - needed, '', available - needed, preempted}
 end
 
 -- SUCCESS PATH: We can afford this request
@@ -55,6 +201,14 @@ end
 -- Increment the reserved counter
 redis.call('INCRBY', KEYS[2], needed)
 
+-- Keep the system-wide aggregate in step, so metrics never need a SCAN
+redis.call('INCRBY', KEYS[4], needed)
+
+-- Low-priority grains are what high-priority requests may preempt
+if ARGV[9] == 'low' then
+    redis.call('INCRBY', KEYS[5], needed)
+end
+
 -- Create comprehensive request tracking hash
 -- This hash serves multiple purposes:
 -- 1. Tracks reservation amount for later release
@@ -62,22 +216,50 @@ redis.call('INCRBY', KEYS[2], needed)
 -- 3. Provides audit trail for debugging
 -- 4. Enables background cleanup of stale requests
 redis.call('HSET', KEYS[3],
-    'customer_id', ARGV[5],
+    'customer_id', ARGV[4],
     'reserved_grains', ARGV[1],
     'estimated_grains', ARGV[2],
     'consumed_grains', '0',  -- Nothing consumed yet
     'status', 'preflight_approved',
-    'created_at', ARGV[3],
-    'metadata', ARGV[4]
+    'created_at', now,
+    'metadata', ARGV[3],
+    'priority', ARGV[9],
+    'billing', postpaid and 'postpaid' or 'prepaid',
+    'schema_version', ARGV[12]
 )
+if ARGV[13] ~= '0' then
+    redis.call('HSET', KEYS[3], 'max_deductions', ARGV[13])
+end
+if ARGV[14] ~= '' then
+    redis.call('HSET', KEYS[3], 'end_user_id', ARGV[14])
+end
+if preempted > 0 then
+    redis.call('HSET', KEYS[3], 'preempted_grains', preempted)
+end
+if postpaid then
+    redis.call('HSET', KEYS[3], 'credit_ceiling', ceiling)
+end
+if ARGV[7] ~= '' then
+    redis.call('HSET', KEYS[3],
+        'input_cost_per_million', ARGV[7],
+        'output_cost_per_million', ARGV[8]
+    )
+end
 
 -- Set TTL to prevent memory leaks from abandoned requests
--- 3600 seconds = 1 hour is generous for any AI request
--- Stale requests get cleaned up by background job before TTL expires
-redis.call('EXPIRE', KEYS[3], 3600)
+-- This is twice the finalize timeout (1 hour by default), which is generous
+-- for any AI request. Stale requests get cleaned up by the orphan sweeper
+-- (SweepOrphanRequests) before the TTL expires
+redis.call('EXPIRE', KEYS[3], ARGV[6])
+
+-- Track the request as in flight until it ends or its hash expires. This
+-- happens whether or not the customer has a limit, so one set later
+-- counts the requests already running.
+redis.call('ZADD', KEYS[9], now + tonumber(ARGV[6]), KEYS[3])
+redis.call('EXPIRE', KEYS[9], ARGV[6])
 
 -- Calculate new available balance after reservation
 local new_available = available - needed
 
 -- Return success with new available balance
-return {1, new_available, ''}
\ No newline at end of file
+return {1, new_available, '', new_available, preempted}
\ No newline at end of file
@@ -6,62 +6,164 @@
 -- Critical: This script enforces the kill switch. If balance hits zero mid-stream,
 -- this script returns failure, causing the SDK to immediately terminate streaming.
 --
+-- Kill grace: a customer may have kill_grace_grains set in their config hash.
+-- The balance is then allowed to go up to that many grains below zero before
+-- the kill switch fires, so a response one token from completion isn't cut
+-- off. The grains a request took from the grace are tracked on its hash as
+-- grace_used_grains. Without the field the grace is zero.
+--
+-- Funding buckets: for a customer with a bucket hash, the deduction is drawn
+-- from the buckets in priority order (see buckets.lua, which is prepended).
+--
+-- Postpaid billing: for a request reserved as postpaid (see
+-- check_and_reserve.lua) the balance is the credit left under the pinned
+-- ceiling, and deductions accrue to the debt counter instead of coming out
+-- of the balance. The grace works the same way, below zero credit.
+--
+-- Kill hysteresis: with kill_hysteresis set, the first deduction refused
+-- for lack of balance records killed_at on the request hash, and every later
+-- deduction for the request is refused with REQUEST_KILLED, even if credits
+-- have arrived since. A balance hovering around zero then kills a stream
+-- once instead of letting it flap between killed and running.
+--
+-- last_deduction_at is Redis server time (see check_and_reserve.lua).
+--
 -- Performance: Must complete in under 2ms as it's called 10-30 times per request
 --
 -- Arguments:
 --   KEYS[1] = "customer:balance:{customer_id}"
 --   KEYS[2] = "request:{request_id}"
+--   KEYS[3] = "system:total_balance" - Sum of all balances (for metrics)
+--   KEYS[4] = "customer:config:{customer_id}" - Per-customer settings (kill_grace_grains)
+--   KEYS[5] = "customer:buckets:{customer_id}" - Funding buckets (may not exist)
+--   KEYS[6] = "customer:debt:{customer_id}" - Postpaid debt
 --
 --   ARGV[1] = grain_amount - How many grains to deduct
 --   ARGV[2] = tokens_consumed - Token count for this batch (for tracking)
+--   ARGV[3] = client_priced - "1" if the SDK computed grain_amount itself
+--   ARGV[4] = pinned_price_field - Request hash field holding the price
+--             pinned at reservation ("input_cost_per_million" or
+--             "output_cost_per_million"), or "" to deduct grain_amount as is
+--   ARGV[5] = kill_hysteresis - "1" to keep a request killed once it runs
+--             out of balance
+--
+-- If the request has the pinned price, tokens_consumed is priced at it and
+-- grain_amount is ignored: a request is charged at the rates it was
+-- reserved at even if model pricing changed since.
 --
 -- Returns:
---   On success: {1, remaining_balance, ""}
---   On failure: {0, current_balance, error_code}
+--   On success: {1, remaining_balance, "", remaining_grace, grains_deducted}
+--   On failure: {0, current_balance, error_code, remaining_grace}
+--
+--   remaining_balance is negative while the request is running on grace.
 --
 -- Error Codes:
---   "INSUFFICIENT_BALANCE" - Customer ran out of grains mid-stream
+--   "INSUFFICIENT_BALANCE" - Customer ran out of grains (and grace) mid-stream
 --   "REQUEST_NOT_FOUND" - Request tracking hash doesn't exist
---   "BALANCE_NEGATIVE" - Balance integrity error (should never happen)
+--   "REQUEST_FINALIZED" - Request already reached a terminal status (nothing deducted)
+--   "COST_EXCEEDS_RESERVATION" - A client-priced deduction would take the
+--                                request past its reservation (nothing deducted)
+--   "TOO_MANY_DEDUCTIONS" - The request already made max_deductions calls
+--                           (nothing deducted)
+--   "REQUEST_KILLED" - With kill_hysteresis, the request already ran out of
+--                      balance once (nothing deducted)
 
 -- Read current balance
 local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local billing = redis.call('HMGET', KEYS[2], 'billing', 'credit_ceiling')
+local postpaid = billing[1] == 'postpaid'
+if postpaid then
+    balance = tonumber(billing[2]) - tonumber(redis.call('GET', KEYS[6]) or '0')
+end
 local amount = tonumber(ARGV[1])
+local grace = tonumber(redis.call('HGET', KEYS[4], 'kill_grace_grains') or '0')
+
+-- Grace left at a given balance. Clamped at zero in case the customer's
+-- grace was lowered while they were already below zero.
+local function grace_left(b)
+    return math.max(0, grace + math.min(0, b))
+end
 
--- Verify request still exists
-local request_exists = redis.call('EXISTS', KEYS[2])
-if request_exists == 0 then
+-- Verify request still exists (every request hash has a status)
+local status = redis.call('HGET', KEYS[2], 'status')
+if not status then
     -- Request tracking hash is missing (expired or never created)
     -- This shouldn't happen in normal operation
-    return {0, balance, 'REQUEST_NOT_FOUND'}
+    return {0, balance, 'REQUEST_NOT_FOUND', grace_left(balance)}
+end
+
+-- A deduction reordered behind FinalizeRequest (or arriving after a cancel
+-- or the orphan sweep) must not charge again: the final cost is settled
+if status == 'completed' or status == 'killed' or status == 'failed' or status == 'timeout' or status == 'abandoned' or status == 'released' then
+    return {0, balance, 'REQUEST_FINALIZED', grace_left(balance)}
+end
+
+-- A killed request stays killed, whatever the balance does now
+if ARGV[5] == '1' and redis.call('HEXISTS', KEYS[2], 'killed_at') == 1 then
+    return {0, balance, 'REQUEST_KILLED', grace_left(balance)}
+end
+
+-- Every call is counted against the cap recorded at reservation, so a
+-- client stuck in a loop is cut off however its deductions turn out.
+-- Requests reserved without a cap have no max_deductions field
+local deductions = redis.call('HMGET', KEYS[2], 'deductions', 'max_deductions')
+if deductions[2] and tonumber(deductions[1] or '0') >= tonumber(deductions[2]) then
+    return {0, balance, 'TOO_MANY_DEDUCTIONS', grace_left(balance)}
+end
+redis.call('HINCRBY', KEYS[2], 'deductions', 1)
+
+-- Price the batch at the rate pinned when the request was reserved
+if ARGV[4] ~= '' then
+    local price = redis.call('HGET', KEYS[2], ARGV[4])
+    if price then
+        amount = math.floor(tonumber(ARGV[2]) * tonumber(price) / 1000000)
+    end
+end
+
+-- A cost the SDK computed itself skipped server-side pricing. Bound it by
+-- the reservation, which the server did check: a deduction past it is
+-- refused outright rather than treated as running out of balance
+if ARGV[3] == '1' then
+    local request = redis.call('HMGET', KEYS[2], 'reserved_grains', 'consumed_grains')
+    if tonumber(request[2] or '0') + amount > tonumber(request[1] or '0') then
+        return {0, balance, 'COST_EXCEEDS_RESERVATION', grace_left(balance)}
+    end
 end
 
 -- Critical balance check
-if balance < amount then
+-- The balance may dip into the grace but never past it
+if balance + grace < amount then
     -- Out of funds! This triggers the kill switch in the SDK
     -- The SDK will throw InsufficientBalanceError and stop streaming
-    return {0, balance, 'INSUFFICIENT_BALANCE'}
+    if ARGV[5] == '1' then
+        redis.call('HSET', KEYS[2], 'killed_at', redis.call('TIME')[1])
+    end
+    return {0, balance, 'INSUFFICIENT_BALANCE', grace_left(balance)}
 end
 
--- Additional safety check: Don't allow balance to go negative
--- This protects against bugs in the estimation logic
-if balance - amount < 0 then
-    -- This is an integrity error that should never happen
-    -- Log it aggressively and prevent the deduction
-    return {0, balance, 'BALANCE_NEGATIVE'}
-end
+-- How much of this deduction comes out of the grace rather than the balance
+local new_balance = balance - amount
+local grace_used = math.max(0, -new_balance) - math.max(0, -balance)
 
 -- SUCCESS PATH: Deduct the grains
-redis.call('DECRBY', KEYS[1], amount)
+if postpaid then
+    -- Billed later: the balance and buckets are untouched
+    redis.call('INCRBY', KEYS[6], amount)
+else
+    redis.call('DECRBY', KEYS[1], amount)
+    redis.call('DECRBY', KEYS[3], amount)
+    draw_buckets(KEYS[5], KEYS[2], amount)
+end
 
 -- Update request tracking to maintain accurate consumption history
 -- This data is crucial for reconciliation and debugging
 redis.call('HINCRBY', KEYS[2], 'consumed_grains', amount)
+if grace_used > 0 then
+    redis.call('HINCRBY', KEYS[2], 'grace_used_grains', grace_used)
+end
 redis.call('HSET', KEYS[2], 
     'status', 'streaming',
-    'last_deduction_at', ARGV[3] or redis.call('TIME')[1]
+    'last_deduction_at', redis.call('TIME')[1]
 )
 
--- Calculate and return new balance
-local new_balance = balance - amount
-return {1, new_balance, ''}
\ No newline at end of file
+return {1, new_balance, '', grace_left(new_balance), amount}
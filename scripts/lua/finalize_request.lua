@@ -7,70 +7,175 @@
 -- This is called exactly once per request at stream-end with authoritative token data
 -- from the AI provider. The reconciliation here ensures perfect accounting accuracy.
 --
+-- Funding buckets: refunds go back to the buckets the request drew from and
+-- additional charges are drawn in priority order (see buckets.lua, which is
+-- prepended).
+--
+-- Releasing a low-priority request's reservation also takes it off the
+-- low-priority counter (see priority.lua, which is prepended).
+--
+-- The request hash is read with load_request (see request.lua, which is
+-- prepended), so requests reserved by an older version of the scripts
+-- finalize the same way.
+--
+-- Postpaid billing: for a request reserved as postpaid (see
+-- check_and_reserve.lua) the reconciliation is applied to the debt counter
+-- instead of the balance. An additional charge is always taken in full, as
+-- the customer is invoiced for it rather than paying out of a balance, and
+-- the reported balance is the credit left under the pinned ceiling.
+--
+-- Refund policy: how much of an overestimate (consumed beyond actual_cost)
+-- is given back follows the customer's refund_policy in their config hash:
+-- all of it ('full', also when unset), none ('none'), or refund_percent
+-- percent rounded down ('partial_percent'). The rest is withheld, recorded
+-- on the request hash and returned so that it is written to PostgreSQL as a
+-- refund_withheld transaction.
+--
+-- Shortfall policy: when a prepaid request's actual cost exceeds what
+-- streaming deducted by more than the balance left, ARGV[7] decides what
+-- happens to the part the balance can't cover (see WithShortfallPolicy):
+-- 'absorb' (also when unset) zeroes the balance and flags the request
+-- undercharge_shortfall, 'negative' takes the whole charge and leaves the
+-- balance below zero, and 'debt' zeroes the balance and adds the rest to
+-- the customer's debt counter, returning it so that it is written to
+-- PostgreSQL as a shortfall_debt transaction.
+--
+-- finalized_at is Redis server time (see check_and_reserve.lua).
+--
 -- Performance: Completes in 3-8ms (acceptable as it's only called once per request)
 --
 -- Arguments:
 --   KEYS[1] = "customer:balance:{customer_id}"
 --   KEYS[2] = "customer:reserved:{customer_id}"
 --   KEYS[3] = "request:{request_id}"
+--   KEYS[4] = "system:total_balance" - Sum of all balances (for metrics)
+--   KEYS[5] = "system:total_reserved" - Sum of all reserved counters (for metrics)
+--   KEYS[6] = "customer:buckets:{customer_id}" - Funding buckets (may not exist)
+--   KEYS[7] = "customer:reserved_low:{customer_id}" - Grains reserved by low-priority requests
+--   KEYS[8] = "customer:debt:{customer_id}" - Postpaid debt (and shortfall debt)
+--   KEYS[9] = "customer:config:{customer_id}" - Per-customer settings (refund policy)
+--   KEYS[10] = "customer:inflight:{customer_id}" - In-flight requests (see check_and_reserve.lua)
 --
 --   ARGV[1] = actual_cost_grains - Exact cost from provider's token counts
 --   ARGV[2] = status - "completed", "killed", or "failed"
---   ARGV[3] = finalized_at_timestamp
+--   ARGV[3] = price_from_pins - "1" to price the request at its pinned prices
+--   ARGV[4] = prompt_tokens - Provider's prompt token count
+--   ARGV[5] = completion_tokens - Provider's completion token count
+--   ARGV[6] = request_ttl - Seconds to keep the finalized request hash, per
+--             status (see WithTerminalRequestTTLs)
+--   ARGV[7] = shortfall_policy - "absorb", "negative" or "debt"
+--
+-- With price_from_pins, a request that had prices pinned at reservation
+-- (see check_and_reserve.lua) is charged prompt_tokens and
+-- completion_tokens at those prices instead of actual_cost_grains, so a
+-- model_pricing change mid-request doesn't affect it. A finalization with no
+-- token counts (the caller only knows the cost) is charged
+-- actual_cost_grains as reported.
 --
 -- Returns:
---   On success: {1, refunded_amount, final_balance}
+--   On success: {1, refunded_amount, final_balance, "", actual_cost,
+--                pinned_input_price, pinned_output_price,
+--                input_cost, output_cost, withheld_amount,
+--                shortfall_debt}
+--               (pinned prices are "" if none were pinned; input_cost and
+--               output_cost, which sum to actual_cost, are "" unless it was
+--               priced from the pins; shortfall_debt is what the 'debt'
+--               shortfall policy added to the debt counter)
+--   Already finalized: {1, 0, current_balance, "ALREADY_FINALIZED"}
 --   On failure: {0, 0, error_code}
 --
 -- Error Codes:
 --   "REQUEST_NOT_FOUND" - Request tracking hash missing
---   "ALREADY_FINALIZED" - Request already finalized (idempotency check)
 
--- Fetch complete request data
-local request_data = redis.call('HGETALL', KEYS[3])
+-- The request is no longer in flight, whatever state it turns out to be in
+redis.call('ZREM', KEYS[10], KEYS[3])
+
+-- Fetch complete request data, in the current layout
+local request = load_request(KEYS[3])
 
 -- Check if request exists
-if #request_data == 0 then
+if not request then
     return {0, 0, 'REQUEST_NOT_FOUND'}
 end
 
--- Convert array to map for easier access
-local request = {}
-for i = 1, #request_data, 2 do
-    request[request_data[i]] = request_data[i + 1]
+-- Balance as the request sees it: credit left for postpaid requests
+local postpaid = request['billing'] == 'postpaid'
+local function current_balance()
+    if postpaid then
+        return tonumber(request['credit_ceiling']) - tonumber(redis.call('GET', KEYS[8]) or '0')
+    end
+    return tonumber(redis.call('GET', KEYS[1]) or '0')
 end
 
 -- Idempotency check: Has this request already been finalized?
 local current_status = request['status']
-if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' then
+if current_status == 'completed' or current_status == 'killed' or current_status == 'failed' or current_status == 'timeout' or current_status == 'abandoned' or current_status == 'released' then
     -- Already finalized. This can happen if SDK retries finalization.
     -- Return success to make this operation idempotent.
-    local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
-    return {1, 0, balance}
+    return {1, 0, current_balance(), 'ALREADY_FINALIZED'}
 end
 
 -- Extract amounts from request tracking
 local reserved = tonumber(request['reserved_grains'] or '0')
 local consumed = tonumber(request['consumed_grains'] or '0')
 local actual_cost = tonumber(ARGV[1])
+local input_price = request['input_cost_per_million']
+local output_price = request['output_cost_per_million']
+local input_cost, output_cost = '', ''
+if ARGV[3] == '1' and input_price and output_price and (tonumber(ARGV[4]) > 0 or tonumber(ARGV[5]) > 0) then
+    input_cost = math.floor(tonumber(ARGV[4]) * tonumber(input_price) / 1000000)
+    output_cost = math.floor(tonumber(ARGV[5]) * tonumber(output_price) / 1000000)
+    actual_cost = input_cost + output_cost
+end
 
 -- Current balance before reconciliation
-local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+local balance = current_balance()
 
 -- Calculate reconciliation adjustment
 -- During streaming, we deducted 'consumed' grains based on estimates
 -- The actual cost from the provider is 'actual_cost'
 -- We need to correct the difference
 
+-- The part of an overestimate the customer's refund policy gives back
+local policy = redis.call('HMGET', KEYS[9], 'refund_policy', 'refund_percent')
+local function refundable(over)
+    if policy[1] == 'none' then
+        return 0
+    elseif policy[1] == 'partial_percent' then
+        return math.floor(over * tonumber(policy[2] or '100') / 100)
+    end
+    return over
+end
+
 local refund = 0
+local withheld = 0
+local shortfall_debt = 0
 
-if consumed > actual_cost then
-    -- We OVERCHARGED during streaming (common case)
-    -- Example: estimated 60k grains, actual was 56k
-    -- Need to refund customer the 4k difference
+if postpaid then
+    -- Settle the debt to the actual cost, whichever way it goes, less
+    -- whatever the refund policy withholds
     refund = consumed - actual_cost
-    redis.call('INCRBY', KEYS[1], refund)
+    if refund > 0 then
+        local over = refund
+        refund = refundable(over)
+        withheld = over - refund
+    end
+    redis.call('DECRBY', KEYS[8], refund)
     balance = balance + refund
+
+elseif consumed > actual_cost then
+    -- We OVERCHARGED during streaming (common case)
+    -- Example: estimated 60k grains, actual was 56k
+    -- Need to refund customer the 4k difference, as far as their refund
+    -- policy allows
+    local over = consumed - actual_cost
+    refund = refundable(over)
+    withheld = over - refund
+    if refund > 0 then
+        redis.call('INCRBY', KEYS[1], refund)
+        return_buckets(KEYS[6], KEYS[3], refund)
+        balance = balance + refund
+    end
     
 elseif actual_cost > consumed then
     -- We UNDERCHARGED during streaming (rare but possible)
@@ -78,48 +183,72 @@ elseif actual_cost > consumed then
     -- Need to deduct the additional 2k from customer
     local additional = actual_cost - consumed
     
-    -- Safety check: Don't allow balance to go negative
-    if balance >= additional then
+    -- Safety check: Don't allow balance to go negative, unless the shortfall
+    -- policy says to
+    if balance >= additional or ARGV[7] == 'negative' then
         redis.call('DECRBY', KEYS[1], additional)
+        draw_buckets(KEYS[6], KEYS[3], additional)
         balance = balance - additional
         refund = -additional  -- Negative refund indicates additional charge
     else
-        -- Balance would go negative. Deduct what we can and log the shortfall.
-        -- This represents a loss for us but prevents customer balance corruption.
-        redis.call('SET', KEYS[1], '0')
-        refund = -balance  -- We could only deduct this much
-        balance = 0
-        
-        -- Mark this as an integrity issue for manual review
-        redis.call('HSET', KEYS[3], 'integrity_issue', 'undercharge_shortfall')
+        -- Balance would go negative. Deduct what we can and handle the
+        -- shortfall as the policy says.
+        -- A balance already below zero (kill grace) is left where it is.
+        local taken = math.max(balance, 0)
+        redis.call('DECRBY', KEYS[1], taken)
+        draw_buckets(KEYS[6], KEYS[3], taken)
+        refund = -taken  -- We could only deduct this much
+        balance = balance - taken
+
+        if ARGV[7] == 'debt' then
+            -- The customer owes the rest
+            shortfall_debt = additional - taken
+            redis.call('INCRBY', KEYS[8], shortfall_debt)
+            redis.call('HSET', KEYS[3], 'shortfall_debt_grains', tostring(shortfall_debt))
+        else
+            -- This represents a loss for us but prevents customer balance
+            -- corruption. Mark this as an integrity issue for manual review
+            redis.call('HSET', KEYS[3], 'integrity_issue', 'undercharge_shortfall')
+        end
     end
 end
 
+-- Every prepaid branch above changed the balance by exactly 'refund'
+if refund ~= 0 and not postpaid then
+    redis.call('INCRBY', KEYS[4], refund)
+end
+
 -- Release the reservation
 -- This frees up the locked grains for new requests
 local current_reserved = tonumber(redis.call('GET', KEYS[2]) or '0')
 
 if current_reserved >= reserved then
     redis.call('DECRBY', KEYS[2], reserved)
+    redis.call('DECRBY', KEYS[5], reserved)
+    release_low(KEYS[7], request['priority'], reserved)
 else
     -- Reserved counter is less than what we're trying to release
     -- This is an integrity error but we handle it gracefully
     -- Set reserved to zero and log the issue
     redis.call('SET', KEYS[2], '0')
+    redis.call('DECRBY', KEYS[5], current_reserved)
+    release_low(KEYS[7], request['priority'], current_reserved)
     redis.call('HSET', KEYS[3], 'integrity_issue', 'reservation_underflow')
 end
 
 -- Update request tracking with final status
 redis.call('HMSET', KEYS[3],
     'status', ARGV[2],
-    'actual_cost_grains', ARGV[1],
+    'actual_cost_grains', tostring(actual_cost),
     'refunded_grains', tostring(refund),
-    'finalized_at', ARGV[3]
+    'withheld_grains', tostring(withheld),
+    'finalized_at', redis.call('TIME')[1]
 )
 
 -- Extend TTL since this is now finalized
--- Keep it around for 24 hours for debugging and analytics
-redis.call('EXPIRE', KEYS[3], 86400)
+-- Keep it around for debugging and analytics, for as long as is configured
+-- for its status (24 hours by default)
+redis.call('EXPIRE', KEYS[3], ARGV[6])
 
--- Return success with refund amount and final balance
-return {1, refund, balance}
\ No newline at end of file
+-- Return success with refund amount, final balance and what was charged
+return {1, refund, balance, '', actual_cost, input_price or '', output_price or '', input_cost, output_cost, withheld, shortfall_debt}
\ No newline at end of file
@@ -0,0 +1,23 @@
+-- priority.lua
+--
+-- Purpose: Helper shared by the scripts that release a reservation
+-- (finalize_request, cancel_request, abandon_request). It is not a script of
+-- its own: the ledger prepends it to each of those scripts.
+--
+-- check_and_reserve records the request's priority (low, normal or high) on
+-- its tracking hash, and counts the grains reserved by low-priority requests
+-- in "customer:reserved_low:{customer_id}", a subset of the reserved counter.
+-- With preemption enabled, a high-priority reservation may be approved
+-- against those grains when the balance alone falls short.
+--
+-- release_low takes a released reservation back off that counter when the
+-- request was low priority. Like the reserved counter, it never goes below
+-- zero.
+
+local function release_low(lkey, priority, amount)
+    if priority ~= 'low' or amount <= 0 then
+        return
+    end
+    local held = tonumber(redis.call('GET', lkey) or '0')
+    redis.call('DECRBY', lkey, math.min(math.max(held, 0), amount))
+end
@@ -0,0 +1,41 @@
+-- request.lua
+--
+-- Purpose: Helper shared by the scripts that read a whole request hash
+-- (finalize_request, cancel_request, abandon_request, upgrade_request). It
+-- is not a script of its own: the ledger prepends it to each of those
+-- scripts.
+--
+-- check_and_reserve records the layout it wrote the request hash in as
+-- schema_version (RequestSchemaVersion in request_schema.go). Hashes without
+-- it are version 1:
+--
+--   1 - priority and billing are only present for low/high priority and
+--       postpaid requests
+--   2 - priority and billing ('prepaid' or 'postpaid') are always present,
+--       plus schema_version
+--
+-- During a rolling deploy old and new scripts share one Redis, so versions
+-- only ever add fields. Old scripts ignore the fields they don't know, and
+-- load_request fills in the ones an older hash lacks, so every script sees
+-- the current layout whichever version created the request.
+--
+-- Returns the hash as a table and the version it was stored at, or nil if
+-- the request doesn't exist.
+
+local function load_request(rkey)
+    local data = redis.call('HGETALL', rkey)
+    if #data == 0 then
+        return nil, 0
+    end
+    local request = {}
+    for i = 1, #data, 2 do
+        request[data[i]] = data[i + 1]
+    end
+    local version = tonumber(request['schema_version'] or '1')
+    if version < 2 then
+        request['priority'] = request['priority'] or 'normal'
+        request['billing'] = request['billing'] or 'prepaid'
+    end
+    request['schema_version'] = '2'
+    return request, version
+end
@@ -0,0 +1,36 @@
+-- reserve_and_deduct.lua
+--
+-- Purpose: Reserve grains for a request and make its first deduction in one
+-- atomic step (ledger.ReserveAndDeduct, the CheckBalanceAndDeduct RPC), so a
+-- client saves a round trip before its stream starts.
+--
+-- This is check_and_reserve.lua and deduct_grains.lua (with buckets.lua
+-- prepended), unchanged, each wrapped in a function by the ledger. The
+-- deduction runs only if the reservation was approved, and sees the request
+-- hash the reservation just created, so the outcome is exactly that of the
+-- two scripts run back to back.
+--
+-- Arguments:
+--   KEYS[1..9]   = check_and_reserve's KEYS
+--   KEYS[10..15] = deduct_grains' KEYS
+--   ARGV[1..15]  = check_and_reserve's ARGV (ARGV[5], dry_run, is always "0")
+--   ARGV[16..20] = deduct_grains' ARGV
+--
+-- Returns:
+--   check_and_reserve's reply, with deduct_grains' reply appended as a
+--   sixth element if the reservation was approved:
+--   {1, new_available, '', new_available, preempted, {deduct_grains reply}}
+
+local function check_and_reserve(KEYS, ARGV)
+    -- check_and_reserve.lua
+end
+
+local function deduct_grains(KEYS, ARGV)
+    -- buckets.lua, deduct_grains.lua
+end
+
+local reservation = check_and_reserve({unpack(KEYS, 1, 9)}, {unpack(ARGV, 1, 15)})
+if reservation[1] == 1 and ARGV[5] ~= '1' then
+    reservation[6] = deduct_grains({unpack(KEYS, 10, 15)}, {unpack(ARGV, 16, 20)})
+end
+return reservation
@@ -0,0 +1,26 @@
+-- upgrade_request.lua
+--
+-- Purpose: Rewrite a request hash created by an older version of the scripts
+-- in the current layout (see request.lua, which is prepended). Run over
+-- every request hash by UpgradeRequestHashes once a deploy has finished, so
+-- no hash of a layout the next version may stop reading is left behind.
+--
+-- Only fields an older layout lacks are written; the TTL is kept.
+--
+-- Arguments:
+--   KEYS[1] = "request:{request_id}"
+--
+-- Returns:
+--   1 if the hash was upgraded, 0 if it was already current or doesn't exist
+
+local request, version = load_request(KEYS[1])
+if not request or version >= tonumber(request['schema_version']) then
+    return 0
+end
+
+redis.call('HSET', KEYS[1],
+    'priority', request['priority'],
+    'billing', request['billing'],
+    'schema_version', request['schema_version']
+)
+return 1
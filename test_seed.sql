@@ -39,8 +39,8 @@ VALUES (
     'tx_initial_test',
     'test_customer_1',
     100000000,
-    'admin_adjustment',
-    'Initial test balance'
+    'opening_balance',
+    'Opening balance'
 )
 ON CONFLICT (transaction_id) DO NOTHING;
 